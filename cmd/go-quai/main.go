@@ -97,6 +97,7 @@ var (
 		utils.NATFlag,
 		utils.NetrestrictFlag,
 		utils.NetworkIdFlag,
+		utils.PermissiveNetworkFlag,
 		utils.NoCompactionFlag,
 		utils.NoDiscoverFlag,
 		utils.NoUSBFlag,
@@ -40,6 +40,7 @@ var AppHelpFlagGroups = []flags.FlagGroup{
 			utils.KeyStoreDirFlag,
 			utils.USBFlag,
 			utils.NetworkIdFlag,
+			utils.PermissiveNetworkFlag,
 			utils.ColosseumFlag,
 			utils.GardenFlag,
 			utils.OrchardFlag,
@@ -139,6 +139,10 @@ var (
 		Usage: "Explicitly set network id (integer)(For testnets: use --garden)",
 		Value: ethconfig.Defaults.NetworkId,
 	}
+	PermissiveNetworkFlag = cli.BoolFlag{
+		Name:  "permissive-network",
+		Usage: "Accept peers on network ids unknown to this binary if their genesis matches (ephemeral testnets only)",
+	}
 	SlicesRunningFlag = cli.StringFlag{
 		Name:  "slices",
 		Usage: "All the slices that are running on this node",
@@ -1472,6 +1476,9 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *ethconfig.Config) {
 	if ctx.GlobalIsSet(NetworkIdFlag.Name) {
 		cfg.NetworkId = ctx.GlobalUint64(NetworkIdFlag.Name)
 	}
+	if ctx.GlobalIsSet(PermissiveNetworkFlag.Name) {
+		cfg.Protocol.PermissiveNetwork = ctx.GlobalBool(PermissiveNetworkFlag.Name)
+	}
 	if ctx.GlobalIsSet(CacheFlag.Name) || ctx.GlobalIsSet(CacheDatabaseFlag.Name) {
 		cfg.DatabaseCache = ctx.GlobalInt(CacheFlag.Name) * ctx.GlobalInt(CacheDatabaseFlag.Name) / 100
 	}
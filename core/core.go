@@ -403,6 +403,12 @@ func (c *Core) GetPendingEtxs(hash common.Hash) *types.PendingEtxs {
 	return rawdb.ReadPendingEtxs(c.sl.sliceDb, hash)
 }
 
+// GetEtxSet retrieves the set of inbound ETXs available for inclusion on top of
+// the given block.
+func (c *Core) GetEtxSet(hash common.Hash, number uint64) types.EtxSet {
+	return rawdb.ReadEtxSet(c.sl.sliceDb, hash, number)
+}
+
 func (c *Core) GetPendingEtxsRollup(hash common.Hash) *types.PendingEtxsRollup {
 	return rawdb.ReadPendingEtxsRollup(c.sl.sliceDb, hash)
 }
@@ -560,6 +566,12 @@ func (c *Core) GetCanonicalHash(number uint64) common.Hash {
 	return c.sl.hc.GetCanonicalHash(number)
 }
 
+// GetHashesByNumber retrieves the hashes of all the headers stored at the given
+// height, canonical or not.
+func (c *Core) GetHashesByNumber(number uint64) []common.Hash {
+	return c.sl.hc.GetHashesByNumber(number)
+}
+
 // GetBlockHashesFromHash retrieves a number of block hashes starting at a given
 // hash, fetching towards the genesis block.
 func (c *Core) GetBlockHashesFromHash(hash common.Hash, max uint64) []common.Hash {
@@ -683,6 +683,12 @@ func (hc *HeaderChain) GetCanonicalHash(number uint64) common.Hash {
 	return hash
 }
 
+// GetHashesByNumber retrieves the hashes of all the headers stored at the given
+// height, canonical or not.
+func (hc *HeaderChain) GetHashesByNumber(number uint64) []common.Hash {
+	return rawdb.ReadAllHashes(hc.headerDb, number)
+}
+
 // CurrentHeader retrieves the current head header of the canonical chain. The
 // header is retrieved from the HeaderChain's internal cache.
 func (hc *HeaderChain) CurrentHeader() *types.Header {
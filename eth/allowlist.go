@@ -0,0 +1,45 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"github.com/dominant-strategies/go-quai/eth/ethconfig"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+)
+
+// newAllowlist creates the classifier of the messages each peer may send from
+// the configured allowlists, nil if there are none. A peer listed more than once
+// may send the messages of all its lists, unlisted ones are unrestricted.
+func newAllowlist(lists []ethconfig.PeerAllowlist) func(peer *eth.Peer) []uint64 {
+	if len(lists) == 0 {
+		return nil
+	}
+	codes := make(map[string][]uint64)
+	for _, list := range lists {
+		for _, id := range list.Peers {
+			// Listed peers are restricted even if their list is empty
+			allowed := codes[id.String()]
+			if allowed == nil {
+				allowed = []uint64{}
+			}
+			codes[id.String()] = append(allowed, list.Messages...)
+		}
+	}
+	return func(peer *eth.Peer) []uint64 {
+		return codes[peer.ID()]
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/eth/ethconfig"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// Tests that the configured allowlists restrict the listed peers to the union of
+// their lists, leaving the other peers unrestricted.
+func TestAllowlistConfig(t *testing.T) {
+	if newAllowlist(nil) != nil {
+		t.Fatalf("classifier created without allowlists")
+	}
+	var (
+		relay   = enode.ID{0xab, 0x01}
+		both    = enode.ID{0xab, 0x02}
+		muted   = enode.ID{0xab, 0x03}
+		regular = enode.ID{0xab, 0x04}
+	)
+	allowlist := newAllowlist([]ethconfig.PeerAllowlist{
+		{Peers: []enode.ID{relay, both}, Messages: []uint64{eth.TransactionsMsg}},
+		{Peers: []enode.ID{both}, Messages: []uint64{eth.NewBlockHashesMsg}},
+		{Peers: []enode.ID{muted}},
+	})
+	tests := []struct {
+		id   enode.ID
+		want []uint64
+	}{
+		{relay, []uint64{eth.TransactionsMsg}},
+		{both, []uint64{eth.TransactionsMsg, eth.NewBlockHashesMsg}},
+		{muted, []uint64{}},
+		{regular, nil},
+	}
+	for i, tt := range tests {
+		peer := eth.NewPeer(eth.ETH66, p2p.NewPeer(tt.id, "peer", nil), nil, nil)
+		if have := allowlist(peer); !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("test %d: allowlist mismatch: have %v, want %v", i, have, tt.want)
+		}
+		peer.Close()
+	}
+}
@@ -33,6 +33,7 @@ import (
 	"github.com/dominant-strategies/go-quai/core/rawdb"
 	"github.com/dominant-strategies/go-quai/core/state"
 	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
 	"github.com/dominant-strategies/go-quai/internal/quaiapi"
 	"github.com/dominant-strategies/go-quai/rlp"
 	"github.com/dominant-strategies/go-quai/rpc"
@@ -293,6 +294,215 @@ func (api *PrivateDebugAPI) Preimage(ctx context.Context, hash common.Hash) (hex
 	return nil, errors.New("unknown preimage")
 }
 
+// fetchTimeout is the time a debug fetch waits for the peer to reply.
+const fetchTimeout = 10 * time.Second
+
+// FetchBlockBody retrieves a fresh copy of a block body from the given peer,
+// ignoring any local copy, to help diagnosing data corruption. The size of the
+// local copy, if any, decides whether the peer is probed for the block first.
+func (api *PrivateDebugAPI) FetchBlockBody(ctx context.Context, peer string, hash common.Hash) (*eth.BlockBody, error) {
+	var size common.StorageSize
+	if block := api.eth.Core().GetBlockByHash(hash); block != nil {
+		size = block.Size()
+	}
+	return api.eth.handler.fetchBody(peer, hash, size, fetchTimeout)
+}
+
+// FetchBlockTxHashes retrieves the ordered transaction hashes of a block from
+// the given peer, to compare its view of the block against the local one.
+func (api *PrivateDebugAPI) FetchBlockTxHashes(ctx context.Context, peer string, hash common.Hash) ([]common.Hash, error) {
+	p, err := api.eth.handler.fetchPeer(peer)
+	if err != nil {
+		return nil, err
+	}
+	return p.FetchBlockTxHashes(hash, fetchTimeout)
+}
+
+// FetchHeadersByNumbers retrieves the canonical headers at a set of ascending
+// block numbers from the given peer, to spot check its chain.
+func (api *PrivateDebugAPI) FetchHeadersByNumbers(ctx context.Context, peer string, numbers []uint64) ([]*types.Header, error) {
+	p, err := api.eth.handler.fetchPeer(peer)
+	if err != nil {
+		return nil, err
+	}
+	return p.FetchHeadersByNumbers(numbers, fetchTimeout)
+}
+
+// FetchPendingEtxsByLocation retrieves a page of the ETXs the given peer holds
+// pending inclusion in a location, continuing after the cursor of the previous
+// page, to compare its pending set against the local one.
+func (api *PrivateDebugAPI) FetchPendingEtxsByLocation(ctx context.Context, peer string, location common.Location, cursor common.Hash) (*eth.PendingEtxsByLocationPacket, error) {
+	p, err := api.eth.handler.fetchPeer(peer)
+	if err != nil {
+		return nil, err
+	}
+	return p.FetchPendingEtxsByLocation(location, cursor, fetchTimeout)
+}
+
+// FetchBlockEtxRoots retrieves the ETX roots of a range of blocks from the given
+// peer, to verify ETX proofs against them.
+func (api *PrivateDebugAPI) FetchBlockEtxRoots(ctx context.Context, peer string, origin uint64, amount int, skip uint64, reverse bool) ([]eth.BlockEtxRoot, error) {
+	p, err := api.eth.handler.fetchPeer(peer)
+	if err != nil {
+		return nil, err
+	}
+	return p.FetchBlockEtxRoots(origin, amount, skip, reverse, fetchTimeout)
+}
+
+// FetchFreshBodies retrieves the bodies of a batch of blocks from the given peer,
+// which skips the ones not on the chain leading to the given head, to check which
+// of them the peer considers stale.
+func (api *PrivateDebugAPI) FetchFreshBodies(ctx context.Context, peer string, head common.Hash, number uint64, hashes []common.Hash) (*eth.FreshBlockBodiesPacket, error) {
+	p, err := api.eth.handler.fetchPeer(peer)
+	if err != nil {
+		return nil, err
+	}
+	return p.FetchFreshBodies(head, number, hashes, fetchTimeout)
+}
+
+// FetchBlockMiners retrieves the miners of a range of consecutive blocks from the
+// given peer, to audit block rewards without downloading the full headers.
+func (api *PrivateDebugAPI) FetchBlockMiners(ctx context.Context, peer string, origin uint64, amount int, dom bool) ([]eth.BlockMiner, error) {
+	p, err := api.eth.handler.fetchPeer(peer)
+	if err != nil {
+		return nil, err
+	}
+	return p.FetchBlockMiners(origin, amount, dom, fetchTimeout)
+}
+
+// FetchUnclesByRange retrieves the uncles referenced by a range of consecutive
+// blocks from the given peer, to audit uncle rewards.
+func (api *PrivateDebugAPI) FetchUnclesByRange(ctx context.Context, peer string, origin uint64, amount int, dom bool) ([]eth.BlockUncles, error) {
+	p, err := api.eth.handler.fetchPeer(peer)
+	if err != nil {
+		return nil, err
+	}
+	return p.FetchUnclesByRange(origin, amount, dom, fetchTimeout)
+}
+
+// FetchBlockData retrieves the headers and the bodies of a range of consecutive
+// blocks from the given peer, in a single round trip if it runs eth/67, to check
+// the data it serves to syncing nodes.
+func (api *PrivateDebugAPI) FetchBlockData(ctx context.Context, peer string, origin uint64, amount int, dom bool) (*eth.BlockDataPacket, error) {
+	p, err := api.eth.handler.fetchPeer(peer)
+	if err != nil {
+		return nil, err
+	}
+	return p.FetchBlockData(origin, amount, dom, fetchTimeout)
+}
+
+// FetchBlockByNumber retrieves the canonical block at the given number from the
+// given peer, to compare its chain against the local one. Nil is returned if the
+// peer doesn't know the block.
+func (api *PrivateDebugAPI) FetchBlockByNumber(ctx context.Context, peer string, location common.Location, number uint64) (map[string]interface{}, error) {
+	p, err := api.eth.handler.fetchPeer(peer)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.FetchBlockByNumber(location, number, fetchTimeout)
+	if err != nil || res.Block == nil {
+		return nil, err
+	}
+	return quaiapi.RPCMarshalBlock(res.Block, true, true)
+}
+
+// FetchEtxManifestProof retrieves from the given peer the proof that a block of
+// the source shard at the given location was rolled up into a dominant block, to
+// check ETX inclusion disputes.
+func (api *PrivateDebugAPI) FetchEtxManifestProof(ctx context.Context, peer string, hash common.Hash, location common.Location, subHash common.Hash) (*eth.EtxManifestProofPacket, error) {
+	p, err := api.eth.handler.fetchPeer(peer)
+	if err != nil {
+		return nil, err
+	}
+	return p.FetchEtxManifestProof(hash, location, subHash, fetchTimeout)
+}
+
+// FetchCanonicalHash retrieves the hash of the canonical block at the given
+// number from the given peer, to check whether a local block is still canonical
+// in its view. The zero hash is returned if the peer doesn't know the block.
+func (api *PrivateDebugAPI) FetchCanonicalHash(ctx context.Context, peer string, location common.Location, number uint64) (common.Hash, error) {
+	p, err := api.eth.handler.fetchPeer(peer)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	res, err := p.FetchCanonicalHash(location, number, fetchTimeout)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return res.Hash, nil
+}
+
+// FetchPendingEtxsSince retrieves a page of the ETXs the given peer holds pending
+// inclusion in a location which were created after the given block, continuing
+// after the cursor of the previous page, to recover the ETXs missed while offline.
+func (api *PrivateDebugAPI) FetchPendingEtxsSince(ctx context.Context, peer string, location common.Location, since common.Hash, cursor common.Hash) (*eth.PendingEtxsSincePacket, error) {
+	p, err := api.eth.handler.fetchPeer(peer)
+	if err != nil {
+		return nil, err
+	}
+	return p.FetchPendingEtxsSince(location, since, cursor, fetchTimeout)
+}
+
+// FetchPartialBodies retrieves the bodies of a batch of blocks from the given
+// peer, reduced to the given fields, the others being left empty.
+func (api *PrivateDebugAPI) FetchPartialBodies(ctx context.Context, peer string, fields eth.BodyField, hashes []common.Hash) ([]*eth.BlockBody, error) {
+	p, err := api.eth.handler.fetchPeer(peer)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.FetchPartialBodies(fields, hashes, fetchTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return res.Unpack()
+}
+
+// FetchHeadersByMiner retrieves from the given peer the headers mined by any of
+// the given addresses within a range of canonical blocks starting at the origin,
+// to audit the blocks credited to a mining pool.
+func (api *PrivateDebugAPI) FetchHeadersByMiner(ctx context.Context, peer string, origin uint64, amount uint64, dom bool, miners []common.Address) (*eth.HeadersByMinerPacket, error) {
+	p, err := api.eth.handler.fetchPeer(peer)
+	if err != nil {
+		return nil, err
+	}
+	return p.FetchHeadersByMiner(eth.HashOrNumber{Number: origin}, amount, dom, miners, fetchTimeout)
+}
+
+// FetchTxNonInclusionProof retrieves from the given peer the proof that a
+// transaction is not part of a block, verified against the local header of the
+// block, to settle whether a transaction was censored.
+func (api *PrivateDebugAPI) FetchTxNonInclusionProof(ctx context.Context, peer string, hash common.Hash, txHash common.Hash) (*eth.TxNonInclusionProofPacket, error) {
+	header := api.eth.Core().GetHeaderByHash(hash)
+	if header == nil {
+		return nil, fmt.Errorf("block %x not found", hash)
+	}
+	p, err := api.eth.handler.fetchPeer(peer)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := p.FetchTxNonInclusionProof(hash, txHash, fetchTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := eth.VerifyTxNonInclusionProof(header, txHash, proof); err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+// PeerStatuses returns the statuses the connected peers advertised in their
+// handshakes, to help diagnosing chain splits.
+func (api *PrivateDebugAPI) PeerStatuses() []*PeerStatus {
+	return api.eth.handler.peers.statuses()
+}
+
+// SyncProgress returns, for each slice run by the node, how far the local chain
+// is behind the peers running the slice, to help following the sync of nodes
+// bridging multiple shards.
+func (api *PrivateDebugAPI) SyncProgress() []*LocationProgress {
+	return api.eth.handler.peers.progress(api.eth.handler.slicesRunning, api.eth.handler.downloader.HeadEntropy())
+}
+
 // BadBlockArgs represents the entries in the list returned when bad blocks are queried.
 type BadBlockArgs struct {
 	Hash  common.Hash            `json:"hash"`
@@ -122,6 +122,9 @@ func New(stack *node.Node, config *ethconfig.Config) (*Quai, error) {
 	if err := pruner.RecoverPruning(stack.ResolvePath(""), chainDb, stack.ResolvePath(config.TrieCleanCacheJournal)); err != nil {
 		log.Error("Failed to recover state", "error", err)
 	}
+	// Advertise the node software to the `eth` peers
+	config.Protocol.ClientVersion = stack.Config().NodeName()
+
 	eth := &Quai{
 		config:            config,
 		chainDb:           chainDb,
@@ -207,6 +210,19 @@ func New(stack *node.Node, config *ethconfig.Config) (*Quai, error) {
 		EventMux:      eth.eventMux,
 		Whitelist:     config.Whitelist,
 		SlicesRunning: config.SlicesRunning,
+		NodeID:        enode.PubkeyToIDV4(&stack.Server().PrivateKey.PublicKey),
+		Archive:       config.NoPruning,
+
+		MinPeersPerLocation: config.MinPeersPerLocation,
+		MaxPeersPerLocation: config.MaxPeersPerLocation,
+		PinnedPeers:         config.PinnedPeers,
+		Allowlist:           newAllowlist(config.PeerAllowlists),
+
+		MaxPendingHandshakes: config.MaxPendingHandshakes,
+		Protocol:             &config.Protocol,
+
+		TxFetcher:  config.TxFetcher,
+		Quarantine: config.Quarantine,
 	}); err != nil {
 		return nil, err
 	}
@@ -227,6 +243,7 @@ func New(stack *node.Node, config *ethconfig.Config) (*Quai, error) {
 	if err != nil {
 		return nil, err
 	}
+	eth.ethDialCandidates = enode.Filter(eth.ethDialCandidates, eth.handler.quarantine.admits)
 
 	// Start the RPC service
 	eth.netRPCService = quaiapi.NewPublicNetAPI(eth.p2pServer, config.NetworkId)
@@ -370,10 +387,27 @@ func (s *Quai) Synced() bool                       { return atomic.LoadUint32(&s
 func (s *Quai) ArchiveMode() bool                  { return s.config.NoPruning }
 func (s *Quai) BloomIndexer() *core.ChainIndexer   { return s.bloomIndexer }
 
+// LocationPeerCounts returns the number of connected peers running each slice.
+func (s *Quai) LocationPeerCounts() map[string]int { return s.handler.peers.locationCounts() }
+
+// SubscribePeerEvents registers a subscription for the lifecycle events of the
+// `eth` peers. Slow subscribers miss the events arriving while their channel is
+// full, so the channel should be buffered.
+func (s *Quai) SubscribePeerEvents(ch chan<- PeerEvent) event.Subscription {
+	return s.handler.SubscribePeerEvents(ch)
+}
+
+// SetBroadcastMirror installs a sink receiving copies of the block and transaction
+// broadcasts made to the peers, or stops the mirroring if nil. Copies are dropped
+// rather than delaying the broadcasts if the sink lags behind.
+func (s *Quai) SetBroadcastMirror(sink BroadcastSink) {
+	s.handler.SetBroadcastMirror(sink)
+}
+
 // Protocols returns all the currently configured
 // network protocols to start.
 func (s *Quai) Protocols() []p2p.Protocol {
-	protos := eth.MakeProtocols((*ethHandler)(s.handler), s.networkID, s.ethDialCandidates)
+	protos := eth.MakeProtocols((*ethHandler)(s.handler), s.networkID, s.handler.protocol, s.ethDialCandidates)
 	return protos
 }
 
@@ -0,0 +1,132 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+)
+
+// broadcastMirrorBuffer is the number of mirrored broadcasts queued for a slow
+// sink before further ones are dropped.
+const broadcastMirrorBuffer = 256
+
+// MirroredBroadcast is a copy of a block or transaction broadcast made to the
+// `eth` peers.
+type MirroredBroadcast struct {
+	Time   time.Time     // When the broadcast was made
+	Code   uint64        // Message code of the broadcast (NewBlockMsg, NewBlockHashesMsg, TransactionsMsg or NewPooledTransactionHashesMsg)
+	Peers  int           // Number of peers the broadcast was sent to
+	Block  *types.Block  // Block propagated or announced, nil for transactions
+	Hashes []common.Hash // Transactions sent or announced, nil for blocks
+}
+
+// BroadcastSink receives the copies of the broadcasts made by the node, e.g. to
+// feed an external monitoring service. Mirrored broadcasts are delivered from a
+// single goroutine, in the order they were made, and must not be modified.
+type BroadcastSink interface {
+	MirrorBroadcast(b *MirroredBroadcast)
+}
+
+// broadcastMirror delivers copies of the broadcasts to a sink without ever
+// blocking the broadcasters. Copies are dropped while the sink lags behind by
+// more than broadcastMirrorBuffer broadcasts.
+type broadcastMirror struct {
+	sink    BroadcastSink
+	queue   chan *MirroredBroadcast
+	quit    chan struct{}
+	dropped uint64 // Number of broadcasts dropped due to a slow sink (atomic)
+}
+
+// newBroadcastMirror creates a mirror delivering into sink until stopped.
+func newBroadcastMirror(sink BroadcastSink) *broadcastMirror {
+	m := &broadcastMirror{
+		sink:  sink,
+		queue: make(chan *MirroredBroadcast, broadcastMirrorBuffer),
+		quit:  make(chan struct{}),
+	}
+	go m.loop()
+	return m
+}
+
+// loop delivers the queued broadcasts to the sink until the mirror is stopped.
+func (m *broadcastMirror) loop() {
+	for {
+		select {
+		case b := <-m.queue:
+			m.sink.MirrorBroadcast(b)
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// mirror queues a copy of a broadcast for the sink, dropping it if the queue is
+// full.
+func (m *broadcastMirror) mirror(b *MirroredBroadcast) {
+	select {
+	case m.queue <- b:
+	default:
+		atomic.AddUint64(&m.dropped, 1)
+	}
+}
+
+// stop terminates the delivery to the sink. Queued broadcasts are discarded.
+func (m *broadcastMirror) stop() {
+	close(m.quit)
+}
+
+// SetBroadcastMirror installs a sink receiving copies of all the block and
+// transaction broadcasts made from now on, replacing any previous one. A nil
+// sink stops the mirroring.
+func (h *handler) SetBroadcastMirror(sink BroadcastSink) {
+	var mirror *broadcastMirror
+	if sink != nil {
+		mirror = newBroadcastMirror(sink)
+	}
+	h.mirrorLock.Lock()
+	old := h.mirror
+	h.mirror = mirror
+	h.mirrorLock.Unlock()
+
+	if old != nil {
+		old.stop()
+	}
+}
+
+// mirrorBroadcast copies a broadcast sent to the given number of peers to the
+// installed sink, if any. Broadcasts reaching no peers are not mirrored.
+func (h *handler) mirrorBroadcast(code uint64, peers int, block *types.Block, hashes []common.Hash) {
+	if peers == 0 {
+		return
+	}
+	h.mirrorLock.RLock()
+	defer h.mirrorLock.RUnlock()
+
+	if h.mirror != nil {
+		h.mirror.mirror(&MirroredBroadcast{
+			Time:   time.Now(),
+			Code:   code,
+			Peers:  peers,
+			Block:  block,
+			Hashes: hashes,
+		})
+	}
+}
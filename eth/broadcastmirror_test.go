@@ -0,0 +1,323 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/common/mclock"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// mirrorTestSink is a broadcast sink collecting the mirrored broadcasts.
+type mirrorTestSink struct {
+	block  chan struct{} // Blocks the deliveries until closed, nil to never block
+	copies []*MirroredBroadcast
+	lock   sync.Mutex
+}
+
+func (s *mirrorTestSink) MirrorBroadcast(b *MirroredBroadcast) {
+	if s.block != nil {
+		<-s.block
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.copies = append(s.copies, b)
+}
+
+// mirrored returns the broadcasts of the given code mirrored so far.
+func (s *mirrorTestSink) mirrored(code uint64) []*MirroredBroadcast {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var copies []*MirroredBroadcast
+	for _, b := range s.copies {
+		if b.Code == code {
+			copies = append(copies, b)
+		}
+	}
+	return copies
+}
+
+// mirrorTestPool is a transaction pool serving the transactions broadcast.
+type mirrorTestPool map[common.Hash]*types.Transaction
+
+func (p mirrorTestPool) Get(hash common.Hash) *types.Transaction { return p[hash] }
+
+// mirrorTestPeers tracks what the remote ends of a handler's peers receive.
+type mirrorTestPeers struct {
+	lock     sync.Mutex
+	received map[uint64]map[int]map[common.Hash]bool // Hashes received by each peer, per message code
+}
+
+// receive consumes the broadcasts sent to a peer.
+func (p *mirrorTestPeers) receive(peer int, rw p2p.MsgReadWriter) {
+	for {
+		msg, err := rw.ReadMsg()
+		if err != nil {
+			return
+		}
+		var hashes []common.Hash
+		switch msg.Code {
+		case eth.NewBlockMsg:
+			packet := new(eth.NewBlockPacket)
+			if err := msg.Decode(packet); err != nil {
+				return
+			}
+			hashes = append(hashes, packet.Block.Hash())
+		case eth.TransactionsMsg:
+			var txs eth.TransactionsPacket
+			if err := msg.Decode(&txs); err != nil {
+				return
+			}
+			for _, tx := range txs {
+				hashes = append(hashes, tx.Hash())
+			}
+		case eth.NewPooledTransactionHashesMsg:
+			if err := msg.Decode(&hashes); err != nil {
+				return
+			}
+		default:
+			msg.Discard()
+			continue
+		}
+		p.lock.Lock()
+		if p.received[msg.Code] == nil {
+			p.received[msg.Code] = make(map[int]map[common.Hash]bool)
+		}
+		if p.received[msg.Code][peer] == nil {
+			p.received[msg.Code][peer] = make(map[common.Hash]bool)
+		}
+		for _, hash := range hashes {
+			p.received[msg.Code][peer][hash] = true
+		}
+		p.lock.Unlock()
+	}
+}
+
+// summary returns the number of peers which received broadcasts of a code, and
+// the hashes broadcast to any of them.
+func (p *mirrorTestPeers) summary(code uint64) (int, map[common.Hash]bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	hashes := make(map[common.Hash]bool)
+	for _, received := range p.received[code] {
+		for hash := range received {
+			hashes[hash] = true
+		}
+	}
+	return len(p.received[code]), hashes
+}
+
+// newMirrorTestHandler creates a handler connected to the given number of peers,
+// whose remote ends record the broadcasts they receive. The peers serve the
+// transactions of the given pool.
+func newMirrorTestHandler(t *testing.T, peers int, txpool mirrorTestPool) (*handler, *mirrorTestPeers) {
+	var (
+		h = &handler{
+			peers:            newPeerSet(),
+			propagatedBlocks: newPropagationFilter(maxPropagatedBlocks, 0, mclock.System{}),
+			propagatedTxs:    newPropagationFilter(maxPropagatedTxs, propagatedTxLifetime, mclock.System{}),
+		}
+		remotes = &mirrorTestPeers{received: make(map[uint64]map[int]map[common.Hash]bool)}
+	)
+	for i := 0; i < peers; i++ {
+		connectMirrorTestPeer(t, h, remotes, i, txpool)
+	}
+	return h, remotes
+}
+
+// connectMirrorTestPeer connects a new peer to the handler, whose remote end
+// records the broadcasts it receives as the i-th peer.
+func connectMirrorTestPeer(t *testing.T, h *handler, remotes *mirrorTestPeers, i int, txpool mirrorTestPool) {
+	t.Helper()
+
+	var (
+		zone   = common.Location{0, 0}
+		status = &eth.StatusPacket{
+			ProtocolVersion: eth.ETH66,
+			NetworkID:       1,
+			Location:        zone.Name(),
+			SlicesRunning:   []common.Location{zone},
+			Entropy:         big.NewInt(1),
+		}
+	)
+	app, net := p2p.MsgPipe()
+	t.Cleanup(func() { app.Close(); net.Close() })
+
+	var (
+		local  = eth.NewPeer(eth.ETH66, p2p.NewPeer(enode.ID{0xe8, byte(i)}, "peer", nil), net, txpool)
+		remote = eth.NewPeer(eth.ETH66, p2p.NewPeer(enode.ID{0xe8, byte(i), 0x01}, "peer", nil), app, nil)
+		errc   = make(chan error, 2)
+	)
+	t.Cleanup(local.Close)
+	t.Cleanup(remote.Close)
+
+	go func() { errc <- local.Handshake(enode.ID{0xe9, 0x01}, status) }()
+	go func() { errc <- remote.Handshake(enode.ID{0xe9, byte(i)}, status) }()
+	for k := 0; k < 2; k++ {
+		if err := <-errc; err != nil {
+			t.Fatalf("peer %d: failed to handshake: %v", i, err)
+		}
+	}
+	if err := h.peers.registerPeer(local); err != nil {
+		t.Fatalf("peer %d: failed to register: %v", i, err)
+	}
+	go remotes.receive(i, app)
+}
+
+// Tests that the block and transaction broadcasts mirrored to the sink match the
+// ones actually sent to the peers.
+func TestBroadcastMirror(t *testing.T) {
+	txpool := make(mirrorTestPool)
+	h, remotes := newMirrorTestHandler(t, 5, txpool)
+
+	sink := new(mirrorTestSink)
+	h.SetBroadcastMirror(sink)
+	defer h.SetBroadcastMirror(nil)
+
+	// Propagate a block and broadcast a batch of transactions
+	header := types.EmptyHeader()
+	header.SetNumber(big.NewInt(1))
+	block := types.NewBlockWithHeader(header)
+
+	txs := make(types.Transactions, 3)
+	for i := range txs {
+		txs[i] = types.NewTx(&types.InternalTx{ChainID: big.NewInt(1), Nonce: uint64(i), GasTipCap: big.NewInt(1), GasFeeCap: big.NewInt(1), Value: big.NewInt(1)})
+	}
+	for _, tx := range txs {
+		txpool[tx.Hash()] = tx
+	}
+
+	start := time.Now()
+	h.propagateBlock(block, nil)
+	h.BroadcastTransactions(txs)
+
+	// Every broadcast kind is sent to some peers, wait for them all to arrive
+	codes := []uint64{eth.NewBlockMsg, eth.TransactionsMsg, eth.NewPooledTransactionHashesMsg}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		done := true
+		for _, code := range codes {
+			peers, _ := remotes.summary(code)
+			if len(sink.mirrored(code)) != 1 || peers != sink.mirrored(code)[0].Peers {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("broadcasts not delivered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond) // Catch any broadcast delivered late
+
+	for _, code := range codes {
+		copies := sink.mirrored(code)
+		if len(copies) != 1 {
+			t.Fatalf("code %#x: mirrored broadcast count mismatch: have %d, want 1", code, len(copies))
+		}
+		mirrored := copies[0]
+		if mirrored.Time.Before(start) || mirrored.Time.After(time.Now()) {
+			t.Errorf("code %#x: mirror time %v out of range", code, mirrored.Time)
+		}
+		peers, hashes := remotes.summary(code)
+		if mirrored.Peers != peers {
+			t.Errorf("code %#x: target peer count mismatch: have %d, want %d", code, mirrored.Peers, peers)
+		}
+		have := make(map[common.Hash]bool)
+		if mirrored.Block != nil {
+			have[mirrored.Block.Hash()] = true
+		}
+		for _, hash := range mirrored.Hashes {
+			have[hash] = true
+		}
+		if len(have) != len(hashes) {
+			t.Errorf("code %#x: mirrored hash count mismatch: have %d, want %d", code, len(have), len(hashes))
+		}
+		for hash := range hashes {
+			if !have[hash] {
+				t.Errorf("code %#x: broadcast of %x not mirrored", code, hash)
+			}
+		}
+	}
+	if peers, _ := remotes.summary(eth.NewBlockMsg); peers != 5 {
+		t.Errorf("block propagated to %d peers, want 5", peers)
+	}
+	// Nothing is mirrored once the sink is removed
+	h.SetBroadcastMirror(nil)
+
+	header = types.EmptyHeader()
+	header.SetNumber(big.NewInt(2))
+	h.propagateBlock(types.NewBlockWithHeader(header), nil)
+
+	time.Sleep(50 * time.Millisecond)
+	if copies := sink.mirrored(eth.NewBlockMsg); len(copies) != 1 {
+		t.Errorf("mirrored broadcast count after removal mismatch: have %d, want 1", len(copies))
+	}
+}
+
+// Tests that a stalled sink doesn't block the broadcasts, the copies it can't
+// keep up with being dropped instead.
+func TestBroadcastMirrorStalledSink(t *testing.T) {
+	h, _ := newMirrorTestHandler(t, 1, nil)
+
+	sink := &mirrorTestSink{block: make(chan struct{})}
+	h.SetBroadcastMirror(sink)
+	defer h.SetBroadcastMirror(nil)
+
+	propagate := func(number int64) {
+		header := types.EmptyHeader()
+		header.SetNumber(big.NewInt(number))
+		h.propagateBlock(types.NewBlockWithHeader(header), nil)
+	}
+	// Stall the sink on a first copy
+	mirror := h.mirror
+	propagate(1)
+	for len(mirror.queue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i < 2*broadcastMirrorBuffer; i++ {
+			propagate(int64(i + 1))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("broadcasts blocked by stalled sink")
+	}
+	// One copy is held by the sink, a buffer full is queued, the rest is dropped
+	if dropped := atomic.LoadUint64(&mirror.dropped); dropped != broadcastMirrorBuffer-1 {
+		t.Errorf("dropped copy count mismatch: have %d, want %d", dropped, broadcastMirrorBuffer-1)
+	}
+	close(sink.block)
+}
@@ -0,0 +1,226 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package downloader
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/crypto"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+	"github.com/dominant-strategies/go-quai/log"
+	"github.com/dominant-strategies/go-quai/trie"
+)
+
+// newBodyTxs creates n signed transactions to fill block bodies with.
+func newBodyTxs(t *testing.T, n int) []*types.Transaction {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	signer := types.NewSigner(big.NewInt(1))
+
+	txs := make([]*types.Transaction, n)
+	for i := range txs {
+		tx, err := types.SignNewTx(key, signer, &types.InternalTx{
+			ChainID:   big.NewInt(1),
+			Nonce:     uint64(i),
+			GasTipCap: big.NewInt(1),
+			GasFeeCap: big.NewInt(1),
+			Gas:       21000,
+			Value:     big.NewInt(1),
+		})
+		if err != nil {
+			t.Fatalf("failed to sign transaction: %v", err)
+		}
+		txs[i] = tx
+	}
+	return txs
+}
+
+// Tests that delivered bodies are checked against the transaction and ETX roots
+// of the requested headers, rejecting tampered ones while accepting the valid
+// bodies delivered before them.
+func TestBodyRootValidation(t *testing.T) {
+	defer func(old common.Location) { common.NodeLocation = old }(common.NodeLocation)
+	common.NodeLocation = common.Location{0, 0}
+
+	txs := newBodyTxs(t, 6)
+	bodies := [][]*types.Transaction{txs[:3], txs[3:]}
+
+	headers := newBodyHeaders(bodies)
+
+	tests := []struct {
+		txs      [][]*types.Transaction
+		etxs     [][]*types.Transaction
+		accepted int
+		err      error
+	}{
+		// Bodies matching the headers
+		{[][]*types.Transaction{txs[:3], txs[3:]}, nil, 2, nil},
+
+		// Transaction sets dropping, adding or reordering transactions
+		{[][]*types.Transaction{txs[:2], txs[3:]}, nil, 0, errInvalidBody},
+		{[][]*types.Transaction{txs[:3], txs[2:]}, nil, 1, errInvalidBody},
+		{[][]*types.Transaction{{txs[1], txs[0], txs[2]}, txs[3:]}, nil, 0, errInvalidBody},
+
+		// External transactions smuggled into the bodies
+		{[][]*types.Transaction{txs[:3], txs[3:]}, [][]*types.Transaction{nil, txs[:1]}, 1, errInvalidBody},
+	}
+	for i, tt := range tests {
+		q := newQueue(10, 10)
+		q.Prepare(0, FullSync)
+		q.Schedule(headers)
+
+		peer := &peerConnection{id: "peer"}
+		if request, _, _ := q.ReserveBodies(peer, len(headers)); request == nil || len(request.Headers) != len(headers) {
+			t.Fatalf("test %d: failed to reserve bodies: %v", i, request)
+		}
+		etxs := tt.etxs
+		if etxs == nil {
+			etxs = make([][]*types.Transaction, len(tt.txs))
+		}
+		accepted, err := q.DeliverBodies(peer.id, tt.txs, make([][]*types.Header, len(tt.txs)), etxs, make([]types.BlockManifest, len(tt.txs)))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if accepted != tt.accepted {
+			t.Errorf("test %d: accepted bodies mismatch: have %d, want %d", i, accepted, tt.accepted)
+		}
+	}
+}
+
+// newBodyHeaders creates a chain of headers committing to the given bodies.
+func newBodyHeaders(bodies [][]*types.Transaction) []*types.Header {
+	headers := make([]*types.Header, len(bodies))
+	for i, body := range bodies {
+		headers[i] = types.EmptyHeader()
+		headers[i].SetNumber(big.NewInt(int64(i + 1)))
+		headers[i].SetTxHash(types.DeriveSha(types.Transactions(body), trie.NewStackTrie(nil)))
+		if i > 0 {
+			headers[i].SetParentHash(headers[i-1].Hash())
+		}
+	}
+	return headers
+}
+
+// Tests that bodies delivered as block data are only accepted up to the first
+// header not matching the requested one, the rest being left to other peers
+// without the peer being treated as malicious.
+func TestDeliverBlockData(t *testing.T) {
+	defer func(old common.Location) { common.NodeLocation = old }(common.NodeLocation)
+	common.NodeLocation = common.Location{0, 0}
+
+	txs := newBodyTxs(t, 6)
+	bodies := [][]*types.Transaction{txs[:2], txs[2:4], txs[4:]}
+	headers := newBodyHeaders(bodies)
+
+	fork := types.CopyHeader(headers[1])
+	fork.SetParentHash(common.Hash{0x01})
+
+	tests := []struct {
+		headers  []*types.Header
+		accepted int
+		lacking  []int
+	}{
+		// Bodies retrieved by hash or with the requested headers
+		{nil, 3, nil},
+		{headers, 3, nil},
+
+		// Bodies from a peer whose chain diverges from the requested one
+		{[]*types.Header{headers[0], fork, headers[2]}, 1, []int{1, 2}},
+	}
+	for i, tt := range tests {
+		q := newQueue(10, 10)
+		q.Prepare(0, FullSync)
+		q.Schedule(headers)
+
+		peer := newPeerConnection("peer", eth.ETH67, nil, log.Log)
+		if request, _, _ := q.ReserveBodies(peer, len(headers)); request == nil || len(request.Headers) != len(headers) {
+			t.Fatalf("test %d: failed to reserve bodies: %v", i, request)
+		}
+		accepted, err := q.DeliverBlockData(peer.id, tt.headers, bodies, make([][]*types.Header, len(bodies)), make([][]*types.Transaction, len(bodies)), make([]types.BlockManifest, len(bodies)))
+		if err != nil {
+			t.Errorf("test %d: failed to deliver block data: %v", i, err)
+		}
+		if accepted != tt.accepted {
+			t.Errorf("test %d: accepted bodies mismatch: have %d, want %d", i, accepted, tt.accepted)
+		}
+		lacking := make(map[int]bool)
+		for _, index := range tt.lacking {
+			lacking[index] = true
+		}
+		for j, header := range headers {
+			if peer.Lacks(header.Hash()) != lacking[j] {
+				t.Errorf("test %d, block %d: lacking mismatch: have %v, want %v", i, j, peer.Lacks(header.Hash()), lacking[j])
+			}
+		}
+	}
+}
+
+// blockDataTestPeer is a download peer recording the body retrievals it's asked
+// for, either by hash or as block data.
+type blockDataTestPeer struct {
+	retryTestPeer
+	requests chan string
+}
+
+func (p *blockDataTestPeer) RequestBodies(hashes []common.Hash) error {
+	p.requests <- "bodies"
+	return nil
+}
+
+func (p *blockDataTestPeer) RequestBlockData(origin uint64, amount int, dom bool) error {
+	p.requests <- "blockdata"
+	return nil
+}
+
+// Tests that body retrievals from eth/67 peers are sent as block data requests
+// for contiguous runs of blocks, and by hash otherwise.
+func TestFetchBodiesBlockData(t *testing.T) {
+	headers := newBodyHeaders(make([][]*types.Transaction, 3))
+
+	tests := []struct {
+		version uint
+		headers []*types.Header
+		want    string
+	}{
+		{eth.ETH67, headers, "blockdata"},
+		{eth.ETH67, []*types.Header{headers[0], headers[2]}, "bodies"},
+		{eth.ETH66, headers, "bodies"},
+	}
+	for i, tt := range tests {
+		peer := &blockDataTestPeer{requests: make(chan string, 1)}
+		conn := newPeerConnection("peer", tt.version, peer, log.Log)
+
+		if err := conn.FetchBodies(&fetchRequest{Peer: conn, Headers: tt.headers}); err != nil {
+			t.Fatalf("test %d: failed to fetch bodies: %v", i, err)
+		}
+		select {
+		case have := <-peer.requests:
+			if have != tt.want {
+				t.Errorf("test %d: request mismatch: have %s, want %s", i, have, tt.want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("test %d: no request sent", i)
+		}
+	}
+}
@@ -42,6 +42,8 @@ var (
 	MaxSkeletonWindow = 1024 // Amount of blocks to be fetched for a skeleton assembly.
 	MaxSkeletonSize   = 1024 // Number of header fetches to need for a skeleton assembly
 	MaxStateFetch     = 384  // Amount of node state values to allow fetching per request
+	MaxHeaderReorder  = 16   // Number of skeleton batches completed past a stalled one before re-requesting it
+	MaxHeaderRetries  = 2    // Number of alternate peers a failed header request is re-issued to
 
 	PrimeSkeletonDist = 8
 	PrimeFetchDepth   = 1000
@@ -379,11 +381,21 @@ func (d *Downloader) syncWithPeer(p *peerConnection, hash common.Hash, entropy *
 		log.Debug("Synchronisation terminated", "elapsed", common.PrettyDuration(time.Since(start)))
 	}(time.Now())
 
-	// Get the latest head of the peer to start the sync from.
-	latest, err := d.fetchHead(p)
+	// Get the latest head of the peer to start the sync from. If another peer had
+	// to deliver it, carry on syncing with that one.
+	source, latest, err := d.fetchHead(p, entropy)
 	if err != nil {
 		return err
 	}
+	if source != p {
+		log.Info("Switching sync to alternate peer", "peer", p.id, "alternate", source.id)
+
+		d.cancelLock.Lock()
+		d.cancelPeer = source.id
+		d.cancelLock.Unlock()
+
+		p = source
+	}
 
 	// Height of the peer
 	peerHeight := latest.Number().Uint64()
@@ -481,14 +493,102 @@ func (d *Downloader) Terminate() {
 	d.Cancel()
 }
 
-// fetchHead retrieves the head header from a remote peer.
-func (d *Downloader) fetchHead(p *peerConnection) (head *types.Header, err error) {
+// fetchHead retrieves the head header from a remote peer. If the peer fails to
+// deliver it, the same header is requested from other peers at or beyond the
+// given entropy, the one which eventually delivered it being returned.
+func (d *Downloader) fetchHead(p *peerConnection, entropy *big.Int) (*peerConnection, *types.Header, error) {
 	p.log.Debug("Retrieving remote chain head")
 
 	// Request the advertised remote head block and wait for the response
 	latest, _, _, _ := p.peer.Head()
-	fetch := 1
-	go p.peer.RequestHeadersByHash(latest, fetch, uint64(1), false, true)
+	req := &headerRequest{hash: latest, amount: 1, skip: 1, reverse: true}
+
+	p, headers, err := d.requestHeaders(p, req, entropy)
+	if err != nil {
+		return nil, nil, err
+	}
+	head := headers[0]
+	p.log.Debug("Remote head identified", "number", head.Number(), "hash", head.Hash())
+	return p, head, nil
+}
+
+// headerRequest is a header retrieval by origin hash which can be re-issued
+// verbatim to another peer if the one it was sent to fails to answer it properly.
+// The skeleton and the full header fetches of the sync are not retried this way,
+// an empty answer terminating them and the skeleton fill rescheduling its tasks
+// across peers already.
+type headerRequest struct {
+	hash    common.Hash // Hash of the origin header
+	amount  int         // Maximum number of headers to retrieve
+	skip    uint64      // Distance between the consecutive headers to retrieve
+	dom     bool        // Whether to retrieve dominant headers only
+	reverse bool        // Whether to retrieve the headers towards genesis
+}
+
+// send issues the request to a peer.
+func (r *headerRequest) send(p *peerConnection) {
+	go p.peer.RequestHeadersByHash(r.hash, r.amount, r.skip, r.dom, r.reverse)
+}
+
+// validate checks that a response answers the request: it must start at the
+// origin and hold at least one and at most the requested number of headers. The
+// headers of a contiguous retrieval must also link up.
+func (r *headerRequest) validate(headers []*types.Header) error {
+	if len(headers) == 0 {
+		return errEmptyHeaderSet
+	}
+	if len(headers) > r.amount {
+		return fmt.Errorf("%w: returned headers %d > requested %d", errBadPeer, len(headers), r.amount)
+	}
+	if headers[0].Hash() != r.hash {
+		return fmt.Errorf("%w: origin %x != requested %x", errBadPeer, headers[0].Hash(), r.hash)
+	}
+	if r.dom || r.skip != 1 {
+		return nil
+	}
+	for i := 1; i < len(headers); i++ {
+		parent, child := headers[i-1], headers[i]
+		if r.reverse {
+			parent, child = child, parent
+		}
+		if child.NumberU64() != parent.NumberU64()+1 || child.ParentHash() != parent.Hash() {
+			return fmt.Errorf("%w: non-contiguous header #%d at index %d", errInvalidChain, headers[i].NumberU64(), i)
+		}
+	}
+	return nil
+}
+
+// requestHeaders retrieves headers from a peer, transparently re-issuing the
+// request to alternate peers if it times out or is answered invalidly, up to
+// MaxHeaderRetries times. The alternates are the untried peers at or beyond the
+// given entropy, highest entropy first. The peer which answered is returned
+// along with the headers, or the last one tried along with its error.
+func (d *Downloader) requestHeaders(p *peerConnection, req *headerRequest, entropy *big.Int) (*peerConnection, []*types.Header, error) {
+	tried := make(map[string]struct{})
+	for {
+		tried[p.id] = struct{}{}
+
+		headers, err := d.awaitHeaders(p, req)
+		if err == nil {
+			return p, headers, nil
+		}
+		if errors.Is(err, errCanceled) || len(tried) > MaxHeaderRetries {
+			return p, nil, err
+		}
+		next := d.peers.HeaderRetryPeer(tried, entropy)
+		if next == nil {
+			return p, nil, err
+		}
+		p.log.Debug("Header request failed, retrying with alternate peer", "alternate", next.id, "err", err)
+		headerRetryMeter.Mark(1)
+		p = next
+	}
+}
+
+// awaitHeaders issues a header request to a peer and waits for its validated
+// response.
+func (d *Downloader) awaitHeaders(p *peerConnection, req *headerRequest) ([]*types.Header, error) {
+	req.send(p)
 
 	ttl := d.peers.rates.TargetTimeout()
 	timeout := time.After(ttl)
@@ -498,27 +598,19 @@ func (d *Downloader) fetchHead(p *peerConnection) (head *types.Header, err error
 			return nil, errCanceled
 
 		case packet := <-d.headerCh:
-			// Discard anything not from the origin peer
+			// Discard anything not from the peer asked
 			if packet.PeerId() != p.id {
 				log.Debug("Received headers from incorrect peer", "peer", packet.PeerId())
 				break
 			}
-			// Make sure the peer gave us at least one and at most the requested headers
 			headers := packet.(*headerPack).headers
-			if len(headers) == 0 || len(headers) > fetch {
-				return nil, fmt.Errorf("%w: returned headers %d != requested %d", errBadPeer, len(headers), fetch)
+			if err := req.validate(headers); err != nil {
+				return nil, err
 			}
-			// The first header needs to be the head, validate against the checkpoint
-			// and request.
-			head := headers[0]
-			if len(headers) == 1 {
-				p.log.Debug("Remote head identified", "number", head.Number(), "hash", head.Hash())
-				return head, nil
-			}
-			return head, nil
+			return headers, nil
 
 		case <-timeout:
-			p.log.Debug("Waiting for head header timed out", "elapsed", ttl)
+			p.log.Debug("Waiting for headers timed out", "elapsed", ttl)
 			return nil, errTimeout
 
 		case <-d.bodyCh:
@@ -794,7 +886,7 @@ func (d *Downloader) fetchBodies(from uint64) error {
 	var (
 		deliver = func(packet dataPack) (int, error) {
 			pack := packet.(*bodyPack)
-			return d.queue.DeliverBodies(pack.peerID, pack.transactions, pack.uncles, pack.extTransactions, pack.manifest)
+			return d.queue.DeliverBlockData(pack.peerID, pack.headers, pack.transactions, pack.uncles, pack.extTransactions, pack.manifest)
 		}
 		expire   = func() map[string]int { return d.queue.ExpireBodies(d.peers.rates.TargetTimeout()) }
 		fetch    = func(p *peerConnection, req *fetchRequest) error { return p.FetchBodies(req) }
@@ -862,6 +954,17 @@ func (d *Downloader) fetchParts(deliveryCh chan dataPack, deliver func(dataPack)
 				if errors.Is(err, errInvalidChain) {
 					return err
 				}
+				// Bodies not matching the roots of the requested headers were
+				// tampered with, drop the peer instead of just retrying them
+				if errors.Is(err, errInvalidBody) {
+					peer.log.Debug("Invalid block bodies delivered, dropping", "err", err)
+					if d.dropPeer == nil {
+						// The dropPeer method is nil when `--copydb` is used for a local copy.
+						peer.log.Warn("Downloader wants to drop peer, but peerdrop-function is not set", "peer", peer.id)
+					} else {
+						d.dropPeer(peer.id)
+					}
+				}
 				// Unless a peer delivered something completely else than requested (usually
 				// caused by a timed out request which came through in the end), set it to
 				// idle. If the delivery's stale, the peer should have already been idled.
@@ -1175,7 +1278,14 @@ func (d *Downloader) DeliverHeaders(id string, headers []*types.Header) error {
 
 // DeliverBodies injects a new batch of block bodies received from a remote node.
 func (d *Downloader) DeliverBodies(id string, transactions [][]*types.Transaction, uncles [][]*types.Header, extTransactions [][]*types.Transaction, manifests []types.BlockManifest) error {
-	return d.deliver(d.bodyCh, &bodyPack{id, transactions, uncles, extTransactions, manifests}, bodyInMeter, bodyDropMeter)
+	return d.deliver(d.bodyCh, &bodyPack{id, transactions, uncles, extTransactions, manifests, nil}, bodyInMeter, bodyDropMeter)
+}
+
+// DeliverBlockData injects a new batch of block bodies received from a remote
+// node along with their headers, answering a body retrieval sent as a block data
+// request.
+func (d *Downloader) DeliverBlockData(id string, headers []*types.Header, transactions [][]*types.Transaction, uncles [][]*types.Header, extTransactions [][]*types.Transaction, manifests []types.BlockManifest) error {
+	return d.deliver(d.bodyCh, &bodyPack{id, transactions, uncles, extTransactions, manifests, headers}, bodyInMeter, bodyDropMeter)
 }
 
 // deliver injects a new batch of data received from a remote node.
@@ -27,6 +27,8 @@ var (
 	headerReqTimer     = metrics.NewRegisteredTimer("eth/downloader/headers/req", nil)
 	headerDropMeter    = metrics.NewRegisteredMeter("eth/downloader/headers/drop", nil)
 	headerTimeoutMeter = metrics.NewRegisteredMeter("eth/downloader/headers/timeout", nil)
+	headerStallMeter   = metrics.NewRegisteredMeter("eth/downloader/headers/stall", nil)
+	headerRetryMeter   = metrics.NewRegisteredMeter("eth/downloader/headers/retry", nil)
 
 	bodyInMeter      = metrics.NewRegisteredMeter("eth/downloader/bodies/in", nil)
 	bodyReqTimer     = metrics.NewRegisteredTimer("eth/downloader/bodies/req", nil)
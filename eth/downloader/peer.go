@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
 	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
 	"github.com/dominant-strategies/go-quai/event"
 	"github.com/dominant-strategies/go-quai/log"
@@ -77,6 +78,13 @@ type Peer interface {
 	RequestBodies([]common.Hash) error
 }
 
+// BlockDataPeer is a full peer which can also return the headers and the bodies
+// of a range of blocks in a single request.
+type BlockDataPeer interface {
+	Peer
+	RequestBlockData(uint64, int, bool) error
+}
+
 // newPeerConnection creates a new downloader peer.
 func newPeerConnection(id string, version uint, peer Peer, logger log.Logger) *peerConnection {
 	return &peerConnection{
@@ -144,6 +152,12 @@ func (p *peerConnection) FetchBodies(request *fetchRequest) error {
 	p.blockStarted = time.Now()
 
 	go func() {
+		// Request contiguous runs from eth/67 peers as block data by number, the
+		// headers returned along being checked against the requested ones
+		if peer, ok := p.peer.(BlockDataPeer); ok && p.version >= eth.ETH67 && contiguous(request.Headers) {
+			peer.RequestBlockData(request.Headers[0].NumberU64(), len(request.Headers), false)
+			return
+		}
 		// Convert the header set to a retrievable slice
 		hashes := make([]common.Hash, 0, len(request.Headers))
 		for _, header := range request.Headers {
@@ -155,6 +169,16 @@ func (p *peerConnection) FetchBodies(request *fetchRequest) error {
 	return nil
 }
 
+// contiguous reports whether the headers form a chain of consecutive blocks.
+func contiguous(headers []*types.Header) bool {
+	for i := 1; i < len(headers); i++ {
+		if headers[i].NumberU64() != headers[i-1].NumberU64()+1 || headers[i].ParentHash() != headers[i-1].Hash() {
+			return false
+		}
+	}
+	return len(headers) > 0
+}
+
 // SetHeadersIdle sets the peer to idle, allowing it to execute new header retrieval
 // requests. Its estimated header retrieval throughput is updated with that measured
 // just now.
@@ -327,6 +351,32 @@ func (ps *peerSet) AllPeers() []*peerConnection {
 	return list
 }
 
+// HeaderRetryPeer picks the peer to re-issue a failed header request to among
+// the ones not tried yet: the one advertising the highest entropy, which must be
+// at least the given one. Nil is returned if no peer is suitable.
+func (ps *peerSet) HeaderRetryPeer(tried map[string]struct{}, entropy *big.Int) *peerConnection {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	var (
+		best        *peerConnection
+		bestEntropy *big.Int
+	)
+	for id, p := range ps.peers {
+		if _, ok := tried[id]; ok || p.version < eth.ETH65 || p.version > eth.ETH67 {
+			continue
+		}
+		_, _, peerEntropy, _ := p.peer.Head()
+		if peerEntropy == nil || (entropy != nil && peerEntropy.Cmp(entropy) < 0) {
+			continue
+		}
+		if best == nil || peerEntropy.Cmp(bestEntropy) > 0 {
+			best, bestEntropy = p, peerEntropy
+		}
+	}
+	return best
+}
+
 // HeaderIdlePeers retrieves a flat list of all the currently header-idle peers
 // within the active peer set, ordered by their reputation.
 func (ps *peerSet) HeaderIdlePeers() ([]*peerConnection, int) {
@@ -336,7 +386,7 @@ func (ps *peerSet) HeaderIdlePeers() ([]*peerConnection, int) {
 	throughput := func(p *peerConnection) int {
 		return p.rates.Capacity(eth.BlockHeadersMsg, time.Second)
 	}
-	return ps.idlePeers(eth.ETH65, eth.ETH66, idle, throughput)
+	return ps.idlePeers(eth.ETH65, eth.ETH67, idle, throughput)
 }
 
 // BodyIdlePeers retrieves a flat list of all the currently body-idle peers within
@@ -348,7 +398,7 @@ func (ps *peerSet) BodyIdlePeers() ([]*peerConnection, int) {
 	throughput := func(p *peerConnection) int {
 		return p.rates.Capacity(eth.BlockBodiesMsg, time.Second)
 	}
-	return ps.idlePeers(eth.ETH65, eth.ETH66, idle, throughput)
+	return ps.idlePeers(eth.ETH65, eth.ETH67, idle, throughput)
 }
 
 // idlePeers retrieves a flat list of all currently idle peers satisfying the
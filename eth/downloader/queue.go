@@ -49,6 +49,7 @@ var (
 var (
 	errNoFetchesPending = errors.New("no fetches pending")
 	errStaleDelivery    = errors.New("stale delivery")
+	errReassigned       = errors.New("fetch reassigned to another peer")
 )
 
 // fetchRequest is a currently running data retrieval operation.
@@ -58,6 +59,7 @@ type fetchRequest struct {
 	To      uint64          // Expected stopping number for the request (used for skeleton fills only)
 	Headers []*types.Header // [eth/62] Requested headers, sorted by request order
 	Time    time.Time       // Time when the request was made
+	Stalled bool            // Whether the request was already reassigned for stalling the skeleton fill
 }
 
 // fetchResult is a struct collecting partial results from data fetchers until
@@ -112,6 +114,7 @@ type queue struct {
 	headerTaskQueue *prque.Prque                   // Priority queue of the skeleton indexes to fetch the filling headers for
 	headerPeerMiss  map[string]map[uint64]struct{} // Set of per-peer header batches known to be unavailable
 	headerPendPool  map[string]*fetchRequest       // Currently pending header retrieval operations
+	headerDone      map[uint64]struct{}            // Set of skeleton indexes already filled
 	headerResults   []*types.Header                // Result cache accumulating the completed headers
 	headerProced    int                            // Number of headers already processed from the results
 	headerOffset    uint64                         // Number of the first header in the result cache
@@ -234,6 +237,7 @@ func (q *queue) ScheduleSkeleton(from uint64, skeleton []*types.Header) {
 	q.headerToPool = make(map[uint64]uint64)
 	q.headerTaskQueue = prque.New(nil)
 	q.headerPeerMiss = make(map[string]map[uint64]struct{}) // Reset availability to correct invalid chains
+	q.headerDone = make(map[uint64]struct{})
 	q.headerResults = make([]*types.Header, skeleton[0].NumberU64()-skeleton[len(skeleton)-1].NumberU64())
 	q.headerProced = 0
 	q.headerOffset = skeleton[len(skeleton)-1].NumberU64() - 1
@@ -387,6 +391,9 @@ func (q *queue) ReserveHeaders(p *peerConnection, count int) *fetchRequest {
 	send, skip := uint64(0), []uint64{}
 	for send == 0 && !q.headerTaskQueue.Empty() {
 		from, _ := q.headerTaskQueue.Pop()
+		if _, ok := q.headerTaskPool[from.(uint64)]; !ok {
+			continue // Filled by a stalled request after being reassigned
+		}
 		if q.headerPeerMiss[p.id] != nil {
 			if _, ok := q.headerPeerMiss[p.id][from.(uint64)]; ok {
 				skip = append(skip, from.(uint64))
@@ -540,7 +547,7 @@ func (q *queue) CancelBodies(request *fetchRequest) {
 // Cancel aborts a fetch request, returning all pending hashes to the task queue.
 func (q *queue) cancel(request *fetchRequest, taskQueue *prque.Prque, pendPool map[string]*fetchRequest) {
 	if request.From > 0 {
-		taskQueue.Push(request.From, -int64(request.From))
+		taskQueue.Push(request.From+1, -int64(request.From+1))
 	}
 	for _, header := range request.Headers {
 		taskQueue.Push(header, -int64(header.Number().Uint64()))
@@ -595,9 +602,10 @@ func (q *queue) expire(timeout time.Duration, pendPool map[string]*fetchRequest,
 			// Update the metrics with the timeout
 			timeoutMeter.Mark(1)
 
-			// Return any non satisfied requests to the pool
-			if request.From > 0 {
-				taskQueue.Push(request.From, -int64(request.From))
+			// Return any non satisfied requests to the pool, unless already
+			// reassigned for stalling
+			if request.From > 0 && !request.Stalled {
+				taskQueue.Push(request.From+1, -int64(request.From+1))
 			}
 			for _, header := range request.Headers {
 				taskQueue.Push(header, -int64(header.Number().Uint64()))
@@ -638,6 +646,10 @@ func (q *queue) DeliverHeaders(id string, headers []*types.Header, headerProcCh
 	headerReqTimer.UpdateSince(request.Time)
 	delete(q.headerPendPool, id)
 
+	// Stalled requests may have been filled by the peer they were reassigned to
+	if _, ok := q.headerTaskPool[request.From+1]; !ok {
+		return 0, errReassigned
+	}
 	// Ensure headers can be mapped onto the skeleton chain
 	targetTo := q.headerToPool[request.From+1]
 
@@ -689,7 +701,9 @@ func (q *queue) DeliverHeaders(id string, headers []*types.Header, headerProcCh
 		}
 		miss[request.From+1] = struct{}{}
 
-		q.headerTaskQueue.Push(request.From+1, -int64(request.From+1))
+		if !request.Stalled {
+			q.headerTaskQueue.Push(request.From+1, -int64(request.From+1))
+		}
 		return 0, errors.New("delivery not accepted")
 	}
 
@@ -698,6 +712,13 @@ func (q *queue) DeliverHeaders(id string, headers []*types.Header, headerProcCh
 	// Clean up a successful fetch and try to deliver any sub-results
 	delete(q.headerTaskPool, request.From+1)
 	delete(q.headerToPool, request.From+1)
+	q.headerDone[request.From+1] = struct{}{}
+
+	if request.Stalled {
+		q.purgeHeaderTasks()
+	} else {
+		q.reassignStalledHeaders()
+	}
 
 	ready := int(requiredHeaderFetch)
 
@@ -720,12 +741,102 @@ func (q *queue) DeliverHeaders(id string, headers []*types.Header, headerProcCh
 	return len(headers), nil
 }
 
+// reassignStalledHeaders bounds the number of skeleton batches completed past the
+// lowest one still in flight. Once MaxHeaderReorder of them accumulated, the
+// stalled batch is marked unavailable at the peer it was requested from and
+// rescheduled, so another peer can fill the gap.
+//
+// Note, this method expects the queue lock to be already held.
+func (q *queue) reassignStalledHeaders() {
+	var stalled *fetchRequest
+	for _, request := range q.headerPendPool {
+		if !request.Stalled && (stalled == nil || request.From < stalled.From) {
+			stalled = request
+		}
+	}
+	if stalled == nil {
+		return
+	}
+	ahead := 0
+	for index := range q.headerDone {
+		if index > stalled.From+1 {
+			ahead++
+		}
+	}
+	if ahead < MaxHeaderReorder {
+		return
+	}
+	log.Debug("Reassigning stalled skeleton fill", "peer", stalled.Peer.id, "from", stalled.From, "ahead", ahead)
+	headerStallMeter.Mark(1)
+
+	miss := q.headerPeerMiss[stalled.Peer.id]
+	if miss == nil {
+		miss = make(map[uint64]struct{})
+		q.headerPeerMiss[stalled.Peer.id] = miss
+	}
+	miss[stalled.From+1] = struct{}{}
+
+	stalled.Stalled = true
+	q.headerTaskQueue.Push(stalled.From+1, -int64(stalled.From+1))
+}
+
+// purgeHeaderTasks drops the skeleton indexes already filled from the task queue,
+// left over by reassigned requests which got filled by the stalled peer after all.
+//
+// Note, this method expects the queue lock to be already held.
+func (q *queue) purgeHeaderTasks() {
+	var tasks []uint64
+	for !q.headerTaskQueue.Empty() {
+		index, _ := q.headerTaskQueue.Pop()
+		if _, ok := q.headerTaskPool[index.(uint64)]; ok {
+			tasks = append(tasks, index.(uint64))
+		}
+	}
+	for _, index := range tasks {
+		q.headerTaskQueue.Push(index, -int64(index))
+	}
+}
+
 // DeliverBodies injects a block body retrieval response into the results queue.
 // The method returns the number of blocks bodies accepted from the delivery and
 // also wakes any threads waiting for data delivery.
 func (q *queue) DeliverBodies(id string, txLists [][]*types.Transaction, uncleLists [][]*types.Header, etxLists [][]*types.Transaction, manifests []types.BlockManifest) (int, error) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
+
+	return q.deliverBodies(id, txLists, uncleLists, etxLists, manifests)
+}
+
+// DeliverBlockData injects a block body retrieval response sent as block data
+// into the results queue, nil headers standing for bodies retrieved by hash. The
+// peer serves its own canonical chain, so past the first header not matching the
+// requested one, the blocks are left to other peers instead of being rejected.
+func (q *queue) DeliverBlockData(id string, headers []*types.Header, txLists [][]*types.Transaction, uncleLists [][]*types.Header, etxLists [][]*types.Transaction, manifests []types.BlockManifest) (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if request := q.blockPendPool[id]; request != nil && headers != nil {
+		matched := 0
+		for matched < len(headers) && matched < len(request.Headers) && headers[matched].Hash() == request.Headers[matched].Hash() {
+			matched++
+		}
+		if matched < len(headers) {
+			for _, header := range request.Headers[matched:] {
+				request.Peer.MarkLacking(header.Hash())
+			}
+		}
+		if matched < len(txLists) {
+			txLists, uncleLists, etxLists, manifests = txLists[:matched], uncleLists[:matched], etxLists[:matched], manifests[:matched]
+		}
+	}
+	return q.deliverBodies(id, txLists, uncleLists, etxLists, manifests)
+}
+
+// deliverBodies validates the retrieved block bodies against the headers of the
+// request and injects them into the results queue.
+//
+// Note, this method expects the queue lock to be already held for writing.
+func (q *queue) deliverBodies(id string, txLists [][]*types.Transaction, uncleLists [][]*types.Header, etxLists [][]*types.Transaction, manifests []types.BlockManifest) (int, error) {
 	nodeCtx := common.NodeLocation.Context()
 	trieHasher := trie.NewStackTrie(nil)
 	validate := func(index int, header *types.Header) error {
@@ -833,7 +944,7 @@ func (q *queue) deliver(id string, taskPool map[common.Hash]*types.Header,
 	}
 	// If none of the data was good, it's a stale delivery
 	if accepted > 0 {
-		return accepted, fmt.Errorf("partial failure: %v", failure)
+		return accepted, fmt.Errorf("partial failure: %w", failure)
 	}
 	return accepted, fmt.Errorf("%w: %v", failure, errStaleDelivery)
 }
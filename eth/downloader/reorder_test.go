@@ -0,0 +1,125 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package downloader
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/core/types"
+)
+
+// newLinkedHeaders creates a chain of headers numbered from..to, inclusive.
+func newLinkedHeaders(from, to uint64) map[uint64]*types.Header {
+	headers := make(map[uint64]*types.Header)
+	for number := from; number <= to; number++ {
+		header := types.EmptyHeader()
+		header.SetNumber(new(big.Int).SetUint64(number))
+		if parent := headers[number-1]; parent != nil {
+			header.SetParentHash(parent.Hash())
+		}
+		headers[number] = header
+	}
+	return headers
+}
+
+// Tests that skeleton batches completing out of order past a stalled one are only
+// buffered up to a limit, after which the stalled range is requested from another
+// peer.
+func TestHeaderReorderBound(t *testing.T) {
+	defer func(old int) { MaxHeaderReorder = old }(MaxHeaderReorder)
+	MaxHeaderReorder = 2
+
+	// Skeleton every 5 headers between 100 and 130, filled in 6 batches
+	chain := newLinkedHeaders(100, 130)
+	var skeleton []*types.Header
+	for number := uint64(130); number >= 100; number -= 5 {
+		skeleton = append(skeleton, chain[number])
+	}
+	batch := func(index uint64) []*types.Header {
+		var headers []*types.Header
+		for number := index - 1; number >= index-5; number-- {
+			headers = append(headers, chain[number])
+		}
+		return headers
+	}
+	q := newQueue(10, 10)
+	q.ScheduleSkeleton(130, skeleton)
+
+	var (
+		procCh = make(chan []*types.Header, 16)
+		peers  = map[string]*peerConnection{}
+	)
+	for _, id := range []string{"stalling", "fast-1", "fast-2"} {
+		peers[id] = &peerConnection{id: id}
+	}
+	reserve := func(id string, want uint64) {
+		t.Helper()
+		request := q.ReserveHeaders(peers[id], 1)
+		if request == nil || request.From+1 != want {
+			t.Fatalf("peer %s: reserved batch mismatch: have %v, want %d", id, request, want)
+		}
+	}
+	deliver := func(id string, index uint64, want error) {
+		t.Helper()
+		if _, err := q.DeliverHeaders(id, batch(index), procCh); !errors.Is(err, want) {
+			t.Fatalf("peer %s: delivery error mismatch: have %v, want %v", id, err, want)
+		}
+	}
+	// The stalling peer gets the lowest batch, the others the ones above it
+	reserve("stalling", 105)
+	reserve("fast-1", 110)
+	reserve("fast-2", 115)
+
+	// A single batch completed past the stalled one is buffered
+	deliver("fast-1", 110, nil)
+	if q.headerPendPool["stalling"].Stalled {
+		t.Fatalf("batch reassigned below the reorder limit")
+	}
+	// Reaching the limit reassigns the stalled range to another peer
+	deliver("fast-2", 115, nil)
+	if !q.headerPendPool["stalling"].Stalled {
+		t.Fatalf("stalled batch not reassigned at the reorder limit")
+	}
+	if q.ReserveHeaders(peers["stalling"], 1) != nil {
+		t.Fatalf("busy stalling peer reserved another batch")
+	}
+	reserve("fast-1", 105)
+	deliver("fast-1", 105, nil)
+
+	// The stalled peer's late reply is discarded, its range being filled already
+	deliver("stalling", 105, errReassigned)
+	if _, ok := q.headerDone[105]; !ok {
+		t.Errorf("reassigned batch not filled")
+	}
+	// The rest of the skeleton fills normally
+	for _, index := range []uint64{120, 125, 130} {
+		reserve("fast-2", index)
+		deliver("fast-2", index, nil)
+	}
+	if pending := q.PendingHeaders(); pending != 0 {
+		t.Errorf("pending batches mismatch: have %d, want 0", pending)
+	}
+	// The result cache is offset by one below the skeleton tail
+	filled, _ := q.RetrieveHeaders()
+	for i, header := range filled[1:] {
+		if header == nil || header.NumberU64() != uint64(100+i) {
+			t.Fatalf("filled header %d mismatch: have %v", i, header)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package downloader
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+	"github.com/dominant-strategies/go-quai/log"
+)
+
+// retryTestPeer is a download peer answering header requests from a chain of
+// headers, either faithfully or in one of the ways a flaky peer fails to.
+type retryTestPeer struct {
+	id      string
+	entropy *big.Int
+	head    common.Hash
+	headers map[common.Hash]*types.Header
+	dl      *Downloader
+
+	silent bool // Whether requests are never answered
+	wrong  bool // Whether requests are answered with another header
+
+	lock      sync.Mutex
+	requested int
+}
+
+func (p *retryTestPeer) Head() (common.Hash, *big.Int, *big.Int, time.Time) {
+	return p.head, nil, p.entropy, time.Time{}
+}
+
+func (p *retryTestPeer) RequestHeadersByHash(origin common.Hash, amount int, skip uint64, dom bool, reverse bool) error {
+	p.lock.Lock()
+	p.requested++
+	p.lock.Unlock()
+
+	switch {
+	case p.silent:
+		return nil
+	case p.wrong:
+		header := types.EmptyHeader()
+		header.SetNumber(big.NewInt(1))
+		return p.dl.DeliverHeaders(p.id, []*types.Header{header})
+	}
+	var headers []*types.Header
+	if header := p.headers[origin]; header != nil {
+		headers = append(headers, header)
+	}
+	return p.dl.DeliverHeaders(p.id, headers)
+}
+
+// requests returns the number of header requests the peer received.
+func (p *retryTestPeer) requests() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.requested
+}
+
+func (p *retryTestPeer) RequestHeadersByNumber(uint64, int, uint64, uint64, bool, bool) error {
+	return nil
+}
+
+func (p *retryTestPeer) RequestBodies([]common.Hash) error { return nil }
+
+// newRetryTestDownloader creates a downloader with a sync running, timing out
+// header requests quickly, and a header to request from its peers.
+func newRetryTestDownloader(t *testing.T) (*Downloader, *types.Header) {
+	d := &Downloader{
+		peers:    newPeerSet(),
+		headerCh: make(chan dataPack, 1),
+		bodyCh:   make(chan dataPack, 1),
+		cancelCh: make(chan struct{}),
+	}
+	d.peers.rates.OverrideTTLLimit = 50 * time.Millisecond
+	t.Cleanup(func() { close(d.cancelCh) })
+
+	header := types.EmptyHeader()
+	header.SetNumber(big.NewInt(10))
+	return d, header
+}
+
+// addRetryTestPeer registers a peer serving the given header as its head.
+func addRetryTestPeer(t *testing.T, d *Downloader, id string, entropy int64, head *types.Header) *retryTestPeer {
+	t.Helper()
+
+	peer := &retryTestPeer{
+		id:      id,
+		entropy: big.NewInt(entropy),
+		head:    head.Hash(),
+		headers: map[common.Hash]*types.Header{head.Hash(): head},
+		dl:      d,
+	}
+	if err := d.peers.Register(newPeerConnection(id, eth.ETH66, peer, log.Log)); err != nil {
+		t.Fatalf("failed to register peer %s: %v", id, err)
+	}
+	return peer
+}
+
+// Tests that a head request timing out on the first peer is re-issued to the
+// alternate peer with the highest entropy, which delivers it.
+func TestFetchHeadFailoverOnTimeout(t *testing.T) {
+	d, head := newRetryTestDownloader(t)
+
+	var (
+		bad    = addRetryTestPeer(t, d, "bad", 100, head)
+		low    = addRetryTestPeer(t, d, "low", 100, head)
+		high   = addRetryTestPeer(t, d, "high", 200, head)
+		behind = addRetryTestPeer(t, d, "behind", 50, head)
+	)
+	bad.silent = true
+
+	source, header, err := d.fetchHead(d.peers.Peer("bad"), big.NewInt(100))
+	if err != nil {
+		t.Fatalf("failed to fetch head: %v", err)
+	}
+	if header.Hash() != head.Hash() {
+		t.Errorf("head mismatch: have %x, want %x", header.Hash(), head.Hash())
+	}
+	if source.id != "high" {
+		t.Errorf("source peer mismatch: have %s, want %s", source.id, "high")
+	}
+	for _, peer := range []*retryTestPeer{low, behind} {
+		if peer.requests() != 0 {
+			t.Errorf("peer %s: requested %d times, want 0", peer.id, peer.requests())
+		}
+	}
+	if high.requests() != 1 {
+		t.Errorf("alternate peer requested %d times, want 1", high.requests())
+	}
+}
+
+// Tests that a head request answered with the wrong header is re-issued to an
+// alternate peer, and that the retries stop at the configured limit.
+func TestFetchHeadFailoverOnInvalidResponse(t *testing.T) {
+	defer func(old int) { MaxHeaderRetries = old }(MaxHeaderRetries)
+
+	d, head := newRetryTestDownloader(t)
+
+	var (
+		wrong  = addRetryTestPeer(t, d, "wrong", 100, head)
+		silent = addRetryTestPeer(t, d, "silent", 300, head)
+		good   = addRetryTestPeer(t, d, "good", 200, head)
+	)
+	wrong.wrong, silent.silent = true, true
+
+	// A single retry only reaches the highest entropy peer, which fails too
+	MaxHeaderRetries = 1
+	if _, _, err := d.fetchHead(d.peers.Peer("wrong"), big.NewInt(100)); !errors.Is(err, errTimeout) {
+		t.Fatalf("error mismatch: have %v, want %v", err, errTimeout)
+	}
+	if good.requests() != 0 {
+		t.Fatalf("peer beyond the retry limit requested %d times", good.requests())
+	}
+	// Two retries get through to the good peer
+	MaxHeaderRetries = 2
+	source, header, err := d.fetchHead(d.peers.Peer("wrong"), big.NewInt(100))
+	if err != nil {
+		t.Fatalf("failed to fetch head: %v", err)
+	}
+	if source.id != "good" || header.Hash() != head.Hash() {
+		t.Errorf("head mismatch: have %x from %s, want %x from %s", header.Hash(), source.id, head.Hash(), "good")
+	}
+	if wrong.requests() != 2 || silent.requests() != 2 || good.requests() != 1 {
+		t.Errorf("request counts mismatch: have %d/%d/%d, want 2/2/1", wrong.requests(), silent.requests(), good.requests())
+	}
+}
+
+// Tests that a failed head request is surfaced if no alternate peer is suitable.
+func TestFetchHeadNoAlternate(t *testing.T) {
+	d, head := newRetryTestDownloader(t)
+
+	bad := addRetryTestPeer(t, d, "bad", 100, head)
+	bad.silent = true
+	addRetryTestPeer(t, d, "behind", 50, head)
+
+	if _, _, err := d.fetchHead(d.peers.Peer("bad"), big.NewInt(100)); !errors.Is(err, errTimeout) {
+		t.Errorf("error mismatch: have %v, want %v", err, errTimeout)
+	}
+}
+
+// Tests that header responses are checked against the request they answer.
+func TestHeaderRequestValidate(t *testing.T) {
+	chain := newLinkedHeaders(100, 104)
+	var (
+		forward = []*types.Header{chain[100], chain[101], chain[102]}
+		reverse = []*types.Header{chain[104], chain[103], chain[102]}
+		gapped  = []*types.Header{chain[100], chain[102]}
+	)
+	tests := []struct {
+		req     headerRequest
+		headers []*types.Header
+		err     error
+	}{
+		{headerRequest{hash: chain[100].Hash(), amount: 3, skip: 1}, forward, nil},
+		{headerRequest{hash: chain[104].Hash(), amount: 3, skip: 1, reverse: true}, reverse, nil},
+		{headerRequest{hash: chain[100].Hash(), amount: 3, skip: 2}, gapped, nil},
+		{headerRequest{hash: chain[100].Hash(), amount: 3, skip: 1, dom: true}, gapped, nil},
+		{headerRequest{hash: chain[100].Hash(), amount: 3, skip: 1}, nil, errEmptyHeaderSet},
+		{headerRequest{hash: chain[100].Hash(), amount: 2, skip: 1}, forward, errBadPeer},
+		{headerRequest{hash: chain[101].Hash(), amount: 3, skip: 1}, forward, errBadPeer},
+		{headerRequest{hash: chain[103].Hash(), amount: 3, skip: 1, reverse: true}, reverse, errBadPeer},
+		{headerRequest{hash: chain[100].Hash(), amount: 3, skip: 1}, gapped, errInvalidChain},
+		{headerRequest{hash: chain[104].Hash(), amount: 3, skip: 1}, reverse, errInvalidChain},
+	}
+	for i, tt := range tests {
+		if err := tt.req.validate(tt.headers); !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
@@ -49,6 +49,7 @@ type bodyPack struct {
 	uncles          [][]*types.Header
 	extTransactions [][]*types.Transaction
 	manifest        []types.BlockManifest
+	headers         []*types.Header // Headers the bodies arrived with, if retrieved as block data
 }
 
 func (p *bodyPack) PeerId() string { return p.peerID }
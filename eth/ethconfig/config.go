@@ -28,9 +28,11 @@ import (
 	"github.com/dominant-strategies/go-quai/core"
 	"github.com/dominant-strategies/go-quai/eth/downloader"
 	"github.com/dominant-strategies/go-quai/eth/gasprice"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
 	"github.com/dominant-strategies/go-quai/ethdb"
 	"github.com/dominant-strategies/go-quai/log"
 	"github.com/dominant-strategies/go-quai/node"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
 	"github.com/dominant-strategies/go-quai/params"
 )
 
@@ -78,6 +80,33 @@ var Defaults = Config{
 	RPCTxFeeCap: 1, // 1 ether
 	DomUrl:      "ws://127.0.0.1:8546",
 	SubUrls:     []string{"ws://127.0.0.1:8546", "ws://127.0.0.1:8546", "ws://127.0.0.1:8546"},
+	TxFetcher: TxFetcherConfig{
+		CoalesceWindow: 200 * time.Millisecond,
+		BatchSize:      256,
+	},
+	Quarantine: QuarantineConfig{
+		Threshold:  3,
+		Backoff:    time.Minute,
+		MaxBackoff: 24 * time.Hour,
+	},
+	MaxPendingHandshakes: 64,
+	Protocol:             eth.DefaultConfig,
+}
+
+// TxFetcherConfig are the options batching the retrieval of the transactions
+// announced by peers into fewer, larger requests.
+type TxFetcherConfig struct {
+	CoalesceWindow time.Duration // Time to hold back retrievals, batching further announcements (0 = fetch immediately)
+	BatchSize      int           // Maximum number of transactions to retrieve in a single request
+}
+
+// QuarantineConfig are the options refusing the peers which repeatedly deliver
+// data failing validation. Each quarantine lasts twice as long as the previous
+// one of the same node, starting at Backoff and capped at MaxBackoff.
+type QuarantineConfig struct {
+	Threshold  int           // Validation failures after which a peer is quarantined (0 = never)
+	Backoff    time.Duration // Duration of the first quarantine of a node
+	MaxBackoff time.Duration // Maximum duration of a quarantine
 }
 
 //go:generate gencodec -type Config -formats toml -out gen_config.go
@@ -134,6 +163,12 @@ type Config struct {
 	// Transaction pool options
 	TxPool core.TxPoolConfig
 
+	// Transaction fetcher options
+	TxFetcher TxFetcherConfig
+
+	// Quarantine of the peers failing validation
+	Quarantine QuarantineConfig
+
 	// Gas Price Oracle options
 	GPO gasprice.Config
 
@@ -164,6 +199,39 @@ type Config struct {
 
 	// Slices running on the node
 	SlicesRunning []common.Location
+
+	// Per slice peer bounds, keeping coverage balanced across the running slices
+	MinPeersPerLocation int // Peers to admit for each running slice even if the peer set is full
+	MaxPeersPerLocation int // Maximum number of peers to admit per slice (0 = unlimited)
+
+	// Trusted peers always preferred for retrieving the data of a slice
+	PinnedPeers []PeerPin
+
+	// Restrictions of the messages accepted from specific peers
+	PeerAllowlists []PeerAllowlist
+
+	// Handshakes in progress at once, smoothing the burst of connections after
+	// a network-wide restart (0 = unlimited)
+	MaxPendingHandshakes int
+
+	// Settings of the `eth` protocol handler shared by all the peers
+	Protocol eth.Config
+}
+
+// PeerPin pins trusted peers, such as the operator's own nodes, as the preferred
+// sources of a slice's data. Other peers are only asked if none of the pinned
+// ones are connected.
+type PeerPin struct {
+	Location common.Location
+	Peers    []enode.ID
+}
+
+// PeerAllowlist restricts the messages accepted from specific peers, such as the
+// ones of a transaction-only relay, to the listed message codes. Messages outside
+// of the list are discarded and held against the peer.
+type PeerAllowlist struct {
+	Peers    []enode.ID
+	Messages []uint64
 }
 
 // CreateProgpowConsensusEngine creates a progpow consensus engine for the given chain configuration.
@@ -10,6 +10,7 @@ import (
 	"github.com/dominant-strategies/go-quai/core"
 	"github.com/dominant-strategies/go-quai/eth/downloader"
 	"github.com/dominant-strategies/go-quai/eth/gasprice"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
 )
 
 // MarshalTOML marshals as TOML.
@@ -38,6 +39,10 @@ func (c Config) MarshalTOML() (interface{}, error) {
 		Miner                   core.Config
 		Progpow                  progpow.Config
 		TxPool                  core.TxPoolConfig
+		TxFetcher               TxFetcherConfig
+		Quarantine              QuarantineConfig
+		Protocol                eth.Config
+		PeerAllowlists          []PeerAllowlist
 		GPO                     gasprice.Config
 		EnablePreimageRecording bool
 		DocRoot                 string `toml:"-"`
@@ -68,6 +73,10 @@ func (c Config) MarshalTOML() (interface{}, error) {
 	enc.Miner = c.Miner
 	enc.Progpow = c.Progpow
 	enc.TxPool = c.TxPool
+	enc.TxFetcher = c.TxFetcher
+	enc.Quarantine = c.Quarantine
+	enc.Protocol = c.Protocol
+	enc.PeerAllowlists = c.PeerAllowlists
 	enc.GPO = c.GPO
 	enc.EnablePreimageRecording = c.EnablePreimageRecording
 	enc.DocRoot = c.DocRoot
@@ -111,6 +120,10 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 		Miner                   *core.Config
 		Progpow                  *progpow.Config
 		TxPool                  *core.TxPoolConfig
+		TxFetcher               *TxFetcherConfig
+		Quarantine              *QuarantineConfig
+		Protocol                *eth.Config
+		PeerAllowlists          []PeerAllowlist
 		GPO                     *gasprice.Config
 		EnablePreimageRecording *bool
 		DocRoot                 *string `toml:"-"`
@@ -190,6 +203,18 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.TxPool != nil {
 		c.TxPool = *dec.TxPool
 	}
+	if dec.TxFetcher != nil {
+		c.TxFetcher = *dec.TxFetcher
+	}
+	if dec.Quarantine != nil {
+		c.Quarantine = *dec.Quarantine
+	}
+	if dec.Protocol != nil {
+		c.Protocol = *dec.Protocol
+	}
+	if dec.PeerAllowlists != nil {
+		c.PeerAllowlists = dec.PeerAllowlists
+	}
 	if dec.GPO != nil {
 		c.GPO = *dec.GPO
 	}
@@ -167,6 +167,12 @@ type TxFetcher struct {
 	requests   map[string]*txRequest               // In-flight transaction retrievals
 	alternates map[common.Hash]map[string]struct{} // In-flight transaction alternate origins if retrieval fails
 
+	// Retrieval batching: idle peers with few queued transactions are held back
+	// for a while, coalescing further announcements into larger requests.
+	coalescing     map[string]mclock.AbsTime // Peers with retrievals held back, and since when
+	coalesceWindow time.Duration             // Time retrievals may be held back (0 = fetch immediately)
+	batchSize      int                       // Maximum number of transactions per retrieval
+
 	// Callbacks
 	hasTx    func(common.Hash) bool             // Retrieves a tx from the local txpool
 	addTxs   func([]*types.Transaction) []error // Insert a batch of transactions into local txpool
@@ -201,6 +207,8 @@ func NewTxFetcherForTests(
 		fetching:    make(map[common.Hash]string),
 		requests:    make(map[string]*txRequest),
 		alternates:  make(map[common.Hash]map[string]struct{}),
+		coalescing:  make(map[string]mclock.AbsTime),
+		batchSize:   maxTxRetrievals,
 		underpriced: mapset.NewSet(),
 		hasTx:       hasTx,
 		addTxs:      addTxs,
@@ -210,6 +218,18 @@ func NewTxFetcherForTests(
 	}
 }
 
+// SetCoalescing configures the fetcher to hold back the retrieval of announced
+// transactions for up to window, batching them into requests of up to batch
+// transactions, fired early once a full batch is queued. It reduces the number
+// of requests when a cold pool is flooded with announcements. It must be called
+// before the fetcher is started.
+func (f *TxFetcher) SetCoalescing(window time.Duration, batch int) {
+	f.coalesceWindow = window
+	if batch > 0 {
+		f.batchSize = batch
+	}
+}
+
 // Notify announces the fetcher of the potential availability of a new batch of
 // transactions in the network.
 func (f *TxFetcher) Notify(peer string, hashes []common.Hash) error {
@@ -348,11 +368,13 @@ func (f *TxFetcher) Stop() {
 
 func (f *TxFetcher) loop() {
 	var (
-		waitTimer    = new(mclock.Timer)
-		timeoutTimer = new(mclock.Timer)
+		waitTimer     = new(mclock.Timer)
+		timeoutTimer  = new(mclock.Timer)
+		coalesceTimer = new(mclock.Timer)
 
-		waitTrigger    = make(chan struct{}, 1)
-		timeoutTrigger = make(chan struct{}, 1)
+		waitTrigger     = make(chan struct{}, 1)
+		timeoutTrigger  = make(chan struct{}, 1)
+		coalesceTrigger = make(chan struct{}, 1)
 	)
 	for {
 		select {
@@ -437,7 +459,7 @@ func (f *TxFetcher) loop() {
 			// If this peer is new and announced something already queued, maybe
 			// request transactions from them
 			if !oldPeer && len(f.announces[ann.origin]) > 0 {
-				f.scheduleFetches(timeoutTimer, timeoutTrigger, map[string]struct{}{ann.origin: {}})
+				f.scheduleFetches(timeoutTimer, timeoutTrigger, coalesceTimer, coalesceTrigger, map[string]struct{}{ann.origin: {}})
 			}
 
 		case <-waitTrigger:
@@ -473,7 +495,7 @@ func (f *TxFetcher) loop() {
 			}
 			// If any peers became active and are idle, request transactions from them
 			if len(actives) > 0 {
-				f.scheduleFetches(timeoutTimer, timeoutTrigger, actives)
+				f.scheduleFetches(timeoutTimer, timeoutTrigger, coalesceTimer, coalesceTrigger, actives)
 			}
 
 		case <-timeoutTrigger:
@@ -516,7 +538,7 @@ func (f *TxFetcher) loop() {
 				}
 			}
 			// Schedule a new transaction retrieval
-			f.scheduleFetches(timeoutTimer, timeoutTrigger, nil)
+			f.scheduleFetches(timeoutTimer, timeoutTrigger, coalesceTimer, coalesceTrigger, nil)
 
 			// No idea if we scheduled something or not, trigger the timer if needed
 			// TODO: can't we dump it into scheduleFetches somehow?
@@ -612,7 +634,7 @@ func (f *TxFetcher) loop() {
 					delete(f.fetching, hash)
 				}
 				// Something was delivered, try to rechedule requests
-				f.scheduleFetches(timeoutTimer, timeoutTrigger, nil) // Partial delivery may enable others to deliver too
+				f.scheduleFetches(timeoutTimer, timeoutTrigger, coalesceTimer, coalesceTrigger, nil) // Partial delivery may enable others to deliver too
 			}
 
 		case drop := <-f.drop:
@@ -662,12 +684,18 @@ func (f *TxFetcher) loop() {
 				}
 				delete(f.announces, drop.peer)
 			}
+			delete(f.coalescing, drop.peer)
 			// If a request was cancelled, check if anything needs to be rescheduled
 			if request != nil {
-				f.scheduleFetches(timeoutTimer, timeoutTrigger, nil)
+				f.scheduleFetches(timeoutTimer, timeoutTrigger, coalesceTimer, coalesceTrigger, nil)
 				f.rescheduleTimeout(timeoutTimer, timeoutTrigger)
 			}
 
+		case <-coalesceTrigger:
+			// At least one peer's retrievals were held back long enough, request
+			// whatever they accumulated
+			f.scheduleFetches(timeoutTimer, timeoutTrigger, coalesceTimer, coalesceTrigger, nil)
+
 		case <-f.quit:
 			return
 		}
@@ -750,8 +778,37 @@ func (f *TxFetcher) rescheduleTimeout(timer *mclock.Timer, trigger chan struct{}
 	})
 }
 
+// rescheduleCoalesce schedules a retrieval run when the first of the peers with
+// held back retrievals runs out of its coalescing window. Peers left without
+// anything to retrieve meanwhile are no longer held back.
+func (f *TxFetcher) rescheduleCoalesce(timer *mclock.Timer, trigger chan struct{}) {
+	if *timer != nil {
+		(*timer).Stop()
+	}
+	now := f.clock.Now()
+
+	earliest := now
+	for peer, since := range f.coalescing {
+		if len(f.announces[peer]) == 0 {
+			delete(f.coalescing, peer)
+			continue
+		}
+		if earliest > since {
+			earliest = since
+		}
+	}
+	if len(f.coalescing) == 0 {
+		return
+	}
+	*timer = f.clock.AfterFunc(f.coalesceWindow-time.Duration(now-earliest), func() {
+		trigger <- struct{}{}
+	})
+}
+
 // scheduleFetches starts a batch of retrievals for all available idle peers.
-func (f *TxFetcher) scheduleFetches(timer *mclock.Timer, timeout chan struct{}, whitelist map[string]struct{}) {
+// Peers with fewer than a batch of transactions queued are held back until the
+// coalescing window, if any, runs out.
+func (f *TxFetcher) scheduleFetches(timer *mclock.Timer, timeout chan struct{}, coalesceTimer *mclock.Timer, coalesce chan struct{}, whitelist map[string]struct{}) {
 	// Gather the set of peers we want to retrieve from (default to all)
 	actives := whitelist
 	if actives == nil {
@@ -771,47 +828,68 @@ func (f *TxFetcher) scheduleFetches(timer *mclock.Timer, timeout chan struct{},
 			return // continue in the for-each
 		}
 		if len(f.announces[peer]) == 0 {
+			delete(f.coalescing, peer)
 			return // continue in the for-each
 		}
-		hashes := make([]common.Hash, 0, maxTxRetrievals)
+		hashes := make([]common.Hash, 0, f.batchSize)
 		f.forEachHash(f.announces[peer], func(hash common.Hash) bool {
 			if _, ok := f.fetching[hash]; !ok {
-				// Mark the hash as fetching and stash away possible alternates
-				f.fetching[hash] = peer
-
-				if _, ok := f.alternates[hash]; ok {
-					panic(fmt.Sprintf("alternate tracker already contains fetching item: %v", f.alternates[hash]))
-				}
-				f.alternates[hash] = f.announced[hash]
-				delete(f.announced, hash)
-
 				// Accumulate the hash and stop if the limit was reached
 				hashes = append(hashes, hash)
-				if len(hashes) >= maxTxRetrievals {
+				if len(hashes) >= f.batchSize {
 					return false // break in the for-each
 				}
 			}
 			return true // continue in the for-each
 		})
-		// If any hashes were allocated, request them from the peer
-		if len(hashes) > 0 {
-			f.requests[peer] = &txRequest{hashes: hashes, time: f.clock.Now()}
-			txRequestOutMeter.Mark(int64(len(hashes)))
-
-			go func(peer string, hashes []common.Hash) {
-				// Try to fetch the transactions, but in case of a request
-				// failure (e.g. peer disconnected), reschedule the hashes.
-				if err := f.fetchTxs(peer, hashes); err != nil {
-					txRequestFailMeter.Mark(int64(len(hashes)))
-					f.Drop(peer)
-				}
-			}(peer, hashes)
+		if len(hashes) == 0 {
+			delete(f.coalescing, peer)
+			return // continue in the for-each
 		}
+		// Hold back partial batches until the coalescing window runs out
+		if len(hashes) < f.batchSize && f.coalesceWindow > 0 {
+			since, ok := f.coalescing[peer]
+			if !ok {
+				since = f.clock.Now()
+				f.coalescing[peer] = since
+			}
+			if time.Duration(f.clock.Now()-since) < f.coalesceWindow {
+				return // continue in the for-each
+			}
+		}
+		delete(f.coalescing, peer)
+
+		for _, hash := range hashes {
+			// Mark the hash as fetching and stash away possible alternates
+			f.fetching[hash] = peer
+
+			if _, ok := f.alternates[hash]; ok {
+				panic(fmt.Sprintf("alternate tracker already contains fetching item: %v", f.alternates[hash]))
+			}
+			f.alternates[hash] = f.announced[hash]
+			delete(f.announced, hash)
+		}
+		// Request the allocated hashes from the peer
+		f.requests[peer] = &txRequest{hashes: hashes, time: f.clock.Now()}
+		txRequestOutMeter.Mark(int64(len(hashes)))
+
+		go func(peer string, hashes []common.Hash) {
+			// Try to fetch the transactions, but in case of a request
+			// failure (e.g. peer disconnected), reschedule the hashes.
+			if err := f.fetchTxs(peer, hashes); err != nil {
+				txRequestFailMeter.Mark(int64(len(hashes)))
+				f.Drop(peer)
+			}
+		}(peer, hashes)
 	})
 	// If a new request was fired, schedule a timeout timer
 	if idle && len(f.requests) > 0 {
 		f.rescheduleTimeout(timer, timeout)
 	}
+	// If any retrievals are held back, schedule them for when their window ends
+	if f.coalesceWindow > 0 {
+		f.rescheduleCoalesce(coalesceTimer, coalesce)
+	}
 }
 
 // forEachPeer does a range loop over a map of peers in production, but during
@@ -18,7 +18,6 @@ package fetcher
 
 import (
 	"errors"
-	"math/big"
 	"math/rand"
 	"testing"
 	"time"
@@ -32,10 +31,10 @@ import (
 var (
 	// testTxs is a set of transactions to use during testing that have meaningful hashes.
 	testTxs = []*types.Transaction{
-		types.NewTransaction(5577006791947779410, common.Address{0x0f}, new(big.Int), 0, new(big.Int), nil),
-		types.NewTransaction(15352856648520921629, common.Address{0xbb}, new(big.Int), 0, new(big.Int), nil),
-		types.NewTransaction(3916589616287113937, common.Address{0x86}, new(big.Int), 0, new(big.Int), nil),
-		types.NewTransaction(9828766684487745566, common.Address{0xac}, new(big.Int), 0, new(big.Int), nil),
+		types.NewTx(&types.InternalTx{Nonce: 5577006791947779410}),
+		types.NewTx(&types.InternalTx{Nonce: 15352856648520921629}),
+		types.NewTx(&types.InternalTx{Nonce: 3916589616287113937}),
+		types.NewTx(&types.InternalTx{Nonce: 9828766684487745566}),
 	}
 	// testTxsHashes is the hashes of the test transactions above
 	testTxsHashes = []common.Hash{testTxs[0].Hash(), testTxs[1].Hash(), testTxs[2].Hash(), testTxs[3].Hash()}
@@ -482,13 +481,13 @@ func TestTransactionFetcherMissingRescheduling(t *testing.T) {
 			},
 			// Deliver the middle transaction requested, the one before which
 			// should be dropped and the one after re-requested.
-			doTxEnqueue{peer: "A", txs: []*types.Transaction{testTxs[0]}, direct: true}, // This depends on the deterministic random
+			doTxEnqueue{peer: "A", txs: []*types.Transaction{testTxs[1]}, direct: true}, // This depends on the deterministic random
 			isScheduled{
 				tracking: map[string][]common.Hash{
-					"A": {testTxsHashes[2]},
+					"A": {testTxsHashes[0]},
 				},
 				fetching: map[string][]common.Hash{
-					"A": {testTxsHashes[2]},
+					"A": {testTxsHashes[0]},
 				},
 			},
 		},
@@ -528,7 +527,7 @@ func TestTransactionFetcherMissingCleanup(t *testing.T) {
 			},
 			// Deliver the middle transaction requested, the one before which
 			// should be dropped and the one after re-requested.
-			doTxEnqueue{peer: "A", txs: []*types.Transaction{testTxs[1]}, direct: true}, // This depends on the deterministic random
+			doTxEnqueue{peer: "A", txs: []*types.Transaction{testTxs[0]}, direct: true}, // This depends on the deterministic random
 			isScheduled{nil, nil, nil},
 		},
 	})
@@ -793,6 +792,78 @@ func TestTransactionFetcherRateLimiting(t *testing.T) {
 	})
 }
 
+// Tests that transactions trickling in from an idle peer are held back for the
+// coalescing window and retrieved in a single request, while full batches are
+// retrieved right away.
+func TestTransactionFetcherCoalescing(t *testing.T) {
+	testTransactionFetcherParallel(t, txFetcherTest{
+		init: func() *TxFetcher {
+			fetcher := NewTxFetcher(
+				func(common.Hash) bool { return false },
+				nil,
+				func(string, []common.Hash) error { return nil },
+			)
+			fetcher.SetCoalescing(time.Second, 4)
+			return fetcher
+		},
+		steps: []interface{}{
+			// Announce transactions one by one, scheduled a bit apart
+			doTxNotify{peer: "A", hashes: []common.Hash{{0x01}}},
+			doWait{time: 200 * time.Millisecond, step: false},
+			doTxNotify{peer: "A", hashes: []common.Hash{{0x02}}},
+			doWait{time: 200 * time.Millisecond, step: false},
+			doTxNotify{peer: "A", hashes: []common.Hash{{0x03}}},
+
+			// Wait for them to get scheduled one by one, ensuring none is
+			// requested individually
+			doWait{time: 100 * time.Millisecond, step: true},
+			isScheduled{
+				tracking: map[string][]common.Hash{
+					"A": {{0x01}},
+				},
+			},
+			doWait{time: 200 * time.Millisecond, step: true},
+			isScheduled{
+				tracking: map[string][]common.Hash{
+					"A": {{0x01}, {0x02}},
+				},
+			},
+			doWait{time: 200 * time.Millisecond, step: true},
+			isWaiting(nil),
+			isScheduled{
+				tracking: map[string][]common.Hash{
+					"A": {{0x01}, {0x02}, {0x03}},
+				},
+			},
+			// Wait for the coalescing window to run out and ensure all of them
+			// are requested together
+			doWait{time: 600 * time.Millisecond, step: true},
+			isScheduled{
+				tracking: map[string][]common.Hash{
+					"A": {{0x01}, {0x02}, {0x03}},
+				},
+				fetching: map[string][]common.Hash{
+					"A": {{0x01}, {0x02}, {0x03}},
+				},
+			},
+			// Announce more than a batch at once and ensure a full batch is
+			// requested without waiting for the coalescing window
+			doTxNotify{peer: "B", hashes: []common.Hash{{0x04}, {0x05}, {0x06}, {0x07}, {0x08}}},
+			doWait{time: txArriveTimeout, step: true},
+			isScheduled{
+				tracking: map[string][]common.Hash{
+					"A": {{0x01}, {0x02}, {0x03}},
+					"B": {{0x04}, {0x05}, {0x06}, {0x07}, {0x08}},
+				},
+				fetching: map[string][]common.Hash{ // Depends on deterministic test randomizer
+					"A": {{0x01}, {0x02}, {0x03}},
+					"B": {{0x04}, {0x05}, {0x06}, {0x08}},
+				},
+			},
+		},
+	})
+}
+
 // Tests that then number of transactions a peer is allowed to announce and/or
 // request at the same time is hard capped.
 func TestTransactionFetcherDoSProtection(t *testing.T) {
@@ -908,7 +979,7 @@ func TestTransactionFetcherUnderpricedDoSProtection(t *testing.T) {
 	// Create a slew of transactions to max out the underpriced set
 	var txs []*types.Transaction
 	for i := 0; i < maxTxUnderpricedSetSize+1; i++ {
-		txs = append(txs, types.NewTransaction(rand.Uint64(), common.Address{byte(rand.Intn(256))}, new(big.Int), 0, new(big.Int), nil))
+		txs = append(txs, types.NewTx(&types.InternalTx{Nonce: rand.Uint64()}))
 	}
 	hashes := make([]common.Hash, len(txs))
 	for i, tx := range txs {
@@ -18,22 +18,27 @@ package eth
 
 import (
 	"errors"
+	"fmt"
 	"math"
+	"math/big"
 	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/common/mclock"
 	"github.com/dominant-strategies/go-quai/core"
 	"github.com/dominant-strategies/go-quai/core/types"
 	"github.com/dominant-strategies/go-quai/eth/downloader"
+	"github.com/dominant-strategies/go-quai/eth/ethconfig"
 	"github.com/dominant-strategies/go-quai/eth/fetcher"
 	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
 	"github.com/dominant-strategies/go-quai/ethdb"
 	"github.com/dominant-strategies/go-quai/event"
 	"github.com/dominant-strategies/go-quai/log"
 	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
 )
 
 const (
@@ -56,6 +61,33 @@ const (
 	// missingParentChanSize is the size of channel listening to the MissingParentEvent
 	missingParentChanSize = 10
 
+	// chainHeadChanSize is the size of channel listening to ChainHeadEvent.
+	chainHeadChanSize = 10
+
+	// capabilitiesRefreshInterval is the time between two refreshes of the serving
+	// capabilities of the connected peers, which change as they prune state.
+	capabilitiesRefreshInterval = 10 * time.Minute
+
+	// poolSnapshotPeers is the number of peers asked for the transactions in
+	// their pools once the node starts accepting transactions.
+	poolSnapshotPeers = 3
+
+	// poolSnapshotLimit is the maximum number of transaction hashes requested
+	// from each peer in a pool snapshot.
+	poolSnapshotLimit = 4096
+
+	// unclePoolPeers is the number of peers asked for their uncle candidates
+	// once the node starts accepting transactions.
+	unclePoolPeers = 3
+
+	// unclePoolLimit is the maximum number of uncle candidates requested from
+	// each peer.
+	unclePoolLimit = 64
+
+	// blockProbeTimeout is the time to wait for a peer to answer whether it has a
+	// block, before giving up on requesting the block from it.
+	blockProbeTimeout = 5 * time.Second
+
 	// minPeerSend is the threshold for sending the block updates. If
 	// sqrt of len(peers) is less than 5 we make the block announcement
 	// to as much as minPeerSend peers otherwise send it to sqrt of len(peers).
@@ -68,6 +100,11 @@ const (
 
 	// minPeerSendTx is the minimum number of peers that will receive a new transaction.
 	minPeerSendTx = 2
+
+	// maxForeignTxs is the number of transactions originating outside of the
+	// local shard a peer may send before being dropped. Honest peers relay only
+	// what their pools accepted, so they should never send any.
+	maxForeignTxs = 64
 )
 
 // txPool defines the methods needed from a transaction pool implementation to
@@ -105,11 +142,30 @@ type handlerConfig struct {
 	EventMux      *event.TypeMux         // Legacy event mux, deprecate for `feed`
 	Whitelist     map[uint64]common.Hash // Hard coded whitelist for sync challenged
 	SlicesRunning []common.Location      // Slices run by the node
+	NodeID        enode.ID               // Identity of the local node, used to reject self-dials
+	Archive       bool                   // Whether the node retains the entire historical state
+
+	MinPeersPerLocation int                 // Peers to admit for each running slice even if full
+	MaxPeersPerLocation int                 // Maximum peers to admit per slice (0 = unlimited)
+	PinnedPeers         []ethconfig.PeerPin // Trusted peers preferred for retrieving each slice's data
+
+	MaxPendingHandshakes int         // Handshakes in progress at once (0 = unlimited)
+	Protocol             *eth.Config // Settings of the `eth` protocol handler (nil = defaults)
+
+	TxFetcher  ethconfig.TxFetcherConfig  // Batching of the announced transaction retrievals
+	Quarantine ethconfig.QuarantineConfig // Backoff schedule of the peers failing validation
+
+	Allowlist func(peer *eth.Peer) []uint64 // Message codes each peer may send (nil = unrestricted)
 }
 
 type handler struct {
 	networkID     uint64
+	nodeID        enode.ID          // Identity of the local node
+	archive       bool              // Whether the entire historical state is retained
 	slicesRunning []common.Location // Slices running on the node
+	chainID       *big.Int          // Chain id the transactions must be signed for, nil if unchecked
+
+	allowlist func(peer *eth.Peer) []uint64 // Classifier of the messages each peer may send
 
 	acceptTxs uint32 // Flag whether we're considered synchronised (enables transaction processing)
 
@@ -122,6 +178,16 @@ type handler struct {
 	blockFetcher *fetcher.BlockFetcher
 	txFetcher    *fetcher.TxFetcher
 	peers        *peerSet
+	peerEvents   *peerEventFeed
+	quarantine   *quarantine
+	handshakes   chan struct{} // Semaphore of the handshakes in progress, nil if unlimited
+	protocol     *eth.Config   // Settings of the `eth` protocol handler
+
+	mirror     *broadcastMirror // Sink copying the outbound broadcasts, nil if none
+	mirrorLock sync.RWMutex
+
+	propagatedBlocks *propagationFilter // Blocks originated or relayed, to drop looping broadcasts
+	propagatedTxs    *propagationFilter // Transactions broadcast, to drop looping broadcasts
 
 	eventMux              *event.TypeMux
 	txsCh                 chan core.NewTxsEvent
@@ -131,6 +197,8 @@ type handler struct {
 	missingPendingEtxsSub event.Subscription
 	missingParentCh       chan common.Hash
 	missingParentSub      event.Subscription
+	chainHeadCh           chan core.ChainHeadEvent
+	chainHeadSub          event.Subscription
 
 	pEtxCh                chan types.PendingEtxs
 	pEtxSub               event.Subscription
@@ -159,16 +227,34 @@ func newHandler(config *handlerConfig) (*handler, error) {
 	}
 	h := &handler{
 		networkID:     config.Network,
+		nodeID:        config.NodeID,
+		archive:       config.Archive,
 		slicesRunning: config.SlicesRunning,
+		chainID:       config.Core.Config().ChainID,
+		allowlist:     config.Allowlist,
 		eventMux:      config.EventMux,
 		database:      config.Database,
 		txpool:        config.TxPool,
 		core:          config.Core,
 		peers:         newPeerSet(),
+		peerEvents:    newPeerEventFeed(),
+		quarantine:    newQuarantine(config.Quarantine, mclock.System{}),
 		whitelist:     config.Whitelist,
 		txsyncCh:      make(chan *txsync),
 		quitSync:      make(chan struct{}),
+
+		propagatedBlocks: newPropagationFilter(maxPropagatedBlocks, 0, mclock.System{}),
+		propagatedTxs:    newPropagationFilter(maxPropagatedTxs, propagatedTxLifetime, mclock.System{}),
 	}
+	h.peers.setLocationLimits(config.SlicesRunning, config.MinPeersPerLocation, config.MaxPeersPerLocation)
+	h.protocol = config.Protocol
+	if h.protocol == nil {
+		h.protocol = &eth.DefaultConfig
+	}
+	if config.MaxPendingHandshakes > 0 {
+		h.handshakes = make(chan struct{}, config.MaxPendingHandshakes)
+	}
+	h.peers.setPinnedPeers(config.PinnedPeers)
 
 	h.downloader = downloader.New(h.eventMux, h.core, h.removePeer)
 
@@ -182,8 +268,11 @@ func newHandler(config *handlerConfig) (*handler, error) {
 	// writeBlock writes the block to the DB
 	writeBlock := func(block *types.Block) {
 		if nodeCtx == common.ZONE_CTX && block.NumberU64()-1 == h.core.CurrentHeader().NumberU64() && h.core.ProcessingState() {
-			if atomic.LoadUint32(&h.acceptTxs) != 1 {
-				atomic.StoreUint32(&h.acceptTxs, 1)
+			if atomic.CompareAndSwapUint32(&h.acceptTxs, 0, 1) {
+				// Catch up with the transactions and uncle candidates broadcast
+				// while syncing
+				go h.requestPoolSnapshots()
+				go h.requestUnclePools()
 			}
 		}
 		h.core.WriteBlock(block)
@@ -200,6 +289,7 @@ func newHandler(config *handlerConfig) (*handler, error) {
 			return p.RequestTxs(hashes)
 		}
 		h.txFetcher = fetcher.NewTxFetcher(h.txpool.Has, h.txpool.AddRemotes, fetchTx)
+		h.txFetcher.SetCoalescing(config.TxFetcher.CoalesceWindow, config.TxFetcher.BatchSize)
 	}
 	h.chainSync = newChainSyncer(h)
 	return h, nil
@@ -207,7 +297,7 @@ func newHandler(config *handlerConfig) (*handler, error) {
 
 // runEthPeer registers an eth peer into the joint eth peerset, adds it to
 // various subsystems and starts handling messages.
-func (h *handler) runEthPeer(peer *eth.Peer, handler eth.Handler) error {
+func (h *handler) runEthPeer(peer *eth.Peer, handler eth.Handler) (err error) {
 	nodeCtx := common.NodeLocation.Context()
 	if !h.chainSync.handlePeerEvent(peer) {
 		return p2p.DiscQuitting
@@ -215,41 +305,62 @@ func (h *handler) runEthPeer(peer *eth.Peer, handler eth.Handler) error {
 	h.peerWG.Add(1)
 	defer h.peerWG.Done()
 
+	if err := h.checkQuarantine(peer); err != nil {
+		peer.Log().Debug("Refusing quarantined peer", "err", err)
+		return err
+	}
 	// Execute the Quai handshake
-	var (
-		genesis = h.core.Genesis()
-		head    = h.core.CurrentHeader()
-		hash    = head.Hash()
-		entropy = h.core.CurrentLogEntropy()
-	)
-	if err := peer.Handshake(h.networkID, h.slicesRunning, entropy, hash, genesis.Hash()); err != nil {
+	status, err := eth.NewStatusPacket(h.core, peer.Version(), h.networkID, h.slicesRunning, h.protocol)
+	if err != nil {
+		peer.Log().Error("Failed to assemble local status", "err", err)
+		return err
+	}
+	if err := peer.CheckDeprecation(h.core.CurrentHeader().NumberU64()); err != nil {
+		peer.Log().Debug("Refusing peer on retired protocol version", "err", err)
+		return err
+	}
+	if err := h.handshake(peer, status); err != nil {
 		peer.Log().Debug("Quai handshake failed", "err", err)
 		return err
 	}
+	h.peerEvents.send(newPeerEvent(PeerEventNegotiated, peer, nil))
+	if h.allowlist != nil {
+		peer.SetAllowlist(h.allowlist(peer))
+	}
+
 	reject := false // reserved peer slots
 	// Ignore maxPeers if this is a trusted peer
 	if !peer.Peer.Info().Network.Trusted {
-		if reject || h.peers.len() >= h.maxPeers {
+		full := reject || h.peers.len() >= h.maxPeers
+		if !h.peers.admitsPeer(peer.SlicesRunning(), full) {
 			return p2p.DiscTooManyPeers
 		}
 	}
-	peer.Log().Debug("Quai peer connected", "name", peer.Name())
+	peer.Log().Debug("Quai peer connected", "name", peer.Name(), "client", peer.ClientVersion())
 
 	// Register the peer locally
 	if err := h.peers.registerPeer(peer); err != nil {
 		peer.Log().Error("Quai peer registration failed", "err", err)
 		return err
 	}
-	defer h.unregisterPeer(peer.ID())
+	h.peerEvents.send(newPeerEvent(PeerEventRegistered, peer, nil))
+	defer func() {
+		h.unregisterPeer(peer.ID())
+		h.recordDrop(peer, err)
+		h.peerEvents.send(newPeerEvent(PeerEventDropped, peer, err))
+	}()
 
 	p := h.peers.peer(peer.ID())
 	if p == nil {
 		return errors.New("peer dropped during handling")
 	}
-	// Register the peer in the downloader. If the downloader considers it banned, we disconnect
-	if err := h.downloader.RegisterPeer(peer.ID(), peer.Version(), peer); err != nil {
-		peer.Log().Error("Failed to register peer in eth syncer", "err", err)
-		return err
+	// Register the peer in the downloader. If the downloader considers it banned, we disconnect.
+	// Light peers serve no data to sync from, so they are kept out of it
+	if !peer.Light() {
+		if err := h.downloader.RegisterPeer(peer.ID(), peer.Version(), peer); err != nil {
+			peer.Log().Error("Failed to register peer in eth syncer", "err", err)
+			return err
+		}
 	}
 
 	h.chainSync.handlePeerEvent(peer)
@@ -266,6 +377,12 @@ func (h *handler) runEthPeer(peer *eth.Peer, handler eth.Handler) error {
 			return err
 		}
 	}
+	// Learn what the peer serves, refreshed periodically afterwards
+	if !peer.Light() && peer.Version() >= eth.ETH66 {
+		if err := peer.RequestCapabilities(); err != nil {
+			return err
+		}
+	}
 	// Handle incoming messages until the connection is torn down
 	return handler(peer)
 }
@@ -278,6 +395,27 @@ func (h *handler) removePeer(id string) {
 	}
 }
 
+// fetchBody retrieves the body of a block directly from the peer with the given
+// id, bypassing the local caches and the downloader scheduling. The expected size
+// of the block decides whether the peer is probed for it first.
+func (h *handler) fetchBody(id string, hash common.Hash, size common.StorageSize, timeout time.Duration) (*eth.BlockBody, error) {
+	peer, err := h.fetchPeer(id)
+	if err != nil {
+		return nil, err
+	}
+	return peer.FetchBody(hash, size, timeout)
+}
+
+// fetchPeer retrieves the registered peer with the given id, for the direct
+// retrievals bypassing the downloader scheduling.
+func (h *handler) fetchPeer(id string) (*ethPeer, error) {
+	peer := h.peers.peer(id)
+	if peer == nil {
+		return nil, fmt.Errorf("%w: %s", errPeerNotRegistered, id)
+	}
+	return peer, nil
+}
+
 // unregisterPeer removes a peer from the downloader, fetchers and main peer set.
 func (h *handler) unregisterPeer(id string) {
 	// Create a custom logger to avoid printing the entire id
@@ -295,7 +433,9 @@ func (h *handler) unregisterPeer(id string) {
 		return
 	}
 
-	h.downloader.UnregisterPeer(id)
+	if !peer.Light() {
+		h.downloader.UnregisterPeer(id)
+	}
 	nodeCtx := common.NodeLocation.Context()
 	if nodeCtx == common.ZONE_CTX && h.core.ProcessingState() {
 		h.txFetcher.Drop(id)
@@ -329,6 +469,12 @@ func (h *handler) Start(maxPeers int) {
 	h.missingParentSub = h.core.SubscribeMissingParentEvent(h.missingParentCh)
 	go h.missingParentLoop()
 
+	// announce head changes to eth/67 peers
+	h.wg.Add(1)
+	h.chainHeadCh = make(chan core.ChainHeadEvent, chainHeadChanSize)
+	h.chainHeadSub = h.core.SubscribeChainHeadEvent(h.chainHeadCh)
+	go h.statusDeltaLoop()
+
 	// broadcast mined blocks
 	h.wg.Add(1)
 	h.minedBlockSub = h.eventMux.Subscribe(core.NewMinedBlockEvent{})
@@ -337,6 +483,9 @@ func (h *handler) Start(maxPeers int) {
 	// start sync handlers
 	h.wg.Add(1)
 	go h.chainSync.loop()
+
+	h.wg.Add(1)
+	go h.capabilitiesLoop()
 	if nodeCtx == common.ZONE_CTX && h.core.ProcessingState() {
 		h.wg.Add(1)
 		go h.txsyncLoop64() //Legacy initial tx echange, drop with eth/64.
@@ -368,10 +517,11 @@ func (h *handler) Stop() {
 	h.missingPendingEtxsSub.Unsubscribe() // quits pendingEtxsBroadcastLoop
 	h.missingPEtxsRollupSub.Unsubscribe() // quits missingPEtxsRollupSub
 	h.missingParentSub.Unsubscribe()      // quits missingParentLoop
+	h.chainHeadSub.Unsubscribe()          // quits statusDeltaLoop
 	h.pEtxSub.Unsubscribe()               // quits pEtxSub
 	h.pEtxRollupSub.Unsubscribe()         // quits pEtxRollupSub
 
-	// Quit chainSync and txsync64.
+	// Quit chainSync, txsync64 and the capabilities refresh.
 	// After this is done, no new peers will be accepted.
 	close(h.quitSync)
 	h.wg.Wait()
@@ -383,45 +533,71 @@ func (h *handler) Stop() {
 	h.peers.close()
 	h.peerWG.Wait()
 
+	// Stop mirroring the broadcasts
+	h.SetBroadcastMirror(nil)
+
 	log.Info("Quai protocol stopped")
 }
 
 // BroadcastBlock will either propagate a block to a subset of its peers, or
 // will only announce its availability (depending what's requested).
 func (h *handler) BroadcastBlock(block *types.Block, propagate bool) {
-	hash := block.Hash()
-	peers := h.peers.peersWithoutBlock(hash)
-
 	// If propagation is requested, send to a subset of the peer
 	if propagate {
-		// Send the block to a subset of our peers
-		var peerThreshold int
-		sqrtNumPeers := int(math.Sqrt(float64(len(peers))))
-		if sqrtNumPeers < minPeerSend {
-			peerThreshold = len(peers)
-		} else {
-			peerThreshold = sqrtNumPeers
-		}
-		transfer := peers[:peerThreshold]
-		for _, peer := range transfer {
-			peer.AsyncSendNewBlock(block)
-		}
-		log.Trace("Propagated block", "hash", hash, "recipients", len(transfer), "duration", common.PrettyDuration(time.Since(block.ReceivedAt)))
+		h.propagateBlock(block, h.core.TotalLogS(block.Header()))
 		return
 	}
+	hash := block.Hash()
+	peers := h.peers.peersWithoutBlock(hash)
+
 	// Otherwise if the block is indeed in out own chain, announce it
 	if h.core.HasBlock(hash, block.NumberU64()) {
 		for _, peer := range peers {
 			peer.AsyncSendNewBlockHash(block)
 		}
+		h.mirrorBroadcast(eth.NewBlockHashesMsg, len(peers), block, nil)
 		log.Trace("Announced block", "hash", hash, "recipients", len(peers), "duration", common.PrettyDuration(time.Since(block.ReceivedAt)))
 	}
 }
 
+// propagateBlock sends a block to a subset of the peers not knowing about it yet.
+// Peers whose advertised head entropy is at or beyond the entropy of the block are
+// skipped, as they're ahead and don't need it. Blocks are propagated only once,
+// any later attempt being a loop through the network.
+func (h *handler) propagateBlock(block *types.Block, entropy *big.Int) {
+	hash := block.Hash()
+	if !h.propagatedBlocks.mark(hash) {
+		log.Trace("Dropped looping block propagation", "hash", hash)
+		return
+	}
+	var peers []*ethPeer
+	for _, peer := range h.peers.peersWithoutBlock(hash) {
+		if _, _, head, _ := peer.Head(); entropy != nil && head != nil && head.Cmp(entropy) >= 0 {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	// Send the block to a subset of our peers
+	var peerThreshold int
+	sqrtNumPeers := int(math.Sqrt(float64(len(peers))))
+	if sqrtNumPeers < minPeerSend {
+		peerThreshold = len(peers)
+	} else {
+		peerThreshold = sqrtNumPeers
+	}
+	transfer := peers[:peerThreshold]
+	for _, peer := range transfer {
+		peer.AsyncSendNewBlock(block)
+	}
+	h.mirrorBroadcast(eth.NewBlockMsg, len(transfer), block, nil)
+	log.Trace("Propagated block", "hash", hash, "recipients", len(transfer), "duration", common.PrettyDuration(time.Since(block.ReceivedAt)))
+}
+
 // BroadcastTransactions will propagate a batch of transactions
 // - To a square root of all peers
 // - And, separately, as announcements to all peers which are not known to
 // already have the given transaction.
+// Transactions already broadcast before are skipped.
 func (h *handler) BroadcastTransactions(txs types.Transactions) {
 	var (
 		annoCount   int // Count of announcements made
@@ -432,9 +608,14 @@ func (h *handler) BroadcastTransactions(txs types.Transactions) {
 		txset = make(map[*ethPeer][]common.Hash) // Set peer->hash to transfer directly
 		annos = make(map[*ethPeer][]common.Hash) // Set peer->hash to announce
 
+		direct    []common.Hash // Transactions sent directly to any peer
+		announced []common.Hash // Transactions announced to any peer
 	)
 	// Broadcast transactions to a batch of peers not knowing about it
 	for _, tx := range txs {
+		if !h.propagatedTxs.mark(tx.Hash()) {
+			continue
+		}
 		peers := h.peers.peersWithoutTransaction(tx.Hash())
 		// Send the tx unconditionally to a subset of our peers
 		numDirect := int(math.Sqrt(float64(len(peers))))
@@ -451,10 +632,16 @@ func (h *handler) BroadcastTransactions(txs types.Transactions) {
 		for _, peer := range subset {
 			txset[peer] = append(txset[peer], tx.Hash())
 		}
+		if len(subset) > 0 {
+			direct = append(direct, tx.Hash())
+		}
 		// For the remaining peers, send announcement only
 		for _, peer := range peers[numDirect:] {
 			annos[peer] = append(annos[peer], tx.Hash())
 		}
+		if len(peers) > numDirect {
+			announced = append(announced, tx.Hash())
+		}
 	}
 	for peer, hashes := range txset {
 		directPeers++
@@ -466,6 +653,8 @@ func (h *handler) BroadcastTransactions(txs types.Transactions) {
 		annoCount += len(hashes)
 		peer.AsyncSendPooledTransactionHashes(hashes)
 	}
+	h.mirrorBroadcast(eth.TransactionsMsg, directPeers, nil, direct)
+	h.mirrorBroadcast(eth.NewPooledTransactionHashesMsg, annoPeers, nil, announced)
 	log.Debug("Transaction broadcast", "txs", len(txs),
 		"announce packs", annoPeers, "announced hashes", annoCount,
 		"tx packs", directPeers, "broadcast txs", directCount)
@@ -522,7 +711,7 @@ func (h *handler) missingPendingEtxsLoop() {
 		case hashAndLocation := <-h.missingPendingEtxsCh:
 			// Only ask from peers running the slice for the missing pending etxs
 			// In the future, peers not responding before the timeout has to be punished
-			peersRunningSlice := h.peers.peerRunningSlice(hashAndLocation.Location)
+			peersRunningSlice := h.peers.peersForSlice(hashAndLocation.Location)
 			// If the node doesn't have any peer running that slice, add a warning
 			if len(peersRunningSlice) == 0 {
 				log.Warn("Node doesn't have peers for given Location", "location", hashAndLocation.Location)
@@ -544,9 +733,19 @@ func (h *handler) missingParentLoop() {
 	for {
 		select {
 		case hash := <-h.missingParentCh:
-			// Check if any of the peers have the body
-			for _, peer := range h.selectSomePeers() {
+			// Ask the peers pinned for the local slice first, if any is connected
+			peers := h.peers.pinnedPeers(common.NodeLocation)
+			if len(peers) == 0 {
+				peers = h.selectSomePeers()
+			}
+			// Parents are expected to be about the size of the current block
+			size := h.core.CurrentBlock().Size()
+			for _, peer := range peers {
 				log.Trace("Fetching the missing parent from", "peer", peer.ID(), "hash", hash)
+				if peer.ShouldProbeBlock(size) {
+					go h.probeAndRequestBlock(peer, hash)
+					continue
+				}
 				peer.RequestBlockByHash(hash)
 			}
 		case <-h.missingParentSub.Err():
@@ -555,6 +754,106 @@ func (h *handler) missingParentLoop() {
 	}
 }
 
+// capabilitiesLoop periodically refreshes the serving capabilities of the peers,
+// which would otherwise be stuck at what they reported on connecting.
+func (h *handler) capabilitiesLoop() {
+	defer h.wg.Done()
+
+	refresh := time.NewTicker(capabilitiesRefreshInterval)
+	defer refresh.Stop()
+
+	for {
+		select {
+		case <-refresh.C:
+			h.refreshCapabilities()
+		case <-h.quitSync:
+			return
+		}
+	}
+}
+
+// refreshCapabilities requests the current serving capabilities of the peers
+// serving requests.
+func (h *handler) refreshCapabilities() {
+	for _, peer := range h.peers.servingPeers() {
+		if peer.Version() < eth.ETH66 {
+			continue
+		}
+		if err := peer.RequestCapabilities(); err != nil {
+			peer.Log().Debug("Failed to request capabilities", "err", err)
+		}
+	}
+}
+
+// requestPoolSnapshots asks a few peers for the transactions pending in their
+// pools, the unknown ones being retrieved like announced ones.
+func (h *handler) requestPoolSnapshots() {
+	for _, peer := range h.somePeersSupporting(eth.GetPoolSnapshotMsg, poolSnapshotPeers) {
+		if err := peer.RequestPoolSnapshot(common.NodeLocation, poolSnapshotLimit); err != nil {
+			peer.Log().Debug("Failed to request pool snapshot", "err", err)
+		}
+	}
+}
+
+// requestUnclePools asks a few peers for their uncle candidates, the unknown ones
+// being retrieved like announced blocks for the local miner to include.
+func (h *handler) requestUnclePools() {
+	for _, peer := range h.somePeersSupporting(eth.GetUnclePoolMsg, unclePoolPeers) {
+		if err := peer.RequestUnclePool(unclePoolLimit); err != nil {
+			peer.Log().Debug("Failed to request uncle pool", "err", err)
+		}
+	}
+}
+
+// somePeersSupporting returns at most count random peers running the local slice
+// and serving the given optional message.
+func (h *handler) somePeersSupporting(code uint64, count int) []*eth.Peer {
+	peers := h.peers.peersSupporting(common.NodeLocation, code)
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > count {
+		peers = peers[:count]
+	}
+	return peers
+}
+
+// statusDeltaLoop announces the new heads of the local chain to the eth/67 peers
+// through status deltas, keeping their view of the local head current without
+// waiting for block announcements.
+func (h *handler) statusDeltaLoop() {
+	defer h.wg.Done()
+	for {
+		select {
+		case ev := <-h.chainHeadCh:
+			h.announceHead(ev.Block.Hash(), h.core.TotalLogS(ev.Block.Header()))
+		case <-h.chainHeadSub.Err():
+			return
+		}
+	}
+}
+
+// announceHead sends a status delta with the given head to the eth/67 peers.
+func (h *handler) announceHead(head common.Hash, entropy *big.Int) {
+	for _, peer := range h.peers.allPeers() {
+		if peer.Version() < eth.ETH67 {
+			continue
+		}
+		if err := peer.SendStatusDelta(head, entropy); err != nil {
+			peer.Log().Debug("Failed to send status delta", "err", err)
+		}
+	}
+}
+
+// probeAndRequestBlock requests a block from a peer only after it confirmed
+// having the block, to avoid requesting large blocks from peers lacking them.
+func (h *handler) probeAndRequestBlock(peer *eth.Peer, hash common.Hash) {
+	have, err := peer.FetchHaveBlock(hash, blockProbeTimeout)
+	if err != nil || !have {
+		log.Trace("Peer lacks the missing parent", "peer", peer.ID(), "hash", hash, "err", err)
+		return
+	}
+	peer.RequestBlockByHash(hash)
+}
+
 // pEtxLoop  listens to the pendingEtxs event in Slice and anounces the pEtx to the peer
 func (h *handler) broadcastPEtxLoop() {
 	defer h.wg.Done()
@@ -626,15 +925,17 @@ func (h *handler) BroadcastPendingEtxsRollup(pEtxRollup types.PendingEtxsRollup)
 }
 
 func (h *handler) selectSomePeers() []*eth.Peer {
+	// Light peers don't serve requests, only select among the others
+	allPeers := h.peers.servingPeers()
+
 	// Get the min(sqrt(len(peers)), minPeerRequest)
-	count := int(math.Sqrt(float64(len(h.peers.allPeers()))))
+	count := int(math.Sqrt(float64(len(allPeers))))
 	if count < minPeerRequest {
 		count = minPeerRequest
 	}
-	if count > len(h.peers.allPeers()) {
-		count = len(h.peers.allPeers())
+	if count > len(allPeers) {
+		count = len(allPeers)
 	}
-	allPeers := h.peers.allPeers()
 
 	// shuffle the filteredPeers
 	rand.Shuffle(len(allPeers), func(i, j int) { allPeers[i], allPeers[j] = allPeers[j], allPeers[i] })
@@ -0,0 +1,65 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/common/mclock"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+)
+
+// Tests that propagated blocks are only sent to the peers whose advertised head
+// is behind the block, skipping the ones already at or beyond it.
+func TestPropagateBlockSkipsAheadPeers(t *testing.T) {
+	header := types.EmptyHeader()
+	header.SetNumber(big.NewInt(10))
+	block := types.NewBlockWithHeader(header)
+
+	tests := []struct {
+		entropy int64
+		receive bool
+	}{
+		{5, true},   // Behind
+		{9, true},   // Just behind
+		{10, false}, // At the block
+		{20, false}, // Ahead
+	}
+	var (
+		h     = &handler{peers: newPeerSet(), propagatedBlocks: newPropagationFilter(maxPropagatedBlocks, 0, mclock.System{})}
+		peers []*eth.Peer
+	)
+	for i, tt := range tests {
+		peer := newSlicePeer(t, byte(i+1), []common.Location{{0, 0}})
+		peers = append(peers, peer)
+		peer.SetHead(common.Hash{byte(i + 1)}, big.NewInt(tt.entropy), big.NewInt(tt.entropy), time.Now())
+		if err := h.peers.registerPeer(peer); err != nil {
+			t.Fatalf("peer %d: failed to register: %v", i, err)
+		}
+	}
+	h.propagateBlock(block, big.NewInt(10))
+
+	for i, tt := range tests {
+		if received := peers[i].KnownBlock(block.Hash()); received != tt.receive {
+			t.Errorf("peer %d: propagation mismatch: have %v, want %v", i, received, tt.receive)
+		}
+	}
+}
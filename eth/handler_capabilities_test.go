@@ -0,0 +1,68 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// Tests that refreshing the capabilities of the peers requests them anew, and
+// that the answers replace the ones recorded on the peers.
+func TestRefreshCapabilities(t *testing.T) {
+	h := &handler{peers: newPeerSet()}
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	peer := eth.NewPeer(eth.ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), net, nil)
+	defer peer.Close()
+	if err := h.peers.registerPeer(peer); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	peer.SetCapabilities(&eth.CapabilitiesPacket{Archive: true})
+	go eth.Handle((*ethHandler)(h), peer)
+
+	go h.refreshCapabilities()
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	if msg.Code != eth.GetCapabilitiesMsg {
+		t.Fatalf("request mismatch: have %#x, want %#x", msg.Code, eth.GetCapabilitiesMsg)
+	}
+	var query eth.GetCapabilitiesPacket66
+	if err := msg.Decode(&query); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	p2p.Send(app, eth.CapabilitiesMsg, &eth.CapabilitiesPacket66{
+		RequestId:          query.RequestId,
+		CapabilitiesPacket: eth.CapabilitiesPacket{PrunedDepth: 128},
+	})
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		if caps := peer.Capabilities(); !caps.Archive && caps.PrunedDepth == 128 {
+			return
+		}
+	}
+	t.Errorf("capabilities not refreshed: have %+v", peer.Capabilities())
+}
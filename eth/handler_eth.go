@@ -19,6 +19,7 @@ package eth
 import (
 	"errors"
 	"fmt"
+	"math/big"
 	"sync/atomic"
 	"time"
 
@@ -34,6 +35,10 @@ const (
 	MaxBlockFetchDist = 50
 )
 
+// errForeignTxs is returned if a peer keeps sending transactions originating
+// outside of the local shard.
+var errForeignTxs = errors.New("too many foreign transactions")
+
 // ethHandler implements the eth.Backend interface to handle the various network
 // packets that are sent as replies or broadcasts.
 type ethHandler handler
@@ -65,6 +70,14 @@ func (h *ethHandler) AcceptTxs() bool {
 	return atomic.LoadUint32(&h.acceptTxs) == 1
 }
 
+// Capabilities retrieves the data serving capabilities of the local node.
+func (h *ethHandler) Capabilities() eth.CapabilitiesPacket {
+	if h.archive {
+		return eth.CapabilitiesPacket{Archive: true}
+	}
+	return eth.CapabilitiesPacket{PrunedDepth: core.TriesInMemory}
+}
+
 // Handle is invoked from a peer's message handler when it receives a new remote
 // message that the handler couldn't consume and serve itself.
 func (h *ethHandler) Handle(peer *eth.Peer, packet eth.Packet) error {
@@ -87,11 +100,19 @@ func (h *ethHandler) Handle(peer *eth.Peer, packet eth.Packet) error {
 	case *eth.NewPooledTransactionHashesPacket:
 		return h.txFetcher.Notify(peer.ID(), *packet)
 
+	case *eth.PoolSnapshotPacket:
+		if packet.Refused {
+			peer.Log().Debug("Pool snapshot refused")
+			return nil
+		}
+		// Retrieve the unknown transactions like announced ones
+		return h.txFetcher.Notify(peer.ID(), packet.Hashes)
+
 	case *eth.TransactionsPacket:
-		return h.txFetcher.Enqueue(peer.ID(), *packet, false)
+		return h.handleTransactions(peer, *packet, false)
 
 	case *eth.PooledTransactionsPacket:
-		return h.txFetcher.Enqueue(peer.ID(), *packet, true)
+		return h.handleTransactions(peer, *packet, true)
 
 	case *eth.PendingEtxsPacket:
 		return h.handlePendingEtxs(*&packet.PendingEtxs)
@@ -99,11 +120,111 @@ func (h *ethHandler) Handle(peer *eth.Peer, packet eth.Packet) error {
 	case *eth.PendingEtxsRollupPacket:
 		return h.handlePendingEtxsRollup(peer, *&packet.PendingEtxsRollup)
 
+	case *eth.EtxRollupsByRangePacket:
+		for _, rollup := range *packet {
+			if err := h.handlePendingEtxsRollup(peer, rollup); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case *eth.BlockTxHashesPacket,
+		*eth.HeadersByNumbersPacket,
+		*eth.PendingEtxsByLocationPacket,
+		*eth.BlockEtxRootsPacket,
+		*eth.FreshBlockBodiesPacket,
+		*eth.BlockMinersPacket,
+		*eth.UnclesByRangePacket,
+		*eth.BlockByNumberPacket,
+		*eth.EtxManifestProofPacket,
+		*eth.CanonicalHashPacket,
+		*eth.PendingEtxsSincePacket,
+		*eth.PartialBodiesPacket,
+		*eth.HeadersByMinerPacket,
+		*eth.TxNonInclusionProofPacket,
+		*eth.HaveBlockReplyPacket:
+		// These are only requested through direct fetches, which consume their
+		// replies. The ones reaching here arrived after the fetch gave up.
+		return nil
+
+	case *eth.UnclePoolPacket:
+		// Retrieve the unknown uncle candidates like announced blocks, making
+		// them available to the local miner
+		hashes, numbers := packet.Unpack()
+		return h.handleBlockAnnounces(peer, hashes, numbers)
+
+	case *eth.BlockDataPacket:
+		// Block data is requested by the downloader in place of block bodies
+		headers, txs, uncles, etxs, manifests := packet.Unpack()
+		if err := h.downloader.DeliverBlockData(peer.ID(), headers, txs, uncles, etxs, manifests); err != nil {
+			log.Debug("Failed to deliver block data", "err", err)
+		}
+		return nil
+
+	case *eth.StatusDeltaPacket:
+		// The protocol handler already applied the delta to the peer's head,
+		// there is nothing internal to deliver it to
+		return nil
+
+	case *eth.CapabilitiesPacket:
+		// Capabilities are recorded on the peer by the protocol handler
+		return nil
+
+	case *eth.HeadPacket:
+		// Refresh our view of the peer's head, ignoring the empty answers for
+		// locations the peer doesn't serve
+		if packet.Hash == (common.Hash{}) || packet.Entropy == nil {
+			return nil
+		}
+		if err := peer.TrackEntropy(new(big.Int).SetUint64(packet.Number), packet.Entropy); err != nil {
+			return err
+		}
+		peer.SetHead(packet.Hash, new(big.Int).SetUint64(packet.Number), packet.Entropy, time.Now())
+		return nil
+
 	default:
 		return fmt.Errorf("unexpected eth packet type: %T", packet)
 	}
 }
 
+// handleTransactions is invoked from a peer's message handler when it transmits a
+// batch of transactions, either broadcast or directly requested. Transactions sent
+// from outside of the local shard or signed for another chain are filtered out
+// before reaching the pool, and peers persistently sending them are dropped.
+func (h *ethHandler) handleTransactions(peer *eth.Peer, txs []*types.Transaction, direct bool) error {
+	local := make([]*types.Transaction, 0, len(txs))
+	for _, tx := range txs {
+		// Check the chain id before the costlier sender recovery
+		if h.chainID != nil && tx.ChainId().Cmp(h.chainID) != 0 {
+			continue
+		}
+		if inLocalShard(tx) {
+			local = append(local, tx)
+		}
+	}
+	if foreign := len(txs) - len(local); foreign > 0 {
+		p := h.peers.peer(peer.ID())
+		if p == nil {
+			return errors.New("unregistered during callback")
+		}
+		peer.Log().Debug("Discarded foreign transactions", "count", foreign)
+		if total := p.addForeignTxs(foreign); total > maxForeignTxs {
+			return fmt.Errorf("%w: %d", errForeignTxs, total)
+		}
+	}
+	return h.txFetcher.Enqueue(peer.ID(), local, direct)
+}
+
+// inLocalShard reports whether a transaction was sent from the local shard. The
+// transactions with invalid signatures are left to the pool to reject.
+func inLocalShard(tx *types.Transaction) bool {
+	from, err := types.Sender(types.NewSigner(tx.ChainId()), tx)
+	if err != nil {
+		return true
+	}
+	return from.Location().Equal(common.NodeLocation)
+}
+
 // handleHeaders is invoked from a peer's message handler when it transmits a batch
 // of headers for the local node to process.
 func (h *ethHandler) handleHeaders(peer *eth.Peer, headers []*types.Header) error {
@@ -192,11 +313,22 @@ func (h *ethHandler) handleBlockBroadcast(peer *eth.Peer, block *types.Block) er
 		log.Warn("Bad Hashes still exist on chain, cannot handle block broadcast yet")
 		return nil
 	}
-	// Schedule the block for import
-	h.blockFetcher.Enqueue(peer.ID(), block)
+	// Drop the blocks we originated or relayed ourselves, they're looping back
+	// through the network. The peer still has the block, so track its head.
+	if h.propagatedBlocks.contains(block.Hash()) {
+		log.Trace("Dropped looping block broadcast", "peer", peer.ID(), "hash", block.Hash())
+	} else {
+		// Schedule the block for import
+		h.blockFetcher.Enqueue(peer.ID(), block)
+	}
 
 	log.Info("Received Block Broadcast", "Hash", block.Hash(), "Number", block.Header().NumberArray())
 	blockS := h.core.TotalLogS(block.Header())
+	if blockS != nil {
+		if err := peer.TrackEntropy(block.Number(), blockS); err != nil {
+			return err
+		}
+	}
 	_, _, peerEntropy, _ := peer.Head()
 	if blockS != nil && peerEntropy != nil {
 		if peerEntropy.Cmp(blockS) < 0 {
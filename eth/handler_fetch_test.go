@@ -0,0 +1,93 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// Tests that a targeted body fetch is served by the requested peer only, and the
+// reply is returned to the caller instead of the downloader.
+func TestFetchBodyFromPeer(t *testing.T) {
+	var (
+		h      = &handler{peers: newPeerSet()}
+		hash   = common.Hash{0x01}
+		served = make(chan byte, 2)
+	)
+	for id := byte(1); id <= 2; id++ {
+		app, net := p2p.MsgPipe()
+		defer app.Close()
+		defer net.Close()
+
+		peer := eth.NewPeer(eth.ETH66, p2p.NewPeer(enode.ID{id}, "peer", nil), net, nil)
+		defer peer.Close()
+		if err := h.peers.registerPeer(peer); err != nil {
+			t.Fatalf("peer %d: failed to register: %v", id, err)
+		}
+		go eth.Handle((*ethHandler)(h), peer)
+
+		// Serve a body identifying the peer, its only uncle being numbered after it
+		go func(id byte) {
+			msg, err := app.ReadMsg()
+			if err != nil {
+				return
+			}
+			var query eth.GetBlockBodiesPacket66
+			if err := msg.Decode(&query); err != nil || len(query.GetBlockBodiesPacket) != 1 || query.GetBlockBodiesPacket[0] != hash {
+				t.Errorf("peer %d: invalid body query: %v", id, err)
+				return
+			}
+			served <- id
+
+			uncle := types.EmptyHeader()
+			uncle.SetNumber(big.NewInt(int64(id)))
+			p2p.Send(app, eth.BlockBodiesMsg, &eth.BlockBodiesPacket66{
+				RequestId:         query.RequestId,
+				BlockBodiesPacket: eth.BlockBodiesPacket{{Uncles: []*types.Header{uncle}}},
+			})
+		}(id)
+	}
+	target := enode.ID{2}.String()
+	body, err := h.fetchBody(target, hash, 0, time.Second)
+	if err != nil {
+		t.Fatalf("failed to fetch body: %v", err)
+	}
+	if len(body.Uncles) != 1 || body.Uncles[0].Number().Uint64() != 2 {
+		t.Errorf("body not served by the targeted peer: %v", body.Uncles)
+	}
+	if id := <-served; id != 2 {
+		t.Errorf("query served by peer %d, want 2", id)
+	}
+	select {
+	case id := <-served:
+		t.Errorf("query also served by peer %d", id)
+	default:
+	}
+	// Fetches from unknown peers are rejected
+	if _, err := h.fetchBody(enode.ID{3}.String(), hash, 0, time.Second); !errors.Is(err, errPeerNotRegistered) {
+		t.Errorf("unknown peer error mismatch: have %v, want %v", err, errPeerNotRegistered)
+	}
+}
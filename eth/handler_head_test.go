@@ -0,0 +1,71 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// Tests that new local heads are announced through status deltas to the eth/67
+// peers only, older peers not understanding them.
+func TestAnnounceHeadStatusDelta(t *testing.T) {
+	h := &handler{peers: newPeerSet()}
+
+	codes := make(map[uint]chan uint64)
+	for i, version := range []uint{eth.ETH66, eth.ETH67} {
+		app, net := p2p.MsgPipe()
+		defer app.Close()
+		defer net.Close()
+
+		peer := eth.NewPeer(version, p2p.NewPeer(enode.ID{byte(i + 1)}, "peer", nil), net, nil)
+		defer peer.Close()
+		if err := h.peers.registerPeer(peer); err != nil {
+			t.Fatalf("peer %d: failed to register: %v", i, err)
+		}
+		codes[version] = make(chan uint64, 1)
+		go func(codes chan uint64) {
+			msg, err := app.ReadMsg()
+			if err != nil {
+				return
+			}
+			msg.Discard()
+			codes <- msg.Code
+		}(codes[version])
+	}
+	h.announceHead(common.Hash{0x01}, big.NewInt(100))
+
+	select {
+	case code := <-codes[eth.ETH67]:
+		if code != eth.StatusDeltaMsg {
+			t.Errorf("eth/67 message mismatch: have %#x, want %#x", code, eth.StatusDeltaMsg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("status delta not sent to eth/67 peer")
+	}
+	select {
+	case code := <-codes[eth.ETH66]:
+		t.Errorf("eth/66 peer sent message %#x", code)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
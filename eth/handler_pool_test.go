@@ -0,0 +1,139 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+)
+
+// registerOptionalPeers registers an eth/67 peer advertising each of the given
+// optional message sets, returning the codes each of them receives.
+func registerOptionalPeers(t *testing.T, h *handler, optional [][]uint64) []chan uint64 {
+	t.Helper()
+
+	codes := make([]chan uint64, len(optional))
+	for i, optional := range optional {
+		peer, app := newPipePeer(t, byte(i+1), &eth.StatusPacket{
+			ProtocolVersion: eth.ETH67,
+			NetworkID:       1,
+			Location:        common.NodeLocation.Name(),
+			SlicesRunning:   []common.Location{common.NodeLocation},
+			Entropy:         big.NewInt(1),
+			Optional:        optional,
+		}, &eth.DefaultConfig)
+
+		if err := h.peers.registerPeer(peer); err != nil {
+			t.Fatalf("peer %d: failed to register: %v", i, err)
+		}
+		codes[i] = make(chan uint64, 1)
+		go func(codes chan uint64) {
+			msg, err := app.ReadMsg()
+			if err != nil {
+				return
+			}
+			msg.Discard()
+			codes <- msg.Code
+		}(codes[i])
+	}
+	return codes
+}
+
+// collectRequests waits a bit for the requests sent to the peers, reporting the
+// ones which received one with the given code and failing on any other.
+func collectRequests(t *testing.T, codes []chan uint64, code uint64) []bool {
+	t.Helper()
+
+	time.Sleep(100 * time.Millisecond)
+
+	requested := make([]bool, len(codes))
+	for i := range codes {
+		select {
+		case have := <-codes[i]:
+			if have != code {
+				t.Errorf("peer %d: request mismatch: have %#x, want %#x", i, have, code)
+			}
+			requested[i] = true
+		default:
+		}
+	}
+	return requested
+}
+
+// Tests that pool snapshots are requested from a few of the peers serving them
+// only, the others not understanding the request.
+func TestRequestPoolSnapshots(t *testing.T) {
+	defer func(old common.Location) { common.NodeLocation = old }(common.NodeLocation)
+	common.NodeLocation = common.Location{0, 0}
+
+	h := &handler{peers: newPeerSet()}
+
+	optional := [][]uint64{nil, {eth.GetUnclePoolMsg}}
+	for i := 0; i < poolSnapshotPeers+2; i++ {
+		optional = append(optional, []uint64{eth.GetPoolSnapshotMsg})
+	}
+	codes := registerOptionalPeers(t, h, optional)
+	h.requestPoolSnapshots()
+
+	requested := collectRequests(t, codes, eth.GetPoolSnapshotMsg)
+	count := 0
+	for i, requested := range requested {
+		if requested && i < 2 {
+			t.Errorf("peer %d: pool snapshot requested without support", i)
+		}
+		if requested {
+			count++
+		}
+	}
+	if count != poolSnapshotPeers {
+		t.Errorf("pool snapshot request count mismatch: have %d, want %d", count, poolSnapshotPeers)
+	}
+}
+
+// Tests that uncle pools are requested from a few of the peers serving them only,
+// the others not understanding the request.
+func TestRequestUnclePools(t *testing.T) {
+	defer func(old common.Location) { common.NodeLocation = old }(common.NodeLocation)
+	common.NodeLocation = common.Location{0, 0}
+
+	h := &handler{peers: newPeerSet()}
+
+	optional := [][]uint64{nil, {eth.GetPoolSnapshotMsg}}
+	for i := 0; i < unclePoolPeers+2; i++ {
+		optional = append(optional, []uint64{eth.GetUnclePoolMsg})
+	}
+	codes := registerOptionalPeers(t, h, optional)
+	h.requestUnclePools()
+
+	requested := collectRequests(t, codes, eth.GetUnclePoolMsg)
+	count := 0
+	for i, requested := range requested {
+		if requested && i < 2 {
+			t.Errorf("peer %d: uncle pool requested without support", i)
+		}
+		if requested {
+			count++
+		}
+	}
+	if count != unclePoolPeers {
+		t.Errorf("uncle pool request count mismatch: have %d, want %d", count, unclePoolPeers)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/crypto"
+	"github.com/dominant-strategies/go-quai/eth/fetcher"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+)
+
+// newShardKey generates a key whose address belongs to the given shard.
+func newShardKey(t *testing.T, location common.Location) *ecdsa.PrivateKey {
+	for {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatalf("failed to generate key: %v", err)
+		}
+		if crypto.PubkeyToAddress(key.PublicKey).Location().Equal(location) {
+			return key
+		}
+	}
+}
+
+// newShardTxs creates a batch of transactions signed by the given key.
+func newShardTxs(t *testing.T, key *ecdsa.PrivateKey, n int) []*types.Transaction {
+	signer := types.NewSigner(big.NewInt(1))
+
+	txs := make([]*types.Transaction, n)
+	for i := range txs {
+		tx, err := types.SignNewTx(key, signer, &types.InternalTx{
+			ChainID:   big.NewInt(1),
+			Nonce:     uint64(i),
+			GasTipCap: big.NewInt(1),
+			GasFeeCap: big.NewInt(1),
+			Gas:       21000,
+			Value:     big.NewInt(1),
+		})
+		if err != nil {
+			t.Fatalf("failed to sign transaction: %v", err)
+		}
+		txs[i] = tx
+	}
+	return txs
+}
+
+// Tests that transactions sent from outside of the local shard are filtered out
+// before reaching the pool, and that peers persistently sending them are dropped.
+func TestForeignTransactionFiltering(t *testing.T) {
+	defer func(old common.Location) { common.NodeLocation = old }(common.NodeLocation)
+	common.NodeLocation = common.Location{0, 0}
+
+	// Transactions are added to the pool synchronously on delivery
+	added := make(map[common.Hash]bool)
+	addTxs := func(txs []*types.Transaction) []error {
+		for _, tx := range txs {
+			added[tx.Hash()] = true
+		}
+		return make([]error, len(txs))
+	}
+	txFetcher := fetcher.NewTxFetcher(func(common.Hash) bool { return false }, addTxs, func(string, []common.Hash) error { return nil })
+	txFetcher.Start()
+	defer txFetcher.Stop()
+
+	h := &ethHandler{peers: newPeerSet(), txFetcher: txFetcher}
+	peer := newSlicePeer(t, 1, []common.Location{{0, 0}})
+	if err := h.peers.registerPeer(peer); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	var (
+		local   = newShardTxs(t, newShardKey(t, common.Location{0, 0}), 4)
+		foreign = newShardTxs(t, newShardKey(t, common.Location{0, 1}), maxForeignTxs)
+	)
+	// Mixed batches only get the in-shard transactions pooled
+	for i, packet := range []eth.Packet{
+		&eth.TransactionsPacket{local[0], foreign[0], local[1]},
+		&eth.PooledTransactionsPacket{foreign[1], local[2], local[3]},
+	} {
+		if err := h.Handle(peer, packet); err != nil {
+			t.Fatalf("packet %d: failed to handle transactions: %v", i, err)
+		}
+	}
+	for i, tx := range local {
+		if !added[tx.Hash()] {
+			t.Errorf("in-shard tx %d: not pooled", i)
+		}
+	}
+	for i, tx := range foreign[:2] {
+		if added[tx.Hash()] {
+			t.Errorf("out-of-shard tx %d: pooled", i)
+		}
+	}
+	// Peers persisting with foreign transactions get dropped
+	packet := eth.TransactionsPacket(foreign[2:])
+	if err := h.Handle(peer, &packet); err != nil {
+		t.Fatalf("peer dropped at the foreign transaction limit: %v", err)
+	}
+	packet = eth.TransactionsPacket(foreign[:1])
+	if err := h.Handle(peer, &packet); !errors.Is(err, errForeignTxs) {
+		t.Errorf("error mismatch: have %v, want %v", err, errForeignTxs)
+	}
+}
+
+// Tests that transactions signed for another chain are discarded before their
+// sender is recovered, counting towards the foreign transactions of the peer.
+func TestTransactionChainIDFiltering(t *testing.T) {
+	defer func(old common.Location) { common.NodeLocation = old }(common.NodeLocation)
+	common.NodeLocation = common.Location{0, 0}
+
+	added := make(map[common.Hash]bool)
+	addTxs := func(txs []*types.Transaction) []error {
+		for _, tx := range txs {
+			added[tx.Hash()] = true
+		}
+		return make([]error, len(txs))
+	}
+	txFetcher := fetcher.NewTxFetcher(func(common.Hash) bool { return false }, addTxs, func(string, []common.Hash) error { return nil })
+	txFetcher.Start()
+	defer txFetcher.Stop()
+
+	h := &ethHandler{peers: newPeerSet(), txFetcher: txFetcher, chainID: big.NewInt(1)}
+	peer := newSlicePeer(t, 2, []common.Location{{0, 0}})
+	if err := h.peers.registerPeer(peer); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	key := newShardKey(t, common.Location{0, 0})
+
+	// Signed for another chain by a local sender
+	other, err := types.SignNewTx(key, types.NewSigner(big.NewInt(2)), &types.InternalTx{
+		ChainID:   big.NewInt(2),
+		GasTipCap: big.NewInt(1),
+		GasFeeCap: big.NewInt(1),
+		Gas:       21000,
+		Value:     big.NewInt(1),
+	})
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
+	// Claiming another chain with a bogus signature, which would be left to the
+	// pool if its sender was recovered
+	bogus := types.NewTx(&types.InternalTx{
+		ChainID:   big.NewInt(2),
+		GasTipCap: big.NewInt(1),
+		GasFeeCap: big.NewInt(1),
+		Gas:       21000,
+		Value:     big.NewInt(1),
+		V:         big.NewInt(1),
+		R:         big.NewInt(1),
+		S:         big.NewInt(1),
+	})
+	local := newShardTxs(t, key, 1)[0]
+
+	packet := eth.TransactionsPacket{other, bogus, local}
+	if err := h.Handle(peer, &packet); err != nil {
+		t.Fatalf("failed to handle transactions: %v", err)
+	}
+	if !added[local.Hash()] {
+		t.Errorf("transaction for the local chain not pooled")
+	}
+	if added[other.Hash()] || added[bogus.Hash()] {
+		t.Errorf("transactions for another chain pooled: %v/%v", added[other.Hash()], added[bogus.Hash()])
+	}
+	if foreign := h.peers.peer(peer.ID()).addForeignTxs(0); foreign != 2 {
+		t.Errorf("foreign transaction count mismatch: have %d, want 2", foreign)
+	}
+}
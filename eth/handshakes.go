@@ -0,0 +1,50 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"time"
+
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+	"github.com/dominant-strategies/go-quai/metrics"
+	"github.com/dominant-strategies/go-quai/p2p"
+)
+
+// handshakeRejectMeter counts the peers refused for finding no free handshake
+// slot in time.
+var handshakeRejectMeter = metrics.NewRegisteredMeter("eth/handshakes/rejected", nil)
+
+// handshake runs the `eth` handshake with a peer once one of the handshake slots
+// is free. Peers queued for longer than the handshake timeout are refused as if
+// the node was full, which dialers take as a hint to retry later.
+func (h *handler) handshake(peer *eth.Peer, status *eth.StatusPacket) error {
+	if h.handshakes != nil {
+		timer := time.NewTimer(h.protocol.HandshakeTimeout)
+		defer timer.Stop()
+
+		select {
+		case h.handshakes <- struct{}{}:
+			defer func() { <-h.handshakes }()
+		case <-timer.C:
+			handshakeRejectMeter.Mark(1)
+			return p2p.DiscTooManyPeers
+		case <-h.quitSync:
+			return p2p.DiscQuitting
+		}
+	}
+	return peer.Handshake(h.nodeID, status)
+}
@@ -0,0 +1,128 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// newHandshakeStatus creates a status passing the validation of the handshake.
+func newHandshakeStatus() *eth.StatusPacket {
+	return &eth.StatusPacket{
+		ProtocolVersion: eth.ETH66,
+		NetworkID:       1,
+		Location:        common.NodeLocation.Name(),
+		SlicesRunning:   []common.Location{{0, 0}},
+		Entropy:         big.NewInt(1),
+	}
+}
+
+// Tests that a burst of concurrent handshakes is run at most MaxPendingHandshakes
+// at a time, queuing the excess ones until a slot frees up.
+func TestHandshakeLimit(t *testing.T) {
+	const (
+		limit = 3
+		peers = 20
+	)
+	var (
+		h      = &handler{nodeID: enode.ID{0xff}, handshakes: make(chan struct{}, limit), protocol: &eth.DefaultConfig, quitSync: make(chan struct{})}
+		status = newHandshakeStatus()
+
+		inflight int32 // Handshakes whose local status arrived, but not the remote one
+		peak     int32 // Highest number of handshakes in flight at once
+		errc     = make(chan error, peers)
+	)
+	for i := 0; i < peers; i++ {
+		app, net := p2p.MsgPipe()
+		defer app.Close()
+		defer net.Close()
+
+		peer := eth.NewPeer(eth.ETH66, p2p.NewPeer(enode.ID{0xf1, byte(i)}, "peer", nil), net, nil)
+		defer peer.Close()
+
+		go func() {
+			// Hold the handshake open for a while once the local status arrives
+			msg, err := app.ReadMsg()
+			if err != nil {
+				return
+			}
+			msg.Discard()
+
+			n := atomic.AddInt32(&inflight, 1)
+			for {
+				if max := atomic.LoadInt32(&peak); n <= max || atomic.CompareAndSwapInt32(&peak, max, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&inflight, -1)
+
+			p2p.Send(app, eth.StatusMsg, status)
+		}()
+		go func() { errc <- h.handshake(peer, status) }()
+	}
+	for i := 0; i < peers; i++ {
+		if err := <-errc; err != nil {
+			t.Errorf("handshake %d failed: %v", i, err)
+		}
+	}
+	if peak := atomic.LoadInt32(&peak); peak != limit {
+		t.Errorf("concurrent handshakes mismatch: have %d, want %d", peak, limit)
+	}
+	if pending := len(h.handshakes); pending != 0 {
+		t.Errorf("handshake slots leaked: %d", pending)
+	}
+}
+
+// Tests that handshakes finding no free slot within the handshake timeout are
+// refused with a hint to retry later, without exchanging any status.
+func TestHandshakeLimitRejection(t *testing.T) {
+	config := eth.DefaultConfig
+	config.HandshakeTimeout = 50 * time.Millisecond
+
+	h := &handler{nodeID: enode.ID{0xff}, handshakes: make(chan struct{}, 1), protocol: &config, quitSync: make(chan struct{})}
+	h.handshakes <- struct{}{}
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	peer := eth.NewPeer(eth.ETH66, p2p.NewPeer(enode.ID{0xf1, 0xff}, "peer", nil), net, nil)
+	defer peer.Close()
+
+	if err := h.handshake(peer, newHandshakeStatus()); err != p2p.DiscTooManyPeers {
+		t.Errorf("queued handshake error mismatch: have %v, want %v", err, p2p.DiscTooManyPeers)
+	}
+	// Handshakes still queued on shutdown are abandoned
+	close(h.quitSync)
+	if err := h.handshake(peer, newHandshakeStatus()); err != p2p.DiscQuitting {
+		t.Errorf("shutdown handshake error mismatch: have %v, want %v", err, p2p.DiscQuitting)
+	}
+	// No status may have been sent to the peer
+	net.Close()
+	if msg, err := app.ReadMsg(); err == nil {
+		t.Errorf("status sent to refused peer: %v", msg)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/dominant-strategies/go-quai/common"
 	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
 )
 
@@ -30,14 +31,65 @@ type ethPeerInfo struct {
 	Version uint     `json:"version"` // Quai protocol version negotiated
 	Entropy *big.Int `json:"entropy"` // Head Entropy of the peer's blockchain
 	Head    string   `json:"head"`    // Hex hash of the peer's best owned block
+	Client  string   `json:"client"`  // Software and version advertised by the peer
+}
+
+// PeerStatus is a snapshot of the status a connected `eth` peer advertised in
+// the handshake, to help spotting peers on a diverging chain. Quai statuses carry
+// no fork ID, the genesis hash identifying the chain instead.
+type PeerStatus struct {
+	ID        string      `json:"id"`        // Identifier of the peer
+	Version   uint        `json:"version"`   // Quai protocol version negotiated
+	NetworkID uint64      `json:"networkId"` // Network advertised by the peer
+	Location  string      `json:"location"`  // Location the peer runs the protocol for
+	Slices    []string    `json:"slices"`    // Names of the slices run by the peer
+	Genesis   common.Hash `json:"genesis"`   // Genesis block of the peer's chain
+	Head      common.Hash `json:"head"`      // Head block advertised in the handshake
+	Entropy   *big.Int    `json:"entropy"`   // Head entropy advertised in the handshake
+	Client    string      `json:"client"`    // Software and version advertised by the peer
+}
+
+// newPeerStatus snapshots the handshake status of a peer, nil if the handshake
+// didn't complete yet.
+func newPeerStatus(peer *eth.Peer) *PeerStatus {
+	status := peer.Status()
+	if status == nil {
+		return nil
+	}
+	slices := make([]string, len(status.SlicesRunning))
+	for i, slice := range status.SlicesRunning {
+		slices[i] = slice.Name()
+	}
+	return &PeerStatus{
+		ID:        peer.ID(),
+		Version:   peer.Version(),
+		NetworkID: status.NetworkID,
+		Location:  status.Location,
+		Slices:    slices,
+		Genesis:   status.Genesis,
+		Head:      status.Head,
+		Entropy:   status.Entropy,
+		Client:    peer.ClientVersion(),
+	}
 }
 
 // ethPeer is a wrapper around eth.Peer to maintain a few extra metadata.
 type ethPeer struct {
 	*eth.Peer
 
-	syncDrop *time.Timer  // Connection dropper if `eth` sync progress isn't validated in time
-	lock     sync.RWMutex // Mutex protecting the internal fields
+	syncDrop   *time.Timer  // Connection dropper if `eth` sync progress isn't validated in time
+	foreignTxs int          // Number of transactions received from outside the local shard
+	lock       sync.RWMutex // Mutex protecting the internal fields
+}
+
+// addForeignTxs accounts for transactions received from outside of the local
+// shard, returning the total number sent by the peer.
+func (p *ethPeer) addForeignTxs(count int) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.foreignTxs += count
+	return p.foreignTxs
 }
 
 // info gathers and returns some `eth` protocol metadata known about a peer.
@@ -48,5 +100,6 @@ func (p *ethPeer) info() *ethPeerInfo {
 		Version: p.Version(),
 		Entropy: entropy,
 		Head:    hash.Hex(),
+		Client:  p.ClientVersion(),
 	}
 }
@@ -0,0 +1,114 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"sync"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+	"github.com/dominant-strategies/go-quai/event"
+)
+
+// PeerEventType is the type of a peer lifecycle event.
+type PeerEventType string
+
+const (
+	// PeerEventNegotiated is emitted when the `eth` handshake with a peer
+	// completed and the protocol version was agreed upon.
+	PeerEventNegotiated PeerEventType = "negotiated"
+
+	// PeerEventRegistered is emitted when a peer was admitted into the peer set.
+	PeerEventRegistered PeerEventType = "registered"
+
+	// PeerEventDropped is emitted when a registered peer was removed from the
+	// peer set, along with the reason of the disconnection.
+	PeerEventDropped PeerEventType = "dropped"
+)
+
+// PeerEvent is a lifecycle notification of an `eth` peer.
+type PeerEvent struct {
+	Type    PeerEventType
+	Peer    string            // Identifier of the peer
+	Version uint              // Negotiated `eth` protocol version
+	Slices  []common.Location // Slices advertised by the peer
+	Reason  error             // Reason of the disconnection for drop events, nil if unknown
+}
+
+// newPeerEvent creates a lifecycle event of the given type for a peer.
+func newPeerEvent(typ PeerEventType, peer *eth.Peer, reason error) PeerEvent {
+	return PeerEvent{
+		Type:    typ,
+		Peer:    peer.ID(),
+		Version: peer.Version(),
+		Slices:  peer.SlicesRunning(),
+		Reason:  reason,
+	}
+}
+
+// peerEventFeed delivers peer lifecycle events to subscribers without ever
+// blocking the sender. Events are dropped for subscribers whose channel is full,
+// so the channels should be buffered according to how fast they are drained.
+type peerEventFeed struct {
+	subs    map[chan<- PeerEvent]struct{}
+	dropped uint64 // Number of events dropped due to slow subscribers
+	lock    sync.Mutex
+}
+
+// newPeerEventFeed creates an empty peer lifecycle event feed.
+func newPeerEventFeed() *peerEventFeed {
+	return &peerEventFeed{
+		subs: make(map[chan<- PeerEvent]struct{}),
+	}
+}
+
+// subscribe registers a channel to receive all future peer events until the
+// returned subscription is cancelled.
+func (f *peerEventFeed) subscribe(ch chan<- PeerEvent) event.Subscription {
+	f.lock.Lock()
+	f.subs[ch] = struct{}{}
+	f.lock.Unlock()
+
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		<-quit
+
+		f.lock.Lock()
+		delete(f.subs, ch)
+		f.lock.Unlock()
+		return nil
+	})
+}
+
+// send delivers an event to every subscriber with room in its channel.
+func (f *peerEventFeed) send(ev PeerEvent) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for ch := range f.subs {
+		select {
+		case ch <- ev:
+		default:
+			f.dropped++
+		}
+	}
+}
+
+// SubscribePeerEvents registers a subscription for the lifecycle events of the
+// `eth` peers. Events are dropped if the channel is full when they happen.
+func (h *handler) SubscribePeerEvents(ch chan<- PeerEvent) event.Subscription {
+	return h.peerEvents.subscribe(ch)
+}
@@ -0,0 +1,106 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+	"github.com/dominant-strategies/go-quai/p2p"
+)
+
+// Tests that subscribers are notified of a full connect-disconnect cycle of a
+// peer, in order, and stop receiving events once unsubscribed.
+func TestPeerEvents(t *testing.T) {
+	var (
+		h      = &handler{peers: newPeerSet(), peerEvents: newPeerEventFeed()}
+		slices = []common.Location{{0, 0}}
+		peer   = newSlicePeer(t, 1, slices)
+		events = make(chan PeerEvent, 3)
+	)
+	sub := h.SubscribePeerEvents(events)
+
+	// Walk the peer through its lifecycle the same way runEthPeer does
+	h.peerEvents.send(newPeerEvent(PeerEventNegotiated, peer, nil))
+	if err := h.peers.registerPeer(peer); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	h.peerEvents.send(newPeerEvent(PeerEventRegistered, peer, nil))
+	if err := h.peers.unregisterPeer(peer.ID()); err != nil {
+		t.Fatalf("failed to unregister peer: %v", err)
+	}
+	h.peerEvents.send(newPeerEvent(PeerEventDropped, peer, p2p.DiscUselessPeer))
+
+	want := []PeerEvent{
+		{Type: PeerEventNegotiated, Peer: peer.ID(), Version: eth.ETH66, Slices: slices},
+		{Type: PeerEventRegistered, Peer: peer.ID(), Version: eth.ETH66, Slices: slices},
+		{Type: PeerEventDropped, Peer: peer.ID(), Version: eth.ETH66, Slices: slices, Reason: p2p.DiscUselessPeer},
+	}
+	for i, w := range want {
+		select {
+		case ev := <-events:
+			if !reflect.DeepEqual(ev, w) {
+				t.Errorf("event %d: mismatch: have %+v, want %+v", i, ev, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d: not delivered", i)
+		}
+	}
+	sub.Unsubscribe()
+
+	h.peerEvents.send(newPeerEvent(PeerEventNegotiated, peer, nil))
+	select {
+	case ev := <-events:
+		t.Errorf("event delivered after unsubscribing: %+v", ev)
+	default:
+	}
+}
+
+// Tests that a subscriber not draining its channel doesn't block the delivery
+// of events, neither to the sender nor to other subscribers.
+func TestPeerEventsSlowSubscriber(t *testing.T) {
+	var (
+		feed = newPeerEventFeed()
+		peer = newSlicePeer(t, 1, []common.Location{{0, 0}})
+		slow = make(chan PeerEvent)
+		fast = make(chan PeerEvent, 8)
+	)
+	defer feed.subscribe(slow).Unsubscribe()
+	defer feed.subscribe(fast).Unsubscribe()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < cap(fast); i++ {
+			feed.send(newPeerEvent(PeerEventRegistered, peer, nil))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("event delivery blocked on slow subscriber")
+	}
+	if len(fast) != cap(fast) {
+		t.Errorf("fast subscriber events mismatch: have %d, want %d", len(fast), cap(fast))
+	}
+	if feed.dropped != uint64(cap(fast)) {
+		t.Errorf("dropped events mismatch: have %d, want %d", feed.dropped, cap(fast))
+	}
+}
@@ -19,9 +19,11 @@ package eth
 import (
 	"errors"
 	"math/big"
+	"sort"
 	"sync"
 
 	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/eth/ethconfig"
 	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
 	"github.com/dominant-strategies/go-quai/p2p"
 )
@@ -47,7 +49,15 @@ var (
 // peerSet represents the collection of active peers currently participating in
 // the `eth` protocol, with or without the `snap` extension.
 type peerSet struct {
-	peers  map[string]*ethPeer // Peers connected on the `eth` protocol
+	peers map[string]*ethPeer // Peers connected on the `eth` protocol
+
+	locations      map[string]int    // Number of registered peers running each slice
+	wanted         []common.Location // Slices which we want peer coverage for
+	minPerLocation int               // Peers to admit for a wanted slice even if full
+	maxPerLocation int               // Peers beyond which a slice adds no value (0 = unlimited)
+
+	pinned map[string]map[string]struct{} // IDs of the peers preferred for each slice
+
 	lock   sync.RWMutex
 	closed bool
 }
@@ -55,8 +65,75 @@ type peerSet struct {
 // newPeerSet creates a new peer set to track the active participants.
 func newPeerSet() *peerSet {
 	return &peerSet{
-		peers: make(map[string]*ethPeer),
+		peers:     make(map[string]*ethPeer),
+		locations: make(map[string]int),
+		pinned:    make(map[string]map[string]struct{}),
+	}
+}
+
+// setLocationLimits configures the per slice peer bounds. Up to min peers are
+// admitted for each of the wanted slices even if the peer set is full, whereas
+// peers only running slices which already have max peers are rejected.
+func (ps *peerSet) setLocationLimits(wanted []common.Location, min, max int) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ps.wanted, ps.minPerLocation, ps.maxPerLocation = wanted, min, max
+}
+
+// setPinnedPeers configures the trusted peers preferred for retrieving the data
+// of each slice, replacing any previous configuration.
+func (ps *peerSet) setPinnedPeers(pins []ethconfig.PeerPin) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ps.pinned = make(map[string]map[string]struct{})
+	for _, pin := range pins {
+		ids := ps.pinned[string(pin.Location)]
+		if ids == nil {
+			ids = make(map[string]struct{})
+			ps.pinned[string(pin.Location)] = ids
+		}
+		for _, id := range pin.Peers {
+			ids[id.String()] = struct{}{}
+		}
+	}
+}
+
+// admitsPeer reports whether a new peer running the given slices should be
+// accepted, given whether the peer set is already full. A full set only admits
+// peers covering a wanted slice below its minimum, otherwise the peer needs to
+// run at least one slice below its maximum.
+func (ps *peerSet) admitsPeer(slices []common.Location, full bool) bool {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	for _, slice := range slices {
+		count := ps.locations[string(slice)]
+		if full {
+			if count < ps.minPerLocation && containsLocation(ps.wanted, slice) {
+				return true
+			}
+			continue
+		}
+		if ps.maxPerLocation == 0 || count < ps.maxPerLocation {
+			return true
+		}
+	}
+	return false
+}
+
+// locationCounts returns the number of registered peers running each slice,
+// keyed by the slice name.
+func (ps *peerSet) locationCounts() map[string]int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	counts := make(map[string]int, len(ps.locations))
+	for loc, count := range ps.locations {
+		counts[common.Location(loc).Name()] = count
 	}
+	return counts
 }
 
 // registerPeer injects a new `eth` peer into the working set, or returns an error
@@ -77,6 +154,9 @@ func (ps *peerSet) registerPeer(peer *eth.Peer) error {
 		Peer: peer,
 	}
 	ps.peers[id] = eth
+	for _, slice := range peer.SlicesRunning() {
+		ps.locations[string(slice)]++
+	}
 	return nil
 }
 
@@ -85,11 +165,16 @@ func (ps *peerSet) registerPeer(peer *eth.Peer) error {
 func (ps *peerSet) unregisterPeer(id string) error {
 	ps.lock.Lock()
 	defer ps.lock.Unlock()
-	_, ok := ps.peers[id]
+	peer, ok := ps.peers[id]
 	if !ok {
 		return errPeerNotRegistered
 	}
 	delete(ps.peers, id)
+	for _, slice := range peer.SlicesRunning() {
+		if ps.locations[string(slice)]--; ps.locations[string(slice)] <= 0 {
+			delete(ps.locations, string(slice))
+		}
+	}
 	return nil
 }
 
@@ -157,45 +242,79 @@ func (ps *peerSet) len() int {
 	return len(ps.peers)
 }
 
-// peerWithHighestEntropy retrieves the known peer with the currently highest Entropy
-func (ps *peerSet) peerWithHighestEntropy() *eth.Peer {
+// peerWithHighestScore retrieves the known peer currently rated highest by the
+// peer scorer, by default the one with the highest entropy. Light peers aren't
+// considered, as they can't be synced from.
+func (ps *peerSet) peerWithHighestScore() *eth.Peer {
 	ps.lock.RLock()
 	defer ps.lock.RUnlock()
 
 	var (
-		bestPeer    *eth.Peer
-		bestEntropy *big.Int
+		bestPeer  *eth.Peer
+		bestScore *big.Int
 	)
 	for _, p := range ps.peers {
-		if _, _, entropy, _ := p.Head(); bestPeer == nil || entropy.Cmp(bestEntropy) > 0 {
-			bestPeer, bestEntropy = p.Peer, entropy
+		if p.Light() {
+			continue
+		}
+		if score := p.Score(); bestPeer == nil || score.Cmp(bestScore) > 0 {
+			bestPeer, bestScore = p.Peer, score
 		}
 	}
 	return bestPeer
 }
 
+// peerRunningSlice retrieves the peers running the given slice and serving
+// requests for its data.
 func (ps *peerSet) peerRunningSlice(location common.Location) []*eth.Peer {
 	ps.lock.RLock()
 	defer ps.lock.RUnlock()
 
-	containsLocation := func(s []common.Location, e common.Location) bool {
-		for _, a := range s {
-			if common.Location.Equal(a, e) {
-				return true
-			}
-		}
-		return false
-	}
-
 	var peersRunningSlice []*eth.Peer
 	for _, p := range ps.peers {
-		if containsLocation(p.Peer.SlicesRunning(), location) {
+		if !p.Light() && containsLocation(p.Peer.SlicesRunning(), location) {
 			peersRunningSlice = append(peersRunningSlice, p.Peer)
 		}
 	}
 	return peersRunningSlice
 }
 
+// pinnedPeers retrieves the connected peers pinned for the given slice, leaving
+// out the light ones.
+func (ps *peerSet) pinnedPeers(location common.Location) []*eth.Peer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	var pinned []*eth.Peer
+	for id := range ps.pinned[string(location)] {
+		if p, ok := ps.peers[id]; ok && !p.Light() {
+			pinned = append(pinned, p.Peer)
+		}
+	}
+	return pinned
+}
+
+// peersForSlice retrieves the peers to retrieve the data of the given slice from:
+// the connected peers pinned for it, or all the peers running it if none is.
+func (ps *peerSet) peersForSlice(location common.Location) []*eth.Peer {
+	if pinned := ps.pinnedPeers(location); len(pinned) > 0 {
+		return pinned
+	}
+	return ps.peerRunningSlice(location)
+}
+
+// peersSupporting retrieves the peers to send a request for the data of the given
+// slice to, leaving out the ones which didn't advertise serving it.
+func (ps *peerSet) peersSupporting(location common.Location, code uint64) []*eth.Peer {
+	var peers []*eth.Peer
+	for _, p := range ps.peersForSlice(location) {
+		if p.Supports(code) {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
 func (ps *peerSet) allPeers() []*eth.Peer {
 	ps.lock.RLock()
 	defer ps.lock.RUnlock()
@@ -207,6 +326,85 @@ func (ps *peerSet) allPeers() []*eth.Peer {
 	return allPeers
 }
 
+// servingPeers retrieves all the peers serving requests, that is the ones which
+// didn't announce themselves as light nodes.
+func (ps *peerSet) servingPeers() []*eth.Peer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	var serving []*eth.Peer
+	for _, p := range ps.peers {
+		if !p.Light() {
+			serving = append(serving, p.Peer)
+		}
+	}
+	return serving
+}
+
+// statuses returns the handshake statuses of all the registered peers, ordered
+// by peer ID.
+func (ps *peerSet) statuses() []*PeerStatus {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	statuses := make([]*PeerStatus, 0, len(ps.peers))
+	for _, p := range ps.peers {
+		if status := newPeerStatus(p.Peer); status != nil {
+			statuses = append(statuses, status)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// LocationProgress is the sync progress of a slice run by the local node, measured
+// against the latest heads advertised by the peers running the same slice.
+type LocationProgress struct {
+	Location     string      `json:"location"`     // Name of the slice
+	Peers        int         `json:"peers"`        // Number of connected peers running the slice
+	Head         common.Hash `json:"head"`         // Head of the peer furthest ahead, empty without peers
+	Entropy      *big.Int    `json:"entropy"`      // Head entropy of the peer furthest ahead, nil without peers
+	LocalEntropy *big.Int    `json:"localEntropy"` // Head entropy of the local chain
+	Behind       *big.Int    `json:"behind"`       // Entropy the local chain is behind by, nil without peers
+}
+
+// progress returns the sync progress of each of the given slices, comparing the
+// local head entropy with the highest one advertised by the peers running the
+// slice, through their handshake or later head updates.
+func (ps *peerSet) progress(slices []common.Location, local *big.Int) []*LocationProgress {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	progress := make([]*LocationProgress, len(slices))
+	for i, slice := range slices {
+		progress[i] = &LocationProgress{
+			Location:     slice.Name(),
+			LocalEntropy: new(big.Int).Set(local),
+		}
+		for _, p := range ps.peers {
+			if !containsLocation(p.Peer.SlicesRunning(), slice) {
+				continue
+			}
+			progress[i].Peers++
+
+			head, _, entropy, _ := p.Head()
+			if entropy == nil {
+				continue
+			}
+			if progress[i].Entropy == nil || entropy.Cmp(progress[i].Entropy) > 0 {
+				progress[i].Head, progress[i].Entropy = head, new(big.Int).Set(entropy)
+			}
+		}
+		if progress[i].Entropy != nil {
+			progress[i].Behind = new(big.Int)
+			if progress[i].Entropy.Cmp(local) > 0 {
+				progress[i].Behind.Sub(progress[i].Entropy, local)
+			}
+		}
+	}
+	return progress
+}
+
 // close disconnects all peers.
 func (ps *peerSet) close() {
 	ps.lock.Lock()
@@ -217,3 +415,13 @@ func (ps *peerSet) close() {
 	}
 	ps.closed = true
 }
+
+// containsLocation reports whether the location is part of the given list.
+func containsLocation(s []common.Location, e common.Location) bool {
+	for _, a := range s {
+		if common.Location.Equal(a, e) {
+			return true
+		}
+	}
+	return false
+}
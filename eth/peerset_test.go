@@ -0,0 +1,443 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/eth/ethconfig"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// newSlicePeer creates an `eth` peer which advertised running the given slices
+// during a simulated handshake.
+func newSlicePeer(t *testing.T, id byte, slices []common.Location) *eth.Peer {
+	t.Helper()
+
+	return newStatusPeer(t, id, &eth.StatusPacket{
+		ProtocolVersion: eth.ETH66,
+		NetworkID:       1,
+		Location:        common.NodeLocation.Name(),
+		SlicesRunning:   slices,
+		Entropy:         big.NewInt(1),
+	})
+}
+
+// newStatusPeer creates an `eth` peer which advertised the given status during
+// a simulated handshake.
+func newStatusPeer(t *testing.T, id byte, status *eth.StatusPacket) *eth.Peer {
+	t.Helper()
+
+	return newConfigPeer(t, id, status, &eth.DefaultConfig)
+}
+
+// newConfigPeer creates an `eth` peer running with the given protocol settings,
+// which advertised the given status during a simulated handshake.
+func newConfigPeer(t *testing.T, id byte, status *eth.StatusPacket, config *eth.Config) *eth.Peer {
+	t.Helper()
+
+	peer, _ := newPipePeer(t, id, status, config)
+	return peer
+}
+
+// newPipePeer creates an `eth` peer running with the given protocol settings,
+// which advertised the given status during a simulated handshake, returning the
+// remote end of its connection too.
+func newPipePeer(t *testing.T, id byte, status *eth.StatusPacket, config *eth.Config) (*eth.Peer, p2p.MsgReadWriter) {
+	t.Helper()
+
+	app, net := p2p.MsgPipe()
+	t.Cleanup(func() { app.Close(); net.Close() })
+
+	peer := eth.NewPeerWithConfig(uint(status.ProtocolVersion), p2p.NewPeer(enode.ID{id}, "peer", nil), net, nil, config)
+	t.Cleanup(peer.Close)
+
+	go func() {
+		// Consume our own status and answer with the remote one
+		if msg, err := app.ReadMsg(); err == nil {
+			msg.Discard()
+		}
+		p2p.Send(app, eth.StatusMsg, status)
+	}()
+	if err := peer.Handshake(enode.ID{0xff}, status); err != nil {
+		t.Fatalf("failed to handshake peer: %v", err)
+	}
+	return peer, app
+}
+
+// Tests that per slice peer counts are tracked across registrations and that
+// the caps and minimums drive peer admission.
+func TestPeerSetLocationLimits(t *testing.T) {
+	var (
+		zone00 = common.Location{0, 0}
+		zone01 = common.Location{0, 1}
+		zone10 = common.Location{1, 0}
+	)
+	ps := newPeerSet()
+	ps.setLocationLimits([]common.Location{zone00, zone01}, 1, 2)
+
+	// Fill up zone-0-0 to its cap
+	for i := byte(0); i < 2; i++ {
+		slices := []common.Location{zone00}
+		if !ps.admitsPeer(slices, false) {
+			t.Fatalf("peer %d: rejected below cap", i)
+		}
+		if err := ps.registerPeer(newSlicePeer(t, i, slices)); err != nil {
+			t.Fatalf("peer %d: failed to register: %v", i, err)
+		}
+	}
+	if ps.admitsPeer([]common.Location{zone00}, false) {
+		t.Errorf("peer admitted above cap")
+	}
+	// Peers also running an under-provisioned slice are still welcome
+	if !ps.admitsPeer([]common.Location{zone00, zone01}, false) {
+		t.Errorf("peer covering under-provisioned slice rejected")
+	}
+	// A full set only admits peers filling a wanted slice below its minimum
+	if !ps.admitsPeer([]common.Location{zone01}, true) {
+		t.Errorf("peer filling wanted slice minimum rejected while full")
+	}
+	if ps.admitsPeer([]common.Location{zone10}, true) {
+		t.Errorf("peer running unwanted slice admitted while full")
+	}
+	if err := ps.registerPeer(newSlicePeer(t, 2, []common.Location{zone01, zone10})); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	if ps.admitsPeer([]common.Location{zone01}, true) {
+		t.Errorf("peer admitted while full with slice minimum met")
+	}
+	// Check the exposed counts, also after dropping peers
+	want := map[string]int{zone00.Name(): 2, zone01.Name(): 1, zone10.Name(): 1}
+	checkLocationCounts(t, ps.locationCounts(), want)
+
+	if err := ps.unregisterPeer(enode.ID{2}.String()); err != nil {
+		t.Fatalf("failed to unregister peer: %v", err)
+	}
+	if err := ps.unregisterPeer(enode.ID{0}.String()); err != nil {
+		t.Fatalf("failed to unregister peer: %v", err)
+	}
+	checkLocationCounts(t, ps.locationCounts(), map[string]int{zone00.Name(): 1})
+
+	if !ps.admitsPeer([]common.Location{zone00}, false) {
+		t.Errorf("peer rejected after slice dropped below cap")
+	}
+}
+
+// Tests that the status snapshot of the peer set reflects what each peer
+// advertised in its handshake.
+func TestPeerSetStatuses(t *testing.T) {
+	var (
+		genesis = common.Hash{0x0e}
+		ps      = newPeerSet()
+		want    []*PeerStatus
+	)
+	for i, version := range []uint{eth.ETH65, eth.ETH66, eth.ETH67} {
+		status := &eth.StatusPacket{
+			ProtocolVersion: uint32(version),
+			NetworkID:       1,
+			Location:        common.NodeLocation.Name(),
+			SlicesRunning:   []common.Location{{0, byte(i)}},
+			Entropy:         big.NewInt(int64(100 * (i + 1))),
+			Head:            common.Hash{byte(i + 1)},
+			Genesis:         genesis,
+		}
+		if version >= eth.ETH67 {
+			status.ClientVersion = fmt.Sprintf("go-quai/v0.%d.0", i)
+		}
+		peer := newStatusPeer(t, byte(i), status)
+		if err := ps.registerPeer(peer); err != nil {
+			t.Fatalf("peer %d: failed to register: %v", i, err)
+		}
+		want = append(want, &PeerStatus{
+			ID:        peer.ID(),
+			Version:   version,
+			NetworkID: 1,
+			Location:  common.NodeLocation.Name(),
+			Slices:    []string{common.Location{0, byte(i)}.Name()},
+			Genesis:   genesis,
+			Head:      status.Head,
+			Entropy:   status.Entropy,
+			Client:    status.ClientVersion,
+		})
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i].ID < want[j].ID })
+
+	if have := ps.statuses(); !reflect.DeepEqual(have, want) {
+		t.Errorf("statuses mismatch:\nhave %+v\nwant %+v", have, want)
+	}
+	// Dropped peers disappear from the snapshot
+	if err := ps.unregisterPeer(want[0].ID); err != nil {
+		t.Fatalf("failed to unregister peer: %v", err)
+	}
+	if have := ps.statuses(); !reflect.DeepEqual(have, want[1:]) {
+		t.Errorf("statuses mismatch after drop:\nhave %+v\nwant %+v", have, want[1:])
+	}
+}
+
+// Tests that the per slice sync progress compares the local head with the best
+// head of the peers running each slice, following their head updates.
+func TestPeerSetProgress(t *testing.T) {
+	var (
+		zone00 = common.Location{0, 0}
+		zone01 = common.Location{0, 1}
+		zone02 = common.Location{0, 2}
+		ps     = newPeerSet()
+	)
+	peers := []struct {
+		slices  []common.Location
+		entropy int64
+	}{
+		{[]common.Location{zone00, zone01}, 100},
+		{[]common.Location{zone01}, 300},
+		{[]common.Location{zone00}, 50},
+		{[]common.Location{{1, 0}}, 1000}, // Slice not run locally
+	}
+	for i, peer := range peers {
+		status := &eth.StatusPacket{
+			ProtocolVersion: eth.ETH66,
+			NetworkID:       1,
+			Location:        common.NodeLocation.Name(),
+			SlicesRunning:   peer.slices,
+			Entropy:         big.NewInt(peer.entropy),
+			Head:            common.Hash{byte(i + 1)},
+		}
+		if err := ps.registerPeer(newStatusPeer(t, byte(i), status)); err != nil {
+			t.Fatalf("peer %d: failed to register: %v", i, err)
+		}
+	}
+	slices := []common.Location{zone00, zone01, zone02}
+	local := big.NewInt(120)
+
+	// Slices whose peers are behind are in sync, the others report the gap
+	want := []*LocationProgress{
+		{Location: zone00.Name(), Peers: 2, Head: common.Hash{1}, Entropy: big.NewInt(100), LocalEntropy: local, Behind: big.NewInt(0)},
+		{Location: zone01.Name(), Peers: 2, Head: common.Hash{2}, Entropy: big.NewInt(300), LocalEntropy: local, Behind: big.NewInt(180)},
+		{Location: zone02.Name(), Peers: 0, LocalEntropy: local},
+	}
+	if have := ps.progress(slices, local); !reflect.DeepEqual(have, want) {
+		t.Errorf("progress mismatch:\nhave %+v\nwant %+v", have, want)
+	}
+	// Head updates after the handshake are taken into account
+	ps.peer(enode.ID{2}.String()).SetHead(common.Hash{0x33}, big.NewInt(10), big.NewInt(500), time.Now())
+
+	want[0].Head, want[0].Entropy, want[0].Behind = common.Hash{0x33}, big.NewInt(500), big.NewInt(380)
+	if have := ps.progress(slices, local); !reflect.DeepEqual(have, want) {
+		t.Errorf("progress mismatch after head update:\nhave %+v\nwant %+v", have, want)
+	}
+	// Dropped peers no longer count
+	if err := ps.unregisterPeer(enode.ID{1}.String()); err != nil {
+		t.Fatalf("failed to unregister peer: %v", err)
+	}
+	want[1].Peers, want[1].Head, want[1].Entropy, want[1].Behind = 1, common.Hash{1}, big.NewInt(100), big.NewInt(0)
+	if have := ps.progress(slices, local); !reflect.DeepEqual(have, want) {
+		t.Errorf("progress mismatch after drop:\nhave %+v\nwant %+v", have, want)
+	}
+}
+
+// Tests that optional requests are only routed to the peers which advertised
+// them in the handshake.
+func TestPeerSetPeersSupporting(t *testing.T) {
+	var (
+		zone00 = common.Location{0, 0}
+		ps     = newPeerSet()
+	)
+	optional := [][]uint64{
+		{eth.GetPoolSnapshotMsg, eth.GetHeadersByMinerMsg},
+		{eth.GetHeadersByMinerMsg},
+		nil,
+	}
+	peers := make([]*eth.Peer, len(optional))
+	for i, codes := range optional {
+		peers[i] = newStatusPeer(t, byte(i), &eth.StatusPacket{
+			ProtocolVersion: eth.ETH67,
+			NetworkID:       1,
+			Location:        common.NodeLocation.Name(),
+			SlicesRunning:   []common.Location{zone00},
+			Entropy:         big.NewInt(1),
+			Optional:        codes,
+		})
+		if err := ps.registerPeer(peers[i]); err != nil {
+			t.Fatalf("peer %d: failed to register: %v", i, err)
+		}
+	}
+	tests := []struct {
+		code  uint64
+		peers []*eth.Peer
+	}{
+		{eth.GetPoolSnapshotMsg, []*eth.Peer{peers[0]}},
+		{eth.GetHeadersByMinerMsg, []*eth.Peer{peers[0], peers[1]}},
+		{eth.GetTxNonInclusionProofMsg, nil},
+		{eth.GetBlockHeadersMsg, peers},
+	}
+	for i, tt := range tests {
+		have := ps.peersSupporting(zone00, tt.code)
+		sort.Slice(have, func(i, j int) bool { return have[i].ID() < have[j].ID() })
+		if !reflect.DeepEqual(have, tt.peers) {
+			t.Errorf("test %d: peers supporting %#x mismatch: have %v, want %v", i, tt.code, have, tt.peers)
+		}
+	}
+	if peers := ps.peersSupporting(common.Location{0, 1}, eth.GetBlockHeadersMsg); len(peers) != 0 {
+		t.Errorf("peers returned for a slice not run: %v", peers)
+	}
+}
+
+func checkLocationCounts(t *testing.T, have, want map[string]int) {
+	t.Helper()
+
+	if len(have) != len(want) {
+		t.Fatalf("location count mismatch: have %v, want %v", have, want)
+	}
+	for name, count := range want {
+		if have[name] != count {
+			t.Errorf("location %s: peer count mismatch: have %d, want %d", name, have[name], count)
+		}
+	}
+}
+
+// Tests that the peers pinned for a slice are preferred for retrieving its data
+// over the other peers running it, which are only used if no pinned peer is
+// connected.
+func TestPeerSetPinnedPeers(t *testing.T) {
+	var (
+		zone00 = common.Location{0, 0}
+		zone01 = common.Location{0, 1}
+	)
+	ps := newPeerSet()
+	ps.setPinnedPeers([]ethconfig.PeerPin{
+		{Location: zone00, Peers: []enode.ID{{0x10}, {0x11}}},
+	})
+	general := newSlicePeer(t, 0x01, []common.Location{zone00, zone01})
+	if err := ps.registerPeer(general); err != nil {
+		t.Fatalf("failed to register general peer: %v", err)
+	}
+	// Without pinned peers connected, the general ones are used
+	if peers := ps.peersForSlice(zone00); len(peers) != 1 || peers[0] != general {
+		t.Fatalf("fallback peers mismatch: have %v", peers)
+	}
+	// Once a pinned peer connects, it's tried exclusively
+	pinned := newSlicePeer(t, 0x10, []common.Location{zone00})
+	if err := ps.registerPeer(pinned); err != nil {
+		t.Fatalf("failed to register pinned peer: %v", err)
+	}
+	if peers := ps.peersForSlice(zone00); len(peers) != 1 || peers[0] != pinned {
+		t.Fatalf("pinned peers mismatch: have %v", peers)
+	}
+	// Pins don't affect the other slices
+	if peers := ps.peersForSlice(zone01); len(peers) != 1 || peers[0] != general {
+		t.Fatalf("unpinned slice peers mismatch: have %v", peers)
+	}
+	// Losing the pinned peer falls back to the general ones
+	if err := ps.unregisterPeer(pinned.ID()); err != nil {
+		t.Fatalf("failed to unregister pinned peer: %v", err)
+	}
+	if peers := ps.peersForSlice(zone00); len(peers) != 1 || peers[0] != general {
+		t.Fatalf("fallback peers mismatch after disconnect: have %v", peers)
+	}
+}
+
+// lowEntropyScorer is a peer scorer preferring the peers with the lowest entropy.
+type lowEntropyScorer struct{}
+
+func (lowEntropyScorer) Observe(eth.PeerSignal) {}
+
+func (lowEntropyScorer) Score(peer *eth.Peer) *big.Int {
+	_, _, entropy, _ := peer.Head()
+	return new(big.Int).Neg(entropy)
+}
+
+// Tests that the sync peer is selected by the configured peer scorer, the default
+// one preferring the peer with the highest entropy.
+func TestPeerSetHighestScore(t *testing.T) {
+	config := eth.DefaultConfig
+
+	ps := newPeerSet()
+	peers := make([]*eth.Peer, 3)
+	for i := range peers {
+		peers[i] = newConfigPeer(t, byte(0x20+i), &eth.StatusPacket{
+			ProtocolVersion: eth.ETH66,
+			NetworkID:       1,
+			Location:        common.NodeLocation.Name(),
+			SlicesRunning:   []common.Location{{0, 0}},
+			Entropy:         big.NewInt(1),
+		}, &config)
+		peers[i].SetHead(common.Hash{byte(i)}, big.NewInt(1), big.NewInt(int64(100*(i+1))), time.Now())
+		if err := ps.registerPeer(peers[i]); err != nil {
+			t.Fatalf("failed to register peer %d: %v", i, err)
+		}
+	}
+	if best := ps.peerWithHighestScore(); best != peers[2] {
+		t.Errorf("default best peer mismatch: have %v, want %v", best.ID(), peers[2].ID())
+	}
+	config.Scorer = lowEntropyScorer{}
+	if best := ps.peerWithHighestScore(); best != peers[0] {
+		t.Errorf("custom best peer mismatch: have %v, want %v", best.ID(), peers[0].ID())
+	}
+}
+
+// Tests that light peers are never selected to send requests to, even if pinned
+// or ahead of the others, while blocks are still propagated to them.
+func TestPeerSetLightPeers(t *testing.T) {
+	zone00 := common.Location{0, 0}
+
+	ps := newPeerSet()
+	ps.setPinnedPeers([]ethconfig.PeerPin{
+		{Location: zone00, Peers: []enode.ID{{0x31}}},
+	})
+	serving := newStatusPeer(t, 0x30, &eth.StatusPacket{
+		ProtocolVersion: eth.ETH67,
+		NetworkID:       1,
+		Location:        common.NodeLocation.Name(),
+		SlicesRunning:   []common.Location{zone00},
+		Entropy:         big.NewInt(1),
+	})
+	light := newStatusPeer(t, 0x31, &eth.StatusPacket{
+		ProtocolVersion: eth.ETH67,
+		NetworkID:       1,
+		Location:        common.NodeLocation.Name(),
+		SlicesRunning:   []common.Location{zone00},
+		Entropy:         big.NewInt(100),
+		Light:           true,
+	})
+	for _, peer := range []*eth.Peer{serving, light} {
+		if err := ps.registerPeer(peer); err != nil {
+			t.Fatalf("failed to register peer %v: %v", peer.ID(), err)
+		}
+	}
+	if peers := ps.peersForSlice(zone00); len(peers) != 1 || peers[0] != serving {
+		t.Errorf("slice peers mismatch: have %v", peers)
+	}
+	if peers := ps.peersSupporting(zone00, eth.GetBlockHeadersMsg); len(peers) != 1 || peers[0] != serving {
+		t.Errorf("request peers mismatch: have %v", peers)
+	}
+	if peers := ps.servingPeers(); len(peers) != 1 || peers[0] != serving {
+		t.Errorf("serving peers mismatch: have %v", peers)
+	}
+	if best := ps.peerWithHighestScore(); best != serving {
+		t.Errorf("sync peer mismatch: have %v, want %v", best.ID(), serving.ID())
+	}
+	if peers := ps.peersWithoutBlock(common.Hash{0x01}); len(peers) != 2 {
+		t.Errorf("block propagation peers mismatch: have %d, want %d", len(peers), 2)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/common/mclock"
+)
+
+const (
+	// maxPropagatedBlocks is the number of block hashes originated or relayed by
+	// the local node which are remembered for dropping looping broadcasts.
+	maxPropagatedBlocks = 1024
+
+	// maxPropagatedTxs is the number of transaction hashes broadcast by the local
+	// node which are remembered for dropping looping broadcasts.
+	maxPropagatedTxs = 32768
+
+	// propagatedTxLifetime is the time after which a broadcast transaction may be
+	// broadcast again. Looping broadcasts come back well within it, while
+	// transactions reinjected into the pool by a reorg are broadcast anew.
+	propagatedTxLifetime = 30 * time.Second
+)
+
+// propagationFilter is a bounded set of the items the local node already sent
+// out. In densely connected zones items keep coming back through other peers,
+// which the per peer known sets can't catch, so the filter ensures each item is
+// propagated at most once within its lifetime. Once full, the oldest items are
+// evicted first.
+type propagationFilter struct {
+	seen     map[common.Hash]mclock.AbsTime // Items propagated, and when
+	order    []propagatedItem               // Items in the order they were marked, oldest first
+	limit    int
+	lifetime time.Duration // Time after which an item may be propagated again (0 = never)
+	clock    mclock.Clock
+	lock     sync.Mutex // Serializes the check-and-mark of concurrent propagations
+}
+
+// propagatedItem is an item marked in the propagation filter.
+type propagatedItem struct {
+	hash common.Hash
+	time mclock.AbsTime
+}
+
+// newPropagationFilter creates a filter remembering up to limit items, each for
+// the given lifetime, or until evicted if zero.
+func newPropagationFilter(limit int, lifetime time.Duration, clock mclock.Clock) *propagationFilter {
+	return &propagationFilter{
+		seen:     make(map[common.Hash]mclock.AbsTime),
+		limit:    limit,
+		lifetime: lifetime,
+		clock:    clock,
+	}
+}
+
+// mark records an item as propagated, reporting whether it is the first time
+// it was seen within its lifetime. Items already marked must not be sent out
+// again.
+func (f *propagationFilter) mark(hash common.Hash) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := f.clock.Now()
+	f.expire(now)
+	if _, ok := f.seen[hash]; ok {
+		return false
+	}
+	for len(f.seen) >= f.limit {
+		delete(f.seen, f.order[0].hash)
+		f.order = f.order[1:]
+	}
+	f.seen[hash] = now
+	f.order = append(f.order, propagatedItem{hash: hash, time: now})
+	return true
+}
+
+// contains reports whether an item was already propagated within its lifetime.
+func (f *propagationFilter) contains(hash common.Hash) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	marked, ok := f.seen[hash]
+	return ok && !f.expired(marked, f.clock.Now())
+}
+
+// expire forgets the items whose lifetime has passed. Items are marked in time
+// order, so the expired ones are all at the front.
+func (f *propagationFilter) expire(now mclock.AbsTime) {
+	for len(f.order) > 0 && f.expired(f.order[0].time, now) {
+		delete(f.seen, f.order[0].hash)
+		f.order = f.order[1:]
+	}
+}
+
+// expired reports whether an item marked at the given time has outlived the
+// lifetime of the filter.
+func (f *propagationFilter) expired(marked, now mclock.AbsTime) bool {
+	return f.lifetime != 0 && time.Duration(now-marked) >= f.lifetime
+}
@@ -0,0 +1,282 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/common/mclock"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// Tests that the propagation filter only lets items through once, and evicts
+// items once full.
+func TestPropagationFilter(t *testing.T) {
+	f := newPropagationFilter(2, 0, mclock.System{})
+
+	if !f.mark(common.Hash{0x01}) {
+		t.Errorf("fresh item rejected")
+	}
+	if f.mark(common.Hash{0x01}) {
+		t.Errorf("propagated item accepted again")
+	}
+	if !f.contains(common.Hash{0x01}) {
+		t.Errorf("propagated item not contained")
+	}
+	f.mark(common.Hash{0x02})
+	f.mark(common.Hash{0x03})
+	if have := len(f.seen); have != 2 {
+		t.Errorf("filter size mismatch: have %d, want %d", have, 2)
+	}
+	if !f.contains(common.Hash{0x03}) {
+		t.Errorf("latest item evicted")
+	}
+}
+
+// Tests that items expire from the propagation filter after its lifetime, being
+// let through again, while filters without a lifetime keep them until evicted.
+func TestPropagationFilterExpiry(t *testing.T) {
+	var (
+		clock = new(mclock.Simulated)
+		f     = newPropagationFilter(4, time.Minute, clock)
+	)
+	f.mark(common.Hash{0x01})
+	clock.Run(30 * time.Second)
+	f.mark(common.Hash{0x02})
+
+	clock.Run(30 * time.Second)
+	if f.contains(common.Hash{0x01}) {
+		t.Errorf("expired item still contained")
+	}
+	if !f.contains(common.Hash{0x02}) {
+		t.Errorf("live item not contained")
+	}
+	if f.mark(common.Hash{0x02}) {
+		t.Errorf("live item accepted again")
+	}
+	if !f.mark(common.Hash{0x01}) {
+		t.Errorf("expired item rejected")
+	}
+	if have := len(f.seen); have != 2 {
+		t.Errorf("filter size mismatch: have %d, want %d", have, 2)
+	}
+	// Items never expire without a lifetime
+	f = newPropagationFilter(4, 0, clock)
+	f.mark(common.Hash{0x01})
+	clock.Run(time.Hour)
+	if f.mark(common.Hash{0x01}) {
+		t.Errorf("item without lifetime accepted again")
+	}
+}
+
+// Tests that a transaction reinjected into the pool by a reorg is broadcast
+// again once its propagation expired, reaching the peers which haven't seen it,
+// while an echo within the lifetime is dropped.
+func TestPropagationTxReinjection(t *testing.T) {
+	txpool := make(mirrorTestPool)
+	h, remotes := newMirrorTestHandler(t, 1, txpool)
+
+	clock := new(mclock.Simulated)
+	h.propagatedTxs = newPropagationFilter(maxPropagatedTxs, propagatedTxLifetime, clock)
+
+	tx := types.NewTx(&types.InternalTx{ChainID: big.NewInt(1), Nonce: 1, GasTipCap: big.NewInt(1), GasFeeCap: big.NewInt(1), Value: big.NewInt(1)})
+	txpool[tx.Hash()] = tx
+
+	// waitPeers waits for the transaction to be broadcast to the given number of
+	// peers, failing if any more receive it
+	waitPeers := func(want int) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if peers, _ := remotes.summary(eth.TransactionsMsg); peers == want {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("transaction not broadcast to %d peers", want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond) // Catch any broadcast delivered late
+
+		if peers, _ := remotes.summary(eth.TransactionsMsg); peers != want {
+			t.Fatalf("broadcast peer count mismatch: have %d, want %d", peers, want)
+		}
+	}
+	h.BroadcastTransactions(types.Transactions{tx})
+	waitPeers(1)
+
+	// Connect a peer which hasn't seen the transaction, an echo within the
+	// lifetime must not reach it
+	connectMirrorTestPeer(t, h, remotes, 1, txpool)
+
+	clock.Run(propagatedTxLifetime / 2)
+	h.BroadcastTransactions(types.Transactions{tx})
+	waitPeers(1)
+
+	// Reinject the transaction once its propagation expired
+	clock.Run(propagatedTxLifetime / 2)
+	h.BroadcastTransactions(types.Transactions{tx})
+	waitPeers(2)
+}
+
+// relayNode is a node of a simulated network, relaying every block broadcast
+// it receives the way the block fetcher does after importing it. The senders are
+// not marked as knowing the blocks, as if their known sets had been evicted, so
+// only the propagation filter stops the blocks from looping.
+type relayNode struct {
+	h *handler
+
+	lock      sync.Mutex
+	delivered map[int]int // Number of broadcasts received from each node
+	relayed   int         // Number of broadcasts relayed further
+}
+
+// receive consumes the block broadcasts sent by another node, relaying the
+// ones not propagated before.
+func (n *relayNode) receive(from int, rw p2p.MsgReadWriter) {
+	for {
+		msg, err := rw.ReadMsg()
+		if err != nil {
+			return
+		}
+		ann := new(eth.NewBlockPacket)
+		if err := msg.Decode(ann); err != nil {
+			return
+		}
+		n.lock.Lock()
+		n.delivered[from]++
+		if !n.h.propagatedBlocks.contains(ann.Block.Hash()) {
+			n.relayed++
+			n.h.propagateBlock(ann.Block, nil)
+		}
+		n.lock.Unlock()
+	}
+}
+
+// Tests that blocks broadcast in a network full of cycles are relayed at most
+// once by every node, and never sent twice over the same link, so propagation
+// dies out instead of looping indefinitely.
+func TestPropagationCyclicTopology(t *testing.T) {
+	// Connect every node with all the others
+	const size = 4
+
+	nodes := make([]*relayNode, size)
+	for i := range nodes {
+		nodes[i] = &relayNode{
+			h:         &handler{peers: newPeerSet(), propagatedBlocks: newPropagationFilter(maxPropagatedBlocks, 0, mclock.System{})},
+			delivered: make(map[int]int),
+		}
+	}
+	zone := common.Location{0, 0}
+	status := &eth.StatusPacket{
+		ProtocolVersion: eth.ETH66,
+		NetworkID:       1,
+		Location:        zone.Name(),
+		SlicesRunning:   []common.Location{zone},
+		Entropy:         big.NewInt(1),
+	}
+	for i := 0; i < size; i++ {
+		for j := i + 1; j < size; j++ {
+			app, net := p2p.MsgPipe()
+			t.Cleanup(func() { app.Close(); net.Close() })
+
+			var (
+				local  = eth.NewPeer(eth.ETH66, p2p.NewPeer(enode.ID{0xa0, byte(i), byte(j)}, "peer", nil), net, nil)
+				remote = eth.NewPeer(eth.ETH66, p2p.NewPeer(enode.ID{0xa0, byte(j), byte(i)}, "peer", nil), app, nil)
+				errc   = make(chan error, 2)
+			)
+			t.Cleanup(local.Close)
+			t.Cleanup(remote.Close)
+
+			go func() { errc <- local.Handshake(enode.ID{0xa1, byte(i)}, status) }()
+			go func() { errc <- remote.Handshake(enode.ID{0xa1, byte(j)}, status) }()
+			for k := 0; k < 2; k++ {
+				if err := <-errc; err != nil {
+					t.Fatalf("link %d-%d: failed to handshake: %v", i, j, err)
+				}
+			}
+			if err := nodes[i].h.peers.registerPeer(local); err != nil {
+				t.Fatalf("link %d-%d: failed to register peer: %v", i, j, err)
+			}
+			if err := nodes[j].h.peers.registerPeer(remote); err != nil {
+				t.Fatalf("link %d-%d: failed to register peer: %v", i, j, err)
+			}
+			// Each side reads what the other side's peer writes
+			go nodes[j].receive(i, app)
+			go nodes[i].receive(j, net)
+		}
+	}
+	// Originate a block on the first node and wait for the gossip to die out
+	header := types.EmptyHeader()
+	header.SetNumber(big.NewInt(1))
+	block := types.NewBlockWithHeader(header)
+
+	nodes[0].h.propagateBlock(block, nil)
+
+	deliveries := func() (total int) {
+		for _, node := range nodes {
+			node.lock.Lock()
+			for _, count := range node.delivered {
+				total += count
+			}
+			node.lock.Unlock()
+		}
+		return total
+	}
+	var (
+		last    = -1
+		settled = time.Now()
+		timeout = time.After(5 * time.Second)
+	)
+	for time.Since(settled) < 250*time.Millisecond {
+		select {
+		case <-timeout:
+			t.Fatalf("propagation didn't settle, %d broadcasts delivered", deliveries())
+		case <-time.After(10 * time.Millisecond):
+		}
+		if total := deliveries(); total != last {
+			last, settled = total, time.Now()
+		}
+	}
+	// Every link carries the block at most once in each direction
+	if last > size*(size-1) {
+		t.Errorf("broadcast count mismatch: have %d, want <= %d", last, size*(size-1))
+	}
+	for i, node := range nodes {
+		node.lock.Lock()
+		for from, count := range node.delivered {
+			if count > 1 {
+				t.Errorf("node %d: block received %d times from node %d", i, count, from)
+			}
+		}
+		switch {
+		case i == 0 && node.relayed != 0:
+			t.Errorf("originating node relayed its own block %d times", node.relayed)
+		case i != 0 && node.relayed != 1:
+			t.Errorf("node %d: relay count mismatch: have %d, want 1", i, node.relayed)
+		}
+		node.lock.Unlock()
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// Tests that messages outside of a peer's allowlist are discarded without being
+// handled, and that the peer is dropped once it sent too many of them.
+func TestMessageAllowlist(t *testing.T) {
+	config := DefaultConfig
+	config.MaxDisallowedMessages = 3
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	peer := newPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), net, nil, &config)
+	defer peer.Close()
+
+	// Restrict the peer to announcing blocks, nothing else should be dispatched
+	peer.SetAllowlist([]uint64{NewBlockHashesMsg, BlockHeadersMsg})
+
+	announce := NewBlockHashesPacket{{Hash: common.Hash{0x01}, Number: 1}}
+	tests := []struct {
+		code    uint64
+		packet  interface{}
+		handled int
+		err     error
+	}{
+		{NewBlockHashesMsg, announce, 1, nil},
+		{GetBlockBodiesMsg, &GetBlockBodiesPacket66{RequestId: 1}, 1, nil},
+		{TransactionsMsg, TransactionsPacket{}, 1, nil},
+		{NewBlockHashesMsg, announce, 2, nil},
+		{GetBlockBodiesMsg, &GetBlockBodiesPacket66{RequestId: 2}, 2, errDisallowedMsg},
+	}
+	backend := new(mockBackend)
+	for i, tt := range tests {
+		go p2p.Send(app, tt.code, tt.packet)
+		if err := handleMessage(backend, peer); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if len(backend.handled) != tt.handled {
+			t.Errorf("test %d: handled packets mismatch: have %d, want %d", i, len(backend.handled), tt.handled)
+		}
+	}
+	// Lifting the restriction lets everything through again
+	peer.SetAllowlist(nil)
+	if !peer.allowed(GetBlockBodiesMsg) || !peer.allowed(TransactionsMsg) {
+		t.Errorf("messages disallowed without an allowlist")
+	}
+}
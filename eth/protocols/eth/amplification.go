@@ -0,0 +1,67 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// responseMsgs are the codes of the messages replying to data retrievals, whose
+// size counts towards the amplification of the requests of a peer.
+var responseMsgs = func() map[uint64]bool {
+	codes := make(map[uint64]bool)
+	for _, packet := range packets {
+		if packet.Role() == RoleResponse {
+			codes[uint64(packet.Kind())] = true
+		}
+	}
+	return codes
+}()
+
+// ampTracker measures the amplification of the data retrievals of a peer within
+// the current amplification window.
+type ampTracker struct {
+	start     time.Time // Start of the current window
+	requested uint64    // Bytes of the retrievals served within the window
+	served    uint64    // Reply bytes sent to the peer before the window started
+}
+
+// throttleAmplification reports whether a data retrieval of the given size from
+// the peer should be discarded, the replies served to it within the current
+// window outweighing its retrievals by more than MaxAmplification. The window
+// is only judged past a soft response limit worth of replies, as single replies
+// are expected to amplify. Discarded retrievals don't count towards the ratio.
+func (p *Peer) throttleAmplification(size uint32) bool {
+	limit := p.config.MaxAmplification
+	if limit == 0 {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	served := atomic.LoadUint64(&p.rw.served)
+	if now := time.Now(); now.Sub(p.amplification.start) >= p.config.AmplificationWindow {
+		p.amplification = ampTracker{start: now, served: served}
+	}
+	replied := served - p.amplification.served
+	if replied > softResponseLimit && replied/limit > p.amplification.requested {
+		return true
+	}
+	p.amplification.requested += uint64(size)
+	return false
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// Tests that peers whose data retrievals are answered with disproportionately
+// large replies get their further retrievals throttled for the rest of the
+// window, while peers with proportionate retrievals are always served.
+func TestAmplificationThrottling(t *testing.T) {
+	config := DefaultConfig
+	config.MaxAmplification, config.AmplificationWindow = 1024, time.Hour
+
+	// Replace the handler with a stub serving a fixed size reply to any request
+	var served int
+	defer func(old msgHandler) { eth66[GetBlockBodiesMsg] = old }(eth66[GetBlockBodiesMsg])
+	eth66[GetBlockBodiesMsg] = func(backend Backend, msg Decoder, peer *Peer) error {
+		var query []byte
+		if err := msg.Decode(&query); err != nil {
+			return err
+		}
+		served++
+		return send(peer.rw, BlockBodiesMsg, make([]byte, 1000*1024))
+	}
+	tests := []struct {
+		request int  // Size of the requests to send
+		count   int  // Number of requests to send
+		served  int  // Number of requests expected to be served
+		reset   bool // Whether to restart the window after the requests
+	}{
+		{16, 5, 3, true},         // Amplifying requests, throttled past the soft response limit
+		{64 * 1024, 8, 8, false}, // Proportionate requests, never throttled
+	}
+	for i, tt := range tests {
+		app, net := p2p.MsgPipe()
+		peer := newPeer(ETH66, p2p.NewPeer(enode.ID{0xe0, byte(i)}, "peer", nil), net, nil, &config)
+
+		// Drain the replies, they aren't relevant beyond their size
+		go func() {
+			for {
+				msg, err := app.ReadMsg()
+				if err != nil {
+					return
+				}
+				msg.Discard()
+			}
+		}()
+		served = 0
+		for j := 0; j < tt.count; j++ {
+			go p2p.Send(app, GetBlockBodiesMsg, make([]byte, tt.request))
+			if err := handleMessage(new(mockBackend), peer); err != nil {
+				t.Fatalf("test %d, request %d: failed to handle request: %v", i, j, err)
+			}
+		}
+		if served != tt.served {
+			t.Errorf("test %d: served requests mismatch: have %d, want %d", i, served, tt.served)
+		}
+		// Throttled peers are served again once the window ends
+		if tt.reset {
+			config.AmplificationWindow = 0
+			go p2p.Send(app, GetBlockBodiesMsg, make([]byte, tt.request))
+			if err := handleMessage(new(mockBackend), peer); err != nil {
+				t.Fatalf("test %d: failed to handle request: %v", i, err)
+			}
+			if served != tt.served+1 {
+				t.Errorf("test %d: request not served in a new window", i)
+			}
+			config.AmplificationWindow = time.Hour
+		}
+		peer.Close()
+		app.Close()
+		net.Close()
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// Tests that block by number queries serve the canonical block of the local
+// chain, and refuse the locations not run by the node.
+func TestGetBlockByNumber(t *testing.T) {
+	chain := newBlockDataChain()
+
+	tests := []struct {
+		location common.Location
+		number   uint64
+		found    bool
+		err      error
+	}{
+		{common.NodeLocation, 3, true, nil},   // Canonical block with a body
+		{common.NodeLocation, 8, false, nil},  // Canonical header without a body
+		{common.NodeLocation, 20, false, nil}, // Future block
+		{common.Location{0, 0, 0}, 3, false, errInvalidLocation},
+		{common.Location{0}, 3, false, nil},    // Unserved location
+		{common.Location{0, 1}, 3, false, nil}, // Unserved location
+	}
+	for i, tt := range tests {
+		res, err := answerGetBlockByNumberQuery(chain, GetBlockByNumberPacket{Location: tt.location, Number: tt.number})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if found := res.Block != nil; found != tt.found {
+			t.Errorf("test %d: block availability mismatch: have %v, want %v", i, found, tt.found)
+			continue
+		}
+		if !tt.found {
+			continue
+		}
+		if want := chain.canonical[tt.number]; res.Block.Hash() != want.Hash() {
+			t.Errorf("test %d: block mismatch: have %x, want %x", i, res.Block.Hash(), want.Hash())
+		}
+		if uncles := res.Block.Uncles(); len(uncles) != 1 || uncles[0].NumberU64() != tt.number-1 {
+			t.Errorf("test %d: body mismatch: have %v", i, uncles)
+		}
+	}
+}
+
+// Tests that a block by number request and its reply round-trip through the
+// wire, and that foreign locations are refused before anything is sent.
+func TestBlockByNumberRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		chain  = newBlockDataChain()
+		local  = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xb5}, "peer", nil), net, nil)
+		remote = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xb6}, "peer", nil), app, nil)
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	if err := local.RequestBlockByNumber(common.Location{0}, 2); !errors.Is(err, errLocationNotServed) {
+		t.Fatalf("foreign location request: error mismatch: have %v, want %v", err, errLocationNotServed)
+	}
+	go local.RequestBlockByNumber(common.NodeLocation, 2)
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	if msg.Code != GetBlockByNumberMsg {
+		t.Fatalf("request code mismatch: have %#x, want %#x", msg.Code, GetBlockByNumberMsg)
+	}
+	var query GetBlockByNumberPacket66
+	if err := msg.Decode(&query); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	if !query.Location.Equal(common.NodeLocation) || query.Number != 2 {
+		t.Fatalf("request mismatch: have %+v", query.GetBlockByNumberPacket)
+	}
+	res, err := answerGetBlockByNumberQuery(chain, query.GetBlockByNumberPacket)
+	if err != nil {
+		t.Fatalf("failed to answer query: %v", err)
+	}
+	go remote.ReplyBlockByNumber(query.RequestId, res)
+
+	backend := new(mockBackend)
+	if err := handleMessage(backend, local); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+	}
+	have := backend.handled[0].(*BlockByNumberPacket)
+	if want := chain.canonical[2]; have.Block == nil || have.Block.Hash() != want.Hash() {
+		t.Fatalf("block mismatch: have %v, want %x", have.Block, want.Hash())
+	}
+	// Peers older than eth/67 can't be asked
+	old := NewPeer(ETH66, p2p.NewPeer(enode.ID{0xb7}, "peer", nil), net, nil)
+	defer old.Close()
+
+	if err := old.RequestBlockByNumber(common.NodeLocation, 2); err == nil {
+		t.Errorf("eth/66 peer accepted block by number request")
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// newBlockDataChain creates a test chain with bodies for blocks 1 to 6, each of
+// them carrying a distinct uncle.
+func newBlockDataChain() *testChain {
+	chain := newTestChain(10)
+	for number := uint64(1); number <= 6; number++ {
+		uncle := types.EmptyHeader()
+		uncle.SetNumber(new(big.Int).SetUint64(number - 1))
+		uncle.SetDifficulty(big.NewInt(2))
+		chain.addBody(chain.canonical[number].Hash(), &types.Body{Uncles: []*types.Header{uncle}})
+	}
+	return chain
+}
+
+// Tests that block data retrievals serve the same headers and bodies as the
+// separate header and body retrievals would, pairing them up one by one.
+func TestGetBlockData(t *testing.T) {
+	chain := newBlockDataChain()
+
+	tests := []struct {
+		query  GetBlockDataPacket
+		dom    []int    // Canonical blocks to mark dominant
+		blocks []uint64 // Blocks whose data is expected
+	}{
+		// Plain ranges by number and by canonical hash, cut at the first missing body
+		{GetBlockDataPacket{Origin: HashOrNumber{Number: 1}, Amount: 4}, nil, []uint64{1, 2, 3, 4}},
+		{GetBlockDataPacket{Origin: HashOrNumber{Hash: chain.canonical[4].Hash()}, Amount: 2}, nil, []uint64{4, 5}},
+		{GetBlockDataPacket{Origin: HashOrNumber{Number: 5}, Amount: 4}, nil, []uint64{5, 6}},
+
+		// Dom queries return only the dominant blocks
+		{GetBlockDataPacket{Origin: HashOrNumber{Number: 1}, Amount: 2, Dom: true}, []int{2, 3, 4}, []uint64{2, 3}},
+
+		// Unknown and future origins are not served
+		{GetBlockDataPacket{Origin: HashOrNumber{Hash: common.Hash{0xff}}, Amount: 2}, nil, nil},
+		{GetBlockDataPacket{Origin: HashOrNumber{Number: 20}, Amount: 2}, nil, nil},
+	}
+	for i, tt := range tests {
+		chain.engine.dom = make(map[common.Hash]bool)
+		for _, n := range tt.dom {
+			chain.engine.dom[chain.canonical[n].Hash()] = true
+		}
+		data := answerGetBlockDataQuery(chain, tt.query, nil)
+		if len(data.Headers) != len(tt.blocks) || len(data.Bodies) != len(tt.blocks) {
+			t.Errorf("test %d: block count mismatch: have %d/%d, want %d", i, len(data.Headers), len(data.Bodies), len(tt.blocks))
+			continue
+		}
+		if len(tt.blocks) == 0 {
+			continue
+		}
+		// Compare against the separate retrieval paths
+		headers := answerGetBlockHeadersQuery(chain, &GetBlockHeadersPacket{
+			Origin: HashOrNumber{Number: tt.blocks[0]},
+			Amount: uint64(len(tt.blocks)),
+			Dom:    tt.query.Dom,
+			Skip:   1,
+		}, 0, nil)
+		for j, number := range tt.blocks {
+			if data.Headers[j].NumberU64() != number || data.Headers[j].Hash() != headers[j].Hash() {
+				t.Errorf("test %d, block %d: header mismatch: have %d/%x, want %d/%x", i, j, data.Headers[j].NumberU64(), data.Headers[j].Hash(), number, headers[j].Hash())
+			}
+			if want := chain.GetBodyRLP(headers[j].Hash()); !bytes.Equal(data.Bodies[j], want) {
+				t.Errorf("test %d, block %d: body mismatch: have %x, want %x", i, j, data.Bodies[j], want)
+			}
+		}
+	}
+}
+
+// Tests that block data requests and their replies round-trip through the wire
+// between eth/67 peers.
+func TestBlockDataRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		chain  = newBlockDataChain()
+		local  = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xb1}, "peer", nil), net, nil)
+		remote = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xb2}, "peer", nil), app, nil)
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	go local.RequestBlockData(2, 3, false)
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	if msg.Code != GetBlockDataMsg {
+		t.Fatalf("request code mismatch: have %#x, want %#x", msg.Code, GetBlockDataMsg)
+	}
+	var query GetBlockDataPacket66
+	if err := msg.Decode(&query); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	if query.Origin.Number != 2 || query.Amount != 3 || query.Dom {
+		t.Fatalf("request mismatch: have %+v", query.GetBlockDataPacket)
+	}
+	go remote.ReplyBlockDataRLP(query.RequestId, answerGetBlockDataQuery(chain, query.GetBlockDataPacket, remote))
+
+	backend := new(mockBackend)
+	if err := handleMessage(backend, local); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+	}
+	have := backend.handled[0].(*BlockDataPacket)
+	if len(have.Headers) != 3 || len(have.Bodies) != 3 {
+		t.Fatalf("block data size mismatch: have %d/%d, want 3/3", len(have.Headers), len(have.Bodies))
+	}
+	for i, header := range have.Headers {
+		if want := chain.canonical[2+i]; header.Hash() != want.Hash() {
+			t.Errorf("header %d mismatch: have %x, want %x", i, header.Hash(), want.Hash())
+		}
+		if uncles := have.Bodies[i].Uncles; len(uncles) != 1 || uncles[0].NumberU64() != header.NumberU64()-1 {
+			t.Errorf("body %d mismatch: have %v", i, uncles)
+		}
+	}
+}
+
+// Tests that block data replies whose headers and bodies don't pair up are
+// rejected before reaching the backend.
+func TestBlockDataMismatch(t *testing.T) {
+	peer := NewPeer(ETH67, p2p.NewPeer(enode.ID{0xb3}, "peer", nil), nil, nil)
+	defer peer.Close()
+
+	requestTracker.Track(peer.id, peer.version, GetBlockDataMsg, BlockDataMsg, 1)
+	defer requestTracker.Fulfil(peer.id, peer.version, BlockDataMsg, 1)
+
+	backend := new(mockBackend)
+	msg := encodeMsg(t, BlockDataMsg, &BlockDataPacket66{
+		RequestId: 1,
+		BlockDataPacket: BlockDataPacket{
+			Headers: []*types.Header{types.EmptyHeader(), types.EmptyHeader()},
+			Bodies:  []*BlockBody{{}},
+		},
+	})
+	if err := handleBlockData66(backend, msg, peer); !errors.Is(err, errInvalidBlockData) {
+		t.Errorf("error mismatch: have %v, want %v", err, errInvalidBlockData)
+	}
+	if len(backend.handled) != 0 {
+		t.Errorf("mismatched block data delivered to the backend")
+	}
+}
+
+// Tests that block data can be fetched directly from eth/67 peers.
+func TestFetchBlockData(t *testing.T) {
+	chain := newBlockDataChain()
+
+	query := GetBlockDataPacket{Origin: HashOrNumber{Number: 2}, Amount: 3}
+	have := testFetch(t, ETH67, GetBlockDataMsg, BlockDataMsg,
+		func(id uint64) interface{} {
+			return &BlockDataRLPPacket66{RequestId: id, BlockDataRLPPacket: answerGetBlockDataQuery(chain, query, nil)}
+		},
+		func(peer *Peer) (interface{}, error) {
+			return peer.FetchBlockData(2, 3, false, time.Second)
+		},
+	).(*BlockDataPacket)
+
+	if len(have.Headers) != 3 || len(have.Bodies) != 3 {
+		t.Fatalf("block data size mismatch: have %d/%d, want 3/3", len(have.Headers), len(have.Bodies))
+	}
+	for i, header := range have.Headers {
+		if want := chain.canonical[2+i]; header.Hash() != want.Hash() {
+			t.Errorf("header %d mismatch: have %x, want %x", i, header.Hash(), want.Hash())
+		}
+	}
+}
+
+// Tests that block data fetches from peers older than eth/67 fall back to a plain
+// header request followed by a body request for the headers retrieved, while
+// the composite request is neither sent nor accepted.
+func TestBlockDataFallback(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		chain  = newBlockDataChain()
+		peer   = NewPeer(ETH66, p2p.NewPeer(enode.ID{0xb4}, "peer", nil), net, nil)
+		remote = NewPeer(ETH66, p2p.NewPeer(enode.ID{0xb5}, "peer", nil), app, nil)
+	)
+	defer peer.Close()
+	defer remote.Close()
+
+	if err := peer.RequestBlockData(2, 3, false); err == nil {
+		t.Fatalf("block data requested from eth/66 peer")
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- func() error {
+			msg, err := app.ReadMsg()
+			if err != nil {
+				return err
+			}
+			if msg.Code != GetBlockHeadersMsg {
+				return fmt.Errorf("request code mismatch: have %#x, want %#x", msg.Code, GetBlockHeadersMsg)
+			}
+			var headers GetBlockHeadersPacket66
+			if err := msg.Decode(&headers); err != nil {
+				return err
+			}
+			if q := headers.GetBlockHeadersPacket; q.Origin.Number != 2 || q.Amount != 3 || q.Skip != 1 || q.Dom || q.Reverse {
+				return fmt.Errorf("header request mismatch: have %+v", q)
+			}
+			if err := remote.ReplyBlockHeaders(headers.RequestId, answerGetBlockHeadersQuery(chain, headers.GetBlockHeadersPacket, 0, remote)); err != nil {
+				return err
+			}
+			if msg, err = app.ReadMsg(); err != nil {
+				return err
+			}
+			if msg.Code != GetBlockBodiesMsg {
+				return fmt.Errorf("request code mismatch: have %#x, want %#x", msg.Code, GetBlockBodiesMsg)
+			}
+			var bodies GetBlockBodiesPacket66
+			if err := msg.Decode(&bodies); err != nil {
+				return err
+			}
+			var response []rlp.RawValue
+			for _, hash := range bodies.GetBlockBodiesPacket {
+				response = append(response, chain.GetBodyRLP(hash))
+			}
+			return remote.ReplyBlockBodiesRLP(bodies.RequestId, response)
+		}()
+	}()
+	backend := new(mockBackend)
+	go func() {
+		for i := 0; i < 2; i++ {
+			if err := handleMessage(backend, peer); err != nil {
+				t.Errorf("failed to handle reply: %v", err)
+			}
+		}
+	}()
+	have, err := peer.FetchBlockData(2, 3, false, time.Second)
+	if err != nil {
+		t.Fatalf("failed to fetch block data: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to serve requests: %v", err)
+	}
+	if len(have.Headers) != 3 || len(have.Bodies) != 3 {
+		t.Fatalf("block data size mismatch: have %d/%d, want 3/3", len(have.Headers), len(have.Bodies))
+	}
+	for i, header := range have.Headers {
+		if want := chain.canonical[2+i]; header.Hash() != want.Hash() {
+			t.Errorf("header %d mismatch: have %x, want %x", i, header.Hash(), want.Hash())
+		}
+		if uncles := have.Bodies[i].Uncles; len(uncles) != 1 || uncles[0].NumberU64() != header.NumberU64()-1 {
+			t.Errorf("body %d mismatch: have %v", i, uncles)
+		}
+	}
+	if len(backend.handled) != 0 {
+		t.Errorf("fetched replies delivered to the backend: %v", backend.handled)
+	}
+	// Block data queries are not dispatched over eth/66
+	enc, _ := rlp.EncodeToBytes(&GetBlockDataPacket66{RequestId: 1})
+	err = dispatchMessage(new(mockBackend), peer, p2p.Msg{Code: GetBlockDataMsg, Size: uint32(len(enc)), Payload: bytes.NewReader(enc)})
+	if !errors.Is(err, errInvalidMsgCode) {
+		t.Errorf("eth/66 block data query error mismatch: have %v, want %v", err, errInvalidMsgCode)
+	}
+}
@@ -17,6 +17,8 @@
 package eth
 
 import (
+	"time"
+
 	"github.com/dominant-strategies/go-quai/common"
 	"github.com/dominant-strategies/go-quai/core/types"
 )
@@ -25,6 +27,10 @@ const (
 	// This is the target size for the packs of transactions or announcements. A
 	// pack can get larger than this if a single transactions exceeds this size.
 	maxTxPacketSize = 100 * 1024
+
+	// maxBlockAnnounceBatch is the maximum number of block hashes to pack into a
+	// single NewBlockHashes announcement.
+	maxBlockAnnounceBatch = 64
 )
 
 // blockPropagation is a block propagation event, waiting for its turn in the
@@ -37,6 +43,10 @@ type blockPropagation struct {
 // to the remote peer. The goal is to have an async writer that does not lock up
 // node internals and at the same time rate limits queued data.
 func (p *Peer) broadcastBlocks() {
+	var (
+		pending []*types.Block   // Block announcements waiting for the window to close
+		flush   <-chan time.Time // Fires when the current coalescing window closes
+	)
 	for {
 		select {
 		case prop := <-p.queuedBlocks:
@@ -46,10 +56,24 @@ func (p *Peer) broadcastBlocks() {
 			p.Log().Trace("Propagated block", "number", prop.block.Number(), "hash", prop.block.Hash(), "number", prop.block.NumberU64())
 
 		case block := <-p.queuedBlockAnns:
-			if err := p.SendNewBlockHashes([]common.Hash{block.Hash()}, []uint64{block.NumberU64()}); err != nil {
+			// Gather the announcement, sending right away if the batch is full
+			pending = append(pending, block)
+			if window := p.config.BlockAnnounceWindow; len(pending) < maxBlockAnnounceBatch && window > 0 {
+				if flush == nil {
+					flush = time.After(window)
+				}
+				continue
+			}
+			if err := p.sendBlockAnnounces(pending); err != nil {
+				return
+			}
+			pending, flush = nil, nil
+
+		case <-flush:
+			if err := p.sendBlockAnnounces(pending); err != nil {
 				return
 			}
-			p.Log().Trace("Announced block", "number", block.Number(), "hash", block.Hash())
+			pending, flush = nil, nil
 
 		case <-p.term:
 			return
@@ -57,6 +81,23 @@ func (p *Peer) broadcastBlocks() {
 	}
 }
 
+// sendBlockAnnounces packs a batch of queued block announcements into a single
+// NewBlockHashes message.
+func (p *Peer) sendBlockAnnounces(blocks []*types.Block) error {
+	var (
+		hashes  = make([]common.Hash, len(blocks))
+		numbers = make([]uint64, len(blocks))
+	)
+	for i, block := range blocks {
+		hashes[i], numbers[i] = block.Hash(), block.NumberU64()
+	}
+	if err := p.SendNewBlockHashes(hashes, numbers); err != nil {
+		return err
+	}
+	p.Log().Trace("Announced blocks", "count", len(blocks), "last", hashes[len(hashes)-1])
+	return nil
+}
+
 // broadcastTransactions is a write loop that schedules transaction broadcasts
 // to the remote peer. The goal is to have an async writer that does not lock up
 // node internals and at the same time rate limits queued data.
@@ -0,0 +1,64 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// Tests that block announcements queued within the coalescing window are sent
+// to the remote peer as a single NewBlockHashes message.
+func TestBlockAnnounceCoalescing(t *testing.T) {
+	config := DefaultConfig
+	config.BlockAnnounceWindow = 200 * time.Millisecond
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	peer := newPeer(ETH66, p2p.NewPeer(enode.ID{}, "peer", nil), net, nil, &config)
+	defer peer.Close()
+
+	blocks := []*types.Block{newTestBlock(1), newTestBlock(2), newTestBlock(3)}
+	for _, block := range blocks {
+		peer.AsyncSendNewBlockHash(block)
+	}
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read announcement: %v", err)
+	}
+	if msg.Code != NewBlockHashesMsg {
+		t.Fatalf("message code mismatch: have %x, want %x", msg.Code, NewBlockHashesMsg)
+	}
+	var ann NewBlockHashesPacket
+	if err := msg.Decode(&ann); err != nil {
+		t.Fatalf("failed to decode announcement: %v", err)
+	}
+	if len(ann) != len(blocks) {
+		t.Fatalf("announcement size mismatch: have %d, want %d", len(ann), len(blocks))
+	}
+	for i, block := range blocks {
+		if ann[i].Hash != block.Hash() || ann[i].Number != block.NumberU64() {
+			t.Errorf("announcement %d mismatch: have %x/%d, want %x/%d", i, ann[i].Hash, ann[i].Number, block.Hash(), block.NumberU64())
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// Tests that canonical hash queries serve the hashes of the local chain, answer
+// numbers beyond the head with an empty hash, and refuse the locations not run
+// by the node.
+func TestGetCanonicalHash(t *testing.T) {
+	chain := newTestChain(10)
+
+	tests := []struct {
+		location common.Location
+		number   uint64
+		found    bool
+		err      error
+	}{
+		{common.NodeLocation, 0, true, nil},   // Genesis
+		{common.NodeLocation, 7, true, nil},   // Canonical block
+		{common.NodeLocation, 10, true, nil},  // Head block
+		{common.NodeLocation, 11, false, nil}, // Beyond the head
+		{common.Location{0, 0, 0}, 7, false, errInvalidLocation},
+		{common.Location{0}, 7, false, nil},    // Unserved location
+		{common.Location{0, 1}, 7, false, nil}, // Unserved location
+	}
+	for i, tt := range tests {
+		res, err := answerGetCanonicalHashQuery(chain, GetCanonicalHashPacket{Location: tt.location, Number: tt.number})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		want := common.Hash{}
+		if tt.found {
+			want = chain.canonical[tt.number].Hash()
+		}
+		if res.Hash != want {
+			t.Errorf("test %d: hash mismatch: have %x, want %x", i, res.Hash, want)
+		}
+	}
+}
+
+// Tests that a canonical hash request and its reply round-trip through the wire,
+// and that foreign locations are refused before anything is sent.
+func TestCanonicalHashRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		chain  = newTestChain(10)
+		local  = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xf3}, "peer", nil), net, nil)
+		remote = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xf4}, "peer", nil), app, nil)
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	if err := local.RequestCanonicalHash(common.Location{0}, 2); !errors.Is(err, errLocationNotServed) {
+		t.Fatalf("foreign location request: error mismatch: have %v, want %v", err, errLocationNotServed)
+	}
+	for _, number := range []uint64{4, 20} {
+		go local.RequestCanonicalHash(common.NodeLocation, number)
+
+		msg, err := app.ReadMsg()
+		if err != nil {
+			t.Fatalf("number %d: failed to read request: %v", number, err)
+		}
+		if msg.Code != GetCanonicalHashMsg {
+			t.Fatalf("number %d: request code mismatch: have %#x, want %#x", number, msg.Code, GetCanonicalHashMsg)
+		}
+		var query GetCanonicalHashPacket66
+		if err := msg.Decode(&query); err != nil {
+			t.Fatalf("number %d: failed to decode request: %v", number, err)
+		}
+		if !query.Location.Equal(common.NodeLocation) || query.Number != number {
+			t.Fatalf("number %d: request mismatch: have %+v", number, query.GetCanonicalHashPacket)
+		}
+		res, err := answerGetCanonicalHashQuery(chain, query.GetCanonicalHashPacket)
+		if err != nil {
+			t.Fatalf("number %d: failed to answer query: %v", number, err)
+		}
+		go remote.ReplyCanonicalHash(query.RequestId, res)
+
+		backend := new(mockBackend)
+		if err := handleMessage(backend, local); err != nil {
+			t.Fatalf("number %d: failed to handle reply: %v", number, err)
+		}
+		if len(backend.handled) != 1 {
+			t.Fatalf("number %d: delivered packet count mismatch: have %d, want %d", number, len(backend.handled), 1)
+		}
+		want := common.Hash{}
+		if number < uint64(len(chain.canonical)) {
+			want = chain.canonical[number].Hash()
+		}
+		if have := backend.handled[0].(*CanonicalHashPacket); have.Hash != want {
+			t.Fatalf("number %d: hash mismatch: have %x, want %x", number, have.Hash, want)
+		}
+	}
+	// Peers older than eth/67 can't be asked
+	old := NewPeer(ETH66, p2p.NewPeer(enode.ID{0xf5}, "peer", nil), net, nil)
+	defer old.Close()
+
+	if err := old.RequestCanonicalHash(common.NodeLocation, 2); err == nil {
+		t.Errorf("eth/66 peer accepted canonical hash request")
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// etxTableFields marks the positions of the ExternalTx fields which tend to be
+// shared by many ETXs of a block: the destination, the call data, the access
+// list and the sender. These are moved into the shared table of a compact body.
+var etxTableFields = [...]bool{5: true, 7: true, 8: true, 9: true}
+
+const (
+	// maxCompactTableEntry is the largest table entry accepted in a compact reply.
+	// Entries are fields of single transactions, so they can't outgrow the size
+	// limit of a transaction in the pool.
+	maxCompactTableEntry = 128 * 1024
+
+	// maxCompactBodyEtxs is the maximum number of ETXs accepted in a single compact
+	// body, well above what the gas limit of a block admits.
+	maxCompactBodyEtxs = 8192
+
+	// compactExpansionFactor is how many times the negotiated message size limit
+	// a compact reply may expand to.
+	compactExpansionFactor = 4
+)
+
+var (
+	errNotExternalTx    = errors.New("not an external transaction")
+	errCompactOversized = errors.New("compact block bodies oversized")
+)
+
+// etxTable deduplicates the field encodings moved out of the compacted ETXs.
+type etxTable struct {
+	entries []rlp.RawValue
+	index   map[string]uint64
+}
+
+// add inserts a field encoding into the table if not yet present and returns
+// its index.
+func (t *etxTable) add(field []byte) uint64 {
+	if idx, ok := t.index[string(field)]; ok {
+		return idx
+	}
+	idx := uint64(len(t.entries))
+	t.entries = append(t.entries, field)
+	t.index[string(field)] = idx
+	return idx
+}
+
+// newCompactBlockBodies converts a batch of RLP encoded block bodies into their
+// compact form, sharing a single table across all of them. An error is returned
+// if any of the bodies contains something other than external transactions in
+// its ETX set, in which case the bodies should be sent in plain form instead.
+func newCompactBlockBodies(bodies []rlp.RawValue) (*CompactBlockBodiesPacket, error) {
+	var (
+		table  = &etxTable{index: make(map[string]uint64)}
+		packet = &CompactBlockBodiesPacket{Bodies: make([]CompactBlockBody, len(bodies))}
+	)
+	for i, body := range bodies {
+		var fields []rlp.RawValue
+		if err := rlp.DecodeBytes(body, &fields); err != nil {
+			return nil, err
+		}
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid block body: %d fields", len(fields))
+		}
+		etxs, err := splitRawList(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		compact := CompactBlockBody{
+			Transactions:    fields[0],
+			Uncles:          fields[1],
+			ExtTransactions: make([]rlp.RawValue, len(etxs)),
+			SubManifest:     fields[3],
+		}
+		for j, etx := range etxs {
+			if compact.ExtTransactions[j], err = compactEtx(etx, table); err != nil {
+				return nil, fmt.Errorf("body %d, etx %d: %w", i, j, err)
+			}
+		}
+		packet.Bodies[i] = compact
+	}
+	packet.Table = table.entries
+	return packet, nil
+}
+
+// Expand reconstructs the original encoding of the compacted block bodies. As a
+// small table entry may be referenced by every ETX of a reply, the size of the
+// expanded bodies is computed up front and refused above maxSize, before any of
+// them is assembled. Tables with oversized or unreferenced entries are refused
+// too, as no honest compaction produces them.
+func (p *CompactBlockBodiesPacket) Expand(maxSize uint64) ([]rlp.RawValue, error) {
+	for i, entry := range p.Table {
+		if len(entry) > maxCompactTableEntry {
+			return nil, fmt.Errorf("%w: table entry %d: %d bytes > %d", errCompactOversized, i, len(entry), maxCompactTableEntry)
+		}
+	}
+	var (
+		used   = make([]bool, len(p.Table))
+		fields = make([][][]rlp.RawValue, len(p.Bodies))
+		size   uint64
+	)
+	for i, body := range p.Bodies {
+		if len(body.ExtTransactions) > maxCompactBodyEtxs {
+			return nil, fmt.Errorf("%w: body %d: %d etxs > %d", errCompactOversized, i, len(body.ExtTransactions), maxCompactBodyEtxs)
+		}
+		size += uint64(len(body.Transactions) + len(body.Uncles) + len(body.SubManifest))
+		fields[i] = make([][]rlp.RawValue, len(body.ExtTransactions))
+		for j, etx := range body.ExtTransactions {
+			var err error
+			if fields[i][j], err = resolveEtx(etx, p.Table, used); err != nil {
+				return nil, fmt.Errorf("body %d, etx %d: %w", i, j, err)
+			}
+			for _, field := range fields[i][j] {
+				size += uint64(len(field))
+			}
+			if size > maxSize {
+				return nil, fmt.Errorf("%w: expanded size above %d bytes", errCompactOversized, maxSize)
+			}
+		}
+	}
+	for i, ok := range used {
+		if !ok {
+			return nil, fmt.Errorf("table entry %d unreferenced", i)
+		}
+	}
+	bodies := make([]rlp.RawValue, len(p.Bodies))
+	for i, body := range p.Bodies {
+		etxs := make([]rlp.RawValue, len(fields[i]))
+		for j := range fields[i] {
+			list, err := rlp.EncodeToBytes(fields[i][j])
+			if err != nil {
+				return nil, err
+			}
+			if etxs[j], err = rlp.EncodeToBytes(append([]byte{types.ExternalTxType}, list...)); err != nil {
+				return nil, err
+			}
+		}
+		etxlist, err := rlp.EncodeToBytes(etxs)
+		if err != nil {
+			return nil, err
+		}
+		if bodies[i], err = rlp.EncodeToBytes([]rlp.RawValue{body.Transactions, body.Uncles, etxlist, body.SubManifest}); err != nil {
+			return nil, err
+		}
+	}
+	return bodies, nil
+}
+
+// compactEtx replaces the table fields of an encoded external transaction with
+// their indices in the table, returning the remaining list of fields.
+func compactEtx(etx []byte, table *etxTable) (rlp.RawValue, error) {
+	// Typed transactions are wrapped into an RLP string within lists
+	enc, _, err := rlp.SplitString(etx)
+	if err != nil {
+		return nil, err
+	}
+	if len(enc) == 0 || enc[0] != types.ExternalTxType {
+		return nil, errNotExternalTx
+	}
+	fields, err := splitRawList(enc[1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) != len(etxTableFields) {
+		return nil, fmt.Errorf("invalid external transaction: %d fields", len(fields))
+	}
+	for i, field := range fields {
+		if etxTableFields[i] {
+			fields[i] = rlp.AppendUint64(nil, table.add(field))
+		}
+	}
+	return rlp.EncodeToBytes(fields)
+}
+
+// resolveEtx restores the table fields of a compacted external transaction,
+// marking the referenced table entries as used, and returns the fields of the
+// original transaction.
+func resolveEtx(compact []byte, table []rlp.RawValue, used []bool) ([]rlp.RawValue, error) {
+	fields, err := splitRawList(compact)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) != len(etxTableFields) {
+		return nil, fmt.Errorf("invalid compact external transaction: %d fields", len(fields))
+	}
+	for i, field := range fields {
+		if !etxTableFields[i] {
+			continue
+		}
+		idx, _, err := rlp.SplitUint64(field)
+		if err != nil {
+			return nil, err
+		}
+		if idx >= uint64(len(table)) {
+			return nil, fmt.Errorf("table index %d out of range (%d entries)", idx, len(table))
+		}
+		fields[i], used[idx] = table[idx], true
+	}
+	return fields, nil
+}
+
+// splitRawList splits an RLP list into the encodings of its items.
+func splitRawList(list []byte) ([]rlp.RawValue, error) {
+	content, _, err := rlp.SplitList(list)
+	if err != nil {
+		return nil, err
+	}
+	var items []rlp.RawValue
+	for len(content) > 0 {
+		_, _, rest, err := rlp.Split(content)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, content[:len(content)-len(rest)])
+		content = rest
+	}
+	return items, nil
+}
@@ -0,0 +1,298 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// newTestEtxs creates n external transactions cycling through the given number
+// of destinations, with the call data and sender shared by all destinations
+// alike, as is common for blocks heavy in cross-chain traffic.
+func newTestEtxs(n int, destinations int) []*types.Transaction {
+	var (
+		sender = common.HexToAddress("0x1a00000000000000000000000000000000000001")
+		data   = bytes.Repeat([]byte{0xca, 0xfe}, 34)
+		etxs   = make([]*types.Transaction, n)
+	)
+	for i := range etxs {
+		to := common.BytesToAddress(append(common.FromHex("0x2b000000000000000000000000000000000000"), byte(i%destinations)))
+
+		etxs[i] = types.NewTx(&types.ExternalTx{
+			ChainID:   big.NewInt(1),
+			Nonce:     uint64(i),
+			GasTipCap: big.NewInt(1),
+			GasFeeCap: big.NewInt(1000000000),
+			Gas:       50000,
+			To:        &to,
+			Value:     big.NewInt(int64(i) * 1000000000),
+			Data:      data,
+			Sender:    sender,
+		})
+	}
+	return etxs
+}
+
+// newTestBodies RLP encodes a batch of block bodies carrying the given ETXs.
+func newTestBodies(t testing.TB, etxsets ...[]*types.Transaction) []rlp.RawValue {
+	bodies := make([]rlp.RawValue, len(etxsets))
+	for i, etxs := range etxsets {
+		body := &types.Body{
+			Transactions:    newTestTransactions(2),
+			ExtTransactions: etxs,
+			SubManifest:     types.BlockManifest{common.Hash{byte(i)}},
+		}
+		enc, err := rlp.EncodeToBytes(body)
+		if err != nil {
+			t.Fatalf("failed to encode body %d: %v", i, err)
+		}
+		bodies[i] = enc
+	}
+	return bodies
+}
+
+// Tests that compacting block bodies deduplicates the repetitive ETX fields and
+// expands back into the exact original encoding.
+func TestCompactBlockBodiesRoundTrip(t *testing.T) {
+	tests := []struct {
+		etxsets [][]*types.Transaction
+		table   int // Expected number of shared table entries
+	}{
+		{nil, 0},                         // No bodies at all
+		{[][]*types.Transaction{nil}, 0}, // Body without ETXs
+		{[][]*types.Transaction{newTestEtxs(1, 1)}, 4},                     // Every field once
+		{[][]*types.Transaction{newTestEtxs(64, 4)}, 4 + 3},                // Destinations vary
+		{[][]*types.Transaction{newTestEtxs(16, 2), newTestEtxs(8, 4)}, 7}, // Table shared across bodies
+	}
+	for i, tt := range tests {
+		bodies := newTestBodies(t, tt.etxsets...)
+
+		compact, err := newCompactBlockBodies(bodies)
+		if err != nil {
+			t.Fatalf("test %d: failed to compact bodies: %v", i, err)
+		}
+		if len(compact.Table) != tt.table {
+			t.Errorf("test %d: table size mismatch: have %d, want %d", i, len(compact.Table), tt.table)
+		}
+		// Send the compacted bodies through the wire and expand them
+		enc, err := rlp.EncodeToBytes(compact)
+		if err != nil {
+			t.Fatalf("test %d: failed to encode compact bodies: %v", i, err)
+		}
+		var decoded CompactBlockBodiesPacket
+		if err := rlp.DecodeBytes(enc, &decoded); err != nil {
+			t.Fatalf("test %d: failed to decode compact bodies: %v", i, err)
+		}
+		expanded, err := decoded.Expand(maxMessageSize)
+		if err != nil {
+			t.Fatalf("test %d: failed to expand bodies: %v", i, err)
+		}
+		if len(expanded) != len(bodies) {
+			t.Fatalf("test %d: body count mismatch: have %d, want %d", i, len(expanded), len(bodies))
+		}
+		for j := range bodies {
+			if !bytes.Equal(expanded[j], bodies[j]) {
+				t.Errorf("test %d, body %d: encoding mismatch", i, j)
+			}
+		}
+	}
+}
+
+// Tests that bodies containing anything but external transactions in their ETX
+// set are refused by the compact encoding, and that corrupt table references
+// are detected on expansion.
+func TestCompactBlockBodiesInvalid(t *testing.T) {
+	bodies := newTestBodies(t, newTestTransactions(1))
+	if _, err := newCompactBlockBodies(bodies); !errors.Is(err, errNotExternalTx) {
+		t.Errorf("error mismatch: have %v, want %v", err, errNotExternalTx)
+	}
+	compact, err := newCompactBlockBodies(newTestBodies(t, newTestEtxs(2, 2)))
+	if err != nil {
+		t.Fatalf("failed to compact bodies: %v", err)
+	}
+	compact.Table = compact.Table[:1]
+	if _, err := compact.Expand(maxMessageSize); err == nil {
+		t.Errorf("expanded bodies with out of range table index")
+	}
+}
+
+// Tests that compact replies can't be used to amplify a small message into an
+// arbitrarily large allocation, by referencing a big table entry many times over,
+// and that tables padded with oversized or unused entries are refused.
+func TestCompactBlockBodiesAmplification(t *testing.T) {
+	compact, err := newCompactBlockBodies(newTestBodies(t, newTestEtxs(1, 1)))
+	if err != nil {
+		t.Fatalf("failed to compact bodies: %v", err)
+	}
+	// Inflate the call data to a large entry and reference it from many ETXs
+	var data int
+	for i, field := range compact.Table {
+		if len(field) > len(compact.Table[data]) {
+			data = i
+		}
+	}
+	compact.Table[data], _ = rlp.EncodeToBytes(make([]byte, 64*1024))
+	etx := compact.Bodies[0].ExtTransactions[0]
+	for len(compact.Bodies[0].ExtTransactions) < 1024 {
+		compact.Bodies[0].ExtTransactions = append(compact.Bodies[0].ExtTransactions, etx)
+	}
+	enc, err := rlp.EncodeToBytes(compact)
+	if err != nil {
+		t.Fatalf("failed to encode compact bodies: %v", err)
+	}
+	if len(enc) > 128*1024 {
+		t.Fatalf("attack reply unexpectedly large: %d bytes", len(enc))
+	}
+	limit := uint64(16 * len(enc))
+	if _, err := compact.Expand(limit); !errors.Is(err, errCompactOversized) {
+		t.Errorf("amplified reply: error mismatch: have %v, want %v", err, errCompactOversized)
+	}
+	// Too many ETXs within a single body are refused regardless of their size
+	many := *compact
+	many.Table = append([]rlp.RawValue{}, compact.Table...)
+	many.Table[data] = rlp.EmptyString
+	for len(many.Bodies[0].ExtTransactions) <= maxCompactBodyEtxs {
+		many.Bodies[0].ExtTransactions = append(many.Bodies[0].ExtTransactions, etx)
+	}
+	if _, err := many.Expand(maxMessageSize); !errors.Is(err, errCompactOversized) {
+		t.Errorf("etx flood: error mismatch: have %v, want %v", err, errCompactOversized)
+	}
+	// Table entries above the size of a transaction are refused
+	compact.Bodies[0].ExtTransactions = compact.Bodies[0].ExtTransactions[:1]
+	compact.Table[data], _ = rlp.EncodeToBytes(make([]byte, maxCompactTableEntry))
+	if _, err := compact.Expand(maxMessageSize); !errors.Is(err, errCompactOversized) {
+		t.Errorf("oversized entry: error mismatch: have %v, want %v", err, errCompactOversized)
+	}
+	// Table entries not referenced by any ETX are refused
+	compact.Table[data] = rlp.EmptyString
+	if _, err := compact.Expand(maxMessageSize); err != nil {
+		t.Fatalf("failed to expand valid bodies: %v", err)
+	}
+	compact.Table = append(compact.Table, rlp.EmptyString)
+	if _, err := compact.Expand(maxMessageSize); err == nil {
+		t.Errorf("expanded bodies with unreferenced table entry")
+	}
+}
+
+// Tests that block bodies are served in compact form to peers which opted into
+// the experimental range, and delivered to the backend as plain bodies.
+func TestCompactBlockBodiesServing(t *testing.T) {
+	var (
+		chain = newTestChain(2)
+		hash  = chain.canonical[1].Hash()
+		etxs  = newTestEtxs(8, 2)
+	)
+	chain.addBody(hash, &types.Body{Transactions: newTestTransactions(1), ExtTransactions: etxs})
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		local  = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), net, nil)
+		remote = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x02}, "peer", nil), app, nil)
+	)
+	defer local.Close()
+	defer remote.Close()
+	local.experimental, remote.experimental = true, true
+
+	go local.RequestBodies([]common.Hash{hash})
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	var query GetBlockBodiesPacket66
+	if err := msg.Decode(&query); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	response, err := answerGetBlockBodiesQuery(chain, query.GetBlockBodiesPacket, TruncateResponse)
+	if err != nil {
+		t.Fatalf("failed to answer query: %v", err)
+	}
+	compact, err := newCompactBlockBodies(response)
+	if err != nil {
+		t.Fatalf("failed to compact bodies: %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- remote.ReplyCompactBlockBodies(query.RequestId, compact) }()
+
+	backend := new(mockBackend)
+	if err := handleMessage(backend, local); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to send reply: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+	}
+	reply := *backend.handled[0].(*BlockBodiesPacket)
+	if len(reply) != 1 || len(reply[0].ExtTransactions) != len(etxs) {
+		t.Fatalf("body mismatch: have %+v", reply)
+	}
+	for i, etx := range etxs {
+		if reply[0].ExtTransactions[i].Hash() != etx.Hash() {
+			t.Errorf("etx %d: hash mismatch: have %x, want %x", i, reply[0].ExtTransactions[i].Hash(), etx.Hash())
+		}
+	}
+	// Peers which didn't opt in are refused the compact form
+	local.experimental = false
+	if err := local.ReplyCompactBlockBodies(1, compact); !errors.Is(err, errNotExperimental) {
+		t.Errorf("error mismatch: have %v, want %v", err, errNotExperimental)
+	}
+}
+
+// Benchmarks the compact encoding of an ETX-dense block, reporting the wire size
+// relative to the plain encoding.
+func BenchmarkCompactBlockBodies(b *testing.B) {
+	bodies := newTestBodies(b, newTestEtxs(1024, 16))
+
+	plain, _ := rlp.EncodeToBytes(bodies)
+	compact, err := newCompactBlockBodies(bodies)
+	if err != nil {
+		b.Fatalf("failed to compact bodies: %v", err)
+	}
+	enc, _ := rlp.EncodeToBytes(compact)
+	ratio := float64(len(enc)) / float64(len(plain))
+
+	b.Run("encode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			compact, _ := newCompactBlockBodies(bodies)
+			rlp.EncodeToBytes(compact)
+		}
+		b.ReportMetric(ratio, "size/plain")
+	})
+	b.Run("decode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var decoded CompactBlockBodiesPacket
+			rlp.DecodeBytes(enc, &decoded)
+			decoded.Expand(maxMessageSize)
+		}
+	})
+}
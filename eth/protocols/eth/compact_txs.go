@@ -0,0 +1,182 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/dominant-strategies/go-quai/common"
+)
+
+const (
+	// txHashPrefixLength is the number of leading bytes of the transaction hashes
+	// announced in compact form.
+	txHashPrefixLength = 8
+
+	// maxSeenTxPrefixes is the number of transaction hashes seen on the network
+	// which are kept for resolving the compact announcements.
+	maxSeenTxPrefixes = maxKnownTxs
+
+	// maxCompactTxAnns is the number of transaction hashes announced in compact
+	// form to a peer which are kept for answering its resolution requests.
+	maxCompactTxAnns = maxQueuedTxAnns
+)
+
+// TxHashPrefix is the truncated hash of a transaction announced in compact form.
+type TxHashPrefix [txHashPrefixLength]byte
+
+// txHashPrefix truncates a transaction hash to its prefix.
+func txHashPrefix(hash common.Hash) (prefix TxHashPrefix) {
+	copy(prefix[:], hash[:])
+	return prefix
+}
+
+// txPrefixIndex is a bounded index of transaction hashes by their prefix. Once
+// full, the oldest hashes are evicted first.
+type txPrefixIndex struct {
+	hashes map[TxHashPrefix][]common.Hash
+	order  []common.Hash // Indexed hashes in insertion order, for eviction
+	limit  int
+	lock   sync.Mutex
+}
+
+// newTxPrefixIndex creates an index holding up to limit hashes.
+func newTxPrefixIndex(limit int) *txPrefixIndex {
+	return &txPrefixIndex{
+		hashes: make(map[TxHashPrefix][]common.Hash),
+		limit:  limit,
+	}
+}
+
+// seenTxs indexes the transaction hashes seen from any peer, against which the
+// compact announcements are resolved.
+var seenTxs = newTxPrefixIndex(maxSeenTxPrefixes)
+
+// add inserts a hash into the index, evicting the oldest one if full.
+func (idx *txPrefixIndex) add(hash common.Hash) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	prefix := txHashPrefix(hash)
+	for _, known := range idx.hashes[prefix] {
+		if known == hash {
+			return
+		}
+	}
+	idx.hashes[prefix] = append(idx.hashes[prefix], hash)
+	idx.order = append(idx.order, hash)
+
+	for len(idx.order) > idx.limit {
+		idx.remove(idx.order[0])
+		idx.order = idx.order[1:]
+	}
+}
+
+// remove drops a hash from its prefix bucket. The caller must hold the lock.
+func (idx *txPrefixIndex) remove(hash common.Hash) {
+	prefix := txHashPrefix(hash)
+	bucket := idx.hashes[prefix]
+	for i, known := range bucket {
+		if known == hash {
+			bucket = append(bucket[:i:i], bucket[i+1:]...)
+			break
+		}
+	}
+	if len(bucket) == 0 {
+		delete(idx.hashes, prefix)
+	} else {
+		idx.hashes[prefix] = bucket
+	}
+}
+
+// lookup retrieves the indexed hashes starting with the given prefix.
+func (idx *txPrefixIndex) lookup(prefix TxHashPrefix) []common.Hash {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	return append([]common.Hash(nil), idx.hashes[prefix]...)
+}
+
+// resolveTxPrefixes maps the prefixes of a compact announcement to the full
+// hashes seen before. Prefixes matching none or several of them are ambiguous
+// and returned unresolved, for their full hashes to be requested.
+func resolveTxPrefixes(prefixes []TxHashPrefix) ([]common.Hash, []TxHashPrefix) {
+	var (
+		hashes     []common.Hash
+		unresolved []TxHashPrefix
+	)
+	for _, prefix := range prefixes {
+		if matches := seenTxs.lookup(prefix); len(matches) == 1 {
+			hashes = append(hashes, matches[0])
+		} else {
+			unresolved = append(unresolved, prefix)
+		}
+	}
+	return hashes, unresolved
+}
+
+// sendCompactPooledTransactionHashes announces a batch of transactions to the
+// peer by their hash prefixes, remembering the full hashes to resolve them on
+// request.
+func (p *Peer) sendCompactPooledTransactionHashes(hashes []common.Hash) error {
+	prefixes := make(CompactPooledTransactionHashesPacket, len(hashes))
+	for i, hash := range hashes {
+		p.compactTxAnns.add(hash)
+		prefixes[i] = txHashPrefix(hash)
+	}
+	return p.SendExperimental(CompactPooledTransactionHashesMsg, prefixes)
+}
+
+// answerGetPooledTransactionHashes resolves the hash prefixes announced to the
+// peer in compact form to their full hashes. Prefixes which weren't announced,
+// or were announced too long ago, are skipped.
+func answerGetPooledTransactionHashes(query GetPooledTransactionHashesPacket, peer *Peer) PooledTransactionHashesPacket {
+	var hashes PooledTransactionHashesPacket
+	for _, prefix := range query {
+		if len(hashes) >= maxCompactTxAnns {
+			break
+		}
+		hashes = append(hashes, peer.compactTxAnns.lookup(prefix)...)
+	}
+	return hashes
+}
+
+// ReplyPooledTransactionHashes is the experimental eth/66 response to
+// GetPooledTransactionHashes.
+func (p *Peer) ReplyPooledTransactionHashes(id uint64, hashes PooledTransactionHashesPacket) error {
+	return p.SendExperimental(PooledTransactionHashesMsg, PooledTransactionHashesPacket66{
+		RequestId:                     id,
+		PooledTransactionHashesPacket: hashes,
+	})
+}
+
+// RequestPooledTransactionHashes fetches the full hashes of the transactions the
+// peer announced by the given prefixes.
+func (p *Peer) RequestPooledTransactionHashes(prefixes []TxHashPrefix) error {
+	p.Log().Debug("Fetching ambiguous transaction hashes", "count", len(prefixes))
+	if !p.experimental {
+		return errNotExperimental
+	}
+	id := rand.Uint64()
+
+	requestTracker.Track(p.id, p.version, GetPooledTransactionHashesMsg, PooledTransactionHashesMsg, id)
+	return p.SendExperimental(GetPooledTransactionHashesMsg, &GetPooledTransactionHashesPacket66{
+		RequestId:                        id,
+		GetPooledTransactionHashesPacket: prefixes,
+	})
+}
@@ -0,0 +1,172 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// Tests that the prefix index resolves the hashes sharing a prefix, ignores the
+// duplicate insertions and evicts the oldest hashes once full.
+func TestTxPrefixIndex(t *testing.T) {
+	var (
+		idx      = newTxPrefixIndex(3)
+		a        = common.Hash{0x01, 0x02}
+		collided = common.Hash{0x01, 0x02, 31: 0xff}
+		b        = common.Hash{0x03}
+		c        = common.Hash{0x04}
+	)
+	idx.add(a)
+	idx.add(a)
+	idx.add(collided)
+	if have := idx.lookup(txHashPrefix(a)); !reflect.DeepEqual(have, []common.Hash{a, collided}) {
+		t.Errorf("colliding prefix mismatch: have %x, want %x", have, []common.Hash{a, collided})
+	}
+	idx.add(b)
+	idx.add(c)
+	if have := idx.lookup(txHashPrefix(a)); !reflect.DeepEqual(have, []common.Hash{collided}) {
+		t.Errorf("evicted prefix mismatch: have %x, want %x", have, []common.Hash{collided})
+	}
+	if have := idx.lookup(txHashPrefix(c)); !reflect.DeepEqual(have, []common.Hash{c}) {
+		t.Errorf("latest prefix mismatch: have %x, want %x", have, []common.Hash{c})
+	}
+	if have := idx.lookup(TxHashPrefix{0xff}); len(have) != 0 {
+		t.Errorf("unknown prefix resolved: %x", have)
+	}
+}
+
+// Tests that compact announcements of transactions seen before are resolved
+// locally, without any round-trip to the announcer.
+func TestCompactTxAnnouncementResolved(t *testing.T) {
+	defer func(old *txPrefixIndex) { seenTxs = old }(seenTxs)
+	seenTxs = newTxPrefixIndex(16)
+
+	hashes := []common.Hash{{0x01}, {0x02}, {0x03}}
+	for _, hash := range hashes {
+		seenTxs.add(hash)
+	}
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	peer := NewPeer(ETH66, p2p.NewPeer(enode.ID{0xfa}, "peer", nil), net, nil)
+	defer peer.Close()
+	peer.experimental = true
+
+	// Any resolution request would block on the unread pipe
+	backend := new(mockBackend)
+	ann := CompactPooledTransactionHashesPacket{txHashPrefix(hashes[0]), txHashPrefix(hashes[2])}
+	if err := deliverCompactPooledTransactionHashes(backend, ann, peer); err != nil {
+		t.Fatalf("failed to deliver announcement: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want 1", len(backend.handled))
+	}
+	want := NewPooledTransactionHashesPacket{hashes[0], hashes[2]}
+	if have := backend.handled[0].(*NewPooledTransactionHashesPacket); !reflect.DeepEqual(*have, want) {
+		t.Errorf("resolved hashes mismatch: have %x, want %x", *have, want)
+	}
+}
+
+// Tests that compact announcements with prefixes colliding between the seen
+// transactions, or not seen at all, get their full hashes requested from the
+// announcer, while the unambiguous ones are delivered right away.
+func TestCompactTxAnnouncementCollision(t *testing.T) {
+	defer func(old *txPrefixIndex) { seenTxs = old }(seenTxs)
+	seenTxs = newTxPrefixIndex(16)
+
+	var (
+		known    = common.Hash{0x01}
+		collided = common.Hash{0x02}
+		other    = common.Hash{0x02, 31: 0xff}
+		unseen   = common.Hash{0x03}
+	)
+	seenTxs.add(known)
+	seenTxs.add(collided)
+	seenTxs.add(other)
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		local  = NewPeer(ETH66, p2p.NewPeer(enode.ID{0xfb}, "peer", nil), net, nil)
+		remote = NewPeer(ETH66, p2p.NewPeer(enode.ID{0xfc}, "peer", nil), app, nil)
+	)
+	defer local.Close()
+	defer remote.Close()
+	local.experimental, remote.experimental = true, true
+
+	// Announce the transactions in compact form
+	go remote.sendPooledTransactionHashes([]common.Hash{known, collided, unseen})
+
+	msg, err := local.rw.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read announcement: %v", err)
+	}
+	if msg.Code != CompactPooledTransactionHashesMsg {
+		t.Fatalf("announcement code mismatch: have %#x, want %#x", msg.Code, CompactPooledTransactionHashesMsg)
+	}
+	var ann CompactPooledTransactionHashesPacket
+	if err := msg.Decode(&ann); err != nil {
+		t.Fatalf("failed to decode announcement: %v", err)
+	}
+	// Resolve the announcement, requesting the ambiguous prefixes
+	var (
+		resolved  = new(mockBackend)
+		requested = make(chan error, 1)
+		served    = make(chan error, 1)
+	)
+	go func() { requested <- deliverCompactPooledTransactionHashes(resolved, ann, local) }()
+	go func() { served <- handleMessage(new(mockBackend), remote) }()
+
+	backend := new(mockBackend)
+	if err := handleMessage(backend, local); err != nil {
+		t.Fatalf("failed to handle resolution reply: %v", err)
+	}
+	if err := <-requested; err != nil {
+		t.Fatalf("failed to deliver announcement: %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("failed to serve resolution request: %v", err)
+	}
+	if len(resolved.handled) != 1 {
+		t.Fatalf("locally resolved packet count mismatch: have %d, want 1", len(resolved.handled))
+	}
+	if have := *resolved.handled[0].(*NewPooledTransactionHashesPacket); !reflect.DeepEqual(have, NewPooledTransactionHashesPacket{known}) {
+		t.Errorf("locally resolved hashes mismatch: have %x, want %x", have, []common.Hash{known})
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("remotely resolved packet count mismatch: have %d, want 1", len(backend.handled))
+	}
+	if have := *backend.handled[0].(*NewPooledTransactionHashesPacket); !reflect.DeepEqual(have, NewPooledTransactionHashesPacket{collided, unseen}) {
+		t.Errorf("remotely resolved hashes mismatch: have %x, want %x", have, []common.Hash{collided, unseen})
+	}
+	// Peers which didn't opt in can't be asked
+	plain := NewPeer(ETH66, p2p.NewPeer(enode.ID{0xfd}, "peer", nil), net, nil)
+	defer plain.Close()
+
+	if err := plain.RequestPooledTransactionHashes(ann); !errors.Is(err, errNotExperimental) {
+		t.Errorf("plain peer request: error mismatch: have %v, want %v", err, errNotExperimental)
+	}
+}
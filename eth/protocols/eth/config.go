@@ -0,0 +1,188 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+)
+
+// Config are the settings of the `eth` protocol handler. A single config is
+// shared by all the peers of the node, it must not be modified once the
+// protocol is running.
+type Config struct {
+	// HandshakeTimeout is the maximum allowed time for the `eth` handshake to
+	// complete before dropping the connection as malicious. It bounds how long
+	// we wait for the remote Status message and may be raised for peers behind
+	// high-latency links.
+	HandshakeTimeout time.Duration
+
+	// BlockAnnounceWindow is the time to wait for further block announcements to
+	// coalesce into the same NewBlockHashes message before sending it. A zero
+	// window sends every announcement on its own.
+	BlockAnnounceWindow time.Duration
+
+	// BodiesResponsePolicy is the policy applied when serving block bodies which
+	// don't fit into a single reply. It defaults to truncation for compatibility
+	// with existing requesters.
+	BodiesResponsePolicy ResponsePolicy
+
+	// MaxAnnounceDistance is the maximum number of blocks a propagated block may
+	// be ahead of the local head before the announcement is deemed bogus and the
+	// sender dropped. Legitimate catch up happens through header sync instead.
+	MaxAnnounceDistance uint64
+
+	// HaveBlockProbeThreshold is the expected block size from which it is worth
+	// probing a peer with HaveBlock before fetching the block, saving a wasted
+	// transfer if the peer doesn't have it. Zero disables probing altogether.
+	HaveBlockProbeThreshold common.StorageSize
+
+	// Experimental opts the local node into the experimental message range. The
+	// range is only enabled with peers which opted in too.
+	Experimental bool
+
+	// PermissiveNetwork accepts peers announcing a network ID this binary doesn't
+	// recognize, as long as their genesis matches, warning about them. It eases
+	// bootstrapping ephemeral testnets, and never applies on the main network.
+	PermissiveNetwork bool
+
+	// ClientVersion is the software and version of the local node, advertised to
+	// the remote peers running eth/67 and above.
+	ClientVersion string `toml:"-"`
+
+	// Deprecations is the schedule of protocol versions being retired, refusing
+	// the peers still running them past the cutover.
+	Deprecations []Deprecation `toml:",omitempty"`
+
+	// Light announces the local node as a light one in the eth/67 handshake, not
+	// serving any requests. Remote peers route their requests elsewhere, but keep
+	// propagating blocks and transactions to it.
+	Light bool
+
+	// MaxMessageSize is the limit on the size of inbound messages advertised to
+	// the remote peers, zero for the protocol default. The limit enforced on a
+	// connection, in both directions, is the lower of the limits advertised by
+	// the two sides.
+	MaxMessageSize uint64
+
+	// PrioritizeServing limits the data retrievals served concurrently to
+	// MaxConcurrentServes, serving the requests of the highest entropy peers
+	// first when saturated. Peers behind the canonical chain are delayed, not
+	// starved.
+	PrioritizeServing bool
+
+	// MaxConcurrentServes is the number of data retrievals served at once when
+	// PrioritizeServing is enabled.
+	MaxConcurrentServes int
+
+	// SlowServeThreshold is the time above which serving a data retrieval request
+	// is reported as slow, warning about the request and the peer it was served to.
+	SlowServeThreshold time.Duration
+
+	// MaxReorgDepth is the depth, in blocks, of the deepest reorg a peer may
+	// plausibly go through. Peers whose advertised entropy drops below the
+	// highest one they advertised by more than this many blocks worth of entropy
+	// are dropped.
+	MaxReorgDepth uint64
+
+	// MaxUnrequestedTxReplies is the number of PooledTransactions replies
+	// carrying transactions which were not requested, after which a peer is
+	// dropped. The unrequested transactions are discarded regardless.
+	MaxUnrequestedTxReplies int
+
+	// SessionLifetime is how long after a disconnect the session with an eth/67
+	// peer may be resumed with a partial Status, skipping the exchange of the
+	// immutable fields. Zero disables session resumption.
+	SessionLifetime time.Duration
+
+	// MaxDecodeFailures is the number of undecodable messages within the
+	// DecodeFailureWindow after which a peer is dropped as malicious. Occasional
+	// failures below it are tolerated. A limit of one drops the peer on the first
+	// undecodable message.
+	MaxDecodeFailures int
+
+	// DecodeFailureWindow is the time window over which the decode failures of a
+	// peer are counted.
+	DecodeFailureWindow time.Duration
+
+	// MaxDisallowedMessages is the number of messages outside of its allowlist
+	// after which a peer is dropped. The ones below it are discarded without
+	// handling.
+	MaxDisallowedMessages int
+
+	// MaxBlockTimeDrift is how far ahead of the local clock the timestamp of a
+	// propagated block may be before the block is deemed bogus and the sender
+	// dropped, ahead of any propagation. It sits well above the allowance of the
+	// consensus engines, so blocks merely queued as future ones are not rejected.
+	// Zero disables the check.
+	MaxBlockTimeDrift time.Duration
+
+	// MaxHeaderSkip is the largest Skip served in header retrievals. Queries
+	// asking for more are clamped to it, bounding the span of chain a single
+	// retrieval can scatter its disk reads across. Zero serves any skip.
+	MaxHeaderSkip uint64
+
+	// MaxProcessingTime is the longest the handling of a single inbound message
+	// may take before the peer is dropped, so a message sending its handler down
+	// an expensive path can't stall the read loop of the peer. Enabling the limit
+	// buffers every message and runs its handler on a goroutine of its own; an
+	// overrunning handler is abandoned, finishing in the background. Zero
+	// disables the limit.
+	MaxProcessingTime time.Duration
+
+	// MaxAmplification is the ratio of the reply bytes served to a peer to the
+	// bytes of its data retrievals above which its further retrievals are
+	// discarded for the rest of AmplificationWindow. The default sits well above
+	// the ratio of full header batches served to syncing peers. Zero disables the
+	// guard.
+	MaxAmplification uint64
+
+	// AmplificationWindow is the period over which the amplification of the data
+	// retrievals of a peer is measured.
+	AmplificationWindow time.Duration
+
+	// Scorer rates the peers from the protocol signals observed about them,
+	// steering which peer is synced with and dropping the ones scored negative.
+	// A nil scorer rates the peers by entropy, as EntropyScorer does.
+	Scorer PeerScorer `toml:"-"`
+
+	// Trace is the set of hooks invoked as the peers progress through the
+	// handshake, all of them disabled by default.
+	Trace HandshakeTrace `toml:"-"`
+}
+
+// DefaultConfig contains the default settings of the `eth` protocol handler.
+var DefaultConfig = Config{
+	HandshakeTimeout:        5 * time.Second,
+	BlockAnnounceWindow:     50 * time.Millisecond,
+	MaxAnnounceDistance:     1024,
+	HaveBlockProbeThreshold: 512 * 1024,
+	MaxDecodeFailures:       3,
+	DecodeFailureWindow:     time.Minute,
+	MaxDisallowedMessages:   4,
+	MaxConcurrentServes:     16,
+	SlowServeThreshold:      time.Second,
+	MaxReorgDepth:           64,
+	MaxUnrequestedTxReplies: 3,
+	SessionLifetime:         time.Minute,
+	MaxAmplification:        1 << 16,
+	AmplificationWindow:     time.Minute,
+	MaxHeaderSkip:           256,
+	MaxBlockTimeDrift:       time.Minute,
+	Scorer:                  EntropyScorer{},
+}
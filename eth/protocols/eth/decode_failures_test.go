@@ -0,0 +1,131 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// Tests that occasional undecodable messages are tolerated, but a peer sending
+// them persistently within the failure window is dropped.
+func TestDecodeFailures(t *testing.T) {
+	config := DefaultConfig
+	config.MaxDecodeFailures = 3
+	config.DecodeFailureWindow = 100 * time.Millisecond
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	peer := newPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), net, nil, &config)
+	defer peer.Close()
+
+	// deliver sends a malformed header request to the peer and handles it
+	deliver := func() error {
+		garbage := []byte{0xff, 0xff, 0xff}
+		go app.WriteMsg(p2p.Msg{Code: GetBlockHeadersMsg, Size: uint32(len(garbage)), Payload: bytes.NewReader(garbage)})
+		return handleMessage(new(mockBackend), peer)
+	}
+	// Failures below the limit are tolerated
+	for i := 0; i < config.MaxDecodeFailures-1; i++ {
+		if err := deliver(); err != nil {
+			t.Fatalf("failure %d: undecodable message not tolerated: %v", i, err)
+		}
+	}
+	// Once the window expires, the peer is given a clean slate
+	time.Sleep(config.DecodeFailureWindow)
+	for i := 0; i < config.MaxDecodeFailures-1; i++ {
+		if err := deliver(); err != nil {
+			t.Fatalf("failure %d: undecodable message not tolerated after window: %v", i, err)
+		}
+	}
+	// Reaching the limit within the window drops the peer
+	if err := deliver(); !errors.Is(err, errDecode) {
+		t.Fatalf("error mismatch: have %v, want %v", err, errDecode)
+	}
+}
+
+// Tests that messages whose payload ends before their declared size are told
+// apart from malformed ones, dropping the peer without counting as a decode
+// failure, while payloads overrunning their declared size are still malformed.
+func TestTruncatedMessages(t *testing.T) {
+	scorer := newTestScorer()
+
+	config := DefaultConfig
+	config.MaxDecodeFailures = 1
+	config.Scorer = scorer
+
+	tests := []struct {
+		code   uint64
+		packet interface{}
+	}{
+		{GetBlockHeadersMsg, &GetBlockHeadersPacket66{RequestId: 1, GetBlockHeadersPacket: &GetBlockHeadersPacket{Origin: HashOrNumber{Hash: common.Hash{0x01}}, Amount: 16}}},
+		{GetBlockBodiesMsg, &GetBlockBodiesPacket66{RequestId: 2, GetBlockBodiesPacket: GetBlockBodiesPacket{{0x01}, {0x02}, {0x03}}}},
+		{NewBlockHashesMsg, &NewBlockHashesPacket{{Hash: common.Hash{0x01}, Number: 1}, {Hash: common.Hash{0x02}, Number: 2}}},
+		{GetPooledTransactionsMsg, &GetPooledTransactionsPacket66{RequestId: 3, GetPooledTransactionsPacket: GetPooledTransactionsPacket{{0x01}, {0x02}}}},
+	}
+	for i, tt := range tests {
+		app, net := p2p.MsgPipe()
+		peer := newPeer(ETH66, p2p.NewPeer(enode.ID{0xef, byte(i)}, "peer", nil), net, nil, &config)
+
+		enc, err := rlp.EncodeToBytes(tt.packet)
+		if err != nil {
+			t.Fatalf("test %d: failed to encode packet: %v", i, err)
+		}
+		cut := enc[:len(enc)/2]
+
+		// A payload cut short of the declared size is truncated
+		go app.WriteMsg(p2p.Msg{Code: tt.code, Size: uint32(len(enc)), Payload: bytes.NewReader(cut)})
+		err = handleMessage(new(mockBackend), peer)
+		if !errors.Is(err, errTruncatedMsg) {
+			t.Errorf("test %d: truncated message error mismatch: have %v, want %v", i, err, errTruncatedMsg)
+		}
+		if errors.Is(err, errDecode) {
+			t.Errorf("test %d: truncated message classified as malformed: %v", i, err)
+		}
+		if len(peer.decodeFailures) != 0 {
+			t.Errorf("test %d: truncated message counted as decode failure", i)
+		}
+		signals := scorer.observed(peer.ID())
+		if len(signals) != 1 || signals[0].Type != PeerSignalTruncated || signals[0].Code != tt.code {
+			t.Errorf("test %d: signals mismatch: have %+v, want truncation of %#x", i, signals, tt.code)
+		}
+		// The same payload declaring its actual size overruns it, and is malformed
+		go app.WriteMsg(p2p.Msg{Code: tt.code, Size: uint32(len(cut)), Payload: bytes.NewReader(cut)})
+		err = handleMessage(new(mockBackend), peer)
+		if !errors.Is(err, errDecode) {
+			t.Errorf("test %d: malformed message error mismatch: have %v, want %v", i, err, errDecode)
+		}
+		if errors.Is(err, errTruncatedMsg) {
+			t.Errorf("test %d: malformed message classified as truncated: %v", i, err)
+		}
+		if signals := scorer.observed(peer.ID()); len(signals) != 2 || signals[1].Type != PeerSignalDecodeFailure {
+			t.Errorf("test %d: signals mismatch: have %+v, want decode failure", i, signals)
+		}
+		peer.Close()
+		app.Close()
+		net.Close()
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// deprecationWarnPeriod and deprecationWarnBlocks are how far ahead of the
+	// cutover connections on a deprecated version start being warned about.
+	deprecationWarnPeriod = 7 * 24 * time.Hour
+	deprecationWarnBlocks = 50000
+
+	// deprecationUrgentPeriod and deprecationUrgentBlocks are how far ahead of
+	// the cutover the warnings turn into errors.
+	deprecationUrgentPeriod = 24 * time.Hour
+	deprecationUrgentBlocks = 5000
+)
+
+// Deprecation schedules the retirement of a protocol version. Peers negotiating
+// it are accepted until the cutover, with warnings growing more severe as it
+// nears, and refused from then on. The cutover is the earlier of the time and
+// the local head height, whichever of the two is set.
+type Deprecation struct {
+	Version uint      // Protocol version being retired
+	Time    time.Time `toml:",omitempty"` // Time of the cutover, unset if zero
+	Height  uint64    `toml:",omitempty"` // Local head height of the cutover, unset if zero
+}
+
+// CheckDeprecation enforces the configured deprecations of the version negotiated
+// with the peer, given the height of the local head. Connections past the cutover
+// of the version are refused, those approaching it accepted with a warning.
+func (p *Peer) CheckDeprecation(head uint64) error {
+	return p.checkDeprecation(time.Now(), head)
+}
+
+// checkDeprecation is the time injectable implementation of CheckDeprecation.
+func (p *Peer) checkDeprecation(now time.Time, head uint64) error {
+	for _, d := range p.config.Deprecations {
+		if d.Version != p.version {
+			continue
+		}
+		var (
+			timed = !d.Time.IsZero()
+			until = d.Time.Sub(now)
+			left  = int64(d.Height) - int64(head)
+		)
+		if (timed && until <= 0) || (d.Height != 0 && left <= 0) {
+			return fmt.Errorf("%w: eth/%d retired at %s", errVersionDeprecated, p.version, d.cutover())
+		}
+		switch {
+		case (timed && until <= deprecationUrgentPeriod) || (d.Height != 0 && left <= deprecationUrgentBlocks):
+			p.Log().Error("Peer running protocol version about to be retired", "version", p.version, "cutover", d.cutover())
+		case (timed && until <= deprecationWarnPeriod) || (d.Height != 0 && left <= deprecationWarnBlocks):
+			p.Log().Warn("Peer running deprecated protocol version", "version", p.version, "cutover", d.cutover())
+		default:
+			p.Log().Debug("Peer running deprecated protocol version", "version", p.version, "cutover", d.cutover())
+		}
+	}
+	return nil
+}
+
+// cutover describes when the deprecated version is retired, for logging.
+func (d Deprecation) cutover() string {
+	switch {
+	case d.Time.IsZero():
+		return fmt.Sprintf("block %d", d.Height)
+	case d.Height == 0:
+		return d.Time.UTC().Format(time.RFC3339)
+	default:
+		return fmt.Sprintf("%s or block %d", d.Time.UTC().Format(time.RFC3339), d.Height)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/log"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// Tests that peers on a deprecated protocol version are accepted with warnings
+// escalating as the cutover nears, and refused past it.
+func TestProtocolDeprecation(t *testing.T) {
+	hook := logtest.NewLocal(log.Log.Logger)
+	defer log.Log.ReplaceHooks(make(logrus.LevelHooks))
+
+	now := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		deprecation Deprecation
+		version     uint
+		head        uint64
+		level       logrus.Level // Level of the expected warning, panic if none
+		err         error
+	}{
+		// Versions without a deprecation, or deprecated far in the future
+		{Deprecation{ETH65, now.Add(time.Hour), 0}, ETH66, 0, logrus.PanicLevel, nil},
+		{Deprecation{ETH66, now.Add(30 * 24 * time.Hour), 0}, ETH66, 0, logrus.PanicLevel, nil},
+		{Deprecation{ETH66, time.Time{}, 1000000}, ETH66, 0, logrus.PanicLevel, nil},
+
+		// Pre-cutover versions, warned about with increasing severity
+		{Deprecation{ETH66, now.Add(3 * 24 * time.Hour), 0}, ETH66, 0, logrus.WarnLevel, nil},
+		{Deprecation{ETH66, now.Add(time.Hour), 0}, ETH66, 0, logrus.ErrorLevel, nil},
+		{Deprecation{ETH66, time.Time{}, 10000}, ETH66, 0, logrus.WarnLevel, nil},
+		{Deprecation{ETH66, time.Time{}, 10000}, ETH66, 9000, logrus.ErrorLevel, nil},
+		{Deprecation{ETH66, now.Add(30 * 24 * time.Hour), 10000}, ETH66, 9000, logrus.ErrorLevel, nil},
+
+		// Post-cutover versions, refused by time or by height
+		{Deprecation{ETH66, now, 0}, ETH66, 0, logrus.PanicLevel, errVersionDeprecated},
+		{Deprecation{ETH66, now.Add(-time.Hour), 0}, ETH66, 0, logrus.PanicLevel, errVersionDeprecated},
+		{Deprecation{ETH66, time.Time{}, 10000}, ETH66, 10000, logrus.PanicLevel, errVersionDeprecated},
+		{Deprecation{ETH66, now.Add(30 * 24 * time.Hour), 10000}, ETH66, 20000, logrus.PanicLevel, errVersionDeprecated},
+	}
+	for i, tt := range tests {
+		hook.Reset()
+		config := DefaultConfig
+		config.Deprecations = []Deprecation{tt.deprecation}
+
+		peer := newPeer(tt.version, p2p.NewPeer(enode.ID{byte(i)}, "peer", nil), nil, nil, &config)
+		if err := peer.checkDeprecation(now, tt.head); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		level := logrus.PanicLevel
+		for _, entry := range hook.AllEntries() {
+			if entry.Level <= logrus.WarnLevel && strings.Contains(entry.Message, "protocol version") {
+				level = entry.Level
+			}
+		}
+		if level != tt.level {
+			t.Errorf("test %d: warning level mismatch: have %v, want %v", i, level, tt.level)
+		}
+	}
+}
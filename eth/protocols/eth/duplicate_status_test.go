@@ -0,0 +1,114 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// Tests that a peer sending its status twice back-to-back at connection start
+// is kept, the duplicate updating its head, while a third status is rejected.
+func TestHandshakeDuplicateStatus(t *testing.T) {
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		local      = newTestStatus(t, common.Location{0, 0})
+		remote     = newTestStatus(t, common.Location{0, 0})
+		localPeer  = NewPeer(ETH66, p2p.NewPeer(enode.ID{0xf6}, "peer", nil), net, nil)
+		remotePeer = NewPeer(ETH66, p2p.NewPeer(enode.ID{0xf7}, "peer", nil), app, nil)
+	)
+	defer localPeer.Close()
+	defer remotePeer.Close()
+
+	errc := make(chan error, 1)
+	go func() { errc <- remotePeer.Handshake(enode.ID{0xf8}, remote) }()
+	if err := localPeer.Handshake(enode.ID{0xf9}, local); err != nil {
+		t.Fatalf("local handshake failed: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("remote handshake failed: %v", err)
+	}
+	// Send the status again, with the head moved in between
+	duplicate := *remote
+	duplicate.Head = common.Hash{0x01}
+	duplicate.Entropy = new(big.Int).Add(remote.Entropy, big.NewInt(1))
+
+	go send(remotePeer.rw, StatusMsg, &duplicate)
+	if err := handleMessage(new(mockBackend), localPeer); err != nil {
+		t.Fatalf("duplicate status rejected: %v", err)
+	}
+	if head, _, entropy, _ := localPeer.Head(); head != duplicate.Head || entropy.Cmp(duplicate.Entropy) != 0 {
+		t.Errorf("head mismatch: have %x/%v, want %x/%v", head, entropy, duplicate.Head, duplicate.Entropy)
+	}
+	// Any further status is an invalid message
+	go send(remotePeer.rw, StatusMsg, &duplicate)
+	if err := handleMessage(new(mockBackend), localPeer); !errors.Is(err, errInvalidMsgCode) {
+		t.Errorf("third status: error mismatch: have %v, want %v", err, errInvalidMsgCode)
+	}
+}
+
+// Tests that a duplicate status is only tolerated as the first message after the
+// handshake, and only if it matches the status of the handshake.
+func TestDuplicateStatusTolerance(t *testing.T) {
+	status := newTestStatus(t, common.Location{0, 0})
+
+	mismatch := *status
+	mismatch.Genesis = common.Hash{0xff}
+
+	partial := partialStatus(status, common.Hash{0x01})
+	partial.Head = common.Hash{0x02}
+
+	tests := []struct {
+		before Packet // Message received ahead of the duplicate, if any
+		status *StatusPacket
+		head   common.Hash // Head of the peer after the duplicate
+		err    error
+	}{
+		{nil, status, status.Head, nil},
+		{nil, &mismatch, status.Head, errGenesisMismatch},
+		{nil, partial, status.Head, nil},
+		{&NewBlockHashesPacket{}, status, status.Head, errInvalidMsgCode},
+	}
+	for i, tt := range tests {
+		peer := NewPeer(ETH66, p2p.NewPeer(enode.ID{0xe1, byte(i)}, "peer", nil), nil, nil)
+		peer.head, peer.entropy = status.Head, status.Entropy
+		peer.status, peer.fresh = status, true
+
+		backend := new(mockBackend)
+		if tt.before != nil {
+			if err := dispatchMessage(backend, peer, encodeMsg(t, uint64(tt.before.Kind()), tt.before)); err != nil {
+				t.Fatalf("test %d: failed to handle preceding message: %v", i, err)
+			}
+		}
+		if err := dispatchMessage(backend, peer, encodeMsg(t, StatusMsg, tt.status)); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if head, _, _, _ := peer.Head(); head != tt.head {
+			t.Errorf("test %d: head mismatch: have %x, want %x", i, head, tt.head)
+		}
+		peer.Close()
+	}
+}
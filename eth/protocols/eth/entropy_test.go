@@ -0,0 +1,146 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// Tests that peers advertising a monotonic entropy, or regressing it within a
+// plausible reorg, are tolerated, but the ones regressing it beyond are not.
+func TestEntropyRegression(t *testing.T) {
+	config := DefaultConfig
+	config.MaxReorgDepth = 10
+
+	// The advertised chain accumulates 1000 entropy per block, so reorgs may drop
+	// the entropy by up to 10000
+	tests := []struct {
+		number uint64
+		err    error
+	}{
+		{100, nil},                 // Initial head
+		{101, nil},                 // Monotonic progress
+		{101, nil},                 // Repeated head
+		{105, nil},                 // Monotonic progress
+		{98, nil},                  // Small regression, within the reorg depth
+		{106, nil},                 // Recovery beyond the previous highest
+		{96, nil},                  // Regression up to the reorg depth
+		{95, errEntropyRegression}, // Regression beyond the reorg depth
+		{50, errEntropyRegression}, // Large regression
+		{107, nil},                 // Progress after a rejected regression
+	}
+	peer := newPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), nil, nil, &config)
+	defer peer.Close()
+
+	for i, tt := range tests {
+		number := new(big.Int).SetUint64(tt.number)
+		if err := peer.TrackEntropy(number, new(big.Int).Mul(number, big.NewInt(1000))); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+	// Regressions from a handshake entropy are judged by the average entropy of
+	// the first numbered update
+	peer = newPeer(ETH66, p2p.NewPeer(enode.ID{0x02}, "peer", nil), nil, nil, &config)
+	defer peer.Close()
+
+	peer.maxEntropy = big.NewInt(200000)
+	if err := peer.TrackEntropy(big.NewInt(195), big.NewInt(195000)); err != nil {
+		t.Errorf("regression from handshake within bound rejected: %v", err)
+	}
+	if err := peer.TrackEntropy(big.NewInt(100), big.NewInt(100000)); !errors.Is(err, errEntropyRegression) {
+		t.Errorf("regression from handshake error mismatch: have %v, want %v", err, errEntropyRegression)
+	}
+}
+
+// Tests that advertised entropies must be non-negative and within the bit length
+// any chain can accumulate.
+func TestValidateEntropy(t *testing.T) {
+	local := newTestStatus(t, common.Location{0, 0})
+
+	pow2 := func(bits uint) *big.Int { return new(big.Int).Lsh(big.NewInt(1), bits) }
+	tests := []struct {
+		entropy *big.Int
+		err     error
+	}{
+		{nil, nil},           // Unknown entropy
+		{big.NewInt(0), nil}, // Genesis entropy
+		{pow2(100), nil},     // Reasonable entropy
+		{new(big.Int).Sub(pow2(maxEntropyBits), big.NewInt(1)), nil}, // Highest entropy
+		{big.NewInt(-1), errEntropyRejected},                         // Negative entropy
+		{pow2(maxEntropyBits), errEntropyRejected},                   // Barely too long entropy
+		{pow2(4096), errEntropyRejected},                             // Absurdly long entropy
+	}
+	for i, tt := range tests {
+		if err := validateEntropy(tt.entropy); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		remote := *local
+		remote.Entropy = tt.entropy
+		if err := validateStatus(&remote, local, false); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: status error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+// Tests that peers advertising an out of bounds entropy are rejected in the
+// handshake and in status deltas.
+func TestHandshakeEntropyBounds(t *testing.T) {
+	absurd := new(big.Int).Lsh(big.NewInt(1), 4096)
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	local := NewPeer(ETH66, p2p.NewPeer(enode.ID{0xe5, 0x01}, "peer", nil), net, nil)
+	defer local.Close()
+
+	// Drain the local status and answer it with an absurd entropy
+	status := newTestStatus(t, common.Location{0, 0})
+	remote := *status
+	remote.Entropy = absurd
+
+	go func() {
+		if msg, err := app.ReadMsg(); err == nil {
+			msg.Discard()
+		}
+		p2p.Send(app, StatusMsg, &remote)
+	}()
+	if err := local.Handshake(enode.ID{0xe5, 0x02}, status); !errors.Is(err, errEntropyRejected) {
+		t.Errorf("handshake error mismatch: have %v, want %v", err, errEntropyRejected)
+	}
+	// Deltas can't push the entropy out of bounds either
+	blob, _ := rlp.EncodeToBytes(absurd)
+	delta := &StatusDeltaPacket{Fields: StatusFieldEntropy, Values: []rlp.RawValue{blob}}
+
+	peer := NewPeer(ETH67, p2p.NewPeer(enode.ID{0xe5, 0x03}, "peer", nil), nil, nil)
+	defer peer.Close()
+
+	peer.entropy = big.NewInt(100)
+	if err := peer.applyStatusDelta(delta); !errors.Is(err, errEntropyRejected) {
+		t.Errorf("delta error mismatch: have %v, want %v", err, errEntropyRejected)
+	}
+	if peer.entropy.Cmp(big.NewInt(100)) != 0 {
+		t.Errorf("entropy modified by rejected delta: %v", peer.entropy)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/trie"
+)
+
+// rollupReader defines the chain methods needed to serve pending ETX rollups.
+type rollupReader interface {
+	chainReader
+
+	// GetPendingEtxsRollup retrieves the pending ETX rollup of a block by hash.
+	GetPendingEtxsRollup(hash common.Hash) *types.PendingEtxsRollup
+}
+
+// answerGetEtxRollupsByRangeQuery walks the requested range of canonical dominant
+// blocks the same way as a dominant block miner retrieval, returning the pending
+// ETX rollup of each. The range is cut short at the first block whose rollup is
+// unavailable, or once the reply reaches softResponseLimit, which keeps it well
+// within the message size limit of any connection. Queries for no or more than
+// maxEtxRollupsServe rollups are rejected.
+func answerGetEtxRollupsByRangeQuery(chain rollupReader, query GetEtxRollupsByRangePacket, peer *Peer) (EtxRollupsByRangePacket, error) {
+	if query.Count == 0 || query.Count > maxEtxRollupsServe {
+		return nil, fmt.Errorf("%w: %d rollups requested, limit %d", errInvalidQuery, query.Count, maxEtxRollupsServe)
+	}
+	var (
+		bytes   int
+		rollups EtxRollupsByRangePacket
+	)
+	for _, header := range canonicalRangeHeaders(chain, query.Origin, query.Count, true, peer) {
+		if bytes >= softResponseLimit {
+			break
+		}
+		rollup := chain.GetPendingEtxsRollup(header.Hash())
+		if rollup == nil {
+			break
+		}
+		rollups = append(rollups, *rollup)
+		bytes += estHeaderSize + len(rollup.Manifest)*common.HashLength
+	}
+	return rollups, nil
+}
+
+// sanityCheck verifies that the rollups of the reply are in ascending block
+// order and that their manifests match the headers committing to them.
+func (p *EtxRollupsByRangePacket) sanityCheck() error {
+	hasher := trie.NewStackTrie(nil)
+	for i, rollup := range *p {
+		if !rollup.IsValid(hasher) {
+			return fmt.Errorf("%w: rollup %d manifest does not match header", errInvalidRollup, i)
+		}
+		if i > 0 && rollup.Header.NumberU64() <= (*p)[i-1].Header.NumberU64() {
+			return fmt.Errorf("%w: rollup %d of block #%d after #%d", errInvalidRollup, i, rollup.Header.NumberU64(), (*p)[i-1].Header.NumberU64())
+		}
+	}
+	return nil
+}
+
+// ReplyEtxRollupsByRange is the eth/67 response to GetEtxRollupsByRange.
+func (p *Peer) ReplyEtxRollupsByRange(id uint64, rollups EtxRollupsByRangePacket) error {
+	return send(p.rw, EtxRollupsByRangeMsg, &EtxRollupsByRangePacket66{
+		RequestId:               id,
+		EtxRollupsByRangePacket: rollups,
+	})
+}
+
+// RequestEtxRollupsByRange fetches the pending ETX rollups of a range of
+// canonical dominant blocks, starting at the origin.
+func (p *Peer) RequestEtxRollupsByRange(origin HashOrNumber, count uint64) error {
+	p.Log().Debug("Fetching range of pending etxs rollups", "origin", origin, "count", count)
+	if err := p.checkOptional(GetEtxRollupsByRangeMsg); err != nil {
+		return err
+	}
+	id := rand.Uint64()
+
+	requestTracker.Track(p.id, p.version, GetEtxRollupsByRangeMsg, EtxRollupsByRangeMsg, id)
+	return send(p.rw, GetEtxRollupsByRangeMsg, &GetEtxRollupsByRangePacket66{
+		RequestId: id,
+		GetEtxRollupsByRangePacket: GetEtxRollupsByRangePacket{
+			Origin: origin,
+			Count:  count,
+		},
+	})
+}
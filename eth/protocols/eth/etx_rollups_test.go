@@ -0,0 +1,275 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/trie"
+)
+
+// rollupChain is a test chain serving the pending ETX rollups of its dominant
+// blocks.
+type rollupChain struct {
+	*testChain
+	rollups map[common.Hash]*types.PendingEtxsRollup
+}
+
+// newRollupChain creates a test chain with the given number of blocks on top of
+// an empty genesis, every third of them being dominant and carrying a rollup of
+// a manifest with the given number of entries.
+func newRollupChain(blocks int, entries int) *rollupChain {
+	chain := &rollupChain{
+		testChain: newTestChain(0),
+		rollups:   make(map[common.Hash]*types.PendingEtxsRollup),
+	}
+	for i := 1; i <= blocks; i++ {
+		header := types.EmptyHeader()
+		header.SetNumber(big.NewInt(int64(i)))
+		header.SetDifficulty(big.NewInt(1))
+		header.SetParentHash(chain.canonical[i-1].Hash())
+
+		var manifest types.BlockManifest
+		if i%3 == 0 {
+			manifest = make(types.BlockManifest, entries)
+			for j := range manifest {
+				manifest[j] = common.Hash{byte(i), byte(j >> 8), byte(j)}
+			}
+			header.SetManifestHash(types.DeriveSha(manifest, trie.NewStackTrie(nil)), common.ZONE_CTX)
+		}
+		hash := header.Hash()
+		chain.headers[hash] = header
+		chain.canonical = append(chain.canonical, header)
+
+		if manifest != nil {
+			chain.engine.dom[hash] = true
+			chain.rollups[hash] = &types.PendingEtxsRollup{Header: header, Manifest: manifest}
+		}
+	}
+	return chain
+}
+
+func (c *rollupChain) GetPendingEtxsRollup(hash common.Hash) *types.PendingEtxsRollup {
+	return c.rollups[hash]
+}
+
+// rollupNumbers returns the numbers of the blocks of a range of rollups.
+func rollupNumbers(rollups EtxRollupsByRangePacket) []uint64 {
+	numbers := make([]uint64, 0, len(rollups))
+	for _, rollup := range rollups {
+		numbers = append(numbers, rollup.Header.NumberU64())
+	}
+	return numbers
+}
+
+// Tests that ranges of rollups are served for the dominant blocks following the
+// origin, cut short at the end of the chain or the first missing rollup.
+func TestGetEtxRollupsByRange(t *testing.T) {
+	chain := newRollupChain(30, 4)
+
+	side := types.EmptyHeader()
+	side.SetNumber(big.NewInt(6))
+	chain.headers[side.Hash()] = side
+
+	tests := []struct {
+		origin HashOrNumber
+		count  uint64
+		want   []uint64
+	}{
+		{HashOrNumber{Number: 0}, 4, []uint64{3, 6, 9, 12}},                                  // From genesis
+		{HashOrNumber{Number: 7}, 3, []uint64{9, 12, 15}},                                    // From a non-dominant block
+		{HashOrNumber{Hash: chain.canonical[6].Hash()}, 2, []uint64{6, 9}},                   // From a dominant block hash
+		{HashOrNumber{Number: 25}, 10, []uint64{27, 30}},                                     // Beyond the head
+		{HashOrNumber{Number: 31}, 1, []uint64{}},                                            // Past the head
+		{HashOrNumber{Hash: side.Hash()}, 2, []uint64{}},                                     // From a non-canonical block
+		{HashOrNumber{Hash: common.Hash{0xff}}, 2, []uint64{}},                               // From an unknown block
+		{HashOrNumber{Number: 12}, maxEtxRollupsServe, []uint64{12, 15, 18, 21, 24, 27, 30}}, // Whole range
+	}
+	for i, tt := range tests {
+		rollups, err := answerGetEtxRollupsByRangeQuery(chain, GetEtxRollupsByRangePacket{Origin: tt.origin, Count: tt.count}, nil)
+		if err != nil {
+			t.Fatalf("test %d: failed to answer query: %v", i, err)
+		}
+		if have := rollupNumbers(rollups); !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("test %d: rollups mismatch: have %v, want %v", i, have, tt.want)
+		}
+		if err := rollups.sanityCheck(); err != nil {
+			t.Errorf("test %d: reply failed sanity check: %v", i, err)
+		}
+	}
+	// A missing rollup cuts the range short
+	delete(chain.rollups, chain.canonical[18].Hash())
+
+	rollups, err := answerGetEtxRollupsByRangeQuery(chain, GetEtxRollupsByRangePacket{Origin: HashOrNumber{Number: 12}, Count: 5}, nil)
+	if err != nil {
+		t.Fatalf("failed to answer query: %v", err)
+	}
+	if have, want := rollupNumbers(rollups), []uint64{12, 15}; !reflect.DeepEqual(have, want) {
+		t.Errorf("cut short rollups mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that queries for no or too many rollups are rejected as invalid.
+func TestGetEtxRollupsByRangeInvalid(t *testing.T) {
+	chain := newRollupChain(6, 1)
+
+	for _, count := range []uint64{0, maxEtxRollupsServe + 1} {
+		if _, err := answerGetEtxRollupsByRangeQuery(chain, GetEtxRollupsByRangePacket{Count: count}, nil); !errors.Is(err, errInvalidQuery) {
+			t.Errorf("count %d: error mismatch: have %v, want %v", count, err, errInvalidQuery)
+		}
+	}
+}
+
+// Tests that large ranges are paged under the response limit, and can be fully
+// retrieved by continuing from the block after the last rollup received.
+func TestGetEtxRollupsByRangePaging(t *testing.T) {
+	// Make every rollup take up around a third of the response limit
+	entries := softResponseLimit / common.HashLength / 3
+	chain := newRollupChain(30, entries)
+
+	var (
+		origin = HashOrNumber{Number: 1}
+		pages  int
+		have   []uint64
+	)
+	for {
+		rollups, err := answerGetEtxRollupsByRangeQuery(chain, GetEtxRollupsByRangePacket{Origin: origin, Count: maxEtxRollupsServe}, nil)
+		if err != nil {
+			t.Fatalf("page %d: failed to answer query: %v", pages, err)
+		}
+		if len(rollups) == 0 {
+			break
+		}
+		pages++
+		if size := len(rollups) * entries * common.HashLength; len(rollups) > 1 && size-entries*common.HashLength >= softResponseLimit {
+			t.Errorf("page %d: %d rollups overshoot the response limit", pages, len(rollups))
+		}
+		have = append(have, rollupNumbers(rollups)...)
+		origin = HashOrNumber{Number: rollups[len(rollups)-1].Header.NumberU64() + 1}
+	}
+	if want := []uint64{3, 6, 9, 12, 15, 18, 21, 24, 27, 30}; !reflect.DeepEqual(have, want) {
+		t.Errorf("paged rollups mismatch: have %v, want %v", have, want)
+	}
+	if pages < 3 {
+		t.Errorf("range not paged: retrieved in %d pages", pages)
+	}
+}
+
+// Tests that rollup range replies out of order or with tampered manifests are
+// rejected.
+func TestEtxRollupsByRangeSanityCheck(t *testing.T) {
+	chain := newRollupChain(9, 2)
+
+	var (
+		first  = *chain.rollups[chain.canonical[3].Hash()]
+		second = *chain.rollups[chain.canonical[6].Hash()]
+		forged = first
+	)
+	forged.Manifest = types.BlockManifest{{0xff}}
+
+	tests := []struct {
+		rollups EtxRollupsByRangePacket
+		valid   bool
+	}{
+		{EtxRollupsByRangePacket{}, true},
+		{EtxRollupsByRangePacket{first, second}, true},
+		{EtxRollupsByRangePacket{second, first}, false},
+		{EtxRollupsByRangePacket{first, first}, false},
+		{EtxRollupsByRangePacket{forged}, false},
+	}
+	for i, tt := range tests {
+		err := tt.rollups.sanityCheck()
+		if tt.valid && err != nil {
+			t.Errorf("test %d: valid reply rejected: %v", i, err)
+		}
+		if !tt.valid && !errors.Is(err, errInvalidRollup) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, errInvalidRollup)
+		}
+	}
+}
+
+// Tests that rollup ranges round-trip through the wire, and that the request is
+// refused to peers older than eth/67.
+func TestEtxRollupsByRangeRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		chain  = newRollupChain(15, 3)
+		origin = HashOrNumber{Hash: chain.canonical[3].Hash()}
+		local  = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xe7, 0x01}, "peer", nil), net, nil)
+		remote = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xe7, 0x02}, "peer", nil), app, nil)
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	advertiseOptional(local, GetEtxRollupsByRangeMsg)
+	go local.RequestEtxRollupsByRange(origin, 4)
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	if msg.Code != GetEtxRollupsByRangeMsg {
+		t.Fatalf("request code mismatch: have %#x, want %#x", msg.Code, GetEtxRollupsByRangeMsg)
+	}
+	var query GetEtxRollupsByRangePacket66
+	if err := msg.Decode(&query); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	if query.Origin != origin || query.Count != 4 {
+		t.Fatalf("request mismatch: have %+v", query.GetEtxRollupsByRangePacket)
+	}
+	res, err := answerGetEtxRollupsByRangeQuery(chain, query.GetEtxRollupsByRangePacket, remote)
+	if err != nil {
+		t.Fatalf("failed to answer query: %v", err)
+	}
+	go remote.ReplyEtxRollupsByRange(query.RequestId, res)
+
+	backend := new(mockBackend)
+	if err := handleMessage(backend, local); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+	}
+	rollups := *backend.handled[0].(*EtxRollupsByRangePacket)
+	if have, want := rollupNumbers(rollups), []uint64{3, 6, 9, 12}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("delivered rollups mismatch: have %v, want %v", have, want)
+	}
+	for i, rollup := range rollups {
+		want := chain.rollups[rollup.Header.Hash()]
+		if want == nil || !reflect.DeepEqual(rollup.Manifest, want.Manifest) {
+			t.Errorf("rollup %d mismatch: have %v, want %v", i, rollup.Manifest, want)
+		}
+	}
+	// Peers older than eth/67 can't be asked
+	old := NewPeer(ETH66, p2p.NewPeer(enode.ID{0xe7, 0x03}, "peer", nil), net, nil)
+	defer old.Close()
+
+	if err := old.RequestEtxRollupsByRange(origin, 4); err == nil {
+		t.Errorf("eth/66 peer accepted rollup range request")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// Tests that messages in the experimental range are only exchanged if both
+// sides opted in during the handshake, and treated as invalid otherwise.
+func TestExperimentalMessages(t *testing.T) {
+	const code = ExperimentalMsgBase + 1
+	experimental[code] = func(backend Backend, msg Decoder, peer *Peer) error {
+		var packet []byte
+		if err := msg.Decode(&packet); err != nil {
+			return err
+		}
+		return backend.Handle(peer, &NewPooledTransactionHashesPacket{common.BytesToHash(packet)})
+	}
+	defer delete(experimental, code)
+
+	tests := []struct {
+		local  bool
+		remote bool
+	}{
+		{true, true},
+		{true, false},
+		{false, true},
+		{false, false},
+	}
+	for i, tt := range tests {
+		config := DefaultConfig
+		config.Experimental = tt.local
+		local, err := NewStatusPacket(newTestChain(0), ETH66, 1, []common.Location{{0, 0}}, &config)
+		if err != nil {
+			t.Fatalf("test %d: failed to assemble status: %v", i, err)
+		}
+
+		remote := newTestStatus(t, common.Location{0, 0})
+		remote.Experimental = tt.remote
+
+		app, net := p2p.MsgPipe()
+		peer := NewPeer(ETH66, p2p.NewPeer(enode.ID{byte(i)}, "peer", nil), net, nil)
+
+		go func() {
+			// Consume our own status and answer with the remote one
+			if msg, err := app.ReadMsg(); err == nil {
+				msg.Discard()
+			}
+			p2p.Send(app, StatusMsg, remote)
+		}()
+		if err := peer.Handshake(enode.ID{0xff}, local); err != nil {
+			t.Fatalf("test %d: failed to handshake: %v", i, err)
+		}
+		enabled := tt.local && tt.remote
+		if peer.Experimental() != enabled {
+			t.Errorf("test %d: negotiation mismatch: have %v, want %v", i, peer.Experimental(), enabled)
+		}
+		// Sending is refused locally unless negotiated
+		if enabled {
+			go peer.SendExperimental(code, []byte{0x01})
+			msg, err := app.ReadMsg()
+			if err != nil {
+				t.Fatalf("test %d: failed to read experimental message: %v", i, err)
+			}
+			if msg.Code != code {
+				t.Errorf("test %d: code mismatch: have %#x, want %#x", i, msg.Code, code)
+			}
+			msg.Discard()
+		} else if err := peer.SendExperimental(code, []byte{0x01}); !errors.Is(err, errNotExperimental) {
+			t.Errorf("test %d: send error mismatch: have %v, want %v", i, err, errNotExperimental)
+		}
+		if err := peer.SendExperimental(NewBlockMsg, []byte{0x01}); !errors.Is(err, errInvalidMsgCode) {
+			t.Errorf("test %d: standard code sent as experimental: %v", i, err)
+		}
+		// Inbound experimental messages are only dispatched if negotiated
+		go p2p.Send(app, code, []byte{0x01})
+
+		backend := new(mockBackend)
+		err = handleMessage(backend, peer)
+		if enabled {
+			if err != nil {
+				t.Errorf("test %d: experimental message rejected: %v", i, err)
+			}
+			if len(backend.handled) != 1 {
+				t.Errorf("test %d: experimental message not delivered", i)
+			}
+		} else {
+			if !errors.Is(err, errInvalidMsgCode) {
+				t.Errorf("test %d: error mismatch: have %v, want %v", i, err, errInvalidMsgCode)
+			}
+			if len(backend.handled) != 0 {
+				t.Errorf("test %d: experimental message delivered", i)
+			}
+		}
+		peer.Close()
+		app.Close()
+		net.Close()
+	}
+}
+
+// Tests that the experimental range is addressable within the eth/66 protocol
+// and doesn't overlap any standard message.
+func TestExperimentalRange(t *testing.T) {
+	if protocolLengths[ETH66] < ExperimentalMsgBase+ExperimentalMsgCount {
+		t.Errorf("experimental range not covered by protocol length %d", protocolLengths[ETH66])
+	}
+	for _, handlers := range []map[uint64]msgHandler{eth65, eth66} {
+		for code := range handlers {
+			if isExperimental(code) {
+				t.Errorf("standard message %#x in experimental range", code)
+			}
+		}
+	}
+}
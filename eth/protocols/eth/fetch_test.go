@@ -0,0 +1,475 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// fetchQuery is the part of the eth/66 requests common to all of them.
+type fetchQuery struct {
+	RequestId uint64
+	Rest      []rlp.RawValue `rlp:"tail"`
+}
+
+// testFetch runs a direct fetch against a remote node answering the request
+// with the given code through the reply assembled for its request id. It checks
+// that the reply is returned to the fetch instead of the backend.
+func testFetch(t *testing.T, version uint, query uint64, code uint64, reply func(id uint64) interface{}, fetch func(peer *Peer) (interface{}, error)) interface{} {
+	t.Helper()
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	peer := NewPeer(version, p2p.NewPeer(enode.ID{0xfe}, "peer", nil), net, nil)
+	defer peer.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		msg, err := app.ReadMsg()
+		if err != nil {
+			errc <- err
+			return
+		}
+		if msg.Code != query {
+			errc <- errors.New("unexpected request code")
+			return
+		}
+		var req fetchQuery
+		if err := msg.Decode(&req); err != nil {
+			errc <- err
+			return
+		}
+		errc <- p2p.Send(app, code, reply(req.RequestId))
+	}()
+	backend := new(mockBackend)
+	go func() {
+		if err := handleMessage(backend, peer); err != nil {
+			t.Errorf("failed to handle reply: %v", err)
+		}
+	}()
+	res, err := fetch(peer)
+	if err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to serve request: %v", err)
+	}
+	if len(backend.handled) != 0 {
+		t.Errorf("fetched reply delivered to the backend: %v", backend.handled)
+	}
+	return res
+}
+
+// Tests that direct fetches give up after their timeout, the replies arriving
+// late being delivered to the backend instead.
+func TestFetchTimeout(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	peer := NewPeer(ETH66, p2p.NewPeer(enode.ID{0xfe}, "peer", nil), net, nil)
+	defer peer.Close()
+
+	queries := make(chan uint64, 1)
+	go func() {
+		msg, err := app.ReadMsg()
+		if err != nil {
+			return
+		}
+		var req fetchQuery
+		msg.Decode(&req)
+		queries <- req.RequestId
+	}()
+	if _, err := peer.FetchBlockTxHashes(common.Hash{0x01}, 10*time.Millisecond); !errors.Is(err, errFetchTimeout) {
+		t.Fatalf("error mismatch: have %v, want %v", err, errFetchTimeout)
+	}
+	go p2p.Send(app, BlockTxHashesMsg, &BlockTxHashesPacket66{RequestId: <-queries})
+
+	backend := new(mockBackend)
+	if err := handleMessage(backend, peer); err != nil {
+		t.Fatalf("failed to handle late reply: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Errorf("late reply not delivered to the backend")
+	}
+}
+
+// Tests that the transaction hashes of a block can be fetched directly.
+func TestFetchBlockTxHashes(t *testing.T) {
+	want := BlockTxHashesPacket{{0x01}, {0x02}}
+	have := testFetch(t, ETH66, GetBlockTxHashesMsg, BlockTxHashesMsg,
+		func(id uint64) interface{} {
+			return &BlockTxHashesPacket66{RequestId: id, BlockTxHashesPacket: want}
+		},
+		func(peer *Peer) (interface{}, error) {
+			return peer.FetchBlockTxHashes(common.Hash{0x01}, time.Second)
+		},
+	)
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("tx hashes mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that the canonical headers at discrete numbers can be fetched directly.
+func TestFetchHeadersByNumbers(t *testing.T) {
+	chain := newTestChain(3)
+	want := HeadersByNumbersPacket{chain.canonical[1], chain.canonical[3]}
+	have := testFetch(t, ETH66, GetHeadersByNumbersMsg, HeadersByNumbersMsg,
+		func(id uint64) interface{} {
+			return &HeadersByNumbersPacket66{RequestId: id, HeadersByNumbersPacket: want}
+		},
+		func(peer *Peer) (interface{}, error) {
+			return peer.FetchHeadersByNumbers([]uint64{1, 3}, time.Second)
+		},
+	)
+	headers := have.(HeadersByNumbersPacket)
+	if len(headers) != len(want) {
+		t.Fatalf("header count mismatch: have %d, want %d", len(headers), len(want))
+	}
+	for i := range want {
+		if headers[i].Hash() != want[i].Hash() {
+			t.Errorf("header %d: hash mismatch: have %x, want %x", i, headers[i].Hash(), want[i].Hash())
+		}
+	}
+}
+
+// Tests that a page of the pending etxs of a location can be fetched directly.
+func TestFetchPendingEtxsByLocation(t *testing.T) {
+	want := &PendingEtxsByLocationPacket{Etxs: newTestEtxs(2, 1), Cursor: common.Hash{0x02}}
+	have := testFetch(t, ETH66, GetPendingEtxsByLocationMsg, PendingEtxsByLocationMsg,
+		func(id uint64) interface{} {
+			return &PendingEtxsByLocationPacket66{RequestId: id, PendingEtxsByLocationPacket: *want}
+		},
+		func(peer *Peer) (interface{}, error) {
+			return peer.FetchPendingEtxsByLocation(common.Location{0, 1}, common.Hash{}, time.Second)
+		},
+	)
+	page := have.(*PendingEtxsByLocationPacket)
+	if page.Cursor != want.Cursor || len(page.Etxs) != len(want.Etxs) {
+		t.Fatalf("page mismatch: have %d etxs until %x, want %d until %x", len(page.Etxs), page.Cursor, len(want.Etxs), want.Cursor)
+	}
+	for i, etx := range want.Etxs {
+		if page.Etxs[i].Hash() != etx.Hash() {
+			t.Errorf("etx %d: hash mismatch: have %x, want %x", i, page.Etxs[i].Hash(), etx.Hash())
+		}
+	}
+}
+
+// Tests that the etx roots of a range of blocks can be fetched directly.
+func TestFetchBlockEtxRoots(t *testing.T) {
+	want := BlockEtxRootsPacket{
+		{Number: 1, Hash: common.Hash{0x01}, EtxRoot: common.Hash{0x11}},
+		{Number: 2, Hash: common.Hash{0x02}, EtxRoot: common.Hash{0x12}},
+	}
+	have := testFetch(t, ETH66, GetBlockEtxRootsMsg, BlockEtxRootsMsg,
+		func(id uint64) interface{} {
+			return &BlockEtxRootsPacket66{RequestId: id, BlockEtxRootsPacket: want}
+		},
+		func(peer *Peer) (interface{}, error) {
+			return peer.FetchBlockEtxRoots(1, 2, 0, false, time.Second)
+		},
+	)
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("etx roots mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that head anchored bodies can be fetched directly, along with the list
+// of the stale ones skipped.
+func TestFetchFreshBodies(t *testing.T) {
+	want := &FreshBlockBodiesPacket{Bodies: []*BlockBody{{}}, Stale: []common.Hash{{0x02}}}
+	have := testFetch(t, ETH66, GetFreshBlockBodiesMsg, FreshBlockBodiesMsg,
+		func(id uint64) interface{} {
+			return &FreshBlockBodiesPacket66{RequestId: id, FreshBlockBodiesPacket: *want}
+		},
+		func(peer *Peer) (interface{}, error) {
+			return peer.FetchFreshBodies(common.Hash{0xff}, 3, []common.Hash{{0x01}, {0x02}}, time.Second)
+		},
+	)
+	bodies := have.(*FreshBlockBodiesPacket)
+	if len(bodies.Bodies) != 1 || !reflect.DeepEqual(bodies.Stale, want.Stale) {
+		t.Errorf("fresh bodies mismatch: have %d bodies, stale %v, want 1, stale %v", len(bodies.Bodies), bodies.Stale, want.Stale)
+	}
+}
+
+// Tests that the miners of a range of blocks can be fetched directly.
+func TestFetchBlockMiners(t *testing.T) {
+	want := BlockMinersPacket{
+		{Number: 1, Miner: common.HexToAddress("0x01")},
+		{Number: 2, Miner: common.HexToAddress("0x02")},
+	}
+	have := testFetch(t, ETH66, GetBlockMinersMsg, BlockMinersMsg,
+		func(id uint64) interface{} {
+			return &BlockMinersPacket66{RequestId: id, BlockMinersPacket: want}
+		},
+		func(peer *Peer) (interface{}, error) {
+			return peer.FetchBlockMiners(1, 2, false, time.Second)
+		},
+	)
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("block miners mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that the uncles of a range of blocks can be fetched directly.
+func TestFetchUnclesByRange(t *testing.T) {
+	chain := newTestChain(2)
+	want := UnclesByRangePacket{{Number: 1}, {Number: 2, Uncles: []*types.Header{chain.canonical[1]}}}
+	have := testFetch(t, ETH66, GetUnclesByRangeMsg, UnclesByRangeMsg,
+		func(id uint64) interface{} {
+			return &UnclesByRangePacket66{RequestId: id, UnclesByRangePacket: want}
+		},
+		func(peer *Peer) (interface{}, error) {
+			return peer.FetchUnclesByRange(1, 2, false, time.Second)
+		},
+	)
+	uncles := have.(UnclesByRangePacket)
+	if len(uncles) != 2 || uncles[0].Number != 1 || len(uncles[0].Uncles) != 0 || uncles[1].Number != 2 || len(uncles[1].Uncles) != 1 {
+		t.Fatalf("uncles mismatch: have %v", uncles)
+	}
+	if uncles[1].Uncles[0].Hash() != chain.canonical[1].Hash() {
+		t.Errorf("uncle hash mismatch: have %x, want %x", uncles[1].Uncles[0].Hash(), chain.canonical[1].Hash())
+	}
+}
+
+// Tests that blocks can be fetched directly by number.
+func TestFetchBlockByNumber(t *testing.T) {
+	chain := newTestChain(2)
+	want := types.NewBlockWithHeader(chain.canonical[2])
+	have := testFetch(t, ETH67, GetBlockByNumberMsg, BlockByNumberMsg,
+		func(id uint64) interface{} {
+			return &BlockByNumberPacket66{RequestId: id, BlockByNumberPacket: BlockByNumberPacket{Block: want}}
+		},
+		func(peer *Peer) (interface{}, error) {
+			return peer.FetchBlockByNumber(common.NodeLocation, 2, time.Second)
+		},
+	)
+	if block := have.(*BlockByNumberPacket).Block; block == nil || block.Hash() != want.Hash() {
+		t.Errorf("block mismatch: have %v, want %x", block, want.Hash())
+	}
+}
+
+// Tests that manifest proofs can be fetched directly.
+func TestFetchEtxManifestProof(t *testing.T) {
+	want := &EtxManifestProofPacket{Root: common.Hash{0x01}, Index: 2, Proof: [][]byte{{0x03}, {0x04}}}
+	have := testFetch(t, ETH67, GetEtxManifestProofMsg, EtxManifestProofMsg,
+		func(id uint64) interface{} {
+			return &EtxManifestProofPacket66{RequestId: id, EtxManifestProofPacket: *want}
+		},
+		func(peer *Peer) (interface{}, error) {
+			advertiseOptional(peer, GetEtxManifestProofMsg)
+			return peer.FetchEtxManifestProof(common.Hash{0x0a}, common.Location{0, 0}, common.Hash{0x0b}, time.Second)
+		},
+	)
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("manifest proof mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that canonical hashes can be fetched directly.
+func TestFetchCanonicalHash(t *testing.T) {
+	want := common.Hash{0x01}
+	have := testFetch(t, ETH67, GetCanonicalHashMsg, CanonicalHashMsg,
+		func(id uint64) interface{} {
+			return &CanonicalHashPacket66{RequestId: id, CanonicalHashPacket: CanonicalHashPacket{Hash: want}}
+		},
+		func(peer *Peer) (interface{}, error) {
+			return peer.FetchCanonicalHash(common.NodeLocation, 1, time.Second)
+		},
+	)
+	if hash := have.(*CanonicalHashPacket).Hash; hash != want {
+		t.Errorf("canonical hash mismatch: have %x, want %x", hash, want)
+	}
+}
+
+// Tests that a page of the pending etxs created after a block can be fetched
+// directly.
+func TestFetchPendingEtxsSince(t *testing.T) {
+	want := &PendingEtxsSincePacket{Etxs: newTestEtxs(2, 1)}
+	have := testFetch(t, ETH67, GetPendingEtxsSinceMsg, PendingEtxsSinceMsg,
+		func(id uint64) interface{} {
+			return &PendingEtxsSincePacket66{RequestId: id, PendingEtxsSincePacket: *want}
+		},
+		func(peer *Peer) (interface{}, error) {
+			return peer.FetchPendingEtxsSince(common.NodeLocation, common.Hash{0x01}, common.Hash{}, time.Second)
+		},
+	)
+	page := have.(*PendingEtxsSincePacket)
+	if page.Cursor != (common.Hash{}) || len(page.Etxs) != len(want.Etxs) {
+		t.Fatalf("page mismatch: have %d etxs until %x, want %d until the end", len(page.Etxs), page.Cursor, len(want.Etxs))
+	}
+	for i, etx := range want.Etxs {
+		if page.Etxs[i].Hash() != etx.Hash() {
+			t.Errorf("etx %d: hash mismatch: have %x, want %x", i, page.Etxs[i].Hash(), etx.Hash())
+		}
+	}
+}
+
+// Tests that block bodies reduced to a subset of their fields can be fetched
+// directly.
+func TestFetchPartialBodies(t *testing.T) {
+	chain := newTestChain(1)
+	uncles, _ := rlp.EncodeToBytes([]*types.Header{chain.canonical[1]})
+	want := &PartialBodiesPacket{Fields: BodyFieldUncles, Bodies: []PartialBlockBody{{uncles}}}
+
+	have := testFetch(t, ETH67, GetPartialBodiesMsg, PartialBodiesMsg,
+		func(id uint64) interface{} {
+			return &PartialBodiesPacket66{RequestId: id, PartialBodiesPacket: *want}
+		},
+		func(peer *Peer) (interface{}, error) {
+			advertiseOptional(peer, GetPartialBodiesMsg)
+			return peer.FetchPartialBodies(BodyFieldUncles, []common.Hash{{0x01}}, time.Second)
+		},
+	)
+	bodies, err := have.(*PartialBodiesPacket).Unpack()
+	if err != nil {
+		t.Fatalf("failed to unpack bodies: %v", err)
+	}
+	if len(bodies) != 1 || len(bodies[0].Uncles) != 1 || bodies[0].Uncles[0].Hash() != chain.canonical[1].Hash() {
+		t.Errorf("partial bodies mismatch: have %v", bodies)
+	}
+}
+
+// Tests that the headers mined by a set of addresses can be fetched directly.
+func TestFetchHeadersByMiner(t *testing.T) {
+	chain := newTestChain(2)
+	want := &HeadersByMinerPacket{Headers: []*types.Header{chain.canonical[2]}, Last: 2}
+	have := testFetch(t, ETH67, GetHeadersByMinerMsg, HeadersByMinerMsg,
+		func(id uint64) interface{} {
+			return &HeadersByMinerPacket66{RequestId: id, HeadersByMinerPacket: *want}
+		},
+		func(peer *Peer) (interface{}, error) {
+			advertiseOptional(peer, GetHeadersByMinerMsg)
+			return peer.FetchHeadersByMiner(HashOrNumber{Number: 1}, 2, false, []common.Address{common.HexToAddress("0x01")}, time.Second)
+		},
+	)
+	headers := have.(*HeadersByMinerPacket)
+	if headers.Last != want.Last || len(headers.Headers) != 1 || headers.Headers[0].Hash() != chain.canonical[2].Hash() {
+		t.Errorf("headers mismatch: have %v, want %v", headers, want)
+	}
+}
+
+// Tests that transaction non-inclusion proofs can be fetched directly.
+func TestFetchTxNonInclusionProof(t *testing.T) {
+	want := &TxNonInclusionProofPacket{Count: 1, Proof: [][]byte{{0x01}}}
+	have := testFetch(t, ETH67, GetTxNonInclusionProofMsg, TxNonInclusionProofMsg,
+		func(id uint64) interface{} {
+			return &TxNonInclusionProofPacket66{RequestId: id, TxNonInclusionProofPacket: *want}
+		},
+		func(peer *Peer) (interface{}, error) {
+			advertiseOptional(peer, GetTxNonInclusionProofMsg)
+			return peer.FetchTxNonInclusionProof(common.Hash{0x01}, common.Hash{0x02}, time.Second)
+		},
+	)
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("proof mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that block availability probes can be fetched directly.
+func TestFetchHaveBlock(t *testing.T) {
+	have := testFetch(t, ETH66, HaveBlockMsg, HaveBlockReplyMsg,
+		func(id uint64) interface{} {
+			return &HaveBlockReplyPacket66{RequestId: id, HaveBlockReplyPacket: HaveBlockReplyPacket{Hash: common.Hash{0x01}, Have: true}}
+		},
+		func(peer *Peer) (interface{}, error) {
+			return peer.FetchHaveBlock(common.Hash{0x01}, time.Second)
+		},
+	)
+	if !have.(bool) {
+		t.Errorf("availability mismatch: have false, want true")
+	}
+}
+
+// Tests that direct body fetches of blocks above the probe threshold first ask
+// the peer whether it has the block, skipping the body request if it doesn't.
+func TestFetchBodyProbe(t *testing.T) {
+	config := DefaultConfig
+	config.HaveBlockProbeThreshold = 1024
+
+	tests := []struct {
+		size  common.StorageSize
+		probe bool
+	}{
+		{config.HaveBlockProbeThreshold - 1, false},
+		{config.HaveBlockProbeThreshold, true},
+	}
+	for i, tt := range tests {
+		app, net := p2p.MsgPipe()
+		peer := newPeer(ETH66, p2p.NewPeer(enode.ID{0xfe}, "peer", nil), net, nil, &config)
+
+		// Deny having the block to probes, serve an empty body to body requests
+		codes := make(chan uint64, 2)
+		go func() {
+			for {
+				msg, err := app.ReadMsg()
+				if err != nil {
+					return
+				}
+				codes <- msg.Code
+
+				var req fetchQuery
+				msg.Decode(&req)
+				switch msg.Code {
+				case HaveBlockMsg:
+					p2p.Send(app, HaveBlockReplyMsg, &HaveBlockReplyPacket66{RequestId: req.RequestId})
+				case GetBlockBodiesMsg:
+					p2p.Send(app, BlockBodiesMsg, &BlockBodiesPacket66{RequestId: req.RequestId, BlockBodiesPacket: BlockBodiesPacket{{}}})
+				}
+			}
+		}()
+		go func() {
+			for handleMessage(new(mockBackend), peer) == nil {
+			}
+		}()
+		_, err := peer.FetchBody(common.Hash{0x01}, tt.size, time.Second)
+		if tt.probe {
+			if !errors.Is(err, errBodyUnavailable) {
+				t.Errorf("test %d: error mismatch: have %v, want %v", i, err, errBodyUnavailable)
+			}
+			if code := <-codes; code != HaveBlockMsg {
+				t.Errorf("test %d: first request mismatch: have %#x, want %#x", i, code, HaveBlockMsg)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("test %d: failed to fetch body: %v", i, err)
+			}
+			if code := <-codes; code != GetBlockBodiesMsg {
+				t.Errorf("test %d: first request mismatch: have %#x, want %#x", i, code, GetBlockBodiesMsg)
+			}
+		}
+		select {
+		case code := <-codes:
+			t.Errorf("test %d: unexpected request %#x", i, code)
+		default:
+		}
+		peer.Close()
+		app.Close()
+		net.Close()
+	}
+}
@@ -17,11 +17,17 @@
 package eth
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"math/big"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/consensus"
 	"github.com/dominant-strategies/go-quai/core"
 	"github.com/dominant-strategies/go-quai/core/types"
 	"github.com/dominant-strategies/go-quai/metrics"
@@ -29,6 +35,7 @@ import (
 	"github.com/dominant-strategies/go-quai/p2p/enode"
 	"github.com/dominant-strategies/go-quai/p2p/enr"
 	"github.com/dominant-strategies/go-quai/params"
+	"github.com/dominant-strategies/go-quai/rlp"
 )
 
 const (
@@ -52,6 +59,65 @@ const (
 	// containing 200+ transactions nowadays, the practical limit will always
 	// be softResponseLimit.
 	maxReceiptsServe = 1024
+
+	// maxEtxRollupsServe is the maximum number of pending ETX rollups to serve.
+	// The practical limit will mostly be softResponseLimit.
+	maxEtxRollupsServe = 1024
+
+	// maxPoolSnapshotServe is the maximum number of transaction hashes to serve
+	// in a pool snapshot, keeping the reply well within the soft response limit.
+	maxPoolSnapshotServe = 4096
+
+	// maxMinerFilters is the maximum number of miner addresses a single header
+	// query may filter by.
+	maxMinerFilters = 64
+
+	// maxUnclePoolServe is the maximum number of uncle candidates to serve. As
+	// the candidates are limited to the few heights uncles may be included at,
+	// the practical limit will mostly be the number of side blocks seen.
+	maxUnclePoolServe = 64
+)
+
+// maxPendingEtxsServe is the maximum number of pending ETXs to serve in a single
+// page. The practical limit will mostly be softResponseLimit.
+var maxPendingEtxsServe = 4096
+
+// slowServeMeter counts the data retrieval requests taking above the slow serve
+// threshold to serve.
+var slowServeMeter = metrics.NewRegisteredMeter("eth/protocols/eth/serve/slow", nil)
+
+// untaggedReplyMeter counts the replies received without a request id over eth/66
+// connections, correlated to the pending requests by their order instead.
+var untaggedReplyMeter = metrics.NewRegisteredMeter("eth/protocols/eth/reply/untagged", nil)
+
+// entropyRegressionMeter counts the peers dropped for regressing their advertised
+// entropy beyond the maximum reorg depth.
+var entropyRegressionMeter = metrics.NewRegisteredMeter("eth/protocols/eth/entropy/regression", nil)
+
+// unrequestedTxMeter counts the pooled transactions discarded for not having been
+// requested from the peer delivering them.
+var unrequestedTxMeter = metrics.NewRegisteredMeter("eth/protocols/eth/txs/unrequested", nil)
+
+// processingTimeoutMeter counts the messages whose handling overran the
+// processing time limit.
+var processingTimeoutMeter = metrics.NewRegisteredMeter("eth/protocols/eth/processing/timeout", nil)
+
+// amplificationThrottleMeter counts the data retrievals discarded for exceeding
+// the maximum amplification.
+var amplificationThrottleMeter = metrics.NewRegisteredMeter("eth/protocols/eth/serve/throttled", nil)
+
+// ResponsePolicy defines how a data retrieval which does not fit within the
+// reply limits is served.
+type ResponsePolicy int
+
+const (
+	// TruncateResponse serves the longest prefix of the requested items fitting
+	// within the reply limits, leaving the remainder to be re-requested.
+	TruncateResponse ResponsePolicy = iota
+
+	// RejectResponse refuses to serve over-limit requests, answering them with
+	// an empty reply so the requester retries with a smaller batch.
+	RejectResponse
 )
 
 // Handler is a callback to invoke from an outside runner after the boilerplate
@@ -71,6 +137,10 @@ type Backend interface {
 	// or if inbound transactions should simply be dropped.
 	AcceptTxs() bool
 
+	// Capabilities retrieves the data serving capabilities of the local node.
+	// The supported messages are filled in by the protocol handler.
+	Capabilities() CapabilitiesPacket
+
 	// RunPeer is invoked when a peer joins on the `eth` protocol. The handler
 	// should do any peer maintenance work, handshakes and validations. If all
 	// is passed, control should be given back to the `handler` to process the
@@ -92,8 +162,35 @@ type TxPool interface {
 	Get(hash common.Hash) *types.Transaction
 }
 
-// MakeProtocols constructs the P2P protocol definitions for `eth`.
-func MakeProtocols(backend Backend, network uint64, dnsdisc enode.Iterator) []p2p.Protocol {
+// chainReader defines the subset of the blockchain methods used to serve remote
+// data queries, allowing them to be answered without a full core.
+type chainReader interface {
+	consensus.ChainHeaderReader
+
+	// Engine retrieves the consensus engine used to classify dominant blocks.
+	Engine() consensus.Engine
+
+	// GetHeaderOrCandidate retrieves a header by hash and number, including
+	// non-canonical candidates.
+	GetHeaderOrCandidate(hash common.Hash, number uint64) *types.Header
+
+	// GetHeaderOrCandidateByHash retrieves a header by hash, including
+	// non-canonical candidates.
+	GetHeaderOrCandidateByHash(hash common.Hash) *types.Header
+
+	// GetAncestor retrieves the ancestor-th ancestor of the given block.
+	GetAncestor(hash common.Hash, number, ancestor uint64, maxNonCanonical *uint64) (common.Hash, uint64)
+
+	// GetBodyRLP retrieves a block body in RLP encoding from the database by hash.
+	GetBodyRLP(hash common.Hash) rlp.RawValue
+
+	// GetEtxSet retrieves the set of inbound ETXs available on top of a block.
+	GetEtxSet(hash common.Hash, number uint64) types.EtxSet
+}
+
+// MakeProtocols constructs the P2P protocol definitions for `eth`, running the
+// peers with the given protocol settings.
+func MakeProtocols(backend Backend, network uint64, config *Config, dnsdisc enode.Iterator) []p2p.Protocol {
 	protocols := make([]p2p.Protocol, len(ProtocolVersions))
 	for i, version := range ProtocolVersions {
 		version := version // Closure
@@ -103,10 +200,14 @@ func MakeProtocols(backend Backend, network uint64, dnsdisc enode.Iterator) []p2
 			Version: version,
 			Length:  protocolLengths[version],
 			Run: func(p *p2p.Peer, rw p2p.MsgReadWriter) error {
-				peer := NewPeer(version, p, rw, backend.TxPool())
+				peer := newPeer(version, p, rw, backend.TxPool(), config)
 				defer peer.Close()
 
+				peer.trace(config.Trace.Connected)
 				return backend.RunPeer(peer, func(peer *Peer) error {
+					// The backend only hands control back once the peer passed
+					// all its checks and got registered
+					peer.trace(config.Trace.Registered)
 					return Handle(backend, peer)
 				})
 			},
@@ -147,13 +248,16 @@ func nodeInfo(chain *core.Core, network uint64) *NodeInfo {
 
 // Handle is invoked whenever an `eth` connection is made that successfully passes
 // the protocol handshake. This method will keep processing messages until the
-// connection is torn down.
+// connection is torn down, or the peer scorer rates the peer negative.
 func Handle(backend Backend, peer *Peer) error {
 	for {
 		if err := handleMessage(backend, peer); err != nil {
 			peer.Log().Debug("Message handling failed in `eth`", "err", err)
 			return err
 		}
+		if score := peer.Score(); score.Sign() < 0 {
+			return fmt.Errorf("%w: %v", errPeerScoreTooLow, score)
+		}
 	}
 }
 
@@ -183,17 +287,148 @@ var eth66 = map[uint64]msgHandler{
 	TransactionsMsg:               handleTransactions,
 	NewPooledTransactionHashesMsg: handleNewPooledTransactionHashes,
 	// eth66 messages with request-id
-	GetBlockHeadersMsg:         handleGetBlockHeaders66,
-	BlockHeadersMsg:            handleBlockHeaders66,
-	GetBlockBodiesMsg:          handleGetBlockBodies66,
-	BlockBodiesMsg:             handleBlockBodies66,
-	GetPooledTransactionsMsg:   handleGetPooledTransactions66,
-	PendingEtxsMsg:             handlePendingEtxs,
-	PendingEtxsRollupMsg:       handlePendingEtxsRollup,
-	GetOnePendingEtxsRollupMsg: handleGetOnePendingEtxsRollup66,
-	GetOnePendingEtxsMsg:       handleGetOnePendingEtxs66,
-	PooledTransactionsMsg:      handlePooledTransactions66,
-	GetBlockMsg:                handleGetBlock66,
+	GetBlockHeadersMsg:          handleGetBlockHeaders66,
+	BlockHeadersMsg:             handleBlockHeaders66,
+	GetBlockBodiesMsg:           handleGetBlockBodies66,
+	BlockBodiesMsg:              handleBlockBodies66,
+	GetPooledTransactionsMsg:    handleGetPooledTransactions66,
+	PendingEtxsMsg:              handlePendingEtxs,
+	PendingEtxsRollupMsg:        handlePendingEtxsRollup,
+	GetOnePendingEtxsRollupMsg:  handleGetOnePendingEtxsRollup66,
+	GetOnePendingEtxsMsg:        handleGetOnePendingEtxs66,
+	PooledTransactionsMsg:       handlePooledTransactions66,
+	GetBlockMsg:                 handleGetBlock66,
+	GetBlockTxHashesMsg:         handleGetBlockTxHashes66,
+	BlockTxHashesMsg:            handleBlockTxHashes66,
+	GetHeadMsg:                  handleGetHead66,
+	HeadMsg:                     handleHead66,
+	GetCapabilitiesMsg:          handleGetCapabilities66,
+	CapabilitiesMsg:             handleCapabilities66,
+	GetHeadersByNumbersMsg:      handleGetHeadersByNumbers66,
+	HeadersByNumbersMsg:         handleHeadersByNumbers66,
+	HaveBlockMsg:                handleHaveBlock66,
+	HaveBlockReplyMsg:           handleHaveBlockReply66,
+	GetPendingEtxsByLocationMsg: handleGetPendingEtxsByLocation66,
+	PendingEtxsByLocationMsg:    handlePendingEtxsByLocation66,
+	GetBlockEtxRootsMsg:         handleGetBlockEtxRoots66,
+	BlockEtxRootsMsg:            handleBlockEtxRoots66,
+	GetFreshBlockBodiesMsg:      handleGetFreshBlockBodies66,
+	FreshBlockBodiesMsg:         handleFreshBlockBodies66,
+	GetBlockMinersMsg:           handleGetBlockMiners66,
+	BlockMinersMsg:              handleBlockMiners66,
+	GetUnclesByRangeMsg:         handleGetUnclesByRange66,
+	UnclesByRangeMsg:            handleUnclesByRange66,
+}
+
+// eth67 contains the handlers of the messages introduced in eth/67. The ones of
+// eth/66 are merged in on initialization.
+var eth67 = map[uint64]msgHandler{
+	GetBlockDataMsg:           handleGetBlockData66,
+	BlockDataMsg:              handleBlockData66,
+	GetBlockByNumberMsg:       handleGetBlockByNumber66,
+	BlockByNumberMsg:          handleBlockByNumber66,
+	StatusDeltaMsg:            handleStatusDelta,
+	GetEtxManifestProofMsg:    handleGetEtxManifestProof66,
+	EtxManifestProofMsg:       handleEtxManifestProof66,
+	GetCanonicalHashMsg:       handleGetCanonicalHash66,
+	CanonicalHashMsg:          handleCanonicalHash66,
+	GetPendingEtxsSinceMsg:    handleGetPendingEtxsSince66,
+	PendingEtxsSinceMsg:       handlePendingEtxsSince66,
+	GetPartialBodiesMsg:       handleGetPartialBodies66,
+	PartialBodiesMsg:          handlePartialBodies66,
+	GetEtxRollupsByRangeMsg:   handleGetEtxRollupsByRange66,
+	EtxRollupsByRangeMsg:      handleEtxRollupsByRange66,
+	GetPoolSnapshotMsg:        handleGetPoolSnapshot66,
+	PoolSnapshotMsg:           handlePoolSnapshot66,
+	GetHeadersByMinerMsg:      handleGetHeadersByMiner66,
+	HeadersByMinerMsg:         handleHeadersByMiner66,
+	GetTxNonInclusionProofMsg: handleGetTxNonInclusionProof66,
+	TxNonInclusionProofMsg:    handleTxNonInclusionProof66,
+	GetUnclePoolMsg:           handleGetUnclePool66,
+	UnclePoolMsg:              handleUnclePool66,
+}
+
+// experimental contains the handlers of the messages being prototyped in the
+// experimental code range. They are only dispatched for peers which opted in.
+var experimental = map[uint64]msgHandler{
+	CompactBlockBodiesMsg:             handleCompactBlockBodies66,
+	CompactPooledTransactionHashesMsg: handleCompactPooledTransactionHashes,
+	GetPooledTransactionHashesMsg:     handleGetPooledTransactionHashes66,
+	PooledTransactionHashesMsg:        handlePooledTransactionHashes66,
+}
+
+// supportedMessages is the sorted list of message codes handled for each protocol
+// version, advertised to peers querying our capabilities.
+var supportedMessages = make(map[uint][]uint64)
+
+func init() {
+	for code, handler := range eth66 {
+		if _, ok := eth67[code]; !ok {
+			eth67[code] = handler
+		}
+	}
+	for version, handlers := range map[uint]map[uint64]msgHandler{ETH65: eth65, ETH66: eth66, ETH67: eth67} {
+		codes := make([]uint64, 0, len(handlers))
+		for code := range handlers {
+			codes = append(codes, code)
+		}
+		sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+		supportedMessages[version] = codes
+	}
+}
+
+// MessageInfo describes a message handled by the `eth` protocol.
+type MessageInfo struct {
+	Code     uint64 // Message code on the wire
+	Name     string // Name of the message packet
+	Versions []uint // Protocol versions handling the message, ascending
+}
+
+// Messages returns the messages handled by the protocol dispatch tables, sorted
+// by message code.
+func Messages() []MessageInfo {
+	names := make(map[uint64]string)
+	for _, packet := range packets {
+		names[uint64(packet.Kind())] = packet.Name()
+	}
+	var (
+		infos []MessageInfo
+		index = make(map[uint64]int)
+	)
+	for _, version := range []uint{ETH65, ETH66, ETH67} {
+		for _, code := range supportedMessages[version] {
+			if i, ok := index[code]; ok {
+				infos[i].Versions = append(infos[i].Versions, version)
+				continue
+			}
+			index[code] = len(infos)
+			infos = append(infos, MessageInfo{Code: code, Name: names[code], Versions: []uint{version}})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Code < infos[j].Code })
+	return infos
+}
+
+// requestNames maps the codes of the data retrieval requests to their names.
+var requestNames = func() map[uint64]string {
+	names := make(map[uint64]string)
+	for _, packet := range packets {
+		if strings.HasPrefix(packet.Name(), "Get") {
+			names[uint64(packet.Kind())] = packet.Name()
+		}
+	}
+	return names
+}()
+
+// reportSlowServe warns about a data retrieval request if serving it took longer
+// than the configured threshold.
+func reportSlowServe(peer *Peer, name string, size uint32, start time.Time) {
+	elapsed := time.Since(start)
+	if elapsed <= peer.config.SlowServeThreshold {
+		return
+	}
+	slowServeMeter.Mark(1)
+	peer.Log().Warn("Slow request serving", "kind", name, "size", size, "peer", peer.ID(), "elapsed", common.PrettyDuration(elapsed))
 }
 
 // handleMessage is invoked whenever an inbound message is received from a remote
@@ -204,15 +439,83 @@ func handleMessage(backend Backend, peer *Peer) error {
 	if err != nil {
 		return err
 	}
-	if msg.Size > maxMessageSize {
-		return fmt.Errorf("%w: %v > %v", errMsgTooLarge, msg.Size, maxMessageSize)
+	if limit := peer.MaxMessageSize(); uint64(msg.Size) > limit {
+		return fmt.Errorf("%w: %v > %v", errMsgTooLarge, msg.Size, limit)
 	}
 	defer msg.Discard()
 
+	if r := activeRecorder(); r != nil {
+		if msg, err = r.record(peer.id, peer.Version(), false, msg); err != nil {
+			return err
+		}
+	}
+	if packetSubs.subscribed(msg.Code) {
+		if msg, err = packetSubs.observe(peer, msg); err != nil {
+			return err
+		}
+	}
+	return dispatchMessage(backend, peer, msg)
+}
+
+// runHandler runs the handler of a message, abandoning it if it overruns the
+// configured processing time limit.
+func runHandler(handler msgHandler, backend Backend, msg p2p.Msg, peer *Peer) error {
+	limit := peer.config.MaxProcessingTime
+	if limit <= 0 {
+		return handler(backend, serializedMsg{msg, activeSerializer()}, peer)
+	}
+	// Buffer the payload, so an abandoned handler doesn't race with the read loop
+	// discarding the message
+	payload, err := io.ReadAll(msg.Payload)
+	if err != nil {
+		return err
+	}
+	msg.Payload = bytes.NewReader(payload)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- handler(backend, serializedMsg{msg, activeSerializer()}, peer)
+	}()
+	timer := time.NewTimer(limit)
+	defer timer.Stop()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-timer.C:
+		processingTimeoutMeter.Mark(1)
+		peer.observe(PeerSignal{Type: PeerSignalServeTimeout, Code: msg.Code})
+		peer.Log().Warn("Message processing timed out", "code", msg.Code, "size", msg.Size, "peer", peer.ID(), "limit", limit)
+		return fmt.Errorf("%w: code %v after %v", errProcessingTimeout, msg.Code, limit)
+	}
+}
+
+// dispatchMessage runs the handler of a message received from the remote peer.
+// A status is only tolerated as the first message after the handshake, any other
+// one being rejected as an invalid message.
+func dispatchMessage(backend Backend, peer *Peer, msg p2p.Msg) error {
+	if peer.markReceived() && msg.Code == StatusMsg {
+		return handleDuplicateStatus(serializedMsg{msg, activeSerializer()}, peer)
+	}
+	if !peer.allowed(msg.Code) {
+		if peer.tolerateDisallowed() {
+			peer.Log().Debug("Discarding disallowed message", "code", msg.Code)
+			return nil
+		}
+		return fmt.Errorf("%w: %v", errDisallowedMsg, msg.Code)
+	}
 	var handlers = eth65
-	if peer.Version() >= ETH66 {
+	if peer.Version() >= ETH67 {
+		handlers = eth67
+	} else if peer.Version() >= ETH66 {
 		handlers = eth66
 	}
+	if isExperimental(msg.Code) {
+		if !peer.Experimental() {
+			return fmt.Errorf("%w: %v: %v", errInvalidMsgCode, msg.Code, errNotExperimental)
+		}
+		handlers = experimental
+	}
 	// Track the amount of time it takes to serve the request and run the handler
 	if metrics.Enabled {
 		h := fmt.Sprintf("%s/%s/%d/%#02x", p2p.HandleHistName, c_ProtocolName, peer.Version(), msg.Code)
@@ -226,7 +529,33 @@ func handleMessage(backend Backend, peer *Peer) error {
 		}(time.Now())
 	}
 	if handler := handlers[msg.Code]; handler != nil {
-		return handler(backend, msg, peer)
+		if name, ok := requestNames[msg.Code]; ok {
+			if peer.throttleAmplification(msg.Size) {
+				amplificationThrottleMeter.Mark(1)
+				peer.Log().Debug("Throttling amplifying data retrieval", "kind", name, "size", msg.Size)
+				return nil
+			}
+			if peer.config.PrioritizeServing {
+				_, _, entropy, _ := peer.Head()
+				defer serveQueue.acquire(entropy, peer.config.MaxConcurrentServes)()
+			}
+			defer reportSlowServe(peer, name, msg.Size, time.Now())
+		}
+		err := runHandler(handler, backend, msg, peer)
+		if isTruncated(err) {
+			// The rest of the stream can't be made sense of, drop the peer without
+			// holding the message against it
+			peer.observe(PeerSignal{Type: PeerSignalTruncated, Code: msg.Code})
+			return fmt.Errorf("%w: %v", errTruncatedMsg, err)
+		}
+		if errors.Is(err, errDecode) {
+			peer.observe(PeerSignal{Type: PeerSignalDecodeFailure, Code: msg.Code})
+		}
+		if errors.Is(err, errDecode) && peer.tolerateDecodeFailure() {
+			peer.Log().Debug("Tolerating undecodable message", "code", msg.Code, "err", err)
+			return nil
+		}
+		return err
 	}
 	return fmt.Errorf("%w: %v", errInvalidMsgCode, msg.Code)
 }
@@ -17,11 +17,15 @@
 package eth
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"sort"
+	"time"
 
 	"github.com/dominant-strategies/go-quai/common"
 	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/crypto"
 	"github.com/dominant-strategies/go-quai/log"
 	"github.com/dominant-strategies/go-quai/rlp"
 	"github.com/dominant-strategies/go-quai/trie"
@@ -32,9 +36,9 @@ func handleGetBlockHeaders(backend Backend, msg Decoder, peer *Peer) error {
 	// Decode the complex header query
 	var query GetBlockHeadersPacket
 	if err := msg.Decode(&query); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
-	response := answerGetBlockHeadersQuery(backend, &query, peer)
+	response := answerGetBlockHeadersQuery(backend.Core(), &query, peer.config.MaxHeaderSkip, peer)
 	return peer.SendBlockHeaders(response)
 }
 
@@ -43,13 +47,26 @@ func handleGetBlockHeaders66(backend Backend, msg Decoder, peer *Peer) error {
 	// Decode the complex header query
 	var query GetBlockHeadersPacket66
 	if err := msg.Decode(&query); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
-	response := answerGetBlockHeadersQuery(backend, query.GetBlockHeadersPacket, peer)
+	response := answerGetBlockHeadersQuery(backend.Core(), query.GetBlockHeadersPacket, peer.config.MaxHeaderSkip, peer)
 	return peer.ReplyBlockHeaders(query.RequestId, response)
 }
 
-func answerGetBlockHeadersQuery(backend Backend, query *GetBlockHeadersPacket, peer *Peer) []*types.Header {
+// answerGetBlockHeadersQuery gathers the headers matching a query, clamping its
+// skip to maxSkip unless zero.
+func answerGetBlockHeadersQuery(chain chainReader, query *GetBlockHeadersPacket, maxSkip uint64, peer *Peer) []*types.Header {
+	// Resolve a head-relative query to the current head, always walking down
+	if query.Origin.IsHead() {
+		query.Origin.Number = chain.CurrentHeader().NumberU64()
+		query.Reverse = true
+	}
+	// Clamp the skip. The To number is checked against every header visited, so
+	// the walk still stops at the first one reaching it
+	if maxSkip != 0 && query.Skip > maxSkip {
+		log.Debug("Clamping header retrieval skip", "skip", query.Skip, "max", maxSkip)
+		query.Skip = maxSkip
+	}
 	hashMode := query.Origin.Hash != (common.Hash{})
 	first := true
 	maxNonCanonical := uint64(100)
@@ -59,6 +76,7 @@ func answerGetBlockHeadersQuery(backend Backend, query *GetBlockHeadersPacket, p
 		bytes   common.StorageSize
 		headers []*types.Header
 		unknown bool
+		checked bool
 	)
 	for !unknown && len(headers) < int(query.Amount) && bytes < softResponseLimit &&
 		len(headers) < maxHeadersServe {
@@ -67,23 +85,31 @@ func answerGetBlockHeadersQuery(backend Backend, query *GetBlockHeadersPacket, p
 		if hashMode {
 			if first {
 				first = false
-				origin = backend.Core().GetHeaderOrCandidateByHash(query.Origin.Hash)
+				origin = chain.GetHeaderOrCandidateByHash(query.Origin.Hash)
 				if origin != nil {
 					query.Origin.Number = origin.NumberU64()
 				}
 			} else {
-				origin = backend.Core().GetHeaderOrCandidate(query.Origin.Hash, query.Origin.Number)
+				origin = chain.GetHeaderOrCandidate(query.Origin.Hash, query.Origin.Number)
 			}
 		} else {
-			origin = backend.Core().GetHeaderByNumber(query.Origin.Number)
+			origin = chain.GetHeaderByNumber(query.Origin.Number)
 		}
 		if origin == nil {
 			break
 		}
+		// Serve nothing if the To number lies behind the resolved origin
+		if !checked {
+			if err := query.checkStop(origin.NumberU64()); err != nil {
+				log.Debug("Refused contradictory header query", "origin", origin.NumberU64(), "to", query.To, "reverse", query.Reverse, "err", err)
+				return nil
+			}
+			checked = true
+		}
 
 		// If dom is true only append header to results array if it is a dominant header
 		if query.Dom {
-			if backend.Core().Engine().IsDomCoincident(backend.Core(), origin) {
+			if chain.Engine().IsDomCoincident(chain, origin) {
 				headers = append(headers, origin)
 				bytes += estHeaderSize
 			}
@@ -91,258 +117,1505 @@ func answerGetBlockHeadersQuery(backend Backend, query *GetBlockHeadersPacket, p
 			headers = append(headers, origin)
 			bytes += estHeaderSize
 			// If dom is false always append header to results array and break when dominant header is found
-			if backend.Core().Engine().IsDomCoincident(backend.Core(), origin) {
+			if chain.Engine().IsDomCoincident(chain, origin) {
 				break
 			}
 		}
 
 		// If the to number is reached stop the search
-		// By default the To is 0 and if its value is specified we need to stop
-		if query.To >= query.Origin.Number && query.Reverse {
+		if query.stopsAt(query.Origin.Number) {
 			break
 		}
 
 		// Advance to the next header of the query
 		switch {
 		case hashMode && query.Reverse:
-			query.Origin.Hash, query.Origin.Number = backend.Core().GetAncestor(query.Origin.Hash, query.Origin.Number, query.Skip, &maxNonCanonical)
+			query.Origin.Hash, query.Origin.Number = chain.GetAncestor(query.Origin.Hash, query.Origin.Number, query.Skip, &maxNonCanonical)
 			unknown = (query.Origin.Hash == common.Hash{})
 		case hashMode && !query.Reverse:
 			unknown = true
 		case query.Reverse:
+			unknown = query.Skip > query.Origin.Number
 			query.Origin.Number -= query.Skip
 		case !query.Reverse:
 			query.Origin.Number += query.Skip
 		}
 	}
 
-	return headers
+	return headers
+}
+
+// checkStop verifies that the To number of a header query resolved to the given
+// origin number lies in the direction of the walk: at or below the origin for
+// a falling query, at or above it for a rising one. A zero To sets no stop, so
+// it is never contradictory. Contradictory queries can't match any header and
+// are answered with an empty reply.
+func (query *GetBlockHeadersPacket) checkStop(origin uint64) error {
+	switch {
+	case query.To == 0:
+		return nil
+	case query.Reverse && query.To > origin:
+		return fmt.Errorf("%w: falling from #%d to #%d", errStopBehindOrigin, origin, query.To)
+	case !query.Reverse && query.To < origin:
+		return fmt.Errorf("%w: rising from #%d to #%d", errStopBehindOrigin, origin, query.To)
+	}
+	return nil
+}
+
+// stopsAt reports whether a header query walking through the given number has
+// reached its To number, after which no further headers are served.
+func (query *GetBlockHeadersPacket) stopsAt(number uint64) bool {
+	if query.Reverse {
+		return number <= query.To
+	}
+	return query.To != 0 && number >= query.To
+}
+
+func handleGetBlockEtxRoots66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the compact header query
+	var query GetBlockEtxRootsPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response := answerGetBlockEtxRootsQuery(backend.Core(), query.GetBlockEtxRootsPacket, peer.config.MaxHeaderSkip, peer)
+	return peer.ReplyBlockEtxRoots(query.RequestId, response)
+}
+
+// answerGetBlockEtxRootsQuery resolves a header query the same way as a full
+// header retrieval, but only returns the ETX root of each matching block.
+func answerGetBlockEtxRootsQuery(chain chainReader, query *GetBlockEtxRootsPacket, maxSkip uint64, peer *Peer) BlockEtxRootsPacket {
+	headers := answerGetBlockHeadersQuery(chain, (*GetBlockHeadersPacket)(query), maxSkip, peer)
+
+	roots := make(BlockEtxRootsPacket, len(headers))
+	for i, header := range headers {
+		roots[i] = BlockEtxRoot{
+			Number:  header.NumberU64(),
+			Hash:    header.Hash(),
+			EtxRoot: header.EtxHash(),
+		}
+	}
+	return roots
+}
+
+func handleGetBlockMiners66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the block miner query
+	var query GetBlockMinersPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response := answerGetBlockMinersQuery(backend.Core(), query.GetBlockMinersPacket, peer)
+	return peer.ReplyBlockMiners(query.RequestId, response)
+}
+
+// answerGetBlockMinersQuery walks the requested range of canonical blocks the
+// same way as a rising header retrieval, but only returns the miner of each
+// matching block. An origin hash is only accepted if it's canonical.
+func answerGetBlockMinersQuery(chain chainReader, query GetBlockMinersPacket, peer *Peer) BlockMinersPacket {
+	headers := canonicalRangeHeaders(chain, query.Origin, query.Amount, query.Dom, peer)
+
+	miners := make(BlockMinersPacket, len(headers))
+	for i, header := range headers {
+		miners[i] = BlockMiner{
+			Number: header.NumberU64(),
+			Miner:  header.Coinbase(),
+		}
+	}
+	return miners
+}
+
+// canonicalRangeHeaders retrieves the headers of a range of canonical blocks the
+// same way as a rising header retrieval. An origin hash is only accepted if it's
+// canonical.
+func canonicalRangeHeaders(chain chainReader, from HashOrNumber, amount uint64, dom bool, peer *Peer) []*types.Header {
+	origin := from.Number
+	if from.Hash != (common.Hash{}) {
+		header := chain.GetHeaderByHash(from.Hash)
+		if header == nil {
+			return nil
+		}
+		if canon := chain.GetHeaderByNumber(header.NumberU64()); canon == nil || canon.Hash() != header.Hash() {
+			return nil
+		}
+		origin = header.NumberU64()
+	}
+	return answerGetBlockHeadersQuery(chain, &GetBlockHeadersPacket{
+		Origin: HashOrNumber{Number: origin},
+		Amount: amount,
+		Dom:    dom,
+		Skip:   1,
+	}, 0, peer)
+}
+
+func handleGetUnclesByRange66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the uncle range query
+	var query GetUnclesByRangePacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response := answerGetUnclesByRangeQuery(backend.Core(), query.GetUnclesByRangePacket, peer)
+	return peer.ReplyUnclesByRangeRLP(query.RequestId, response)
+}
+
+// answerGetUnclesByRangeQuery walks the requested range of canonical blocks the
+// same way as a block miner retrieval, returning the uncle section of the body
+// of each matching block. The range is cut short at the first block whose body
+// is unavailable, or once the reply reaches softResponseLimit, which keeps it
+// well within the message size limit of any connection.
+func answerGetUnclesByRangeQuery(chain chainReader, query GetUnclesByRangePacket, peer *Peer) UnclesByRangeRLPPacket {
+	var (
+		bytes  int
+		uncles UnclesByRangeRLPPacket
+	)
+	for _, header := range canonicalRangeHeaders(chain, query.Origin, query.Amount, query.Dom, peer) {
+		if bytes >= softResponseLimit {
+			break
+		}
+		body := chain.GetBodyRLP(header.Hash())
+		if len(body) == 0 {
+			break
+		}
+		// The uncles are the second field of the body, skip over the transactions
+		content, _, err := rlp.SplitList(body)
+		if err != nil {
+			break
+		}
+		_, _, rest, err := rlp.Split(content)
+		if err != nil {
+			break
+		}
+		_, _, tail, err := rlp.Split(rest)
+		if err != nil {
+			break
+		}
+		section := rest[:len(rest)-len(tail)]
+
+		uncles = append(uncles, BlockUnclesRLP{Number: header.NumberU64(), Uncles: section})
+		bytes += len(section)
+	}
+	return uncles
+}
+
+func handleGetBlockData66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the block data query
+	var query GetBlockDataPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response := answerGetBlockDataQuery(backend.Core(), query.GetBlockDataPacket, peer)
+	return peer.ReplyBlockDataRLP(query.RequestId, response)
+}
+
+// answerGetBlockDataQuery walks the requested range of canonical blocks the same
+// way as a block miner retrieval, returning the header and the body of each
+// matching block. The range is cut short at the first block whose body is
+// unavailable, or once the reply reaches softResponseLimit, so the headers and
+// the bodies always pair up.
+func answerGetBlockDataQuery(chain chainReader, query GetBlockDataPacket, peer *Peer) BlockDataRLPPacket {
+	var (
+		bytes int
+		data  BlockDataRLPPacket
+	)
+	for _, header := range canonicalRangeHeaders(chain, query.Origin, query.Amount, query.Dom, peer) {
+		if bytes >= softResponseLimit {
+			break
+		}
+		body := chain.GetBodyRLP(header.Hash())
+		if len(body) == 0 {
+			break
+		}
+		data.Headers = append(data.Headers, header)
+		data.Bodies = append(data.Bodies, body)
+		bytes += estHeaderSize + len(body)
+	}
+	return data
+}
+
+func handleGetHeadersByNumbers66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the discrete header query
+	var query GetHeadersByNumbersPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response, err := answerGetHeadersByNumbersQuery(backend.Core(), query.GetHeadersByNumbersPacket)
+	if err != nil {
+		return err
+	}
+	return peer.ReplyHeadersByNumbers(query.RequestId, response)
+}
+
+// answerGetHeadersByNumbersQuery retrieves the canonical headers at the requested
+// numbers, skipping the ones not known locally. Queries exceeding the serving
+// limit or not in strictly ascending order are rejected.
+func answerGetHeadersByNumbersQuery(chain chainReader, query GetHeadersByNumbersPacket) ([]*types.Header, error) {
+	if len(query) > maxHeadersServe {
+		return nil, fmt.Errorf("%w: %d headers requested, limit %d", errInvalidQuery, len(query), maxHeadersServe)
+	}
+	for i := 1; i < len(query); i++ {
+		if query[i] <= query[i-1] {
+			return nil, fmt.Errorf("%w: number %d at index %d not ascending", errInvalidQuery, query[i], i)
+		}
+	}
+	var (
+		bytes   common.StorageSize
+		headers []*types.Header
+	)
+	for _, number := range query {
+		if bytes >= softResponseLimit {
+			break
+		}
+		if header := chain.GetHeaderByNumber(number); header != nil {
+			headers = append(headers, header)
+			bytes += estHeaderSize
+		}
+	}
+	return headers, nil
+}
+
+func handleHaveBlock66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the block availability probe
+	var query HaveBlockPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	have := answerHaveBlockQuery(backend.Core(), query.HaveBlockPacket)
+	return peer.ReplyHaveBlock(query.RequestId, query.Hash, have)
+}
+
+// answerHaveBlockQuery reports whether both the header and the body of the
+// probed block are available locally, i.e. whether a GetBlock would succeed.
+func answerHaveBlockQuery(chain chainReader, query HaveBlockPacket) bool {
+	if chain.GetHeaderOrCandidateByHash(query.Hash) == nil {
+		return false
+	}
+	return len(chain.GetBodyRLP(query.Hash)) != 0
+}
+
+func handleGetPendingEtxsByLocation66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the pending etxs retrieval message
+	var query GetPendingEtxsByLocationPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response, err := answerGetPendingEtxsByLocationQuery(backend.Core(), query.GetPendingEtxsByLocationPacket)
+	if err != nil {
+		return err
+	}
+	return peer.ReplyPendingEtxsByLocation(query.RequestId, response)
+}
+
+// answerGetPendingEtxsByLocationQuery retrieves a page of the ETXs pending
+// inclusion at the current head, ordered by hash and starting after the query
+// cursor. Only the location run by this node can be served, as the pending set
+// is only tracked for the local chain, other locations are answered with an
+// empty page. ETXs entering the set behind the cursor while paging are only
+// picked up by a subsequent full retrieval.
+func answerGetPendingEtxsByLocationQuery(chain chainReader, query GetPendingEtxsByLocationPacket) (*PendingEtxsByLocationPacket, error) {
+	if err := validateLocation(query.Location); err != nil {
+		return nil, err
+	}
+	if !query.Location.Equal(common.NodeLocation) {
+		return new(PendingEtxsByLocationPacket), nil
+	}
+	head := chain.CurrentHeader()
+	set := chain.GetEtxSet(head.Hash(), head.NumberU64())
+
+	etxs, cursor := pagePendingEtxs(set, query.Cursor, 0)
+	return &PendingEtxsByLocationPacket{Etxs: etxs, Cursor: cursor}, nil
+}
+
+// pagePendingEtxs retrieves a page of the ETXs of a pending set which entered it
+// at or above the given height, ordered by hash and starting after the cursor.
+// The cursor of the next page is returned, zero if there are no more ETXs.
+func pagePendingEtxs(set types.EtxSet, cursor common.Hash, from uint64) (types.Transactions, common.Hash) {
+	hashes := make([]common.Hash, 0, len(set))
+	for hash, entry := range set {
+		if entry.Height >= from && bytes.Compare(hash[:], cursor[:]) > 0 {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i][:], hashes[j][:]) < 0 })
+
+	var (
+		size common.StorageSize
+		etxs types.Transactions
+	)
+	for i, hash := range hashes {
+		if i >= maxPendingEtxsServe || size >= softResponseLimit {
+			return etxs, hashes[i-1]
+		}
+		etx := set[hash].ETX
+		etxs = append(etxs, &etx)
+		size += etx.Size()
+	}
+	return etxs, common.Hash{}
+}
+
+func handleGetPendingEtxsSince66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the pending etxs retrieval message
+	var query GetPendingEtxsSincePacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response, err := answerGetPendingEtxsSinceQuery(backend.Core(), query.GetPendingEtxsSincePacket)
+	if err != nil {
+		return err
+	}
+	return peer.ReplyPendingEtxsSince(query.RequestId, response)
+}
+
+// answerGetPendingEtxsSinceQuery retrieves a page of the ETXs pending inclusion
+// at the current head which entered the pending set after the requested block,
+// paged like answerGetPendingEtxsByLocationQuery. ETXs created after a block not
+// on the local canonical chain can't be told apart, so the whole set is served.
+func answerGetPendingEtxsSinceQuery(chain chainReader, query GetPendingEtxsSincePacket) (*PendingEtxsSincePacket, error) {
+	if err := validateLocation(query.Location); err != nil {
+		return nil, err
+	}
+	if !query.Location.Equal(common.NodeLocation) {
+		return new(PendingEtxsSincePacket), nil
+	}
+	head := chain.CurrentHeader()
+	set := chain.GetEtxSet(head.Hash(), head.NumberU64())
+
+	var from uint64
+	if query.Since != (common.Hash{}) {
+		if since := chain.GetHeaderByHash(query.Since); since != nil {
+			if canon := chain.GetHeaderByNumber(since.NumberU64()); canon != nil && canon.Hash() == query.Since {
+				from = since.NumberU64() + 1
+			}
+		}
+	}
+	etxs, cursor := pagePendingEtxs(set, query.Cursor, from)
+	return &PendingEtxsSincePacket{Etxs: etxs, Cursor: cursor}, nil
+}
+
+func handleGetBlockBodies(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the block body retrieval message
+	var query GetBlockBodiesPacket
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response, err := answerGetBlockBodiesQuery(backend.Core(), query, peer.config.BodiesResponsePolicy)
+	if err != nil {
+		peer.Log().Debug("Rejected block bodies request", "err", err)
+	}
+	return peer.SendBlockBodiesRLP(response)
+}
+
+func handleGetBlockBodies66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the block body retrieval message
+	var query GetBlockBodiesPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response, err := answerGetBlockBodiesQuery(backend.Core(), query.GetBlockBodiesPacket, peer.config.BodiesResponsePolicy)
+	if err != nil {
+		peer.Log().Debug("Rejected block bodies request", "err", err)
+	}
+	// Peers prototyping the compact encoding get the ETXs deduplicated, unless
+	// the bodies can't be compacted
+	if peer.Experimental() {
+		compact, err := newCompactBlockBodies(response)
+		if err == nil {
+			return peer.ReplyCompactBlockBodies(query.RequestId, compact)
+		}
+		peer.Log().Trace("Failed to compact block bodies", "err", err)
+	}
+	return peer.ReplyBlockBodiesRLP(query.RequestId, response)
+}
+
+// answerGetBlockBodiesQuery gathers the requested block bodies until the fetch
+// or network limits are reached. If the request does not fit within the limits
+// and the policy rejects over-limit requests, an error is returned instead of a
+// truncated list.
+func answerGetBlockBodiesQuery(chain chainReader, query GetBlockBodiesPacket, policy ResponsePolicy) ([]rlp.RawValue, error) {
+	// Gather blocks until the fetch or network limits is reached. Repeated hashes
+	// are only read from disk once, but still answered at each of their positions.
+	var (
+		bytes  int
+		bodies []rlp.RawValue
+		read   = make(map[common.Hash]rlp.RawValue)
+	)
+	for i, hash := range query {
+		if bytes >= softResponseLimit || len(bodies) >= maxBodiesServe {
+			if policy == RejectResponse {
+				return nil, fmt.Errorf("%w: only %d of %d bodies fit", errResponseTooLarge, i, len(query))
+			}
+			break
+		}
+		data, ok := read[hash]
+		if !ok {
+			data = chain.GetBodyRLP(hash)
+			read[hash] = data
+		}
+		if len(data) != 0 {
+			bodies = append(bodies, data)
+			bytes += len(data)
+		}
+	}
+	return bodies, nil
+}
+
+func handleGetFreshBlockBodies66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the head anchored block body retrieval message
+	var query GetFreshBlockBodiesPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response, err := answerGetFreshBlockBodiesQuery(backend.Core(), query.GetFreshBlockBodiesPacket, peer.config.BodiesResponsePolicy)
+	if errors.Is(err, errInvalidQuery) {
+		return err
+	}
+	if err != nil {
+		peer.Log().Debug("Rejected fresh block bodies request", "err", err)
+	}
+	return peer.ReplyFreshBlockBodiesRLP(query.RequestId, response)
+}
+
+// answerGetFreshBlockBodiesQuery gathers the requested block bodies like a plain
+// body retrieval, but skips the blocks known to have been reorged out of the
+// chain leading to the requester's head, reporting them as stale instead. The
+// check is only possible if the requester's head is canonical locally, otherwise
+// all bodies are served. Queries exceeding the serving limit are rejected.
+func answerGetFreshBlockBodiesQuery(chain chainReader, query GetFreshBlockBodiesPacket, policy ResponsePolicy) (FreshBlockBodiesRLPPacket, error) {
+	if len(query.Hashes) > maxBodiesServe {
+		return FreshBlockBodiesRLPPacket{}, fmt.Errorf("%w: %d bodies requested, limit %d", errInvalidQuery, len(query.Hashes), maxBodiesServe)
+	}
+	head := chain.GetHeaderByNumber(query.Number)
+	anchored := head != nil && head.Hash() == query.Head
+
+	var (
+		fresh    = make(GetBlockBodiesPacket, 0, len(query.Hashes))
+		response FreshBlockBodiesRLPPacket
+	)
+	for _, hash := range query.Hashes {
+		if anchored && isStaleBlock(chain, hash, query.Number) {
+			response.Stale = append(response.Stale, hash)
+			continue
+		}
+		fresh = append(fresh, hash)
+	}
+	bodies, err := answerGetBlockBodiesQuery(chain, fresh, policy)
+	response.Bodies = bodies
+	return response, err
+}
+
+// isStaleBlock reports whether a known block at or below the given canonical
+// head number is not part of the canonical chain, i.e. was reorged out.
+func isStaleBlock(chain chainReader, hash common.Hash, head uint64) bool {
+	header := chain.GetHeaderOrCandidateByHash(hash)
+	if header == nil || header.NumberU64() > head {
+		return false
+	}
+	canon := chain.GetHeaderByNumber(header.NumberU64())
+	return canon == nil || canon.Hash() != hash
+}
+
+func handleGetPartialBodies66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the partial block body retrieval message
+	var query GetPartialBodiesPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response, err := answerGetPartialBodiesQuery(backend.Core(), query.GetPartialBodiesPacket, peer.config.BodiesResponsePolicy)
+	if errors.Is(err, errInvalidQuery) {
+		return err
+	}
+	if err != nil {
+		peer.Log().Debug("Rejected partial block bodies request", "err", err)
+	}
+	return peer.ReplyPartialBodies(query.RequestId, response)
+}
+
+func handleGetEtxRollupsByRange66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the rollup range query
+	var query GetEtxRollupsByRangePacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response, err := answerGetEtxRollupsByRangeQuery(backend.Core(), query.GetEtxRollupsByRangePacket, peer)
+	if err != nil {
+		return err
+	}
+	return peer.ReplyEtxRollupsByRange(query.RequestId, response)
+}
+
+func handleGetPoolSnapshot66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the pool snapshot query
+	var query GetPoolSnapshotPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	var response PoolSnapshotPacket
+	if servesPoolSnapshots(backend) {
+		hashes, err := answerGetPoolSnapshotQuery(backend.Core(), query.GetPoolSnapshotPacket)
+		if err != nil {
+			return err
+		}
+		response.Hashes = hashes
+	} else {
+		response.Refused = true
+	}
+	return peer.ReplyPoolSnapshot(query.RequestId, response)
+}
+
+func handleGetHeadersByMiner66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the miner filtered header query
+	var query GetHeadersByMinerPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response, err := answerGetHeadersByMinerQuery(backend.Core(), query.GetHeadersByMinerPacket, peer)
+	if err != nil {
+		return err
+	}
+	return peer.ReplyHeadersByMiner(query.RequestId, response)
+}
+
+func handleGetTxNonInclusionProof66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the transaction non-inclusion proof query
+	var query GetTxNonInclusionProofPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response := answerGetTxNonInclusionProofQuery(backend.Core(), query.GetTxNonInclusionProofPacket)
+	return peer.ReplyTxNonInclusionProof(query.RequestId, response)
+}
+
+func handleGetUnclePool66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the uncle pool query
+	var query GetUnclePoolPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response, err := answerGetUnclePoolQuery(backend.Core(), query.GetUnclePoolPacket)
+	if err != nil {
+		return err
+	}
+	return peer.ReplyUnclePool(query.RequestId, response)
+}
+
+func handleGetBlockTxHashes66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the transaction hashes retrieval message
+	var query GetBlockTxHashesPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response := answerGetBlockTxHashesQuery(backend.Core(), query.GetBlockTxHashesPacket)
+	return peer.ReplyBlockTxHashes(query.RequestId, response)
+}
+
+// answerGetBlockTxHashesQuery collects the ordered transaction hashes of the
+// requested block. Unknown blocks are answered with an empty list.
+func answerGetBlockTxHashesQuery(chain chainReader, query GetBlockTxHashesPacket) []common.Hash {
+	body := chain.GetBodyRLP(query.Hash)
+	if len(body) == 0 {
+		return []common.Hash{}
+	}
+	hashes, err := txHashesFromBodyRLP(body)
+	if err != nil {
+		log.Error("Failed to extract transaction hashes from body", "hash", query.Hash, "err", err)
+		return []common.Hash{}
+	}
+	return hashes
+}
+
+// txHashesFromBodyRLP walks the transaction list of an RLP encoded block body
+// and hashes each transaction envelope in place, avoiding decoding the full
+// transactions.
+func txHashesFromBodyRLP(body rlp.RawValue) ([]common.Hash, error) {
+	fields, _, err := rlp.SplitList(body)
+	if err != nil {
+		return nil, err
+	}
+	txs, _, err := rlp.SplitList(fields)
+	if err != nil {
+		return nil, err
+	}
+	count, err := rlp.CountValues(txs)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]common.Hash, 0, count)
+	for len(txs) > 0 {
+		var enc []byte
+		if enc, txs, err = rlp.SplitString(txs); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, crypto.Keccak256Hash(enc))
+	}
+	return hashes, nil
+}
+
+func handleGetHead66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the head retrieval message
+	var query GetHeadPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response, err := answerGetHeadQuery(backend.Core(), query.GetHeadPacket)
+	if err != nil {
+		return err
+	}
+	return peer.ReplyHead(query.RequestId, response)
+}
+
+// answerGetHeadQuery retrieves the current head of the requested chain. Only the
+// chain run by this node can be served, other locations are answered without a
+// head.
+func answerGetHeadQuery(chain chainReader, query GetHeadPacket) (*HeadPacket, error) {
+	if err := validateLocation(query.Location); err != nil {
+		return nil, err
+	}
+	if !query.Location.Equal(common.NodeLocation) {
+		return new(HeadPacket), nil
+	}
+	head := chain.CurrentHeader()
+	return &HeadPacket{
+		Hash:    head.Hash(),
+		Number:  head.NumberU64(),
+		Entropy: chain.Engine().TotalLogS(head),
+	}, nil
+}
+
+func handleGetBlockByNumber66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the block retrieval message
+	var query GetBlockByNumberPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response, err := answerGetBlockByNumberQuery(backend.Core(), query.GetBlockByNumberPacket)
+	if err != nil {
+		return err
+	}
+	return peer.ReplyBlockByNumber(query.RequestId, response)
+}
+
+// answerGetBlockByNumberQuery retrieves the canonical block at the requested
+// number. Only the chain run by this node can be served, other locations and
+// unknown blocks are answered without one.
+func answerGetBlockByNumberQuery(chain chainReader, query GetBlockByNumberPacket) (*BlockByNumberPacket, error) {
+	if err := validateLocation(query.Location); err != nil {
+		return nil, err
+	}
+	if !query.Location.Equal(common.NodeLocation) {
+		return new(BlockByNumberPacket), nil
+	}
+	header := chain.GetHeaderByNumber(query.Number)
+	if header == nil {
+		return new(BlockByNumberPacket), nil
+	}
+	blob := chain.GetBodyRLP(header.Hash())
+	if len(blob) == 0 {
+		return new(BlockByNumberPacket), nil
+	}
+	body := new(BlockBody)
+	if err := rlp.DecodeBytes(blob, body); err != nil {
+		log.Error("Failed to decode stored block body", "hash", header.Hash(), "err", err)
+		return new(BlockByNumberPacket), nil
+	}
+	block := types.NewBlockWithHeader(header).WithBody(body.Transactions, body.Uncles, body.ExtTransactions, body.SubManifest)
+	return &BlockByNumberPacket{Block: block}, nil
+}
+
+func handleGetCanonicalHash66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the canonical hash retrieval message
+	var query GetCanonicalHashPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response, err := answerGetCanonicalHashQuery(backend.Core(), query.GetCanonicalHashPacket)
+	if err != nil {
+		return err
+	}
+	return peer.ReplyCanonicalHash(query.RequestId, response)
+}
+
+// answerGetCanonicalHashQuery retrieves the hash of the canonical block at the
+// requested number. Only the chain run by this node can be served, other
+// locations and numbers beyond the head are answered with an empty hash.
+func answerGetCanonicalHashQuery(chain chainReader, query GetCanonicalHashPacket) (*CanonicalHashPacket, error) {
+	if err := validateLocation(query.Location); err != nil {
+		return nil, err
+	}
+	if !query.Location.Equal(common.NodeLocation) {
+		return new(CanonicalHashPacket), nil
+	}
+	header := chain.GetHeaderByNumber(query.Number)
+	if header == nil {
+		return new(CanonicalHashPacket), nil
+	}
+	return &CanonicalHashPacket{Hash: header.Hash()}, nil
+}
+
+func handleGetCapabilities66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the capabilities retrieval message
+	var query GetCapabilitiesPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	response := backend.Capabilities()
+	response.Messages = supportedMessages[peer.version]
+	return peer.ReplyCapabilities(query.RequestId, &response)
+}
+
+// validateLocation checks that a location received from the network addresses
+// an existing chain within the Quai hierarchy.
+func validateLocation(loc common.Location) error {
+	switch {
+	case len(loc) > common.HierarchyDepth-1:
+		return fmt.Errorf("%w: %v too deep", errInvalidLocation, loc)
+	case loc.HasRegion() && loc.Region() >= common.NumRegionsInPrime:
+		return fmt.Errorf("%w: region %d out of range", errInvalidLocation, loc.Region())
+	case loc.HasZone() && loc.Zone() >= common.NumZonesInRegion:
+		return fmt.Errorf("%w: zone %d out of range", errInvalidLocation, loc.Zone())
+	}
+	return nil
+}
+
+func handleGetBlock(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the block retrieval message
+	var query GetBlockPacket
+	if err := msg.Decode(&query); err != nil {
+		fmt.Println("Error decoding the message", err)
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	log.Info("Got a block fetch request eth/65: ", "Hash", query.Hash)
+	// check if we have the requested block in the database.
+	response := backend.Core().GetBlockOrCandidateByHash(query.Hash)
+	if response != nil {
+		return peer.SendNewBlock(response)
+	}
+	return nil
+}
+
+func handleGetBlock66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the block retrieval message
+	var query GetBlockPacket66
+	if err := msg.Decode(&query); err != nil {
+		fmt.Println("Error decoding the message", err)
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	log.Debug("Got a block fetch request eth/66: ", "Hash", query.Hash)
+	// check if we have the requested block in the database.
+	response := backend.Core().GetBlockOrCandidateByHash(query.Hash)
+	if response != nil {
+		return peer.SendNewBlock(response)
+	}
+	return nil
+}
+
+func handlePendingEtxs(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the block pending etxs retrieval message
+	ann := new(PendingEtxsPacket)
+	if err := msg.Decode(&ann); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	// Mark the hashes as present at the remote node
+	peer.markPendingEtxs(ann.PendingEtxs.Header.Hash())
+
+	return backend.Handle(peer, ann)
+}
+
+func handlePendingEtxsRollup(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the block pending etxs rollup retrieval message
+	ann := new(PendingEtxsRollupPacket)
+	if err := msg.Decode(&ann); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	// The manifest order is committed to by the header's manifest hash, so any
+	// reordered or tampered manifest is rejected before reaching the backend
+	if !ann.PendingEtxsRollup.IsValid(trie.NewStackTrie(nil)) {
+		return fmt.Errorf("%w: manifest does not match header", errInvalidRollup)
+	}
+	return backend.Handle(peer, ann)
+}
+
+func handleGetOnePendingEtxs66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the block pending etxs retrieval message
+	var query GetOnePendingEtxsPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	pendingEtxs := backend.Core().GetPendingEtxs(query.Hash)
+	if pendingEtxs == nil {
+		log.Debug("Couldn't complete a pendingEtxs request for", "Hash", query.Hash)
+		return nil
+	}
+	log.Trace("Completing  a pendingEtxs request for", "Hash", pendingEtxs.Header.Hash())
+	return peer.SendPendingEtxs(*pendingEtxs)
+}
+
+func handleGetOnePendingEtxsRollup66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the block pending etxs rollup retrieval message
+	var query GetOnePendingEtxsRollupPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	pendingEtxs := backend.Core().GetPendingEtxsRollup(query.Hash)
+	if pendingEtxs == nil {
+		log.Debug("Couldn't complete a pendingEtxs request for", "Hash", query.Hash)
+		return nil
+	}
+	log.Trace("Completing  a pendingEtxs request for", "Hash", pendingEtxs.Header.Hash())
+	return peer.SendPendingEtxsRollup(*pendingEtxs)
+}
+
+func handleNewBlockhashes(backend Backend, msg Decoder, peer *Peer) error {
+	// A batch of new block announcements just arrived
+	ann := new(NewBlockHashesPacket)
+	if err := msg.Decode(ann); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	// Mark the hashes as present at the remote node
+	for _, block := range *ann {
+		peer.markBlock(block.Hash)
+	}
+	// Deliver them all to the backend for queuing
+	return backend.Handle(peer, ann)
+}
+
+func handleNewBlock(backend Backend, msg Decoder, peer *Peer) error {
+	nodeCtx := common.NodeLocation.Context()
+	// Retrieve and decode the propagated block
+	ann := new(NewBlockPacket)
+	if err := msg.Decode(ann); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	if ann.Block == nil {
+		return fmt.Errorf("%w: message %v: no block", errDecode, msg)
+	}
+	if err := ann.sanityCheck(); err != nil {
+		return err
+	}
+	if err := checkBlockTime(ann.Block, time.Now(), peer.config.MaxBlockTimeDrift); err != nil {
+		return err
+	}
+	// Once synced, reject blocks implausibly far ahead of our head so they can't
+	// be used to trigger expensive sync attempts. Nodes still catching up rely
+	// on such announcements and skip the check.
+	if backend.AcceptTxs() {
+		if err := checkAnnounceDistance(backend.Core(), ann.Block, peer.config.MaxAnnounceDistance); err != nil {
+			return err
+		}
+	}
+	// Making sure that the region and prime chains have zero txs and etxs in them
+	if nodeCtx == common.ZONE_CTX {
+		if hash := types.CalcUncleHash(ann.Block.Uncles()); hash != ann.Block.UncleHash() {
+			log.Warn("Propagated block has invalid uncles", "have", hash, "exp", ann.Block.UncleHash())
+			return nil // TODO: return error eventually, but wait a few releases
+		}
+		if hash := types.DeriveSha(ann.Block.Transactions(), trie.NewStackTrie(nil)); hash != ann.Block.TxHash() {
+			log.Warn("Propagated block has invalid transaction", "have", hash, "exp", ann.Block.TxHash())
+			return nil // TODO: return error eventually, but wait a few releases
+		}
+		if hash := types.DeriveSha(ann.Block.ExtTransactions(), trie.NewStackTrie(nil)); hash != ann.Block.EtxHash() {
+			log.Warn("Propagated block has invalid external transaction", "have", hash, "exp", ann.Block.EtxHash())
+			return nil // TODO: return error eventually, but wait a few releases
+		}
+	} else {
+		if len(ann.Block.Transactions()) != 0 {
+			log.Warn("Propagated block has transactions in the body", "len", len(ann.Block.Transactions()))
+		}
+		if len(ann.Block.ExtTransactions()) != 0 {
+			log.Warn("Propagated block has ext transactions in the body", "len", len(ann.Block.ExtTransactions()))
+		}
+		if len(ann.Block.Uncles()) != 0 {
+			log.Warn("Propagated block has uncles in the body", "len", len(ann.Block.Uncles()))
+		}
+		// Dom nodes need to validate the subordinate manifest against the subordinate's manifesthash
+		if hash := types.DeriveSha(ann.Block.SubManifest(), trie.NewStackTrie(nil)); hash != ann.Block.ManifestHash(nodeCtx+1) {
+			log.Warn("Propagated block has invalid subordinate manifest", "peer", peer.id, "block hash", ann.Block.Hash(), "have", hash, "exp", ann.Block.ManifestHash())
+			return nil
+		}
+		if err := verifySubManifest(backend.Core(), ann.Block.SubManifest(), ann.Block.ParentHash(nodeCtx), nodeCtx+1); err != nil {
+			return err
+		}
+	}
+	ann.Block.ReceivedAt = msg.Time()
+	ann.Block.ReceivedFrom = peer
+
+	// Mark the peer as owning the block
+	peer.markBlock(ann.Block.Hash())
+
+	return backend.Handle(peer, ann)
+}
+
+// verifySubManifest checks that a subordinate manifest lists the subordinate blocks
+// since the last coordinate block in chain order. The first entry must be the
+// parent coordinate block itself, as it's coincident with the subordinate chain,
+// and no entry may repeat. The entries whose header is known locally must also
+// link to the preceding entry in the subordinate context.
+func verifySubManifest(chain chainReader, manifest types.BlockManifest, parent common.Hash, subCtx int) error {
+	if len(manifest) == 0 {
+		return fmt.Errorf("%w: empty", errInvalidManifest)
+	}
+	if manifest[0] != parent {
+		return fmt.Errorf("%w: first entry %x is not the parent coordinate %x", errInvalidManifest, manifest[0], parent)
+	}
+	seen := make(map[common.Hash]int, len(manifest))
+	for i, hash := range manifest {
+		if j, ok := seen[hash]; ok {
+			return fmt.Errorf("%w: entry %d repeats entry %d (%x)", errInvalidManifest, i, j, hash)
+		}
+		seen[hash] = i
+
+		if i == 0 {
+			continue
+		}
+		if header := chain.GetHeaderOrCandidateByHash(hash); header != nil && header.ParentHash(subCtx) != manifest[i-1] {
+			return fmt.Errorf("%w: entry %d (%x) has parent %x, want entry %d (%x)", errInvalidManifest, i, hash, header.ParentHash(subCtx), i-1, manifest[i-1])
+		}
+	}
+	return nil
+}
+
+// checkAnnounceDistance verifies that a propagated block is not further ahead of
+// the local head than the given distance.
+func checkAnnounceDistance(chain chainReader, block *types.Block, distance uint64) error {
+	head := chain.CurrentHeader().NumberU64()
+	if number := block.NumberU64(); number > head+distance {
+		return fmt.Errorf("%w: number %d, head %d", errFutureBlock, number, head)
+	}
+	return nil
+}
+
+func handleBlockHeaders(backend Backend, msg Decoder, peer *Peer) error {
+	// A batch of headers arrived to one of our previous requests
+	res := new(BlockHeadersPacket)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	return backend.Handle(peer, res)
+}
+
+// decodeReply66 decodes an eth/66 reply into res, the request id wrapper of the
+// reply packet, given as well as the id and packet fields of the wrapper.
+//
+// Due to an interop bug, some peers reply without the request id wrapper on eth/66
+// connections. Such replies are detected by their RLP structure, lacking a leading
+// integer next to the packet, and are decoded bare. The id of the oldest request
+// pending towards the peer for the same reply is assumed, since replies to these
+// peers arrive in request order.
+func decodeReply66(msg Decoder, peer *Peer, code uint64, res interface{}, id *uint64, packet interface{}) error {
+	var raw rlp.RawValue
+	if err := msg.Decode(&raw); err != nil {
+		return err
+	}
+	if tagged(raw) {
+		return rlp.DecodeBytes(raw, res)
+	}
+	if err := rlp.DecodeBytes(raw, packet); err != nil {
+		return err
+	}
+	untaggedReplyMeter.Mark(1)
+	if peer.markUntagged() {
+		peer.Log().Warn("Peer replies without request ids, correlating by order", "code", code)
+	}
+	// If there's no pending request, leave the id zero for the tracker to reject
+	*id, _ = requestTracker.Oldest(peer.id, peer.version, code)
+	return nil
+}
+
+// tagged reports whether an eth/66 message payload has the shape of a request id
+// wrapper: a list of an integer and the packet.
+func tagged(payload []byte) bool {
+	content, _, err := rlp.SplitList(payload)
+	if err != nil {
+		return false
+	}
+	kind, value, rest, err := rlp.Split(content)
+	if err != nil || kind == rlp.List || len(value) > 8 {
+		return false
+	}
+	_, _, rest, err = rlp.Split(rest)
+	return err == nil && len(rest) == 0
+}
+
+func handleBlockHeaders66(backend Backend, msg Decoder, peer *Peer) error {
+	// A batch of headers arrived to one of our previous requests
+	res := new(BlockHeadersPacket66)
+	if err := decodeReply66(msg, peer, BlockHeadersMsg, res, &res.RequestId, &res.BlockHeadersPacket); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	if err := peer.fulfil(BlockHeadersMsg, res.RequestId); err != nil {
+		return rejectReply(peer, BlockHeadersMsg, err)
+	}
+	// Replies to direct fetches are consumed by the fetcher, not the backend
+	if peer.deliverFetch(res.RequestId, &res.BlockHeadersPacket) {
+		return nil
+	}
+	return backend.Handle(peer, &res.BlockHeadersPacket)
+}
+
+func handleBlockBodies(backend Backend, msg Decoder, peer *Peer) error {
+	// A batch of block bodies arrived to one of our previous requests
+	res := new(BlockBodiesPacket)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	return backend.Handle(peer, res)
+}
+
+func handleBlockBodies66(backend Backend, msg Decoder, peer *Peer) error {
+	// A batch of block bodies arrived to one of our previous requests
+	res := new(BlockBodiesPacket66)
+	if err := decodeReply66(msg, peer, BlockBodiesMsg, res, &res.RequestId, &res.BlockBodiesPacket); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	if err := peer.fulfil(BlockBodiesMsg, res.RequestId); err != nil {
+		return rejectReply(peer, BlockBodiesMsg, err)
+	}
+	// Replies to direct fetches are consumed by the fetcher, not the backend
+	if peer.deliverFetch(res.RequestId, &res.BlockBodiesPacket) {
+		return nil
+	}
+	return backend.Handle(peer, &res.BlockBodiesPacket)
+}
+
+func handleCompactBlockBodies66(backend Backend, msg Decoder, peer *Peer) error {
+	// A batch of compacted block bodies arrived to one of our previous requests
+	res := new(CompactBlockBodiesPacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	if err := peer.fulfil(BlockBodiesMsg, res.RequestId); err != nil {
+		return rejectReply(peer, BlockBodiesMsg, err)
+	}
+	// Restore the original encoding and deliver as plain block bodies, expanding
+	// to a few times the message limit at most
+	bodies, err := res.Expand(compactExpansionFactor * peer.MaxMessageSize())
+	if err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	packet := make(BlockBodiesPacket, len(bodies))
+	for i, body := range bodies {
+		packet[i] = new(BlockBody)
+		if err := rlp.DecodeBytes(body, packet[i]); err != nil {
+			return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+		}
+	}
+	if peer.deliverFetch(res.RequestId, &packet) {
+		return nil
+	}
+	return backend.Handle(peer, &packet)
+}
+
+func handleBlockTxHashes66(backend Backend, msg Decoder, peer *Peer) error {
+	// A list of transaction hashes arrived to one of our previous requests
+	res := new(BlockTxHashesPacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	if err := peer.fulfil(BlockTxHashesMsg, res.RequestId); err != nil {
+		return rejectReply(peer, BlockTxHashesMsg, err)
+	}
+	// Replies to direct fetches are consumed by the fetcher, not the backend
+	if peer.deliverFetch(res.RequestId, &res.BlockTxHashesPacket) {
+		return nil
+	}
+	return backend.Handle(peer, &res.BlockTxHashesPacket)
+}
+
+func handleHead66(backend Backend, msg Decoder, peer *Peer) error {
+	// The head of a chain arrived to one of our previous requests
+	res := new(HeadPacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	if err := peer.fulfil(HeadMsg, res.RequestId); err != nil {
+		return rejectReply(peer, HeadMsg, err)
+	}
+
+	return backend.Handle(peer, &res.HeadPacket)
+}
+
+func handleHeadersByNumbers66(backend Backend, msg Decoder, peer *Peer) error {
+	// A batch of discrete headers arrived to one of our previous requests
+	res := new(HeadersByNumbersPacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	if err := peer.fulfil(HeadersByNumbersMsg, res.RequestId); err != nil {
+		return rejectReply(peer, HeadersByNumbersMsg, err)
+	}
+	// Replies to direct fetches are consumed by the fetcher, not the backend
+	if peer.deliverFetch(res.RequestId, &res.HeadersByNumbersPacket) {
+		return nil
+	}
+	return backend.Handle(peer, &res.HeadersByNumbersPacket)
+}
+
+func handleHaveBlockReply66(backend Backend, msg Decoder, peer *Peer) error {
+	// A block availability answer arrived to one of our previous probes
+	res := new(HaveBlockReplyPacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	if err := peer.fulfil(HaveBlockReplyMsg, res.RequestId); err != nil {
+		return rejectReply(peer, HaveBlockReplyMsg, err)
+	}
+	// Replies to direct fetches are consumed by the fetcher, not the backend
+	if peer.deliverFetch(res.RequestId, &res.HaveBlockReplyPacket) {
+		return nil
+	}
+	return backend.Handle(peer, &res.HaveBlockReplyPacket)
+}
+
+func handlePendingEtxsByLocation66(backend Backend, msg Decoder, peer *Peer) error {
+	// A page of pending etxs arrived to one of our previous requests
+	res := new(PendingEtxsByLocationPacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	if err := peer.fulfil(PendingEtxsByLocationMsg, res.RequestId); err != nil {
+		return rejectReply(peer, PendingEtxsByLocationMsg, err)
+	}
+	// Replies to direct fetches are consumed by the fetcher, not the backend
+	if peer.deliverFetch(res.RequestId, &res.PendingEtxsByLocationPacket) {
+		return nil
+	}
+	return backend.Handle(peer, &res.PendingEtxsByLocationPacket)
+}
+
+func handlePendingEtxsSince66(backend Backend, msg Decoder, peer *Peer) error {
+	// A page of pending etxs arrived to one of our previous requests
+	res := new(PendingEtxsSincePacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	if err := peer.fulfil(PendingEtxsSinceMsg, res.RequestId); err != nil {
+		return rejectReply(peer, PendingEtxsSinceMsg, err)
+	}
+	// Replies to direct fetches are consumed by the fetcher, not the backend
+	if peer.deliverFetch(res.RequestId, &res.PendingEtxsSincePacket) {
+		return nil
+	}
+	return backend.Handle(peer, &res.PendingEtxsSincePacket)
+}
+
+func handleBlockEtxRoots66(backend Backend, msg Decoder, peer *Peer) error {
+	// A batch of etx roots arrived to one of our previous requests
+	res := new(BlockEtxRootsPacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	if err := peer.fulfil(BlockEtxRootsMsg, res.RequestId); err != nil {
+		return rejectReply(peer, BlockEtxRootsMsg, err)
+	}
+	// Replies to direct fetches are consumed by the fetcher, not the backend
+	if peer.deliverFetch(res.RequestId, &res.BlockEtxRootsPacket) {
+		return nil
+	}
+	return backend.Handle(peer, &res.BlockEtxRootsPacket)
+}
+
+func handleFreshBlockBodies66(backend Backend, msg Decoder, peer *Peer) error {
+	// A batch of head anchored block bodies arrived to one of our previous requests
+	res := new(FreshBlockBodiesPacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	if err := peer.fulfil(FreshBlockBodiesMsg, res.RequestId); err != nil {
+		return rejectReply(peer, FreshBlockBodiesMsg, err)
+	}
+	// Replies to direct fetches are consumed by the fetcher, not the backend
+	if peer.deliverFetch(res.RequestId, &res.FreshBlockBodiesPacket) {
+		return nil
+	}
+	return backend.Handle(peer, &res.FreshBlockBodiesPacket)
 }
 
-func handleGetBlockBodies(backend Backend, msg Decoder, peer *Peer) error {
-	// Decode the block body retrieval message
-	var query GetBlockBodiesPacket
-	if err := msg.Decode(&query); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+func handlePartialBodies66(backend Backend, msg Decoder, peer *Peer) error {
+	// A batch of partial block bodies arrived to one of our previous requests
+	res := new(PartialBodiesPacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
-	response := answerGetBlockBodiesQuery(backend, query, peer)
-	return peer.SendBlockBodiesRLP(response)
+	if err := res.sanityCheck(); err != nil {
+		return err
+	}
+	if err := peer.fulfil(PartialBodiesMsg, res.RequestId); err != nil {
+		return rejectReply(peer, PartialBodiesMsg, err)
+	}
+	// Replies to direct fetches are consumed by the fetcher, not the backend
+	if peer.deliverFetch(res.RequestId, &res.PartialBodiesPacket) {
+		return nil
+	}
+	return backend.Handle(peer, &res.PartialBodiesPacket)
 }
 
-func handleGetBlockBodies66(backend Backend, msg Decoder, peer *Peer) error {
-	// Decode the block body retrieval message
-	var query GetBlockBodiesPacket66
-	if err := msg.Decode(&query); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+func handlePoolSnapshot66(backend Backend, msg Decoder, peer *Peer) error {
+	// A snapshot of the remote pool arrived to one of our previous requests
+	res := new(PoolSnapshotPacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
-	response := answerGetBlockBodiesQuery(backend, query.GetBlockBodiesPacket, peer)
-	return peer.ReplyBlockBodiesRLP(query.RequestId, response)
+	if err := res.sanityCheck(); err != nil {
+		return err
+	}
+	if err := peer.fulfil(PoolSnapshotMsg, res.RequestId); err != nil {
+		return rejectReply(peer, PoolSnapshotMsg, err)
+	}
+	for _, hash := range res.Hashes {
+		peer.markTransaction(hash)
+	}
+	return backend.Handle(peer, &res.PoolSnapshotPacket)
 }
 
-func answerGetBlockBodiesQuery(backend Backend, query GetBlockBodiesPacket, peer *Peer) []rlp.RawValue {
-	// Gather blocks until the fetch or network limits is reached
-	var (
-		bytes  int
-		bodies []rlp.RawValue
-	)
-	for _, hash := range query {
-		if bytes >= softResponseLimit || len(bodies) >= maxBodiesServe {
-			break
-		}
-		if data := backend.Core().GetBodyRLP(hash); len(data) != 0 {
-			bodies = append(bodies, data)
-			bytes += len(data)
-		}
+func handleHeadersByMiner66(backend Backend, msg Decoder, peer *Peer) error {
+	// A batch of miner filtered headers arrived to one of our previous requests
+	res := new(HeadersByMinerPacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	if err := res.sanityCheck(); err != nil {
+		return err
+	}
+	if err := peer.fulfil(HeadersByMinerMsg, res.RequestId); err != nil {
+		return rejectReply(peer, HeadersByMinerMsg, err)
 	}
-	return bodies
+	// Replies to direct fetches are consumed by the fetcher, not the backend
+	if peer.deliverFetch(res.RequestId, &res.HeadersByMinerPacket) {
+		return nil
+	}
+	return backend.Handle(peer, &res.HeadersByMinerPacket)
 }
 
-func handleGetBlock(backend Backend, msg Decoder, peer *Peer) error {
-	// Decode the block retrieval message
-	var query GetBlockPacket
-	if err := msg.Decode(&query); err != nil {
-		fmt.Println("Error decoding the message", err)
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+func handleTxNonInclusionProof66(backend Backend, msg Decoder, peer *Peer) error {
+	// A transaction non-inclusion proof arrived to one of our previous requests
+	res := new(TxNonInclusionProofPacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
-	log.Info("Got a block fetch request eth/65: ", "Hash", query.Hash)
-	// check if we have the requested block in the database.
-	response := backend.Core().GetBlockOrCandidateByHash(query.Hash)
-	if response != nil {
-		return peer.SendNewBlock(response)
+	if err := peer.fulfil(TxNonInclusionProofMsg, res.RequestId); err != nil {
+		return rejectReply(peer, TxNonInclusionProofMsg, err)
 	}
-	return nil
+	// Replies to direct fetches are consumed by the fetcher, not the backend
+	if peer.deliverFetch(res.RequestId, &res.TxNonInclusionProofPacket) {
+		return nil
+	}
+	return backend.Handle(peer, &res.TxNonInclusionProofPacket)
 }
 
-func handleGetBlock66(backend Backend, msg Decoder, peer *Peer) error {
-	// Decode the block retrieval message
-	var query GetBlockPacket66
-	if err := msg.Decode(&query); err != nil {
-		fmt.Println("Error decoding the message", err)
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+func handleUnclePool66(backend Backend, msg Decoder, peer *Peer) error {
+	// The uncle candidates of the remote chain arrived to one of our previous requests
+	res := new(UnclePoolPacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
-	log.Debug("Got a block fetch request eth/66: ", "Hash", query.Hash)
-	// check if we have the requested block in the database.
-	response := backend.Core().GetBlockOrCandidateByHash(query.Hash)
-	if response != nil {
-		return peer.SendNewBlock(response)
+	if err := res.sanityCheck(); err != nil {
+		return err
 	}
-	return nil
+	if err := peer.fulfil(UnclePoolMsg, res.RequestId); err != nil {
+		return rejectReply(peer, UnclePoolMsg, err)
+	}
+	for _, uncle := range res.UnclePoolPacket {
+		peer.markBlock(uncle.Hash)
+	}
+	return backend.Handle(peer, &res.UnclePoolPacket)
 }
 
-func handlePendingEtxs(backend Backend, msg Decoder, peer *Peer) error {
-	// Decode the block pending etxs retrieval message
-	ann := new(PendingEtxsPacket)
-	if err := msg.Decode(&ann); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+func handleEtxRollupsByRange66(backend Backend, msg Decoder, peer *Peer) error {
+	// A range of pending etxs rollups arrived to one of our previous requests
+	res := new(EtxRollupsByRangePacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	if err := res.sanityCheck(); err != nil {
+		return err
+	}
+	if err := peer.fulfil(EtxRollupsByRangeMsg, res.RequestId); err != nil {
+		return rejectReply(peer, EtxRollupsByRangeMsg, err)
 	}
-	// Mark the hashes as present at the remote node
-	peer.markPendingEtxs(ann.PendingEtxs.Header.Hash())
 
-	return backend.Handle(peer, ann)
+	return backend.Handle(peer, &res.EtxRollupsByRangePacket)
 }
 
-func handlePendingEtxsRollup(backend Backend, msg Decoder, peer *Peer) error {
-	// Decode the block pending etxs rollup retrieval message
-	ann := new(PendingEtxsRollupPacket)
-	if err := msg.Decode(&ann); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+func handleBlockMiners66(backend Backend, msg Decoder, peer *Peer) error {
+	// A batch of block miners arrived to one of our previous requests
+	res := new(BlockMinersPacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
-	return backend.Handle(peer, ann)
+	if err := peer.fulfil(BlockMinersMsg, res.RequestId); err != nil {
+		return rejectReply(peer, BlockMinersMsg, err)
+	}
+	// Replies to direct fetches are consumed by the fetcher, not the backend
+	if peer.deliverFetch(res.RequestId, &res.BlockMinersPacket) {
+		return nil
+	}
+	return backend.Handle(peer, &res.BlockMinersPacket)
 }
 
-func handleGetOnePendingEtxs66(backend Backend, msg Decoder, peer *Peer) error {
-	// Decode the block pending etxs retrieval message
-	var query GetOnePendingEtxsPacket66
-	if err := msg.Decode(&query); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+func handleUnclesByRange66(backend Backend, msg Decoder, peer *Peer) error {
+	// A batch of block uncles arrived to one of our previous requests
+	res := new(UnclesByRangePacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
-	requestTracker.Fulfil(peer.id, peer.version, GetOnePendingEtxsMsg, query.RequestId)
-	pendingEtxs := backend.Core().GetPendingEtxs(query.Hash)
-	if pendingEtxs == nil {
-		log.Debug("Couldn't complete a pendingEtxs request for", "Hash", query.Hash)
+	if err := peer.fulfil(UnclesByRangeMsg, res.RequestId); err != nil {
+		return rejectReply(peer, UnclesByRangeMsg, err)
+	}
+	// Replies to direct fetches are consumed by the fetcher, not the backend
+	if peer.deliverFetch(res.RequestId, &res.UnclesByRangePacket) {
 		return nil
 	}
-	log.Trace("Completing  a pendingEtxs request for", "Hash", pendingEtxs.Header.Hash())
-	return peer.SendPendingEtxs(*pendingEtxs)
+	return backend.Handle(peer, &res.UnclesByRangePacket)
 }
 
-func handleGetOnePendingEtxsRollup66(backend Backend, msg Decoder, peer *Peer) error {
-	// Decode the block pending etxs rollup retrieval message
-	var query GetOnePendingEtxsRollupPacket66
-	if err := msg.Decode(&query); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+func handleBlockData66(backend Backend, msg Decoder, peer *Peer) error {
+	// A range of block data arrived to one of our previous requests
+	res := new(BlockDataPacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
-	requestTracker.Fulfil(peer.id, peer.version, GetOnePendingEtxsRollupMsg, query.RequestId)
-	pendingEtxs := backend.Core().GetPendingEtxsRollup(query.Hash)
-	if pendingEtxs == nil {
-		log.Debug("Couldn't complete a pendingEtxs request for", "Hash", query.Hash)
+	if len(res.Headers) != len(res.Bodies) {
+		return fmt.Errorf("%w: %d headers, %d bodies", errInvalidBlockData, len(res.Headers), len(res.Bodies))
+	}
+	if err := peer.fulfil(BlockDataMsg, res.RequestId); err != nil {
+		return rejectReply(peer, BlockDataMsg, err)
+	}
+	// Replies to direct fetches are consumed by the fetcher, not the backend
+	if peer.deliverFetch(res.RequestId, &res.BlockDataPacket) {
 		return nil
 	}
-	log.Trace("Completing  a pendingEtxs request for", "Hash", pendingEtxs.Header.Hash())
-	return peer.SendPendingEtxsRollup(*pendingEtxs)
+	return backend.Handle(peer, &res.BlockDataPacket)
 }
 
-func handleNewBlockhashes(backend Backend, msg Decoder, peer *Peer) error {
-	// A batch of new block announcements just arrived
-	ann := new(NewBlockHashesPacket)
-	if err := msg.Decode(ann); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+func handleBlockByNumber66(backend Backend, msg Decoder, peer *Peer) error {
+	// A block arrived to one of our previous requests
+	res := new(BlockByNumberPacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
-	// Mark the hashes as present at the remote node
-	for _, block := range *ann {
-		peer.markBlock(block.Hash)
+	if err := peer.fulfil(BlockByNumberMsg, res.RequestId); err != nil {
+		return rejectReply(peer, BlockByNumberMsg, err)
 	}
-	// Deliver them all to the backend for queuing
-	return backend.Handle(peer, ann)
+	// Replies to direct fetches are consumed by the fetcher, not the backend
+	if peer.deliverFetch(res.RequestId, &res.BlockByNumberPacket) {
+		return nil
+	}
+	return backend.Handle(peer, &res.BlockByNumberPacket)
 }
 
-func handleNewBlock(backend Backend, msg Decoder, peer *Peer) error {
-	nodeCtx := common.NodeLocation.Context()
-	// Retrieve and decode the propagated block
-	ann := new(NewBlockPacket)
-	if err := msg.Decode(ann); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+func handleCanonicalHash66(backend Backend, msg Decoder, peer *Peer) error {
+	// A canonical hash arrived to one of our previous requests
+	res := new(CanonicalHashPacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
-	if err := ann.sanityCheck(); err != nil {
-		return err
+	if err := peer.fulfil(CanonicalHashMsg, res.RequestId); err != nil {
+		return rejectReply(peer, CanonicalHashMsg, err)
 	}
-	// Making sure that the region and prime chains have zero txs and etxs in them
-	if nodeCtx == common.ZONE_CTX {
-		if hash := types.CalcUncleHash(ann.Block.Uncles()); hash != ann.Block.UncleHash() {
-			log.Warn("Propagated block has invalid uncles", "have", hash, "exp", ann.Block.UncleHash())
-			return nil // TODO: return error eventually, but wait a few releases
-		}
-		if hash := types.DeriveSha(ann.Block.Transactions(), trie.NewStackTrie(nil)); hash != ann.Block.TxHash() {
-			log.Warn("Propagated block has invalid transaction", "have", hash, "exp", ann.Block.TxHash())
-			return nil // TODO: return error eventually, but wait a few releases
-		}
-		if hash := types.DeriveSha(ann.Block.ExtTransactions(), trie.NewStackTrie(nil)); hash != ann.Block.EtxHash() {
-			log.Warn("Propagated block has invalid external transaction", "have", hash, "exp", ann.Block.EtxHash())
-			return nil // TODO: return error eventually, but wait a few releases
-		}
-	} else {
-		if len(ann.Block.Transactions()) != 0 {
-			log.Warn("Propagated block has transactions in the body", "len", len(ann.Block.Transactions()))
-		}
-		if len(ann.Block.ExtTransactions()) != 0 {
-			log.Warn("Propagated block has ext transactions in the body", "len", len(ann.Block.ExtTransactions()))
-		}
-		if len(ann.Block.Uncles()) != 0 {
-			log.Warn("Propagated block has uncles in the body", "len", len(ann.Block.Uncles()))
-		}
-		// Dom nodes need to validate the subordinate manifest against the subordinate's manifesthash
-		if hash := types.DeriveSha(ann.Block.SubManifest(), trie.NewStackTrie(nil)); hash != ann.Block.ManifestHash(nodeCtx+1) {
-			log.Warn("Propagated block has invalid subordinate manifest", "peer", peer.id, "block hash", ann.Block.Hash(), "have", hash, "exp", ann.Block.ManifestHash())
-			return nil
-		}
+	// Replies to direct fetches are consumed by the fetcher, not the backend
+	if peer.deliverFetch(res.RequestId, &res.CanonicalHashPacket) {
+		return nil
 	}
-	ann.Block.ReceivedAt = msg.Time()
-	ann.Block.ReceivedFrom = peer
-
-	// Mark the peer as owning the block
-	peer.markBlock(ann.Block.Hash())
-
-	return backend.Handle(peer, ann)
+	return backend.Handle(peer, &res.CanonicalHashPacket)
 }
 
-func handleBlockHeaders(backend Backend, msg Decoder, peer *Peer) error {
-	// A batch of headers arrived to one of our previous requests
-	res := new(BlockHeadersPacket)
-	if err := msg.Decode(res); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+func handleGetEtxManifestProof66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the manifest proof retrieval message
+	var query GetEtxManifestProofPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
-	return backend.Handle(peer, res)
+	response, err := answerGetEtxManifestProofQuery(backend.Core(), query.GetEtxManifestProofPacket)
+	if err != nil {
+		return err
+	}
+	return peer.ReplyEtxManifestProof(query.RequestId, response)
 }
 
-func handleBlockHeaders66(backend Backend, msg Decoder, peer *Peer) error {
-	// A batch of headers arrived to one of our previous requests
-	res := new(BlockHeadersPacket66)
-	if err := msg.Decode(res); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+// answerGetEtxManifestProofQuery proves the inclusion of a source shard block in
+// the subordinate manifest of a dominant block. Only the direct subordinates of
+// the chain run by this node can be proven, other shards are answered without
+// a root.
+func answerGetEtxManifestProofQuery(chain chainReader, query GetEtxManifestProofPacket) (*EtxManifestProofPacket, error) {
+	if err := validateLocation(query.Location); err != nil {
+		return nil, err
+	}
+	if len(query.Location) != len(common.NodeLocation)+1 || !query.Location.DomLocation().Equal(common.NodeLocation) {
+		return new(EtxManifestProofPacket), nil
 	}
-	requestTracker.Fulfil(peer.id, peer.version, BlockHeadersMsg, res.RequestId)
+	header := chain.GetHeaderByHash(query.Hash)
+	if header == nil {
+		return new(EtxManifestProofPacket), nil
+	}
+	response := &EtxManifestProofPacket{Root: header.ManifestHash(query.Location.Context())}
 
-	return backend.Handle(peer, &res.BlockHeadersPacket)
+	// The manifest only holds the blocks of the source shard if the dominant block
+	// is coincident with it
+	if loc := header.Location(); len(loc) < len(query.Location) || !loc[:len(query.Location)].Equal(query.Location) {
+		return response, nil
+	}
+	blob := chain.GetBodyRLP(query.Hash)
+	if len(blob) == 0 {
+		return response, nil
+	}
+	body := new(BlockBody)
+	if err := rlp.DecodeBytes(blob, body); err != nil {
+		log.Error("Failed to decode stored block body", "hash", query.Hash, "err", err)
+		return response, nil
+	}
+	for i, hash := range body.SubManifest {
+		if hash == query.SubHash {
+			root, proof, err := proveManifest(body.SubManifest, i)
+			if err != nil {
+				log.Error("Failed to prove manifest entry", "hash", query.Hash, "index", i, "err", err)
+				return response, nil
+			}
+			// Stale bodies can't prove anything against the header
+			if root == response.Root {
+				response.Index, response.Proof = uint64(i), proof
+			}
+			break
+		}
+	}
+	return response, nil
 }
 
-func handleBlockBodies(backend Backend, msg Decoder, peer *Peer) error {
-	// A batch of block bodies arrived to one of our previous requests
-	res := new(BlockBodiesPacket)
+func handleStatusDelta(backend Backend, msg Decoder, peer *Peer) error {
+	// The remote head moved, update the status cached at the handshake
+	delta := new(StatusDeltaPacket)
+	if err := msg.Decode(delta); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	if err := peer.applyStatusDelta(delta); err != nil {
+		return err
+	}
+	return backend.Handle(peer, delta)
+}
+
+func handleEtxManifestProof66(backend Backend, msg Decoder, peer *Peer) error {
+	// A manifest proof arrived to one of our previous requests
+	res := new(EtxManifestProofPacket66)
 	if err := msg.Decode(res); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
-	return backend.Handle(peer, res)
+	if err := peer.fulfil(EtxManifestProofMsg, res.RequestId); err != nil {
+		return rejectReply(peer, EtxManifestProofMsg, err)
+	}
+	// Replies to direct fetches are consumed by the fetcher, not the backend
+	if peer.deliverFetch(res.RequestId, &res.EtxManifestProofPacket) {
+		return nil
+	}
+	return backend.Handle(peer, &res.EtxManifestProofPacket)
 }
 
-func handleBlockBodies66(backend Backend, msg Decoder, peer *Peer) error {
-	// A batch of block bodies arrived to one of our previous requests
-	res := new(BlockBodiesPacket66)
+func handleCapabilities66(backend Backend, msg Decoder, peer *Peer) error {
+	// The serving capabilities arrived to one of our previous requests
+	res := new(CapabilitiesPacket66)
 	if err := msg.Decode(res); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	if err := peer.fulfil(CapabilitiesMsg, res.RequestId); err != nil {
+		return rejectReply(peer, CapabilitiesMsg, err)
 	}
-	requestTracker.Fulfil(peer.id, peer.version, BlockBodiesMsg, res.RequestId)
+	peer.SetCapabilities(&res.CapabilitiesPacket)
 
-	return backend.Handle(peer, &res.BlockBodiesPacket)
+	return backend.Handle(peer, &res.CapabilitiesPacket)
 }
 
 func handleNewPooledTransactionHashes(backend Backend, msg Decoder, peer *Peer) error {
@@ -360,7 +1633,7 @@ func handleNewPooledTransactionHashes(backend Backend, msg Decoder, peer *Peer)
 	}
 	ann := new(NewPooledTransactionHashesPacket)
 	if err := msg.Decode(ann); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
 	// Schedule all the unknown hashes for retrieval
 	for _, hash := range *ann {
@@ -369,6 +1642,74 @@ func handleNewPooledTransactionHashes(backend Backend, msg Decoder, peer *Peer)
 	return backend.Handle(peer, ann)
 }
 
+func handleCompactPooledTransactionHashes(backend Backend, msg Decoder, peer *Peer) error {
+	nodeCtx := common.NodeLocation.Context()
+	if nodeCtx != common.ZONE_CTX {
+		return errors.New("transactions are only handled in zone")
+	}
+	if !backend.Core().Slice().ProcessingState() {
+		return nil
+	}
+	// New compact transaction announcement arrived, make sure we have
+	// a valid and fresh chain to handle them
+	if !backend.AcceptTxs() {
+		return nil
+	}
+	ann := new(CompactPooledTransactionHashesPacket)
+	if err := msg.Decode(ann); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	return deliverCompactPooledTransactionHashes(backend, *ann, peer)
+}
+
+// deliverCompactPooledTransactionHashes schedules the transactions announced in
+// compact form for retrieval. The prefixes resolving to a single hash seen before
+// are delivered right away, the full hashes of the ambiguous ones are requested
+// from the announcer.
+func deliverCompactPooledTransactionHashes(backend Backend, ann CompactPooledTransactionHashesPacket, peer *Peer) error {
+	hashes, unresolved := resolveTxPrefixes(ann)
+	if len(unresolved) > 0 {
+		if err := peer.RequestPooledTransactionHashes(unresolved); err != nil {
+			return err
+		}
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	for _, hash := range hashes {
+		peer.markTransaction(hash)
+	}
+	resolved := NewPooledTransactionHashesPacket(hashes)
+	return backend.Handle(peer, &resolved)
+}
+
+func handleGetPooledTransactionHashes66(backend Backend, msg Decoder, peer *Peer) error {
+	// Decode the compact announcement resolution message
+	var query GetPooledTransactionHashesPacket66
+	if err := msg.Decode(&query); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	hashes := answerGetPooledTransactionHashes(query.GetPooledTransactionHashesPacket, peer)
+	return peer.ReplyPooledTransactionHashes(query.RequestId, hashes)
+}
+
+func handlePooledTransactionHashes66(backend Backend, msg Decoder, peer *Peer) error {
+	// The full hashes of a compact announcement arrived to one of our previous
+	// requests, schedule them for retrieval like a regular announcement
+	res := new(PooledTransactionHashesPacket66)
+	if err := msg.Decode(res); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	if err := peer.fulfil(PooledTransactionHashesMsg, res.RequestId); err != nil {
+		return rejectReply(peer, PooledTransactionHashesMsg, err)
+	}
+	for _, hash := range res.PooledTransactionHashesPacket {
+		peer.markTransaction(hash)
+	}
+	ann := NewPooledTransactionHashesPacket(res.PooledTransactionHashesPacket)
+	return backend.Handle(peer, &ann)
+}
+
 func handleGetPooledTransactions(backend Backend, msg Decoder, peer *Peer) error {
 	nodeCtx := common.NodeLocation.Context()
 	if nodeCtx != common.ZONE_CTX {
@@ -380,7 +1721,7 @@ func handleGetPooledTransactions(backend Backend, msg Decoder, peer *Peer) error
 	// Decode the pooled transactions retrieval message
 	var query GetPooledTransactionsPacket
 	if err := msg.Decode(&query); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
 	hashes, txs := answerGetPooledTransactions(backend, query, peer)
 	return peer.SendPooledTransactionsRLP(hashes, txs)
@@ -390,7 +1731,7 @@ func handleGetPooledTransactions66(backend Backend, msg Decoder, peer *Peer) err
 	// Decode the pooled transactions retrieval message
 	var query GetPooledTransactionsPacket66
 	if err := msg.Decode(&query); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
 	hashes, txs := answerGetPooledTransactions(backend, query.GetPooledTransactionsPacket, peer)
 	return peer.ReplyPooledTransactionsRLP(query.RequestId, hashes, txs)
@@ -439,7 +1780,7 @@ func handleTransactions(backend Backend, msg Decoder, peer *Peer) error {
 	// Transactions can be processed, parse all of them and deliver to the pool
 	var txs TransactionsPacket
 	if err := msg.Decode(&txs); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
 	for i, tx := range txs {
 		// Validate and mark the remote transaction
@@ -466,7 +1807,7 @@ func handlePooledTransactions(backend Backend, msg Decoder, peer *Peer) error {
 	// Transactions can be processed, parse all of them and deliver to the pool
 	var txs PooledTransactionsPacket
 	if err := msg.Decode(&txs); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
 	for i, tx := range txs {
 		// Validate and mark the remote transaction
@@ -492,8 +1833,8 @@ func handlePooledTransactions66(backend Backend, msg Decoder, peer *Peer) error
 	}
 	// Transactions can be processed, parse all of them and deliver to the pool
 	var txs PooledTransactionsPacket66
-	if err := msg.Decode(&txs); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
+	if err := decodeReply66(msg, peer, PooledTransactionsMsg, &txs, &txs.RequestId, &txs.PooledTransactionsPacket); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
 	for i, tx := range txs.PooledTransactionsPacket {
 		// Validate and mark the remote transaction
@@ -502,7 +1843,12 @@ func handlePooledTransactions66(backend Backend, msg Decoder, peer *Peer) error
 		}
 		peer.markTransaction(tx.Hash())
 	}
-	requestTracker.Fulfil(peer.id, peer.version, PooledTransactionsMsg, txs.RequestId)
-
-	return backend.Handle(peer, &txs.PooledTransactionsPacket)
+	if err := peer.fulfil(PooledTransactionsMsg, txs.RequestId); err != nil {
+		return rejectReply(peer, PooledTransactionsMsg, err)
+	}
+	requested, err := peer.filterRequestedTxs(txs.RequestId, txs.PooledTransactionsPacket)
+	if err != nil {
+		return err
+	}
+	return backend.Handle(peer, &requested)
 }
@@ -0,0 +1,1334 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// Tests that the transaction hashes of a block are served in body order, and
+// that empty or unknown blocks are answered with an empty list.
+func TestGetBlockTxHashes(t *testing.T) {
+	chain := newTestChain(0)
+
+	var (
+		fullHash  = common.Hash{0x01}
+		emptyHash = common.Hash{0x02}
+		txs       = newTestTransactions(5)
+	)
+	chain.addBody(fullHash, &types.Body{Transactions: txs})
+	chain.addBody(emptyHash, &types.Body{})
+
+	want := make([]common.Hash, len(txs))
+	for i, tx := range txs {
+		want[i] = tx.Hash()
+	}
+	tests := []struct {
+		hash common.Hash
+		want []common.Hash
+	}{
+		{fullHash, want},
+		{emptyHash, []common.Hash{}},
+		{common.Hash{0xff}, []common.Hash{}},
+	}
+	for i, tt := range tests {
+		have := answerGetBlockTxHashesQuery(chain, GetBlockTxHashesPacket{Hash: tt.hash})
+		if !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("test %d: hashes mismatch: have %x, want %x", i, have, tt.want)
+		}
+	}
+}
+
+// Tests that a transaction hash reply round-trips through the wire intact.
+func TestBlockTxHashesReply(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	peer := NewPeer(ETH66, p2p.NewPeer(enode.ID{}, "peer", nil), net, nil)
+	defer peer.Close()
+
+	hashes := []common.Hash{{0x01}, {0x02}, {0x03}}
+	go peer.ReplyBlockTxHashes(42, hashes)
+
+	if err := p2p.ExpectMsg(app, BlockTxHashesMsg, BlockTxHashesPacket66{
+		RequestId:           42,
+		BlockTxHashesPacket: hashes,
+	}); err != nil {
+		t.Fatalf("reply mismatch: %v", err)
+	}
+}
+
+// Tests that a head-relative header query is resolved against the current head
+// of the serving node and walks towards genesis.
+func TestGetBlockHeadersFromHead(t *testing.T) {
+	chain := newTestChain(10)
+
+	tests := []struct {
+		query  *GetBlockHeadersPacket
+		expect []uint64
+	}{
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: HeadNumber}, Amount: 3, Skip: 1}, []uint64{10, 9, 8}},
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: HeadNumber}, Amount: 3, Skip: 2}, []uint64{10, 8, 6}},
+		// The direction is forced downwards even if the requester asks otherwise
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: HeadNumber}, Amount: 2, Skip: 1, Reverse: false}, []uint64{10, 9}},
+		// Asking for more than available stops at genesis
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: HeadNumber}, Amount: 20, Skip: 5}, []uint64{10, 5, 0}},
+	}
+	for i, tt := range tests {
+		headers := answerGetBlockHeadersQuery(chain, tt.query, DefaultConfig.MaxHeaderSkip, nil)
+		if len(headers) != len(tt.expect) {
+			t.Errorf("test %d: header count mismatch: have %d, want %d", i, len(headers), len(tt.expect))
+			continue
+		}
+		for j, header := range headers {
+			if want := chain.canonical[tt.expect[j]].Hash(); header.Hash() != want {
+				t.Errorf("test %d, header %d: hash mismatch: have %x, want %x", i, j, header.Hash(), want)
+			}
+		}
+	}
+}
+
+// Tests that header queries skipping more than the maximum are clamped to it,
+// still stopping at the To number, while queries within the bound are served
+// as requested.
+func TestGetBlockHeadersSkipClamp(t *testing.T) {
+	const maxSkip = 4
+
+	chain := newTestChain(20)
+
+	tests := []struct {
+		query  *GetBlockHeadersPacket
+		expect []uint64
+	}{
+		// Excessive skips clamped in both directions, and by hash
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: 0}, Amount: 3, Skip: 1 << 40}, []uint64{0, 4, 8}},
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: 20}, Amount: 10, Skip: ^uint64(0), Reverse: true}, []uint64{20, 16, 12, 8, 4, 0}},
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Hash: chain.canonical[20].Hash()}, Amount: 3, Skip: 1 << 40, Reverse: true}, []uint64{20, 16, 12}},
+
+		// Clamped skips stopping at the first header reaching To
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: 20}, Amount: 10, Skip: 1 << 40, Reverse: true, To: 12}, []uint64{20, 16, 12}},
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: 20}, Amount: 10, Skip: 1 << 40, Reverse: true, To: 10}, []uint64{20, 16, 12, 8}},
+
+		// Skips within the bound served as requested
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: 20}, Amount: 10, Skip: 3, Reverse: true, To: 10}, []uint64{20, 17, 14, 11, 8}},
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: 2}, Amount: 10, Skip: 4}, []uint64{2, 6, 10, 14, 18}},
+	}
+	for i, tt := range tests {
+		headers := answerGetBlockHeadersQuery(chain, tt.query, maxSkip, nil)
+		if len(headers) != len(tt.expect) {
+			t.Errorf("test %d: header count mismatch: have %d, want %d", i, len(headers), len(tt.expect))
+			continue
+		}
+		for j, header := range headers {
+			if want := chain.canonical[tt.expect[j]].Hash(); header.Hash() != want {
+				t.Errorf("test %d, header %d: hash mismatch: have %x, want %x", i, j, header.Hash(), want)
+			}
+		}
+		if tt.query.Skip > maxSkip {
+			t.Errorf("test %d: skip not clamped: have %d, max %d", i, tt.query.Skip, maxSkip)
+		}
+	}
+}
+
+// Tests that header queries stop at their To number in both directions, and
+// that queries whose To number lies behind the origin are classified as
+// contradictory and served nothing.
+func TestGetBlockHeadersStop(t *testing.T) {
+	chain := newTestChain(20)
+
+	tests := []struct {
+		query  *GetBlockHeadersPacket
+		expect []uint64
+		err    error
+	}{
+		// Rising queries with the To number above, at and below the origin
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: 5}, Amount: 10, Skip: 1, To: 8}, []uint64{5, 6, 7, 8}, nil},
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: 5}, Amount: 10, Skip: 1, To: 5}, []uint64{5}, nil},
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: 5}, Amount: 10, Skip: 1, To: 3}, nil, errStopBehindOrigin},
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: 5}, Amount: 10, Skip: 4, To: 11}, []uint64{5, 9, 13}, nil},
+
+		// Falling queries with the To number below, at and above the origin
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: 10}, Amount: 10, Skip: 1, Reverse: true, To: 7}, []uint64{10, 9, 8, 7}, nil},
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: 10}, Amount: 10, Skip: 1, Reverse: true, To: 10}, []uint64{10}, nil},
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: 10}, Amount: 10, Skip: 1, Reverse: true, To: 12}, nil, errStopBehindOrigin},
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Hash: chain.canonical[10].Hash()}, Amount: 10, Skip: 1, Reverse: true, To: 12}, nil, errStopBehindOrigin},
+
+		// Head-relative queries fall from the current head
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: HeadNumber}, Amount: 10, Skip: 1, To: 18}, []uint64{20, 19, 18}, nil},
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: HeadNumber}, Amount: 10, Skip: 1, To: 25}, nil, errStopBehindOrigin},
+
+		// Queries without a To number are limited by their amount only
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: 5}, Amount: 3, Skip: 1}, []uint64{5, 6, 7}, nil},
+		{&GetBlockHeadersPacket{Origin: HashOrNumber{Number: 10}, Amount: 3, Skip: 1, Reverse: true}, []uint64{10, 9, 8}, nil},
+	}
+	for i, tt := range tests {
+		// Classify the stop number against the origin the query resolves to
+		origin := tt.query.Origin.Number
+		switch {
+		case tt.query.Origin.IsHead():
+			origin = chain.CurrentHeader().NumberU64()
+		case tt.query.Origin.Hash != (common.Hash{}):
+			origin = chain.GetHeaderByHash(tt.query.Origin.Hash).NumberU64()
+		}
+		reverse := tt.query.Reverse || tt.query.Origin.IsHead()
+		check := &GetBlockHeadersPacket{Reverse: reverse, To: tt.query.To}
+		if err := check.checkStop(origin); !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+			t.Errorf("test %d: stop classification mismatch: have %v, want %v", i, err, tt.err)
+		}
+		headers := answerGetBlockHeadersQuery(chain, tt.query, DefaultConfig.MaxHeaderSkip, nil)
+		if len(headers) != len(tt.expect) {
+			t.Errorf("test %d: header count mismatch: have %d, want %d", i, len(headers), len(tt.expect))
+			continue
+		}
+		for j, header := range headers {
+			if want := chain.canonical[tt.expect[j]].Hash(); header.Hash() != want {
+				t.Errorf("test %d, header %d: hash mismatch: have %x, want %x", i, j, header.Hash(), want)
+			}
+		}
+	}
+}
+
+// Tests that the head sentinel survives the wire encoding.
+func TestHeadOriginEncoding(t *testing.T) {
+	enc, err := rlp.EncodeToBytes(&GetBlockHeadersPacket{Origin: HashOrNumber{Number: HeadNumber}, Amount: 1})
+	if err != nil {
+		t.Fatalf("failed to encode query: %v", err)
+	}
+	var query GetBlockHeadersPacket
+	if err := rlp.DecodeBytes(enc, &query); err != nil {
+		t.Fatalf("failed to decode query: %v", err)
+	}
+	if !query.Origin.IsHead() {
+		t.Fatalf("head origin lost: %+v", query.Origin)
+	}
+}
+
+// Tests that the head is only served for the location run by the node, and that
+// malformed locations are rejected.
+func TestGetHead(t *testing.T) {
+	chain := newTestChain(5)
+
+	head, err := answerGetHeadQuery(chain, GetHeadPacket{Location: common.NodeLocation})
+	if err != nil {
+		t.Fatalf("failed to answer head query: %v", err)
+	}
+	want := chain.canonical[5]
+	if head.Hash != want.Hash() || head.Number != 5 || head.Entropy.Uint64() != 5 {
+		t.Errorf("head mismatch: have %x/%d/%v, want %x/%d/%d", head.Hash, head.Number, head.Entropy, want.Hash(), 5, 5)
+	}
+	tests := []struct {
+		location common.Location
+		err      error
+	}{
+		{common.Location{0, 0, 0}, errInvalidLocation},
+		{common.Location{byte(common.NumRegionsInPrime)}, errInvalidLocation},
+		{common.Location{0, byte(common.NumZonesInRegion)}, errInvalidLocation},
+		{common.Location{0}, nil},
+		{common.Location{0, 1}, nil},
+	}
+	for i, tt := range tests {
+		head, err := answerGetHeadQuery(chain, GetHeadPacket{Location: tt.location})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		// Locations not served are answered without a head instead of failing
+		if err == nil && (head.Hash != (common.Hash{}) || head.Entropy != nil) {
+			t.Errorf("test %d: unserved location answered with head %x", i, head.Hash)
+		}
+	}
+}
+
+// Tests that a head request and its reply round-trip through the wire and the
+// reply is delivered to the backend.
+func TestHeadRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	peer := NewPeer(ETH66, p2p.NewPeer(enode.ID{0x03}, "peer", nil), net, nil)
+	defer peer.Close()
+
+	if err := peer.RequestHead(common.Location{0}); !errors.Is(err, errLocationNotServed) {
+		t.Fatalf("foreign location request: error mismatch: have %v, want %v", err, errLocationNotServed)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- peer.RequestHead(common.NodeLocation) }()
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	var query GetHeadPacket66
+	if err := msg.Decode(&query); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	if !query.Location.Equal(common.NodeLocation) {
+		t.Fatalf("location mismatch: have %v, want %v", query.Location, common.NodeLocation)
+	}
+	chain := newTestChain(3)
+	head, err := answerGetHeadQuery(chain, query.GetHeadPacket)
+	if err != nil {
+		t.Fatalf("failed to answer head query: %v", err)
+	}
+	go p2p.Send(app, HeadMsg, HeadPacket66{RequestId: query.RequestId, HeadPacket: *head})
+
+	backend := new(mockBackend)
+	if err := handleMessage(backend, peer); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+	}
+	if have := backend.handled[0].(*HeadPacket); have.Hash != chain.canonical[3].Hash() || have.Number != 3 {
+		t.Errorf("reply mismatch: have %x/%d, want %x/%d", have.Hash, have.Number, chain.canonical[3].Hash(), 3)
+	}
+}
+
+// Tests that over-limit block body requests are truncated or rejected depending
+// on the configured response policy.
+func TestGetBlockBodiesResponsePolicy(t *testing.T) {
+	chain := newTestChain(0)
+
+	// Fill the chain with bodies, twice as many as fit into a reply
+	var query GetBlockBodiesPacket
+	for i := 0; i < 4; i++ {
+		hash := common.Hash{byte(i + 1)}
+		chain.bodies[hash] = make(rlp.RawValue, softResponseLimit/2)
+		query = append(query, hash)
+	}
+	bodies, err := answerGetBlockBodiesQuery(chain, query, TruncateResponse)
+	if err != nil {
+		t.Fatalf("truncating policy failed: %v", err)
+	}
+	if len(bodies) != 2 {
+		t.Errorf("truncated body count mismatch: have %d, want %d", len(bodies), 2)
+	}
+	if bodies, err := answerGetBlockBodiesQuery(chain, query, RejectResponse); !errors.Is(err, errResponseTooLarge) {
+		t.Errorf("rejecting policy: error mismatch: have %v, want %v", err, errResponseTooLarge)
+	} else if len(bodies) != 0 {
+		t.Errorf("rejecting policy served %d bodies", len(bodies))
+	}
+	// Requests fitting within the limits are served regardless of policy
+	if bodies, err := answerGetBlockBodiesQuery(chain, query[:2], RejectResponse); err != nil {
+		t.Errorf("rejecting policy refused in-limit request: %v", err)
+	} else if len(bodies) != 2 {
+		t.Errorf("in-limit body count mismatch: have %d, want %d", len(bodies), 2)
+	}
+}
+
+// bodyReadCounter is a chain counting the block body reads hitting the database.
+type bodyReadCounter struct {
+	*testChain
+	reads map[common.Hash]int
+}
+
+func (c *bodyReadCounter) GetBodyRLP(hash common.Hash) rlp.RawValue {
+	c.reads[hash]++
+	return c.testChain.GetBodyRLP(hash)
+}
+
+// Tests that block body requests repeating hashes read each body only once, yet
+// answer every requested position.
+func TestGetBlockBodiesDuplicates(t *testing.T) {
+	chain := &bodyReadCounter{testChain: newTestChain(0), reads: make(map[common.Hash]int)}
+
+	var (
+		first   = common.Hash{0x01}
+		second  = common.Hash{0x02}
+		unknown = common.Hash{0xff}
+	)
+	chain.bodies[first] = rlp.RawValue{0xc1, 0x01}
+	chain.bodies[second] = rlp.RawValue{0xc1, 0x02}
+
+	query := GetBlockBodiesPacket{first, second, first, unknown, first, second, unknown}
+	bodies, err := answerGetBlockBodiesQuery(chain, query, TruncateResponse)
+	if err != nil {
+		t.Fatalf("failed to answer query: %v", err)
+	}
+	// Unknown bodies are skipped, the rest follow the request order
+	want := []rlp.RawValue{chain.bodies[first], chain.bodies[second], chain.bodies[first], chain.bodies[first], chain.bodies[second]}
+	if !reflect.DeepEqual(bodies, want) {
+		t.Errorf("bodies mismatch: have %x, want %x", bodies, want)
+	}
+	for _, hash := range []common.Hash{first, second, unknown} {
+		if reads := chain.reads[hash]; reads != 1 {
+			t.Errorf("body %x: read count mismatch: have %d, want 1", hash[:1], reads)
+		}
+	}
+}
+
+// Tests that the serving capabilities of a peer can be queried after the
+// handshake and are recorded on the requesting side.
+func TestCapabilitiesRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		local  = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), net, nil)
+		remote = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x02}, "peer", nil), app, nil)
+
+		localBackend  = new(mockBackend)
+		remoteBackend = &mockBackend{caps: CapabilitiesPacket{PrunedDepth: 128}}
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	if caps := local.Capabilities(); caps != nil {
+		t.Fatalf("capabilities known before query: %+v", caps)
+	}
+	go local.RequestCapabilities()
+
+	errc := make(chan error, 1)
+	go func() { errc <- handleMessage(remoteBackend, remote) }()
+
+	if err := handleMessage(localBackend, local); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to serve request: %v", err)
+	}
+	caps := local.Capabilities()
+	if caps == nil {
+		t.Fatalf("capabilities not recorded")
+	}
+	if caps.Archive || caps.PrunedDepth != 128 {
+		t.Errorf("capabilities mismatch: have archive %v depth %d, want archive false depth 128", caps.Archive, caps.PrunedDepth)
+	}
+	if !reflect.DeepEqual(caps.Messages, supportedMessages[ETH66]) {
+		t.Errorf("supported messages mismatch: have %v, want %v", caps.Messages, supportedMessages[ETH66])
+	}
+	if len(localBackend.handled) != 1 {
+		t.Errorf("delivered packet count mismatch: have %d, want %d", len(localBackend.handled), 1)
+	}
+}
+
+// Tests that propagated blocks are only accepted within the configured distance
+// ahead of the local head.
+func TestAnnounceDistance(t *testing.T) {
+	chain := newTestChain(10)
+
+	tests := []struct {
+		number uint64
+		err    error
+	}{
+		{5, nil},  // Stale block
+		{11, nil}, // Next block
+		{26, nil}, // Plausibly ahead, right at the limit
+		{27, errFutureBlock},
+		{1 << 40, errFutureBlock},
+	}
+	for i, tt := range tests {
+		if err := checkAnnounceDistance(chain, newTestBlock(tt.number), 16); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+// Tests that headers can be retrieved at discrete numbers, with unknown numbers
+// skipped and malformed queries rejected.
+func TestGetHeadersByNumbers(t *testing.T) {
+	chain := newTestChain(20)
+
+	tests := []struct {
+		query  GetHeadersByNumbersPacket
+		expect []uint64
+		err    error
+	}{
+		{GetHeadersByNumbersPacket{}, nil, nil},
+		{GetHeadersByNumbersPacket{0, 10, 20}, []uint64{0, 10, 20}, nil},
+		{GetHeadersByNumbersPacket{3, 4, 17}, []uint64{3, 4, 17}, nil},
+		// Numbers beyond the head are skipped
+		{GetHeadersByNumbersPacket{5, 15, 25, 35}, []uint64{5, 15}, nil},
+		{GetHeadersByNumbersPacket{100}, nil, nil},
+		// Unordered or duplicate numbers are rejected
+		{GetHeadersByNumbersPacket{10, 5}, nil, errInvalidQuery},
+		{GetHeadersByNumbersPacket{5, 5}, nil, errInvalidQuery},
+		// Oversized queries are rejected
+		{make(GetHeadersByNumbersPacket, maxHeadersServe+1), nil, errInvalidQuery},
+	}
+	for i, tt := range tests {
+		headers, err := answerGetHeadersByNumbersQuery(chain, tt.query)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+			continue
+		}
+		if len(headers) != len(tt.expect) {
+			t.Errorf("test %d: header count mismatch: have %d, want %d", i, len(headers), len(tt.expect))
+			continue
+		}
+		for j, header := range headers {
+			if want := chain.canonical[tt.expect[j]].Hash(); header.Hash() != want {
+				t.Errorf("test %d, header %d: hash mismatch: have %x, want %x", i, j, header.Hash(), want)
+			}
+		}
+	}
+}
+
+// Tests that a discrete header request and its reply round-trip through the wire.
+func TestHeadersByNumbersRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		local  = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), net, nil)
+		remote = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x02}, "peer", nil), app, nil)
+		chain  = newTestChain(10)
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	go local.RequestHeadersByNumbers([]uint64{2, 4, 8, 16})
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	var query GetHeadersByNumbersPacket66
+	if err := msg.Decode(&query); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	headers, err := answerGetHeadersByNumbersQuery(chain, query.GetHeadersByNumbersPacket)
+	if err != nil {
+		t.Fatalf("failed to answer request: %v", err)
+	}
+	go remote.ReplyHeadersByNumbers(query.RequestId, headers)
+
+	backend := new(mockBackend)
+	if err := handleMessage(backend, local); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+	}
+	have := *backend.handled[0].(*HeadersByNumbersPacket)
+	if len(have) != 3 {
+		t.Fatalf("header count mismatch: have %d, want %d", len(have), 3)
+	}
+	for i, number := range []uint64{2, 4, 8} {
+		if have[i].Hash() != chain.canonical[number].Hash() {
+			t.Errorf("header %d: hash mismatch: have %x, want %x", i, have[i].Hash(), chain.canonical[number].Hash())
+		}
+	}
+}
+
+// Tests that block availability probes are answered according to whether the
+// full block is available locally.
+func TestHaveBlock(t *testing.T) {
+	chain := newTestChain(3)
+
+	var (
+		full     = chain.canonical[2].Hash()
+		headless = common.Hash{0x01}
+	)
+	chain.addBody(full, &types.Body{Transactions: newTestTransactions(1)})
+	chain.addBody(headless, &types.Body{})
+
+	tests := []struct {
+		hash common.Hash
+		have bool
+	}{
+		{full, true},
+		{chain.canonical[1].Hash(), false}, // Header without body
+		{headless, false},                  // Body without header
+		{common.Hash{0xff}, false},         // Unknown block
+	}
+	for i, tt := range tests {
+		if have := answerHaveBlockQuery(chain, HaveBlockPacket{Hash: tt.hash}); have != tt.have {
+			t.Errorf("test %d: availability mismatch: have %v, want %v", i, have, tt.have)
+		}
+	}
+}
+
+// Tests that block availability probes and their answers round-trip through
+// the wire.
+func TestHaveBlockRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		local  = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), net, nil)
+		remote = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x02}, "peer", nil), app, nil)
+		hash   = common.Hash{0x01}
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	for _, have := range []bool{true, false} {
+		go local.RequestHaveBlock(hash)
+
+		msg, err := app.ReadMsg()
+		if err != nil {
+			t.Fatalf("failed to read probe: %v", err)
+		}
+		var query HaveBlockPacket66
+		if err := msg.Decode(&query); err != nil {
+			t.Fatalf("failed to decode probe: %v", err)
+		}
+		if query.Hash != hash {
+			t.Fatalf("probed hash mismatch: have %x, want %x", query.Hash, hash)
+		}
+		go remote.ReplyHaveBlock(query.RequestId, query.Hash, have)
+
+		backend := new(mockBackend)
+		if err := handleMessage(backend, local); err != nil {
+			t.Fatalf("failed to handle answer: %v", err)
+		}
+		if len(backend.handled) != 1 {
+			t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+		}
+		reply := backend.handled[0].(*HaveBlockReplyPacket)
+		if reply.Hash != hash || reply.Have != have {
+			t.Errorf("answer mismatch: have %x/%v, want %x/%v", reply.Hash, reply.Have, hash, have)
+		}
+	}
+}
+
+// Tests that probing is only advised for blocks above the configured size.
+func TestShouldProbeBlock(t *testing.T) {
+	config := DefaultConfig
+	config.HaveBlockProbeThreshold = 1024
+	peer := newPeer(ETH66, p2p.NewPeer(enode.ID{0xe1}, "peer", nil), nil, nil, &config)
+	defer peer.Close()
+
+	if peer.ShouldProbeBlock(1023) {
+		t.Errorf("small block probed")
+	}
+	if !peer.ShouldProbeBlock(1024) {
+		t.Errorf("large block not probed")
+	}
+	config.HaveBlockProbeThreshold = 0
+	if peer.ShouldProbeBlock(1 << 30) {
+		t.Errorf("block probed with probing disabled")
+	}
+}
+
+// Tests that the pending etx set of the local location is paged out in hash
+// order, with the cursors chaining the pages together without gaps or overlaps.
+func TestGetPendingEtxsByLocation(t *testing.T) {
+	defer func(old int) { maxPendingEtxsServe = old }(maxPendingEtxsServe)
+	maxPendingEtxsServe = 3
+
+	var (
+		chain = newTestChain(2)
+		head  = chain.CurrentHeader()
+		set   = types.NewEtxSet()
+	)
+	for _, tx := range newTestTransactions(8) {
+		set[tx.Hash()] = types.EtxSetEntry{Height: 1, ETX: *tx}
+	}
+	chain.etxSets[head.Hash()] = set
+
+	var (
+		query  = GetPendingEtxsByLocationPacket{Location: common.NodeLocation}
+		hashes []common.Hash
+		pages  int
+	)
+	for {
+		page, err := answerGetPendingEtxsByLocationQuery(chain, query)
+		if err != nil {
+			t.Fatalf("page %d: failed to answer query: %v", pages, err)
+		}
+		if len(page.Etxs) > maxPendingEtxsServe {
+			t.Fatalf("page %d: page size mismatch: have %d, want <= %d", pages, len(page.Etxs), maxPendingEtxsServe)
+		}
+		for _, etx := range page.Etxs {
+			hashes = append(hashes, etx.Hash())
+		}
+		pages++
+		if page.Cursor == (common.Hash{}) {
+			break
+		}
+		if page.Cursor != hashes[len(hashes)-1] {
+			t.Fatalf("page %d: cursor mismatch: have %x, want %x", pages, page.Cursor, hashes[len(hashes)-1])
+		}
+		query.Cursor = page.Cursor
+	}
+	if pages != 3 {
+		t.Errorf("page count mismatch: have %d, want %d", pages, 3)
+	}
+	if len(hashes) != len(set) {
+		t.Fatalf("etx count mismatch: have %d, want %d", len(hashes), len(set))
+	}
+	for i, hash := range hashes {
+		if _, ok := set[hash]; !ok {
+			t.Errorf("etx %d: unknown etx %x served", i, hash)
+		}
+		if i > 0 && bytes.Compare(hashes[i-1][:], hash[:]) >= 0 {
+			t.Errorf("etx %d: etxs not served in hash order", i)
+		}
+	}
+	// A location not run locally is answered with an empty, final page
+	foreign, err := answerGetPendingEtxsByLocationQuery(chain, GetPendingEtxsByLocationPacket{Location: common.Location{0, 1}})
+	if err != nil {
+		t.Fatalf("failed to answer foreign query: %v", err)
+	}
+	if len(foreign.Etxs) != 0 || foreign.Cursor != (common.Hash{}) {
+		t.Errorf("foreign location served: %d etxs, cursor %x", len(foreign.Etxs), foreign.Cursor)
+	}
+	// An empty or unknown set is served as an empty, final page
+	delete(chain.etxSets, head.Hash())
+	page, err := answerGetPendingEtxsByLocationQuery(chain, GetPendingEtxsByLocationPacket{Location: common.NodeLocation})
+	if err != nil {
+		t.Fatalf("failed to answer query: %v", err)
+	}
+	if len(page.Etxs) != 0 || page.Cursor != (common.Hash{}) {
+		t.Errorf("empty set page mismatch: have %d etxs, cursor %x", len(page.Etxs), page.Cursor)
+	}
+}
+
+// Tests that pending etx pages and their cursors round-trip through the wire.
+func TestPendingEtxsByLocationRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		local  = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), net, nil)
+		remote = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x02}, "peer", nil), app, nil)
+		cursor = common.Hash{0x01}
+		etxs   = newTestTransactions(2)
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	go local.RequestPendingEtxsByLocation(common.NodeLocation, cursor)
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	var query GetPendingEtxsByLocationPacket66
+	if err := msg.Decode(&query); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	if !query.Location.Equal(common.NodeLocation) || query.Cursor != cursor {
+		t.Fatalf("request mismatch: have %v/%x, want %v/%x", query.Location, query.Cursor, common.NodeLocation, cursor)
+	}
+	next := etxs[1].Hash()
+	go remote.ReplyPendingEtxsByLocation(query.RequestId, &PendingEtxsByLocationPacket{Etxs: etxs, Cursor: next})
+
+	backend := new(mockBackend)
+	if err := handleMessage(backend, local); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+	}
+	page := backend.handled[0].(*PendingEtxsByLocationPacket)
+	if page.Cursor != next {
+		t.Errorf("cursor mismatch: have %x, want %x", page.Cursor, next)
+	}
+	if len(page.Etxs) != len(etxs) {
+		t.Fatalf("etx count mismatch: have %d, want %d", len(page.Etxs), len(etxs))
+	}
+	for i := range etxs {
+		if page.Etxs[i].Hash() != etxs[i].Hash() {
+			t.Errorf("etx %d mismatch: have %x, want %x", i, page.Etxs[i].Hash(), etxs[i].Hash())
+		}
+	}
+}
+
+// Tests that etx root queries are resolved like full header queries, with the
+// compact roots matching the ones extracted from the full headers.
+func TestGetBlockEtxRoots(t *testing.T) {
+	chain := newTestChain(10)
+	for i, header := range chain.canonical {
+		header.SetEtxHash(common.Hash{byte(i + 1)})
+	}
+	// Changing the headers changed their hashes, reindex them
+	chain.headers = make(map[common.Hash]*types.Header)
+	for _, header := range chain.canonical {
+		chain.headers[header.Hash()] = header
+	}
+	tests := []func() *GetBlockHeadersPacket{
+		func() *GetBlockHeadersPacket {
+			return &GetBlockHeadersPacket{Origin: HashOrNumber{Number: 2}, Amount: 4, Skip: 1}
+		},
+		func() *GetBlockHeadersPacket {
+			return &GetBlockHeadersPacket{Origin: HashOrNumber{Number: 9}, Amount: 3, Skip: 3, Reverse: true}
+		},
+		func() *GetBlockHeadersPacket {
+			return &GetBlockHeadersPacket{Origin: HashOrNumber{Hash: chain.canonical[5].Hash()}, Amount: 1}
+		},
+		func() *GetBlockHeadersPacket {
+			return &GetBlockHeadersPacket{Origin: HashOrNumber{Number: HeadNumber}, Amount: 2, Skip: 1}
+		},
+		func() *GetBlockHeadersPacket {
+			return &GetBlockHeadersPacket{Origin: HashOrNumber{Number: 20}, Amount: 2, Skip: 1}
+		},
+	}
+	for i, query := range tests {
+		headers := answerGetBlockHeadersQuery(chain, query(), DefaultConfig.MaxHeaderSkip, nil)
+		roots := answerGetBlockEtxRootsQuery(chain, (*GetBlockEtxRootsPacket)(query()), DefaultConfig.MaxHeaderSkip, nil)
+
+		if len(roots) != len(headers) {
+			t.Errorf("test %d: root count mismatch: have %d, want %d", i, len(roots), len(headers))
+			continue
+		}
+		for j, header := range headers {
+			want := BlockEtxRoot{Number: header.NumberU64(), Hash: header.Hash(), EtxRoot: header.EtxHash()}
+			if roots[j] != want {
+				t.Errorf("test %d, root %d: mismatch: have %+v, want %+v", i, j, roots[j], want)
+			}
+		}
+	}
+}
+
+// Tests that etx root requests and their replies round-trip through the wire.
+func TestBlockEtxRootsRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		local  = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), net, nil)
+		remote = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x02}, "peer", nil), app, nil)
+		roots  = BlockEtxRootsPacket{
+			{Number: 4, Hash: common.Hash{0x04}, EtxRoot: common.Hash{0x40}},
+			{Number: 6, Hash: common.Hash{0x06}, EtxRoot: common.Hash{0x60}},
+		}
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	go local.RequestBlockEtxRoots(4, 2, 2, false)
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	var query GetBlockEtxRootsPacket66
+	if err := msg.Decode(&query); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	if query.Origin.Number != 4 || query.Amount != 2 || query.Skip != 2 || query.Reverse {
+		t.Fatalf("request mismatch: have %+v", query.GetBlockEtxRootsPacket)
+	}
+	go remote.ReplyBlockEtxRoots(query.RequestId, roots)
+
+	backend := new(mockBackend)
+	if err := handleMessage(backend, local); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+	}
+	if have := *backend.handled[0].(*BlockEtxRootsPacket); !reflect.DeepEqual(have, roots) {
+		t.Errorf("roots mismatch: have %+v, want %+v", have, roots)
+	}
+}
+
+// Tests that block miner retrievals walk the canonical chain from the origin and
+// honour the dominant block filter like header retrievals.
+func TestGetBlockMiners(t *testing.T) {
+	chain := newTestChain(10)
+	for i, header := range chain.canonical {
+		header.SetCoinbase(common.BytesToAddress([]byte{byte(i + 1)}))
+	}
+	// Changing the headers changed their hashes, reindex them
+	chain.headers = make(map[common.Hash]*types.Header)
+	for _, header := range chain.canonical {
+		chain.headers[header.Hash()] = header
+	}
+	side := types.EmptyHeader()
+	side.SetNumber(big.NewInt(3))
+	side.SetDifficulty(big.NewInt(2))
+	chain.headers[side.Hash()] = side
+
+	tests := []struct {
+		query  GetBlockMinersPacket
+		dom    []int    // Canonical blocks to mark dominant
+		blocks []uint64 // Blocks whose miners are expected
+	}{
+		// Plain ranges by number and by canonical hash
+		{GetBlockMinersPacket{Origin: HashOrNumber{Number: 2}, Amount: 4}, nil, []uint64{2, 3, 4, 5}},
+		{GetBlockMinersPacket{Origin: HashOrNumber{Hash: chain.canonical[6].Hash()}, Amount: 2}, nil, []uint64{6, 7}},
+		{GetBlockMinersPacket{Origin: HashOrNumber{Number: 8}, Amount: 5}, nil, []uint64{8, 9, 10}},
+
+		// Non-dom queries stop at the first dominant block, dom ones return only those
+		{GetBlockMinersPacket{Origin: HashOrNumber{Number: 2}, Amount: 4}, []int{3}, []uint64{2, 3}},
+		{GetBlockMinersPacket{Origin: HashOrNumber{Number: 1}, Amount: 2, Dom: true}, []int{3, 5, 8}, []uint64{3, 5}},
+		{GetBlockMinersPacket{Origin: HashOrNumber{Number: 6}, Amount: 3, Dom: true}, []int{3}, nil},
+
+		// Unknown, sidechain and future origins are not served
+		{GetBlockMinersPacket{Origin: HashOrNumber{Hash: common.Hash{0xff}}, Amount: 2}, nil, nil},
+		{GetBlockMinersPacket{Origin: HashOrNumber{Hash: side.Hash()}, Amount: 2}, nil, nil},
+		{GetBlockMinersPacket{Origin: HashOrNumber{Number: 20}, Amount: 2}, nil, nil},
+	}
+	for i, tt := range tests {
+		chain.engine.dom = make(map[common.Hash]bool)
+		for _, n := range tt.dom {
+			chain.engine.dom[chain.canonical[n].Hash()] = true
+		}
+		miners := answerGetBlockMinersQuery(chain, tt.query, nil)
+		if len(miners) != len(tt.blocks) {
+			t.Errorf("test %d: miner count mismatch: have %d, want %d", i, len(miners), len(tt.blocks))
+			continue
+		}
+		for j, number := range tt.blocks {
+			want := BlockMiner{Number: number, Miner: chain.canonical[number].Coinbase()}
+			if !reflect.DeepEqual(miners[j], want) {
+				t.Errorf("test %d, miner %d: mismatch: have %+v, want %+v", i, j, miners[j], want)
+			}
+		}
+	}
+}
+
+// Tests that block miner requests and their replies round-trip through the wire.
+func TestBlockMinersRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		local  = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), net, nil)
+		remote = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x02}, "peer", nil), app, nil)
+		miners = BlockMinersPacket{
+			{Number: 4, Miner: common.BytesToAddress([]byte{0x04})},
+			{Number: 9, Miner: common.BytesToAddress([]byte{0x09})},
+		}
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	go local.RequestBlockMiners(4, 2, true)
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	var query GetBlockMinersPacket66
+	if err := msg.Decode(&query); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	if query.Origin.Number != 4 || query.Amount != 2 || !query.Dom {
+		t.Fatalf("request mismatch: have %+v", query.GetBlockMinersPacket)
+	}
+	go remote.ReplyBlockMiners(query.RequestId, miners)
+
+	backend := new(mockBackend)
+	if err := handleMessage(backend, local); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+	}
+	if have := *backend.handled[0].(*BlockMinersPacket); !reflect.DeepEqual(have, miners) {
+		t.Errorf("miners mismatch: have %+v, want %+v", have, miners)
+	}
+}
+
+// Tests that uncle range retrievals return the uncle section of each block in
+// the range, including the blocks without uncles, and honour the dominant block
+// filter like header retrievals.
+func TestGetUnclesByRange(t *testing.T) {
+	chain := newTestChain(10)
+
+	// Give blocks 1 to 6 a body, with uncles on some of them
+	uncles := make(map[uint64][]*types.Header)
+	for number, count := range map[uint64]int{2: 2, 4: 1} {
+		for i := 0; i < count; i++ {
+			uncle := types.EmptyHeader()
+			uncle.SetNumber(big.NewInt(int64(number - 1)))
+			uncle.SetDifficulty(big.NewInt(int64(i + 2)))
+			uncles[number] = append(uncles[number], uncle)
+		}
+	}
+	for number := uint64(1); number <= 6; number++ {
+		chain.addBody(chain.canonical[number].Hash(), &types.Body{Uncles: uncles[number]})
+	}
+	tests := []struct {
+		query  GetUnclesByRangePacket
+		dom    []int    // Canonical blocks to mark dominant
+		blocks []uint64 // Blocks whose uncles are expected
+	}{
+		// Plain ranges by number and by canonical hash, cut at the first missing body
+		{GetUnclesByRangePacket{Origin: HashOrNumber{Number: 1}, Amount: 4}, nil, []uint64{1, 2, 3, 4}},
+		{GetUnclesByRangePacket{Origin: HashOrNumber{Hash: chain.canonical[4].Hash()}, Amount: 2}, nil, []uint64{4, 5}},
+		{GetUnclesByRangePacket{Origin: HashOrNumber{Number: 5}, Amount: 4}, nil, []uint64{5, 6}},
+
+		// Non-dom queries stop at the first dominant block, dom ones return only those
+		{GetUnclesByRangePacket{Origin: HashOrNumber{Number: 1}, Amount: 4}, []int{2}, []uint64{1, 2}},
+		{GetUnclesByRangePacket{Origin: HashOrNumber{Number: 1}, Amount: 2, Dom: true}, []int{2, 3, 4}, []uint64{2, 3}},
+
+		// Unknown and future origins are not served
+		{GetUnclesByRangePacket{Origin: HashOrNumber{Hash: common.Hash{0xff}}, Amount: 2}, nil, nil},
+		{GetUnclesByRangePacket{Origin: HashOrNumber{Number: 20}, Amount: 2}, nil, nil},
+	}
+	for i, tt := range tests {
+		chain.engine.dom = make(map[common.Hash]bool)
+		for _, n := range tt.dom {
+			chain.engine.dom[chain.canonical[n].Hash()] = true
+		}
+		// Round-trip the reply to check it decodes into the full packet
+		enc, err := rlp.EncodeToBytes(answerGetUnclesByRangeQuery(chain, tt.query, nil))
+		if err != nil {
+			t.Fatalf("test %d: failed to encode reply: %v", i, err)
+		}
+		var reply UnclesByRangePacket
+		if err := rlp.DecodeBytes(enc, &reply); err != nil {
+			t.Fatalf("test %d: failed to decode reply: %v", i, err)
+		}
+		if len(reply) != len(tt.blocks) {
+			t.Errorf("test %d: block count mismatch: have %d, want %d", i, len(reply), len(tt.blocks))
+			continue
+		}
+		for j, number := range tt.blocks {
+			if reply[j].Number != number {
+				t.Errorf("test %d, block %d: number mismatch: have %d, want %d", i, j, reply[j].Number, number)
+			}
+			if len(reply[j].Uncles) != len(uncles[number]) {
+				t.Errorf("test %d, block %d: uncle count mismatch: have %d, want %d", i, j, len(reply[j].Uncles), len(uncles[number]))
+				continue
+			}
+			for k, uncle := range reply[j].Uncles {
+				if uncle.Hash() != uncles[number][k].Hash() {
+					t.Errorf("test %d, block %d, uncle %d: hash mismatch: have %x, want %x", i, j, k, uncle.Hash(), uncles[number][k].Hash())
+				}
+			}
+		}
+	}
+}
+
+// Tests that uncle range requests and their replies round-trip through the wire.
+func TestUnclesByRangeRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	uncle := types.EmptyHeader()
+	uncle.SetNumber(big.NewInt(3))
+	uncle.SetDifficulty(big.NewInt(2))
+
+	enc, err := rlp.EncodeToBytes([]*types.Header{uncle})
+	if err != nil {
+		t.Fatalf("failed to encode uncles: %v", err)
+	}
+	var (
+		local  = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), net, nil)
+		remote = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x02}, "peer", nil), app, nil)
+		reply  = UnclesByRangeRLPPacket{
+			{Number: 4, Uncles: enc},
+			{Number: 5, Uncles: rlp.EmptyList},
+		}
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	go local.RequestUnclesByRange(4, 2, false)
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	var query GetUnclesByRangePacket66
+	if err := msg.Decode(&query); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	if query.Origin.Number != 4 || query.Amount != 2 || query.Dom {
+		t.Fatalf("request mismatch: have %+v", query.GetUnclesByRangePacket)
+	}
+	go remote.ReplyUnclesByRangeRLP(query.RequestId, reply)
+
+	backend := new(mockBackend)
+	if err := handleMessage(backend, local); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+	}
+	have := *backend.handled[0].(*UnclesByRangePacket)
+	if len(have) != 2 || have[0].Number != 4 || have[1].Number != 5 || len(have[1].Uncles) != 0 {
+		t.Fatalf("uncles mismatch: have %+v", have)
+	}
+	if len(have[0].Uncles) != 1 || have[0].Uncles[0].Hash() != uncle.Hash() {
+		t.Errorf("uncle mismatch: have %+v, want %x", have[0].Uncles, uncle.Hash())
+	}
+}
+
+// Tests that eth/66 payloads are told apart from bare packets by their shape.
+func TestTaggedReply(t *testing.T) {
+	header := types.EmptyHeader()
+	tests := []struct {
+		packet interface{}
+		tagged bool
+	}{
+		{&BlockHeadersPacket66{RequestId: 1, BlockHeadersPacket: BlockHeadersPacket{header}}, true},
+		{&BlockHeadersPacket66{RequestId: 1<<64 - 1}, true},
+		{&BlockBodiesPacket66{}, true},
+		{BlockHeadersPacket{header}, false},
+		{BlockHeadersPacket{}, false},
+		{[]common.Hash{{0x01}, {0x02}}, false},
+		{[]common.Hash{{0x01}}, false},
+	}
+	for i, tt := range tests {
+		enc, err := rlp.EncodeToBytes(tt.packet)
+		if err != nil {
+			t.Fatalf("test %d: failed to encode packet: %v", i, err)
+		}
+		if have := tagged(enc); have != tt.tagged {
+			t.Errorf("test %d: tagged mismatch: have %v, want %v", i, have, tt.tagged)
+		}
+	}
+}
+
+// Tests that eth/66 replies missing the request id wrapper are decoded bare and
+// correlated to the oldest pending request, alongside well-formed ones.
+func TestUntaggedReplies(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	peer := NewPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), net, nil)
+	defer peer.Close()
+
+	for _, id := range []uint64{101, 102, 103} {
+		requestTracker.Track(peer.id, peer.version, GetBlockHeadersMsg, BlockHeadersMsg, id)
+	}
+	requestTracker.Track(peer.id, peer.version, GetBlockBodiesMsg, BlockBodiesMsg, 104)
+
+	var headers []*types.Header
+	for i := 0; i < 3; i++ {
+		header := types.EmptyHeader()
+		header.SetNumber(big.NewInt(int64(i)))
+		headers = append(headers, header)
+	}
+	tests := []struct {
+		code   uint64
+		packet interface{}
+		err    error
+	}{
+		{BlockHeadersMsg, &BlockHeadersPacket66{RequestId: 102, BlockHeadersPacket: BlockHeadersPacket{headers[0]}}, nil},
+		{BlockHeadersMsg, BlockHeadersPacket{headers[1]}, nil}, // Correlated to 101
+		{BlockBodiesMsg, BlockBodiesPacket{&BlockBody{}}, nil}, // Correlated to 104
+		{BlockHeadersMsg, BlockHeadersPacket{headers[2]}, nil}, // Correlated to 103
+		{BlockHeadersMsg, BlockHeadersPacket{headers[2]}, errUnsolicitedResponse},
+	}
+	backend := new(mockBackend)
+	for i, tt := range tests {
+		go p2p.Send(app, tt.code, tt.packet)
+		if err := handleMessage(backend, peer); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+	if _, ok := requestTracker.Oldest(peer.id, peer.version, BlockHeadersMsg); ok {
+		t.Errorf("header requests left pending")
+	}
+	if len(backend.handled) != 4 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 4)
+	}
+	for i, want := range []*types.Header{headers[0], headers[1], nil, headers[2]} {
+		if want == nil {
+			if bodies, ok := backend.handled[i].(*BlockBodiesPacket); !ok || len(*bodies) != 1 {
+				t.Errorf("packet %d: bodies mismatch: have %v", i, backend.handled[i])
+			}
+			continue
+		}
+		if have, ok := backend.handled[i].(*BlockHeadersPacket); !ok || len(*have) != 1 || (*have)[0].Hash() != want.Hash() {
+			t.Errorf("packet %d: headers mismatch: have %v", i, backend.handled[i])
+		}
+	}
+}
+
+// Tests that subordinate manifests are only accepted if they start at the parent
+// coordinate block and list the subordinate blocks in chain order.
+func TestVerifySubManifest(t *testing.T) {
+	const subCtx = common.ZONE_CTX
+
+	// Create a short subordinate chain on top of the parent coordinate block
+	var (
+		chain  = newTestChain(0)
+		parent = common.Hash{0xca, 0xfe}
+		hashes = []common.Hash{parent}
+	)
+	for i := 1; i <= 3; i++ {
+		header := types.EmptyHeader()
+		header.SetNumber(big.NewInt(int64(i)), subCtx)
+		header.SetParentHash(hashes[i-1], subCtx)
+		chain.headers[header.Hash()] = header
+		hashes = append(hashes, header.Hash())
+	}
+	unknown := common.Hash{0xff}
+
+	tests := []struct {
+		manifest types.BlockManifest
+		valid    bool
+	}{
+		// Manifests listing the subordinate blocks in order, possibly unknown ones
+		{types.BlockManifest{hashes[0], hashes[1], hashes[2], hashes[3]}, true},
+		{types.BlockManifest{hashes[0]}, true},
+		{types.BlockManifest{hashes[0], hashes[1], unknown}, true},
+
+		// Manifests not starting at the parent coordinate block
+		{types.BlockManifest{}, false},
+		{types.BlockManifest{hashes[1], hashes[2]}, false},
+		{types.BlockManifest{unknown, hashes[0], hashes[1]}, false},
+
+		// Manifests with the subordinate blocks out of order
+		{types.BlockManifest{hashes[0], hashes[2], hashes[1]}, false},
+		{types.BlockManifest{hashes[0], hashes[1], hashes[3]}, false},
+		{types.BlockManifest{hashes[0], hashes[3], hashes[2], hashes[1]}, false},
+		{types.BlockManifest{hashes[0], unknown, hashes[2]}, false},
+
+		// Manifests repeating entries
+		{types.BlockManifest{hashes[0], hashes[1], hashes[1]}, false},
+		{types.BlockManifest{hashes[0], hashes[1], hashes[0]}, false},
+	}
+	for i, tt := range tests {
+		err := verifySubManifest(chain, tt.manifest, parent, subCtx)
+		if tt.valid && err != nil {
+			t.Errorf("test %d: valid manifest rejected: %v", i, err)
+		}
+		if !tt.valid && !errors.Is(err, errInvalidManifest) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, errInvalidManifest)
+		}
+	}
+}
+
+// Tests that head anchored body retrievals skip the blocks reorged out of the
+// requester's chain, but only if the requester's head is known canonical.
+func TestGetFreshBlockBodies(t *testing.T) {
+	chain := newTestChain(6)
+
+	// Create a sidechain block at height 3 and one above the requester's head
+	side := types.EmptyHeader()
+	side.SetNumber(big.NewInt(3))
+	side.SetDifficulty(big.NewInt(2))
+	side.SetParentHash(chain.canonical[2].Hash())
+	chain.headers[side.Hash()] = side
+
+	future := types.EmptyHeader()
+	future.SetNumber(big.NewInt(6))
+	future.SetDifficulty(big.NewInt(2))
+	chain.headers[future.Hash()] = future
+
+	hashes := []common.Hash{chain.canonical[2].Hash(), side.Hash(), chain.canonical[3].Hash(), future.Hash()}
+	for _, hash := range hashes {
+		chain.addBody(hash, &types.Body{Transactions: newTestTransactions(1)})
+	}
+	var (
+		head  = chain.canonical[5]
+		fresh = []common.Hash{hashes[0], hashes[2], hashes[3]}
+	)
+	tests := []struct {
+		head   common.Hash
+		number uint64
+		bodies []common.Hash
+		stale  []common.Hash
+	}{
+		{head.Hash(), 5, fresh, []common.Hash{side.Hash()}}, // Anchored, sidechain block skipped
+		{common.Hash{0xff}, 5, hashes, nil},                 // Unknown requester head, everything served
+		{side.Hash(), 3, hashes, nil},                       // Non-canonical requester head, everything served
+		{chain.canonical[2].Hash(), 2, hashes, nil},         // Blocks above the requester's head are not judged
+	}
+	for i, tt := range tests {
+		response, err := answerGetFreshBlockBodiesQuery(chain, GetFreshBlockBodiesPacket{Head: tt.head, Number: tt.number, Hashes: hashes}, TruncateResponse)
+		if err != nil {
+			t.Fatalf("test %d: failed to answer query: %v", i, err)
+		}
+		if !reflect.DeepEqual(response.Stale, tt.stale) {
+			t.Errorf("test %d: stale mismatch: have %x, want %x", i, response.Stale, tt.stale)
+		}
+		if len(response.Bodies) != len(tt.bodies) {
+			t.Errorf("test %d: body count mismatch: have %d, want %d", i, len(response.Bodies), len(tt.bodies))
+			continue
+		}
+		for j, hash := range tt.bodies {
+			if !bytes.Equal(response.Bodies[j], chain.bodies[hash]) {
+				t.Errorf("test %d, body %d: content mismatch", i, j)
+			}
+		}
+	}
+	// Oversized queries are rejected outright
+	oversized := GetFreshBlockBodiesPacket{Head: head.Hash(), Number: 5, Hashes: make([]common.Hash, maxBodiesServe+1)}
+	if _, err := answerGetFreshBlockBodiesQuery(chain, oversized, TruncateResponse); !errors.Is(err, errInvalidQuery) {
+		t.Errorf("error mismatch: have %v, want %v", err, errInvalidQuery)
+	}
+}
+
+// Tests that head anchored body replies served from RLP decode into full bodies
+// on the requester side, along with the stale markers.
+func TestFreshBlockBodiesRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		local  = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), net, nil)
+		remote = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x02}, "peer", nil), app, nil)
+		head   = common.Hash{0x01}
+		hashes = []common.Hash{{0x02}, {0x03}}
+		txs    = newTestTransactions(2)
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	go local.RequestFreshBodies(head, 7, hashes)
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	var query GetFreshBlockBodiesPacket66
+	if err := msg.Decode(&query); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	if query.Head != head || query.Number != 7 || !reflect.DeepEqual(query.Hashes, hashes) {
+		t.Fatalf("request mismatch: have %+v", query.GetFreshBlockBodiesPacket)
+	}
+	body, _ := rlp.EncodeToBytes(&BlockBody{Transactions: txs})
+	go remote.ReplyFreshBlockBodiesRLP(query.RequestId, FreshBlockBodiesRLPPacket{
+		Bodies: []rlp.RawValue{body},
+		Stale:  hashes[1:],
+	})
+	backend := new(mockBackend)
+	if err := handleMessage(backend, local); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+	}
+	reply := backend.handled[0].(*FreshBlockBodiesPacket)
+	if !reflect.DeepEqual(reply.Stale, hashes[1:]) {
+		t.Errorf("stale mismatch: have %x, want %x", reply.Stale, hashes[1:])
+	}
+	if len(reply.Bodies) != 1 || len(reply.Bodies[0].Transactions) != len(txs) {
+		t.Fatalf("body mismatch: have %+v", reply.Bodies)
+	}
+	for i, tx := range txs {
+		if reply.Bodies[0].Transactions[i].Hash() != tx.Hash() {
+			t.Errorf("tx %d: hash mismatch: have %x, want %x", i, reply.Bodies[0].Transactions[i].Hash(), tx.Hash())
+		}
+	}
+}
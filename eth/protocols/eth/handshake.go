@@ -17,62 +17,401 @@
 package eth
 
 import (
+	"errors"
 	"fmt"
 	"math/big"
 	"time"
 
 	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
 	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
 )
 
-const (
-	// handshakeTimeout is the maximum allowed time for the `eth` handshake to
-	// complete before dropping the connection.= as malicious.
-	handshakeTimeout = 5 * time.Second
-)
+// HandshakeTrace is a set of optional hooks invoked with a timestamp as a peer
+// progresses through connection establishment, allowing to analyse where the
+// handshake time goes. Hooks left unset are skipped. The status hooks may run
+// concurrently, as the status messages are exchanged in parallel.
+type HandshakeTrace struct {
+	Connected       func(peer *Peer, at time.Time) // Transport connected, protocol started
+	StatusSent      func(peer *Peer, at time.Time) // Local status delivered to the remote peer
+	StatusReceived  func(peer *Peer, at time.Time) // Remote status read from the wire
+	StatusValidated func(peer *Peer, at time.Time) // Remote status accepted
+	Registered      func(peer *Peer, at time.Time) // Peer registered with the backend
+}
 
-// Handshake executes the eth protocol handshake, negotiating version number,
-// network IDs, difficulties, head and genesis blocks.
-func (p *Peer) Handshake(network uint64, slices []common.Location, entropy *big.Int, head common.Hash, genesis common.Hash) error {
-	// Send out own handshake in a new thread
-	errc := make(chan error, 2)
-
-	var status StatusPacket // safe to read after two values have been received from errc
-
-	go func() {
-		errc <- p2p.Send(p.rw, StatusMsg, &StatusPacket{
-			ProtocolVersion: uint32(p.version),
-			NetworkID:       network,
-			SlicesRunning:   slices,
-			Location:        common.NodeLocation.Name(),
-			Entropy:         entropy,
-			Head:            head,
-			Genesis:         genesis,
-		})
-	}()
-	go func() {
-		errc <- p.readStatus(network, &status, genesis)
-	}()
-	timeout := time.NewTimer(handshakeTimeout)
+// trace invokes the given handshake hook for the peer, if set.
+func (p *Peer) trace(hook func(*Peer, time.Time)) {
+	if hook != nil {
+		hook(p, time.Now())
+	}
+}
+
+// statusChain defines the chain methods needed to assemble the local status.
+type statusChain interface {
+	// Genesis retrieves the genesis block of the chain.
+	Genesis() *types.Block
+
+	// CurrentHeader retrieves the current head header of the canonical chain.
+	CurrentHeader() *types.Header
+
+	// CurrentLogEntropy retrieves the entropy of the current head.
+	CurrentLogEntropy() *big.Int
+}
+
+// NewStatusPacket assembles the status announced to remote peers from the state
+// of the local chain, making sure it passes the same validation the remote side
+// will subject it to.
+func NewStatusPacket(chain statusChain, version uint, network uint64, slices []common.Location, config *Config) (*StatusPacket, error) {
+	status := &StatusPacket{
+		ProtocolVersion: uint32(version),
+		NetworkID:       network,
+		Location:        common.NodeLocation.Name(),
+		SlicesRunning:   slices,
+		Entropy:         chain.CurrentLogEntropy(),
+		Head:            chain.CurrentHeader().Hash(),
+		Genesis:         chain.Genesis().Hash(),
+		Experimental:    config.Experimental,
+	}
+	// Only advertise a custom message size limit, keeping the status of nodes
+	// running with the default compatible with peers unaware of the field
+	if size := config.MaxMessageSize; size != 0 && size != maxMessageSize {
+		status.MaxMessageSize = size
+	}
+	// Only eth/67 statuses carry the client version, eth/66 peers predating the
+	// field would reject the status
+	if version >= ETH67 {
+		status.ClientVersion = sanitizeClientVersion(config.ClientVersion)
+	}
+	if version >= ETH67 && config.Light {
+		status.Light = true
+	} else if version >= ETH67 {
+		status.Optional = localOptionalMessages(version)
+	}
+	if err := validateStatus(status, status, false); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// mainNetworkID is the network ID of the main network, on which the network IDs
+// are always matched strictly.
+const mainNetworkID = 1
+
+// knownNetworks are the network IDs of the networks this binary ships with.
+var knownNetworks = map[uint64]string{
+	1:    "colosseum",
+	2:    "garden",
+	3:    "orchard",
+	4:    "local",
+	5:    "lighthouse",
+	1337: "developer",
+}
+
+// permitNetwork reports whether a status announcing a different network ID than
+// the local one may be accepted nonetheless, the remote network being unknown
+// and the local node running in permissive mode off the main network.
+func permitNetwork(status, local *StatusPacket, permissive bool) bool {
+	if !permissive || local.NetworkID == mainNetworkID {
+		return false
+	}
+	_, known := knownNetworks[status.NetworkID]
+	return !known
+}
+
+// validateStatus checks a status against the local one. Both nodes must run the
+// same protocol version on the same network, location and genesis, and announce
+// a sane set of running slices. Unknown networks are tolerated if permissive.
+func validateStatus(status, local *StatusPacket, permissive bool) error {
+	if status.NetworkID != local.NetworkID && !permitNetwork(status, local, permissive) {
+		return fmt.Errorf("%w: %d (!= %d)", errNetworkIDMismatch, status.NetworkID, local.NetworkID)
+	}
+	if status.ProtocolVersion != local.ProtocolVersion {
+		return fmt.Errorf("%w: %d (!= %d)", errProtocolVersionMismatch, status.ProtocolVersion, local.ProtocolVersion)
+	}
+	if status.Location != local.Location {
+		return fmt.Errorf("%w: %s (!= %s)", errLocationMismatch, status.Location, local.Location)
+	}
+	if status.Genesis != local.Genesis {
+		return fmt.Errorf("%w: %x (!= %x)", errGenesisMismatch, status.Genesis, local.Genesis)
+	}
+	if err := validateSlicesRunning(status.SlicesRunning); err != nil {
+		return fmt.Errorf("%w: %v", errSlicesRunningRejected, err)
+	}
+	if err := validateEntropy(status.Entropy); err != nil {
+		return err
+	}
+	if size := status.MaxMessageSize; size != 0 && (size < minMessageSize || size > absoluteMaxMessageSize) {
+		return fmt.Errorf("%w: %d not in [%d, %d]", errMessageSizeRejected, size, minMessageSize, absoluteMaxMessageSize)
+	}
+	if len(status.ClientVersion) > maxClientVersionLength {
+		return fmt.Errorf("%w: %d > %d", errClientVersionRejected, len(status.ClientVersion), maxClientVersionLength)
+	}
+	if len(status.Optional) > maxOptionalMessages {
+		return fmt.Errorf("%w: %d > %d", errOptionalRejected, len(status.Optional), maxOptionalMessages)
+	}
+	return nil
+}
+
+// validateSlicesRunning checks the slices a peer advertises to be running, as
+// they steer the routing of the location specific retrievals. They must be
+// distinct zones of the hierarchy, so their number is bounded by its size.
+func validateSlicesRunning(slices []common.Location) error {
+	if len(slices) == 0 {
+		return errors.New("no slices running")
+	}
+	if len(slices) > maxSlicesRunning {
+		return fmt.Errorf("%d slices running, hierarchy holds %d", len(slices), maxSlicesRunning)
+	}
+	seen := make(map[string]struct{}, len(slices))
+	for _, slice := range slices {
+		if err := validateLocation(slice); err != nil {
+			return err
+		}
+		if len(slice) != common.HierarchyDepth-1 {
+			return fmt.Errorf("slice %v not a zone", slice)
+		}
+		if _, ok := seen[string(slice)]; ok {
+			return fmt.Errorf("slice %v duplicated", slice)
+		}
+		seen[string(slice)] = struct{}{}
+	}
+	return nil
+}
+
+// validateEntropy checks the entropy advertised by a peer to be non-negative
+// and within the bit length any chain can accumulate, so that absurd values
+// can't bog down the entropy comparisons. A missing entropy is left to the
+// callers to handle.
+func validateEntropy(entropy *big.Int) error {
+	if entropy == nil {
+		return nil
+	}
+	if entropy.Sign() < 0 {
+		return fmt.Errorf("%w: negative %v", errEntropyRejected, entropy)
+	}
+	if bits := entropy.BitLen(); bits > maxEntropyBits {
+		return fmt.Errorf("%w: %d bits > %d", errEntropyRejected, bits, maxEntropyBits)
+	}
+	return nil
+}
+
+// sanitizeClientVersion strips a client version string of everything but the
+// printable ASCII characters, so it's safe to log, and caps its length.
+func sanitizeClientVersion(version string) string {
+	clean := make([]byte, 0, len(version))
+	for i := 0; i < len(version) && len(clean) < maxClientVersionLength; i++ {
+		if c := version[i]; c >= 0x20 && c < 0x7f {
+			clean = append(clean, c)
+		}
+	}
+	return string(clean)
+}
+
+// negotiateMessageSize returns the message size limit of a connection, being
+// the lower of the limits advertised by the two sides. Peers not advertising a
+// limit are assumed to use the default one.
+func negotiateMessageSize(local, remote uint64) uint64 {
+	if local == 0 {
+		local = maxMessageSize
+	}
+	if remote == 0 {
+		remote = maxMessageSize
+	}
+	if remote < local {
+		return remote
+	}
+	return local
+}
+
+// Handshake executes the eth protocol handshake, announcing the local status and
+// negotiating version number, network IDs, difficulties, head and genesis blocks
+// with the remote peer. Connections looping back to the local node, identified
+// by self, are rejected before any status is exchanged.
+//
+// Peers reconnecting within the session lifetime of an eth/67 session may resume
+// it, only exchanging the mutable head and entropy. If either side doesn't know
+// the session, both fall back to exchanging the full statuses. Older versions
+// never resume, as their peers may predate the session fields of the status.
+func (p *Peer) Handshake(self enode.ID, local *StatusPacket) error {
+	if p.Peer.ID() == self {
+		return fmt.Errorf("%w: %v", errSelfConnection, self)
+	}
+	if uint(local.ProtocolVersion) != p.version {
+		return fmt.Errorf("%w: local %d (!= %d)", errProtocolVersionMismatch, local.ProtocolVersion, p.version)
+	}
+	if err := validateStatus(local, local, false); err != nil {
+		return fmt.Errorf("invalid local status: %w", err)
+	}
+	var (
+		key    = sessionKey{self: self, remote: p.Peer.ID()}
+		digest = statusDigest(local)
+		resume *session
+		full   = local
+	)
+	resumable := p.version >= ETH67 && p.config.SessionLifetime > 0
+	if resumable {
+		resume = sessions.lookup(key, digest)
+
+		full = new(StatusPacket)
+		*full = *local
+		full.SessionNonce = sessionNonce()
+	}
+	out := full
+	if resume != nil {
+		out = partialStatus(local, resume.token)
+	}
+	deadline := p.config.HandshakeTimeout
+	timeout := time.NewTimer(deadline)
 	defer timeout.Stop()
-	for i := 0; i < 2; i++ {
+
+	var status StatusPacket
+	if err := p.exchangeStatus(out, local, &status, resumable, timeout.C, deadline); err != nil {
+		return err
+	}
+	// If either side failed to resume the session, the full statuses are needed:
+	// a partial status not echoed by the remote side is followed by the full one,
+	// and an unknown partial one from the remote side is replaced by its full one
+	var (
+		resent = out != full && status.SessionToken != resume.token
+		hit    = status.partial() && resume != nil && status.SessionToken == resume.token
+		reread = status.partial() && !hit
+	)
+	if resent || reread {
+		var send, recv *StatusPacket
+		if resent {
+			send = full
+		}
+		if reread {
+			status, recv = StatusPacket{}, &status
+		}
+		if err := p.exchangeStatus(send, local, recv, false, timeout.C, deadline); err != nil {
+			return err
+		}
+	}
+	switch {
+	case hit:
+		// Restore the immutable fields of the remote status from the session
+		resumed := *resume.status
+		resumed.Entropy, resumed.Head = status.Entropy, status.Head
+		status = resumed
+
+		sessions.resume(key)
+		p.trace(p.config.Trace.StatusValidated)
+
+	case resumable && status.SessionNonce != (common.Hash{}):
+		remote := status
+		sessions.store(key, &session{
+			token:  sessionToken(full.SessionNonce, status.SessionNonce),
+			digest: digest,
+			status: &remote,
+		})
+
+	default:
+		sessions.drop(key)
+	}
+	if resumable {
+		p.session = &key
+	}
+	// Decode the status entropy
+	p.entropy, p.head = status.Entropy, status.Head
+	if status.Entropy != nil {
+		p.maxEntropy, p.maxNumber = new(big.Int).Set(status.Entropy), nil
+	}
+	p.slicesRunning = status.SlicesRunning
+	p.status = &status
+	p.fresh = true
+	p.announced = &StatusPacket{Entropy: local.Entropy, Head: local.Head}
+	p.experimental = local.Experimental && status.Experimental && p.version >= ETH66
+	p.rw.setLimit(negotiateMessageSize(local.MaxMessageSize, status.MaxMessageSize))
+	if p.version >= ETH67 {
+		p.clientVersion = sanitizeClientVersion(status.ClientVersion)
+		p.light = status.Light
+		p.optional = make(map[uint64]struct{}, len(status.Optional))
+		for _, code := range status.Optional {
+			if isOptional(code) {
+				p.optional[code] = struct{}{}
+			}
+		}
+	}
+	p.observe(PeerSignal{Type: PeerSignalHandshake, Entropy: status.Entropy})
+	return nil
+}
+
+// handleDuplicateStatus handles a status received as the first message after
+// the handshake, which some buggy clients send twice back-to-back. Instead of
+// dropping the peer for an unexpected message, the duplicate is checked against
+// the status of the handshake and treated as an update of the remote head.
+// Partial statuses have nothing to be checked against and are ignored.
+func handleDuplicateStatus(msg Decoder, peer *Peer) error {
+	var status StatusPacket
+	if err := msg.Decode(&status); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
+	}
+	peer.Log().Debug("Tolerating duplicate status", "head", status.Head, "partial", status.partial())
+	if status.partial() {
+		return nil
+	}
+	if err := validateStatus(&status, peer.status, peer.config.PermissiveNetwork); err != nil {
+		return err
+	}
+	if status.Entropy == nil {
+		return nil
+	}
+	if err := peer.TrackEntropy(nil, status.Entropy); err != nil {
+		return err
+	}
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+
+	peer.head, peer.entropy, peer.receivedHeadAt = status.Head, status.Entropy, time.Now()
+	return nil
+}
+
+// exchangeStatus concurrently sends the out status to the remote peer and reads
+// its status into in, skipping either if nil. The connection is torn down if the
+// exchange doesn't complete before the timeout fires.
+func (p *Peer) exchangeStatus(out, local, in *StatusPacket, partial bool, timeout <-chan time.Time, deadline time.Duration) error {
+	var (
+		errc    = make(chan error, 2)
+		pending int
+	)
+	if out != nil {
+		pending++
+		go func() {
+			err := send(p.rw, StatusMsg, out)
+			if err == nil {
+				p.trace(p.config.Trace.StatusSent)
+			}
+			errc <- err
+		}()
+	}
+	if in != nil {
+		pending++
+		go func() {
+			errc <- p.readStatus(local, in, partial)
+		}()
+	}
+	for ; pending > 0; pending-- {
 		select {
 		case err := <-errc:
 			if err != nil {
 				return err
 			}
-		case <-timeout.C:
-			return p2p.DiscReadTimeout
+		case <-timeout:
+			// Tear the connection down so the pending status read and write
+			// are released instead of lingering on a silent peer
+			p.Disconnect(p2p.DiscReadTimeout)
+			return fmt.Errorf("%w: timeout after %v", errNoStatusMsg, deadline)
 		}
 	}
-	// Decode the status entropy
-	p.entropy, p.head = status.Entropy, status.Head
-	p.slicesRunning = status.SlicesRunning
 	return nil
 }
 
-// readStatus reads the remote handshake message.
-func (p *Peer) readStatus(network uint64, status *StatusPacket, genesis common.Hash) error {
+// readStatus reads the remote handshake message and validates it against the
+// local status. Partial statuses resuming a session are accepted unvalidated if
+// allowed, the caller being responsible for resolving them.
+func (p *Peer) readStatus(local *StatusPacket, status *StatusPacket, partial bool) error {
 	msg, err := p.rw.ReadMsg()
 	if err != nil {
 		return err
@@ -84,24 +423,20 @@ func (p *Peer) readStatus(network uint64, status *StatusPacket, genesis common.H
 		return fmt.Errorf("%w: %v > %v", errMsgTooLarge, msg.Size, maxMessageSize)
 	}
 	// Decode the handshake and make sure everything matches
-	if err := msg.Decode(&status); err != nil {
-		return fmt.Errorf("%w: message %v: %v", errDecode, msg, err)
-	}
-	if status.NetworkID != network {
-		return fmt.Errorf("%w: %d (!= %d)", errNetworkIDMismatch, status.NetworkID, network)
+	if err := activeSerializer().Decode(msg, &status); err != nil {
+		return fmt.Errorf("%w: message %v: %w", errDecode, msg, err)
 	}
-	if uint(status.ProtocolVersion) != p.version {
-		return fmt.Errorf("%w: %d (!= %d)", errProtocolVersionMismatch, status.ProtocolVersion, p.version)
-	}
-	if status.Location != common.NodeLocation.Name() {
-		return fmt.Errorf("%w: %s (!= %s)", errLocationMismatch, status.Location, common.NodeLocation.Name())
+	p.trace(p.config.Trace.StatusReceived)
+
+	if partial && status.partial() {
+		return validateEntropy(status.Entropy)
 	}
-	if status.Genesis != genesis {
-		return fmt.Errorf("%w: %x (!= %x)", errGenesisMismatch, status.Genesis, genesis)
+	if err := validateStatus(status, local, p.config.PermissiveNetwork); err != nil {
+		return err
 	}
-	// sanity check slices running
-	if len(status.SlicesRunning) == 0 || len(status.SlicesRunning) > common.NumRegionsInPrime*common.NumZonesInRegion {
-		return fmt.Errorf("%w: %v", errSlicesRunningRejected, fmt.Errorf("slices running sanity check failed"))
+	if status.NetworkID != local.NetworkID {
+		p.Log().Warn("Accepting peer on unrecognized network", "network", status.NetworkID, "local", local.NetworkID, "genesis", status.Genesis)
 	}
+	p.trace(p.config.Trace.StatusValidated)
 	return nil
 }
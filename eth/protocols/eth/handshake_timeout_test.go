@@ -0,0 +1,328 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// Tests that a peer withholding its Status message is dropped once the
+// configured handshake timeout expires.
+func TestHandshakeTimeout(t *testing.T) {
+	config := DefaultConfig
+	config.HandshakeTimeout = 150 * time.Millisecond
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+
+	peer := newPeer(ETH66, p2p.NewPeerPipe(enode.ID{}, "peer", nil, net), net, nil, &config)
+	defer peer.Close()
+
+	// Consume our own status but never answer it
+	go app.ReadMsg()
+
+	start := time.Now()
+	err := peer.Handshake(enode.ID{0xff}, newTestStatus(t, common.Location{0, 0}))
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, errNoStatusMsg) {
+		t.Fatalf("wrong error: have %v, want %v", err, errNoStatusMsg)
+	}
+	if !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("error not marked as timeout: %v", err)
+	}
+	if elapsed < config.HandshakeTimeout || elapsed > 2*config.HandshakeTimeout {
+		t.Errorf("timeout fired after %v, want ~%v", elapsed, config.HandshakeTimeout)
+	}
+	// The connection must have been torn down
+	if _, err := app.ReadMsg(); err != p2p.ErrPipeClosed {
+		t.Errorf("connection not closed: have %v, want %v", err, p2p.ErrPipeClosed)
+	}
+}
+
+// Tests that a connection looping back to the local node is rejected before any
+// status is exchanged.
+func TestHandshakeSelfConnection(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+
+	self := enode.ID{0x01}
+	peer := NewPeer(ETH66, p2p.NewPeerPipe(self, "self", nil, net), net, nil)
+	defer peer.Close()
+
+	// The pipe is unbuffered, so a status send would block the handshake
+	err := peer.Handshake(self, newTestStatus(t, common.Location{0, 0}))
+	if !errors.Is(err, errSelfConnection) {
+		t.Fatalf("wrong error: have %v, want %v", err, errSelfConnection)
+	}
+}
+
+// Tests that the handshake trace hooks fire in order, with monotonic timestamps,
+// as a peer is connected, handshaken and registered.
+func TestHandshakeTrace(t *testing.T) {
+	var (
+		remote = enode.ID{0x01}
+		lock   sync.Mutex
+		stages []string
+		times  []time.Time
+	)
+	hook := func(stage string) func(*Peer, time.Time) {
+		return func(peer *Peer, at time.Time) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			stages = append(stages, stage)
+			times = append(times, at)
+		}
+	}
+	config := DefaultConfig
+	config.Trace = HandshakeTrace{
+		Connected:       hook("connected"),
+		StatusSent:      hook("sent"),
+		StatusReceived:  hook("received"),
+		StatusValidated: hook("validated"),
+		Registered:      hook("registered"),
+	}
+	status := newTestStatus(t, common.Location{0, 0})
+	backend := &mockBackend{
+		run: func(peer *Peer, handler Handler) error {
+			if err := peer.Handshake(enode.ID{0xff}, status); err != nil {
+				return err
+			}
+			return handler(peer)
+		},
+	}
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+
+	var run func(*p2p.Peer, p2p.MsgReadWriter) error
+	for _, proto := range MakeProtocols(backend, 1, &config, nil) {
+		if proto.Version == ETH66 {
+			run = proto.Run
+		}
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- run(p2p.NewPeer(remote, "peer", nil), net) }()
+
+	// Consume the local status, then answer it after a short delay so that the
+	// send and receive stages are ordered
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read status: %v", err)
+	}
+	msg.Discard()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := p2p.Send(app, StatusMsg, status); err != nil {
+		t.Fatalf("failed to send status: %v", err)
+	}
+	// Wait for the peer to be registered and tear it down
+	deadline := time.Now().Add(time.Second)
+	for {
+		lock.Lock()
+		done := len(stages) == 5
+		lock.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("handshake stages not completed: %v", stages)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	app.Close()
+	<-errc
+
+	want := []string{"connected", "sent", "received", "validated", "registered"}
+	if !reflect.DeepEqual(stages, want) {
+		t.Fatalf("stage order mismatch: have %v, want %v", stages, want)
+	}
+	for i := 1; i < len(times); i++ {
+		if times[i].Before(times[i-1]) {
+			t.Errorf("stage %s timestamp %v before %s at %v", stages[i], times[i], stages[i-1], times[i-1])
+		}
+	}
+}
+
+// Tests that the status assembled from the chain state passes its own validation
+// and survives the wire, and that invalid local setups are caught upfront.
+func TestNewStatusPacket(t *testing.T) {
+	chain := newTestChain(4)
+
+	status, err := NewStatusPacket(chain, ETH66, 1, []common.Location{{0, 0}}, &DefaultConfig)
+	if err != nil {
+		t.Fatalf("failed to assemble status: %v", err)
+	}
+	if status.Head != chain.CurrentHeader().Hash() || status.Genesis != chain.canonical[0].Hash() || status.Entropy.Uint64() != 4 {
+		t.Errorf("chain state mismatch: have head %x, genesis %x, entropy %v", status.Head, status.Genesis, status.Entropy)
+	}
+	enc, err := rlp.EncodeToBytes(status)
+	if err != nil {
+		t.Fatalf("failed to encode status: %v", err)
+	}
+	var dec StatusPacket
+	if err := rlp.DecodeBytes(enc, &dec); err != nil {
+		t.Fatalf("failed to decode status: %v", err)
+	}
+	if !reflect.DeepEqual(&dec, status) {
+		t.Errorf("status mismatch after round-trip: have %+v, want %+v", dec, status)
+	}
+	if err := validateStatus(&dec, status, false); err != nil {
+		t.Errorf("round-tripped status rejected: %v", err)
+	}
+	// Statuses announcing bogus slices can't be assembled
+	for i, slices := range [][]common.Location{nil, {{0, byte(common.NumZonesInRegion)}}} {
+		if _, err := NewStatusPacket(chain, ETH66, 1, slices, &DefaultConfig); !errors.Is(err, errSlicesRunningRejected) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, errSlicesRunningRejected)
+		}
+	}
+}
+
+// Tests that remote statuses are rejected on any mismatch with the local one.
+func TestValidateStatus(t *testing.T) {
+	local := newTestStatus(t, common.Location{0, 0})
+
+	tests := []struct {
+		modify func(status *StatusPacket)
+		err    error
+	}{
+		{func(status *StatusPacket) {}, nil},
+		{func(status *StatusPacket) { status.NetworkID++ }, errNetworkIDMismatch},
+		{func(status *StatusPacket) { status.ProtocolVersion = ETH65 }, errProtocolVersionMismatch},
+		{func(status *StatusPacket) { status.Location = "cyprus2" }, errLocationMismatch},
+		{func(status *StatusPacket) { status.Genesis = common.Hash{0x01} }, errGenesisMismatch},
+		{func(status *StatusPacket) { status.SlicesRunning = nil }, errSlicesRunningRejected},
+		{func(status *StatusPacket) { status.MaxMessageSize = minMessageSize }, nil},
+		{func(status *StatusPacket) { status.MaxMessageSize = absoluteMaxMessageSize }, nil},
+		{func(status *StatusPacket) { status.MaxMessageSize = minMessageSize - 1 }, errMessageSizeRejected},
+		{func(status *StatusPacket) { status.MaxMessageSize = absoluteMaxMessageSize + 1 }, errMessageSizeRejected},
+		{func(status *StatusPacket) { status.ClientVersion = strings.Repeat("a", maxClientVersionLength) }, nil},
+		{func(status *StatusPacket) { status.ClientVersion = strings.Repeat("a", maxClientVersionLength+1) }, errClientVersionRejected},
+	}
+	for i, tt := range tests {
+		remote := *local
+		tt.modify(&remote)
+		if err := validateStatus(&remote, local, false); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+// Tests that remote statuses advertising more slices than the hierarchy holds,
+// duplicated or invalid ones are rejected.
+func TestValidateSlicesRunning(t *testing.T) {
+	local := newTestStatus(t, common.Location{0, 0})
+
+	var all []common.Location
+	for region := 0; region < common.NumRegionsInPrime; region++ {
+		for zone := 0; zone < common.NumZonesInRegion; zone++ {
+			all = append(all, common.Location{byte(region), byte(zone)})
+		}
+	}
+	tests := []struct {
+		slices []common.Location
+		err    error
+	}{
+		// Valid slice sets, up to the whole hierarchy
+		{[]common.Location{{0, 0}}, nil},
+		{[]common.Location{{0, 1}, {2, 2}}, nil},
+		{all, nil},
+
+		// Slice sets exceeding the hierarchy
+		{append(all, common.Location{0, 0}), errSlicesRunningRejected},
+		{append(append([]common.Location{}, all...), all...), errSlicesRunningRejected},
+
+		// Duplicated or invalid slices
+		{[]common.Location{{0, 1}, {0, 1}}, errSlicesRunningRejected},
+		{[]common.Location{{0, 0}, {0, byte(common.NumZonesInRegion)}}, errSlicesRunningRejected},
+		{[]common.Location{{byte(common.NumRegionsInPrime), 0}}, errSlicesRunningRejected},
+		{[]common.Location{{0, 0}, {0}}, errSlicesRunningRejected},
+		{[]common.Location{{0, 0}, {}}, errSlicesRunningRejected},
+		{[]common.Location{{0, 0, 0}}, errSlicesRunningRejected},
+	}
+	for i, tt := range tests {
+		remote := *local
+		remote.SlicesRunning = tt.slices
+		if err := validateStatus(&remote, local, false); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+// Tests that the client versions advertised in the eth/67 handshake are
+// sanitized and recorded on the peers at both ends, and that older statuses
+// don't carry them.
+func TestHandshakeClientVersion(t *testing.T) {
+	status := func(version uint, client string) *StatusPacket {
+		config := DefaultConfig
+		config.ClientVersion = client
+
+		status, err := NewStatusPacket(newTestChain(0), version, 1, []common.Location{{0, 0}}, &config)
+		if err != nil {
+			t.Fatalf("failed to assemble eth/%d status: %v", version, err)
+		}
+		return status
+	}
+	client := "go-quai/v0.1.0\x1b[31m/linux-amd64\n"
+	if legacy := status(ETH66, client); legacy.ClientVersion != "" {
+		t.Errorf("eth/66 status carries client version %q", legacy.ClientVersion)
+	}
+	local := status(ETH67, client)
+	remote := status(ETH67, "go-quai/v0.2.0/"+strings.Repeat("x", 2*maxClientVersionLength))
+
+	if want := "go-quai/v0.1.0[31m/linux-amd64"; local.ClientVersion != want {
+		t.Errorf("local status version mismatch: have %q, want %q", local.ClientVersion, want)
+	}
+	if len(remote.ClientVersion) != maxClientVersionLength {
+		t.Errorf("remote status version length mismatch: have %d, want %d", len(remote.ClientVersion), maxClientVersionLength)
+	}
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		localPeer  = NewPeer(ETH67, p2p.NewPeer(enode.ID{0x01}, "peer", nil), net, nil)
+		remotePeer = NewPeer(ETH67, p2p.NewPeer(enode.ID{0x02}, "peer", nil), app, nil)
+	)
+	defer localPeer.Close()
+	defer remotePeer.Close()
+
+	errc := make(chan error, 1)
+	go func() { errc <- remotePeer.Handshake(enode.ID{0xff}, remote) }()
+	if err := localPeer.Handshake(enode.ID{0xfe}, local); err != nil {
+		t.Fatalf("local handshake failed: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("remote handshake failed: %v", err)
+	}
+	if have := localPeer.ClientVersion(); have != remote.ClientVersion {
+		t.Errorf("local peer version mismatch: have %q, want %q", have, remote.ClientVersion)
+	}
+	if have := remotePeer.ClientVersion(); have != local.ClientVersion {
+		t.Errorf("remote peer version mismatch: have %q, want %q", have, local.ClientVersion)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/crypto"
+	"github.com/dominant-strategies/go-quai/ethdb/memorydb"
+	"github.com/dominant-strategies/go-quai/rlp"
+	"github.com/dominant-strategies/go-quai/trie"
+)
+
+// proofList collects the trie nodes of a merkle proof, in path order.
+type proofList [][]byte
+
+func (l *proofList) Put(key []byte, value []byte) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *proofList) Delete(key []byte) error {
+	return errors.New("deletion not supported")
+}
+
+// proveManifest derives the root of a block manifest the same way the headers
+// commit to it, along with the merkle proof of the entry at the given index.
+func proveManifest(manifest types.BlockManifest, index int) (common.Hash, [][]byte, error) {
+	tr, err := trie.New(common.Hash{}, trie.NewDatabase(memorydb.New()))
+	if err != nil {
+		return common.Hash{}, nil, err
+	}
+	root := types.DeriveSha(manifest, tr)
+
+	var proof proofList
+	if err := tr.Prove(rlp.AppendUint64(nil, uint64(index)), 0, &proof); err != nil {
+		return common.Hash{}, nil, err
+	}
+	return root, proof, nil
+}
+
+// VerifyEtxManifestProof checks that a manifest proof shows the block of the
+// source shard at the given location rolled up into the dominant block of the
+// given header, referencing the ETXs it emitted.
+func VerifyEtxManifestProof(header *types.Header, location common.Location, subHash common.Hash, proof *EtxManifestProofPacket) error {
+	if err := validateLocation(location); err != nil {
+		return err
+	}
+	if len(location) == 0 {
+		return fmt.Errorf("%w: prime has no dominant chain", errInvalidLocation)
+	}
+	if root := header.ManifestHash(location.Context()); proof.Root != root {
+		return fmt.Errorf("%w: root %x, header commits to %x", errInvalidManifestProof, proof.Root, root)
+	}
+	if loc := header.Location(); len(loc) < len(location) || !loc[:len(location)].Equal(location) {
+		return fmt.Errorf("%w: dominant block at %v not coincident with %v", errInvalidManifestProof, header.Location(), location)
+	}
+	nodes := memorydb.New()
+	for _, node := range proof.Proof {
+		nodes.Put(crypto.Keccak256(node), node)
+	}
+	value, err := trie.VerifyProof(proof.Root, rlp.AppendUint64(nil, proof.Index), nodes)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidManifestProof, err)
+	}
+	want, _ := rlp.EncodeToBytes(subHash)
+	if !bytes.Equal(value, want) {
+		return fmt.Errorf("%w: block %x not at index %d", errInvalidManifestProof, subHash, proof.Index)
+	}
+	return nil
+}
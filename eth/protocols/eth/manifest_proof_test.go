@@ -0,0 +1,204 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/trie"
+)
+
+// newManifestChain creates a test chain run by region-0, with a dominant block
+// coincident with zone-0-1 rolling up a manifest of the given size.
+func newManifestChain(size int) (*testChain, *types.Header, types.BlockManifest) {
+	chain := newTestChain(1)
+
+	manifest := make(types.BlockManifest, size)
+	for i := range manifest {
+		manifest[i] = common.BigToHash(big.NewInt(int64(i + 1)))
+	}
+	header := types.EmptyHeader()
+	header.SetNumber(big.NewInt(2))
+	header.SetLocation(common.Location{0, 1})
+	header.SetManifestHash(types.DeriveSha(manifest, trie.NewStackTrie(nil)), common.ZONE_CTX)
+
+	chain.headers[header.Hash()] = header
+	chain.addBody(header.Hash(), &types.Body{SubManifest: manifest})
+	return chain, header, manifest
+}
+
+// Tests that manifest proofs are served for the blocks rolled up into dominant
+// blocks, and verify against the dominant headers.
+func TestGetEtxManifestProof(t *testing.T) {
+	defer func(old common.Location) { common.NodeLocation = old }(common.NodeLocation)
+	common.NodeLocation = common.Location{0}
+
+	// Span the reordered insertion of the first 128 manifest entries
+	chain, header, manifest := newManifestChain(130)
+
+	tests := []struct {
+		query    GetEtxManifestProofPacket
+		root     bool  // Whether the manifest root is expected
+		included bool  // Whether the inclusion proof is expected
+		err      error // Error expected when answering the query
+	}{
+		// Blocks rolled up at the start, middle and end of the manifest
+		{GetEtxManifestProofPacket{header.Hash(), common.Location{0, 1}, manifest[0]}, true, true, nil},
+		{GetEtxManifestProofPacket{header.Hash(), common.Location{0, 1}, manifest[127]}, true, true, nil},
+		{GetEtxManifestProofPacket{header.Hash(), common.Location{0, 1}, manifest[129]}, true, true, nil},
+
+		// Blocks not rolled up, or from a shard not coincident with the dominant block
+		{GetEtxManifestProofPacket{header.Hash(), common.Location{0, 1}, common.Hash{0xff}}, true, false, nil},
+		{GetEtxManifestProofPacket{header.Hash(), common.Location{0, 0}, manifest[0]}, true, false, nil},
+
+		// Unknown dominant blocks
+		{GetEtxManifestProofPacket{common.Hash{0xff}, common.Location{0, 1}, manifest[0]}, false, false, nil},
+
+		// Shards not subordinate to the local chain, answered without a root
+		{GetEtxManifestProofPacket{header.Hash(), common.Location{1, 0}, manifest[0]}, false, false, nil},
+		{GetEtxManifestProofPacket{header.Hash(), common.Location{0}, manifest[0]}, false, false, nil},
+		{GetEtxManifestProofPacket{header.Hash(), common.Location{0, 0, 0}, manifest[0]}, false, false, errInvalidLocation},
+	}
+	for i, tt := range tests {
+		proof, err := answerGetEtxManifestProofQuery(chain, tt.query)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if root := proof.Root == header.ManifestHash(common.ZONE_CTX); root != tt.root {
+			t.Errorf("test %d: root availability mismatch: have %v, want %v", i, root, tt.root)
+		}
+		if included := len(proof.Proof) > 0; included != tt.included {
+			t.Errorf("test %d: proof availability mismatch: have %v, want %v", i, included, tt.included)
+		}
+		err = VerifyEtxManifestProof(header, tt.query.Location, tt.query.SubHash, proof)
+		if tt.included && err != nil {
+			t.Errorf("test %d: failed to verify proof: %v", i, err)
+		}
+		if !tt.included && !errors.Is(err, errInvalidManifestProof) {
+			t.Errorf("test %d: verification error mismatch: have %v, want %v", i, err, errInvalidManifestProof)
+		}
+	}
+}
+
+// Tests that tampered manifest proofs fail verification.
+func TestVerifyEtxManifestProofTampered(t *testing.T) {
+	defer func(old common.Location) { common.NodeLocation = old }(common.NodeLocation)
+	common.NodeLocation = common.Location{0}
+
+	chain, header, manifest := newManifestChain(8)
+	proof, err := answerGetEtxManifestProofQuery(chain, GetEtxManifestProofPacket{header.Hash(), common.Location{0, 1}, manifest[3]})
+	if err != nil {
+		t.Fatalf("failed to answer query: %v", err)
+	}
+	if err := VerifyEtxManifestProof(header, common.Location{0, 1}, manifest[3], proof); err != nil {
+		t.Fatalf("failed to verify untampered proof: %v", err)
+	}
+	tamper := []func(p *EtxManifestProofPacket) (common.Location, common.Hash){
+		// Proving another block
+		func(p *EtxManifestProofPacket) (common.Location, common.Hash) {
+			return common.Location{0, 1}, manifest[4]
+		},
+		// Moving the block to another index
+		func(p *EtxManifestProofPacket) (common.Location, common.Hash) {
+			p.Index = 4
+			return common.Location{0, 1}, manifest[3]
+		},
+		// Replacing the root
+		func(p *EtxManifestProofPacket) (common.Location, common.Hash) {
+			p.Root = common.Hash{0xff}
+			return common.Location{0, 1}, manifest[3]
+		},
+		// Dropping proof nodes
+		func(p *EtxManifestProofPacket) (common.Location, common.Hash) {
+			p.Proof = p.Proof[:len(p.Proof)-1]
+			return common.Location{0, 1}, manifest[3]
+		},
+		// Claiming another shard
+		func(p *EtxManifestProofPacket) (common.Location, common.Hash) {
+			return common.Location{0, 0}, manifest[3]
+		},
+	}
+	for i, fn := range tamper {
+		tampered := &EtxManifestProofPacket{Root: proof.Root, Index: proof.Index, Proof: append([][]byte{}, proof.Proof...)}
+		location, hash := fn(tampered)
+		if err := VerifyEtxManifestProof(header, location, hash, tampered); !errors.Is(err, errInvalidManifestProof) {
+			t.Errorf("tamper %d: error mismatch: have %v, want %v", i, err, errInvalidManifestProof)
+		}
+	}
+}
+
+// Tests that manifest proof requests and their replies round-trip through the
+// wire between eth/67 peers.
+func TestEtxManifestProofRoundTrip(t *testing.T) {
+	defer func(old common.Location) { common.NodeLocation = old }(common.NodeLocation)
+	common.NodeLocation = common.Location{0}
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		chain, header, manifest = newManifestChain(8)
+
+		local  = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xb8}, "peer", nil), net, nil)
+		remote = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xb9}, "peer", nil), app, nil)
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	advertiseOptional(local, GetEtxManifestProofMsg)
+	go local.RequestEtxManifestProof(header.Hash(), common.Location{0, 1}, manifest[5])
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	if msg.Code != GetEtxManifestProofMsg {
+		t.Fatalf("request code mismatch: have %#x, want %#x", msg.Code, GetEtxManifestProofMsg)
+	}
+	var query GetEtxManifestProofPacket66
+	if err := msg.Decode(&query); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	res, err := answerGetEtxManifestProofQuery(chain, query.GetEtxManifestProofPacket)
+	if err != nil {
+		t.Fatalf("failed to answer query: %v", err)
+	}
+	go remote.ReplyEtxManifestProof(query.RequestId, res)
+
+	backend := new(mockBackend)
+	if err := handleMessage(backend, local); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+	}
+	proof := backend.handled[0].(*EtxManifestProofPacket)
+	if err := VerifyEtxManifestProof(header, common.Location{0, 1}, manifest[5], proof); err != nil {
+		t.Errorf("failed to verify delivered proof: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// Tests that the message size limit of a connection is the lower of the limits
+// advertised by the two sides, defaulting for peers not advertising any.
+func TestNegotiateMessageSize(t *testing.T) {
+	tests := []struct {
+		local, remote uint64
+		want          uint64
+	}{
+		{0, 0, maxMessageSize},
+		{minMessageSize, 0, minMessageSize},
+		{0, absoluteMaxMessageSize, maxMessageSize},
+		{absoluteMaxMessageSize, minMessageSize, minMessageSize},
+		{absoluteMaxMessageSize, absoluteMaxMessageSize, absoluteMaxMessageSize},
+	}
+	for i, tt := range tests {
+		if have := negotiateMessageSize(tt.local, tt.remote); have != tt.want {
+			t.Errorf("test %d: limit mismatch: have %d, want %d", i, have, tt.want)
+		}
+	}
+}
+
+// Tests that two peers advertising different message size limits both enforce
+// the lower one, on inbound as well as outbound messages.
+func TestHandshakeMessageSize(t *testing.T) {
+	largeConfig, smallConfig := DefaultConfig, DefaultConfig
+	largeConfig.MaxMessageSize = absoluteMaxMessageSize
+	smallConfig.MaxMessageSize = minMessageSize
+
+	large, err := NewStatusPacket(newTestChain(0), ETH66, 1, []common.Location{{0, 0}}, &largeConfig)
+	if err != nil {
+		t.Fatalf("failed to assemble large status: %v", err)
+	}
+	small, err := NewStatusPacket(newTestChain(0), ETH66, 1, []common.Location{{0, 0}}, &smallConfig)
+	if err != nil {
+		t.Fatalf("failed to assemble small status: %v", err)
+	}
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		local  = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), net, nil)
+		remote = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x02}, "peer", nil), app, nil)
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	errc := make(chan error, 1)
+	go func() { errc <- remote.Handshake(enode.ID{0xff}, small) }()
+	if err := local.Handshake(enode.ID{0xfe}, large); err != nil {
+		t.Fatalf("local handshake failed: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("remote handshake failed: %v", err)
+	}
+	oversized := make([]byte, minMessageSize)
+	for _, peer := range []*Peer{local, remote} {
+		if limit := peer.MaxMessageSize(); limit != minMessageSize {
+			t.Errorf("peer %s: limit mismatch: have %d, want %d", peer.id[:4], limit, minMessageSize)
+		}
+		// Oversized messages are refused locally instead of getting us dropped
+		if err := p2p.Send(peer.rw, TransactionsMsg, oversized); !errors.Is(err, errMsgTooLarge) {
+			t.Errorf("peer %s: send error mismatch: have %v, want %v", peer.id[:4], err, errMsgTooLarge)
+		}
+	}
+	// Oversized messages sneaking past the sender are rejected by the receiver
+	for _, pair := range [][2]*Peer{{local, remote}, {remote, local}} {
+		sender, receiver := pair[0], pair[1]
+
+		go p2p.Send(sender.rw.MsgReadWriter, TransactionsMsg, oversized)
+		if err := handleMessage(new(mockBackend), receiver); !errors.Is(err, errMsgTooLarge) {
+			t.Errorf("peer %s: receive error mismatch: have %v, want %v", receiver.id[:4], err, errMsgTooLarge)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Tests that the message registry lists every dispatched message with its name
+// and the protocol versions handling it.
+func TestMessages(t *testing.T) {
+	var (
+		all    = []uint{ETH65, ETH66, ETH67}
+		eth    = []uint{ETH66, ETH67}
+		latest = []uint{ETH67}
+	)
+	want := []MessageInfo{
+		{NewBlockHashesMsg, "NewBlockHashes", all},
+		{TransactionsMsg, "Transactions", all},
+		{GetBlockHeadersMsg, "GetBlockHeaders", all},
+		{BlockHeadersMsg, "BlockHeaders", all},
+		{GetBlockBodiesMsg, "GetBlockBodies", all},
+		{BlockBodiesMsg, "BlockBodies", all},
+		{NewBlockMsg, "NewBlock", all},
+		{NewPooledTransactionHashesMsg, "NewPooledTransactionHashes", all},
+		{GetPooledTransactionsMsg, "GetPooledTransactions", all},
+		{PooledTransactionsMsg, "PooledTransactions", all},
+		{GetBlockMsg, "GetBlock", all},
+		{PendingEtxsMsg, "PendingEtxs", eth},
+		{GetOnePendingEtxsMsg, "GetOnePendingEtxs", eth},
+		{PendingEtxsRollupMsg, "PendingEtxsManifest", eth},
+		{GetOnePendingEtxsRollupMsg, "GetOnePendingEtxsRollup", eth},
+		{GetBlockTxHashesMsg, "GetBlockTxHashes", eth},
+		{BlockTxHashesMsg, "BlockTxHashes", eth},
+		{GetHeadMsg, "GetHead", eth},
+		{HeadMsg, "Head", eth},
+		{GetCapabilitiesMsg, "GetCapabilities", eth},
+		{CapabilitiesMsg, "Capabilities", eth},
+		{GetHeadersByNumbersMsg, "GetHeadersByNumbers", eth},
+		{HeadersByNumbersMsg, "HeadersByNumbers", eth},
+		{HaveBlockMsg, "HaveBlock", eth},
+		{HaveBlockReplyMsg, "HaveBlockReply", eth},
+		{GetPendingEtxsByLocationMsg, "GetPendingEtxsByLocation", eth},
+		{PendingEtxsByLocationMsg, "PendingEtxsByLocation", eth},
+		{GetBlockEtxRootsMsg, "GetBlockEtxRoots", eth},
+		{BlockEtxRootsMsg, "BlockEtxRoots", eth},
+		{GetFreshBlockBodiesMsg, "GetFreshBlockBodies", eth},
+		{FreshBlockBodiesMsg, "FreshBlockBodies", eth},
+		{GetBlockMinersMsg, "GetBlockMiners", eth},
+		{BlockMinersMsg, "BlockMiners", eth},
+		{GetUnclesByRangeMsg, "GetUnclesByRange", eth},
+		{UnclesByRangeMsg, "UnclesByRange", eth},
+		{GetBlockDataMsg, "GetBlockData", latest},
+		{BlockDataMsg, "BlockData", latest},
+		{GetBlockByNumberMsg, "GetBlockByNumber", latest},
+		{BlockByNumberMsg, "BlockByNumber", latest},
+		{StatusDeltaMsg, "StatusDelta", latest},
+		{GetEtxManifestProofMsg, "GetEtxManifestProof", latest},
+		{EtxManifestProofMsg, "EtxManifestProof", latest},
+		{GetCanonicalHashMsg, "GetCanonicalHash", latest},
+		{CanonicalHashMsg, "CanonicalHash", latest},
+		{GetPendingEtxsSinceMsg, "GetPendingEtxsSince", latest},
+		{PendingEtxsSinceMsg, "PendingEtxsSince", latest},
+		{GetPartialBodiesMsg, "GetPartialBodies", latest},
+		{PartialBodiesMsg, "PartialBodies", latest},
+		{GetEtxRollupsByRangeMsg, "GetEtxRollupsByRange", latest},
+		{EtxRollupsByRangeMsg, "EtxRollupsByRange", latest},
+		{GetPoolSnapshotMsg, "GetPoolSnapshot", latest},
+		{PoolSnapshotMsg, "PoolSnapshot", latest},
+		{GetHeadersByMinerMsg, "GetHeadersByMiner", latest},
+		{HeadersByMinerMsg, "HeadersByMiner", latest},
+		{GetTxNonInclusionProofMsg, "GetTxNonInclusionProof", latest},
+		{TxNonInclusionProofMsg, "TxNonInclusionProof", latest},
+		{GetUnclePoolMsg, "GetUnclePool", latest},
+		{UnclePoolMsg, "UnclePool", latest},
+	}
+	if have := Messages(); !reflect.DeepEqual(have, want) {
+		t.Errorf("message registry mismatch:\nhave %v\nwant %v", have, want)
+	}
+}
+
+// Tests that every packet type is registered under a unique message code.
+func TestPacketKinds(t *testing.T) {
+	seen := make(map[byte]string)
+	for _, packet := range packets {
+		if name, ok := seen[packet.Kind()]; ok {
+			t.Errorf("packets %s and %s share code %#x", name, packet.Name(), packet.Kind())
+		}
+		seen[packet.Kind()] = packet.Name()
+	}
+}
+
+// Tests that every message reports the part it plays in the protocol, including
+// the Quai specific etx messages.
+func TestMessageRoles(t *testing.T) {
+	want := map[uint64]PacketRole{
+		StatusMsg:                     RoleHandshake,
+		NewBlockHashesMsg:             RoleBroadcast,
+		TransactionsMsg:               RoleBroadcast,
+		GetBlockHeadersMsg:            RoleRequest,
+		BlockHeadersMsg:               RoleResponse,
+		GetBlockBodiesMsg:             RoleRequest,
+		BlockBodiesMsg:                RoleResponse,
+		NewBlockMsg:                   RoleBroadcast,
+		NewPooledTransactionHashesMsg: RoleBroadcast,
+		GetPooledTransactionsMsg:      RoleRequest,
+		PooledTransactionsMsg:         RoleResponse,
+		GetBlockMsg:                   RoleRequest,
+		PendingEtxsMsg:                RoleBroadcast,
+		GetOnePendingEtxsMsg:          RoleRequest,
+		PendingEtxsRollupMsg:          RoleBroadcast,
+		GetOnePendingEtxsRollupMsg:    RoleRequest,
+		GetBlockTxHashesMsg:           RoleRequest,
+		BlockTxHashesMsg:              RoleResponse,
+		GetHeadMsg:                    RoleRequest,
+		HeadMsg:                       RoleResponse,
+		GetCapabilitiesMsg:            RoleRequest,
+		CapabilitiesMsg:               RoleResponse,
+		GetHeadersByNumbersMsg:        RoleRequest,
+		HeadersByNumbersMsg:           RoleResponse,
+		HaveBlockMsg:                  RoleRequest,
+		HaveBlockReplyMsg:             RoleResponse,
+		GetPendingEtxsByLocationMsg:   RoleRequest,
+		PendingEtxsByLocationMsg:      RoleResponse,
+		GetBlockEtxRootsMsg:           RoleRequest,
+		BlockEtxRootsMsg:              RoleResponse,
+		GetFreshBlockBodiesMsg:        RoleRequest,
+		FreshBlockBodiesMsg:           RoleResponse,
+		GetBlockMinersMsg:             RoleRequest,
+		BlockMinersMsg:                RoleResponse,
+		GetUnclesByRangeMsg:           RoleRequest,
+		UnclesByRangeMsg:              RoleResponse,
+		GetBlockDataMsg:               RoleRequest,
+		BlockDataMsg:                  RoleResponse,
+		GetBlockByNumberMsg:           RoleRequest,
+		BlockByNumberMsg:              RoleResponse,
+		StatusDeltaMsg:                RoleBroadcast,
+		GetEtxManifestProofMsg:        RoleRequest,
+		EtxManifestProofMsg:           RoleResponse,
+		GetCanonicalHashMsg:           RoleRequest,
+		CanonicalHashMsg:              RoleResponse,
+		GetPendingEtxsSinceMsg:        RoleRequest,
+		PendingEtxsSinceMsg:           RoleResponse,
+		GetPartialBodiesMsg:           RoleRequest,
+		PartialBodiesMsg:              RoleResponse,
+		GetEtxRollupsByRangeMsg:       RoleRequest,
+		EtxRollupsByRangeMsg:          RoleResponse,
+		GetPoolSnapshotMsg:            RoleRequest,
+		PoolSnapshotMsg:               RoleResponse,
+		GetHeadersByMinerMsg:          RoleRequest,
+		HeadersByMinerMsg:             RoleResponse,
+		GetTxNonInclusionProofMsg:     RoleRequest,
+		TxNonInclusionProofMsg:        RoleResponse,
+		GetUnclePoolMsg:               RoleRequest,
+		UnclePoolMsg:                  RoleResponse,
+		CompactBlockBodiesMsg:         RoleResponse,
+
+		CompactPooledTransactionHashesMsg: RoleBroadcast,
+		GetPooledTransactionHashesMsg:     RoleRequest,
+		PooledTransactionHashesMsg:        RoleResponse,
+	}
+	for _, packet := range packets {
+		code := uint64(packet.Kind())
+		role, ok := want[code]
+		if !ok {
+			t.Errorf("packet %s: role not covered by the test", packet.Name())
+			continue
+		}
+		if have, _ := MessageRole(code); have != role {
+			t.Errorf("packet %s: role mismatch: have %v, want %v", packet.Name(), have, role)
+		}
+	}
+	if _, ok := MessageRole(0x7f); ok {
+		t.Errorf("unknown message code reported a role")
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+)
+
+// answerGetHeadersByMinerQuery walks the requested range of canonical blocks the
+// same way as a block miner retrieval, returning the headers mined by any of the
+// requested addresses. The scanned range is bounded like a header retrieval, so
+// the reply stays within the soft response limit. Queries filtering by no or
+// more than maxMinerFilters miners are rejected.
+func answerGetHeadersByMinerQuery(chain chainReader, query GetHeadersByMinerPacket, peer *Peer) (HeadersByMinerPacket, error) {
+	if len(query.Miners) == 0 || len(query.Miners) > maxMinerFilters {
+		return HeadersByMinerPacket{}, fmt.Errorf("%w: %d miners filtered, limit %d", errInvalidQuery, len(query.Miners), maxMinerFilters)
+	}
+	miners := make(map[common.AddressBytes]struct{}, len(query.Miners))
+	for _, miner := range query.Miners {
+		miners[miner.Bytes20()] = struct{}{}
+	}
+	var response HeadersByMinerPacket
+	for _, header := range canonicalRangeHeaders(chain, query.Origin, query.Amount, query.Dom, peer) {
+		if _, ok := miners[header.Coinbase().Bytes20()]; ok {
+			response.Headers = append(response.Headers, header)
+		}
+		response.Last = header.NumberU64()
+	}
+	return response, nil
+}
+
+// sanityCheck verifies that the headers of the reply are within the serving
+// limit, in ascending block order and not past the last block scanned.
+func (p *HeadersByMinerPacket) sanityCheck() error {
+	if len(p.Headers) > maxHeadersServe {
+		return fmt.Errorf("%w: %d headers, limit %d", errInvalidMinerHeaders, len(p.Headers), maxHeadersServe)
+	}
+	for i, header := range p.Headers {
+		if header == nil {
+			return fmt.Errorf("%w: header %d missing", errInvalidMinerHeaders, i)
+		}
+		if i > 0 && header.NumberU64() <= p.Headers[i-1].NumberU64() {
+			return fmt.Errorf("%w: header %d of block #%d after #%d", errInvalidMinerHeaders, i, header.NumberU64(), p.Headers[i-1].NumberU64())
+		}
+		if header.NumberU64() > p.Last {
+			return fmt.Errorf("%w: header %d of block #%d past last scanned #%d", errInvalidMinerHeaders, i, header.NumberU64(), p.Last)
+		}
+	}
+	return nil
+}
+
+// ReplyHeadersByMiner is the eth/67 response to GetHeadersByMiner.
+func (p *Peer) ReplyHeadersByMiner(id uint64, headers HeadersByMinerPacket) error {
+	return send(p.rw, HeadersByMinerMsg, &HeadersByMinerPacket66{
+		RequestId:            id,
+		HeadersByMinerPacket: headers,
+	})
+}
+
+// RequestHeadersByMiner fetches the headers mined by any of the given addresses
+// within a range of canonical blocks, starting at the origin.
+func (p *Peer) RequestHeadersByMiner(origin HashOrNumber, amount uint64, dom bool, miners []common.Address) error {
+	return p.requestHeadersByMiner(rand.Uint64(), origin, amount, dom, miners)
+}
+
+// FetchHeadersByMiner retrieves the headers mined by any of the given addresses
+// within a range of canonical blocks, waiting for the reply up to the given
+// timeout.
+func (p *Peer) FetchHeadersByMiner(origin HashOrNumber, amount uint64, dom bool, miners []common.Address, timeout time.Duration) (*HeadersByMinerPacket, error) {
+	res, err := p.fetch(fmt.Sprintf("headers by %d miners", len(miners)), timeout, func(id uint64) error {
+		return p.requestHeadersByMiner(id, origin, amount, dom, miners)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*HeadersByMinerPacket), nil
+}
+
+// requestHeadersByMiner sends a headers by miner request under the given id.
+func (p *Peer) requestHeadersByMiner(id uint64, origin HashOrNumber, amount uint64, dom bool, miners []common.Address) error {
+	p.Log().Debug("Fetching headers by miner", "origin", origin, "amount", amount, "dom", dom, "miners", len(miners))
+	if err := p.checkOptional(GetHeadersByMinerMsg); err != nil {
+		return err
+	}
+	requestTracker.Track(p.id, p.version, GetHeadersByMinerMsg, HeadersByMinerMsg, id)
+	return send(p.rw, GetHeadersByMinerMsg, &GetHeadersByMinerPacket66{
+		RequestId: id,
+		GetHeadersByMinerPacket: GetHeadersByMinerPacket{
+			Origin: origin,
+			Amount: amount,
+			Dom:    dom,
+			Miners: miners,
+		},
+	})
+}
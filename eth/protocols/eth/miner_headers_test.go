@@ -0,0 +1,261 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// newMinerChain creates a test chain with the given number of blocks on top of
+// an empty genesis, mined in turn by the given addresses.
+func newMinerChain(blocks int, miners ...common.Address) *testChain {
+	chain := newTestChain(blocks)
+	for i, header := range chain.canonical {
+		header.SetCoinbase(miners[i%len(miners)])
+	}
+	// Changing the headers changed their hashes, reindex them
+	chain.headers = make(map[common.Hash]*types.Header)
+	for _, header := range chain.canonical {
+		chain.headers[header.Hash()] = header
+	}
+	return chain
+}
+
+// headerNumbers returns the numbers of a list of headers.
+func headerNumbers(headers []*types.Header) []uint64 {
+	numbers := make([]uint64, 0, len(headers))
+	for _, header := range headers {
+		numbers = append(numbers, header.NumberU64())
+	}
+	return numbers
+}
+
+// Tests that miner filtered header retrievals scan the canonical chain from the
+// origin like block miner retrievals, returning only the matching headers.
+func TestGetHeadersByMiner(t *testing.T) {
+	var (
+		alice = common.BytesToAddress([]byte{0x01})
+		bob   = common.BytesToAddress([]byte{0x02})
+		carol = common.BytesToAddress([]byte{0x03})
+		dave  = common.BytesToAddress([]byte{0x04})
+	)
+	// Blocks 0, 3, 6... are mined by alice, 1, 4, 7... by bob and the rest by carol
+	chain := newMinerChain(20, alice, bob, carol)
+
+	side := types.EmptyHeader()
+	side.SetNumber(big.NewInt(3))
+	side.SetCoinbase(alice)
+	chain.headers[side.Hash()] = side
+
+	tests := []struct {
+		query  GetHeadersByMinerPacket
+		dom    []int    // Canonical blocks to mark dominant
+		blocks []uint64 // Blocks whose headers are expected
+		last   uint64   // Last block expected to be scanned
+	}{
+		// Ranges mixing matching and non-matching headers
+		{GetHeadersByMinerPacket{Origin: HashOrNumber{Number: 1}, Amount: 12, Miners: []common.Address{alice}}, nil, []uint64{3, 6, 9, 12}, 12},
+		{GetHeadersByMinerPacket{Origin: HashOrNumber{Number: 2}, Amount: 6, Miners: []common.Address{bob, carol}}, nil, []uint64{2, 4, 5, 7}, 7},
+		{GetHeadersByMinerPacket{Origin: HashOrNumber{Hash: chain.canonical[6].Hash()}, Amount: 4, Miners: []common.Address{alice, alice}}, nil, []uint64{6, 9}, 9},
+		{GetHeadersByMinerPacket{Origin: HashOrNumber{Number: 15}, Amount: 10, Miners: []common.Address{bob}}, nil, []uint64{16, 19}, 20},
+
+		// Ranges without any match still report how far they were scanned
+		{GetHeadersByMinerPacket{Origin: HashOrNumber{Number: 1}, Amount: 5, Miners: []common.Address{dave}}, nil, nil, 5},
+
+		// Non-dom queries stop at the first dominant block, dom ones scan only those
+		{GetHeadersByMinerPacket{Origin: HashOrNumber{Number: 2}, Amount: 10, Miners: []common.Address{alice}}, []int{5}, []uint64{3}, 5},
+		{GetHeadersByMinerPacket{Origin: HashOrNumber{Number: 1}, Amount: 4, Dom: true, Miners: []common.Address{alice}}, []int{3, 5, 6, 8}, []uint64{3, 6}, 8},
+
+		// Unknown, sidechain and future origins are not served
+		{GetHeadersByMinerPacket{Origin: HashOrNumber{Hash: common.Hash{0xff}}, Amount: 2, Miners: []common.Address{alice}}, nil, nil, 0},
+		{GetHeadersByMinerPacket{Origin: HashOrNumber{Hash: side.Hash()}, Amount: 2, Miners: []common.Address{alice}}, nil, nil, 0},
+		{GetHeadersByMinerPacket{Origin: HashOrNumber{Number: 30}, Amount: 2, Miners: []common.Address{alice}}, nil, nil, 0},
+	}
+	for i, tt := range tests {
+		chain.engine.dom = make(map[common.Hash]bool)
+		for _, n := range tt.dom {
+			chain.engine.dom[chain.canonical[n].Hash()] = true
+		}
+		res, err := answerGetHeadersByMinerQuery(chain, tt.query, nil)
+		if err != nil {
+			t.Errorf("test %d: failed to answer query: %v", i, err)
+			continue
+		}
+		if have := headerNumbers(res.Headers); !reflect.DeepEqual(have, append([]uint64{}, tt.blocks...)) {
+			t.Errorf("test %d: headers mismatch: have %v, want %v", i, have, tt.blocks)
+		}
+		if res.Last != tt.last {
+			t.Errorf("test %d: last scanned block mismatch: have %d, want %d", i, res.Last, tt.last)
+		}
+		for j, header := range res.Headers {
+			if header.Hash() != chain.canonical[header.NumberU64()].Hash() {
+				t.Errorf("test %d, header %d: not the canonical header", i, j)
+			}
+		}
+		if err := res.sanityCheck(); err != nil {
+			t.Errorf("test %d: reply failed sanity check: %v", i, err)
+		}
+	}
+}
+
+// Tests that the scan is bounded like a header retrieval, and may be continued
+// from after the last block scanned.
+func TestGetHeadersByMinerLimit(t *testing.T) {
+	var (
+		alice = common.BytesToAddress([]byte{0x01})
+		bob   = common.BytesToAddress([]byte{0x02})
+		chain = newMinerChain(maxHeadersServe+10, alice, bob)
+	)
+	query := GetHeadersByMinerPacket{Amount: 2 * maxHeadersServe, Miners: []common.Address{bob}}
+
+	res, err := answerGetHeadersByMinerQuery(chain, query, nil)
+	if err != nil {
+		t.Fatalf("failed to answer query: %v", err)
+	}
+	if res.Last != maxHeadersServe-1 {
+		t.Fatalf("last scanned block mismatch: have %d, want %d", res.Last, maxHeadersServe-1)
+	}
+	if len(res.Headers) != maxHeadersServe/2 {
+		t.Fatalf("header count mismatch: have %d, want %d", len(res.Headers), maxHeadersServe/2)
+	}
+	query.Origin = HashOrNumber{Number: res.Last + 1}
+	if res, err = answerGetHeadersByMinerQuery(chain, query, nil); err != nil {
+		t.Fatalf("failed to answer continuation: %v", err)
+	}
+	if have, want := headerNumbers(res.Headers), []uint64{1025, 1027, 1029, 1031, 1033}; !reflect.DeepEqual(have, want) {
+		t.Errorf("continued headers mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that queries filtering by no or too many miners are rejected as invalid.
+func TestGetHeadersByMinerInvalid(t *testing.T) {
+	chain := newMinerChain(4, common.BytesToAddress([]byte{0x01}))
+
+	for i, miners := range [][]common.Address{nil, make([]common.Address, maxMinerFilters+1)} {
+		query := GetHeadersByMinerPacket{Amount: 4, Miners: miners}
+		if _, err := answerGetHeadersByMinerQuery(chain, query, nil); !errors.Is(err, errInvalidQuery) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, errInvalidQuery)
+		}
+	}
+}
+
+// Tests that replies with unordered headers, or headers past the last block
+// scanned, are rejected.
+func TestHeadersByMinerSanityCheck(t *testing.T) {
+	chain := newTestChain(5)
+	headers := chain.canonical
+
+	tests := []struct {
+		reply HeadersByMinerPacket
+		valid bool
+	}{
+		{HeadersByMinerPacket{}, true},
+		{HeadersByMinerPacket{Last: 5}, true},
+		{HeadersByMinerPacket{Headers: []*types.Header{headers[1], headers[4]}, Last: 4}, true},
+		{HeadersByMinerPacket{Headers: []*types.Header{headers[4], headers[1]}, Last: 4}, false},
+		{HeadersByMinerPacket{Headers: []*types.Header{headers[2], headers[2]}, Last: 4}, false},
+		{HeadersByMinerPacket{Headers: []*types.Header{headers[1], headers[5]}, Last: 4}, false},
+		{HeadersByMinerPacket{Headers: []*types.Header{nil}, Last: 4}, false},
+		{HeadersByMinerPacket{Headers: make([]*types.Header, maxHeadersServe+1), Last: 4}, false},
+	}
+	for i, tt := range tests {
+		err := tt.reply.sanityCheck()
+		if tt.valid && err != nil {
+			t.Errorf("test %d: valid reply rejected: %v", i, err)
+		}
+		if !tt.valid && !errors.Is(err, errInvalidMinerHeaders) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, errInvalidMinerHeaders)
+		}
+	}
+}
+
+// Tests that miner filtered headers round-trip through the wire, and that the
+// request is refused to peers older than eth/67.
+func TestHeadersByMinerRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		alice  = common.BytesToAddress([]byte{0x01})
+		bob    = common.BytesToAddress([]byte{0x02})
+		chain  = newMinerChain(10, alice, bob)
+		origin = HashOrNumber{Number: 2}
+		local  = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xec, 0x01}, "peer", nil), net, nil)
+		remote = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xec, 0x02}, "peer", nil), app, nil)
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	advertiseOptional(local, GetHeadersByMinerMsg)
+	go local.RequestHeadersByMiner(origin, 6, false, []common.Address{bob})
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	if msg.Code != GetHeadersByMinerMsg {
+		t.Fatalf("request code mismatch: have %#x, want %#x", msg.Code, GetHeadersByMinerMsg)
+	}
+	var query GetHeadersByMinerPacket66
+	if err := msg.Decode(&query); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	if query.Origin != origin || query.Amount != 6 || len(query.Miners) != 1 || !query.Miners[0].Equal(bob) {
+		t.Fatalf("request mismatch: have %+v", query.GetHeadersByMinerPacket)
+	}
+	res, err := answerGetHeadersByMinerQuery(chain, query.GetHeadersByMinerPacket, remote)
+	if err != nil {
+		t.Fatalf("failed to answer query: %v", err)
+	}
+	go remote.ReplyHeadersByMiner(query.RequestId, res)
+
+	backend := new(mockBackend)
+	if err := handleMessage(backend, local); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+	}
+	delivered := backend.handled[0].(*HeadersByMinerPacket)
+	if have, want := headerNumbers(delivered.Headers), []uint64{3, 5, 7}; !reflect.DeepEqual(have, want) {
+		t.Errorf("delivered headers mismatch: have %v, want %v", have, want)
+	}
+	if delivered.Last != 7 {
+		t.Errorf("delivered last scanned block mismatch: have %d, want %d", delivered.Last, 7)
+	}
+	for i, header := range delivered.Headers {
+		if header.Hash() != chain.canonical[header.NumberU64()].Hash() {
+			t.Errorf("header %d: hash mismatch after round trip", i)
+		}
+	}
+	// Peers older than eth/67 can't be asked
+	old := NewPeer(ETH66, p2p.NewPeer(enode.ID{0xec, 0x03}, "peer", nil), net, nil)
+	defer old.Close()
+
+	if err := old.RequestHeadersByMiner(origin, 6, false, []common.Address{bob}); err == nil {
+		t.Errorf("eth/66 peer accepted miner filtered header request")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/log"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// Tests that peers on a different network are rejected in strict mode, while in
+// permissive mode the ones on networks unknown to the binary are accepted with a
+// warning, unless the local node runs on the main network.
+func TestPermissiveNetwork(t *testing.T) {
+	hook := logtest.NewLocal(log.Log.Logger)
+	defer log.Log.ReplaceHooks(make(logrus.LevelHooks))
+
+	tests := []struct {
+		permissive bool
+		local      uint64
+		remote     uint64
+		genesis    common.Hash // Remote genesis override, zero to keep the local one
+		err        error
+	}{
+		{false, 7, 7, common.Hash{}, nil},                             // Same network
+		{false, 7, 9, common.Hash{}, errNetworkIDMismatch},            // Strict, unknown network
+		{true, 7, 9, common.Hash{}, nil},                              // Permissive, unknown network
+		{true, 7, 2, common.Hash{}, errNetworkIDMismatch},             // Permissive, known network
+		{true, mainNetworkID, 9, common.Hash{}, errNetworkIDMismatch}, // Permissive, local main network
+		{true, 7, 9, common.Hash{0x01}, errGenesisMismatch},           // Permissive, unknown network on another genesis
+	}
+	for i, tt := range tests {
+		hook.Reset()
+		config := DefaultConfig
+		config.PermissiveNetwork = tt.permissive
+
+		local := newTestStatus(t, common.Location{0, 0})
+		local.NetworkID = tt.local
+
+		remote := *local
+		remote.NetworkID = tt.remote
+		if tt.genesis != (common.Hash{}) {
+			remote.Genesis = tt.genesis
+		}
+		app, net := p2p.MsgPipe()
+		var (
+			localPeer  = newPeer(ETH66, p2p.NewPeer(enode.ID{0xc2}, "remote", nil), net, nil, &config)
+			remotePeer = newPeer(ETH66, p2p.NewPeer(enode.ID{0xc1}, "local", nil), app, nil, &config)
+		)
+		errc := make(chan error, 1)
+		go func() { errc <- remotePeer.Handshake(enode.ID{0xc2}, &remote) }()
+
+		err := localPeer.Handshake(enode.ID{0xc1}, local)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		app.Close()
+		net.Close()
+		<-errc
+
+		localPeer.Close()
+		remotePeer.Close()
+
+		var warned bool
+		for _, entry := range hook.AllEntries() {
+			// Only consider the warnings of the local side about the remote network
+			if entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, "Accepting peer on unrecognized network") && strings.Contains(entry.Message, fmt.Sprintf("network=%d", tt.remote)) {
+				warned = true
+			}
+		}
+		if want := err == nil && tt.local != tt.remote; warned != want {
+			t.Errorf("test %d: warning mismatch: have %v, want %v", i, warned, want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"fmt"
+	"sort"
+)
+
+// maxOptionalMessages is the maximum number of optional message codes a peer
+// may advertise in its status.
+const maxOptionalMessages = 64
+
+// optionalMessages are the requests a node may or may not serve on top of the
+// ones mandated by its protocol version. Peers advertise the ones they serve in
+// their status, and the requests are only sent to peers which advertised them.
+var optionalMessages = map[uint64]struct{}{
+	GetEtxManifestProofMsg:    {},
+	GetPartialBodiesMsg:       {},
+	GetEtxRollupsByRangeMsg:   {},
+	GetPoolSnapshotMsg:        {},
+	GetHeadersByMinerMsg:      {},
+	GetTxNonInclusionProofMsg: {},
+	GetUnclePoolMsg:           {},
+}
+
+// isOptional reports whether the message code is an optional request.
+func isOptional(code uint64) bool {
+	_, ok := optionalMessages[code]
+	return ok
+}
+
+// localOptionalMessages returns the sorted optional message codes served by the
+// local node for the given protocol version.
+func localOptionalMessages(version uint) []uint64 {
+	var codes []uint64
+	for _, code := range supportedMessages[version] {
+		if isOptional(code) {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
+
+// Supports reports whether the message may be sent to the peer. Light peers
+// serve no requests at all, optional requests need to be advertised by the peer
+// in the handshake, and all the other messages only need to be handled by the
+// negotiated protocol version.
+func (p *Peer) Supports(code uint64) bool {
+	if role, _ := MessageRole(code); role == RoleRequest && p.light {
+		return false
+	}
+	if isOptional(code) {
+		_, ok := p.optional[code]
+		return ok
+	}
+	codes := supportedMessages[p.version]
+	i := sort.Search(len(codes), func(i int) bool { return codes[i] >= code })
+	return i < len(codes) && codes[i] == code
+}
+
+// checkOptional returns an error if the optional request wasn't advertised by
+// the peer, which would most likely drop the connection on receiving it.
+func (p *Peer) checkOptional(code uint64) error {
+	if !p.Supports(code) {
+		return fmt.Errorf("%w: %s", errOptionalNotSupported, requestNames[code])
+	}
+	return nil
+}
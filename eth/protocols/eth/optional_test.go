@@ -0,0 +1,194 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// advertiseOptional marks the optional requests as advertised by the peer, as
+// if negotiated in the handshake.
+func advertiseOptional(p *Peer, codes ...uint64) {
+	if p.optional == nil {
+		p.optional = make(map[uint64]struct{})
+	}
+	for _, code := range codes {
+		p.optional[code] = struct{}{}
+	}
+}
+
+// Tests that eth/67 statuses advertise all the optional requests served, and
+// that older ones advertise none.
+func TestOptionalMessagesAdvertised(t *testing.T) {
+	want := []uint64{GetEtxManifestProofMsg, GetPartialBodiesMsg, GetEtxRollupsByRangeMsg, GetPoolSnapshotMsg, GetHeadersByMinerMsg, GetTxNonInclusionProofMsg, GetUnclePoolMsg}
+
+	status, err := NewStatusPacket(newTestChain(0), ETH67, 1, []common.Location{{0, 0}}, &DefaultConfig)
+	if err != nil {
+		t.Fatalf("failed to assemble eth/67 status: %v", err)
+	}
+	if !reflect.DeepEqual(status.Optional, want) {
+		t.Errorf("eth/67 optional messages mismatch: have %#x, want %#x", status.Optional, want)
+	}
+	if status := newTestStatus(t, common.Location{0, 0}); len(status.Optional) != 0 {
+		t.Errorf("eth/66 status advertised optional messages: %#x", status.Optional)
+	}
+	// Statuses advertising absurd numbers of codes are rejected
+	status.Optional = make([]uint64, maxOptionalMessages+1)
+	if err := validateStatus(status, status, false); !errors.Is(err, errOptionalRejected) {
+		t.Errorf("oversized optional messages error mismatch: have %v, want %v", err, errOptionalRejected)
+	}
+}
+
+// Tests that optional requests are only sent to peers which advertised them in
+// the handshake, while the mandatory messages only depend on the version.
+func TestOptionalMessagesNegotiated(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	local, err := NewStatusPacket(newTestChain(0), ETH67, 1, []common.Location{{0, 0}}, &DefaultConfig)
+	if err != nil {
+		t.Fatalf("failed to assemble local status: %v", err)
+	}
+	remote := *local
+	remote.Optional = []uint64{GetPoolSnapshotMsg, 0x7f}
+
+	peer := NewPeer(ETH67, p2p.NewPeer(enode.ID{0xee, 0x01}, "peer", nil), net, nil)
+	defer peer.Close()
+
+	go func() {
+		// Consume our own status and answer with the remote one
+		if msg, err := app.ReadMsg(); err == nil {
+			msg.Discard()
+		}
+		p2p.Send(app, StatusMsg, &remote)
+	}()
+	if err := peer.Handshake(enode.ID{0xee, 0x02}, local); err != nil {
+		t.Fatalf("failed to handshake: %v", err)
+	}
+	tests := []struct {
+		code      uint64
+		supported bool
+	}{
+		{GetBlockHeadersMsg, true},
+		{GetCanonicalHashMsg, true},
+		{GetPoolSnapshotMsg, true},
+		{GetHeadersByMinerMsg, false},
+		{GetTxNonInclusionProofMsg, false},
+		{0x7f, false},
+	}
+	for i, tt := range tests {
+		if have := peer.Supports(tt.code); have != tt.supported {
+			t.Errorf("test %d: support of %#x mismatch: have %v, want %v", i, tt.code, have, tt.supported)
+		}
+	}
+	// Requests not advertised are refused without reaching the wire
+	if err := peer.RequestHeadersByMiner(HashOrNumber{Number: 1}, 1, false, nil); !errors.Is(err, errOptionalNotSupported) {
+		t.Errorf("unadvertised request error mismatch: have %v, want %v", err, errOptionalNotSupported)
+	}
+	if err := peer.RequestTxNonInclusionProof(common.Hash{0x01}, common.Hash{0x02}); !errors.Is(err, errOptionalNotSupported) {
+		t.Errorf("unadvertised request error mismatch: have %v, want %v", err, errOptionalNotSupported)
+	}
+	go peer.RequestPoolSnapshot(nil, 16)
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	defer msg.Discard()
+
+	if msg.Code != GetPoolSnapshotMsg {
+		t.Errorf("request code mismatch: have %#x, want %#x", msg.Code, GetPoolSnapshotMsg)
+	}
+	// Peers older than eth/67 support no optional requests
+	old := NewPeer(ETH66, p2p.NewPeer(enode.ID{0xee, 0x03}, "peer", nil), net, nil)
+	defer old.Close()
+
+	if old.Supports(GetPoolSnapshotMsg) {
+		t.Errorf("eth/66 peer supports optional request")
+	}
+	if err := old.RequestPoolSnapshot(nil, 16); !errors.Is(err, errOptionalNotSupported) {
+		t.Errorf("eth/66 request error mismatch: have %v, want %v", err, errOptionalNotSupported)
+	}
+}
+
+// Tests that light nodes announce themselves in the eth/67 handshake instead of
+// the optional requests, and that no requests are sent to them while blocks are
+// still propagated.
+func TestLightHandshake(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	config := DefaultConfig
+	config.Light = true
+
+	remote, err := NewStatusPacket(newTestChain(0), ETH67, 1, []common.Location{{0, 0}}, &config)
+	if err != nil {
+		t.Fatalf("failed to assemble light status: %v", err)
+	}
+	if !remote.Light || len(remote.Optional) != 0 {
+		t.Fatalf("light status mismatch: light %v, optional %#x", remote.Light, remote.Optional)
+	}
+
+	local, err := NewStatusPacket(newTestChain(0), ETH67, 1, []common.Location{{0, 0}}, &DefaultConfig)
+	if err != nil {
+		t.Fatalf("failed to assemble local status: %v", err)
+	}
+	peer := NewPeer(ETH67, p2p.NewPeer(enode.ID{0xf2, 0x01}, "peer", nil), net, nil)
+	defer peer.Close()
+
+	go func() {
+		// Consume our own status and answer with the light one
+		if msg, err := app.ReadMsg(); err == nil {
+			msg.Discard()
+		}
+		p2p.Send(app, StatusMsg, remote)
+	}()
+	if err := peer.Handshake(enode.ID{0xf2, 0x02}, local); err != nil {
+		t.Fatalf("failed to handshake: %v", err)
+	}
+	if !peer.Light() {
+		t.Fatalf("light peer not recognised")
+	}
+	tests := []struct {
+		code      uint64
+		supported bool
+	}{
+		{GetBlockHeadersMsg, false},
+		{GetBlockBodiesMsg, false},
+		{GetPoolSnapshotMsg, false},
+		{GetUnclePoolMsg, false},
+		{NewBlockMsg, true},
+		{NewBlockHashesMsg, true},
+		{BlockHeadersMsg, true},
+	}
+	for i, tt := range tests {
+		if have := peer.Supports(tt.code); have != tt.supported {
+			t.Errorf("test %d: support of %#x mismatch: have %v, want %v", i, tt.code, have, tt.supported)
+		}
+	}
+	if err := peer.RequestUnclePool(16); !errors.Is(err, errOptionalNotSupported) {
+		t.Errorf("light peer request error mismatch: have %v, want %v", err, errOptionalNotSupported)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/event"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// InboundPacket is a packet received from an `eth` peer, as delivered to the
+// subscribers of its kind.
+type InboundPacket struct {
+	Peer      string    // Identifier of the remote peer
+	Version   uint      // Protocol version of the connection
+	RequestId uint64    // Request id of `eth/66` requests and replies, zero otherwise
+	Packet    Packet    // Decoded packet, shared by all subscribers and not to be modified
+	Time      time.Time // Time the message was received
+}
+
+// packetFeed delivers the inbound packets of the kinds subscribed to without
+// ever blocking the read loops. Packets are dropped for subscribers whose channel
+// is full, so the channels should be buffered according to how fast they are
+// drained.
+type packetFeed struct {
+	subs    map[byte]map[chan<- *InboundPacket]struct{}
+	dropped uint64 // Number of packets dropped due to slow subscribers
+	lock    sync.RWMutex
+}
+
+// packetSubs is the feed of the inbound packets received from all `eth` peers.
+var packetSubs = &packetFeed{
+	subs: make(map[byte]map[chan<- *InboundPacket]struct{}),
+}
+
+// SubscribePackets registers a subscription for the packets of the given kind
+// received from any `eth` peer. The packets are decoded from a copy of the
+// messages, which are still handled as usual. Packets are dropped if the channel
+// is full when they arrive.
+func SubscribePackets(kind byte, ch chan<- *InboundPacket) event.Subscription {
+	return packetSubs.subscribe(kind, ch)
+}
+
+// subscribe registers a channel to receive all future packets of a kind until
+// the returned subscription is cancelled.
+func (f *packetFeed) subscribe(kind byte, ch chan<- *InboundPacket) event.Subscription {
+	f.lock.Lock()
+	if f.subs[kind] == nil {
+		f.subs[kind] = make(map[chan<- *InboundPacket]struct{})
+	}
+	f.subs[kind][ch] = struct{}{}
+	f.lock.Unlock()
+
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		<-quit
+
+		f.lock.Lock()
+		delete(f.subs[kind], ch)
+		if len(f.subs[kind]) == 0 {
+			delete(f.subs, kind)
+		}
+		f.lock.Unlock()
+		return nil
+	})
+}
+
+// subscribed reports whether the messages with the given code have subscribers.
+func (f *packetFeed) subscribed(code uint64) bool {
+	if code > 0xff {
+		return false
+	}
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return len(f.subs[byte(code)]) > 0
+}
+
+// observe decodes a message received from a peer and delivers it to the
+// subscribers of its kind. As the message payload is consumed in the process, a
+// replacement message is returned for further use. Malformed messages are left
+// for their handler to reject.
+func (f *packetFeed) observe(peer *Peer, msg p2p.Msg) (p2p.Msg, error) {
+	payload := make([]byte, msg.Size)
+	if _, err := io.ReadFull(msg.Payload, payload); err != nil {
+		return msg, err
+	}
+	msg.Payload = bytes.NewReader(payload)
+
+	packet := newPacket(msg.Code)
+	if packet == nil {
+		return msg, nil
+	}
+	var (
+		id      uint64
+		content = payload
+	)
+	if peer.Version() >= ETH66 && !untaggedMsgs[msg.Code] {
+		list, _, err := rlp.SplitList(payload)
+		if err != nil {
+			return msg, nil
+		}
+		if id, content, err = rlp.SplitUint64(list); err != nil {
+			return msg, nil
+		}
+	}
+	if err := rlp.DecodeBytes(content, packet); err != nil {
+		return msg, nil
+	}
+	f.send(&InboundPacket{
+		Peer:      peer.id,
+		Version:   peer.Version(),
+		RequestId: id,
+		Packet:    packet,
+		Time:      msg.ReceivedAt,
+	})
+	return msg, nil
+}
+
+// send delivers a packet to every subscriber of its kind with room in its
+// channel.
+func (f *packetFeed) send(packet *InboundPacket) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for ch := range f.subs[packet.Packet.Kind()] {
+		select {
+		case ch <- packet:
+		default:
+			f.dropped++
+		}
+	}
+}
+
+// newPacket creates an empty packet of the kind identified by the message code,
+// nil if the code is unknown.
+func newPacket(code uint64) Packet {
+	for _, packet := range packets {
+		if uint64(packet.Kind()) == code {
+			return reflect.New(reflect.TypeOf(packet).Elem()).Interface().(Packet)
+		}
+	}
+	return nil
+}
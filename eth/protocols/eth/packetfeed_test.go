@@ -0,0 +1,161 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// unsyncedBackend is a mock backend still catching up with the network, so
+// propagated blocks are accepted without consulting the local chain.
+type unsyncedBackend struct {
+	mockBackend
+}
+
+func (b *unsyncedBackend) AcceptTxs() bool { return false }
+
+// Tests that subscribers to a packet kind get the inbound packets of that kind
+// delivered, while the messages are still handled as usual.
+func TestSubscribePackets(t *testing.T) {
+	defer func(old common.Location) { common.NodeLocation = old }(common.NodeLocation)
+	common.NodeLocation = common.Location{0, 0}
+
+	var (
+		blocks = make(chan *InboundPacket, 4)
+		txs    = make(chan *InboundPacket, 4)
+	)
+	sub := SubscribePackets(NewBlockMsg, blocks)
+	defer SubscribePackets(TransactionsMsg, txs).Unsubscribe()
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	peer := NewPeer(ETH66, p2p.NewPeer(enode.ID{0xf1}, "peer", nil), net, nil)
+	defer peer.Close()
+
+	header := types.EmptyHeader()
+	header.SetNumber(big.NewInt(1))
+	block := types.NewBlockWithHeader(header)
+
+	go p2p.Send(app, NewBlockMsg, &NewBlockPacket{Block: block})
+
+	backend := new(unsyncedBackend)
+	if err := handleMessage(backend, peer); err != nil {
+		t.Fatalf("failed to handle block: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("handled packet count mismatch: have %d, want 1", len(backend.handled))
+	}
+	select {
+	case packet := <-blocks:
+		if packet.Peer != peer.ID() {
+			t.Errorf("peer mismatch: have %s, want %s", packet.Peer, peer.ID())
+		}
+		ann, ok := packet.Packet.(*NewBlockPacket)
+		if !ok {
+			t.Fatalf("packet type mismatch: have %T, want %T", packet.Packet, new(NewBlockPacket))
+		}
+		if ann.Block.Hash() != block.Hash() {
+			t.Errorf("block mismatch: have %x, want %x", ann.Block.Hash(), block.Hash())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("block not delivered")
+	}
+	if len(txs) != 0 {
+		t.Errorf("block delivered to subscriber of another kind")
+	}
+	// Unsubscribed channels don't get further packets
+	sub.Unsubscribe()
+
+	go p2p.Send(app, NewBlockMsg, &NewBlockPacket{Block: block})
+	if err := handleMessage(backend, peer); err != nil {
+		t.Fatalf("failed to handle block: %v", err)
+	}
+	if len(blocks) != 0 {
+		t.Errorf("block delivered after unsubscribing")
+	}
+}
+
+// Tests that the request ids of tagged `eth/66` messages are stripped off for
+// decoding, and the observed messages can still be decoded by their handlers.
+func TestObserveTaggedPacket(t *testing.T) {
+	var (
+		feed    = &packetFeed{subs: make(map[byte]map[chan<- *InboundPacket]struct{})}
+		packets = make(chan *InboundPacket, 1)
+		peer    = NewPeer(ETH66, p2p.NewPeer(enode.ID{0xf2}, "peer", nil), nil, nil)
+		query   = GetBlockBodiesPacket{{0x01}, {0x02}}
+	)
+	defer feed.subscribe(GetBlockBodiesMsg, packets).Unsubscribe()
+
+	msg, err := feed.observe(peer, encodeMsg(t, GetBlockBodiesMsg, &GetBlockBodiesPacket66{RequestId: 7, GetBlockBodiesPacket: query}))
+	if err != nil {
+		t.Fatalf("failed to observe message: %v", err)
+	}
+	packet := <-packets
+	if packet.RequestId != 7 {
+		t.Errorf("request id mismatch: have %d, want %d", packet.RequestId, 7)
+	}
+	if have := *packet.Packet.(*GetBlockBodiesPacket); len(have) != len(query) || have[0] != query[0] || have[1] != query[1] {
+		t.Errorf("packet mismatch: have %x, want %x", have, query)
+	}
+	var decoded GetBlockBodiesPacket66
+	if err := msg.Decode(&decoded); err != nil {
+		t.Fatalf("failed to decode observed message: %v", err)
+	}
+	if decoded.RequestId != 7 || len(decoded.GetBlockBodiesPacket) != len(query) {
+		t.Errorf("observed message mismatch: have %v", decoded)
+	}
+}
+
+// Tests that a subscriber not draining its channel doesn't block the delivery
+// of packets, neither to the read loop nor to other subscribers.
+func TestSubscribePacketsSlowSubscriber(t *testing.T) {
+	var (
+		feed = &packetFeed{subs: make(map[byte]map[chan<- *InboundPacket]struct{})}
+		slow = make(chan *InboundPacket)
+		fast = make(chan *InboundPacket, 8)
+	)
+	defer feed.subscribe(NewBlockMsg, slow).Unsubscribe()
+	defer feed.subscribe(NewBlockMsg, fast).Unsubscribe()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < cap(fast); i++ {
+			feed.send(&InboundPacket{Packet: new(NewBlockPacket)})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("packet delivery blocked on slow subscriber")
+	}
+	if len(fast) != cap(fast) {
+		t.Errorf("fast subscriber packets mismatch: have %d, want %d", len(fast), cap(fast))
+	}
+	if feed.dropped != uint64(cap(fast)) {
+		t.Errorf("dropped packets mismatch: have %d, want %d", feed.dropped, cap(fast))
+	}
+}
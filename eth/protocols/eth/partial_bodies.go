@@ -0,0 +1,197 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// bodyFieldOrder lists the body fields in bit order, which is also the order
+// they are stored in the encoded block bodies.
+var bodyFieldOrder = []BodyField{BodyFieldTransactions, BodyFieldUncles, BodyFieldExtTransactions, BodyFieldSubManifest}
+
+// selectBodyFields reduces an encoded block body to the given fields, without
+// decoding them.
+func selectBodyFields(body rlp.RawValue, fields BodyField) (PartialBlockBody, error) {
+	content, _, err := rlp.SplitList(body)
+	if err != nil {
+		return nil, err
+	}
+	partial := make(PartialBlockBody, 0, bits.OnesCount64(uint64(fields)))
+	for _, field := range bodyFieldOrder {
+		_, _, rest, err := rlp.Split(content)
+		if err != nil {
+			return nil, fmt.Errorf("field %#x: %v", uint64(field), err)
+		}
+		if fields&field != 0 {
+			partial = append(partial, rlp.RawValue(content[:len(content)-len(rest)]))
+		}
+		content = rest
+	}
+	return partial, nil
+}
+
+// Unpack decodes the fields of the partial body flagged in the bitmap, leaving
+// the other fields of the returned body empty.
+func (b PartialBlockBody) Unpack(fields BodyField) (*BlockBody, error) {
+	if fields&^bodyFieldsKnown != 0 {
+		return nil, fmt.Errorf("%w: unknown fields %#x", errInvalidPartialBody, uint64(fields&^bodyFieldsKnown))
+	}
+	if len(b) != bits.OnesCount64(uint64(fields)) {
+		return nil, fmt.Errorf("%w: %d values for fields %#x", errInvalidPartialBody, len(b), uint64(fields))
+	}
+	var (
+		body   = new(BlockBody)
+		values = b
+	)
+	for _, field := range bodyFieldOrder {
+		if fields&field == 0 {
+			continue
+		}
+		var val interface{}
+		switch field {
+		case BodyFieldTransactions:
+			val = &body.Transactions
+		case BodyFieldUncles:
+			val = &body.Uncles
+		case BodyFieldExtTransactions:
+			val = &body.ExtTransactions
+		case BodyFieldSubManifest:
+			val = &body.SubManifest
+		}
+		if err := rlp.DecodeBytes(values[0], val); err != nil {
+			return nil, fmt.Errorf("%w: field %#x: %v", errInvalidPartialBody, uint64(field), err)
+		}
+		values = values[1:]
+	}
+	return body, nil
+}
+
+// sanityCheck verifies that the reply only flags known fields and that every
+// body carries exactly one value for each of them.
+func (p *PartialBodiesPacket) sanityCheck() error {
+	if p.Fields&^bodyFieldsKnown != 0 {
+		return fmt.Errorf("%w: unknown fields %#x", errInvalidPartialBody, uint64(p.Fields&^bodyFieldsKnown))
+	}
+	want := bits.OnesCount64(uint64(p.Fields))
+	for i, body := range p.Bodies {
+		if len(body) != want {
+			return fmt.Errorf("%w: body %d has %d values, want %d", errInvalidPartialBody, i, len(body), want)
+		}
+	}
+	return nil
+}
+
+// Unpack decodes the partial bodies of the reply, the fields which weren't
+// requested being left empty.
+func (p *PartialBodiesPacket) Unpack() ([]*BlockBody, error) {
+	bodies := make([]*BlockBody, len(p.Bodies))
+	for i, partial := range p.Bodies {
+		body, err := partial.Unpack(p.Fields)
+		if err != nil {
+			return nil, fmt.Errorf("body %d: %w", i, err)
+		}
+		bodies[i] = body
+	}
+	return bodies, nil
+}
+
+// answerGetPartialBodiesQuery gathers the requested block bodies like a plain
+// body retrieval, reduced to the requested fields. Unknown blocks are skipped.
+// Queries selecting no or unknown fields, or exceeding the serving limit, are
+// rejected.
+func answerGetPartialBodiesQuery(chain chainReader, query GetPartialBodiesPacket, policy ResponsePolicy) (PartialBodiesPacket, error) {
+	if query.Fields == 0 || query.Fields&^bodyFieldsKnown != 0 {
+		return PartialBodiesPacket{}, fmt.Errorf("%w: body fields %#x", errInvalidQuery, uint64(query.Fields))
+	}
+	if len(query.Hashes) > maxBodiesServe {
+		return PartialBodiesPacket{}, fmt.Errorf("%w: %d bodies requested, limit %d", errInvalidQuery, len(query.Hashes), maxBodiesServe)
+	}
+	var (
+		bytes    int
+		response = PartialBodiesPacket{Fields: query.Fields}
+	)
+	for i, hash := range query.Hashes {
+		if bytes >= softResponseLimit {
+			if policy == RejectResponse {
+				return PartialBodiesPacket{Fields: query.Fields}, fmt.Errorf("%w: only %d of %d bodies fit", errResponseTooLarge, i, len(query.Hashes))
+			}
+			break
+		}
+		data := chain.GetBodyRLP(hash)
+		if len(data) == 0 {
+			continue
+		}
+		body, err := selectBodyFields(data, query.Fields)
+		if err != nil {
+			return PartialBodiesPacket{Fields: query.Fields}, fmt.Errorf("body %x: %v", hash, err)
+		}
+		response.Bodies = append(response.Bodies, body)
+		for _, value := range body {
+			bytes += len(value)
+		}
+	}
+	return response, nil
+}
+
+// ReplyPartialBodies is the eth/67 response to GetPartialBodies.
+func (p *Peer) ReplyPartialBodies(id uint64, response PartialBodiesPacket) error {
+	return send(p.rw, PartialBodiesMsg, &PartialBodiesPacket66{
+		RequestId:           id,
+		PartialBodiesPacket: response,
+	})
+}
+
+// RequestPartialBodies fetches a batch of blocks' bodies reduced to the given
+// fields.
+func (p *Peer) RequestPartialBodies(fields BodyField, hashes []common.Hash) error {
+	return p.requestPartialBodies(rand.Uint64(), fields, hashes)
+}
+
+// FetchPartialBodies retrieves a batch of blocks' bodies reduced to the given
+// fields, waiting for the reply up to the given timeout.
+func (p *Peer) FetchPartialBodies(fields BodyField, hashes []common.Hash, timeout time.Duration) (*PartialBodiesPacket, error) {
+	res, err := p.fetch(fmt.Sprintf("%d partial bodies", len(hashes)), timeout, func(id uint64) error {
+		return p.requestPartialBodies(id, fields, hashes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*PartialBodiesPacket), nil
+}
+
+// requestPartialBodies sends a partial bodies request under the given id.
+func (p *Peer) requestPartialBodies(id uint64, fields BodyField, hashes []common.Hash) error {
+	p.Log().Debug("Fetching batch of partial block bodies", "count", len(hashes), "fields", uint64(fields))
+	if err := p.checkOptional(GetPartialBodiesMsg); err != nil {
+		return err
+	}
+	requestTracker.Track(p.id, p.version, GetPartialBodiesMsg, PartialBodiesMsg, id)
+	return send(p.rw, GetPartialBodiesMsg, &GetPartialBodiesPacket66{
+		RequestId: id,
+		GetPartialBodiesPacket: GetPartialBodiesPacket{
+			Fields: fields,
+			Hashes: hashes,
+		},
+	})
+}
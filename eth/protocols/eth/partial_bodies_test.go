@@ -0,0 +1,247 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"math/big"
+	"math/bits"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// newPartialBodiesChain creates a test chain whose head block has a body with
+// all of its fields populated.
+func newPartialBodiesChain() (*testChain, common.Hash, *types.Body) {
+	uncle := types.EmptyHeader()
+	uncle.SetNumber(big.NewInt(9))
+
+	var (
+		chain = newTestChain(10)
+		hash  = chain.CurrentHeader().Hash()
+		txs   = newTestTransactions(4)
+		body  = &types.Body{
+			Transactions:    txs[:2],
+			Uncles:          []*types.Header{uncle},
+			ExtTransactions: txs[2:],
+			SubManifest:     types.BlockManifest{{0x01}, {0x02}},
+		}
+	)
+	chain.addBody(hash, body)
+	return chain, hash, body
+}
+
+// checkPartialBody verifies that exactly the selected fields of a body were
+// served.
+func checkPartialBody(t *testing.T, fields BodyField, have *BlockBody, want *types.Body) {
+	t.Helper()
+
+	txHashes := func(txs []*types.Transaction) (hashes []common.Hash) {
+		for _, tx := range txs {
+			hashes = append(hashes, tx.Hash())
+		}
+		return hashes
+	}
+	checkTxs := func(name string, field BodyField, have, want []*types.Transaction) {
+		if fields&field == 0 {
+			want = nil
+		}
+		haveHashes, wantHashes := txHashes(have), txHashes(want)
+		if len(haveHashes) != len(wantHashes) {
+			t.Errorf("fields %#x: %s count mismatch: have %d, want %d", uint64(fields), name, len(haveHashes), len(wantHashes))
+			return
+		}
+		for i := range wantHashes {
+			if haveHashes[i] != wantHashes[i] {
+				t.Errorf("fields %#x: %s %d mismatch: have %x, want %x", uint64(fields), name, i, haveHashes[i], wantHashes[i])
+			}
+		}
+	}
+	checkTxs("transaction", BodyFieldTransactions, have.Transactions, want.Transactions)
+	checkTxs("etx", BodyFieldExtTransactions, have.ExtTransactions, want.ExtTransactions)
+
+	wantUncles := 0
+	if fields&BodyFieldUncles != 0 {
+		wantUncles = len(want.Uncles)
+	}
+	if len(have.Uncles) != wantUncles {
+		t.Errorf("fields %#x: uncle count mismatch: have %d, want %d", uint64(fields), len(have.Uncles), wantUncles)
+	} else if wantUncles > 0 && have.Uncles[0].Hash() != want.Uncles[0].Hash() {
+		t.Errorf("fields %#x: uncle mismatch: have %x, want %x", uint64(fields), have.Uncles[0].Hash(), want.Uncles[0].Hash())
+	}
+	var wantManifest types.BlockManifest
+	if fields&BodyFieldSubManifest != 0 {
+		wantManifest = want.SubManifest
+	}
+	if len(have.SubManifest) != len(wantManifest) {
+		t.Errorf("fields %#x: manifest length mismatch: have %d, want %d", uint64(fields), len(have.SubManifest), len(wantManifest))
+		return
+	}
+	for i := range wantManifest {
+		if have.SubManifest[i] != wantManifest[i] {
+			t.Errorf("fields %#x: manifest entry %d mismatch: have %x, want %x", uint64(fields), i, have.SubManifest[i], wantManifest[i])
+		}
+	}
+}
+
+// Tests that every subset of the body fields can be requested, the bodies only
+// carrying the selected fields.
+func TestGetPartialBodiesFieldSubsets(t *testing.T) {
+	chain, hash, body := newPartialBodiesChain()
+
+	for fields := BodyField(1); fields <= bodyFieldsKnown; fields++ {
+		query := GetPartialBodiesPacket{Fields: fields, Hashes: []common.Hash{hash, {0xff}}}
+		res, err := answerGetPartialBodiesQuery(chain, query, TruncateResponse)
+		if err != nil {
+			t.Fatalf("fields %#x: failed to answer query: %v", uint64(fields), err)
+		}
+		if res.Fields != fields {
+			t.Errorf("fields %#x: reply fields mismatch: have %#x", uint64(fields), uint64(res.Fields))
+		}
+		// The unknown block is skipped, the known one reduced to the fields
+		if len(res.Bodies) != 1 {
+			t.Fatalf("fields %#x: body count mismatch: have %d, want 1", uint64(fields), len(res.Bodies))
+		}
+		if have, want := len(res.Bodies[0]), bits.OnesCount64(uint64(fields)); have != want {
+			t.Fatalf("fields %#x: value count mismatch: have %d, want %d", uint64(fields), have, want)
+		}
+		if err := res.sanityCheck(); err != nil {
+			t.Fatalf("fields %#x: reply failed sanity check: %v", uint64(fields), err)
+		}
+		bodies, err := res.Unpack()
+		if err != nil {
+			t.Fatalf("fields %#x: failed to unpack reply: %v", uint64(fields), err)
+		}
+		checkPartialBody(t, fields, bodies[0], body)
+	}
+}
+
+// Tests that queries selecting no or unknown fields, or too many bodies, are
+// rejected as invalid.
+func TestGetPartialBodiesInvalid(t *testing.T) {
+	chain, hash, _ := newPartialBodiesChain()
+
+	tests := []GetPartialBodiesPacket{
+		{Fields: 0, Hashes: []common.Hash{hash}},
+		{Fields: BodyFieldTransactions | bodyFieldsKnown + 1, Hashes: []common.Hash{hash}},
+		{Fields: BodyFieldTransactions, Hashes: make([]common.Hash, maxBodiesServe+1)},
+	}
+	for i, query := range tests {
+		if _, err := answerGetPartialBodiesQuery(chain, query, TruncateResponse); !errors.Is(err, errInvalidQuery) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, errInvalidQuery)
+		}
+	}
+}
+
+// Tests that partial body replies whose values don't match the flagged fields
+// are rejected.
+func TestPartialBodiesSanityCheck(t *testing.T) {
+	tests := []struct {
+		packet PartialBodiesPacket
+		valid  bool
+	}{
+		{PartialBodiesPacket{Fields: BodyFieldUncles, Bodies: []PartialBlockBody{{{0xc0}}}}, true},
+		{PartialBodiesPacket{Fields: BodyFieldUncles | BodyFieldSubManifest, Bodies: []PartialBlockBody{{{0xc0}, {0xc0}}, {{0xc0}, {0xc0}}}}, true},
+		{PartialBodiesPacket{Fields: BodyFieldUncles}, true},
+		{PartialBodiesPacket{Fields: BodyFieldUncles, Bodies: []PartialBlockBody{{{0xc0}, {0xc0}}}}, false},
+		{PartialBodiesPacket{Fields: BodyFieldUncles | BodyFieldSubManifest, Bodies: []PartialBlockBody{{{0xc0}}}}, false},
+		{PartialBodiesPacket{Fields: bodyFieldsKnown + 1, Bodies: []PartialBlockBody{{{0xc0}}}}, false},
+	}
+	for i, tt := range tests {
+		err := tt.packet.sanityCheck()
+		if tt.valid && err != nil {
+			t.Errorf("test %d: valid reply rejected: %v", i, err)
+		}
+		if !tt.valid && !errors.Is(err, errInvalidPartialBody) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, errInvalidPartialBody)
+		}
+	}
+	// Values not decoding into their field are caught on unpacking
+	bad := PartialBodiesPacket{Fields: BodyFieldSubManifest, Bodies: []PartialBlockBody{{rlp.RawValue{0x01}}}}
+	if _, err := bad.Unpack(); !errors.Is(err, errInvalidPartialBody) {
+		t.Errorf("undecodable value: error mismatch: have %v, want %v", err, errInvalidPartialBody)
+	}
+}
+
+// Tests that partial bodies round-trip through the wire, and that the request
+// is refused to peers older than eth/67.
+func TestPartialBodiesRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		chain, hash, body = newPartialBodiesChain()
+		fields            = BodyFieldExtTransactions | BodyFieldSubManifest
+		local             = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xe4, 0x01}, "peer", nil), net, nil)
+		remote            = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xe4, 0x02}, "peer", nil), app, nil)
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	advertiseOptional(local, GetPartialBodiesMsg)
+	go local.RequestPartialBodies(fields, []common.Hash{hash})
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	if msg.Code != GetPartialBodiesMsg {
+		t.Fatalf("request code mismatch: have %#x, want %#x", msg.Code, GetPartialBodiesMsg)
+	}
+	var query GetPartialBodiesPacket66
+	if err := msg.Decode(&query); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	if query.Fields != fields || len(query.Hashes) != 1 || query.Hashes[0] != hash {
+		t.Fatalf("request mismatch: have %+v", query.GetPartialBodiesPacket)
+	}
+	res, err := answerGetPartialBodiesQuery(chain, query.GetPartialBodiesPacket, TruncateResponse)
+	if err != nil {
+		t.Fatalf("failed to answer query: %v", err)
+	}
+	go remote.ReplyPartialBodies(query.RequestId, res)
+
+	backend := new(mockBackend)
+	if err := handleMessage(backend, local); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+	}
+	bodies, err := backend.handled[0].(*PartialBodiesPacket).Unpack()
+	if err != nil {
+		t.Fatalf("failed to unpack reply: %v", err)
+	}
+	if len(bodies) != 1 {
+		t.Fatalf("body count mismatch: have %d, want 1", len(bodies))
+	}
+	checkPartialBody(t, fields, bodies[0], body)
+
+	// Peers older than eth/67 can't be asked
+	old := NewPeer(ETH66, p2p.NewPeer(enode.ID{0xe4, 0x03}, "peer", nil), net, nil)
+	defer old.Close()
+
+	if err := old.RequestPartialBodies(fields, []common.Hash{hash}); err == nil {
+		t.Errorf("eth/66 peer accepted partial bodies request")
+	}
+}
@@ -18,9 +18,11 @@ package eth
 
 import (
 	"errors"
+	"fmt"
 	"math/big"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	mapset "github.com/deckarep/golang-set"
@@ -60,6 +62,11 @@ const (
 	// dropping broadcasts. Similarly to block propagations, there's no point to queue
 	// above some healthy uncle limit, so use that.
 	maxQueuedBlockAnns = 4
+
+	// maxTxRequests is the maximum number of pooled transaction requests to track
+	// per peer, awaiting their replies. The transaction fetcher only keeps a few of
+	// them in flight, so the older ones are long expired when this is reached.
+	maxTxRequests = 64
 )
 
 // max is a helper function which returns the larger of the two given integers.
@@ -75,7 +82,7 @@ type Peer struct {
 	id string // Unique ID for the peer, cached
 
 	*p2p.Peer                       // The embedded P2P package peer
-	rw            p2p.MsgReadWriter // Input/output streams for snap
+	rw            *limitedRW        // Input/output streams for snap, capped to the negotiated message size
 	version       uint              // Protocol version negotiated
 	slicesRunning []common.Location // Slices run by the node
 
@@ -84,6 +91,32 @@ type Peer struct {
 	entropy        *big.Int    // Latest advertised head block entropy
 	receivedHeadAt time.Time   // Time when the head was received
 
+	maxEntropy *big.Int // Highest entropy ever advertised by the peer
+	maxNumber  *big.Int // Number of the block with the highest entropy, nil if unknown
+
+	capabilities  *CapabilitiesPacket // Latest serving capabilities reported by the peer, nil if never queried
+	experimental  bool                // Whether both sides opted into the experimental messages
+	clientVersion string              // Software and version advertised by the peer, empty if unknown
+	optional      map[uint64]struct{} // Optional requests advertised by the peer in the handshake
+	light         bool                // Whether the peer announced not serving any requests
+	session       *sessionKey         // Session established in the handshake, nil if not resumable
+	announced     *StatusPacket       // Mutable status fields last announced to the peer
+	status        *StatusPacket       // Status advertised by the peer in the handshake, nil before it
+	fresh         bool                // Whether no message was received since the handshake
+
+	decodeFailures []time.Time // Times of the undecodable messages received within the failure window
+	untagged       bool        // Whether the peer was caught replying without request ids on eth/66
+	amplification  ampTracker  // Amplification of the data retrievals served to the peer
+
+	fetches        map[uint64]chan Packet              // Direct fetches awaiting a reply, keyed by request id
+	txRequests     map[uint64]map[common.Hash]struct{} // Pooled transactions requested from the peer, keyed by request id
+	unrequestedTxs int                                 // Number of replies carrying unrequested pooled transactions
+
+	compactTxAnns *txPrefixIndex // Transactions announced to the peer in compact form
+
+	allowlist  map[uint64]struct{} // Message codes the peer may send, nil if unrestricted
+	disallowed int                 // Number of messages received outside of the allowlist
+
 	knownBlocks     mapset.Set             // Set of block hashes known to be known by this peer
 	queuedBlocks    chan *blockPropagation // Queue of blocks to broadcast to the peer
 	queuedBlockAnns chan *types.Block      // Queue of blocks to announce to the peer
@@ -95,26 +128,41 @@ type Peer struct {
 	txBroadcast chan []common.Hash // Channel used to queue transaction propagation requests
 	txAnnounce  chan []common.Hash // Channel used to queue transaction announcement requests
 
-	term chan struct{} // Termination channel to stop the broadcasters
-	lock sync.RWMutex  // Mutex protecting the internal fields
+	config *Config       // Protocol settings of the local node
+	term   chan struct{} // Termination channel to stop the broadcasters
+	lock   sync.RWMutex  // Mutex protecting the internal fields
 }
 
 // NewPeer create a wrapper for a network connection and negotiated  protocol
-// version.
+// version, running with the default protocol settings.
 func NewPeer(version uint, p *p2p.Peer, rw p2p.MsgReadWriter, txpool TxPool) *Peer {
+	return newPeer(version, p, rw, txpool, &DefaultConfig)
+}
+
+// NewPeerWithConfig creates a wrapper for a network connection and negotiated
+// protocol version, running with the given protocol settings.
+func NewPeerWithConfig(version uint, p *p2p.Peer, rw p2p.MsgReadWriter, txpool TxPool, config *Config) *Peer {
+	return newPeer(version, p, rw, txpool, config)
+}
+
+// newPeer creates a wrapper for a network connection and negotiated protocol
+// version, running with the given protocol settings.
+func newPeer(version uint, p *p2p.Peer, rw p2p.MsgReadWriter, txpool TxPool, config *Config) *Peer {
 	peer := &Peer{
 		id:               p.ID().String(),
 		Peer:             p,
-		rw:               rw,
+		rw:               &limitedRW{MsgReadWriter: rw, id: p.ID().String(), version: version, limit: maxMessageSize},
 		version:          version,
 		knownTxs:         mapset.NewSet(),
 		knownBlocks:      mapset.NewSet(),
 		knownPendingEtxs: mapset.NewSet(),
+		compactTxAnns:    newTxPrefixIndex(maxCompactTxAnns),
 		queuedBlocks:     make(chan *blockPropagation, maxQueuedBlocks),
 		queuedBlockAnns:  make(chan *types.Block, maxQueuedBlockAnns),
 		txBroadcast:      make(chan []common.Hash),
 		txAnnounce:       make(chan []common.Hash),
 		txpool:           txpool,
+		config:           config,
 		term:             make(chan struct{}),
 	}
 	// Start up all the broadcasters
@@ -126,10 +174,46 @@ func NewPeer(version uint, p *p2p.Peer, rw p2p.MsgReadWriter, txpool TxPool) *Pe
 	return peer
 }
 
+// limitedRW is a message stream refusing to send messages above the message
+// size limit negotiated with the remote peer.
+type limitedRW struct {
+	p2p.MsgReadWriter
+	id      string // Identifier of the remote peer, for message recording
+	version uint   // Protocol version negotiated
+	limit   uint64 // Message size limit, accessed atomically
+	served  uint64 // Bytes of the replies sent to data retrievals, accessed atomically
+}
+
+// WriteMsg sends a message, unless it's above the negotiated size limit.
+func (rw *limitedRW) WriteMsg(msg p2p.Msg) error {
+	if limit := atomic.LoadUint64(&rw.limit); uint64(msg.Size) > limit {
+		return fmt.Errorf("%w: %v > %v", errMsgTooLarge, msg.Size, limit)
+	}
+	if r := activeRecorder(); r != nil {
+		var err error
+		if msg, err = r.record(rw.id, rw.version, true, msg); err != nil {
+			return err
+		}
+	}
+	if responseMsgs[msg.Code] {
+		atomic.AddUint64(&rw.served, uint64(msg.Size))
+	}
+	return rw.MsgReadWriter.WriteMsg(msg)
+}
+
+// setLimit updates the message size limit of the stream.
+func (rw *limitedRW) setLimit(limit uint64) {
+	atomic.StoreUint64(&rw.limit, limit)
+}
+
 // Close signals the broadcast goroutine to terminate. Only ever call this if
 // you created the peer yourself via NewPeer. Otherwise let whoever created it
 // clean it up!
 func (p *Peer) Close() {
+	if p.session != nil {
+		sessions.release(*p.session, p.config.SessionLifetime)
+	}
+	p.observe(PeerSignal{Type: PeerSignalClosed})
 	close(p.term)
 }
 
@@ -163,6 +247,181 @@ func (p *Peer) SetHead(hash common.Hash, number *big.Int, entropy *big.Int, rece
 	p.entropy = new(big.Int).Set(entropy)
 }
 
+// Capabilities retrieves the latest serving capabilities reported by the peer,
+// or nil if they were never queried.
+func (p *Peer) Capabilities() *CapabilitiesPacket {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.capabilities
+}
+
+// SetCapabilities updates the serving capabilities of the peer.
+func (p *Peer) SetCapabilities(caps *CapabilitiesPacket) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.capabilities = caps
+}
+
+// TrackEntropy records an entropy advertised by the peer for the block of the
+// given number, returning an error if it regressed from the highest one further
+// than a reorg of the configured depth can explain. The entropy of a block being
+// estimated from the average of the advertised chain, the regression can't be
+// judged until a block number is known.
+func (p *Peer) TrackEntropy(number *big.Int, entropy *big.Int) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.maxEntropy == nil || entropy.Cmp(p.maxEntropy) >= 0 {
+		p.maxEntropy = new(big.Int).Set(entropy)
+		if p.maxNumber = nil; number != nil {
+			p.maxNumber = new(big.Int).Set(number)
+		}
+		return nil
+	}
+	ref, refNumber := p.maxEntropy, p.maxNumber
+	if refNumber == nil || refNumber.Sign() == 0 {
+		ref, refNumber = entropy, number
+	}
+	if refNumber == nil || refNumber.Sign() == 0 {
+		return nil
+	}
+	bound := new(big.Int).Div(ref, refNumber)
+	bound.Mul(bound, new(big.Int).SetUint64(p.config.MaxReorgDepth))
+
+	if drop := new(big.Int).Sub(p.maxEntropy, entropy); drop.Cmp(bound) > 0 {
+		entropyRegressionMeter.Mark(1)
+		p.Log().Warn("Peer entropy regressed", "highest", p.maxEntropy, "entropy", entropy, "bound", bound)
+		return fmt.Errorf("%w: %v -> %v", errEntropyRegression, p.maxEntropy, entropy)
+	}
+	return nil
+}
+
+// tolerateDecodeFailure records an undecodable message received from the peer,
+// reporting whether the peer is still below the limit of decode failures.
+func (p *Peer) tolerateDecodeFailure() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	recent := p.decodeFailures[:0]
+	for _, failure := range p.decodeFailures {
+		if now.Sub(failure) < p.config.DecodeFailureWindow {
+			recent = append(recent, failure)
+		}
+	}
+	p.decodeFailures = append(recent, now)
+	return len(p.decodeFailures) < p.config.MaxDecodeFailures
+}
+
+// SetAllowlist restricts the messages accepted from the peer to the given codes.
+// Other messages are discarded, and the peer is dropped after the configured number
+// of them. A nil list lifts the restriction.
+func (p *Peer) SetAllowlist(codes []uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if codes == nil {
+		p.allowlist = nil
+		return
+	}
+	p.allowlist = make(map[uint64]struct{}, len(codes))
+	for _, code := range codes {
+		p.allowlist[code] = struct{}{}
+	}
+}
+
+// allowed reports whether the peer may send messages with the given code.
+func (p *Peer) allowed(code uint64) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if p.allowlist == nil {
+		return true
+	}
+	_, ok := p.allowlist[code]
+	return ok
+}
+
+// tolerateDisallowed records a message received from the peer outside of its
+// allowlist, reporting whether the peer is still below the limit of them.
+func (p *Peer) tolerateDisallowed() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.disallowed++
+	return p.disallowed < p.config.MaxDisallowedMessages
+}
+
+// markUntagged records that the peer sent an eth/66 reply without a request id,
+// reporting whether it's the first time it did so.
+func (p *Peer) markUntagged() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	first := !p.untagged
+	p.untagged = true
+	return first
+}
+
+// markReceived records that a message was received from the peer, reporting
+// whether it's the first one since the handshake.
+func (p *Peer) markReceived() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	first := p.fresh
+	p.fresh = false
+	return first
+}
+
+// ClientVersion retrieves the software and version advertised by the peer during
+// the handshake, or an empty string if it didn't advertise any.
+func (p *Peer) ClientVersion() string {
+	return p.clientVersion
+}
+
+// Status retrieves a copy of the status the peer advertised in the handshake, or
+// nil if the handshake didn't complete yet. The head and entropy are those of the
+// handshake, the latest ones are reported by Head.
+func (p *Peer) Status() *StatusPacket {
+	if p.status == nil {
+		return nil
+	}
+	status := *p.status
+	return &status
+}
+
+// Light reports whether the peer announced itself as a light node in the
+// handshake, not serving any requests.
+func (p *Peer) Light() bool {
+	return p.light
+}
+
+// Experimental reports whether experimental messages may be exchanged with the
+// peer, which is the case if both sides opted in during the handshake.
+func (p *Peer) Experimental() bool {
+	return p.experimental
+}
+
+// SendExperimental sends a message from the experimental range to the peer.
+func (p *Peer) SendExperimental(code uint64, data interface{}) error {
+	if !isExperimental(code) {
+		return fmt.Errorf("%w: %v", errInvalidMsgCode, code)
+	}
+	if !p.experimental {
+		return errNotExperimental
+	}
+	return send(p.rw, code, data)
+}
+
+// MaxMessageSize returns the size limit of the messages exchanged with the peer,
+// as negotiated during the handshake.
+func (p *Peer) MaxMessageSize() uint64 {
+	return atomic.LoadUint64(&p.rw.limit)
+}
+
 // SlicesRunning returns the slices that are running by the node
 func (p *Peer) SlicesRunning() []common.Location {
 	return p.slicesRunning
@@ -201,6 +460,7 @@ func (p *Peer) markTransaction(hash common.Hash) {
 		p.knownTxs.Pop()
 	}
 	p.knownTxs.Add(hash)
+	seenTxs.add(hash)
 }
 
 // markPendingEtxs marks a pendingEtxs header as known for the peer, ensuring that the block will
@@ -230,7 +490,7 @@ func (p *Peer) SendTransactions(txs types.Transactions) error {
 	for _, tx := range txs {
 		p.knownTxs.Add(tx.Hash())
 	}
-	return p2p.Send(p.rw, TransactionsMsg, txs)
+	return send(p.rw, TransactionsMsg, txs)
 }
 
 // AsyncSendTransactions queues a list of transactions (by hash) to eventually
@@ -265,7 +525,10 @@ func (p *Peer) sendPooledTransactionHashes(hashes []common.Hash) error {
 	for _, hash := range hashes {
 		p.knownTxs.Add(hash)
 	}
-	return p2p.Send(p.rw, NewPooledTransactionHashesMsg, NewPooledTransactionHashesPacket(hashes))
+	if p.experimental {
+		return p.sendCompactPooledTransactionHashes(hashes)
+	}
+	return send(p.rw, NewPooledTransactionHashesMsg, NewPooledTransactionHashesPacket(hashes))
 }
 
 // AsyncSendPooledTransactionHashes queues a list of transactions hashes to eventually
@@ -299,7 +562,7 @@ func (p *Peer) SendPooledTransactionsRLP(hashes []common.Hash, txs []rlp.RawValu
 	for _, hash := range hashes {
 		p.knownTxs.Add(hash)
 	}
-	return p2p.Send(p.rw, PooledTransactionsMsg, txs) // Not packed into PooledTransactionsPacket to avoid RLP decoding
+	return send(p.rw, PooledTransactionsMsg, txs) // Not packed into PooledTransactionsPacket to avoid RLP decoding
 }
 
 // ReplyPooledTransactionsRLP is the eth/66 version of SendPooledTransactionsRLP.
@@ -312,7 +575,7 @@ func (p *Peer) ReplyPooledTransactionsRLP(id uint64, hashes []common.Hash, txs [
 		p.knownTxs.Add(hash)
 	}
 	// Not packed into PooledTransactionsPacket to avoid RLP decoding
-	return p2p.Send(p.rw, PooledTransactionsMsg, PooledTransactionsRLPPacket66{
+	return send(p.rw, PooledTransactionsMsg, PooledTransactionsRLPPacket66{
 		RequestId:                   id,
 		PooledTransactionsRLPPacket: txs,
 	})
@@ -333,7 +596,7 @@ func (p *Peer) SendNewBlockHashes(hashes []common.Hash, numbers []uint64) error
 		request[i].Hash = hashes[i]
 		request[i].Number = numbers[i]
 	}
-	return p2p.Send(p.rw, NewBlockHashesMsg, request)
+	return send(p.rw, NewBlockHashesMsg, request)
 }
 
 // AsyncSendNewBlockHash queues the availability of a block for propagation to a
@@ -359,7 +622,7 @@ func (p *Peer) SendNewBlock(block *types.Block) error {
 		p.knownBlocks.Pop()
 	}
 	p.knownBlocks.Add(block.Hash())
-	return p2p.Send(p.rw, NewBlockMsg, &NewBlockPacket{
+	return send(p.rw, NewBlockMsg, &NewBlockPacket{
 		Block: block,
 	})
 }
@@ -381,32 +644,165 @@ func (p *Peer) AsyncSendNewBlock(block *types.Block) {
 
 // SendBlockHeaders sends a batch of block headers to the remote peer.
 func (p *Peer) SendBlockHeaders(headers []*types.Header) error {
-	return p2p.Send(p.rw, BlockHeadersMsg, BlockHeadersPacket(headers))
+	return send(p.rw, BlockHeadersMsg, BlockHeadersPacket(headers))
 }
 
 // ReplyBlockHeaders is the eth/66 version of SendBlockHeaders.
 func (p *Peer) ReplyBlockHeaders(id uint64, headers []*types.Header) error {
-	return p2p.Send(p.rw, BlockHeadersMsg, BlockHeadersPacket66{
+	return send(p.rw, BlockHeadersMsg, BlockHeadersPacket66{
 		RequestId:          id,
 		BlockHeadersPacket: headers,
 	})
 }
 
+// ReplyHeadersByNumbers is the eth/66 response to a GetHeadersByNumbers request.
+func (p *Peer) ReplyHeadersByNumbers(id uint64, headers []*types.Header) error {
+	return send(p.rw, HeadersByNumbersMsg, HeadersByNumbersPacket66{
+		RequestId:              id,
+		HeadersByNumbersPacket: headers,
+	})
+}
+
+// ReplyHaveBlock is the eth/66 response to a HaveBlock probe.
+func (p *Peer) ReplyHaveBlock(id uint64, hash common.Hash, have bool) error {
+	return send(p.rw, HaveBlockReplyMsg, HaveBlockReplyPacket66{
+		RequestId:            id,
+		HaveBlockReplyPacket: HaveBlockReplyPacket{Hash: hash, Have: have},
+	})
+}
+
+// ReplyPendingEtxsByLocation is the eth/66 response to GetPendingEtxsByLocation.
+func (p *Peer) ReplyPendingEtxsByLocation(id uint64, page *PendingEtxsByLocationPacket) error {
+	return send(p.rw, PendingEtxsByLocationMsg, PendingEtxsByLocationPacket66{
+		RequestId:                   id,
+		PendingEtxsByLocationPacket: *page,
+	})
+}
+
+// ReplyBlockEtxRoots is the eth/66 response to GetBlockEtxRoots.
+func (p *Peer) ReplyBlockEtxRoots(id uint64, roots BlockEtxRootsPacket) error {
+	return send(p.rw, BlockEtxRootsMsg, BlockEtxRootsPacket66{
+		RequestId:           id,
+		BlockEtxRootsPacket: roots,
+	})
+}
+
+// ReplyBlockMiners is the eth/66 response to GetBlockMiners.
+func (p *Peer) ReplyBlockMiners(id uint64, miners BlockMinersPacket) error {
+	return send(p.rw, BlockMinersMsg, BlockMinersPacket66{
+		RequestId:         id,
+		BlockMinersPacket: miners,
+	})
+}
+
+// ReplyUnclesByRangeRLP is the eth/66 response to GetUnclesByRange, with the
+// uncles already RLP encoded.
+func (p *Peer) ReplyUnclesByRangeRLP(id uint64, uncles UnclesByRangeRLPPacket) error {
+	return send(p.rw, UnclesByRangeMsg, UnclesByRangeRLPPacket66{
+		RequestId:              id,
+		UnclesByRangeRLPPacket: uncles,
+	})
+}
+
+// ReplyBlockDataRLP is the eth/67 response to GetBlockData, with the bodies
+// already RLP encoded.
+func (p *Peer) ReplyBlockDataRLP(id uint64, data BlockDataRLPPacket) error {
+	return send(p.rw, BlockDataMsg, BlockDataRLPPacket66{
+		RequestId:          id,
+		BlockDataRLPPacket: data,
+	})
+}
+
+// ReplyBlockByNumber is the eth/67 response to GetBlockByNumber.
+func (p *Peer) ReplyBlockByNumber(id uint64, block *BlockByNumberPacket) error {
+	return send(p.rw, BlockByNumberMsg, BlockByNumberPacket66{
+		RequestId:           id,
+		BlockByNumberPacket: *block,
+	})
+}
+
+// ReplyCanonicalHash is the eth/67 response to GetCanonicalHash.
+func (p *Peer) ReplyCanonicalHash(id uint64, hash *CanonicalHashPacket) error {
+	return send(p.rw, CanonicalHashMsg, CanonicalHashPacket66{
+		RequestId:           id,
+		CanonicalHashPacket: *hash,
+	})
+}
+
+// ReplyPendingEtxsSince is the eth/67 response to GetPendingEtxsSince.
+func (p *Peer) ReplyPendingEtxsSince(id uint64, page *PendingEtxsSincePacket) error {
+	return send(p.rw, PendingEtxsSinceMsg, PendingEtxsSincePacket66{
+		RequestId:              id,
+		PendingEtxsSincePacket: *page,
+	})
+}
+
+// ReplyEtxManifestProof is the eth/67 response to GetEtxManifestProof.
+func (p *Peer) ReplyEtxManifestProof(id uint64, proof *EtxManifestProofPacket) error {
+	return send(p.rw, EtxManifestProofMsg, EtxManifestProofPacket66{
+		RequestId:              id,
+		EtxManifestProofPacket: *proof,
+	})
+}
+
 // SendBlockBodiesRLP sends a batch of block contents to the remote peer from
 // an already RLP encoded format.
 func (p *Peer) SendBlockBodiesRLP(bodies []rlp.RawValue) error {
-	return p2p.Send(p.rw, BlockBodiesMsg, bodies) // Not packed into BlockBodiesPacket to avoid RLP decoding
+	return send(p.rw, BlockBodiesMsg, bodies) // Not packed into BlockBodiesPacket to avoid RLP decoding
 }
 
 // ReplyBlockBodiesRLP is the eth/66 version of SendBlockBodiesRLP.
 func (p *Peer) ReplyBlockBodiesRLP(id uint64, bodies []rlp.RawValue) error {
 	// Not packed into BlockBodiesPacket to avoid RLP decoding
-	return p2p.Send(p.rw, BlockBodiesMsg, BlockBodiesRLPPacket66{
+	return send(p.rw, BlockBodiesMsg, BlockBodiesRLPPacket66{
 		RequestId:            id,
 		BlockBodiesRLPPacket: bodies,
 	})
 }
 
+// ReplyCompactBlockBodies is the experimental eth/66 response to GetBlockBodies,
+// with the ETXs of the bodies in compact form.
+func (p *Peer) ReplyCompactBlockBodies(id uint64, bodies *CompactBlockBodiesPacket) error {
+	return p.SendExperimental(CompactBlockBodiesMsg, CompactBlockBodiesPacket66{
+		RequestId:                id,
+		CompactBlockBodiesPacket: *bodies,
+	})
+}
+
+// ReplyFreshBlockBodiesRLP is the eth/66 response to GetFreshBlockBodies, with
+// the bodies already RLP encoded.
+func (p *Peer) ReplyFreshBlockBodiesRLP(id uint64, response FreshBlockBodiesRLPPacket) error {
+	// Not packed into FreshBlockBodiesPacket to avoid RLP decoding
+	return send(p.rw, FreshBlockBodiesMsg, FreshBlockBodiesRLPPacket66{
+		RequestId:                 id,
+		FreshBlockBodiesRLPPacket: response,
+	})
+}
+
+// ReplyBlockTxHashes is the eth/66 response to a GetBlockTxHashes request.
+func (p *Peer) ReplyBlockTxHashes(id uint64, hashes []common.Hash) error {
+	return send(p.rw, BlockTxHashesMsg, BlockTxHashesPacket66{
+		RequestId:           id,
+		BlockTxHashesPacket: hashes,
+	})
+}
+
+// ReplyCapabilities is the eth/66 response to a GetCapabilities request.
+func (p *Peer) ReplyCapabilities(id uint64, caps *CapabilitiesPacket) error {
+	return send(p.rw, CapabilitiesMsg, CapabilitiesPacket66{
+		RequestId:          id,
+		CapabilitiesPacket: *caps,
+	})
+}
+
+// ReplyHead is the eth/66 response to a GetHead request.
+func (p *Peer) ReplyHead(id uint64, head *HeadPacket) error {
+	return send(p.rw, HeadMsg, HeadPacket66{
+		RequestId:  id,
+		HeadPacket: *head,
+	})
+}
+
 // RequestOneHeader is a wrapper around the header query functions to fetch a
 // single header. It is used solely by the fetcher.
 func (p *Peer) RequestOneHeader(hash common.Hash) error {
@@ -421,12 +817,12 @@ func (p *Peer) RequestOneHeader(hash common.Hash) error {
 		id := rand.Uint64()
 
 		requestTracker.Track(p.id, p.version, GetBlockHeadersMsg, BlockHeadersMsg, id)
-		return p2p.Send(p.rw, GetBlockHeadersMsg, &GetBlockHeadersPacket66{
+		return send(p.rw, GetBlockHeadersMsg, &GetBlockHeadersPacket66{
 			RequestId:             id,
 			GetBlockHeadersPacket: &query,
 		})
 	}
-	return p2p.Send(p.rw, GetBlockHeadersMsg, &query)
+	return send(p.rw, GetBlockHeadersMsg, &query)
 }
 
 // RequestHeadersByHash fetches a batch of blocks' headers corresponding to the
@@ -444,12 +840,203 @@ func (p *Peer) RequestHeadersByHash(origin common.Hash, amount int, skip uint64,
 		id := rand.Uint64()
 
 		requestTracker.Track(p.id, p.version, GetBlockHeadersMsg, BlockHeadersMsg, id)
-		return p2p.Send(p.rw, GetBlockHeadersMsg, &GetBlockHeadersPacket66{
+		return send(p.rw, GetBlockHeadersMsg, &GetBlockHeadersPacket66{
 			RequestId:             id,
 			GetBlockHeadersPacket: &query,
 		})
 	}
-	return p2p.Send(p.rw, GetBlockHeadersMsg, &query)
+	return send(p.rw, GetBlockHeadersMsg, &query)
+}
+
+// RequestBlockEtxRoots fetches the ETX roots of a batch of blocks corresponding
+// to the specified header query, based on the number of an origin block.
+func (p *Peer) RequestBlockEtxRoots(origin uint64, amount int, skip uint64, reverse bool) error {
+	return p.requestBlockEtxRoots(rand.Uint64(), origin, amount, skip, reverse)
+}
+
+// FetchBlockEtxRoots retrieves the ETX roots of a batch of blocks, waiting for
+// the reply up to the given timeout.
+func (p *Peer) FetchBlockEtxRoots(origin uint64, amount int, skip uint64, reverse bool, timeout time.Duration) (BlockEtxRootsPacket, error) {
+	res, err := p.fetch(fmt.Sprintf("%d etx roots from %d", amount, origin), timeout, func(id uint64) error {
+		return p.requestBlockEtxRoots(id, origin, amount, skip, reverse)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return *res.(*BlockEtxRootsPacket), nil
+}
+
+// requestBlockEtxRoots sends an etx roots request under the given id.
+func (p *Peer) requestBlockEtxRoots(id uint64, origin uint64, amount int, skip uint64, reverse bool) error {
+	p.Log().Debug("Fetching batch of etx roots", "count", amount, "skip", skip, "from num", origin, "reverse", reverse)
+	if p.Version() >= ETH66 {
+		requestTracker.Track(p.id, p.version, GetBlockEtxRootsMsg, BlockEtxRootsMsg, id)
+		return send(p.rw, GetBlockEtxRootsMsg, &GetBlockEtxRootsPacket66{
+			RequestId: id,
+			GetBlockEtxRootsPacket: &GetBlockEtxRootsPacket{
+				Origin:  HashOrNumber{Number: origin},
+				Amount:  uint64(amount),
+				Skip:    skip,
+				Reverse: reverse,
+			},
+		})
+	}
+	return errors.New("eth65 not supported for RequestBlockEtxRoots call")
+}
+
+// RequestBlockMiners fetches the miners of a range of consecutive blocks, based
+// on the number of the origin block. If dom is set, only dominant blocks are
+// returned, otherwise the range ends at the first dominant block.
+func (p *Peer) RequestBlockMiners(origin uint64, amount int, dom bool) error {
+	return p.requestBlockMiners(rand.Uint64(), origin, amount, dom)
+}
+
+// FetchBlockMiners retrieves the miners of a range of consecutive blocks, waiting
+// for the reply up to the given timeout.
+func (p *Peer) FetchBlockMiners(origin uint64, amount int, dom bool, timeout time.Duration) (BlockMinersPacket, error) {
+	res, err := p.fetch(fmt.Sprintf("%d block miners from %d", amount, origin), timeout, func(id uint64) error {
+		return p.requestBlockMiners(id, origin, amount, dom)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return *res.(*BlockMinersPacket), nil
+}
+
+// requestBlockMiners sends a block miners request under the given id.
+func (p *Peer) requestBlockMiners(id uint64, origin uint64, amount int, dom bool) error {
+	p.Log().Debug("Fetching batch of block miners", "count", amount, "from num", origin, "dom", dom)
+	if p.Version() >= ETH66 {
+		requestTracker.Track(p.id, p.version, GetBlockMinersMsg, BlockMinersMsg, id)
+		return send(p.rw, GetBlockMinersMsg, &GetBlockMinersPacket66{
+			RequestId: id,
+			GetBlockMinersPacket: GetBlockMinersPacket{
+				Origin: HashOrNumber{Number: origin},
+				Amount: uint64(amount),
+				Dom:    dom,
+			},
+		})
+	}
+	return errors.New("eth65 not supported for RequestBlockMiners call")
+}
+
+// RequestUnclesByRange fetches the uncles referenced by a range of consecutive
+// blocks, based on the number of the origin block. If dom is set, only dominant
+// blocks are returned, otherwise the range ends at the first dominant block.
+func (p *Peer) RequestUnclesByRange(origin uint64, amount int, dom bool) error {
+	return p.requestUnclesByRange(rand.Uint64(), origin, amount, dom)
+}
+
+// FetchUnclesByRange retrieves the uncles referenced by a range of consecutive
+// blocks, waiting for the reply up to the given timeout.
+func (p *Peer) FetchUnclesByRange(origin uint64, amount int, dom bool, timeout time.Duration) (UnclesByRangePacket, error) {
+	res, err := p.fetch(fmt.Sprintf("uncles of %d blocks from %d", amount, origin), timeout, func(id uint64) error {
+		return p.requestUnclesByRange(id, origin, amount, dom)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return *res.(*UnclesByRangePacket), nil
+}
+
+// requestUnclesByRange sends an uncles by range request under the given id.
+func (p *Peer) requestUnclesByRange(id uint64, origin uint64, amount int, dom bool) error {
+	p.Log().Debug("Fetching batch of block uncles", "count", amount, "from num", origin, "dom", dom)
+	if p.Version() >= ETH66 {
+		requestTracker.Track(p.id, p.version, GetUnclesByRangeMsg, UnclesByRangeMsg, id)
+		return send(p.rw, GetUnclesByRangeMsg, &GetUnclesByRangePacket66{
+			RequestId: id,
+			GetUnclesByRangePacket: GetUnclesByRangePacket{
+				Origin: HashOrNumber{Number: origin},
+				Amount: uint64(amount),
+				Dom:    dom,
+			},
+		})
+	}
+	return errors.New("eth65 not supported for RequestUnclesByRange call")
+}
+
+// RequestBlockData fetches the headers and the bodies of a range of consecutive
+// blocks in a single round trip, based on the number of the origin block. Peers
+// older than eth/67 don't serve the composite request, see FetchBlockData for a
+// retrieval falling back to separate requests.
+func (p *Peer) RequestBlockData(origin uint64, amount int, dom bool) error {
+	return p.requestBlockData(rand.Uint64(), origin, amount, dom)
+}
+
+// FetchBlockData retrieves the headers and the bodies of a range of consecutive
+// blocks, waiting for each reply up to the given timeout. Peers older than eth/67
+// are asked for the headers of the range first and for their bodies once known.
+func (p *Peer) FetchBlockData(origin uint64, amount int, dom bool, timeout time.Duration) (*BlockDataPacket, error) {
+	what := fmt.Sprintf("data of %d blocks from #%d", amount, origin)
+	if p.Version() >= ETH67 {
+		res, err := p.fetch(what, timeout, func(id uint64) error {
+			return p.requestBlockData(id, origin, amount, dom)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return res.(*BlockDataPacket), nil
+	}
+	if p.Version() < ETH66 {
+		return nil, errors.New("eth65 not supported for direct block data fetches")
+	}
+	res, err := p.fetch("headers of "+what, timeout, func(id uint64) error {
+		requestTracker.Track(p.id, p.version, GetBlockHeadersMsg, BlockHeadersMsg, id)
+		return send(p.rw, GetBlockHeadersMsg, &GetBlockHeadersPacket66{
+			RequestId: id,
+			GetBlockHeadersPacket: &GetBlockHeadersPacket{
+				Origin: HashOrNumber{Number: origin},
+				Amount: uint64(amount),
+				Skip:   1,
+				Dom:    dom,
+			},
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	headers := *res.(*BlockHeadersPacket)
+	if len(headers) == 0 {
+		return new(BlockDataPacket), nil
+	}
+	hashes := make([]common.Hash, len(headers))
+	for i, header := range headers {
+		hashes[i] = header.Hash()
+	}
+	res, err = p.fetch("bodies of "+what, timeout, func(id uint64) error {
+		requestTracker.Track(p.id, p.version, GetBlockBodiesMsg, BlockBodiesMsg, id)
+		return send(p.rw, GetBlockBodiesMsg, &GetBlockBodiesPacket66{
+			RequestId:            id,
+			GetBlockBodiesPacket: hashes,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	bodies := *res.(*BlockBodiesPacket)
+	if len(bodies) != len(headers) {
+		return nil, fmt.Errorf("%w: %d headers, %d bodies", errInvalidBlockData, len(headers), len(bodies))
+	}
+	return &BlockDataPacket{Headers: headers, Bodies: bodies}, nil
+}
+
+// requestBlockData sends a block data request under the given id.
+func (p *Peer) requestBlockData(id uint64, origin uint64, amount int, dom bool) error {
+	if p.Version() < ETH67 {
+		return errors.New("eth66 not supported for RequestBlockData call")
+	}
+	p.Log().Debug("Fetching batch of block data", "count", amount, "from num", origin, "dom", dom)
+
+	requestTracker.Track(p.id, p.version, GetBlockDataMsg, BlockDataMsg, id)
+	return send(p.rw, GetBlockDataMsg, &GetBlockDataPacket66{
+		RequestId: id,
+		GetBlockDataPacket: GetBlockDataPacket{
+			Origin: HashOrNumber{Number: origin},
+			Amount: uint64(amount),
+			Dom:    dom,
+		},
+	})
 }
 
 // RequestBlockByHash fetches a block corresponding to the
@@ -463,12 +1050,12 @@ func (p *Peer) RequestBlockByHash(hash common.Hash) error {
 		id := rand.Uint64()
 
 		requestTracker.Track(p.id, p.version, GetBlockMsg, NewBlockMsg, id)
-		return p2p.Send(p.rw, GetBlockMsg, &GetBlockPacket66{
+		return send(p.rw, GetBlockMsg, &GetBlockPacket66{
 			RequestId:      id,
 			GetBlockPacket: query,
 		})
 	}
-	return p2p.Send(p.rw, GetBlockMsg, &query)
+	return send(p.rw, GetBlockMsg, &query)
 }
 
 // RequestHeadersByNumber fetches a batch of blocks' headers corresponding to the
@@ -487,12 +1074,18 @@ func (p *Peer) RequestHeadersByNumber(origin uint64, amount int, skip uint64, to
 		id := rand.Uint64()
 
 		requestTracker.Track(p.id, p.version, GetBlockHeadersMsg, BlockHeadersMsg, id)
-		return p2p.Send(p.rw, GetBlockHeadersMsg, &GetBlockHeadersPacket66{
+		return send(p.rw, GetBlockHeadersMsg, &GetBlockHeadersPacket66{
 			RequestId:             id,
 			GetBlockHeadersPacket: &query,
 		})
 	}
-	return p2p.Send(p.rw, GetBlockHeadersMsg, &query)
+	return send(p.rw, GetBlockHeadersMsg, &query)
+}
+
+// RequestLatestHeaders fetches a batch of headers walking down from the remote
+// peer's current head, without needing to know its head number in advance.
+func (p *Peer) RequestLatestHeaders(amount int, skip uint64, dom bool) error {
+	return p.RequestHeadersByNumber(HeadNumber, amount, skip, 0, dom, true)
 }
 
 // ExpectRequestHeadersByNumber is a testing method to mirror the recipient side
@@ -515,12 +1108,476 @@ func (p *Peer) RequestBodies(hashes []common.Hash) error {
 		id := rand.Uint64()
 
 		requestTracker.Track(p.id, p.version, GetBlockBodiesMsg, BlockBodiesMsg, id)
-		return p2p.Send(p.rw, GetBlockBodiesMsg, &GetBlockBodiesPacket66{
+		return send(p.rw, GetBlockBodiesMsg, &GetBlockBodiesPacket66{
 			RequestId:            id,
 			GetBlockBodiesPacket: hashes,
 		})
 	}
-	return p2p.Send(p.rw, GetBlockBodiesMsg, GetBlockBodiesPacket(hashes))
+	return send(p.rw, GetBlockBodiesMsg, GetBlockBodiesPacket(hashes))
+}
+
+// FetchBody retrieves the body of a single block directly from the peer, waiting
+// for the reply up to the given timeout. The retrieval bypasses the downloader,
+// the reply not being delivered to the backend, which makes it suitable to pull
+// a fresh copy of a body for diagnostics. If the block is expected to be large
+// enough, the peer is probed for it first, saving a wasted transfer if missing.
+func (p *Peer) FetchBody(hash common.Hash, size common.StorageSize, timeout time.Duration) (*BlockBody, error) {
+	if p.Version() < ETH66 {
+		return nil, errors.New("eth65 not supported for direct body fetches")
+	}
+	if p.ShouldProbeBlock(size) {
+		have, err := p.FetchHaveBlock(hash, timeout)
+		if err != nil {
+			return nil, err
+		}
+		if !have {
+			return nil, fmt.Errorf("%w: %x", errBodyUnavailable, hash)
+		}
+	}
+	p.Log().Debug("Fetching block body directly", "hash", hash)
+
+	res, err := p.fetch(fmt.Sprintf("body %x", hash), timeout, func(id uint64) error {
+		requestTracker.Track(p.id, p.version, GetBlockBodiesMsg, BlockBodiesMsg, id)
+		return send(p.rw, GetBlockBodiesMsg, &GetBlockBodiesPacket66{
+			RequestId:            id,
+			GetBlockBodiesPacket: GetBlockBodiesPacket{hash},
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	bodies := *res.(*BlockBodiesPacket)
+	if len(bodies) == 0 {
+		return nil, fmt.Errorf("%w: %x", errBodyUnavailable, hash)
+	}
+	return bodies[0], nil
+}
+
+// fetch issues a request under a fresh request id and waits up to the given
+// timeout for the reply, which the message handlers hand over to the waiting
+// fetch instead of delivering it to the backend. The request tracker refuses
+// replies of the wrong type, so the reply matches the request sent.
+func (p *Peer) fetch(what string, timeout time.Duration, request func(id uint64) error) (Packet, error) {
+	id := rand.Uint64()
+	resCh := make(chan Packet, 1)
+
+	p.lock.Lock()
+	if p.fetches == nil {
+		p.fetches = make(map[uint64]chan Packet)
+	}
+	p.fetches[id] = resCh
+	p.lock.Unlock()
+
+	defer func() {
+		p.lock.Lock()
+		delete(p.fetches, id)
+		p.lock.Unlock()
+	}()
+	if err := request(id); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-resCh:
+		return res, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: %s after %v", errFetchTimeout, what, timeout)
+	case <-p.term:
+		return nil, fmt.Errorf("%w: %s", errFetchAborted, what)
+	}
+}
+
+// deliverFetch hands a reply over to the direct fetch awaiting it, reporting
+// whether the reply was consumed.
+func (p *Peer) deliverFetch(id uint64, packet Packet) bool {
+	p.lock.RLock()
+	resCh, ok := p.fetches[id]
+	p.lock.RUnlock()
+
+	if ok {
+		resCh <- packet
+	}
+	return ok
+}
+
+// RequestFreshBodies fetches a batch of blocks' bodies, letting the remote node
+// skip the ones reorged out of the chain leading to the given local head.
+func (p *Peer) RequestFreshBodies(head common.Hash, number uint64, hashes []common.Hash) error {
+	return p.requestFreshBodies(rand.Uint64(), head, number, hashes)
+}
+
+// FetchFreshBodies retrieves a batch of blocks' bodies, skipping the ones reorged
+// out of the chain leading to the given local head, waiting for the reply up to
+// the given timeout.
+func (p *Peer) FetchFreshBodies(head common.Hash, number uint64, hashes []common.Hash, timeout time.Duration) (*FreshBlockBodiesPacket, error) {
+	res, err := p.fetch(fmt.Sprintf("%d fresh bodies", len(hashes)), timeout, func(id uint64) error {
+		return p.requestFreshBodies(id, head, number, hashes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*FreshBlockBodiesPacket), nil
+}
+
+// requestFreshBodies sends a fresh bodies request under the given id.
+func (p *Peer) requestFreshBodies(id uint64, head common.Hash, number uint64, hashes []common.Hash) error {
+	p.Log().Debug("Fetching batch of fresh block bodies", "count", len(hashes), "head", head, "number", number)
+	if p.Version() >= ETH66 {
+		requestTracker.Track(p.id, p.version, GetFreshBlockBodiesMsg, FreshBlockBodiesMsg, id)
+		return send(p.rw, GetFreshBlockBodiesMsg, &GetFreshBlockBodiesPacket66{
+			RequestId: id,
+			GetFreshBlockBodiesPacket: GetFreshBlockBodiesPacket{
+				Head:   head,
+				Number: number,
+				Hashes: hashes,
+			},
+		})
+	}
+	return errors.New("eth65 not supported for RequestFreshBodies call")
+}
+
+// RequestBlockTxHashes fetches the ordered transaction hashes of a block from
+// a remote node.
+func (p *Peer) RequestBlockTxHashes(hash common.Hash) error {
+	return p.requestBlockTxHashes(rand.Uint64(), hash)
+}
+
+// FetchBlockTxHashes retrieves the ordered transaction hashes of a block from a
+// remote node, waiting for the reply up to the given timeout.
+func (p *Peer) FetchBlockTxHashes(hash common.Hash, timeout time.Duration) (BlockTxHashesPacket, error) {
+	res, err := p.fetch(fmt.Sprintf("tx hashes of %x", hash), timeout, func(id uint64) error {
+		return p.requestBlockTxHashes(id, hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return *res.(*BlockTxHashesPacket), nil
+}
+
+// requestBlockTxHashes sends a transaction hashes request under the given id.
+func (p *Peer) requestBlockTxHashes(id uint64, hash common.Hash) error {
+	p.Log().Debug("Fetching block transaction hashes", "hash", hash)
+	if p.Version() >= ETH66 {
+		requestTracker.Track(p.id, p.version, GetBlockTxHashesMsg, BlockTxHashesMsg, id)
+		return send(p.rw, GetBlockTxHashesMsg, &GetBlockTxHashesPacket66{
+			RequestId:              id,
+			GetBlockTxHashesPacket: GetBlockTxHashesPacket{Hash: hash},
+		})
+	}
+	return errors.New("eth65 not supported for RequestBlockTxHashes call")
+}
+
+// RequestHead fetches the current head of the chain at the given location from
+// a remote node. Only the chain the peer runs, which must match our own, can be
+// served.
+func (p *Peer) RequestHead(location common.Location) error {
+	p.Log().Debug("Fetching chain head", "location", location)
+	if err := validateLocation(location); err != nil {
+		return err
+	}
+	if !location.Equal(common.NodeLocation) {
+		return fmt.Errorf("%w: %v", errLocationNotServed, location)
+	}
+	if p.Version() >= ETH66 {
+		id := rand.Uint64()
+
+		requestTracker.Track(p.id, p.version, GetHeadMsg, HeadMsg, id)
+		return send(p.rw, GetHeadMsg, &GetHeadPacket66{
+			RequestId:     id,
+			GetHeadPacket: GetHeadPacket{Location: location},
+		})
+	}
+	return errors.New("eth65 not supported for RequestHead call")
+}
+
+// RequestBlockByNumber fetches the canonical block at the given number of the
+// chain at the given location from a remote node, saving the header lookup of a
+// retrieval by hash. Only the chain the peer runs, which must match our own, can
+// be served.
+func (p *Peer) RequestBlockByNumber(location common.Location, number uint64) error {
+	return p.requestBlockByNumber(rand.Uint64(), location, number)
+}
+
+// FetchBlockByNumber retrieves the canonical block at the given number of the
+// chain at the given location, waiting for the reply up to the given timeout.
+func (p *Peer) FetchBlockByNumber(location common.Location, number uint64, timeout time.Duration) (*BlockByNumberPacket, error) {
+	res, err := p.fetch(fmt.Sprintf("block %d of %v", number, location), timeout, func(id uint64) error {
+		return p.requestBlockByNumber(id, location, number)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*BlockByNumberPacket), nil
+}
+
+// requestBlockByNumber sends a block by number request under the given id.
+func (p *Peer) requestBlockByNumber(id uint64, location common.Location, number uint64) error {
+	p.Log().Debug("Fetching block by number", "location", location, "number", number)
+	if err := validateLocation(location); err != nil {
+		return err
+	}
+	if !location.Equal(common.NodeLocation) {
+		return fmt.Errorf("%w: %v", errLocationNotServed, location)
+	}
+	if p.Version() < ETH67 {
+		return errors.New("eth66 not supported for RequestBlockByNumber call")
+	}
+	requestTracker.Track(p.id, p.version, GetBlockByNumberMsg, BlockByNumberMsg, id)
+	return send(p.rw, GetBlockByNumberMsg, &GetBlockByNumberPacket66{
+		RequestId: id,
+		GetBlockByNumberPacket: GetBlockByNumberPacket{
+			Location: location,
+			Number:   number,
+		},
+	})
+}
+
+// RequestCanonicalHash fetches the hash of the canonical block at the given
+// number of the chain at the given location from a remote node, to cheaply check
+// whether a known block is still canonical. Only the chain the peer runs, which
+// must match our own, can be served.
+func (p *Peer) RequestCanonicalHash(location common.Location, number uint64) error {
+	return p.requestCanonicalHash(rand.Uint64(), location, number)
+}
+
+// FetchCanonicalHash retrieves the hash of the canonical block at the given number
+// of the chain at the given location, waiting for the reply up to the given timeout.
+func (p *Peer) FetchCanonicalHash(location common.Location, number uint64, timeout time.Duration) (*CanonicalHashPacket, error) {
+	res, err := p.fetch(fmt.Sprintf("canonical hash %d of %v", number, location), timeout, func(id uint64) error {
+		return p.requestCanonicalHash(id, location, number)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*CanonicalHashPacket), nil
+}
+
+// requestCanonicalHash sends a canonical hash request under the given id.
+func (p *Peer) requestCanonicalHash(id uint64, location common.Location, number uint64) error {
+	p.Log().Debug("Fetching canonical hash", "location", location, "number", number)
+	if err := validateLocation(location); err != nil {
+		return err
+	}
+	if !location.Equal(common.NodeLocation) {
+		return fmt.Errorf("%w: %v", errLocationNotServed, location)
+	}
+	if p.Version() < ETH67 {
+		return errors.New("eth66 not supported for RequestCanonicalHash call")
+	}
+	requestTracker.Track(p.id, p.version, GetCanonicalHashMsg, CanonicalHashMsg, id)
+	return send(p.rw, GetCanonicalHashMsg, &GetCanonicalHashPacket66{
+		RequestId: id,
+		GetCanonicalHashPacket: GetCanonicalHashPacket{
+			Location: location,
+			Number:   number,
+		},
+	})
+}
+
+// RequestEtxManifestProof fetches the proof that a block of the source shard at
+// the given location was rolled up into the given dominant block. The peer must
+// run the dominant chain of the source shard.
+func (p *Peer) RequestEtxManifestProof(hash common.Hash, location common.Location, subHash common.Hash) error {
+	return p.requestEtxManifestProof(rand.Uint64(), hash, location, subHash)
+}
+
+// FetchEtxManifestProof retrieves the proof that a block of the source shard at
+// the given location was rolled up into the given dominant block, waiting for the
+// reply up to the given timeout.
+func (p *Peer) FetchEtxManifestProof(hash common.Hash, location common.Location, subHash common.Hash, timeout time.Duration) (*EtxManifestProofPacket, error) {
+	res, err := p.fetch(fmt.Sprintf("manifest proof of %x in %x", subHash, hash), timeout, func(id uint64) error {
+		return p.requestEtxManifestProof(id, hash, location, subHash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*EtxManifestProofPacket), nil
+}
+
+// requestEtxManifestProof sends a manifest proof request under the given id.
+func (p *Peer) requestEtxManifestProof(id uint64, hash common.Hash, location common.Location, subHash common.Hash) error {
+	p.Log().Debug("Fetching etx manifest proof", "hash", hash, "location", location, "sub", subHash)
+	if err := validateLocation(location); err != nil {
+		return err
+	}
+	if len(location) == 0 {
+		return fmt.Errorf("%w: prime has no dominant chain", errInvalidLocation)
+	}
+	if err := p.checkOptional(GetEtxManifestProofMsg); err != nil {
+		return err
+	}
+	requestTracker.Track(p.id, p.version, GetEtxManifestProofMsg, EtxManifestProofMsg, id)
+	return send(p.rw, GetEtxManifestProofMsg, &GetEtxManifestProofPacket66{
+		RequestId: id,
+		GetEtxManifestProofPacket: GetEtxManifestProofPacket{
+			Hash:     hash,
+			Location: location,
+			SubHash:  subHash,
+		},
+	})
+}
+
+// RequestHeadersByNumbers fetches the canonical headers at a set of discrete,
+// strictly ascending block numbers from a remote node.
+func (p *Peer) RequestHeadersByNumbers(numbers []uint64) error {
+	return p.requestHeadersByNumbers(rand.Uint64(), numbers)
+}
+
+// FetchHeadersByNumbers retrieves the canonical headers at a set of discrete,
+// strictly ascending block numbers, waiting for the reply up to the given timeout.
+func (p *Peer) FetchHeadersByNumbers(numbers []uint64, timeout time.Duration) (HeadersByNumbersPacket, error) {
+	res, err := p.fetch(fmt.Sprintf("headers at %d numbers", len(numbers)), timeout, func(id uint64) error {
+		return p.requestHeadersByNumbers(id, numbers)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return *res.(*HeadersByNumbersPacket), nil
+}
+
+// requestHeadersByNumbers sends a headers by numbers request under the given id.
+func (p *Peer) requestHeadersByNumbers(id uint64, numbers []uint64) error {
+	p.Log().Debug("Fetching headers by numbers", "count", len(numbers))
+	if p.Version() >= ETH66 {
+		requestTracker.Track(p.id, p.version, GetHeadersByNumbersMsg, HeadersByNumbersMsg, id)
+		return send(p.rw, GetHeadersByNumbersMsg, &GetHeadersByNumbersPacket66{
+			RequestId:                 id,
+			GetHeadersByNumbersPacket: numbers,
+		})
+	}
+	return errors.New("eth65 not supported for RequestHeadersByNumbers call")
+}
+
+// ShouldProbeBlock reports whether a block of the given expected size warrants
+// an availability probe before being requested with GetBlock.
+func (p *Peer) ShouldProbeBlock(size common.StorageSize) bool {
+	threshold := p.config.HaveBlockProbeThreshold
+	return threshold > 0 && size >= threshold
+}
+
+// RequestHaveBlock probes a remote node for whether it can serve the block with
+// the given hash. See ShouldProbeBlock for when this is worth the round trip.
+func (p *Peer) RequestHaveBlock(hash common.Hash) error {
+	return p.requestHaveBlock(rand.Uint64(), hash)
+}
+
+// FetchHaveBlock probes a remote node for whether it can serve the block with
+// the given hash, waiting for the answer up to the given timeout.
+func (p *Peer) FetchHaveBlock(hash common.Hash, timeout time.Duration) (bool, error) {
+	res, err := p.fetch(fmt.Sprintf("availability of %x", hash), timeout, func(id uint64) error {
+		return p.requestHaveBlock(id, hash)
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.(*HaveBlockReplyPacket).Have, nil
+}
+
+// requestHaveBlock sends a block availability probe under the given id.
+func (p *Peer) requestHaveBlock(id uint64, hash common.Hash) error {
+	p.Log().Debug("Probing block availability", "hash", hash)
+	if p.Version() >= ETH66 {
+		requestTracker.Track(p.id, p.version, HaveBlockMsg, HaveBlockReplyMsg, id)
+		return send(p.rw, HaveBlockMsg, &HaveBlockPacket66{
+			RequestId:       id,
+			HaveBlockPacket: HaveBlockPacket{Hash: hash},
+		})
+	}
+	return errors.New("eth65 not supported for RequestHaveBlock call")
+}
+
+// RequestPendingEtxsByLocation fetches a page of the ETXs pending inclusion in
+// the given location, continuing after the cursor of the previous page.
+func (p *Peer) RequestPendingEtxsByLocation(location common.Location, cursor common.Hash) error {
+	return p.requestPendingEtxsByLocation(rand.Uint64(), location, cursor)
+}
+
+// FetchPendingEtxsByLocation retrieves a page of the ETXs pending inclusion in
+// the given location, waiting for the reply up to the given timeout.
+func (p *Peer) FetchPendingEtxsByLocation(location common.Location, cursor common.Hash, timeout time.Duration) (*PendingEtxsByLocationPacket, error) {
+	res, err := p.fetch(fmt.Sprintf("pending etxs of %v", location), timeout, func(id uint64) error {
+		return p.requestPendingEtxsByLocation(id, location, cursor)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*PendingEtxsByLocationPacket), nil
+}
+
+// requestPendingEtxsByLocation sends a pending etxs by location request under the given id.
+func (p *Peer) requestPendingEtxsByLocation(id uint64, location common.Location, cursor common.Hash) error {
+	p.Log().Debug("Fetching pending etxs by location", "location", location, "cursor", cursor)
+	if p.Version() >= ETH66 {
+		requestTracker.Track(p.id, p.version, GetPendingEtxsByLocationMsg, PendingEtxsByLocationMsg, id)
+		return send(p.rw, GetPendingEtxsByLocationMsg, &GetPendingEtxsByLocationPacket66{
+			RequestId: id,
+			GetPendingEtxsByLocationPacket: GetPendingEtxsByLocationPacket{
+				Location: location,
+				Cursor:   cursor,
+			},
+		})
+	}
+	return errors.New("eth65 not supported for RequestPendingEtxsByLocation call")
+}
+
+// RequestPendingEtxsSince fetches a page of the ETXs pending inclusion in the
+// given location which were created after the given block, continuing after the
+// cursor of the previous page. Only the chain the peer runs, which must match
+// our own, can be served.
+func (p *Peer) RequestPendingEtxsSince(location common.Location, since common.Hash, cursor common.Hash) error {
+	return p.requestPendingEtxsSince(rand.Uint64(), location, since, cursor)
+}
+
+// FetchPendingEtxsSince retrieves a page of the ETXs pending inclusion in the
+// given location which were created after the given block, waiting for the reply
+// up to the given timeout.
+func (p *Peer) FetchPendingEtxsSince(location common.Location, since common.Hash, cursor common.Hash, timeout time.Duration) (*PendingEtxsSincePacket, error) {
+	res, err := p.fetch(fmt.Sprintf("pending etxs of %v since %x", location, since), timeout, func(id uint64) error {
+		return p.requestPendingEtxsSince(id, location, since, cursor)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*PendingEtxsSincePacket), nil
+}
+
+// requestPendingEtxsSince sends a pending etxs since request under the given id.
+func (p *Peer) requestPendingEtxsSince(id uint64, location common.Location, since common.Hash, cursor common.Hash) error {
+	p.Log().Debug("Fetching pending etxs since block", "location", location, "since", since, "cursor", cursor)
+	if err := validateLocation(location); err != nil {
+		return err
+	}
+	if !location.Equal(common.NodeLocation) {
+		return fmt.Errorf("%w: %v", errLocationNotServed, location)
+	}
+	if p.Version() < ETH67 {
+		return errors.New("eth66 not supported for RequestPendingEtxsSince call")
+	}
+	requestTracker.Track(p.id, p.version, GetPendingEtxsSinceMsg, PendingEtxsSinceMsg, id)
+	return send(p.rw, GetPendingEtxsSinceMsg, &GetPendingEtxsSincePacket66{
+		RequestId: id,
+		GetPendingEtxsSincePacket: GetPendingEtxsSincePacket{
+			Location: location,
+			Since:    since,
+			Cursor:   cursor,
+		},
+	})
+}
+
+// RequestCapabilities fetches the current serving capabilities of a remote node.
+func (p *Peer) RequestCapabilities() error {
+	p.Log().Debug("Fetching serving capabilities")
+	if p.Version() >= ETH66 {
+		id := rand.Uint64()
+
+		requestTracker.Track(p.id, p.version, GetCapabilitiesMsg, CapabilitiesMsg, id)
+		return send(p.rw, GetCapabilitiesMsg, &GetCapabilitiesPacket66{
+			RequestId: id,
+		})
+	}
+	return errors.New("eth65 not supported for RequestCapabilities call")
 }
 
 // RequestTxs fetches a batch of transactions from a remote node.
@@ -529,24 +1586,75 @@ func (p *Peer) RequestTxs(hashes []common.Hash) error {
 	if p.Version() >= ETH66 {
 		id := rand.Uint64()
 
+		p.trackTxRequest(id, hashes)
 		requestTracker.Track(p.id, p.version, GetPooledTransactionsMsg, PooledTransactionsMsg, id)
-		return p2p.Send(p.rw, GetPooledTransactionsMsg, &GetPooledTransactionsPacket66{
+		return send(p.rw, GetPooledTransactionsMsg, &GetPooledTransactionsPacket66{
 			RequestId:                   id,
 			GetPooledTransactionsPacket: hashes,
 		})
 	}
-	return p2p.Send(p.rw, GetPooledTransactionsMsg, GetPooledTransactionsPacket(hashes))
+	return send(p.rw, GetPooledTransactionsMsg, GetPooledTransactionsPacket(hashes))
+}
+
+// trackTxRequest remembers the hashes of a pooled transaction request, so that
+// the reply can be checked against them.
+func (p *Peer) trackTxRequest(id uint64, hashes []common.Hash) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.txRequests == nil {
+		p.txRequests = make(map[uint64]map[common.Hash]struct{})
+	}
+	if len(p.txRequests) >= maxTxRequests {
+		for old := range p.txRequests {
+			delete(p.txRequests, old)
+			break
+		}
+	}
+	requested := make(map[common.Hash]struct{}, len(hashes))
+	for _, hash := range hashes {
+		requested[hash] = struct{}{}
+	}
+	p.txRequests[id] = requested
+}
+
+// filterRequestedTxs drops the transactions of a pooled transaction reply which
+// were not asked for in the corresponding request. Transactions requested but
+// not delivered are fine, the remote pool may have dropped them meanwhile. An
+// error is returned if the peer exceeded the allowance of unrequested replies.
+func (p *Peer) filterRequestedTxs(id uint64, txs PooledTransactionsPacket) (PooledTransactionsPacket, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	requested := p.txRequests[id]
+	delete(p.txRequests, id)
+
+	filtered := txs[:0]
+	for _, tx := range txs {
+		if _, ok := requested[tx.Hash()]; ok {
+			filtered = append(filtered, tx)
+		}
+	}
+	if extra := len(txs) - len(filtered); extra > 0 {
+		unrequestedTxMeter.Mark(int64(extra))
+		p.unrequestedTxs++
+
+		p.Log().Debug("Discarded unrequested pooled transactions", "count", extra)
+		if p.unrequestedTxs >= p.config.MaxUnrequestedTxReplies {
+			return filtered, fmt.Errorf("%w: %d replies", errUnrequestedTxs, p.unrequestedTxs)
+		}
+	}
+	return filtered, nil
 }
 
 // RequestOnePendingEtx fetches a pendingEtx for a given block hash from a remote node.
 func (p *Peer) RequestOnePendingEtxs(hash common.Hash) error {
 	p.Log().Debug("Fetching a pending etx", "hash", hash)
 	if p.Version() >= ETH66 {
-		id := rand.Uint64()
-
-		requestTracker.Track(p.id, p.version, GetOnePendingEtxsMsg, PendingEtxsMsg, id)
-		return p2p.Send(p.rw, GetOnePendingEtxsMsg, &GetOnePendingEtxsPacket66{
-			RequestId:               id,
+		// The pending etxs are pushed back without the request id, so there is no
+		// reply to track the request by
+		return send(p.rw, GetOnePendingEtxsMsg, &GetOnePendingEtxsPacket66{
+			RequestId:               rand.Uint64(),
 			GetOnePendingEtxsPacket: GetOnePendingEtxsPacket{Hash: hash},
 		})
 	}
@@ -557,11 +1665,10 @@ func (p *Peer) RequestOnePendingEtxs(hash common.Hash) error {
 func (p *Peer) RequestOnePendingEtxsRollup(hash common.Hash) error {
 	p.Log().Debug("Fetching a pending etx rollup", "hash", hash)
 	if p.Version() >= ETH66 {
-		id := rand.Uint64()
-
-		requestTracker.Track(p.id, p.version, GetOnePendingEtxsRollupMsg, PendingEtxsRollupMsg, id)
-		return p2p.Send(p.rw, GetOnePendingEtxsRollupMsg, &GetOnePendingEtxsPacket66{
-			RequestId:               id,
+		// The rollup is pushed back without the request id, so there is no reply
+		// to track the request by
+		return send(p.rw, GetOnePendingEtxsRollupMsg, &GetOnePendingEtxsPacket66{
+			RequestId:               rand.Uint64(),
 			GetOnePendingEtxsPacket: GetOnePendingEtxsPacket{Hash: hash},
 		})
 	}
@@ -575,25 +1682,25 @@ func (p *Peer) SendPendingEtxs(pendingEtxs types.PendingEtxs) error {
 		p.knownPendingEtxs.Pop()
 	}
 	p.knownPendingEtxs.Add(pendingEtxs.Header.Hash())
-	return p2p.Send(p.rw, PendingEtxsMsg, &PendingEtxsPacket{
-		PendingEtxs: pendingEtxs,
-	})
+
+	// Only eth/67 peers understand the versioned encoding
+	packet := &PendingEtxsPacket{PendingEtxs: pendingEtxs}
+	if p.version >= ETH67 {
+		packet.Version = pendingEtxsVersion
+	}
+	return send(p.rw, PendingEtxsMsg, packet)
 }
 
 // SendNewPendingEtxsRollup propagates an entire pending etx Rollup to a remote peer.
 func (p *Peer) SendPendingEtxsRollup(pEtxsRollup types.PendingEtxsRollup) error {
 	p.Log().Debug("Fetching a pending etx", "hash", pEtxsRollup.Header.Hash())
 	if p.Version() >= ETH66 {
-		id := rand.Uint64()
-
-		// TODO: what to put in the GetOnePendingEtxsMsg
-		requestTracker.Track(p.id, p.version, GetOnePendingEtxsMsg, PendingEtxsRollupMsg, id)
 		// Mark all the pendingEtxs hash as known, but ensure we don't overflow our limits
 		for p.knownPendingEtxs.Cardinality() >= maxKnownPendingEtxs {
 			p.knownPendingEtxs.Pop()
 		}
 		p.knownPendingEtxs.Add(pEtxsRollup.Header.Hash())
-		return p2p.Send(p.rw, PendingEtxsRollupMsg, &PendingEtxsRollupPacket{
+		return send(p.rw, PendingEtxsRollupMsg, &PendingEtxsRollupPacket{
 			PendingEtxsRollup: pEtxsRollup,
 		})
 	}
@@ -21,9 +21,16 @@ package eth
 
 import (
 	"crypto/rand"
+	"math/big"
+	"testing"
 
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/consensus"
+	"github.com/dominant-strategies/go-quai/core/types"
 	"github.com/dominant-strategies/go-quai/p2p"
 	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/params"
+	"github.com/dominant-strategies/go-quai/rlp"
 )
 
 // testPeer is a simulated peer to allow testing direct network calls.
@@ -59,3 +66,151 @@ func (p *testPeer) close() {
 	p.Peer.Close()
 	p.app.Close()
 }
+
+// testChain is a minimal in-memory chain implementing chainReader, used to
+// exercise the serving paths without spinning up a full core.
+type testChain struct {
+	engine    *testEngine
+	headers   map[common.Hash]*types.Header
+	canonical []*types.Header
+	bodies    map[common.Hash]rlp.RawValue
+	etxSets   map[common.Hash]types.EtxSet
+}
+
+// newTestChain creates an in-memory chain with the given number of blocks on
+// top of an empty genesis.
+func newTestChain(blocks int) *testChain {
+	chain := &testChain{
+		engine:  &testEngine{dom: make(map[common.Hash]bool)},
+		headers: make(map[common.Hash]*types.Header),
+		bodies:  make(map[common.Hash]rlp.RawValue),
+		etxSets: make(map[common.Hash]types.EtxSet),
+	}
+	for i := 0; i <= blocks; i++ {
+		header := types.EmptyHeader()
+		header.SetNumber(big.NewInt(int64(i)))
+		header.SetDifficulty(big.NewInt(1))
+		if i > 0 {
+			header.SetParentHash(chain.canonical[i-1].Hash())
+		}
+		chain.headers[header.Hash()] = header
+		chain.canonical = append(chain.canonical, header)
+	}
+	return chain
+}
+
+// addBody stores the RLP encoding of a block body under the given hash.
+func (c *testChain) addBody(hash common.Hash, body *types.Body) {
+	enc, err := rlp.EncodeToBytes(body)
+	if err != nil {
+		panic(err)
+	}
+	c.bodies[hash] = enc
+}
+
+func (c *testChain) Config() *params.ChainConfig                 { return params.TestChainConfig }
+func (c *testChain) CurrentHeader() *types.Header                { return c.canonical[len(c.canonical)-1] }
+func (c *testChain) GetTerminiByHash(common.Hash) *types.Termini { return nil }
+func (c *testChain) ProcessingState() bool                       { return false }
+func (c *testChain) Engine() consensus.Engine                    { return c.engine }
+func (c *testChain) Genesis() *types.Block                       { return types.NewBlockWithHeader(c.canonical[0]) }
+func (c *testChain) CurrentLogEntropy() *big.Int                 { return c.engine.TotalLogS(c.CurrentHeader()) }
+
+func (c *testChain) GetHeader(hash common.Hash, number uint64) *types.Header {
+	if header := c.headers[hash]; header != nil && header.NumberU64() == number {
+		return header
+	}
+	return nil
+}
+
+func (c *testChain) GetHeaderByHash(hash common.Hash) *types.Header { return c.headers[hash] }
+
+func (c *testChain) GetHeaderByNumber(number uint64) *types.Header {
+	if number >= uint64(len(c.canonical)) {
+		return nil
+	}
+	return c.canonical[number]
+}
+
+func (c *testChain) GetHeaderOrCandidate(hash common.Hash, number uint64) *types.Header {
+	return c.GetHeader(hash, number)
+}
+
+func (c *testChain) GetHeaderOrCandidateByHash(hash common.Hash) *types.Header {
+	return c.GetHeaderByHash(hash)
+}
+
+func (c *testChain) GetAncestor(hash common.Hash, number, ancestor uint64, maxNonCanonical *uint64) (common.Hash, uint64) {
+	if ancestor > number {
+		return common.Hash{}, 0
+	}
+	for ; ancestor > 0; ancestor-- {
+		header := c.GetHeader(hash, number)
+		if header == nil {
+			return common.Hash{}, 0
+		}
+		hash, number = header.ParentHash(), number-1
+	}
+	return hash, number
+}
+
+func (c *testChain) GetBodyRLP(hash common.Hash) rlp.RawValue { return c.bodies[hash] }
+
+func (c *testChain) GetEtxSet(hash common.Hash, number uint64) types.EtxSet {
+	return c.etxSets[hash]
+}
+
+// testEngine is a consensus engine stub which only knows how to classify the
+// dominant blocks explicitly marked as such.
+type testEngine struct {
+	consensus.Engine
+	dom map[common.Hash]bool
+}
+
+func (e *testEngine) IsDomCoincident(chain consensus.ChainHeaderReader, header *types.Header) bool {
+	return e.dom[header.Hash()]
+}
+
+// TotalLogS reports the header number as entropy, keeping it monotonic.
+func (e *testEngine) TotalLogS(header *types.Header) *big.Int {
+	return new(big.Int).SetUint64(header.NumberU64())
+}
+
+// newTestStatus assembles a valid eth/66 status over an empty test chain, running
+// the given slices.
+func newTestStatus(t *testing.T, slices ...common.Location) *StatusPacket {
+	t.Helper()
+
+	status, err := NewStatusPacket(newTestChain(0), ETH66, 1, slices, &DefaultConfig)
+	if err != nil {
+		t.Fatalf("failed to assemble status: %v", err)
+	}
+	return status
+}
+
+// newTestTransactions creates a batch of distinct, unsigned transactions.
+func newTestTransactions(n int) []*types.Transaction {
+	txs := make([]*types.Transaction, n)
+	for i := range txs {
+		txs[i] = types.NewTx(&types.InternalTx{
+			ChainID:   big.NewInt(1),
+			Nonce:     uint64(i),
+			GasTipCap: big.NewInt(1),
+			GasFeeCap: big.NewInt(1),
+			Gas:       21000,
+			Value:     big.NewInt(int64(i)),
+			V:         new(big.Int),
+			R:         new(big.Int),
+			S:         new(big.Int),
+		})
+	}
+	return txs
+}
+
+// newTestBlock creates an empty block with the given number in the current
+// node context.
+func newTestBlock(number uint64) *types.Block {
+	header := types.EmptyHeader()
+	header.SetNumber(new(big.Int).SetUint64(number))
+	return types.NewBlockWithHeader(header)
+}
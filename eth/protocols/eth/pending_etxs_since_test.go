@@ -0,0 +1,209 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// newPendingEtxsChain creates a test chain whose head has a pending etx set with
+// one etx entering it at every height from 1 up to the head.
+func newPendingEtxsChain() (*testChain, types.EtxSet) {
+	var (
+		chain = newTestChain(10)
+		head  = chain.CurrentHeader()
+		set   = types.NewEtxSet()
+	)
+	for i, tx := range newTestTransactions(10) {
+		set[tx.Hash()] = types.EtxSetEntry{Height: uint64(i + 1), ETX: *tx}
+	}
+	chain.etxSets[head.Hash()] = set
+	return chain, set
+}
+
+// collectPendingEtxsSince pages through the pending etxs created after a block,
+// checking the pages against the serving limit.
+func collectPendingEtxsSince(t *testing.T, chain *testChain, since common.Hash) ([]*types.Transaction, int) {
+	t.Helper()
+
+	var (
+		query = GetPendingEtxsSincePacket{Location: common.NodeLocation, Since: since}
+		etxs  []*types.Transaction
+		pages int
+	)
+	for {
+		page, err := answerGetPendingEtxsSinceQuery(chain, query)
+		if err != nil {
+			t.Fatalf("page %d: failed to answer query: %v", pages, err)
+		}
+		if len(page.Etxs) > maxPendingEtxsServe {
+			t.Fatalf("page %d: page size mismatch: have %d, want <= %d", pages, len(page.Etxs), maxPendingEtxsServe)
+		}
+		etxs = append(etxs, page.Etxs...)
+		pages++
+
+		if page.Cursor == (common.Hash{}) {
+			return etxs, pages
+		}
+		if page.Cursor != etxs[len(etxs)-1].Hash() {
+			t.Fatalf("page %d: cursor mismatch: have %x, want %x", pages, page.Cursor, etxs[len(etxs)-1].Hash())
+		}
+		query.Cursor = page.Cursor
+	}
+}
+
+// Tests that only the pending etxs which entered the set after the requested
+// block are served, the whole set being served for blocks not on the canonical
+// chain.
+func TestGetPendingEtxsSince(t *testing.T) {
+	chain, set := newPendingEtxsChain()
+
+	tests := []struct {
+		since common.Hash
+		from  uint64 // Lowest height of the etxs expected
+	}{
+		{common.Hash{}, 1},               // Everything
+		{chain.canonical[0].Hash(), 1},   // Genesis
+		{chain.canonical[6].Hash(), 7},   // Mid chain
+		{chain.canonical[9].Hash(), 10},  // Right before the head
+		{chain.canonical[10].Hash(), 11}, // Head, nothing newer
+		{common.Hash{0xff}, 1},           // Unknown block
+	}
+	for i, tt := range tests {
+		etxs, _ := collectPendingEtxsSince(t, chain, tt.since)
+
+		want := 0
+		for _, entry := range set {
+			if entry.Height >= tt.from {
+				want++
+			}
+		}
+		if len(etxs) != want {
+			t.Errorf("test %d: etx count mismatch: have %d, want %d", i, len(etxs), want)
+		}
+		for _, etx := range etxs {
+			if height := set[etx.Hash()].Height; height < tt.from {
+				t.Errorf("test %d: etx %x from height %d served, want >= %d", i, etx.Hash(), height, tt.from)
+			}
+		}
+	}
+	// A location not run locally is answered with an empty, final page
+	query := GetPendingEtxsSincePacket{Location: common.Location{0, 1}, Since: chain.canonical[6].Hash()}
+	res, err := answerGetPendingEtxsSinceQuery(chain, query)
+	if err != nil {
+		t.Fatalf("failed to answer foreign query: %v", err)
+	}
+	if len(res.Etxs) != 0 || res.Cursor != (common.Hash{}) {
+		t.Errorf("foreign location served: %d etxs, cursor %x", len(res.Etxs), res.Cursor)
+	}
+}
+
+// Tests that the pending etxs created after a block are paged out without gaps
+// or overlaps, the cursors chaining the pages together.
+func TestGetPendingEtxsSincePaging(t *testing.T) {
+	defer func(old int) { maxPendingEtxsServe = old }(maxPendingEtxsServe)
+	maxPendingEtxsServe = 2
+
+	chain, set := newPendingEtxsChain()
+
+	etxs, pages := collectPendingEtxsSince(t, chain, chain.canonical[3].Hash())
+	if pages != 4 {
+		t.Errorf("page count mismatch: have %d, want %d", pages, 4)
+	}
+	if len(etxs) != 7 {
+		t.Fatalf("etx count mismatch: have %d, want %d", len(etxs), 7)
+	}
+	seen := make(map[common.Hash]bool)
+	for i, etx := range etxs {
+		if seen[etx.Hash()] {
+			t.Errorf("etx %d: etx %x served twice", i, etx.Hash())
+		}
+		seen[etx.Hash()] = true
+
+		if height := set[etx.Hash()].Height; height < 4 {
+			t.Errorf("etx %d: etx from height %d served, want >= %d", i, height, 4)
+		}
+	}
+}
+
+// Tests that pending etx pages created after a block round-trip through the
+// wire, and that the request is refused to peers older than eth/67.
+func TestPendingEtxsSinceRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		chain, _ = newPendingEtxsChain()
+		since    = chain.canonical[8].Hash()
+		local    = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xe3, 0x01}, "peer", nil), net, nil)
+		remote   = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xe3, 0x02}, "peer", nil), app, nil)
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	go local.RequestPendingEtxsSince(common.NodeLocation, since, common.Hash{})
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	if msg.Code != GetPendingEtxsSinceMsg {
+		t.Fatalf("request code mismatch: have %#x, want %#x", msg.Code, GetPendingEtxsSinceMsg)
+	}
+	var query GetPendingEtxsSincePacket66
+	if err := msg.Decode(&query); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	if !query.Location.Equal(common.NodeLocation) || query.Since != since {
+		t.Fatalf("request mismatch: have %+v", query.GetPendingEtxsSincePacket)
+	}
+	res, err := answerGetPendingEtxsSinceQuery(chain, query.GetPendingEtxsSincePacket)
+	if err != nil {
+		t.Fatalf("failed to answer query: %v", err)
+	}
+	go remote.ReplyPendingEtxsSince(query.RequestId, res)
+
+	backend := new(mockBackend)
+	if err := handleMessage(backend, local); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+	}
+	page := backend.handled[0].(*PendingEtxsSincePacket)
+	if len(page.Etxs) != len(res.Etxs) || page.Cursor != res.Cursor {
+		t.Fatalf("page mismatch: have %d etxs/%x, want %d etxs/%x", len(page.Etxs), page.Cursor, len(res.Etxs), res.Cursor)
+	}
+	for i := range res.Etxs {
+		if page.Etxs[i].Hash() != res.Etxs[i].Hash() {
+			t.Errorf("etx %d mismatch: have %x, want %x", i, page.Etxs[i].Hash(), res.Etxs[i].Hash())
+		}
+	}
+	// Peers older than eth/67 can't be asked
+	old := NewPeer(ETH66, p2p.NewPeer(enode.ID{0xe3, 0x03}, "peer", nil), net, nil)
+	defer old.Close()
+
+	if err := old.RequestPendingEtxsSince(common.NodeLocation, since, common.Hash{}); err == nil {
+		t.Errorf("eth/66 peer accepted pending etxs since request")
+	}
+}
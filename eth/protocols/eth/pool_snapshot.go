@@ -0,0 +1,135 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+)
+
+// poolReader defines the transaction pool methods needed to serve snapshots.
+type poolReader interface {
+	// TxPoolPending retrieves the executable transactions of the pool, grouped
+	// by sender and sorted by nonce.
+	TxPoolPending(enforceTips bool) (map[common.AddressBytes]types.Transactions, error)
+}
+
+// servesPoolSnapshots reports whether the local pool is worth sharing. Nodes not
+// running a zone's pool, or still syncing it, refuse to.
+func servesPoolSnapshots(backend Backend) bool {
+	if common.NodeLocation.Context() != common.ZONE_CTX {
+		return false
+	}
+	return backend.Core().Slice().ProcessingState() && backend.AcceptTxs()
+}
+
+// answerGetPoolSnapshotQuery collects the hashes of the pending transactions in
+// the pool, optionally only the ones sent from the requested location. Senders
+// are visited in address order and their transactions in nonce order, so that
+// a truncated snapshot is still executable. Snapshots are bounded by the query
+// limit and by maxPoolSnapshotServe, and queries for no hashes are rejected.
+func answerGetPoolSnapshotQuery(pool poolReader, query GetPoolSnapshotPacket) ([]common.Hash, error) {
+	if query.Limit == 0 {
+		return nil, fmt.Errorf("%w: empty pool snapshot requested", errInvalidQuery)
+	}
+	if len(query.Location) > 0 {
+		if err := validateLocation(query.Location); err != nil {
+			return nil, err
+		}
+	}
+	limit := query.Limit
+	if limit > maxPoolSnapshotServe {
+		limit = maxPoolSnapshotServe
+	}
+	pending, err := pool.TxPoolPending(false)
+	if err != nil {
+		return nil, err
+	}
+	senders := make([]common.AddressBytes, 0, len(pending))
+	for sender := range pending {
+		senders = append(senders, sender)
+	}
+	sort.Slice(senders, func(i, j int) bool {
+		return bytes.Compare(senders[i][:], senders[j][:]) < 0
+	})
+	var hashes []common.Hash
+	for _, sender := range senders {
+		txs := pending[sender]
+		if len(txs) == 0 {
+			continue
+		}
+		if len(query.Location) > 0 && !query.Location.ContainsAddress(common.Bytes20ToAddress(sender)) {
+			continue
+		}
+		for _, tx := range txs {
+			if uint64(len(hashes)) >= limit {
+				return hashes, nil
+			}
+			hashes = append(hashes, tx.Hash())
+		}
+	}
+	return hashes, nil
+}
+
+// sanityCheck verifies that a pool snapshot is within the serving limit, and
+// that refusals carry no hashes.
+func (p *PoolSnapshotPacket) sanityCheck() error {
+	if len(p.Hashes) > maxPoolSnapshotServe {
+		return fmt.Errorf("%w: %d hashes, limit %d", errInvalidPoolSnapshot, len(p.Hashes), maxPoolSnapshotServe)
+	}
+	if p.Refused && len(p.Hashes) > 0 {
+		return fmt.Errorf("%w: refusal with %d hashes", errInvalidPoolSnapshot, len(p.Hashes))
+	}
+	return nil
+}
+
+// ReplyPoolSnapshot is the eth/67 response to GetPoolSnapshot.
+func (p *Peer) ReplyPoolSnapshot(id uint64, snapshot PoolSnapshotPacket) error {
+	// Mark all the transactions as known, but ensure we don't overflow our limits
+	for _, hash := range snapshot.Hashes {
+		p.markTransaction(hash)
+	}
+	return send(p.rw, PoolSnapshotMsg, &PoolSnapshotPacket66{
+		RequestId:          id,
+		PoolSnapshotPacket: snapshot,
+	})
+}
+
+// RequestPoolSnapshot fetches the hashes of up to limit pending transactions in
+// the remote pool, sent from the given location if not empty. The transactions
+// not known locally are then retrieved like announced ones.
+func (p *Peer) RequestPoolSnapshot(location common.Location, limit uint64) error {
+	p.Log().Debug("Fetching pool snapshot", "location", location, "limit", limit)
+	if err := p.checkOptional(GetPoolSnapshotMsg); err != nil {
+		return err
+	}
+	id := rand.Uint64()
+
+	requestTracker.Track(p.id, p.version, GetPoolSnapshotMsg, PoolSnapshotMsg, id)
+	return send(p.rw, GetPoolSnapshotMsg, &GetPoolSnapshotPacket66{
+		RequestId: id,
+		GetPoolSnapshotPacket: GetPoolSnapshotPacket{
+			Location: location,
+			Limit:    limit,
+		},
+	})
+}
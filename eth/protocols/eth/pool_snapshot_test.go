@@ -0,0 +1,242 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// snapshotPool is a transaction pool serving a fixed set of pending transactions.
+type snapshotPool map[common.AddressBytes]types.Transactions
+
+func (p snapshotPool) TxPoolPending(enforceTips bool) (map[common.AddressBytes]types.Transactions, error) {
+	return p, nil
+}
+
+// newSnapshotPool creates a pool with the given number of pending transactions
+// for each sender, identified by the first byte of its address.
+func newSnapshotPool(senders map[byte]int) snapshotPool {
+	pool := make(snapshotPool)
+	for prefix, count := range senders {
+		sender := common.AddressBytes{prefix}
+		for nonce := 0; nonce < count; nonce++ {
+			tx := types.NewTx(&types.InternalTx{ChainID: big.NewInt(1), Nonce: uint64(nonce), GasTipCap: big.NewInt(1), GasFeeCap: big.NewInt(1), Value: big.NewInt(int64(prefix))})
+			pool[sender] = append(pool[sender], tx)
+		}
+	}
+	return pool
+}
+
+// snapshotHashes returns the hashes of the given senders' transactions, in the
+// order a snapshot lists them.
+func snapshotHashes(pool snapshotPool, prefixes ...byte) []common.Hash {
+	var hashes []common.Hash
+	for _, prefix := range prefixes {
+		for _, tx := range pool[common.AddressBytes{prefix}] {
+			hashes = append(hashes, tx.Hash())
+		}
+	}
+	return hashes
+}
+
+// Tests that pool snapshots list the pending transactions sender by sender in
+// nonce order, within the requested location and limit.
+func TestGetPoolSnapshot(t *testing.T) {
+	// Senders 0x01 and 0x10 are in cyprus1, 0x20 in cyprus2, 0x60 in paxos1
+	pool := newSnapshotPool(map[byte]int{0x01: 3, 0x10: 2, 0x20: 4, 0x60: 1})
+
+	tests := []struct {
+		query  GetPoolSnapshotPacket
+		hashes []common.Hash
+	}{
+		// Whole pool snapshots
+		{
+			GetPoolSnapshotPacket{Limit: 100},
+			snapshotHashes(pool, 0x01, 0x10, 0x20, 0x60),
+		},
+		// Truncated snapshots keep whole nonce sequences up to the limit
+		{
+			GetPoolSnapshotPacket{Limit: 4},
+			snapshotHashes(pool, 0x01, 0x10)[:4],
+		},
+		// Location filtered snapshots
+		{
+			GetPoolSnapshotPacket{Location: common.Location{0, 0}, Limit: 100},
+			snapshotHashes(pool, 0x01, 0x10),
+		},
+		{
+			GetPoolSnapshotPacket{Location: common.Location{0, 1}, Limit: 3},
+			snapshotHashes(pool, 0x20)[:3],
+		},
+		{
+			GetPoolSnapshotPacket{Location: common.Location{1, 0}, Limit: 100},
+			snapshotHashes(pool, 0x60),
+		},
+		{
+			GetPoolSnapshotPacket{Location: common.Location{2, 0}, Limit: 100},
+			nil,
+		},
+	}
+	for i, tt := range tests {
+		hashes, err := answerGetPoolSnapshotQuery(pool, tt.query)
+		if err != nil {
+			t.Errorf("test %d: failed to answer query: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(hashes, tt.hashes) {
+			t.Errorf("test %d: snapshot mismatch: have %x, want %x", i, hashes, tt.hashes)
+		}
+	}
+	// Snapshots are capped at the serving limit
+	hashes, err := answerGetPoolSnapshotQuery(newSnapshotPool(map[byte]int{0x01: maxPoolSnapshotServe + 10}), GetPoolSnapshotPacket{Limit: 2 * maxPoolSnapshotServe})
+	if err != nil {
+		t.Fatalf("failed to answer oversized query: %v", err)
+	}
+	if len(hashes) != maxPoolSnapshotServe {
+		t.Errorf("oversized snapshot length mismatch: have %d, want %d", len(hashes), maxPoolSnapshotServe)
+	}
+}
+
+// Tests that malformed pool snapshot queries are rejected.
+func TestGetPoolSnapshotInvalid(t *testing.T) {
+	pool := newSnapshotPool(map[byte]int{0x01: 1})
+
+	tests := []struct {
+		query GetPoolSnapshotPacket
+		err   error
+	}{
+		{GetPoolSnapshotPacket{}, errInvalidQuery},
+		{GetPoolSnapshotPacket{Location: common.Location{0, 0, 0}, Limit: 1}, errInvalidLocation},
+		{GetPoolSnapshotPacket{Location: common.Location{common.NumRegionsInPrime, 0}, Limit: 1}, errInvalidLocation},
+	}
+	for i, tt := range tests {
+		if _, err := answerGetPoolSnapshotQuery(pool, tt.query); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+// Tests that oversized snapshots and refusals carrying hashes are rejected.
+func TestPoolSnapshotSanityCheck(t *testing.T) {
+	tests := []struct {
+		snapshot PoolSnapshotPacket
+		valid    bool
+	}{
+		{PoolSnapshotPacket{}, true},
+		{PoolSnapshotPacket{Refused: true}, true},
+		{PoolSnapshotPacket{Hashes: make([]common.Hash, maxPoolSnapshotServe)}, true},
+		{PoolSnapshotPacket{Hashes: make([]common.Hash, maxPoolSnapshotServe+1)}, false},
+		{PoolSnapshotPacket{Hashes: []common.Hash{{0x01}}, Refused: true}, false},
+	}
+	for i, tt := range tests {
+		err := tt.snapshot.sanityCheck()
+		if tt.valid && err != nil {
+			t.Errorf("test %d: valid snapshot rejected: %v", i, err)
+		}
+		if !tt.valid && !errors.Is(err, errInvalidPoolSnapshot) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, errInvalidPoolSnapshot)
+		}
+	}
+}
+
+// Tests that pool snapshots round-trip through the wire, marking the hashes as
+// known to the peer, and that nodes not serving their pool refuse the request.
+func TestPoolSnapshotRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		pool   = newSnapshotPool(map[byte]int{0x01: 2, 0x20: 2})
+		local  = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xeb, 0x01}, "peer", nil), net, nil)
+		remote = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xeb, 0x02}, "peer", nil), app, nil)
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	advertiseOptional(local, GetPoolSnapshotMsg)
+	go local.RequestPoolSnapshot(nil, 16)
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	if msg.Code != GetPoolSnapshotMsg {
+		t.Fatalf("request code mismatch: have %#x, want %#x", msg.Code, GetPoolSnapshotMsg)
+	}
+	var query GetPoolSnapshotPacket66
+	if err := msg.Decode(&query); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	if len(query.Location) != 0 || query.Limit != 16 {
+		t.Fatalf("request mismatch: have %+v", query.GetPoolSnapshotPacket)
+	}
+	hashes, err := answerGetPoolSnapshotQuery(pool, query.GetPoolSnapshotPacket)
+	if err != nil {
+		t.Fatalf("failed to answer query: %v", err)
+	}
+	go remote.ReplyPoolSnapshot(query.RequestId, PoolSnapshotPacket{Hashes: hashes})
+
+	backend := new(mockBackend)
+	if err := handleMessage(backend, local); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+	}
+	snapshot := backend.handled[0].(*PoolSnapshotPacket)
+	if want := snapshotHashes(pool, 0x01, 0x20); !reflect.DeepEqual(snapshot.Hashes, want) || snapshot.Refused {
+		t.Fatalf("delivered snapshot mismatch: have %+v, want %x", snapshot, want)
+	}
+	for _, hash := range snapshot.Hashes {
+		if !local.KnownTransaction(hash) {
+			t.Errorf("snapshot hash %x not marked known to the requester", hash)
+		}
+		if !remote.KnownTransaction(hash) {
+			t.Errorf("snapshot hash %x not marked known to the server", hash)
+		}
+	}
+	// Nodes outside of a zone don't serve their pool
+	go local.RequestPoolSnapshot(nil, 16)
+
+	errc := make(chan error, 1)
+	go func() { errc <- handleMessage(new(mockBackend), remote) }()
+	if err := handleMessage(backend, local); err != nil {
+		t.Fatalf("failed to handle refusal: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to handle request: %v", err)
+	}
+	if refusal := backend.handled[1].(*PoolSnapshotPacket); !refusal.Refused || len(refusal.Hashes) != 0 {
+		t.Errorf("refusal mismatch: have %+v", refusal)
+	}
+	// Peers older than eth/67 can't be asked
+	old := NewPeer(ETH66, p2p.NewPeer(enode.ID{0xeb, 0x03}, "peer", nil), net, nil)
+	defer old.Close()
+
+	if err := old.RequestPoolSnapshot(nil, 16); err == nil {
+		t.Errorf("eth/66 peer accepted pool snapshot request")
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// Tests that pooled transaction replies are filtered down to the requested ones,
+// penalizing the peers delivering unrequested transactions.
+func TestPooledTransactionsFiltering(t *testing.T) {
+	config := DefaultConfig
+	config.MaxUnrequestedTxReplies = 2
+
+	txs := newTestTransactions(6)
+	hashes := func(txs []*types.Transaction) []common.Hash {
+		var hashes []common.Hash
+		for _, tx := range txs {
+			hashes = append(hashes, tx.Hash())
+		}
+		return hashes
+	}
+	tests := []struct {
+		requested []*types.Transaction
+		delivered []*types.Transaction
+		accepted  []*types.Transaction
+		penalties int
+		err       error
+	}{
+		// Exact reply, all accepted
+		{txs[:3], txs[:3], txs[:3], 0, nil},
+		// Partial reply, the delivered ones accepted
+		{txs[:3], txs[1:2], txs[1:2], 0, nil},
+		// Empty reply, nothing to accept
+		{txs[:3], nil, nil, 0, nil},
+		// Reply with extras, the extras dropped and the peer penalized
+		{txs[:2], txs[:4], txs[:2], 1, nil},
+		// Reply with only extras, all dropped and the peer dropped at the limit
+		{txs[:2], txs[4:], nil, 2, errUnrequestedTxs},
+	}
+	peer := newPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), nil, nil, &config)
+	defer peer.Close()
+
+	for i, tt := range tests {
+		id := uint64(i)
+		peer.trackTxRequest(id, hashes(tt.requested))
+
+		delivered := append(PooledTransactionsPacket{}, tt.delivered...)
+		accepted, err := peer.filterRequestedTxs(id, delivered)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if have, want := hashes(accepted), hashes(tt.accepted); len(have) != len(want) {
+			t.Errorf("test %d: accepted transactions mismatch: have %x, want %x", i, have, want)
+		} else {
+			for j := range have {
+				if have[j] != want[j] {
+					t.Errorf("test %d: accepted transaction %d mismatch: have %x, want %x", i, j, have[j], want[j])
+				}
+			}
+		}
+		if peer.unrequestedTxs != tt.penalties {
+			t.Errorf("test %d: penalties mismatch: have %d, want %d", i, peer.unrequestedTxs, tt.penalties)
+		}
+		if _, ok := peer.txRequests[id]; ok {
+			t.Errorf("test %d: request still tracked after its reply", i)
+		}
+	}
+	// Replies to requests no longer tracked carry nothing that was asked for
+	if accepted, _ := peer.filterRequestedTxs(100, PooledTransactionsPacket(txs[:1])); len(accepted) != 0 {
+		t.Errorf("reply to an untracked request accepted: %v", accepted)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// Tests that handlers overrunning the processing time limit are abandoned at the
+// deadline, dropping the peer, while the ones within it are left alone.
+func TestMaxProcessingTime(t *testing.T) {
+	// Replace the handler with a stub taking a configurable time to complete
+	var (
+		delay time.Duration
+		done  = make(chan struct{}, 1)
+	)
+	defer func(old msgHandler) { eth66[GetBlockBodiesMsg] = old }(eth66[GetBlockBodiesMsg])
+	eth66[GetBlockBodiesMsg] = func(backend Backend, msg Decoder, peer *Peer) error {
+		var query []uint64
+		if err := msg.Decode(&query); err != nil {
+			return err
+		}
+		time.Sleep(delay)
+		done <- struct{}{}
+		return nil
+	}
+	tests := []struct {
+		limit time.Duration
+		delay time.Duration
+		err   error
+	}{
+		{20 * time.Millisecond, 0, nil},                                       // Fast handler
+		{20 * time.Millisecond, 500 * time.Millisecond, errProcessingTimeout}, // Slow handler
+		{0, 100 * time.Millisecond, nil},                                      // Slow handler, limit disabled
+	}
+	for i, tt := range tests {
+		delay = tt.delay
+
+		config := DefaultConfig
+		config.MaxProcessingTime = tt.limit
+
+		app, net := p2p.MsgPipe()
+		peer := newPeer(ETH66, p2p.NewPeer(enode.ID{byte(i)}, "peer", nil), net, nil, &config)
+
+		go p2p.Send(app, GetBlockBodiesMsg, []uint64{1, 2, 3})
+
+		start := time.Now()
+		err := handleMessage(new(mockBackend), peer)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if tt.err != nil {
+			if elapsed := time.Since(start); elapsed >= tt.delay {
+				t.Errorf("test %d: handler not abandoned at the deadline: took %v", i, elapsed)
+			}
+		}
+		// Wait for abandoned handlers too, so they don't leak into the next test
+		<-done
+
+		peer.Close()
+		app.Close()
+		net.Close()
+	}
+}
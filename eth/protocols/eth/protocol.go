@@ -20,9 +20,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/big"
+	"time"
 
 	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core"
 	"github.com/dominant-strategies/go-quai/core/types"
 	"github.com/dominant-strategies/go-quai/rlp"
 )
@@ -31,6 +34,7 @@ import (
 const (
 	ETH65 = 65
 	ETH66 = 66
+	ETH67 = 67
 )
 
 // ProtocolName is the official short name of the `quai` protocol used during
@@ -39,14 +43,43 @@ const c_ProtocolName = "quai"
 
 // ProtocolVersions are the supported versions of the `eth` protocol (first
 // is primary).
-var ProtocolVersions = []uint{ETH66, ETH65}
+var ProtocolVersions = []uint{ETH67, ETH66, ETH65}
 
 // protocolLengths are the number of implemented message corresponding to
-// different protocol versions.
-var protocolLengths = map[uint]uint64{ETH66: 21, ETH65: 19}
+// different protocol versions. The eth/66 and eth/67 lengths also span the
+// experimental message range.
+var protocolLengths = map[uint]uint64{
+	ETH67: ExperimentalMsgBase + ExperimentalMsgCount,
+	ETH66: ExperimentalMsgBase + ExperimentalMsgCount,
+	ETH65: 19,
+}
 
-// maxMessageSize is the maximum cap on the size of a protocol message.
-const maxMessageSize = 10 * 1024 * 1024
+const (
+	// maxMessageSize is the default cap on the size of a protocol message, used
+	// for peers not advertising a limit of their own.
+	maxMessageSize = 10 * 1024 * 1024
+
+	// minMessageSize is the lowest message size limit a peer may advertise,
+	// leaving room for replies filled up to the soft response limit.
+	minMessageSize = 2 * softResponseLimit
+
+	// absoluteMaxMessageSize is the highest message size limit a peer may
+	// advertise, bounded by the largest message the RLPx transport can frame.
+	absoluteMaxMessageSize = 1<<24 - 1
+
+	// maxClientVersionLength is the maximum length of the client version string
+	// a peer may advertise.
+	maxClientVersionLength = 128
+
+	// maxSlicesRunning is the maximum number of slices a peer may advertise to
+	// be running, bounded by the number of slices in the hierarchy.
+	maxSlicesRunning = common.NumRegionsInPrime * common.NumZonesInRegion
+
+	// maxEntropyBits is the maximum bit length of the entropy a peer may
+	// advertise. A block reduces the entropy by at most 256 bits, accumulated
+	// with 64 bits of mantissa, and no chain can outgrow 64 bit block numbers.
+	maxEntropyBits = 8 + 64 + 64
+)
 
 const (
 	// Protocol messages in eth/64
@@ -66,12 +99,82 @@ const (
 
 	GetBlockMsg = 0x0b
 
-	PendingEtxsMsg             = 0x11
-	GetOnePendingEtxsMsg       = 0x12
-	PendingEtxsRollupMsg       = 0x13
-	GetOnePendingEtxsRollupMsg = 0x14
+	PendingEtxsMsg              = 0x11
+	GetOnePendingEtxsMsg        = 0x12
+	PendingEtxsRollupMsg        = 0x13
+	GetOnePendingEtxsRollupMsg  = 0x14
+	GetBlockTxHashesMsg         = 0x15
+	BlockTxHashesMsg            = 0x16
+	GetHeadMsg                  = 0x17
+	HeadMsg                     = 0x18
+	GetCapabilitiesMsg          = 0x19
+	CapabilitiesMsg             = 0x1a
+	GetHeadersByNumbersMsg      = 0x1b
+	HeadersByNumbersMsg         = 0x1c
+	HaveBlockMsg                = 0x1d
+	HaveBlockReplyMsg           = 0x1e
+	GetPendingEtxsByLocationMsg = 0x1f
+	PendingEtxsByLocationMsg    = 0x20
+	GetBlockEtxRootsMsg         = 0x21
+	BlockEtxRootsMsg            = 0x22
+	GetFreshBlockBodiesMsg      = 0x23
+	FreshBlockBodiesMsg         = 0x24
+	GetBlockMinersMsg           = 0x25
+	BlockMinersMsg              = 0x26
+	GetUnclesByRangeMsg         = 0x27
+	UnclesByRangeMsg            = 0x28
+
+	// Protocol messages introduced in eth/67
+	GetBlockDataMsg           = 0x29
+	BlockDataMsg              = 0x2a
+	GetBlockByNumberMsg       = 0x2b
+	BlockByNumberMsg          = 0x2c
+	StatusDeltaMsg            = 0x2d
+	GetEtxManifestProofMsg    = 0x2e
+	EtxManifestProofMsg       = 0x2f
+	GetCanonicalHashMsg       = 0x30
+	CanonicalHashMsg          = 0x31
+	GetPendingEtxsSinceMsg    = 0x32
+	PendingEtxsSinceMsg       = 0x33
+	GetPartialBodiesMsg       = 0x34
+	PartialBodiesMsg          = 0x35
+	GetEtxRollupsByRangeMsg   = 0x36
+	EtxRollupsByRangeMsg      = 0x37
+	GetPoolSnapshotMsg        = 0x38
+	PoolSnapshotMsg           = 0x39
+	GetHeadersByMinerMsg      = 0x3a
+	HeadersByMinerMsg         = 0x3b
+	GetTxNonInclusionProofMsg = 0x3c
+	TxNonInclusionProofMsg    = 0x3d
+	GetUnclePoolMsg           = 0x3e
+	UnclePoolMsg              = 0x3f
+)
+
+const (
+	// ExperimentalMsgBase is the first message code of the range reserved for
+	// prototyping new messages without bumping the protocol version. Codes in
+	// the range are only valid between peers which both opted in during the
+	// status exchange.
+	ExperimentalMsgBase = 0x40
+
+	// ExperimentalMsgCount is the number of codes in the experimental range.
+	ExperimentalMsgCount = 0x20
+)
+
+// Messages being prototyped in the experimental range
+const (
+	CompactBlockBodiesMsg             = ExperimentalMsgBase + 0x00
+	CompactPooledTransactionHashesMsg = ExperimentalMsgBase + 0x01
+	GetPooledTransactionHashesMsg     = ExperimentalMsgBase + 0x02
+	PooledTransactionHashesMsg        = ExperimentalMsgBase + 0x03
 )
 
+// isExperimental reports whether a message code falls into the experimental
+// message range.
+func isExperimental(code uint64) bool {
+	return code >= ExperimentalMsgBase && code < ExperimentalMsgBase+ExperimentalMsgCount
+}
+
 var (
 	errNoStatusMsg             = errors.New("no status message")
 	errMsgTooLarge             = errors.New("message too long")
@@ -82,12 +185,108 @@ var (
 	errGenesisMismatch         = errors.New("genesis mismatch")
 	errLocationMismatch        = errors.New("location mismatch")
 	errSlicesRunningRejected   = errors.New("slices running not valid")
+	errUnsolicitedResponse     = errors.New("unsolicited response")
+	errInvalidLocation         = errors.New("invalid location")
+	errLocationNotServed       = errors.New("location not served")
+	errSelfConnection          = errors.New("connected to self")
+	errResponseTooLarge        = errors.New("response too large, reduce batch")
+	errFutureBlock             = errors.New("block too far ahead of head")
+	errFutureTimestamp         = errors.New("block timestamp too far in the future")
+	errInvalidQuery            = errors.New("invalid query")
+	errInvalidRollup           = errors.New("invalid pending etxs rollup")
+	errNotExperimental         = errors.New("experimental messages not negotiated")
+	errMessageSizeRejected     = errors.New("message size limit rejected")
+	errInvalidManifest         = errors.New("invalid subordinate manifest")
+	errDisallowedMsg           = errors.New("message not in allowlist")
+	errClientVersionRejected   = errors.New("client version too long")
+	errGasLimitExceeded        = errors.New("block gas limit exceeded")
+	errEntropyRegression       = errors.New("entropy regression")
+	errBodyUnavailable         = errors.New("block body unavailable")
+	errFetchTimeout            = errors.New("fetch timed out")
+	errFetchAborted            = errors.New("fetch aborted by disconnect")
+	errUnrequestedTxs          = errors.New("unrequested pooled transactions")
+	errProcessingTimeout       = errors.New("message processing timed out")
+	errInvalidBlockData        = errors.New("mismatched block data")
+	errInvalidStatusDelta      = errors.New("invalid status delta")
+	errInvalidManifestProof    = errors.New("invalid manifest proof")
+	errInvalidPartialBody      = errors.New("invalid partial block body")
+	errVersionDeprecated       = errors.New("protocol version deprecated")
+	errEntropyRejected         = errors.New("entropy out of bounds")
+	errPeerScoreTooLow         = errors.New("peer score too low")
+	errStopBehindOrigin        = errors.New("stop number behind origin")
+	errInvalidBlock            = errors.New("invalid block")
+	errInvalidPoolSnapshot     = errors.New("invalid pool snapshot")
+	errInvalidMinerHeaders     = errors.New("invalid miner headers")
+	errInvalidTxProof          = errors.New("invalid transaction proof")
+	errTxIncluded              = errors.New("transaction included in block")
+	errOptionalRejected        = errors.New("optional messages not valid")
+	errOptionalNotSupported    = errors.New("optional message not supported by peer")
+	errTruncatedMsg            = errors.New("truncated message")
+	errInvalidUnclePool        = errors.New("invalid uncle pool")
 )
 
+// validationErrors are the failures of a peer to deliver data passing the sanity
+// or integrity checks, as opposed to it merely breaking the protocol rules.
+var validationErrors = []error{
+	errInvalidBlock,
+	errGasLimitExceeded,
+	errInvalidBlockData,
+	errInvalidManifest,
+	errInvalidManifestProof,
+	errInvalidPartialBody,
+	errInvalidRollup,
+}
+
+// IsValidationFailure reports whether a peer was dropped for delivering data
+// which failed the sanity or integrity checks.
+func IsValidationFailure(err error) bool {
+	for _, failure := range validationErrors {
+		if errors.Is(err, failure) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTruncated reports whether a decode failure was caused by the payload ending
+// before the size declared by the message, as happens when a connection is cut
+// mid-message. Content overrunning the declared size is malformed instead.
+func isTruncated(err error) bool {
+	return errors.Is(err, errDecode) && errors.Is(err, io.ErrUnexpectedEOF)
+}
+
 // Packet represents a p2p message in the `eth` protocol.
 type Packet interface {
-	Name() string // Name returns a string corresponding to the message type.
-	Kind() byte   // Kind returns the message type.
+	Name() string     // Name returns a string corresponding to the message type.
+	Kind() byte       // Kind returns the message type.
+	Role() PacketRole // Role returns the part the message plays in the protocol.
+}
+
+// PacketRole is the part a message plays in the exchanges of the protocol,
+// allowing middleware to treat the messages uniformly.
+type PacketRole int
+
+const (
+	RoleRequest   PacketRole = iota // Retrieval asking the remote peer for data
+	RoleResponse                    // Reply to a previous retrieval
+	RoleBroadcast                   // Unsolicited propagation or announcement
+	RoleHandshake                   // Exchange establishing the connection
+)
+
+// String implements fmt.Stringer.
+func (r PacketRole) String() string {
+	switch r {
+	case RoleRequest:
+		return "request"
+	case RoleResponse:
+		return "response"
+	case RoleBroadcast:
+		return "broadcast"
+	case RoleHandshake:
+		return "handshake"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(r))
+	}
 }
 
 // StatusPacket is the network packet for the status message for eth/64 and later.
@@ -99,6 +298,13 @@ type StatusPacket struct {
 	Entropy         *big.Int
 	Head            common.Hash
 	Genesis         common.Hash
+	Experimental    bool        `rlp:"optional"` // Opt-in to the experimental message range
+	MaxMessageSize  uint64      `rlp:"optional"` // Limit on the size of inbound messages, 0 for the default
+	ClientVersion   string      `rlp:"optional"` // Software and version of the node, eth/67 and above
+	SessionNonce    common.Hash `rlp:"optional"` // Randomness contributed to the session token, full eth/67 statuses only
+	SessionToken    common.Hash `rlp:"optional"` // Token of the session being resumed, partial statuses only
+	Optional        []uint64    `rlp:"optional"` // Optional request codes served by the node, eth/67 and above
+	Light           bool        `rlp:"optional"` // Node not serving any requests, eth/67 and above
 }
 
 // NewBlockHashesPacket is the network packet for the block announcements.
@@ -130,7 +336,7 @@ type GetBlockHeadersPacket struct {
 	Amount  uint64       // Maximum number of headers to retrieve
 	Dom     bool         // true: Return only dom blocks upto amount, False : Return only non-dom blocks upto amount or dom block
 	Reverse bool         // Query direction (false = rising towards latest, true = falling towards genesis)
-	To      uint64       // Stop the fetch when To number is reached
+	To      uint64       // Stop the fetch once the To number is reached (0 = no stop), must not lie behind the origin
 	Skip    uint64       // The number of headers to skip between fetching the header from local database.
 }
 
@@ -146,6 +352,16 @@ type HashOrNumber struct {
 	Number uint64      // Block hash from which to retrieve headers (excludes Hash)
 }
 
+// HeadNumber is a reserved origin number requesting headers starting from the
+// serving node's current head, walking towards genesis. It allows fetching the
+// latest headers of a peer without knowing its head number.
+const HeadNumber = math.MaxUint64
+
+// IsHead reports whether the origin is the head-relative sentinel.
+func (hn *HashOrNumber) IsHead() bool {
+	return hn.Hash == (common.Hash{}) && hn.Number == HeadNumber
+}
+
 // EncodeRLP is a specialized encoder for HashOrNumber to encode only one of the
 // two contained union fields.
 func (hn *HashOrNumber) EncodeRLP(w io.Writer) error {
@@ -192,8 +408,56 @@ type NewBlockPacket struct {
 
 // sanityCheck verifies that the values are reasonable, as a DoS protection
 func (request *NewBlockPacket) sanityCheck() error {
+	if request.Block == nil || request.Block.Header() == nil {
+		return fmt.Errorf("%w: missing block", errDecode)
+	}
 	if err := request.Block.SanityCheck(); err != nil {
-		return err
+		return fmt.Errorf("%w: %v", errInvalidBlock, err)
+	}
+	return checkBlockGas(request.Block)
+}
+
+// checkBlockTime rejects blocks whose timestamp is ahead of the given local time
+// by more than the allowed drift. A zero drift disables the check.
+func checkBlockTime(block *types.Block, now time.Time, drift time.Duration) error {
+	if drift <= 0 {
+		return nil
+	}
+	limit := now.Add(drift).Unix()
+	if limit < 0 {
+		return nil
+	}
+	if timestamp := block.Time(); timestamp > uint64(limit) {
+		return fmt.Errorf("%w: timestamp %d, local time %d, drift limit %v", errFutureTimestamp, timestamp, now.Unix(), drift)
+	}
+	return nil
+}
+
+// checkBlockGas rejects blocks whose transactions obviously cannot fit into the
+// declared gas limit. The sum of the transaction gas limits is no bound, unused
+// gas being returned to the pool, so only the gas that is certainly spent is
+// checked: the reported usage, every single transaction's allowance and the
+// cumulative intrinsic cost of the internal transactions.
+func checkBlockGas(block *types.Block) error {
+	limit := block.GasLimit()
+	if used := block.GasUsed(); used > limit {
+		return fmt.Errorf("%w: used %d, limit %d", errGasLimitExceeded, used, limit)
+	}
+	var intrinsic uint64
+	for i, tx := range block.Transactions() {
+		if tx.Gas() > limit {
+			return fmt.Errorf("%w: tx %d gas %d, limit %d", errGasLimitExceeded, i, tx.Gas(), limit)
+		}
+		if tx.Type() != types.InternalTxType && tx.Type() != types.InternalToExternalTxType {
+			continue
+		}
+		gas, err := core.IntrinsicGas(tx.Data(), tx.AccessList(), tx.To() == nil)
+		if err != nil {
+			return fmt.Errorf("%w: tx %d: %v", errGasLimitExceeded, i, err)
+		}
+		if intrinsic += gas; intrinsic > limit {
+			return fmt.Errorf("%w: intrinsic gas %d, limit %d", errGasLimitExceeded, intrinsic, limit)
+		}
 	}
 	return nil
 }
@@ -311,15 +575,821 @@ type GetOnePendingEtxsRollupPacket66 struct {
 	GetOnePendingEtxsRollupPacket
 }
 
+// GetBlockTxHashesPacket represents a query for the ordered transaction hashes
+// of a single block.
+type GetBlockTxHashesPacket struct {
+	Hash common.Hash
+}
+
+// GetBlockTxHashesPacket66 is the eth/66 version of the GetBlockTxHashesPacket.
+type GetBlockTxHashesPacket66 struct {
+	RequestId uint64
+	GetBlockTxHashesPacket
+}
+
+// BlockTxHashesPacket is the network packet carrying the transaction hashes of
+// a block, in the order they appear in the block body.
+type BlockTxHashesPacket []common.Hash
+
+// BlockTxHashesPacket66 is the eth/66 version of the BlockTxHashesPacket.
+type BlockTxHashesPacket66 struct {
+	RequestId uint64
+	BlockTxHashesPacket
+}
+
+// GetHeadPacket represents a query for the current head of a chain within the
+// Quai hierarchy.
+type GetHeadPacket struct {
+	Location common.Location
+}
+
+// GetHeadPacket66 is the eth/66 version of the GetHeadPacket.
+type GetHeadPacket66 struct {
+	RequestId uint64
+	GetHeadPacket
+}
+
+// HeadPacket is the network packet carrying the current head of the requested
+// chain.
+type HeadPacket struct {
+	Hash    common.Hash
+	Number  uint64
+	Entropy *big.Int
+}
+
+// HeadPacket66 is the eth/66 version of the HeadPacket.
+type HeadPacket66 struct {
+	RequestId uint64
+	HeadPacket
+}
+
+// GetHeadersByNumbersPacket represents a query for the canonical headers at a
+// set of discrete, strictly ascending block numbers.
+type GetHeadersByNumbersPacket []uint64
+
+// GetHeadersByNumbersPacket66 is the eth/66 version of the GetHeadersByNumbersPacket.
+type GetHeadersByNumbersPacket66 struct {
+	RequestId uint64
+	GetHeadersByNumbersPacket
+}
+
+// HeadersByNumbersPacket is the network packet carrying the headers requested by
+// number, in ascending order. Numbers unknown to the serving node are skipped.
+type HeadersByNumbersPacket []*types.Header
+
+// HeadersByNumbersPacket66 is the eth/66 version of the HeadersByNumbersPacket.
+type HeadersByNumbersPacket66 struct {
+	RequestId uint64
+	HeadersByNumbersPacket
+}
+
+// HaveBlockPacket represents a probe for whether a remote node can serve the
+// full block with the given hash, cheaper than fetching it outright.
+type HaveBlockPacket struct {
+	Hash common.Hash
+}
+
+// HaveBlockPacket66 is the eth/66 version of the HaveBlockPacket.
+type HaveBlockPacket66 struct {
+	RequestId uint64
+	HaveBlockPacket
+}
+
+// HaveBlockReplyPacket is the network packet answering a block availability
+// probe.
+type HaveBlockReplyPacket struct {
+	Hash common.Hash
+	Have bool
+}
+
+// HaveBlockReplyPacket66 is the eth/66 version of the HaveBlockReplyPacket.
+type HaveBlockReplyPacket66 struct {
+	RequestId uint64
+	HaveBlockReplyPacket
+}
+
+// GetPendingEtxsByLocationPacket represents a paged retrieval of the ETXs
+// currently pending inclusion in the given location.
+type GetPendingEtxsByLocationPacket struct {
+	Location common.Location
+	Cursor   common.Hash // Hash of the last ETX already retrieved, zero to start from the beginning
+}
+
+// GetPendingEtxsByLocationPacket66 is the eth/66 version of the
+// GetPendingEtxsByLocationPacket.
+type GetPendingEtxsByLocationPacket66 struct {
+	RequestId uint64
+	GetPendingEtxsByLocationPacket
+}
+
+// PendingEtxsByLocationPacket is a page of pending ETXs, ordered by hash.
+type PendingEtxsByLocationPacket struct {
+	Etxs   types.Transactions
+	Cursor common.Hash // Cursor to retrieve the next page with, zero if there are no more ETXs
+}
+
+// PendingEtxsByLocationPacket66 is the eth/66 version of the
+// PendingEtxsByLocationPacket.
+type PendingEtxsByLocationPacket66 struct {
+	RequestId uint64
+	PendingEtxsByLocationPacket
+}
+
+// GetBlockEtxRootsPacket is a header query answered with the compact ETX roots
+// of the matching blocks instead of their full headers.
+type GetBlockEtxRootsPacket GetBlockHeadersPacket
+
+// GetBlockEtxRootsPacket66 is the eth/66 version of the GetBlockEtxRootsPacket.
+type GetBlockEtxRootsPacket66 struct {
+	RequestId uint64
+	*GetBlockEtxRootsPacket
+}
+
+// BlockEtxRoot is the compact representation of a block header, carrying only
+// what is needed to verify cross-chain ETX proofs against it.
+type BlockEtxRoot struct {
+	Number  uint64
+	Hash    common.Hash
+	EtxRoot common.Hash
+}
+
+// BlockEtxRootsPacket is the network packet answering a GetBlockEtxRoots query.
+type BlockEtxRootsPacket []BlockEtxRoot
+
+// BlockEtxRootsPacket66 is the eth/66 version of the BlockEtxRootsPacket.
+type BlockEtxRootsPacket66 struct {
+	RequestId uint64
+	BlockEtxRootsPacket
+}
+
+// GetFreshBlockBodiesPacket represents a block body query carrying the head of
+// the requester, allowing the server to skip the bodies of blocks which were
+// reorged out of the chain leading to it.
+type GetFreshBlockBodiesPacket struct {
+	Head   common.Hash   // Current head block of the requester
+	Number uint64        // Number of the requester's head block
+	Hashes []common.Hash // Blocks to retrieve the bodies of
+}
+
+// GetFreshBlockBodiesPacket66 is the eth/66 version of the
+// GetFreshBlockBodiesPacket.
+type GetFreshBlockBodiesPacket66 struct {
+	RequestId uint64
+	GetFreshBlockBodiesPacket
+}
+
+// FreshBlockBodiesPacket is the network packet answering a GetFreshBlockBodies
+// query.
+type FreshBlockBodiesPacket struct {
+	Bodies []*BlockBody
+	Stale  []common.Hash // Requested blocks skipped as not on the requester's chain
+}
+
+// FreshBlockBodiesPacket66 is the eth/66 version of the FreshBlockBodiesPacket.
+type FreshBlockBodiesPacket66 struct {
+	RequestId uint64
+	FreshBlockBodiesPacket
+}
+
+// FreshBlockBodiesRLPPacket is used for replying to fresh block body requests
+// with the bodies already RLP-encoded, avoiding the decode-encode roundtrip.
+type FreshBlockBodiesRLPPacket struct {
+	Bodies []rlp.RawValue
+	Stale  []common.Hash
+}
+
+// FreshBlockBodiesRLPPacket66 is the FreshBlockBodiesRLPPacket over eth/66.
+type FreshBlockBodiesRLPPacket66 struct {
+	RequestId uint64
+	FreshBlockBodiesRLPPacket
+}
+
+// GetBlockMinersPacket is a query for the miners of a range of consecutive
+// canonical blocks, starting at the origin. Dom filters the blocks the same way
+// as in GetBlockHeadersPacket.
+type GetBlockMinersPacket struct {
+	Origin HashOrNumber // Block from which to retrieve miners
+	Amount uint64       // Maximum number of miners to retrieve
+	Dom    bool         // true: Return only dom blocks upto amount, False : Return only non-dom blocks upto amount or dom block
+}
+
+// GetBlockMinersPacket66 is the eth/66 version of the GetBlockMinersPacket.
+type GetBlockMinersPacket66 struct {
+	RequestId uint64
+	GetBlockMinersPacket
+}
+
+// BlockMiner is the coinbase of a block, along with the block number.
+type BlockMiner struct {
+	Number uint64
+	Miner  common.Address
+}
+
+// BlockMinersPacket is the network packet answering a GetBlockMiners query.
+type BlockMinersPacket []BlockMiner
+
+// BlockMinersPacket66 is the eth/66 version of the BlockMinersPacket.
+type BlockMinersPacket66 struct {
+	RequestId uint64
+	BlockMinersPacket
+}
+
+// GetUnclesByRangePacket is a query for the uncles referenced by a range of
+// consecutive canonical blocks, starting at the origin. Dom filters the blocks
+// the same way as in GetBlockHeadersPacket.
+type GetUnclesByRangePacket struct {
+	Origin HashOrNumber // Block from which to retrieve uncles
+	Amount uint64       // Maximum number of blocks to retrieve the uncles of
+	Dom    bool         // true: Return only dom blocks upto amount, False : Return only non-dom blocks upto amount or dom block
+}
+
+// GetUnclesByRangePacket66 is the eth/66 version of the GetUnclesByRangePacket.
+type GetUnclesByRangePacket66 struct {
+	RequestId uint64
+	GetUnclesByRangePacket
+}
+
+// BlockUncles is the set of uncles referenced by a block, along with the block
+// number. Blocks without uncles have an empty set.
+type BlockUncles struct {
+	Number uint64
+	Uncles []*types.Header
+}
+
+// UnclesByRangePacket is the network packet answering a GetUnclesByRange query.
+type UnclesByRangePacket []BlockUncles
+
+// UnclesByRangePacket66 is the eth/66 version of the UnclesByRangePacket.
+type UnclesByRangePacket66 struct {
+	RequestId uint64
+	UnclesByRangePacket
+}
+
+// BlockUnclesRLP is the BlockUncles with the uncles already RLP-encoded, as
+// stored in the block body.
+type BlockUnclesRLP struct {
+	Number uint64
+	Uncles rlp.RawValue
+}
+
+// UnclesByRangeRLPPacket is used for replying to uncle range requests straight
+// from the stored block bodies, avoiding the decode-encode roundtrip.
+type UnclesByRangeRLPPacket []BlockUnclesRLP
+
+// UnclesByRangeRLPPacket66 is the UnclesByRangeRLPPacket over eth/66.
+type UnclesByRangeRLPPacket66 struct {
+	RequestId uint64
+	UnclesByRangeRLPPacket
+}
+
+// GetBlockDataPacket is a query for the headers and the bodies of a range of
+// consecutive canonical blocks in a single round trip, starting at the origin.
+// Dom filters the blocks the same way as in GetBlockHeadersPacket.
+type GetBlockDataPacket struct {
+	Origin HashOrNumber // Block from which to retrieve data
+	Amount uint64       // Maximum number of blocks to retrieve
+	Dom    bool         // true: Return only dom blocks upto amount, False : Return only non-dom blocks upto amount or dom block
+}
+
+// GetBlockDataPacket66 is the GetBlockDataPacket with a request id.
+type GetBlockDataPacket66 struct {
+	RequestId uint64
+	GetBlockDataPacket
+}
+
+// BlockDataPacket is the network packet answering a GetBlockData query. The
+// bodies correspond to the headers one by one.
+type BlockDataPacket struct {
+	Headers []*types.Header
+	Bodies  []*BlockBody
+}
+
+// Unpack retrieves the headers and the split contents of the bodies from the
+// packet, in the flat format the downloader consumes.
+func (p *BlockDataPacket) Unpack() ([]*types.Header, [][]*types.Transaction, [][]*types.Header, [][]*types.Transaction, []types.BlockManifest) {
+	bodies := BlockBodiesPacket(p.Bodies)
+	txs, uncles, etxs, manifests := bodies.Unpack()
+	return p.Headers, txs, uncles, etxs, manifests
+}
+
+// BlockDataPacket66 is the BlockDataPacket with a request id.
+type BlockDataPacket66 struct {
+	RequestId uint64
+	BlockDataPacket
+}
+
+// BlockDataRLPPacket is used for replying to block data requests with the bodies
+// straight from the database, avoiding the decode-encode roundtrip.
+type BlockDataRLPPacket struct {
+	Headers []*types.Header
+	Bodies  []rlp.RawValue
+}
+
+// BlockDataRLPPacket66 is the BlockDataRLPPacket with a request id.
+type BlockDataRLPPacket66 struct {
+	RequestId uint64
+	BlockDataRLPPacket
+}
+
+// GetBlockByNumberPacket is a query for the canonical block at a given number of
+// the chain at a location within the Quai hierarchy.
+type GetBlockByNumberPacket struct {
+	Location common.Location
+	Number   uint64
+}
+
+// GetBlockByNumberPacket66 is the GetBlockByNumberPacket with a request id.
+type GetBlockByNumberPacket66 struct {
+	RequestId uint64
+	GetBlockByNumberPacket
+}
+
+// BlockByNumberPacket is the network packet answering a GetBlockByNumber query,
+// carrying no block if the requested one is unknown.
+type BlockByNumberPacket struct {
+	Block *types.Block `rlp:"nil"`
+}
+
+// BlockByNumberPacket66 is the BlockByNumberPacket with a request id.
+type BlockByNumberPacket66 struct {
+	RequestId uint64
+	BlockByNumberPacket
+}
+
+// StatusField is a bitmap of the status fields updated by a status delta.
+type StatusField uint64
+
+const (
+	StatusFieldHead    StatusField = 1 << iota // Head block hash
+	StatusFieldEntropy                         // Head block entropy
+
+	statusFieldsKnown = StatusFieldHead | StatusFieldEntropy
+)
+
+// StatusDeltaPacket is the network packet updating the mutable fields of the
+// status exchanged in the handshake. Only the fields flagged in the bitmap are
+// carried, RLP encoded in bit order.
+type StatusDeltaPacket struct {
+	Fields StatusField
+	Values []rlp.RawValue
+}
+
+// GetEtxManifestProofPacket is a query for the proof that a block of a source
+// shard was rolled up into the subordinate manifest of a dominant block, through
+// which the ETXs it emitted are referenced.
+type GetEtxManifestProofPacket struct {
+	Hash     common.Hash     // Hash of the dominant block
+	Location common.Location // Location of the source shard, subordinate to the dominant chain
+	SubHash  common.Hash     // Hash of the source shard block to prove
+}
+
+// GetEtxManifestProofPacket66 is the GetEtxManifestProofPacket with a request id.
+type GetEtxManifestProofPacket66 struct {
+	RequestId uint64
+	GetEtxManifestProofPacket
+}
+
+// EtxManifestProofPacket is the network packet answering a GetEtxManifestProof
+// query with the subordinate manifest root of the dominant block, and the merkle
+// proof of the source block at its index in the manifest. The root is empty if
+// the dominant block is unknown, the proof if the source block isn't included.
+type EtxManifestProofPacket struct {
+	Root  common.Hash
+	Index uint64
+	Proof [][]byte
+}
+
+// EtxManifestProofPacket66 is the EtxManifestProofPacket with a request id.
+type EtxManifestProofPacket66 struct {
+	RequestId uint64
+	EtxManifestProofPacket
+}
+
+// GetCanonicalHashPacket is a query for the hash of the canonical block at a
+// given number of the chain at a location within the Quai hierarchy.
+type GetCanonicalHashPacket struct {
+	Location common.Location
+	Number   uint64
+}
+
+// GetCanonicalHashPacket66 is the GetCanonicalHashPacket with a request id.
+type GetCanonicalHashPacket66 struct {
+	RequestId uint64
+	GetCanonicalHashPacket
+}
+
+// CanonicalHashPacket is the network packet answering a GetCanonicalHash query,
+// carrying an empty hash if the requested number is beyond the head.
+type CanonicalHashPacket struct {
+	Hash common.Hash
+}
+
+// CanonicalHashPacket66 is the CanonicalHashPacket with a request id.
+type CanonicalHashPacket66 struct {
+	RequestId uint64
+	CanonicalHashPacket
+}
+
+// GetPendingEtxsSincePacket represents a paged retrieval of the ETXs pending
+// inclusion in the given location which entered the pending set after a known
+// canonical block.
+type GetPendingEtxsSincePacket struct {
+	Location common.Location
+	Since    common.Hash // Hash of the block after which the ETXs were created, zero for all of them
+	Cursor   common.Hash // Hash of the last ETX already retrieved, zero to start from the beginning
+}
+
+// GetPendingEtxsSincePacket66 is the GetPendingEtxsSincePacket with a request id.
+type GetPendingEtxsSincePacket66 struct {
+	RequestId uint64
+	GetPendingEtxsSincePacket
+}
+
+// PendingEtxsSincePacket is a page of the pending ETXs created after a block,
+// ordered by hash.
+type PendingEtxsSincePacket struct {
+	Etxs   types.Transactions
+	Cursor common.Hash // Cursor to retrieve the next page with, zero if there are no more ETXs
+}
+
+// PendingEtxsSincePacket66 is the PendingEtxsSincePacket with a request id.
+type PendingEtxsSincePacket66 struct {
+	RequestId uint64
+	PendingEtxsSincePacket
+}
+
+// BodyField is a bitmap of the block body fields selected by a partial body
+// retrieval.
+type BodyField uint64
+
+const (
+	BodyFieldTransactions    BodyField = 1 << iota // Transactions contained within the block
+	BodyFieldUncles                                // Uncles contained within the block
+	BodyFieldExtTransactions                       // External transactions emitted by the block
+	BodyFieldSubManifest                           // Manifest of the subordinate blocks
+
+	bodyFieldsKnown = BodyFieldTransactions | BodyFieldUncles | BodyFieldExtTransactions | BodyFieldSubManifest
+)
+
+// GetPartialBodiesPacket represents a block body query for a subset of the body
+// fields only.
+type GetPartialBodiesPacket struct {
+	Fields BodyField     // Body fields to retrieve
+	Hashes []common.Hash // Blocks to retrieve the bodies of
+}
+
+// GetPartialBodiesPacket66 is the GetPartialBodiesPacket with a request id.
+type GetPartialBodiesPacket66 struct {
+	RequestId uint64
+	GetPartialBodiesPacket
+}
+
+// PartialBlockBody is a block body reduced to the fields flagged in the bitmap
+// of the reply carrying it, RLP encoded in bit order.
+type PartialBlockBody []rlp.RawValue
+
+// PartialBodiesPacket is the network packet answering a GetPartialBodies query.
+type PartialBodiesPacket struct {
+	Fields BodyField
+	Bodies []PartialBlockBody
+}
+
+// PartialBodiesPacket66 is the PartialBodiesPacket with a request id.
+type PartialBodiesPacket66 struct {
+	RequestId uint64
+	PartialBodiesPacket
+}
+
+// GetEtxRollupsByRangePacket is a query for the pending ETX rollups of a range of
+// consecutive canonical dominant blocks, starting at the origin.
+type GetEtxRollupsByRangePacket struct {
+	Origin HashOrNumber // Block from which to retrieve the rollups
+	Count  uint64       // Maximum number of dominant blocks to retrieve the rollups of
+}
+
+// GetEtxRollupsByRangePacket66 is the GetEtxRollupsByRangePacket with a request id.
+type GetEtxRollupsByRangePacket66 struct {
+	RequestId uint64
+	GetEtxRollupsByRangePacket
+}
+
+// EtxRollupsByRangePacket is the network packet answering a GetEtxRollupsByRange
+// query, carrying the rollups in ascending block order. A reply holding fewer
+// rollups than requested is continued from the block after the last one.
+type EtxRollupsByRangePacket []types.PendingEtxsRollup
+
+// EtxRollupsByRangePacket66 is the EtxRollupsByRangePacket with a request id.
+type EtxRollupsByRangePacket66 struct {
+	RequestId uint64
+	EtxRollupsByRangePacket
+}
+
+// GetPoolSnapshotPacket is a query for the hashes of the pending transactions in
+// the pool of the remote peer, meant to warm up the local pool after a restart.
+type GetPoolSnapshotPacket struct {
+	Location common.Location // Location the transactions must be sent from (empty = any)
+	Limit    uint64          // Maximum number of hashes to retrieve
+}
+
+// GetPoolSnapshotPacket66 is the GetPoolSnapshotPacket with a request id.
+type GetPoolSnapshotPacket66 struct {
+	RequestId uint64
+	GetPoolSnapshotPacket
+}
+
+// PoolSnapshotPacket is the network packet answering a GetPoolSnapshot query.
+// The hashes are retrieved through GetPooledTransactions like announced ones.
+// Peers unwilling to share their pool, e.g. as it isn't synced yet, refuse the
+// query without any hashes.
+type PoolSnapshotPacket struct {
+	Hashes  []common.Hash
+	Refused bool
+}
+
+// PoolSnapshotPacket66 is the PoolSnapshotPacket with a request id.
+type PoolSnapshotPacket66 struct {
+	RequestId uint64
+	PoolSnapshotPacket
+}
+
+// GetHeadersByMinerPacket is a query for the headers mined by any of a set of
+// addresses within a range of consecutive canonical blocks, starting at the
+// origin. Dom filters the blocks the same way as in GetBlockHeadersPacket.
+type GetHeadersByMinerPacket struct {
+	Origin HashOrNumber     // Block from which to start scanning
+	Amount uint64           // Maximum number of blocks to scan
+	Dom    bool             // true: Scan only dom blocks upto amount, False : Scan only non-dom blocks upto amount or dom block
+	Miners []common.Address // Coinbases of the headers to retrieve
+}
+
+// GetHeadersByMinerPacket66 is the GetHeadersByMinerPacket with a request id.
+type GetHeadersByMinerPacket66 struct {
+	RequestId uint64
+	GetHeadersByMinerPacket
+}
+
+// HeadersByMinerPacket is the network packet answering a GetHeadersByMiner query,
+// carrying the matching headers in ascending block order. As the scan may be cut
+// short of the requested range, Last is the number of the last block scanned,
+// from after which the query is to be continued.
+type HeadersByMinerPacket struct {
+	Headers []*types.Header
+	Last    uint64
+}
+
+// HeadersByMinerPacket66 is the HeadersByMinerPacket with a request id.
+type HeadersByMinerPacket66 struct {
+	RequestId uint64
+	HeadersByMinerPacket
+}
+
+// GetTxNonInclusionProofPacket is a query for the proof that a transaction is not
+// part of the transaction trie of a block.
+type GetTxNonInclusionProofPacket struct {
+	Hash   common.Hash // Hash of the block
+	TxHash common.Hash // Hash of the transaction to prove absent
+}
+
+// GetTxNonInclusionProofPacket66 is the GetTxNonInclusionProofPacket with a request id.
+type GetTxNonInclusionProofPacket66 struct {
+	RequestId uint64
+	GetTxNonInclusionProofPacket
+}
+
+// TxNonInclusionProofPacket is the network packet answering a GetTxNonInclusionProof
+// query. As the transaction trie is keyed by index rather than by hash, absence
+// is proven by opening every index of the trie: Proof holds the trie nodes on the
+// paths to the Count transactions of the block and to the first index past them.
+// The proof is empty if the block is unknown or too large to prove.
+type TxNonInclusionProofPacket struct {
+	Count uint64
+	Proof [][]byte
+}
+
+// TxNonInclusionProofPacket66 is the TxNonInclusionProofPacket with a request id.
+type TxNonInclusionProofPacket66 struct {
+	RequestId uint64
+	TxNonInclusionProofPacket
+}
+
+// GetUnclePoolPacket is a query for the uncle candidates known to the remote peer,
+// meant for miners to include the side blocks seen by their peers as uncles.
+type GetUnclePoolPacket struct {
+	Limit uint64 // Maximum number of candidates to retrieve
+}
+
+// GetUnclePoolPacket66 is the GetUnclePoolPacket with a request id.
+type GetUnclePoolPacket66 struct {
+	RequestId uint64
+	GetUnclePoolPacket
+}
+
+// UncleCandidate is a recent side block which wasn't included as an uncle yet.
+type UncleCandidate struct {
+	Hash   common.Hash // Hash of the side block
+	Number uint64      // Number of the side block
+}
+
+// UnclePoolPacket is the network packet answering a GetUnclePool query, listing
+// the uncle candidates of the peer's chain, newest first. The ones not known
+// locally are retrieved like announced blocks. The pool may well be empty.
+type UnclePoolPacket []UncleCandidate
+
+// Unpack retrieves the hashes and numbers of the uncle candidates in a split flat
+// format, as taken by the block announcement handling.
+func (p *UnclePoolPacket) Unpack() ([]common.Hash, []uint64) {
+	var (
+		hashes  = make([]common.Hash, len(*p))
+		numbers = make([]uint64, len(*p))
+	)
+	for i, uncle := range *p {
+		hashes[i], numbers[i] = uncle.Hash, uncle.Number
+	}
+	return hashes, numbers
+}
+
+// UnclePoolPacket66 is the UnclePoolPacket with a request id.
+type UnclePoolPacket66 struct {
+	RequestId uint64
+	UnclePoolPacket
+}
+
+// CompactBlockBodiesPacket is the experimental alternative to BlockBodiesPacket,
+// sent in reply to GetBlockBodies between peers which opted into the experimental
+// range. The fields of the ETXs which tend to repeat across cross-chain heavy
+// blocks are replaced by indices into a table shared by all bodies of the reply.
+type CompactBlockBodiesPacket struct {
+	Table  []rlp.RawValue     // Distinct encodings of the deduplicated ETX fields
+	Bodies []CompactBlockBody // Block bodies referencing the shared table
+}
+
+// CompactBlockBodiesPacket66 is the CompactBlockBodiesPacket over eth/66.
+type CompactBlockBodiesPacket66 struct {
+	RequestId uint64
+	CompactBlockBodiesPacket
+}
+
+// CompactBlockBody is a block body with its ETXs in compact form. All the other
+// fields are kept in their original encoding.
+type CompactBlockBody struct {
+	Transactions    rlp.RawValue
+	Uncles          rlp.RawValue
+	ExtTransactions []rlp.RawValue // ETX field lists with the table fields replaced by indices
+	SubManifest     rlp.RawValue
+}
+
+// CompactPooledTransactionHashesPacket is the experimental alternative to
+// NewPooledTransactionHashesPacket, announcing transactions by the prefixes of
+// their hashes. Prefixes the receiver can't resolve to a single hash it has seen
+// are resolved by the announcer through GetPooledTransactionHashes.
+type CompactPooledTransactionHashesPacket []TxHashPrefix
+
+// GetPooledTransactionHashesPacket is a query for the full hashes of the
+// transactions announced in compact form by the given prefixes.
+type GetPooledTransactionHashesPacket []TxHashPrefix
+
+// GetPooledTransactionHashesPacket66 is the GetPooledTransactionHashesPacket
+// over eth/66.
+type GetPooledTransactionHashesPacket66 struct {
+	RequestId uint64
+	GetPooledTransactionHashesPacket
+}
+
+// PooledTransactionHashesPacket is the network packet answering a
+// GetPooledTransactionHashes query with every announced hash matching one of
+// the requested prefixes.
+type PooledTransactionHashesPacket []common.Hash
+
+// PooledTransactionHashesPacket66 is the PooledTransactionHashesPacket over
+// eth/66.
+type PooledTransactionHashesPacket66 struct {
+	RequestId uint64
+	PooledTransactionHashesPacket
+}
+
+// GetCapabilitiesPacket represents a query for the current serving capabilities
+// of a remote node.
+type GetCapabilitiesPacket struct{}
+
+// GetCapabilitiesPacket66 is the eth/66 version of the GetCapabilitiesPacket.
+type GetCapabilitiesPacket66 struct {
+	RequestId uint64
+	GetCapabilitiesPacket
+}
+
+// CapabilitiesPacket is the network packet describing the data a node is
+// currently willing to serve.
+type CapabilitiesPacket struct {
+	Archive     bool     // Whether the entire historical state is retained
+	PrunedDepth uint64   // Number of recent blocks with state available, zero if archive
+	Messages    []uint64 // Message codes handled on the connection
+}
+
+// CapabilitiesPacket66 is the eth/66 version of the CapabilitiesPacket.
+type CapabilitiesPacket66 struct {
+	RequestId uint64
+	CapabilitiesPacket
+}
+
+// pendingEtxsVersion is the encoding version of PendingEtxsPacket produced by
+// this node on eth/67. Fields introduced by later versions are appended after
+// the known ones, so that older nodes can decode the packet and skip whatever
+// they don't understand. Earlier protocol versions use the legacy, unversioned
+// encoding.
+const pendingEtxsVersion = 1
+
+// PendingEtxsPacket is the network packet for the pending etxs propagation
+// message.
 type PendingEtxsPacket struct {
+	Version     uint // Encoding version, zero for the legacy unversioned encoding
 	PendingEtxs types.PendingEtxs
 }
 
+// legacyPendingEtxsPacket is the wire format of the PendingEtxsPacket spoken by
+// eth/65 and eth/66 nodes.
+type legacyPendingEtxsPacket struct {
+	PendingEtxs types.PendingEtxs
+}
+
+// extPendingEtxsPacket is the versioned wire format of the PendingEtxsPacket,
+// tolerating trailing fields added by newer versions.
+type extPendingEtxsPacket struct {
+	Version     uint
+	PendingEtxs types.PendingEtxs
+	Rest        []rlp.RawValue `rlp:"tail"`
+}
+
+// EncodeRLP serializes the packet, falling back to the legacy encoding if no
+// version was set.
+func (p *PendingEtxsPacket) EncodeRLP(w io.Writer) error {
+	if p.Version == 0 {
+		return rlp.Encode(w, &legacyPendingEtxsPacket{PendingEtxs: p.PendingEtxs})
+	}
+	return rlp.Encode(w, &extPendingEtxsPacket{
+		Version:     p.Version,
+		PendingEtxs: p.PendingEtxs,
+	})
+}
+
+// DecodeRLP deserializes the packet from either the legacy or the versioned
+// encoding, ignoring any unknown trailing fields of the latter.
+func (p *PendingEtxsPacket) DecodeRLP(s *rlp.Stream) error {
+	raw, err := s.Raw()
+	if err != nil {
+		return err
+	}
+	content, _, err := rlp.SplitList(raw)
+	if err != nil {
+		return err
+	}
+	// Legacy packets start with the pending etxs list, versioned ones with an integer
+	if kind, _, _, err := rlp.Split(content); err == nil && kind == rlp.List {
+		var lp legacyPendingEtxsPacket
+		if err := rlp.DecodeBytes(raw, &lp); err != nil {
+			return err
+		}
+		p.Version, p.PendingEtxs = 0, lp.PendingEtxs
+		return nil
+	}
+	var ep extPendingEtxsPacket
+	if err := rlp.DecodeBytes(raw, &ep); err != nil {
+		return err
+	}
+	if ep.Version == 0 {
+		return errors.New("missing pending etxs encoding version")
+	}
+	p.Version, p.PendingEtxs = ep.Version, ep.PendingEtxs
+	return nil
+}
+
 type PendingEtxsPacket66 struct {
 	RequestId uint64
 	PendingEtxsPacket
 }
 
+// EncodeRLP serializes the packet. It is needed to keep the request id on the
+// wire, as the encoder of the embedded PendingEtxsPacket would be promoted.
+func (p *PendingEtxsPacket66) EncodeRLP(w io.Writer) error {
+	return rlp.Encode(w, []interface{}{p.RequestId, &p.PendingEtxsPacket})
+}
+
+// DecodeRLP deserializes the packet, see EncodeRLP.
+func (p *PendingEtxsPacket66) DecodeRLP(s *rlp.Stream) error {
+	if _, err := s.List(); err != nil {
+		return err
+	}
+	if err := s.Decode(&p.RequestId); err != nil {
+		return err
+	}
+	if err := s.Decode(&p.PendingEtxsPacket); err != nil {
+		return err
+	}
+	return s.ListEnd()
+}
+
+// PendingEtxsRollupPacket is the network packet for the pending etxs rollup
+// propagation message. The manifest is encoded in chain order, which is the
+// canonical order committed to by the header's manifest hash.
 type PendingEtxsRollupPacket struct {
 	PendingEtxsRollup types.PendingEtxsRollup
 }
@@ -329,47 +1399,335 @@ type PendingEtxsRollupPacket66 struct {
 	PendingEtxsRollupPacket
 }
 
-func (*StatusPacket) Name() string { return "Status" }
-func (*StatusPacket) Kind() byte   { return StatusMsg }
+func (*StatusPacket) Name() string     { return "Status" }
+func (*StatusPacket) Kind() byte       { return StatusMsg }
+func (*StatusPacket) Role() PacketRole { return RoleHandshake }
+
+func (*NewBlockHashesPacket) Name() string     { return "NewBlockHashes" }
+func (*NewBlockHashesPacket) Kind() byte       { return NewBlockHashesMsg }
+func (*NewBlockHashesPacket) Role() PacketRole { return RoleBroadcast }
+
+func (*TransactionsPacket) Name() string     { return "Transactions" }
+func (*TransactionsPacket) Kind() byte       { return TransactionsMsg }
+func (*TransactionsPacket) Role() PacketRole { return RoleBroadcast }
+
+func (*GetBlockHeadersPacket) Name() string     { return "GetBlockHeaders" }
+func (*GetBlockHeadersPacket) Kind() byte       { return GetBlockHeadersMsg }
+func (*GetBlockHeadersPacket) Role() PacketRole { return RoleRequest }
+
+func (*BlockHeadersPacket) Name() string     { return "BlockHeaders" }
+func (*BlockHeadersPacket) Kind() byte       { return BlockHeadersMsg }
+func (*BlockHeadersPacket) Role() PacketRole { return RoleResponse }
+
+func (*GetBlockBodiesPacket) Name() string     { return "GetBlockBodies" }
+func (*GetBlockBodiesPacket) Kind() byte       { return GetBlockBodiesMsg }
+func (*GetBlockBodiesPacket) Role() PacketRole { return RoleRequest }
+
+func (*BlockBodiesPacket) Name() string     { return "BlockBodies" }
+func (*BlockBodiesPacket) Kind() byte       { return BlockBodiesMsg }
+func (*BlockBodiesPacket) Role() PacketRole { return RoleResponse }
 
-func (*NewBlockHashesPacket) Name() string { return "NewBlockHashes" }
-func (*NewBlockHashesPacket) Kind() byte   { return NewBlockHashesMsg }
+func (*NewBlockPacket) Name() string     { return "NewBlock" }
+func (*NewBlockPacket) Kind() byte       { return NewBlockMsg }
+func (*NewBlockPacket) Role() PacketRole { return RoleBroadcast }
 
-func (*TransactionsPacket) Name() string { return "Transactions" }
-func (*TransactionsPacket) Kind() byte   { return TransactionsMsg }
+func (*NewPooledTransactionHashesPacket) Name() string     { return "NewPooledTransactionHashes" }
+func (*NewPooledTransactionHashesPacket) Kind() byte       { return NewPooledTransactionHashesMsg }
+func (*NewPooledTransactionHashesPacket) Role() PacketRole { return RoleBroadcast }
 
-func (*GetBlockHeadersPacket) Name() string { return "GetBlockHeaders" }
-func (*GetBlockHeadersPacket) Kind() byte   { return GetBlockHeadersMsg }
+func (*GetPooledTransactionsPacket) Name() string     { return "GetPooledTransactions" }
+func (*GetPooledTransactionsPacket) Kind() byte       { return GetPooledTransactionsMsg }
+func (*GetPooledTransactionsPacket) Role() PacketRole { return RoleRequest }
 
-func (*BlockHeadersPacket) Name() string { return "BlockHeaders" }
-func (*BlockHeadersPacket) Kind() byte   { return BlockHeadersMsg }
+func (*PooledTransactionsPacket) Name() string     { return "PooledTransactions" }
+func (*PooledTransactionsPacket) Kind() byte       { return PooledTransactionsMsg }
+func (*PooledTransactionsPacket) Role() PacketRole { return RoleResponse }
 
-func (*GetBlockBodiesPacket) Name() string { return "GetBlockBodies" }
-func (*GetBlockBodiesPacket) Kind() byte   { return GetBlockBodiesMsg }
+func (*GetBlockPacket) Name() string     { return "GetBlock" }
+func (*GetBlockPacket) Kind() byte       { return GetBlockMsg }
+func (*GetBlockPacket) Role() PacketRole { return RoleRequest }
 
-func (*BlockBodiesPacket) Name() string { return "BlockBodies" }
-func (*BlockBodiesPacket) Kind() byte   { return BlockBodiesMsg }
+func (*GetOnePendingEtxsPacket) Name() string     { return "GetOnePendingEtxs" }
+func (*GetOnePendingEtxsPacket) Kind() byte       { return GetOnePendingEtxsMsg }
+func (*GetOnePendingEtxsPacket) Role() PacketRole { return RoleRequest }
 
-func (*NewBlockPacket) Name() string { return "NewBlock" }
-func (*NewBlockPacket) Kind() byte   { return NewBlockMsg }
+// The pending ETXs are pushed unsolicited, and only answer the GetOnePendingEtxs
+// queries without a request id, so both of them are handled as broadcasts.
+func (*PendingEtxsPacket) Name() string     { return "PendingEtxs" }
+func (*PendingEtxsPacket) Kind() byte       { return PendingEtxsMsg }
+func (*PendingEtxsPacket) Role() PacketRole { return RoleBroadcast }
 
-func (*NewPooledTransactionHashesPacket) Name() string { return "NewPooledTransactionHashes" }
-func (*NewPooledTransactionHashesPacket) Kind() byte   { return NewPooledTransactionHashesMsg }
+func (*PendingEtxsRollupPacket) Name() string     { return "PendingEtxsManifest" }
+func (*PendingEtxsRollupPacket) Kind() byte       { return PendingEtxsRollupMsg }
+func (*PendingEtxsRollupPacket) Role() PacketRole { return RoleBroadcast }
 
-func (*GetPooledTransactionsPacket) Name() string { return "GetPooledTransactions" }
-func (*GetPooledTransactionsPacket) Kind() byte   { return GetPooledTransactionsMsg }
+func (*GetOnePendingEtxsRollupPacket) Name() string     { return "GetOnePendingEtxsRollup" }
+func (*GetOnePendingEtxsRollupPacket) Kind() byte       { return GetOnePendingEtxsRollupMsg }
+func (*GetOnePendingEtxsRollupPacket) Role() PacketRole { return RoleRequest }
 
-func (*PooledTransactionsPacket) Name() string { return "PooledTransactions" }
-func (*PooledTransactionsPacket) Kind() byte   { return PooledTransactionsMsg }
+func (*GetBlockTxHashesPacket) Name() string     { return "GetBlockTxHashes" }
+func (*GetBlockTxHashesPacket) Kind() byte       { return GetBlockTxHashesMsg }
+func (*GetBlockTxHashesPacket) Role() PacketRole { return RoleRequest }
 
-func (*GetBlockPacket) Name() string { return "GetBlock" }
-func (*GetBlockPacket) Kind() byte   { return GetBlockMsg }
+func (*BlockTxHashesPacket) Name() string     { return "BlockTxHashes" }
+func (*BlockTxHashesPacket) Kind() byte       { return BlockTxHashesMsg }
+func (*BlockTxHashesPacket) Role() PacketRole { return RoleResponse }
 
-func (*GetOnePendingEtxsPacket) Name() string { return "GetOnePendingEtxs" }
-func (*GetOnePendingEtxsPacket) Kind() byte   { return GetOnePendingEtxsMsg }
+func (*GetHeadPacket) Name() string     { return "GetHead" }
+func (*GetHeadPacket) Kind() byte       { return GetHeadMsg }
+func (*GetHeadPacket) Role() PacketRole { return RoleRequest }
 
-func (*PendingEtxsPacket) Name() string { return "PendingEtxs" }
-func (*PendingEtxsPacket) Kind() byte   { return PendingEtxsMsg }
+func (*HeadPacket) Name() string     { return "Head" }
+func (*HeadPacket) Kind() byte       { return HeadMsg }
+func (*HeadPacket) Role() PacketRole { return RoleResponse }
 
-func (*PendingEtxsRollupPacket) Name() string { return "PendingEtxsManifest" }
-func (*PendingEtxsRollupPacket) Kind() byte   { return PendingEtxsRollupMsg }
+func (*GetCapabilitiesPacket) Name() string     { return "GetCapabilities" }
+func (*GetCapabilitiesPacket) Kind() byte       { return GetCapabilitiesMsg }
+func (*GetCapabilitiesPacket) Role() PacketRole { return RoleRequest }
+
+func (*CapabilitiesPacket) Name() string     { return "Capabilities" }
+func (*CapabilitiesPacket) Kind() byte       { return CapabilitiesMsg }
+func (*CapabilitiesPacket) Role() PacketRole { return RoleResponse }
+
+func (*GetHeadersByNumbersPacket) Name() string     { return "GetHeadersByNumbers" }
+func (*GetHeadersByNumbersPacket) Kind() byte       { return GetHeadersByNumbersMsg }
+func (*GetHeadersByNumbersPacket) Role() PacketRole { return RoleRequest }
+
+func (*HeadersByNumbersPacket) Name() string     { return "HeadersByNumbers" }
+func (*HeadersByNumbersPacket) Kind() byte       { return HeadersByNumbersMsg }
+func (*HeadersByNumbersPacket) Role() PacketRole { return RoleResponse }
+
+func (*HaveBlockPacket) Name() string     { return "HaveBlock" }
+func (*HaveBlockPacket) Kind() byte       { return HaveBlockMsg }
+func (*HaveBlockPacket) Role() PacketRole { return RoleRequest }
+
+func (*HaveBlockReplyPacket) Name() string     { return "HaveBlockReply" }
+func (*HaveBlockReplyPacket) Kind() byte       { return HaveBlockReplyMsg }
+func (*HaveBlockReplyPacket) Role() PacketRole { return RoleResponse }
+
+func (*GetPendingEtxsByLocationPacket) Name() string     { return "GetPendingEtxsByLocation" }
+func (*GetPendingEtxsByLocationPacket) Kind() byte       { return GetPendingEtxsByLocationMsg }
+func (*GetPendingEtxsByLocationPacket) Role() PacketRole { return RoleRequest }
+
+func (*PendingEtxsByLocationPacket) Name() string     { return "PendingEtxsByLocation" }
+func (*PendingEtxsByLocationPacket) Kind() byte       { return PendingEtxsByLocationMsg }
+func (*PendingEtxsByLocationPacket) Role() PacketRole { return RoleResponse }
+
+func (*GetBlockEtxRootsPacket) Name() string     { return "GetBlockEtxRoots" }
+func (*GetBlockEtxRootsPacket) Kind() byte       { return GetBlockEtxRootsMsg }
+func (*GetBlockEtxRootsPacket) Role() PacketRole { return RoleRequest }
+
+func (*BlockEtxRootsPacket) Name() string     { return "BlockEtxRoots" }
+func (*BlockEtxRootsPacket) Kind() byte       { return BlockEtxRootsMsg }
+func (*BlockEtxRootsPacket) Role() PacketRole { return RoleResponse }
+
+func (*GetFreshBlockBodiesPacket) Name() string     { return "GetFreshBlockBodies" }
+func (*GetFreshBlockBodiesPacket) Kind() byte       { return GetFreshBlockBodiesMsg }
+func (*GetFreshBlockBodiesPacket) Role() PacketRole { return RoleRequest }
+
+func (*FreshBlockBodiesPacket) Name() string     { return "FreshBlockBodies" }
+func (*FreshBlockBodiesPacket) Kind() byte       { return FreshBlockBodiesMsg }
+func (*FreshBlockBodiesPacket) Role() PacketRole { return RoleResponse }
+
+func (*GetBlockMinersPacket) Name() string     { return "GetBlockMiners" }
+func (*GetBlockMinersPacket) Kind() byte       { return GetBlockMinersMsg }
+func (*GetBlockMinersPacket) Role() PacketRole { return RoleRequest }
+
+func (*BlockMinersPacket) Name() string     { return "BlockMiners" }
+func (*BlockMinersPacket) Kind() byte       { return BlockMinersMsg }
+func (*BlockMinersPacket) Role() PacketRole { return RoleResponse }
+
+func (*GetUnclesByRangePacket) Name() string     { return "GetUnclesByRange" }
+func (*GetUnclesByRangePacket) Kind() byte       { return GetUnclesByRangeMsg }
+func (*GetUnclesByRangePacket) Role() PacketRole { return RoleRequest }
+
+func (*UnclesByRangePacket) Name() string     { return "UnclesByRange" }
+func (*UnclesByRangePacket) Kind() byte       { return UnclesByRangeMsg }
+func (*UnclesByRangePacket) Role() PacketRole { return RoleResponse }
+
+func (*GetBlockDataPacket) Name() string     { return "GetBlockData" }
+func (*GetBlockDataPacket) Kind() byte       { return GetBlockDataMsg }
+func (*GetBlockDataPacket) Role() PacketRole { return RoleRequest }
+
+func (*BlockDataPacket) Name() string     { return "BlockData" }
+func (*BlockDataPacket) Kind() byte       { return BlockDataMsg }
+func (*BlockDataPacket) Role() PacketRole { return RoleResponse }
+
+func (*GetBlockByNumberPacket) Name() string     { return "GetBlockByNumber" }
+func (*GetBlockByNumberPacket) Kind() byte       { return GetBlockByNumberMsg }
+func (*GetBlockByNumberPacket) Role() PacketRole { return RoleRequest }
+
+func (*BlockByNumberPacket) Name() string     { return "BlockByNumber" }
+func (*BlockByNumberPacket) Kind() byte       { return BlockByNumberMsg }
+func (*BlockByNumberPacket) Role() PacketRole { return RoleResponse }
+
+func (*StatusDeltaPacket) Name() string     { return "StatusDelta" }
+func (*StatusDeltaPacket) Kind() byte       { return StatusDeltaMsg }
+func (*StatusDeltaPacket) Role() PacketRole { return RoleBroadcast }
+
+func (*GetEtxManifestProofPacket) Name() string     { return "GetEtxManifestProof" }
+func (*GetEtxManifestProofPacket) Kind() byte       { return GetEtxManifestProofMsg }
+func (*GetEtxManifestProofPacket) Role() PacketRole { return RoleRequest }
+
+func (*EtxManifestProofPacket) Name() string     { return "EtxManifestProof" }
+func (*EtxManifestProofPacket) Kind() byte       { return EtxManifestProofMsg }
+func (*EtxManifestProofPacket) Role() PacketRole { return RoleResponse }
+
+func (*GetCanonicalHashPacket) Name() string     { return "GetCanonicalHash" }
+func (*GetCanonicalHashPacket) Kind() byte       { return GetCanonicalHashMsg }
+func (*GetCanonicalHashPacket) Role() PacketRole { return RoleRequest }
+
+func (*CanonicalHashPacket) Name() string     { return "CanonicalHash" }
+func (*CanonicalHashPacket) Kind() byte       { return CanonicalHashMsg }
+func (*CanonicalHashPacket) Role() PacketRole { return RoleResponse }
+
+func (*GetPendingEtxsSincePacket) Name() string     { return "GetPendingEtxsSince" }
+func (*GetPendingEtxsSincePacket) Kind() byte       { return GetPendingEtxsSinceMsg }
+func (*GetPendingEtxsSincePacket) Role() PacketRole { return RoleRequest }
+
+func (*PendingEtxsSincePacket) Name() string     { return "PendingEtxsSince" }
+func (*PendingEtxsSincePacket) Kind() byte       { return PendingEtxsSinceMsg }
+func (*PendingEtxsSincePacket) Role() PacketRole { return RoleResponse }
+
+func (*GetPartialBodiesPacket) Name() string     { return "GetPartialBodies" }
+func (*GetPartialBodiesPacket) Kind() byte       { return GetPartialBodiesMsg }
+func (*GetPartialBodiesPacket) Role() PacketRole { return RoleRequest }
+
+func (*PartialBodiesPacket) Name() string     { return "PartialBodies" }
+func (*PartialBodiesPacket) Kind() byte       { return PartialBodiesMsg }
+func (*PartialBodiesPacket) Role() PacketRole { return RoleResponse }
+
+func (*GetEtxRollupsByRangePacket) Name() string     { return "GetEtxRollupsByRange" }
+func (*GetEtxRollupsByRangePacket) Kind() byte       { return GetEtxRollupsByRangeMsg }
+func (*GetEtxRollupsByRangePacket) Role() PacketRole { return RoleRequest }
+
+func (*EtxRollupsByRangePacket) Name() string     { return "EtxRollupsByRange" }
+func (*EtxRollupsByRangePacket) Kind() byte       { return EtxRollupsByRangeMsg }
+func (*EtxRollupsByRangePacket) Role() PacketRole { return RoleResponse }
+
+func (*GetPoolSnapshotPacket) Name() string     { return "GetPoolSnapshot" }
+func (*GetPoolSnapshotPacket) Kind() byte       { return GetPoolSnapshotMsg }
+func (*GetPoolSnapshotPacket) Role() PacketRole { return RoleRequest }
+
+func (*PoolSnapshotPacket) Name() string     { return "PoolSnapshot" }
+func (*PoolSnapshotPacket) Kind() byte       { return PoolSnapshotMsg }
+func (*PoolSnapshotPacket) Role() PacketRole { return RoleResponse }
+
+func (*GetHeadersByMinerPacket) Name() string     { return "GetHeadersByMiner" }
+func (*GetHeadersByMinerPacket) Kind() byte       { return GetHeadersByMinerMsg }
+func (*GetHeadersByMinerPacket) Role() PacketRole { return RoleRequest }
+
+func (*HeadersByMinerPacket) Name() string     { return "HeadersByMiner" }
+func (*HeadersByMinerPacket) Kind() byte       { return HeadersByMinerMsg }
+func (*HeadersByMinerPacket) Role() PacketRole { return RoleResponse }
+
+func (*GetTxNonInclusionProofPacket) Name() string     { return "GetTxNonInclusionProof" }
+func (*GetTxNonInclusionProofPacket) Kind() byte       { return GetTxNonInclusionProofMsg }
+func (*GetTxNonInclusionProofPacket) Role() PacketRole { return RoleRequest }
+
+func (*TxNonInclusionProofPacket) Name() string     { return "TxNonInclusionProof" }
+func (*TxNonInclusionProofPacket) Kind() byte       { return TxNonInclusionProofMsg }
+func (*TxNonInclusionProofPacket) Role() PacketRole { return RoleResponse }
+
+func (*GetUnclePoolPacket) Name() string     { return "GetUnclePool" }
+func (*GetUnclePoolPacket) Kind() byte       { return GetUnclePoolMsg }
+func (*GetUnclePoolPacket) Role() PacketRole { return RoleRequest }
+
+func (*UnclePoolPacket) Name() string     { return "UnclePool" }
+func (*UnclePoolPacket) Kind() byte       { return UnclePoolMsg }
+func (*UnclePoolPacket) Role() PacketRole { return RoleResponse }
+
+func (*CompactBlockBodiesPacket) Name() string     { return "CompactBlockBodies" }
+func (*CompactBlockBodiesPacket) Kind() byte       { return CompactBlockBodiesMsg }
+func (*CompactBlockBodiesPacket) Role() PacketRole { return RoleResponse }
+
+func (*CompactPooledTransactionHashesPacket) Name() string     { return "CompactPooledTransactionHashes" }
+func (*CompactPooledTransactionHashesPacket) Kind() byte       { return CompactPooledTransactionHashesMsg }
+func (*CompactPooledTransactionHashesPacket) Role() PacketRole { return RoleBroadcast }
+
+func (*GetPooledTransactionHashesPacket) Name() string     { return "GetPooledTransactionHashes" }
+func (*GetPooledTransactionHashesPacket) Kind() byte       { return GetPooledTransactionHashesMsg }
+func (*GetPooledTransactionHashesPacket) Role() PacketRole { return RoleRequest }
+
+func (*PooledTransactionHashesPacket) Name() string     { return "PooledTransactionHashes" }
+func (*PooledTransactionHashesPacket) Kind() byte       { return PooledTransactionHashesMsg }
+func (*PooledTransactionHashesPacket) Role() PacketRole { return RoleResponse }
+
+// MessageRole looks up the part played in the protocol by the message with the
+// given code, reporting false for unknown codes.
+func MessageRole(code uint64) (PacketRole, bool) {
+	for _, packet := range packets {
+		if uint64(packet.Kind()) == code {
+			return packet.Role(), true
+		}
+	}
+	return 0, false
+}
+
+// packets contains an instance of every packet type of the protocol, allowing to
+// look up message metadata by code.
+var packets = []Packet{
+	new(StatusPacket),
+	new(NewBlockHashesPacket),
+	new(TransactionsPacket),
+	new(GetBlockHeadersPacket),
+	new(BlockHeadersPacket),
+	new(GetBlockBodiesPacket),
+	new(BlockBodiesPacket),
+	new(NewBlockPacket),
+	new(NewPooledTransactionHashesPacket),
+	new(GetPooledTransactionsPacket),
+	new(PooledTransactionsPacket),
+	new(GetBlockPacket),
+	new(GetOnePendingEtxsPacket),
+	new(PendingEtxsPacket),
+	new(PendingEtxsRollupPacket),
+	new(GetOnePendingEtxsRollupPacket),
+	new(GetBlockTxHashesPacket),
+	new(BlockTxHashesPacket),
+	new(GetHeadPacket),
+	new(HeadPacket),
+	new(GetCapabilitiesPacket),
+	new(CapabilitiesPacket),
+	new(GetHeadersByNumbersPacket),
+	new(HeadersByNumbersPacket),
+	new(HaveBlockPacket),
+	new(HaveBlockReplyPacket),
+	new(GetPendingEtxsByLocationPacket),
+	new(PendingEtxsByLocationPacket),
+	new(GetBlockEtxRootsPacket),
+	new(BlockEtxRootsPacket),
+	new(GetFreshBlockBodiesPacket),
+	new(FreshBlockBodiesPacket),
+	new(GetBlockMinersPacket),
+	new(BlockMinersPacket),
+	new(GetUnclesByRangePacket),
+	new(UnclesByRangePacket),
+	new(GetBlockDataPacket),
+	new(BlockDataPacket),
+	new(GetBlockByNumberPacket),
+	new(BlockByNumberPacket),
+	new(StatusDeltaPacket),
+	new(GetEtxManifestProofPacket),
+	new(EtxManifestProofPacket),
+	new(GetCanonicalHashPacket),
+	new(CanonicalHashPacket),
+	new(GetPendingEtxsSincePacket),
+	new(PendingEtxsSincePacket),
+	new(GetPartialBodiesPacket),
+	new(PartialBodiesPacket),
+	new(GetEtxRollupsByRangePacket),
+	new(EtxRollupsByRangePacket),
+	new(GetPoolSnapshotPacket),
+	new(PoolSnapshotPacket),
+	new(GetHeadersByMinerPacket),
+	new(HeadersByMinerPacket),
+	new(GetTxNonInclusionProofPacket),
+	new(TxNonInclusionProofPacket),
+	new(GetUnclePoolPacket),
+	new(UnclePoolPacket),
+	new(CompactBlockBodiesPacket),
+	new(CompactPooledTransactionHashesPacket),
+	new(GetPooledTransactionHashesPacket),
+	new(PooledTransactionHashesPacket),
+}
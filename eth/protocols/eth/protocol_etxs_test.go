@@ -0,0 +1,239 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/rlp"
+	"github.com/dominant-strategies/go-quai/trie"
+)
+
+// futurePendingEtxsPacket simulates a later revision of the PendingEtxsPacket
+// which appended an extra field to the wire format.
+type futurePendingEtxsPacket struct {
+	Version     uint
+	PendingEtxs types.PendingEtxs
+	Extra       []byte `rlp:"optional"`
+}
+
+func newTestPendingEtxs() types.PendingEtxs {
+	header := types.EmptyHeader()
+	header.SetNumber(big.NewInt(1))
+	return types.PendingEtxs{Header: header, Etxs: newTestTransactions(2)}
+}
+
+// Tests that a versioned pending etxs packet round-trips.
+func TestPendingEtxsPacketEncoding(t *testing.T) {
+	etxs := newTestPendingEtxs()
+
+	enc, err := rlp.EncodeToBytes(&PendingEtxsPacket{Version: pendingEtxsVersion, PendingEtxs: etxs})
+	if err != nil {
+		t.Fatalf("failed to encode packet: %v", err)
+	}
+	var packet PendingEtxsPacket
+	if err := rlp.DecodeBytes(enc, &packet); err != nil {
+		t.Fatalf("failed to decode packet: %v", err)
+	}
+	if packet.Version != pendingEtxsVersion {
+		t.Errorf("version mismatch: have %d, want %d", packet.Version, pendingEtxsVersion)
+	}
+	checkPendingEtxs(t, packet.PendingEtxs, etxs)
+}
+
+// Tests that a packet produced by a newer node carrying unknown trailing fields
+// is decoded by the current version, ignoring the extras.
+func TestPendingEtxsPacketForwardCompat(t *testing.T) {
+	etxs := newTestPendingEtxs()
+
+	enc, err := rlp.EncodeToBytes(&futurePendingEtxsPacket{
+		Version:     pendingEtxsVersion + 1,
+		PendingEtxs: etxs,
+		Extra:       []byte{0xde, 0xad},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode packet: %v", err)
+	}
+	var packet PendingEtxsPacket
+	if err := rlp.DecodeBytes(enc, &packet); err != nil {
+		t.Fatalf("failed to decode newer packet: %v", err)
+	}
+	if packet.Version != pendingEtxsVersion+1 {
+		t.Errorf("version mismatch: have %d, want %d", packet.Version, pendingEtxsVersion+1)
+	}
+	checkPendingEtxs(t, packet.PendingEtxs, etxs)
+}
+
+// Tests that a packet produced by the current version is decoded by a newer
+// node, which treats the fields it introduced as absent.
+func TestPendingEtxsPacketBackwardCompat(t *testing.T) {
+	etxs := newTestPendingEtxs()
+
+	enc, err := rlp.EncodeToBytes(&PendingEtxsPacket{Version: pendingEtxsVersion, PendingEtxs: etxs})
+	if err != nil {
+		t.Fatalf("failed to encode packet: %v", err)
+	}
+	var packet futurePendingEtxsPacket
+	if err := rlp.DecodeBytes(enc, &packet); err != nil {
+		t.Fatalf("failed to decode older packet: %v", err)
+	}
+	if packet.Version != pendingEtxsVersion {
+		t.Errorf("version mismatch: have %d, want %d", packet.Version, pendingEtxsVersion)
+	}
+	if packet.Extra != nil {
+		t.Errorf("unexpected extra field: %x", packet.Extra)
+	}
+	checkPendingEtxs(t, packet.PendingEtxs, etxs)
+}
+
+// Tests that unversioned packets use the legacy encoding of eth/65 and eth/66,
+// which both the legacy nodes and the current version can decode.
+func TestPendingEtxsPacketLegacy(t *testing.T) {
+	etxs := newTestPendingEtxs()
+
+	// Packets without a version must be readable by the legacy nodes
+	enc, err := rlp.EncodeToBytes(&PendingEtxsPacket{PendingEtxs: etxs})
+	if err != nil {
+		t.Fatalf("failed to encode packet: %v", err)
+	}
+	var legacy struct {
+		PendingEtxs types.PendingEtxs
+	}
+	if err := rlp.DecodeBytes(enc, &legacy); err != nil {
+		t.Fatalf("legacy node failed to decode packet: %v", err)
+	}
+	checkPendingEtxs(t, legacy.PendingEtxs, etxs)
+
+	// Packets sent by the legacy nodes must be readable by the current version
+	if enc, err = rlp.EncodeToBytes(&legacy); err != nil {
+		t.Fatalf("failed to encode legacy packet: %v", err)
+	}
+	var packet PendingEtxsPacket
+	if err := rlp.DecodeBytes(enc, &packet); err != nil {
+		t.Fatalf("failed to decode legacy packet: %v", err)
+	}
+	if packet.Version != 0 {
+		t.Errorf("version mismatch: have %d, want 0", packet.Version)
+	}
+	checkPendingEtxs(t, packet.PendingEtxs, etxs)
+}
+
+// Tests that peers are sent the versioned pending etxs encoding only from eth/67.
+func TestSendPendingEtxsVersion(t *testing.T) {
+	etxs := newTestPendingEtxs()
+
+	tests := []struct {
+		version uint
+		want    uint
+	}{
+		{ETH65, 0},
+		{ETH66, 0},
+		{ETH67, pendingEtxsVersion},
+	}
+	for _, tt := range tests {
+		app, net := p2p.MsgPipe()
+		peer := NewPeer(tt.version, p2p.NewPeer(enode.ID{0xf4, byte(tt.version)}, "peer", nil), app, nil)
+
+		errc := make(chan error, 1)
+		go func() { errc <- peer.SendPendingEtxs(etxs) }()
+
+		msg, err := net.ReadMsg()
+		if err != nil {
+			t.Fatalf("eth/%d: failed to read message: %v", tt.version, err)
+		}
+		var packet PendingEtxsPacket
+		if err := msg.Decode(&packet); err != nil {
+			t.Fatalf("eth/%d: failed to decode packet: %v", tt.version, err)
+		}
+		if packet.Version != tt.want {
+			t.Errorf("eth/%d: version mismatch: have %d, want %d", tt.version, packet.Version, tt.want)
+		}
+		checkPendingEtxs(t, packet.PendingEtxs, etxs)
+		if err := <-errc; err != nil {
+			t.Errorf("eth/%d: failed to send packet: %v", tt.version, err)
+		}
+		peer.Close()
+		app.Close()
+	}
+}
+
+func checkPendingEtxs(t *testing.T, have, want types.PendingEtxs) {
+	t.Helper()
+
+	if have.Header.Hash() != want.Header.Hash() {
+		t.Errorf("header mismatch: have %x, want %x", have.Header.Hash(), want.Header.Hash())
+	}
+	if len(have.Etxs) != len(want.Etxs) {
+		t.Fatalf("etx count mismatch: have %d, want %d", len(have.Etxs), len(want.Etxs))
+	}
+	for i := range have.Etxs {
+		if have.Etxs[i].Hash() != want.Etxs[i].Hash() {
+			t.Errorf("etx %d mismatch: have %x, want %x", i, have.Etxs[i].Hash(), want.Etxs[i].Hash())
+		}
+	}
+}
+
+// Tests that a pending etxs rollup is only accepted with its manifest in the
+// canonical order committed to by the header.
+func TestPendingEtxsRollupOrdering(t *testing.T) {
+	manifest := types.BlockManifest{{0x01}, {0x02}, {0x03}}
+
+	header := types.EmptyHeader()
+	header.SetManifestHash(types.DeriveSha(manifest, trie.NewStackTrie(nil)), common.ZONE_CTX)
+
+	shuffled := types.BlockManifest{manifest[2], manifest[0], manifest[1]}
+	tests := []struct {
+		manifest types.BlockManifest
+		err      error
+	}{
+		{manifest, nil},
+		{shuffled, errInvalidRollup},
+		{manifest[:2], errInvalidRollup},
+	}
+	for i, tt := range tests {
+		packet := &PendingEtxsRollupPacket{
+			PendingEtxsRollup: types.PendingEtxsRollup{Header: header, Manifest: tt.manifest},
+		}
+		// The encoding must be deterministic for identical rollups
+		enc1, err := rlp.EncodeToBytes(packet)
+		if err != nil {
+			t.Fatalf("test %d: failed to encode packet: %v", i, err)
+		}
+		enc2, _ := rlp.EncodeToBytes(packet)
+		if !bytes.Equal(enc1, enc2) {
+			t.Errorf("test %d: non-deterministic encoding", i)
+		}
+		backend := new(mockBackend)
+		peer := NewPeer(ETH66, p2p.NewPeer(enode.ID{byte(i)}, "peer", nil), nil, nil)
+
+		msg := p2p.Msg{Code: PendingEtxsRollupMsg, Size: uint32(len(enc1)), Payload: bytes.NewReader(enc1)}
+		if err := handlePendingEtxsRollup(backend, msg, peer); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if delivered := len(backend.handled) == 1; delivered != (tt.err == nil) {
+			t.Errorf("test %d: delivery mismatch: have %v, want %v", i, delivered, tt.err == nil)
+		}
+		peer.Close()
+	}
+}
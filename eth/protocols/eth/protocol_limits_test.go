@@ -0,0 +1,211 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/big"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// listHeader creates an RLP list header claiming the given payload size,
+// regardless of how much data actually follows.
+func listHeader(size uint64) []byte {
+	if size < 56 {
+		return []byte{0xc0 + byte(size)}
+	}
+	enc := make([]byte, 8)
+	binary.BigEndian.PutUint64(enc, size)
+	enc = bytes.TrimLeft(enc, "\x00")
+	return append([]byte{0xf7 + byte(len(enc))}, enc...)
+}
+
+// Tests that slice-typed packets with a lying length prefix are rejected based
+// on the actual message size, without allocating for the claimed length.
+func TestInflatedLengthPrefix(t *testing.T) {
+	// A short but valid element list, claimed to span 2GB
+	items, _ := rlp.EncodeToBytes([]uint64{1, 2, 3})
+	items = items[1:] // strip the honest list header
+
+	inflated := append(listHeader(1<<31), items...)
+
+	tests := []struct {
+		name   string
+		packet interface{}
+	}{
+		{"BlockHeaders", new(BlockHeadersPacket66)},
+		{"GetBlockBodies", new(GetBlockBodiesPacket66)},
+		{"BlockBodies", new(BlockBodiesPacket66)},
+		{"BlockTxHashes", new(BlockTxHashesPacket66)},
+		{"GetPooledTransactions", new(GetPooledTransactionsPacket66)},
+		{"PooledTransactions", new(PooledTransactionsPacket66)},
+	}
+	for _, tt := range tests {
+		// Wrap the inflated list into an honest request envelope, and also send
+		// it with the envelope itself inflated
+		id, _ := rlp.EncodeToBytes(uint64(1))
+		content := append(id, inflated...)
+
+		payloads := [][]byte{
+			append(listHeader(uint64(len(content))), content...),
+			append(listHeader(1<<31), content...),
+		}
+		for i, payload := range payloads {
+			msg := p2p.Msg{Size: uint32(len(payload)), Payload: bytes.NewReader(payload)}
+
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			err := msg.Decode(tt.packet)
+			runtime.ReadMemStats(&after)
+
+			if err == nil {
+				t.Errorf("%s/%d: inflated packet decoded", tt.name, i)
+			}
+			if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1024*1024 {
+				t.Errorf("%s/%d: oversized allocation: %d bytes", tt.name, i, alloc)
+			}
+		}
+	}
+}
+
+// Tests that propagated blocks carrying more transaction gas than their gas limit
+// could ever accommodate are rejected by the sanity check.
+func TestNewBlockGasSanityCheck(t *testing.T) {
+	newTx := func(gas uint64) *types.Transaction {
+		return types.NewTx(&types.InternalTx{
+			ChainID:   big.NewInt(1),
+			GasTipCap: big.NewInt(1),
+			GasFeeCap: big.NewInt(1),
+			Gas:       gas,
+			To:        &common.Address{},
+			Value:     big.NewInt(1),
+			V:         new(big.Int),
+			R:         new(big.Int),
+			S:         new(big.Int),
+		})
+	}
+	// Plain transfers spend their full 21000 gas allowance intrinsically
+	txs := []*types.Transaction{newTx(21000), newTx(21000), newTx(21000)}
+	huge := newTx(1_000_000)
+
+	tests := []struct {
+		limit uint64
+		used  uint64
+		txs   []*types.Transaction
+		err   error
+	}{
+		{42000, 0, nil, nil},                                             // Empty block
+		{63000, 63000, txs, nil},                                         // Exactly at the limit
+		{100000, 63000, txs, nil},                                        // Within the limit
+		{42000, 63000, nil, errGasLimitExceeded},                         // Usage above the limit
+		{42000, 42000, txs, errGasLimitExceeded},                         // Intrinsic gas above the limit
+		{100000, 21000, []*types.Transaction{huge}, errGasLimitExceeded}, // Single tx above the limit
+	}
+	for i, tt := range tests {
+		header := types.EmptyHeader()
+		header.SetNumber(big.NewInt(1))
+		header.SetGasLimit(tt.limit)
+		header.SetGasUsed(tt.used)
+
+		packet := &NewBlockPacket{Block: types.NewBlockWithHeader(header).WithBody(tt.txs, nil, nil, nil)}
+		if err := packet.sanityCheck(); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+// Tests that block announcements without a block are rejected as undecodable
+// instead of crashing the handler.
+func TestNewBlockMissingBlock(t *testing.T) {
+	for i, packet := range []*NewBlockPacket{{}, {Block: new(types.Block)}} {
+		if err := packet.sanityCheck(); !errors.Is(err, errDecode) {
+			t.Errorf("packet %d: error mismatch: have %v, want %v", i, err, errDecode)
+		}
+	}
+	// An empty announcement, and one carrying an empty block
+	for i, payload := range [][]byte{{0xc0}, {0xc1, 0xc0}} {
+		msg := p2p.Msg{Code: NewBlockMsg, Size: uint32(len(payload)), Payload: bytes.NewReader(payload)}
+		if err := handleNewBlock(nil, msg, nil); !errors.Is(err, errDecode) {
+			t.Errorf("payload %d: error mismatch: have %v, want %v", i, err, errDecode)
+		}
+	}
+}
+
+// Tests that blocks stamped within the allowed drift ahead of the local clock are
+// accepted, while ones further in the future are rejected before reaching the
+// backend.
+func TestBlockTimeDrift(t *testing.T) {
+	newBlock := func(timestamp uint64) *types.Block {
+		header := types.EmptyHeader()
+		header.SetNumber(big.NewInt(1))
+		header.SetGasLimit(21000)
+		header.SetTime(timestamp)
+		return types.NewBlockWithHeader(header)
+	}
+	now := time.Unix(1_700_000_000, 0)
+
+	tests := []struct {
+		timestamp uint64
+		err       error
+	}{
+		{0, nil},                       // Ancient block
+		{uint64(now.Unix()) - 10, nil}, // Recent block
+		{uint64(now.Unix()) + 30, nil}, // Slightly ahead, within the drift
+		{uint64(now.Unix()) + 60, nil}, // Exactly at the drift
+		{uint64(now.Unix()) + 61, errFutureTimestamp},
+		{uint64(now.Unix()) + 3600, errFutureTimestamp},
+		{math.MaxUint64, errFutureTimestamp},
+	}
+	for i, tt := range tests {
+		if err := checkBlockTime(newBlock(tt.timestamp), now, time.Minute); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+	// Far future announcements drop the sender before the block is handled
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		backend = new(mockBackend)
+		peer    = NewPeer(ETH66, p2p.NewPeer(enode.ID{0xe8, 0x01}, "peer", nil), net, nil)
+	)
+	defer peer.Close()
+
+	future := encodeMsg(t, NewBlockMsg, &NewBlockPacket{Block: newBlock(uint64(time.Now().Add(time.Hour).Unix()))})
+	if err := handleNewBlock(backend, future, peer); !errors.Is(err, errFutureTimestamp) {
+		t.Errorf("announcement error mismatch: have %v, want %v", err, errFutureTimestamp)
+	}
+	if len(backend.handled) != 0 {
+		t.Errorf("far future block handled")
+	}
+	// Blocks are not checked with the bound disabled
+	if err := checkBlockTime(newBlock(math.MaxUint64), now, 0); err != nil {
+		t.Errorf("far future block rejected with the check disabled: %v", err)
+	}
+}
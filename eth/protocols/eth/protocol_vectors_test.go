@@ -0,0 +1,275 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// To regenerate the packet encoding vectors after a deliberate wire format
+// change, run
+//
+//	go test -run TestPacketVectors -write-test-vectors
+var writeTestVectorsFlag = flag.Bool("write-test-vectors", false, "Overwrite eth packet vectors in testdata/")
+
+// vectorPackets returns a deterministic instance of every packet type of the
+// protocol, from which the golden encodings are produced.
+func vectorPackets() []interface{} {
+	var (
+		hash    = common.HexToHash("0x00000000000000000000000000000000000000000000000000000000deadc0de")
+		other   = common.HexToHash("0x00000000000000000000000000000000000000000000000000000000feedbeef")
+		id      = uint64(1111)
+		txs     = newTestTransactions(2)
+		header  = newTestBlock(3).Header()
+		headers = []*types.Header{header}
+
+		manifest = types.BlockManifest{hash, other}
+		body     = &BlockBody{Transactions: txs, Uncles: headers, ExtTransactions: txs[:1], SubManifest: manifest}
+		etxs     = types.PendingEtxs{Header: header, Etxs: txs}
+		rollup   = types.PendingEtxsRollup{Header: header, Manifest: manifest}
+		caps     = CapabilitiesPacket{PrunedDepth: 128, Messages: []uint64{GetBlockHeadersMsg, BlockHeadersMsg}}
+		location = common.Location{0, 1}
+		miner    = common.HexToAddress("0x00000000000000000000000000000000deadbeef")
+
+		table   = []rlp.RawValue{{0x82, 0xca, 0xfe}, {0xc0}}
+		compact = CompactBlockBody{Transactions: rlp.RawValue{0xc0}, Uncles: rlp.RawValue{0xc0}, ExtTransactions: []rlp.RawValue{{0xc3, 0x01, 0x80, 0x01}}, SubManifest: rlp.RawValue{0xc0}}
+	)
+	return []interface{}{
+		&StatusPacket{
+			ProtocolVersion: ETH66,
+			NetworkID:       1,
+			Location:        location.Name(),
+			SlicesRunning:   []common.Location{{0, 0}, location},
+			Entropy:         big.NewInt(1000),
+			Head:            hash,
+			Genesis:         other,
+			Experimental:    true,
+		},
+		&NewBlockHashesPacket{{Hash: hash, Number: 3}, {Hash: other, Number: 4}},
+		&TransactionsPacket{txs[0], txs[1]},
+		&GetBlockHeadersPacket{Origin: HashOrNumber{Hash: hash}, Amount: 5, Dom: true, To: 2, Skip: 1},
+		&GetBlockHeadersPacket66{id, &GetBlockHeadersPacket{Origin: HashOrNumber{Number: 3}, Amount: 5, Reverse: true}},
+		&BlockHeadersPacket{header},
+		&BlockHeadersPacket66{id, headers},
+		&NewBlockPacket{Block: types.NewBlockWithHeader(header).WithBody(txs, nil, txs[:1], manifest)},
+		&GetBlockBodiesPacket{hash, other},
+		&GetBlockBodiesPacket66{id, GetBlockBodiesPacket{hash, other}},
+		&BlockBodiesPacket{body},
+		&BlockBodiesPacket66{id, BlockBodiesPacket{body}},
+		&NewPooledTransactionHashesPacket{hash, other},
+		&GetPooledTransactionsPacket{hash, other},
+		&GetPooledTransactionsPacket66{id, GetPooledTransactionsPacket{hash, other}},
+		&PooledTransactionsPacket{txs[0], txs[1]},
+		&PooledTransactionsPacket66{id, PooledTransactionsPacket{txs[0], txs[1]}},
+		&GetBlockPacket{Hash: hash},
+		&GetBlockPacket66{id, GetBlockPacket{Hash: hash}},
+		&GetOnePendingEtxsPacket{Hash: hash},
+		&GetOnePendingEtxsPacket66{id, GetOnePendingEtxsPacket{Hash: hash}},
+		&PendingEtxsPacket{PendingEtxs: etxs},
+		&PendingEtxsPacket66{id, PendingEtxsPacket{PendingEtxs: etxs}},
+		&PendingEtxsRollupPacket{PendingEtxsRollup: rollup},
+		&PendingEtxsRollupPacket66{id, PendingEtxsRollupPacket{PendingEtxsRollup: rollup}},
+		&GetOnePendingEtxsRollupPacket{Hash: hash},
+		&GetOnePendingEtxsRollupPacket66{id, GetOnePendingEtxsRollupPacket{Hash: hash}},
+		&GetBlockTxHashesPacket{Hash: hash},
+		&GetBlockTxHashesPacket66{id, GetBlockTxHashesPacket{Hash: hash}},
+		&BlockTxHashesPacket{hash, other},
+		&BlockTxHashesPacket66{id, BlockTxHashesPacket{hash, other}},
+		&GetHeadPacket{Location: location},
+		&GetHeadPacket66{id, GetHeadPacket{Location: location}},
+		&HeadPacket{Hash: hash, Number: 3, Entropy: big.NewInt(1000)},
+		&HeadPacket66{id, HeadPacket{Hash: hash, Number: 3, Entropy: big.NewInt(1000)}},
+		&GetCapabilitiesPacket{},
+		&GetCapabilitiesPacket66{id, GetCapabilitiesPacket{}},
+		&caps,
+		&CapabilitiesPacket66{id, caps},
+		&GetHeadersByNumbersPacket{1, 3, 5},
+		&GetHeadersByNumbersPacket66{id, GetHeadersByNumbersPacket{1, 3, 5}},
+		&HeadersByNumbersPacket{header},
+		&HeadersByNumbersPacket66{id, headers},
+		&HaveBlockPacket{Hash: hash},
+		&HaveBlockPacket66{id, HaveBlockPacket{Hash: hash}},
+		&HaveBlockReplyPacket{Hash: hash, Have: true},
+		&HaveBlockReplyPacket66{id, HaveBlockReplyPacket{Hash: hash, Have: true}},
+		&GetPendingEtxsByLocationPacket{Location: location, Cursor: hash},
+		&GetPendingEtxsByLocationPacket66{id, GetPendingEtxsByLocationPacket{Location: location, Cursor: hash}},
+		&PendingEtxsByLocationPacket{Etxs: txs, Cursor: other},
+		&PendingEtxsByLocationPacket66{id, PendingEtxsByLocationPacket{Etxs: txs, Cursor: other}},
+		&GetBlockEtxRootsPacket{Origin: HashOrNumber{Number: 3}, Amount: 5, Skip: 1},
+		&GetBlockEtxRootsPacket66{id, &GetBlockEtxRootsPacket{Origin: HashOrNumber{Hash: hash}, Amount: 5, Reverse: true}},
+		&BlockEtxRootsPacket{{Number: 3, Hash: hash, EtxRoot: other}},
+		&BlockEtxRootsPacket66{id, BlockEtxRootsPacket{{Number: 3, Hash: hash, EtxRoot: other}}},
+		&GetFreshBlockBodiesPacket{Head: hash, Number: 3, Hashes: []common.Hash{hash, other}},
+		&GetFreshBlockBodiesPacket66{id, GetFreshBlockBodiesPacket{Head: hash, Number: 3, Hashes: []common.Hash{hash, other}}},
+		&FreshBlockBodiesPacket{Bodies: []*BlockBody{body}, Stale: []common.Hash{other}},
+		&FreshBlockBodiesPacket66{id, FreshBlockBodiesPacket{Bodies: []*BlockBody{body}, Stale: []common.Hash{other}}},
+		&GetBlockMinersPacket{Origin: HashOrNumber{Number: 3}, Amount: 5, Dom: true},
+		&GetBlockMinersPacket66{id, GetBlockMinersPacket{Origin: HashOrNumber{Hash: hash}, Amount: 5}},
+		&BlockMinersPacket{{Number: 3, Miner: miner}},
+		&BlockMinersPacket66{id, BlockMinersPacket{{Number: 3, Miner: miner}}},
+		&GetUnclesByRangePacket{Origin: HashOrNumber{Number: 3}, Amount: 5, Dom: true},
+		&GetUnclesByRangePacket66{id, GetUnclesByRangePacket{Origin: HashOrNumber{Hash: hash}, Amount: 5}},
+		&UnclesByRangePacket{{Number: 3, Uncles: []*types.Header{header}}, {Number: 4}},
+		&UnclesByRangePacket66{id, UnclesByRangePacket{{Number: 3, Uncles: []*types.Header{header}}, {Number: 4}}},
+		&GetBlockDataPacket{Origin: HashOrNumber{Number: 3}, Amount: 5, Dom: true},
+		&GetBlockDataPacket66{id, GetBlockDataPacket{Origin: HashOrNumber{Hash: hash}, Amount: 5}},
+		&BlockDataPacket{Headers: []*types.Header{header}, Bodies: []*BlockBody{body}},
+		&BlockDataPacket66{id, BlockDataPacket{Headers: []*types.Header{header}, Bodies: []*BlockBody{body}}},
+		&GetBlockByNumberPacket{Location: location, Number: 3},
+		&GetBlockByNumberPacket66{id, GetBlockByNumberPacket{Location: location, Number: 3}},
+		&BlockByNumberPacket{Block: types.NewBlockWithHeader(header).WithBody(txs, nil, txs[:1], manifest)},
+		&BlockByNumberPacket66{id, BlockByNumberPacket{}},
+		&StatusDeltaPacket{Fields: StatusFieldHead | StatusFieldEntropy, Values: []rlp.RawValue{{0x01}, {0x82, 0x03, 0xe8}}},
+		&GetEtxManifestProofPacket{Hash: hash, Location: location, SubHash: other},
+		&GetEtxManifestProofPacket66{id, GetEtxManifestProofPacket{Hash: hash, Location: location, SubHash: other}},
+		&EtxManifestProofPacket{Root: hash, Index: 3, Proof: [][]byte{{0xc2, 0x01, 0x02}, {0xc1, 0x03}}},
+		&EtxManifestProofPacket66{id, EtxManifestProofPacket{Root: hash}},
+		&GetCanonicalHashPacket{Location: location, Number: 3},
+		&GetCanonicalHashPacket66{id, GetCanonicalHashPacket{Location: location, Number: 3}},
+		&CanonicalHashPacket{Hash: hash},
+		&CanonicalHashPacket66{id, CanonicalHashPacket{}},
+		&GetPendingEtxsSincePacket{Location: location, Since: hash, Cursor: other},
+		&GetPendingEtxsSincePacket66{id, GetPendingEtxsSincePacket{Location: location, Since: hash}},
+		&PendingEtxsSincePacket{Etxs: txs, Cursor: other},
+		&PendingEtxsSincePacket66{id, PendingEtxsSincePacket{Etxs: txs}},
+		&GetPartialBodiesPacket{Fields: BodyFieldTransactions | BodyFieldSubManifest, Hashes: []common.Hash{hash, other}},
+		&GetPartialBodiesPacket66{id, GetPartialBodiesPacket{Fields: BodyFieldUncles, Hashes: []common.Hash{hash}}},
+		&PartialBodiesPacket{Fields: BodyFieldUncles | BodyFieldExtTransactions, Bodies: []PartialBlockBody{{{0xc0}, {0xc1, 0x80}}}},
+		&PartialBodiesPacket66{id, PartialBodiesPacket{Fields: BodyFieldSubManifest, Bodies: []PartialBlockBody{{{0xc0}}}}},
+		&GetEtxRollupsByRangePacket{Origin: HashOrNumber{Hash: hash}, Count: 16},
+		&GetEtxRollupsByRangePacket66{id, GetEtxRollupsByRangePacket{Origin: HashOrNumber{Number: 3}, Count: 2}},
+		&EtxRollupsByRangePacket{rollup, rollup},
+		&EtxRollupsByRangePacket66{id, EtxRollupsByRangePacket{rollup}},
+		&GetPoolSnapshotPacket{Location: location, Limit: 256},
+		&GetPoolSnapshotPacket66{id, GetPoolSnapshotPacket{Limit: 16}},
+		&PoolSnapshotPacket{Hashes: []common.Hash{hash, other}},
+		&PoolSnapshotPacket66{id, PoolSnapshotPacket{Refused: true}},
+		&GetHeadersByMinerPacket{Origin: HashOrNumber{Number: 3}, Amount: 64, Dom: true, Miners: []common.Address{miner}},
+		&GetHeadersByMinerPacket66{id, GetHeadersByMinerPacket{Origin: HashOrNumber{Hash: hash}, Amount: 8, Miners: []common.Address{miner, miner}}},
+		&HeadersByMinerPacket{Headers: headers, Last: 66},
+		&HeadersByMinerPacket66{id, HeadersByMinerPacket{Last: 10}},
+		&GetTxNonInclusionProofPacket{Hash: hash, TxHash: other},
+		&GetTxNonInclusionProofPacket66{id, GetTxNonInclusionProofPacket{Hash: hash, TxHash: other}},
+		&TxNonInclusionProofPacket{Count: 2, Proof: [][]byte{{0xc2, 0x01, 0x02}, {0xc1, 0x03}}},
+		&TxNonInclusionProofPacket66{id, TxNonInclusionProofPacket{}},
+		&GetUnclePoolPacket{Limit: 64},
+		&GetUnclePoolPacket66{id, GetUnclePoolPacket{Limit: 16}},
+		&UnclePoolPacket{{Hash: hash, Number: 12}, {Hash: other, Number: 11}},
+		&UnclePoolPacket66{id, UnclePoolPacket{}},
+		&CompactBlockBodiesPacket{Table: table, Bodies: []CompactBlockBody{compact}},
+		&CompactBlockBodiesPacket66{id, CompactBlockBodiesPacket{Table: table, Bodies: []CompactBlockBody{compact}}},
+		&CompactPooledTransactionHashesPacket{txHashPrefix(hash), txHashPrefix(other)},
+		&GetPooledTransactionHashesPacket{txHashPrefix(hash)},
+		&GetPooledTransactionHashesPacket66{id, GetPooledTransactionHashesPacket{txHashPrefix(hash)}},
+		&PooledTransactionHashesPacket{hash, other},
+		&PooledTransactionHashesPacket66{id, PooledTransactionHashesPacket{hash}},
+	}
+}
+
+// Tests that the wire encoding of every packet type matches its golden vector,
+// catching accidental format changes such as reordered fields.
+func TestPacketVectors(t *testing.T) {
+	covered := make(map[string]bool)
+	for _, packet := range vectorPackets() {
+		name := reflect.TypeOf(packet).Elem().Name()
+		covered[name] = true
+
+		t.Run(name, func(t *testing.T) {
+			enc, err := rlp.EncodeToBytes(packet)
+			if err != nil {
+				t.Fatalf("failed to encode packet: %v", err)
+			}
+			file := filepath.Join("testdata", name+".txt")
+			if *writeTestVectorsFlag {
+				writeTestVector(file, fmt.Sprintf("eth packet %s", name), enc)
+			}
+			golden := hexFile(t, file)
+			if !bytes.Equal(enc, golden) {
+				t.Fatalf("encoding mismatch:\n  have: %x\n  want: %x", enc, golden)
+			}
+			// The golden vector must also decode into an identical packet
+			dec := reflect.New(reflect.TypeOf(packet).Elem()).Interface()
+			if err := rlp.DecodeBytes(golden, dec); err != nil {
+				t.Fatalf("failed to decode vector: %v", err)
+			}
+			if reenc, _ := rlp.EncodeToBytes(dec); !bytes.Equal(reenc, golden) {
+				t.Fatalf("re-encoding mismatch:\n  have: %x\n  want: %x", reenc, golden)
+			}
+		})
+	}
+	// Make sure new packet types don't slip through without a vector
+	for _, packet := range packets {
+		if name := reflect.TypeOf(packet).Elem().Name(); !covered[name] {
+			t.Errorf("packet %s has no encoding vector", name)
+		}
+	}
+}
+
+// hexFile reads a hex encoded test vector, ignoring comment lines.
+func hexFile(t *testing.T, file string) []byte {
+	t.Helper()
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("failed to read vector: %v", err)
+	}
+	var text []byte
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 && line[0] == '#' {
+			continue
+		}
+		text = append(text, line...)
+	}
+	data := make([]byte, hex.DecodedLen(len(text)))
+	if _, err := hex.Decode(data, text); err != nil {
+		t.Fatalf("invalid hex in %s: %v", file, err)
+	}
+	return data
+}
+
+// writeTestVector writes a hex encoded test vector, preceded by a comment.
+func writeTestVector(file, comment string, data []byte) {
+	fd, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		panic(err)
+	}
+	defer fd.Close()
+
+	fmt.Fprintf(fd, "# %s\n\n", comment)
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > 32 {
+			chunk = data[:32]
+		}
+		data = data[len(chunk):]
+		fmt.Fprintf(fd, "%x\n", chunk)
+	}
+}
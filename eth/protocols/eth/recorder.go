@@ -0,0 +1,170 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/log"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// untaggedMsgs are the messages which don't carry a request id, not even on
+// `eth/66` connections.
+var untaggedMsgs = map[uint64]bool{
+	StatusMsg:                     true,
+	NewBlockHashesMsg:             true,
+	NewBlockMsg:                   true,
+	TransactionsMsg:               true,
+	NewPooledTransactionHashesMsg: true,
+	PendingEtxsMsg:                true,
+	PendingEtxsRollupMsg:          true,
+	StatusDeltaMsg:                true,
+}
+
+// recorder is the message recorder currently installed, if any.
+var recorder atomic.Value // *Recorder
+
+// SetRecorder installs a recorder capturing every message exchanged with the
+// `eth` peers from now on. A nil recorder stops recording.
+func SetRecorder(r *Recorder) {
+	recorder.Store(r)
+}
+
+// activeRecorder retrieves the installed message recorder, nil if none.
+func activeRecorder() *Recorder {
+	r, _ := recorder.Load().(*Recorder)
+	return r
+}
+
+// RecordedMsg is a protocol message captured by a Recorder.
+type RecordedMsg struct {
+	Time      uint64 // Unix time of the capture, in nanoseconds
+	Peer      string // Identifier of the remote peer
+	Outbound  bool   // Whether the message was sent to or received from the peer
+	Code      uint64 // Message code, identifying the packet kind
+	RequestId uint64 // Request id of `eth/66` requests and replies, zero otherwise
+	Payload   []byte // Raw RLP content of the message
+}
+
+// Recorder captures protocol messages into a stream of RLP encoded RecordedMsg
+// entries, which can be read back with ReadRecording.
+type Recorder struct {
+	w    io.Writer
+	err  error // First write failure, recording stops after it
+	lock sync.Mutex
+}
+
+// NewRecorder creates a message recorder writing into w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w}
+}
+
+// Err returns the error which stopped the recording, if any.
+func (r *Recorder) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.err
+}
+
+// record captures a message exchanged with a peer. As the message payload is
+// consumed in the process, a replacement message is returned for further use.
+func (r *Recorder) record(peer string, version uint, outbound bool, msg p2p.Msg) (p2p.Msg, error) {
+	payload := make([]byte, msg.Size)
+	if _, err := io.ReadFull(msg.Payload, payload); err != nil {
+		return msg, err
+	}
+	msg.Payload = bytes.NewReader(payload)
+
+	entry := &RecordedMsg{
+		Time:     uint64(time.Now().UnixNano()),
+		Peer:     peer,
+		Outbound: outbound,
+		Code:     msg.Code,
+		Payload:  payload,
+	}
+	if version >= ETH66 && !untaggedMsgs[msg.Code] {
+		entry.RequestId = requestId(payload)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.err == nil {
+		if r.err = rlp.Encode(r.w, entry); r.err != nil {
+			log.Warn("Message recording failed", "err", r.err)
+		}
+	}
+	return msg, nil
+}
+
+// requestId extracts the request id from an `eth/66` message payload, returning
+// zero if the payload is malformed.
+func requestId(payload []byte) uint64 {
+	content, _, err := rlp.SplitList(payload)
+	if err != nil {
+		return 0
+	}
+	id, _, err := rlp.SplitUint64(content)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// ReadRecording reads back all the messages captured by a Recorder.
+func ReadRecording(r io.Reader) ([]*RecordedMsg, error) {
+	var (
+		stream = rlp.NewStream(r, 0)
+		msgs   []*RecordedMsg
+	)
+	for {
+		msg := new(RecordedMsg)
+		if err := stream.Decode(msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return msgs, nil
+			}
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+// Replay feeds the recorded inbound messages through the message handlers as if
+// they were received from the given peer, returning the outcome of handling each
+// of them. Outbound messages are skipped.
+func Replay(msgs []*RecordedMsg, backend Backend, peer *Peer) []error {
+	var errs []error
+	for _, msg := range msgs {
+		if msg.Outbound {
+			continue
+		}
+		errs = append(errs, dispatchMessage(backend, peer, p2p.Msg{
+			Code:       msg.Code,
+			Size:       uint32(len(msg.Payload)),
+			Payload:    bytes.NewReader(msg.Payload),
+			ReceivedAt: time.Unix(0, int64(msg.Time)),
+		}))
+	}
+	return errs
+}
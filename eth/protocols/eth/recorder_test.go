@@ -0,0 +1,99 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// Tests that a recorded session captures the messages flowing in both ways, and
+// that replaying it results in the same outcomes as the original dispatch.
+func TestRecordReplay(t *testing.T) {
+	var recording bytes.Buffer
+	SetRecorder(NewRecorder(&recording))
+	defer SetRecorder(nil)
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		local   = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), net, nil)
+		remote  = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x02}, "peer", nil), app, nil)
+		backend = new(mockBackend)
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	session := []struct {
+		code   uint64
+		packet interface{}
+		id     uint64
+	}{
+		{NewBlockHashesMsg, &NewBlockHashesPacket{{Hash: common.Hash{0x01}, Number: 1}}, 0},
+		{BlockBodiesMsg, &BlockBodiesPacket66{RequestId: 42}, 42}, // Unsolicited reply
+		{0x3f, []uint64{}, 0},               // Invalid message code
+		{NewBlockHashesMsg, []uint64{1}, 0}, // Undecodable message
+	}
+	var have []error
+	for _, msg := range session {
+		go p2p.Send(remote.rw, msg.code, msg.packet)
+		have = append(have, handleMessage(backend, local))
+	}
+	SetRecorder(nil)
+
+	msgs, err := ReadRecording(&recording)
+	if err != nil {
+		t.Fatalf("failed to read recording: %v", err)
+	}
+	if len(msgs) != 2*len(session) {
+		t.Fatalf("recorded message count mismatch: have %d, want %d", len(msgs), 2*len(session))
+	}
+	for i, msg := range msgs {
+		// Every message is recorded by the sender first, then the receiver
+		want := session[i/2]
+		peer, outbound := remote.id, i%2 == 0
+		if !outbound {
+			peer = local.id
+		}
+		if msg.Peer != peer || msg.Outbound != outbound || msg.Code != want.code || msg.RequestId != want.id {
+			t.Errorf("message %d: mismatch: have %s/%v/%#x/%d, want %s/%v/%#x/%d", i,
+				msg.Peer[:4], msg.Outbound, msg.Code, msg.RequestId, peer[:4], outbound, want.code, want.id)
+		}
+	}
+	// Replay the session on a fresh connection and compare the outcomes
+	replayer := NewPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), net, nil)
+	defer replayer.Close()
+
+	replayed := new(mockBackend)
+	if errs := Replay(msgs, replayed, replayer); fmt.Sprint(errs) != fmt.Sprint(have) {
+		t.Errorf("replayed outcomes mismatch: have %v, want %v", errs, have)
+	}
+	if !reflect.DeepEqual(replayed.handled, backend.handled) {
+		t.Errorf("replayed packets mismatch: have %v, want %v", replayed.handled, backend.handled)
+	}
+	if len(backend.handled) != 1 {
+		t.Errorf("handled packet count mismatch: have %d, want 1", len(backend.handled))
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"math/big"
+	"time"
+)
+
+// PeerSignalType is the kind of a protocol signal about a peer.
+type PeerSignalType int
+
+const (
+	// PeerSignalHandshake is observed when the handshake with a peer completed,
+	// carrying the entropy it advertised.
+	PeerSignalHandshake PeerSignalType = iota
+
+	// PeerSignalResponse is observed when a peer answered a tracked request,
+	// carrying the code of the response and the time it took to arrive.
+	PeerSignalResponse
+
+	// PeerSignalDecodeFailure is observed when a message of a peer couldn't be
+	// decoded, carrying its code. Tolerated failures are observed too.
+	PeerSignalDecodeFailure
+
+	// PeerSignalServeTimeout is observed when processing a message of a peer
+	// overran the processing time limit, carrying its code.
+	PeerSignalServeTimeout
+
+	// PeerSignalClosed is observed when a peer disconnected, after which nothing
+	// recorded about it is needed anymore.
+	PeerSignalClosed
+
+	// PeerSignalTruncated is observed when a message of a peer was cut short,
+	// carrying its code. Unlike decode failures, these hint at a flaky link
+	// rather than at a misbehaving peer.
+	PeerSignalTruncated
+)
+
+// PeerSignal is a protocol level observation about a peer.
+type PeerSignal struct {
+	Type    PeerSignalType
+	Peer    string        // Identifier of the peer
+	Code    uint64        // Message code the signal relates to, if any
+	Entropy *big.Int      // Entropy advertised in the handshake
+	Latency time.Duration // Time it took to answer a request
+}
+
+// PeerScorer rates peers from the protocol signals observed about them. The
+// scores steer which peer is synced with, and peers scored negative are dropped.
+// Both methods may be called concurrently.
+type PeerScorer interface {
+	// Observe records a protocol signal about a peer.
+	Observe(signal PeerSignal)
+
+	// Score rates a peer, the higher the better. The returned value must not be
+	// modified by the caller.
+	Score(peer *Peer) *big.Int
+}
+
+// EntropyScorer is the default peer scorer, rating peers by the entropy of the
+// head they advertised and never dropping them.
+type EntropyScorer struct{}
+
+// Observe implements PeerScorer, ignoring the signals.
+func (EntropyScorer) Observe(PeerSignal) {}
+
+// Score implements PeerScorer, returning the entropy advertised by the peer.
+func (EntropyScorer) Score(peer *Peer) *big.Int {
+	if _, _, entropy, _ := peer.Head(); entropy != nil {
+		return entropy
+	}
+	return new(big.Int)
+}
+
+// scorer retrieves the peer scorer configured for the peer.
+func (p *Peer) scorer() PeerScorer {
+	if p.config.Scorer == nil {
+		return EntropyScorer{}
+	}
+	return p.config.Scorer
+}
+
+// observe feeds a signal about the peer to the configured scorer.
+func (p *Peer) observe(signal PeerSignal) {
+	signal.Peer = p.id
+	p.scorer().Observe(signal)
+}
+
+// Score rates the peer with the configured scorer.
+func (p *Peer) Score() *big.Int {
+	return p.scorer().Score(p)
+}
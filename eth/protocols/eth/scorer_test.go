@@ -0,0 +1,190 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// testScorer is a peer scorer recording the signals it observes, and scoring
+// peers as configured.
+type testScorer struct {
+	signals map[string][]PeerSignal // Signals observed about each peer
+	scores  map[string]*big.Int     // Scores of the peers, 1 if unset
+	lock    sync.Mutex
+}
+
+func newTestScorer() *testScorer {
+	return &testScorer{
+		signals: make(map[string][]PeerSignal),
+		scores:  make(map[string]*big.Int),
+	}
+}
+
+func (s *testScorer) Observe(signal PeerSignal) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.signals[signal.Peer] = append(s.signals[signal.Peer], signal)
+}
+
+func (s *testScorer) Score(peer *Peer) *big.Int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if score := s.scores[peer.ID()]; score != nil {
+		return score
+	}
+	return big.NewInt(1)
+}
+
+// observed returns the signals observed about a peer.
+func (s *testScorer) observed(peer string) []PeerSignal {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]PeerSignal{}, s.signals[peer]...)
+}
+
+// Tests that a custom peer scorer is fed the protocol signals of a peer through
+// its lifecycle, and that peers it scores negative are dropped.
+func TestPeerScorerSignals(t *testing.T) {
+	scorer := newTestScorer()
+
+	// Handshake a peer, announcing a known entropy to it
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		local   = newTestStatus(t, common.Location{0, 0})
+		remote  = *local
+		config  = DefaultConfig
+		peer    = newPeer(ETH66, p2p.NewPeer(enode.ID{0xe6, 0x01}, "peer", nil), net, nil, &config)
+		backend = new(mockBackend)
+	)
+	remote.Entropy = big.NewInt(12345)
+	config.Scorer = scorer
+
+	go func() {
+		if msg, err := app.ReadMsg(); err == nil {
+			msg.Discard()
+		}
+		p2p.Send(app, StatusMsg, &remote)
+	}()
+	if err := peer.Handshake(enode.ID{0xe6, 0x02}, local); err != nil {
+		t.Fatalf("failed to handshake: %v", err)
+	}
+	// Answer a tracked request, then send an undecodable reply
+	requestTracker.Track(peer.ID(), ETH66, GetBlockHeadersMsg, BlockHeadersMsg, 1)
+	go p2p.Send(app, BlockHeadersMsg, &BlockHeadersPacket66{RequestId: 1})
+	if err := handleMessage(backend, peer); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	go p2p.Send(app, BlockHeadersMsg, []uint64{1, 2, 3})
+	if err := handleMessage(backend, peer); err != nil {
+		t.Fatalf("undecodable reply not tolerated: %v", err)
+	}
+	// Overrun the processing time limit with a slow handler
+	done := make(chan struct{})
+	defer func(old msgHandler) { eth66[GetBlockBodiesMsg] = old }(eth66[GetBlockBodiesMsg])
+	eth66[GetBlockBodiesMsg] = func(backend Backend, msg Decoder, peer *Peer) error {
+		defer close(done)
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}
+	config.MaxProcessingTime = 10 * time.Millisecond
+
+	go p2p.Send(app, GetBlockBodiesMsg, &GetBlockBodiesPacket66{RequestId: 2})
+	if err := handleMessage(backend, peer); !errors.Is(err, errProcessingTimeout) {
+		t.Fatalf("error mismatch: have %v, want %v", err, errProcessingTimeout)
+	}
+	<-done
+	config.MaxProcessingTime = 0
+
+	// Rate the peer negative, which drops it after its next message
+	scorer.lock.Lock()
+	scorer.scores[peer.ID()] = big.NewInt(-1)
+	scorer.lock.Unlock()
+
+	go p2p.Send(app, NewBlockHashesMsg, NewBlockHashesPacket{})
+	if err := Handle(backend, peer); !errors.Is(err, errPeerScoreTooLow) {
+		t.Fatalf("error mismatch: have %v, want %v", err, errPeerScoreTooLow)
+	}
+	peer.Close()
+
+	// Check that every signal was observed, in order
+	want := []PeerSignal{
+		{Type: PeerSignalHandshake, Entropy: remote.Entropy},
+		{Type: PeerSignalResponse, Code: BlockHeadersMsg},
+		{Type: PeerSignalDecodeFailure, Code: BlockHeadersMsg},
+		{Type: PeerSignalServeTimeout, Code: GetBlockBodiesMsg},
+		{Type: PeerSignalClosed},
+	}
+	have := scorer.observed(peer.ID())
+	if len(have) != len(want) {
+		t.Fatalf("signal count mismatch: have %d, want %d: %+v", len(have), len(want), have)
+	}
+	for i := range want {
+		if have[i].Type != want[i].Type || have[i].Code != want[i].Code || have[i].Peer != peer.ID() {
+			t.Errorf("signal %d mismatch: have %+v, want %+v", i, have[i], want[i])
+		}
+	}
+	if have[0].Entropy == nil || have[0].Entropy.Cmp(remote.Entropy) != 0 {
+		t.Errorf("handshake entropy mismatch: have %v, want %v", have[0].Entropy, remote.Entropy)
+	}
+	if have[1].Latency <= 0 {
+		t.Errorf("response latency not measured: %v", have[1].Latency)
+	}
+}
+
+// Tests that the default scorer rates peers by their advertised entropy, as do
+// configs leaving the scorer unset, while custom scorers replace it.
+func TestEntropyScorer(t *testing.T) {
+	var (
+		config = DefaultConfig
+		peer   = newPeer(ETH66, p2p.NewPeer(enode.ID{0xe6, 0x03}, "peer", nil), nil, nil, &config)
+	)
+	defer peer.Close()
+
+	if score := peer.Score(); score.Sign() != 0 {
+		t.Errorf("score without entropy mismatch: have %v, want 0", score)
+	}
+	peer.SetHead(common.Hash{0x01}, big.NewInt(1), big.NewInt(100), time.Now())
+	if score := peer.Score(); score.Cmp(big.NewInt(100)) != 0 {
+		t.Errorf("score mismatch: have %v, want 100", score)
+	}
+	scorer := newTestScorer()
+	scorer.scores[peer.ID()] = big.NewInt(7)
+
+	config.Scorer = scorer
+	if score := peer.Score(); score.Cmp(big.NewInt(7)) != 0 {
+		t.Errorf("custom score mismatch: have %v, want 7", score)
+	}
+	config.Scorer = nil
+	if score := peer.Score(); score.Cmp(big.NewInt(100)) != 0 {
+		t.Errorf("unset scorer score mismatch: have %v, want 100", score)
+	}
+}
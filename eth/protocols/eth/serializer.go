@@ -0,0 +1,102 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// Serializer converts the protocol packets to and from the payload of network
+// messages. The wire format of the `eth` protocol is RLP, alternative encodings
+// are only meant for experiments and tests between nodes using the same one.
+//
+// Packets carrying pre-encoded RLP content (e.g. the *RLPPacket replies) embed
+// it verbatim as a byte blob under any serializer.
+type Serializer interface {
+	// Encode serializes a packet, returning the payload and its size.
+	Encode(packet interface{}) (uint32, io.Reader, error)
+
+	// Decode deserializes the payload of a message into a packet. Failures due
+	// to the payload ending prematurely should wrap io.ErrUnexpectedEOF.
+	Decode(msg p2p.Msg, packet interface{}) error
+}
+
+// RLPSerializer is the default packet serializer, using the RLP wire format.
+type RLPSerializer struct{}
+
+// Encode implements Serializer, RLP encoding the packet.
+func (RLPSerializer) Encode(packet interface{}) (uint32, io.Reader, error) {
+	size, r, err := rlp.EncodeToReader(packet)
+	return uint32(size), r, err
+}
+
+// Decode implements Serializer, RLP decoding the message payload. Unlike with
+// p2p.Msg.Decode, the RLP error is wrapped, so that payloads cut short can be
+// told apart from malformed ones.
+func (RLPSerializer) Decode(msg p2p.Msg, packet interface{}) error {
+	s := rlp.NewStream(msg.Payload, uint64(msg.Size))
+	if err := s.Decode(packet); err != nil {
+		return fmt.Errorf("(code %x) (size %d) %w", msg.Code, msg.Size, err)
+	}
+	return nil
+}
+
+// serializer is the packet serializer currently installed.
+var serializer atomic.Value // Serializer
+
+// SetSerializer installs the serializer used for all the packets exchanged with
+// the `eth` peers from now on. A nil serializer restores the RLP default.
+func SetSerializer(s Serializer) {
+	if s == nil {
+		s = RLPSerializer{}
+	}
+	serializer.Store(&s)
+}
+
+// activeSerializer retrieves the installed packet serializer.
+func activeSerializer() Serializer {
+	if s, ok := serializer.Load().(*Serializer); ok {
+		return *s
+	}
+	return RLPSerializer{}
+}
+
+// send serializes a packet with the active serializer and writes it as a message
+// with the given code.
+func send(w p2p.MsgWriter, code uint64, packet interface{}) error {
+	size, r, err := activeSerializer().Encode(packet)
+	if err != nil {
+		return err
+	}
+	return w.WriteMsg(p2p.Msg{Code: code, Size: size, Payload: r})
+}
+
+// serializedMsg is a network message decoded with the active serializer.
+type serializedMsg struct {
+	p2p.Msg
+	serializer Serializer
+}
+
+// Decode deserializes the message payload into a packet.
+func (msg serializedMsg) Decode(packet interface{}) error {
+	return msg.serializer.Decode(msg.Msg, packet)
+}
@@ -0,0 +1,106 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// jsonSerializer is a trivial alternative to the RLP serializer.
+type jsonSerializer struct{}
+
+func (jsonSerializer) Encode(packet interface{}) (uint32, io.Reader, error) {
+	blob, err := json.Marshal(packet)
+	return uint32(len(blob)), bytes.NewReader(blob), err
+}
+
+func (jsonSerializer) Decode(msg p2p.Msg, packet interface{}) error {
+	blob, err := ioutil.ReadAll(msg.Payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(blob, packet)
+}
+
+// Tests that packets are exchanged with the installed serializer, round tripping
+// through the message dispatch unchanged.
+func TestAlternateSerializer(t *testing.T) {
+	SetSerializer(jsonSerializer{})
+	defer SetSerializer(nil)
+
+	tests := []struct {
+		code   uint64
+		packet interface{}
+	}{
+		{NewBlockHashesMsg, &NewBlockHashesPacket{{Hash: common.Hash{0x01}, Number: 1}, {Hash: common.Hash{0x02}, Number: 2}}},
+		{GetBlockHeadersMsg, &GetBlockHeadersPacket66{RequestId: 1, GetBlockHeadersPacket: &GetBlockHeadersPacket{Origin: HashOrNumber{Number: 10}, Amount: 5}}},
+		{HeadMsg, &HeadPacket66{RequestId: 2, HeadPacket: HeadPacket{Hash: common.Hash{0x03}, Number: 3, Entropy: big.NewInt(42)}}},
+		{CapabilitiesMsg, &CapabilitiesPacket66{RequestId: 3, CapabilitiesPacket: CapabilitiesPacket{PrunedDepth: 128, Messages: []uint64{GetBlockHeadersMsg}}}},
+	}
+	for i, tt := range tests {
+		app, net := p2p.MsgPipe()
+
+		go send(app, tt.code, tt.packet)
+		msg, err := net.ReadMsg()
+		if err != nil {
+			t.Fatalf("test %d: failed to read message: %v", i, err)
+		}
+		// The payload must not be in the RLP wire format
+		payload, _ := ioutil.ReadAll(msg.Payload)
+		if _, _, err := rlp.SplitList(payload); err == nil {
+			t.Errorf("test %d: payload RLP encoded: %x", i, payload)
+		}
+		msg.Payload = bytes.NewReader(payload)
+
+		decoded := reflect.New(reflect.TypeOf(tt.packet).Elem()).Interface()
+		if err := (serializedMsg{msg, activeSerializer()}).Decode(decoded); err != nil {
+			t.Fatalf("test %d: failed to decode packet: %v", i, err)
+		}
+		if !reflect.DeepEqual(decoded, tt.packet) {
+			t.Errorf("test %d: packet mismatch: have %+v, want %+v", i, decoded, tt.packet)
+		}
+		app.Close()
+		net.Close()
+	}
+	// Announcements are delivered to the backend through the usual dispatch
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	peer := NewPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), net, nil)
+	defer peer.Close()
+
+	backend := new(mockBackend)
+	go send(app, tests[0].code, tests[0].packet)
+	if err := handleMessage(backend, peer); err != nil {
+		t.Fatalf("failed to handle message: %v", err)
+	}
+	if len(backend.handled) != 1 || !reflect.DeepEqual(backend.handled[0], tests[0].packet) {
+		t.Errorf("handled packets mismatch: have %v, want %v", backend.handled, tests[0].packet)
+	}
+}
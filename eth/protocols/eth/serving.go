@@ -0,0 +1,145 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"container/heap"
+	"math/big"
+	"sync"
+)
+
+// serveFairnessInterval is the number of serving slots handed out between two
+// slots granted to the longest waiting request regardless of its entropy, so
+// the requests of low entropy peers are delayed but never starved.
+const serveFairnessInterval = 4
+
+// serveQueue is the scheduler of the data retrievals served to remote peers
+// when serving is prioritized.
+var serveQueue = newServeScheduler()
+
+// serveWaiter is a data retrieval waiting for a serving slot.
+type serveWaiter struct {
+	entropy *big.Int      // Entropy advertised by the requesting peer
+	seq     uint64        // Arrival order of the request
+	index   int           // Index of the waiter in the priority heap
+	ready   chan struct{} // Closed when the waiter is granted a slot
+}
+
+// serveHeap is a priority queue of waiters, highest entropy first and earliest
+// arrival breaking ties.
+type serveHeap []*serveWaiter
+
+func (h serveHeap) Len() int { return len(h) }
+
+func (h serveHeap) Less(i, j int) bool {
+	if c := h[i].entropy.Cmp(h[j].entropy); c != 0 {
+		return c > 0
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h serveHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *serveHeap) Push(x interface{}) {
+	w := x.(*serveWaiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *serveHeap) Pop() interface{} {
+	old := *h
+	w := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return w
+}
+
+// serveScheduler limits the number of data retrievals served concurrently,
+// handing the slots freed up under saturation to the requests of the highest
+// entropy peers first.
+type serveScheduler struct {
+	active  int            // Number of slots currently held
+	seq     uint64         // Arrival counter of the waiters
+	grants  uint64         // Number of slots handed to waiters
+	waiting serveHeap      // Waiters ordered by entropy
+	arrival []*serveWaiter // Waiters ordered by arrival, oldest first
+
+	lock sync.Mutex
+}
+
+// newServeScheduler creates a scheduler without any slots held.
+func newServeScheduler() *serveScheduler {
+	return new(serveScheduler)
+}
+
+// acquire blocks until a serving slot is available for a request of a peer at
+// the given entropy, up to limit slots being held at once. The returned function
+// must be called to free the slot up.
+func (s *serveScheduler) acquire(entropy *big.Int, limit int) func() {
+	if entropy == nil {
+		entropy = new(big.Int)
+	}
+	s.lock.Lock()
+	if s.active < limit && len(s.waiting) == 0 {
+		s.active++
+		s.lock.Unlock()
+		return s.release
+	}
+	w := &serveWaiter{
+		entropy: entropy,
+		seq:     s.seq,
+		ready:   make(chan struct{}),
+	}
+	s.seq++
+	heap.Push(&s.waiting, w)
+	s.arrival = append(s.arrival, w)
+	s.lock.Unlock()
+
+	<-w.ready
+	return s.release
+}
+
+// release frees a serving slot up, handing it over to the next waiter if there
+// is any.
+func (s *serveScheduler) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.waiting) == 0 {
+		s.active--
+		return
+	}
+	// Every serveFairnessInterval-th slot goes to the longest waiting request,
+	// the rest to the highest entropy one
+	var w *serveWaiter
+	s.grants++
+	if s.grants%serveFairnessInterval == 0 {
+		w = s.arrival[0]
+		heap.Remove(&s.waiting, w.index)
+	} else {
+		w = heap.Pop(&s.waiting).(*serveWaiter)
+	}
+	for i, waiter := range s.arrival {
+		if waiter == w {
+			s.arrival = append(s.arrival[:i], s.arrival[i+1:]...)
+			break
+		}
+	}
+	close(w.ready)
+}
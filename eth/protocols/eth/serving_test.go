@@ -0,0 +1,117 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+// Tests that requests within the concurrency limit are served right away.
+func TestServeSchedulerUnsaturated(t *testing.T) {
+	s := newServeScheduler()
+
+	done := make(chan func())
+	for i := 0; i < 3; i++ {
+		go func() { done <- s.acquire(big.NewInt(1), 3) }()
+	}
+	var releases []func()
+	for i := 0; i < 3; i++ {
+		select {
+		case release := <-done:
+			releases = append(releases, release)
+		case <-time.After(time.Second):
+			t.Fatalf("request %d not served within the limit", i)
+		}
+	}
+	for _, release := range releases {
+		release()
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.active != 0 {
+		t.Errorf("slots held after release: %d", s.active)
+	}
+}
+
+// Tests that under saturation the requests of high entropy peers are served
+// first, while the ones of low entropy peers still get a slot regularly.
+func TestServeSchedulerPriority(t *testing.T) {
+	s := newServeScheduler()
+
+	// Saturate the scheduler, and queue up alternating low and high entropy
+	// requests, the low entropy ones arriving first
+	hold := s.acquire(big.NewInt(1), 1)
+
+	served := make(chan int64, 16)
+	for i := 0; i < 16; i++ {
+		entropy := int64(1)
+		if i%2 == 1 {
+			entropy = 100
+		}
+		go func() {
+			release := s.acquire(big.NewInt(entropy), 1)
+			served <- entropy
+			release()
+		}()
+		// Wait for the request to be queued, keeping the arrival order
+		for {
+			s.lock.Lock()
+			queued := len(s.waiting)
+			s.lock.Unlock()
+			if queued == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	hold()
+
+	var order []int64
+	for i := 0; i < 16; i++ {
+		select {
+		case entropy := <-served:
+			order = append(order, entropy)
+		case <-time.After(time.Second):
+			t.Fatalf("request %d never served, order so far: %v", i, order)
+		}
+	}
+	// High entropy requests take the slots, except the ones reserved for the
+	// longest waiting requests
+	want := []int64{100, 100, 100, 1, 100, 100, 100, 1, 100, 100, 1, 1, 1, 1, 1, 1}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("serving order mismatch: have %v, want %v", order, want)
+		}
+	}
+	// The last slot may still be in the process of being released
+	for deadline := time.Now().Add(time.Second); ; {
+		s.lock.Lock()
+		active, waiting, arrival := s.active, len(s.waiting), len(s.arrival)
+		s.lock.Unlock()
+
+		if active == 0 && waiting == 0 && arrival == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("scheduler not drained: active %d, waiting %d/%d", active, waiting, arrival)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
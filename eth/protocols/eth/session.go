@@ -0,0 +1,165 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"sync"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/crypto"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// maxSessions is the maximum number of resumable sessions tracked at once.
+const maxSessions = 1024
+
+// sessionKey identifies a session by the local and the remote node ids.
+type sessionKey struct {
+	self   enode.ID
+	remote enode.ID
+}
+
+// session is the state retained from a full handshake, allowing to resume it.
+type session struct {
+	token   common.Hash   // Token both sides derived from the full handshake
+	digest  common.Hash   // Digest of the local status the session was established with
+	status  *StatusPacket // Full status announced by the remote peer
+	expires time.Time     // Time the session lapses, zero while the peer is connected
+}
+
+// sessionCache tracks the sessions which may be resumed.
+type sessionCache struct {
+	sessions map[sessionKey]*session
+	lock     sync.Mutex
+}
+
+// sessions is the set of resumable sessions of the local node.
+var sessions = &sessionCache{sessions: make(map[sessionKey]*session)}
+
+// lookup retrieves the session which may be resumed with a peer, nil if there's
+// none or the local status changed since it was established.
+func (c *sessionCache) lookup(key sessionKey, digest common.Hash) *session {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	s := c.sessions[key]
+	if s == nil || s.digest != digest {
+		return nil
+	}
+	if !s.expires.IsZero() && time.Now().After(s.expires) {
+		delete(c.sessions, key)
+		return nil
+	}
+	return s
+}
+
+// store tracks a freshly established session with a peer, replacing any previous
+// one. New sessions are not tracked if the cache is full of unexpired ones.
+func (c *sessionCache) store(key sessionKey, s *session) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.sessions[key]; !ok && len(c.sessions) >= maxSessions {
+		now := time.Now()
+		for key, s := range c.sessions {
+			if !s.expires.IsZero() && now.After(s.expires) {
+				delete(c.sessions, key)
+			}
+		}
+		if len(c.sessions) >= maxSessions {
+			return
+		}
+	}
+	c.sessions[key] = s
+}
+
+// resume marks a session as in use again by a connected peer.
+func (c *sessionCache) resume(key sessionKey) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if s := c.sessions[key]; s != nil {
+		s.expires = time.Time{}
+	}
+}
+
+// release starts the resumption window of a session on peer disconnect, lasting
+// for the given lifetime.
+func (c *sessionCache) release(key sessionKey, lifetime time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if s := c.sessions[key]; s != nil && s.expires.IsZero() {
+		s.expires = time.Now().Add(lifetime)
+	}
+}
+
+// drop forgets the session with a peer.
+func (c *sessionCache) drop(key sessionKey) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.sessions, key)
+}
+
+// partial reports whether the status only carries the mutable fields, resuming
+// a previous session.
+func (s *StatusPacket) partial() bool {
+	return s.SessionToken != (common.Hash{})
+}
+
+// partialStatus creates the status resuming a session, only carrying the fields
+// which may have changed since the session was established.
+func partialStatus(local *StatusPacket, token common.Hash) *StatusPacket {
+	return &StatusPacket{
+		ProtocolVersion: local.ProtocolVersion,
+		Entropy:         local.Entropy,
+		Head:            local.Head,
+		SessionToken:    token,
+	}
+}
+
+// statusDigest hashes the immutable fields of a local status, so sessions are
+// only resumed while the local node announces the same.
+func statusDigest(status *StatusPacket) common.Hash {
+	immutable := *status
+	immutable.Entropy, immutable.Head = nil, common.Hash{}
+	immutable.SessionNonce, immutable.SessionToken = common.Hash{}, common.Hash{}
+
+	blob, _ := rlp.EncodeToBytes(&immutable)
+	return crypto.Keccak256Hash(blob)
+}
+
+// sessionNonce generates the randomness contributed to a session token.
+func sessionNonce() common.Hash {
+	var nonce common.Hash
+	rand.Read(nonce[:])
+	return nonce
+}
+
+// sessionToken derives the token of a session from the nonces of the two sides,
+// independent of which side is which.
+func sessionToken(a, b common.Hash) common.Hash {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+	return crypto.Keccak256Hash(a[:], b[:])
+}
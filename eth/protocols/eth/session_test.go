@@ -0,0 +1,261 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+var (
+	sessionLocalID  = enode.ID{0xa1}
+	sessionRemoteID = enode.ID{0xa2}
+)
+
+// newSessionStatus assembles a valid eth/67 status, the first version resuming
+// sessions, over an empty test chain running the given slices.
+func newSessionStatus(t *testing.T, slices ...common.Location) *StatusPacket {
+	t.Helper()
+
+	status, err := NewStatusPacket(newTestChain(0), ETH67, 1, slices, &DefaultConfig)
+	if err != nil {
+		t.Fatalf("failed to assemble status: %v", err)
+	}
+	return status
+}
+
+// connectSession runs the eth/67 handshake between two nodes, returning the peers
+// on both sides, along with the statuses sent by each of them.
+func connectSession(t *testing.T, config *Config, local, remote *StatusPacket) (*Peer, *Peer, []*StatusPacket, []*StatusPacket) {
+	t.Helper()
+
+	var recording bytes.Buffer
+	SetRecorder(NewRecorder(&recording))
+	defer SetRecorder(nil)
+
+	app, net := p2p.MsgPipe()
+	t.Cleanup(func() {
+		app.Close()
+		net.Close()
+	})
+	var (
+		localPeer  = newPeer(ETH67, p2p.NewPeer(sessionRemoteID, "remote", nil), net, nil, config)
+		remotePeer = newPeer(ETH67, p2p.NewPeer(sessionLocalID, "local", nil), app, nil, config)
+	)
+	errc := make(chan error, 1)
+	go func() { errc <- remotePeer.Handshake(sessionRemoteID, remote) }()
+	if err := localPeer.Handshake(sessionLocalID, local); err != nil {
+		t.Fatalf("local handshake failed: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("remote handshake failed: %v", err)
+	}
+	msgs, err := ReadRecording(&recording)
+	if err != nil {
+		t.Fatalf("failed to read recording: %v", err)
+	}
+	var localSent, remoteSent []*StatusPacket
+	for _, msg := range msgs {
+		if !msg.Outbound || msg.Code != StatusMsg {
+			continue
+		}
+		status := new(StatusPacket)
+		if err := rlp.DecodeBytes(msg.Payload, status); err != nil {
+			t.Fatalf("failed to decode status: %v", err)
+		}
+		if msg.Peer == localPeer.id {
+			localSent = append(localSent, status)
+		} else {
+			remoteSent = append(remoteSent, status)
+		}
+	}
+	return localPeer, remotePeer, localSent, remoteSent
+}
+
+// disconnectSession tears down the peers of a session, starting its resumption
+// window on both sides.
+func disconnectSession(peers ...*Peer) {
+	for _, peer := range peers {
+		peer.Close()
+	}
+}
+
+// dropSessions forgets the sessions between the two test nodes.
+func dropSessions() {
+	sessions.drop(sessionKey{self: sessionLocalID, remote: sessionRemoteID})
+	sessions.drop(sessionKey{self: sessionRemoteID, remote: sessionLocalID})
+}
+
+// Tests that reconnecting peers resume their previous session, only exchanging
+// the mutable fields of their statuses.
+func TestHandshakeSessionResume(t *testing.T) {
+	defer dropSessions()
+
+	local := newSessionStatus(t, common.Location{0, 0})
+	remote := newSessionStatus(t, common.Location{0, 0}, common.Location{0, 1})
+	remote.ClientVersion = "go-quai/remote"
+
+	localPeer, remotePeer, localSent, remoteSent := connectSession(t, &DefaultConfig, local, remote)
+	for i, sent := range [][]*StatusPacket{localSent, remoteSent} {
+		if len(sent) != 1 || sent[0].partial() || sent[0].SessionNonce == (common.Hash{}) {
+			t.Fatalf("side %d: initial statuses mismatch: have %+v, want one full", i, sent)
+		}
+	}
+	disconnectSession(localPeer, remotePeer)
+
+	// Reconnect with the remote node having progressed meanwhile
+	progressed := *remote
+	progressed.Head, progressed.Entropy = common.Hash{0x01}, big.NewInt(1000)
+
+	localPeer, remotePeer, localSent, remoteSent = connectSession(t, &DefaultConfig, local, &progressed)
+	defer disconnectSession(localPeer, remotePeer)
+
+	for i, sent := range [][]*StatusPacket{localSent, remoteSent} {
+		if len(sent) != 1 || !sent[0].partial() {
+			t.Fatalf("side %d: resumed statuses mismatch: have %+v, want one partial", i, sent)
+		}
+		if sent[0].Genesis != (common.Hash{}) || len(sent[0].SlicesRunning) != 0 {
+			t.Errorf("side %d: immutable fields exchanged on resumption: %+v", i, sent[0])
+		}
+	}
+	if head, _, entropy, _ := localPeer.Head(); head != progressed.Head || entropy.Cmp(progressed.Entropy) != 0 {
+		t.Errorf("head mismatch: have %x/%v, want %x/%v", head, entropy, progressed.Head, progressed.Entropy)
+	}
+	if have := localPeer.ClientVersion(); have != remote.ClientVersion {
+		t.Errorf("client version not restored: have %q, want %q", have, remote.ClientVersion)
+	}
+	if have := localPeer.SlicesRunning(); len(have) != 2 {
+		t.Errorf("slices running not restored: have %v, want %v", have, remote.SlicesRunning)
+	}
+}
+
+// Tests that peers fall back to exchanging the full statuses if the session is
+// unknown or expired on either side, establishing a fresh one.
+func TestHandshakeSessionMiss(t *testing.T) {
+	defer dropSessions()
+
+	local := newSessionStatus(t, common.Location{0, 0})
+	remote := newSessionStatus(t, common.Location{0, 0})
+
+	tests := []struct {
+		forget       func() // Invalidates the session between the connections
+		localStatus  int    // Statuses sent by the local side
+		remoteStatus int    // Statuses sent by the remote side
+	}{
+		// Local side forgot the session, the remote side resends its full status
+		{func() { sessions.drop(sessionKey{self: sessionLocalID, remote: sessionRemoteID}) }, 1, 2},
+		// Remote side forgot the session, the local side resends its full status
+		{func() { sessions.drop(sessionKey{self: sessionRemoteID, remote: sessionLocalID}) }, 2, 1},
+		// Session expired on both sides, full statuses straight away
+		{func() { time.Sleep(10 * time.Millisecond) }, 1, 1},
+	}
+	for i, tt := range tests {
+		config := DefaultConfig
+		if i == len(tests)-1 {
+			config.SessionLifetime = time.Millisecond
+		}
+		localPeer, remotePeer, _, _ := connectSession(t, &config, local, remote)
+		disconnectSession(localPeer, remotePeer)
+		tt.forget()
+
+		localPeer, remotePeer, localSent, remoteSent := connectSession(t, &config, local, remote)
+
+		if len(localSent) != tt.localStatus || len(remoteSent) != tt.remoteStatus {
+			t.Errorf("test %d: status count mismatch: have %d/%d, want %d/%d", i, len(localSent), len(remoteSent), tt.localStatus, tt.remoteStatus)
+		}
+		for j, sent := range [][]*StatusPacket{localSent, remoteSent} {
+			if last := sent[len(sent)-1]; last.partial() || last.Genesis != local.Genesis {
+				t.Errorf("test %d: side %d: last status not full: %+v", i, j, last)
+			}
+		}
+		// Both sides must have established the same fresh session
+		var (
+			localSession  = sessions.lookup(sessionKey{self: sessionLocalID, remote: sessionRemoteID}, statusDigest(local))
+			remoteSession = sessions.lookup(sessionKey{self: sessionRemoteID, remote: sessionLocalID}, statusDigest(remote))
+		)
+		if localSession == nil || remoteSession == nil || localSession.token != remoteSession.token {
+			t.Errorf("test %d: fresh session mismatch: have %v, %v", i, localSession, remoteSession)
+		}
+		disconnectSession(localPeer, remotePeer)
+		dropSessions()
+	}
+}
+
+// legacyStatusPacket is the status layout predating the optional fields.
+type legacyStatusPacket struct {
+	ProtocolVersion uint32
+	NetworkID       uint64
+	Location        string
+	SlicesRunning   []common.Location
+	Entropy         *big.Int
+	Head            common.Hash
+	Genesis         common.Hash
+}
+
+// Tests that eth/66 peers are never offered a session nor told the client
+// version, the status sent to them remaining decodable by nodes predating the
+// optional status fields.
+func TestHandshakeLegacyStatus(t *testing.T) {
+	defer dropSessions()
+
+	config := DefaultConfig
+	config.ClientVersion = "go-quai/v0.1.0"
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	peer := newPeer(ETH66, p2p.NewPeer(sessionRemoteID, "remote", nil), net, nil, &config)
+	defer peer.Close()
+
+	status, err := NewStatusPacket(newTestChain(0), ETH66, 1, []common.Location{{0, 0}}, &config)
+	if err != nil {
+		t.Fatalf("failed to assemble status: %v", err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- peer.Handshake(sessionLocalID, status) }()
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read status: %v", err)
+	}
+	var legacy legacyStatusPacket
+	if err := msg.Decode(&legacy); err != nil {
+		t.Fatalf("legacy node failed to decode status: %v", err)
+	}
+	if legacy.Genesis != status.Genesis || legacy.Head != status.Head {
+		t.Errorf("status mismatch: have %+v, want %+v", legacy, status)
+	}
+	// Answering with the legacy status must complete the handshake
+	if err := p2p.Send(app, StatusMsg, &legacy); err != nil {
+		t.Fatalf("failed to send status: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if peer.session != nil {
+		t.Errorf("session established with eth/66 peer")
+	}
+}
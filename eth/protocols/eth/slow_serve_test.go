@@ -0,0 +1,86 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/log"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// Tests that data retrievals taking longer than the threshold to serve are
+// reported, while fast ones and non-request messages are not.
+func TestSlowServeWarning(t *testing.T) {
+	config := DefaultConfig
+	config.SlowServeThreshold = 20 * time.Millisecond
+
+	hook := logtest.NewLocal(log.Log.Logger)
+	defer log.Log.ReplaceHooks(make(logrus.LevelHooks))
+
+	// Replace the handlers with stubs taking a configurable time to complete
+	var delay time.Duration
+	stub := func(backend Backend, msg Decoder, peer *Peer) error {
+		time.Sleep(delay)
+		return nil
+	}
+	for _, code := range []uint64{GetBlockBodiesMsg, BlockBodiesMsg} {
+		defer func(code uint64, old msgHandler) { eth66[code] = old }(code, eth66[code])
+		eth66[code] = stub
+	}
+	tests := []struct {
+		code  uint64
+		delay time.Duration
+		warn  bool
+	}{
+		{GetBlockBodiesMsg, 0, false},                            // Fast request
+		{GetBlockBodiesMsg, 2 * config.SlowServeThreshold, true}, // Slow request
+		{BlockBodiesMsg, 2 * config.SlowServeThreshold, false},   // Slow response handling, not served
+	}
+	for i, tt := range tests {
+		hook.Reset()
+		delay = tt.delay
+
+		app, net := p2p.MsgPipe()
+		peer := newPeer(ETH66, p2p.NewPeer(enode.ID{byte(i)}, "peer", nil), net, nil, &config)
+
+		go p2p.Send(app, tt.code, []uint64{1, 2, 3})
+		if err := handleMessage(new(mockBackend), peer); err != nil {
+			t.Fatalf("test %d: failed to handle message: %v", i, err)
+		}
+		var warned bool
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, "Slow request serving") {
+				warned = true
+				if !strings.Contains(entry.Message, "GetBlockBodies") || !strings.Contains(entry.Message, peer.ID()) {
+					t.Errorf("test %d: warning misses request details: %q", i, entry.Message)
+				}
+			}
+		}
+		if warned != tt.warn {
+			t.Errorf("test %d: warning mismatch: have %v, want %v", i, warned, tt.warn)
+		}
+		peer.Close()
+		app.Close()
+		net.Close()
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// newStatusDelta creates the delta updating the mutable fields of a status from
+// their old values to the new ones, only carrying the fields which changed.
+func newStatusDelta(old, status *StatusPacket) (*StatusDeltaPacket, error) {
+	delta := new(StatusDeltaPacket)
+	if status.Head != old.Head {
+		blob, err := rlp.EncodeToBytes(status.Head)
+		if err != nil {
+			return nil, err
+		}
+		delta.Fields |= StatusFieldHead
+		delta.Values = append(delta.Values, blob)
+	}
+	if status.Entropy != nil && (old.Entropy == nil || status.Entropy.Cmp(old.Entropy) != 0) {
+		blob, err := rlp.EncodeToBytes(status.Entropy)
+		if err != nil {
+			return nil, err
+		}
+		delta.Fields |= StatusFieldEntropy
+		delta.Values = append(delta.Values, blob)
+	}
+	return delta, nil
+}
+
+// apply updates the fields of a status flagged in the delta, returning an error
+// if the delta flags unknown fields or its values don't match the flags.
+func (d *StatusDeltaPacket) apply(status *StatusPacket) error {
+	if d.Fields&^statusFieldsKnown != 0 {
+		return fmt.Errorf("%w: unknown fields %#x", errInvalidStatusDelta, uint64(d.Fields&^statusFieldsKnown))
+	}
+	var (
+		values  = d.Values
+		head    = status.Head
+		entropy = status.Entropy
+	)
+	next := func(field StatusField, val interface{}) error {
+		if d.Fields&field == 0 {
+			return nil
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("%w: missing value of field %#x", errInvalidStatusDelta, uint64(field))
+		}
+		if err := rlp.DecodeBytes(values[0], val); err != nil {
+			return fmt.Errorf("%w: field %#x: %v", errInvalidStatusDelta, uint64(field), err)
+		}
+		values = values[1:]
+		return nil
+	}
+	if err := next(StatusFieldHead, &head); err != nil {
+		return err
+	}
+	if d.Fields&StatusFieldEntropy != 0 {
+		entropy = new(big.Int)
+		if err := next(StatusFieldEntropy, entropy); err != nil {
+			return err
+		}
+		if err := validateEntropy(entropy); err != nil {
+			return err
+		}
+	}
+	if len(values) != 0 {
+		return fmt.Errorf("%w: %d excess values", errInvalidStatusDelta, len(values))
+	}
+	status.Head, status.Entropy = head, entropy
+	return nil
+}
+
+// SendStatusDelta announces the new head and entropy of the local node to the
+// peer, only sending the fields which changed since they were last announced,
+// in the handshake or in a previous delta.
+func (p *Peer) SendStatusDelta(head common.Hash, entropy *big.Int) error {
+	if p.Version() < ETH67 {
+		return errors.New("eth66 not supported for SendStatusDelta call")
+	}
+	p.lock.RLock()
+	announced := p.announced
+	p.lock.RUnlock()
+
+	if announced == nil {
+		announced = new(StatusPacket)
+	}
+	status := &StatusPacket{Head: head, Entropy: new(big.Int).Set(entropy)}
+	delta, err := newStatusDelta(announced, status)
+	if err != nil {
+		return err
+	}
+	if delta.Fields == 0 {
+		return nil
+	}
+	if err := send(p.rw, StatusDeltaMsg, delta); err != nil {
+		return err
+	}
+	p.lock.Lock()
+	p.announced = status
+	p.lock.Unlock()
+
+	return nil
+}
+
+// applyStatusDelta updates the head and entropy advertised by the peer with a
+// status delta it sent. The number of the new head is unknown until the head is
+// announced or retrieved.
+func (p *Peer) applyStatusDelta(delta *StatusDeltaPacket) error {
+	p.lock.RLock()
+	status := &StatusPacket{Head: p.head, Entropy: p.entropy}
+	p.lock.RUnlock()
+
+	if err := delta.apply(status); err != nil {
+		return err
+	}
+	if delta.Fields&StatusFieldEntropy != 0 {
+		if err := p.TrackEntropy(nil, status.Entropy); err != nil {
+			return err
+		}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.head, p.entropy = status.Head, status.Entropy
+	if delta.Fields&StatusFieldHead != 0 {
+		p.receivedHeadAt = time.Now()
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// Tests that status deltas only carry the changed fields, and applying them on
+// the old status yields the new one.
+func TestStatusDelta(t *testing.T) {
+	old := &StatusPacket{Head: common.Hash{0x01}, Entropy: big.NewInt(100)}
+
+	tests := []struct {
+		status *StatusPacket
+		fields StatusField
+	}{
+		{&StatusPacket{Head: common.Hash{0x01}, Entropy: big.NewInt(100)}, 0},
+		{&StatusPacket{Head: common.Hash{0x02}, Entropy: big.NewInt(100)}, StatusFieldHead},
+		{&StatusPacket{Head: common.Hash{0x01}, Entropy: big.NewInt(200)}, StatusFieldEntropy},
+		{&StatusPacket{Head: common.Hash{0x02}, Entropy: big.NewInt(200)}, StatusFieldHead | StatusFieldEntropy},
+	}
+	for i, tt := range tests {
+		delta, err := newStatusDelta(old, tt.status)
+		if err != nil {
+			t.Fatalf("test %d: failed to create delta: %v", i, err)
+		}
+		if delta.Fields != tt.fields {
+			t.Errorf("test %d: fields mismatch: have %#x, want %#x", i, delta.Fields, tt.fields)
+		}
+		status := &StatusPacket{Head: old.Head, Entropy: old.Entropy}
+		if err := delta.apply(status); err != nil {
+			t.Fatalf("test %d: failed to apply delta: %v", i, err)
+		}
+		if status.Head != tt.status.Head || status.Entropy.Cmp(tt.status.Entropy) != 0 {
+			t.Errorf("test %d: status mismatch: have %x/%v, want %x/%v", i, status.Head, status.Entropy, tt.status.Head, tt.status.Entropy)
+		}
+		if old.Entropy.Cmp(big.NewInt(100)) != 0 {
+			t.Fatalf("test %d: old status modified: entropy %v", i, old.Entropy)
+		}
+	}
+}
+
+// Tests that malformed status deltas are rejected without touching the status.
+func TestStatusDeltaInvalid(t *testing.T) {
+	head, _ := rlp.EncodeToBytes(common.Hash{0x02})
+	entropy, _ := rlp.EncodeToBytes(big.NewInt(200))
+
+	tests := []*StatusDeltaPacket{
+		{Fields: 1 << 5}, // Unknown field
+		{Fields: StatusFieldHead | StatusFieldEntropy, Values: []rlp.RawValue{head}}, // Missing value
+		{Fields: StatusFieldHead, Values: []rlp.RawValue{head, entropy}},             // Excess value
+		{Fields: StatusFieldHead, Values: []rlp.RawValue{entropy}},                   // Mistyped value
+	}
+	for i, delta := range tests {
+		status := &StatusPacket{Head: common.Hash{0x01}, Entropy: big.NewInt(100)}
+		if err := delta.apply(status); !errors.Is(err, errInvalidStatusDelta) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, errInvalidStatusDelta)
+		}
+		if status.Head != (common.Hash{0x01}) || status.Entropy.Cmp(big.NewInt(100)) != 0 {
+			t.Errorf("test %d: status modified by invalid delta: %x/%v", i, status.Head, status.Entropy)
+		}
+	}
+}
+
+// Tests that status deltas round-trip through the wire, updating the head of the
+// peer on the receiving side with single and multi-field deltas.
+func TestStatusDeltaRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		local  = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xd1}, "peer", nil), app, nil)
+		remote = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xd2}, "peer", nil), net, nil)
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	// Pretend the handshake already exchanged the statuses
+	local.announced = &StatusPacket{Head: common.Hash{0x01}, Entropy: big.NewInt(100)}
+	remote.head, remote.entropy = common.Hash{0x01}, big.NewInt(100)
+
+	tests := []struct {
+		head    common.Hash
+		entropy int64
+		fields  StatusField
+	}{
+		{common.Hash{0x02}, 100, StatusFieldHead},
+		{common.Hash{0x02}, 200, StatusFieldEntropy},
+		{common.Hash{0x03}, 300, StatusFieldHead | StatusFieldEntropy},
+	}
+	for i, tt := range tests {
+		errc := make(chan error, 1)
+		go func() { errc <- local.SendStatusDelta(tt.head, big.NewInt(tt.entropy)) }()
+
+		backend := new(mockBackend)
+		if err := handleMessage(backend, remote); err != nil {
+			t.Fatalf("test %d: failed to handle delta: %v", i, err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("test %d: failed to send delta: %v", i, err)
+		}
+		if len(backend.handled) != 1 {
+			t.Fatalf("test %d: delivered packet count mismatch: have %d, want 1", i, len(backend.handled))
+		}
+		if delta := backend.handled[0].(*StatusDeltaPacket); delta.Fields != tt.fields {
+			t.Errorf("test %d: fields mismatch: have %#x, want %#x", i, delta.Fields, tt.fields)
+		}
+		head, _, entropy, _ := remote.Head()
+		if head != tt.head || entropy.Int64() != tt.entropy {
+			t.Errorf("test %d: head mismatch: have %x/%v, want %x/%d", i, head, entropy, tt.head, tt.entropy)
+		}
+	}
+	// Unchanged statuses are not sent at all
+	if err := local.SendStatusDelta(common.Hash{0x03}, big.NewInt(300)); err != nil {
+		t.Fatalf("failed to skip empty delta: %v", err)
+	}
+}
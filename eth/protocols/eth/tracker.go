@@ -17,10 +17,40 @@
 package eth
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
+	"github.com/dominant-strategies/go-quai/metrics"
 	"github.com/dominant-strategies/go-quai/p2p/tracker"
 )
 
 // requestTracker is a singleton tracker for eth/66 and newer request times.
 var requestTracker = tracker.New(c_ProtocolName, 5*time.Minute)
+
+// lateReplyMeter counts the replies discarded for arriving after their request
+// expired.
+var lateReplyMeter = metrics.NewRegisteredMeter("eth/protocols/eth/reply/late", nil)
+
+// fulfil fills the pending request a reply of the peer answers, feeding the time
+// it took to arrive to the scorer.
+func (p *Peer) fulfil(code uint64, id uint64) error {
+	elapsed, err := requestTracker.Fulfil(p.id, p.version, code, id)
+	if err != nil {
+		return err
+	}
+	p.observe(PeerSignal{Type: PeerSignalResponse, Code: code, Latency: elapsed})
+	return nil
+}
+
+// rejectReply handles a reply of the peer which failed to fulfil a request. Late
+// replies to requests which expired are discarded, as the peer is slow but
+// honest, whereas replies to requests never made are unsolicited.
+func rejectReply(peer *Peer, code uint64, err error) error {
+	if errors.Is(err, tracker.ErrExpiredRequest) {
+		lateReplyMeter.Mark(1)
+		peer.Log().Debug("Discarding late reply", "code", code, "err", err)
+		return nil
+	}
+	return fmt.Errorf("%w: %v", errUnsolicitedResponse, err)
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/p2p/tracker"
+	"github.com/dominant-strategies/go-quai/rlp"
+)
+
+// mockBackend is a minimal Backend which only records the packets delivered
+// to it by the protocol handlers.
+type mockBackend struct {
+	caps    CapabilitiesPacket
+	run     func(peer *Peer, handler Handler) error // Peer runner, nil to return immediately
+	handled []Packet
+}
+
+func (b *mockBackend) Core() *core.Core                 { return nil }
+func (b *mockBackend) TxPool() TxPool                   { return nil }
+func (b *mockBackend) AcceptTxs() bool                  { return true }
+func (b *mockBackend) Capabilities() CapabilitiesPacket { return b.caps }
+func (b *mockBackend) PeerInfo(enode.ID) interface{}    { return nil }
+func (b *mockBackend) RunPeer(peer *Peer, handler Handler) error {
+	if b.run != nil {
+		return b.run(peer, handler)
+	}
+	return nil
+}
+func (b *mockBackend) Handle(peer *Peer, pkt Packet) error {
+	b.handled = append(b.handled, pkt)
+	return nil
+}
+
+// encodeMsg wraps a packet into a network message ready to be decoded by the
+// protocol handlers.
+func encodeMsg(t *testing.T, code uint64, packet interface{}) p2p.Msg {
+	t.Helper()
+
+	enc, err := rlp.EncodeToBytes(packet)
+	if err != nil {
+		t.Fatalf("failed to encode packet: %v", err)
+	}
+	return p2p.Msg{Code: code, Size: uint32(len(enc)), Payload: bytes.NewReader(enc)}
+}
+
+// Tests that replies which do not correspond to any request sent to the peer
+// are rejected before reaching the backend.
+func TestUnsolicitedResponses(t *testing.T) {
+	tests := []struct {
+		code    uint64
+		handler msgHandler
+		packet  interface{}
+	}{
+		{BlockHeadersMsg, handleBlockHeaders66, &BlockHeadersPacket66{RequestId: rand.Uint64()}},
+		{BlockBodiesMsg, handleBlockBodies66, &BlockBodiesPacket66{RequestId: rand.Uint64()}},
+		{BlockTxHashesMsg, handleBlockTxHashes66, &BlockTxHashesPacket66{RequestId: rand.Uint64()}},
+	}
+	for i, tt := range tests {
+		backend := new(mockBackend)
+		peer := NewPeer(ETH66, p2p.NewPeer(enode.ID{byte(i)}, "peer", nil), nil, nil)
+
+		err := tt.handler(backend, encodeMsg(t, tt.code, tt.packet), peer)
+		if !errors.Is(err, errUnsolicitedResponse) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, errUnsolicitedResponse)
+		}
+		if len(backend.handled) != 0 {
+			t.Errorf("test %d: unsolicited packet delivered to backend", i)
+		}
+		peer.Close()
+	}
+}
+
+// Tests that replies are only accepted once, from the peer they were requested
+// from and with the response code that was expected.
+func TestSolicitedResponses(t *testing.T) {
+	var (
+		backend = new(mockBackend)
+		peer    = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), nil, nil)
+		other   = NewPeer(ETH66, p2p.NewPeer(enode.ID{0x02}, "other", nil), nil, nil)
+		id      = rand.Uint64()
+	)
+	defer peer.Close()
+	defer other.Close()
+
+	requestTracker.Track(peer.id, peer.version, GetBlockHeadersMsg, BlockHeadersMsg, id)
+
+	reply := &BlockHeadersPacket66{RequestId: id, BlockHeadersPacket: []*types.Header{types.EmptyHeader()}}
+
+	// A different peer or a different reply type must not consume the request
+	if err := handleBlockHeaders66(backend, encodeMsg(t, BlockHeadersMsg, reply), other); !errors.Is(err, errUnsolicitedResponse) {
+		t.Fatalf("foreign peer reply: error mismatch: have %v, want %v", err, errUnsolicitedResponse)
+	}
+	bodies := &BlockBodiesPacket66{RequestId: id}
+	if err := handleBlockBodies66(backend, encodeMsg(t, BlockBodiesMsg, bodies), peer); !errors.Is(err, errUnsolicitedResponse) {
+		t.Fatalf("mismatched reply: error mismatch: have %v, want %v", err, errUnsolicitedResponse)
+	}
+	// The genuine reply is accepted, but only once
+	if err := handleBlockHeaders66(backend, encodeMsg(t, BlockHeadersMsg, reply), peer); err != nil {
+		t.Fatalf("solicited reply rejected: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+	}
+	if err := handleBlockHeaders66(backend, encodeMsg(t, BlockHeadersMsg, reply), peer); !errors.Is(err, errUnsolicitedResponse) {
+		t.Fatalf("duplicate reply: error mismatch: have %v, want %v", err, errUnsolicitedResponse)
+	}
+}
+
+// Tests that late replies to expired requests are discarded without dropping the
+// peer, while replies to requests never made are still reported as unsolicited.
+func TestLateResponses(t *testing.T) {
+	peer := NewPeer(ETH66, p2p.NewPeer(enode.ID{0x01}, "peer", nil), nil, nil)
+	defer peer.Close()
+
+	if err := rejectReply(peer, BlockHeadersMsg, fmt.Errorf("%w: %d", tracker.ErrExpiredRequest, 1)); err != nil {
+		t.Errorf("late reply rejected: %v", err)
+	}
+	if err := rejectReply(peer, BlockHeadersMsg, errors.New("unknown request id")); !errors.Is(err, errUnsolicitedResponse) {
+		t.Errorf("unsolicited reply error mismatch: have %v, want %v", err, errUnsolicitedResponse)
+	}
+}
+
+// Tests that messages whose replies don't echo the request id, or which aren't
+// requests at all, are not tracked, as nothing would ever fulfil them.
+func TestUntrackedMessages(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	peer := NewPeer(ETH66, p2p.NewPeer(enode.ID{0x03}, "peer", nil), net, nil)
+	defer peer.Close()
+
+	go func() {
+		for {
+			msg, err := app.ReadMsg()
+			if err != nil {
+				return
+			}
+			msg.Discard()
+		}
+	}()
+	if err := peer.SendPendingEtxsRollup(types.PendingEtxsRollup{Header: types.EmptyHeader()}); err != nil {
+		t.Fatalf("failed to send rollup: %v", err)
+	}
+	if err := peer.RequestOnePendingEtxs(common.Hash{0x01}); err != nil {
+		t.Fatalf("failed to request pending etxs: %v", err)
+	}
+	if err := peer.RequestOnePendingEtxsRollup(common.Hash{0x02}); err != nil {
+		t.Fatalf("failed to request rollup: %v", err)
+	}
+	for _, code := range []uint64{PendingEtxsMsg, PendingEtxsRollupMsg} {
+		if id, ok := requestTracker.Oldest(peer.id, peer.version, code); ok {
+			t.Errorf("code %#x: request %d tracked", code, id)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/crypto"
+	"github.com/dominant-strategies/go-quai/ethdb/memorydb"
+	"github.com/dominant-strategies/go-quai/log"
+	"github.com/dominant-strategies/go-quai/rlp"
+	"github.com/dominant-strategies/go-quai/trie"
+)
+
+// proofSet collects the distinct trie nodes of several merkle proofs, in the
+// order they are first met.
+type proofSet struct {
+	seen  map[common.Hash]bool
+	nodes [][]byte
+	size  int
+}
+
+func (s *proofSet) Put(key []byte, value []byte) error {
+	if hash := common.BytesToHash(key); !s.seen[hash] {
+		s.seen[hash] = true
+		s.nodes = append(s.nodes, value)
+		s.size += len(value)
+	}
+	return nil
+}
+
+func (s *proofSet) Delete(key []byte) error {
+	return errors.New("deletion not supported")
+}
+
+// proveTxNonInclusion derives the transaction trie root of a list of transactions
+// the same way as the headers commit to it, along with the trie nodes opening
+// every index of the trie and the first index past them. Proofs growing beyond
+// softResponseLimit are abandoned, returning nil nodes.
+func proveTxNonInclusion(txs types.Transactions) (common.Hash, [][]byte, error) {
+	tr, err := trie.New(common.Hash{}, trie.NewDatabase(memorydb.New()))
+	if err != nil {
+		return common.Hash{}, nil, err
+	}
+	root := types.DeriveSha(txs, tr)
+
+	proof := &proofSet{seen: make(map[common.Hash]bool)}
+	for i := 0; i <= len(txs); i++ {
+		if err := tr.Prove(rlp.AppendUint64(nil, uint64(i)), 0, proof); err != nil {
+			return common.Hash{}, nil, err
+		}
+		if proof.size > softResponseLimit {
+			return root, nil, nil
+		}
+	}
+	return root, proof.nodes, nil
+}
+
+// answerGetTxNonInclusionProofQuery opens the whole transaction trie of a block,
+// from which the absence of any transaction can be verified. The proof doesn't
+// depend on the queried transaction, proving the presence of an included one
+// failing on the verifier's side. Nothing is proven if the block is unknown, if
+// its stored body doesn't match the header, or if the proof would grow beyond
+// softResponseLimit.
+func answerGetTxNonInclusionProofQuery(chain chainReader, query GetTxNonInclusionProofPacket) TxNonInclusionProofPacket {
+	header := chain.GetHeaderByHash(query.Hash)
+	if header == nil {
+		return TxNonInclusionProofPacket{}
+	}
+	blob := chain.GetBodyRLP(query.Hash)
+	if len(blob) == 0 {
+		return TxNonInclusionProofPacket{}
+	}
+	body := new(BlockBody)
+	if err := rlp.DecodeBytes(blob, body); err != nil {
+		log.Error("Failed to decode stored block body", "hash", query.Hash, "err", err)
+		return TxNonInclusionProofPacket{}
+	}
+	root, proof, err := proveTxNonInclusion(body.Transactions)
+	if err != nil {
+		log.Error("Failed to prove transaction trie", "hash", query.Hash, "err", err)
+		return TxNonInclusionProofPacket{}
+	}
+	// Stale bodies and oversized proofs can't prove anything against the header
+	if root != header.TxHash() || proof == nil {
+		return TxNonInclusionProofPacket{}
+	}
+	return TxNonInclusionProofPacket{Count: uint64(len(body.Transactions)), Proof: proof}
+}
+
+// VerifyTxNonInclusionProof checks that a non-inclusion proof shows the given
+// transaction absent from the transaction trie of the given header. Every index
+// up to the proven count must be opened, none of them holding the transaction,
+// and the index past them must be proven empty, the trie of a block holding its
+// transactions at consecutive indices.
+func VerifyTxNonInclusionProof(header *types.Header, txHash common.Hash, proof *TxNonInclusionProofPacket) error {
+	root := header.TxHash()
+	if root == types.EmptyRootHash {
+		if proof.Count != 0 {
+			return fmt.Errorf("%w: %d transactions in empty trie", errInvalidTxProof, proof.Count)
+		}
+		return nil
+	}
+	nodes := memorydb.New()
+	for _, node := range proof.Proof {
+		nodes.Put(crypto.Keccak256(node), node)
+	}
+	// The transactions are stored in their typed encoding, which hashes to the
+	// transaction hash
+	for i := uint64(0); i < proof.Count; i++ {
+		value, err := trie.VerifyProof(root, rlp.AppendUint64(nil, i), nodes)
+		if err != nil {
+			return fmt.Errorf("%w: index %d: %v", errInvalidTxProof, i, err)
+		}
+		if value == nil {
+			return fmt.Errorf("%w: index %d empty, %d transactions proven", errInvalidTxProof, i, proof.Count)
+		}
+		if crypto.Keccak256Hash(value) == txHash {
+			return fmt.Errorf("%w: %x at index %d", errTxIncluded, txHash, i)
+		}
+	}
+	value, err := trie.VerifyProof(root, rlp.AppendUint64(nil, proof.Count), nodes)
+	if err != nil {
+		return fmt.Errorf("%w: index %d: %v", errInvalidTxProof, proof.Count, err)
+	}
+	if value != nil {
+		return fmt.Errorf("%w: index %d past the %d transactions proven not empty", errInvalidTxProof, proof.Count, proof.Count)
+	}
+	return nil
+}
+
+// ReplyTxNonInclusionProof is the eth/67 response to GetTxNonInclusionProof.
+func (p *Peer) ReplyTxNonInclusionProof(id uint64, proof TxNonInclusionProofPacket) error {
+	return send(p.rw, TxNonInclusionProofMsg, &TxNonInclusionProofPacket66{
+		RequestId:                 id,
+		TxNonInclusionProofPacket: proof,
+	})
+}
+
+// RequestTxNonInclusionProof fetches the proof that a transaction is not part of
+// the transaction trie of a block.
+func (p *Peer) RequestTxNonInclusionProof(hash common.Hash, txHash common.Hash) error {
+	return p.requestTxNonInclusionProof(rand.Uint64(), hash, txHash)
+}
+
+// FetchTxNonInclusionProof retrieves the proof that a transaction is not part of
+// the transaction trie of a block, waiting for the reply up to the given timeout.
+// The proof still needs to be checked with VerifyTxNonInclusionProof.
+func (p *Peer) FetchTxNonInclusionProof(hash common.Hash, txHash common.Hash, timeout time.Duration) (*TxNonInclusionProofPacket, error) {
+	res, err := p.fetch(fmt.Sprintf("non-inclusion proof of %x in %x", txHash, hash), timeout, func(id uint64) error {
+		return p.requestTxNonInclusionProof(id, hash, txHash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*TxNonInclusionProofPacket), nil
+}
+
+// requestTxNonInclusionProof sends a non-inclusion proof request under the given id.
+func (p *Peer) requestTxNonInclusionProof(id uint64, hash common.Hash, txHash common.Hash) error {
+	p.Log().Debug("Fetching transaction non-inclusion proof", "hash", hash, "tx", txHash)
+	if err := p.checkOptional(GetTxNonInclusionProofMsg); err != nil {
+		return err
+	}
+	requestTracker.Track(p.id, p.version, GetTxNonInclusionProofMsg, TxNonInclusionProofMsg, id)
+	return send(p.rw, GetTxNonInclusionProofMsg, &GetTxNonInclusionProofPacket66{
+		RequestId: id,
+		GetTxNonInclusionProofPacket: GetTxNonInclusionProofPacket{
+			Hash:   hash,
+			TxHash: txHash,
+		},
+	})
+}
@@ -0,0 +1,175 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/trie"
+)
+
+// newTxProofChain creates a test chain with a block holding the given number of
+// transactions, returning its header and transactions.
+func newTxProofChain(size int) (*testChain, *types.Header, types.Transactions) {
+	chain := newTestChain(1)
+
+	txs := types.Transactions(newTestTransactions(size))
+	header := types.EmptyHeader()
+	header.SetNumber(big.NewInt(2))
+	header.SetTxHash(types.DeriveSha(txs, trie.NewStackTrie(nil)))
+
+	chain.headers[header.Hash()] = header
+	chain.addBody(header.Hash(), &types.Body{Transactions: txs})
+	return chain, header, txs
+}
+
+// Tests that non-inclusion proofs verify for transactions absent from a block,
+// and fail for the ones it includes.
+func TestTxNonInclusionProof(t *testing.T) {
+	absent := types.NewTx(&types.InternalTx{ChainID: big.NewInt(1), Nonce: 1000, GasTipCap: big.NewInt(1), GasFeeCap: big.NewInt(1), Value: big.NewInt(1)})
+
+	// Span empty blocks, single node tries and the reordered insertion of the
+	// first 128 indices
+	for _, size := range []int{0, 1, 2, 16, 130} {
+		chain, header, txs := newTxProofChain(size)
+
+		proof := answerGetTxNonInclusionProofQuery(chain, GetTxNonInclusionProofPacket{Hash: header.Hash(), TxHash: absent.Hash()})
+		if proof.Count != uint64(size) {
+			t.Fatalf("size %d: proven transaction count mismatch: have %d, want %d", size, proof.Count, size)
+		}
+		if err := VerifyTxNonInclusionProof(header, absent.Hash(), &proof); err != nil {
+			t.Errorf("size %d: failed to verify absent transaction: %v", size, err)
+		}
+		for i, tx := range txs {
+			if err := VerifyTxNonInclusionProof(header, tx.Hash(), &proof); !errors.Is(err, errTxIncluded) {
+				t.Errorf("size %d, tx %d: verification error mismatch: have %v, want %v", size, i, err, errTxIncluded)
+			}
+		}
+	}
+}
+
+// Tests that nothing is proven for unknown blocks, or blocks whose stored body
+// doesn't match the header.
+func TestTxNonInclusionProofUnavailable(t *testing.T) {
+	chain, header, _ := newTxProofChain(4)
+
+	stale := types.EmptyHeader()
+	stale.SetNumber(big.NewInt(3))
+	stale.SetTxHash(common.Hash{0x01})
+	chain.headers[stale.Hash()] = stale
+	chain.addBody(stale.Hash(), &types.Body{Transactions: newTestTransactions(2)})
+
+	for i, hash := range []common.Hash{{0xff}, stale.Hash()} {
+		proof := answerGetTxNonInclusionProofQuery(chain, GetTxNonInclusionProofPacket{Hash: hash})
+		if proof.Count != 0 || len(proof.Proof) != 0 {
+			t.Errorf("test %d: unavailable proof served: %d transactions, %d nodes", i, proof.Count, len(proof.Proof))
+		}
+	}
+	// An empty proof can't vouch for a block with transactions
+	if err := VerifyTxNonInclusionProof(header, common.Hash{0xff}, new(TxNonInclusionProofPacket)); !errors.Is(err, errInvalidTxProof) {
+		t.Errorf("empty proof error mismatch: have %v, want %v", err, errInvalidTxProof)
+	}
+}
+
+// Tests that tampered non-inclusion proofs are rejected, in particular ones
+// hiding transactions by understating the size of the trie.
+func TestVerifyTxNonInclusionProofTampered(t *testing.T) {
+	chain, header, txs := newTxProofChain(16)
+
+	tamper := []func(p *TxNonInclusionProofPacket) common.Hash{
+		// Hiding the last transaction
+		func(p *TxNonInclusionProofPacket) common.Hash { p.Count--; return txs[15].Hash() },
+		// Claiming transactions past the end
+		func(p *TxNonInclusionProofPacket) common.Hash { p.Count++; return common.Hash{0xff} },
+		// Dropping proof nodes
+		func(p *TxNonInclusionProofPacket) common.Hash { p.Proof = p.Proof[1:]; return common.Hash{0xff} },
+		// Claiming an empty block
+		func(p *TxNonInclusionProofPacket) common.Hash { p.Count = 0; return txs[0].Hash() },
+	}
+	for i, fn := range tamper {
+		proof := answerGetTxNonInclusionProofQuery(chain, GetTxNonInclusionProofPacket{Hash: header.Hash()})
+		target := fn(&proof)
+		if err := VerifyTxNonInclusionProof(header, target, &proof); !errors.Is(err, errInvalidTxProof) {
+			t.Errorf("tamper %d: verification error mismatch: have %v, want %v", i, err, errInvalidTxProof)
+		}
+	}
+}
+
+// Tests that non-inclusion proofs round-trip through the wire, and that the
+// request is refused to peers older than eth/67.
+func TestTxNonInclusionProofRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		chain, header, txs = newTxProofChain(8)
+		absent             = common.Hash{0xff}
+
+		local  = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xed, 0x01}, "peer", nil), net, nil)
+		remote = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xed, 0x02}, "peer", nil), app, nil)
+	)
+	defer local.Close()
+	defer remote.Close()
+
+	advertiseOptional(local, GetTxNonInclusionProofMsg)
+	go local.RequestTxNonInclusionProof(header.Hash(), absent)
+
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read request: %v", err)
+	}
+	if msg.Code != GetTxNonInclusionProofMsg {
+		t.Fatalf("request code mismatch: have %#x, want %#x", msg.Code, GetTxNonInclusionProofMsg)
+	}
+	var query GetTxNonInclusionProofPacket66
+	if err := msg.Decode(&query); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	if query.Hash != header.Hash() || query.TxHash != absent {
+		t.Fatalf("request mismatch: have %+v", query.GetTxNonInclusionProofPacket)
+	}
+	go remote.ReplyTxNonInclusionProof(query.RequestId, answerGetTxNonInclusionProofQuery(chain, query.GetTxNonInclusionProofPacket))
+
+	backend := new(mockBackend)
+	if err := handleMessage(backend, local); err != nil {
+		t.Fatalf("failed to handle reply: %v", err)
+	}
+	if len(backend.handled) != 1 {
+		t.Fatalf("delivered packet count mismatch: have %d, want %d", len(backend.handled), 1)
+	}
+	proof := backend.handled[0].(*TxNonInclusionProofPacket)
+	if err := VerifyTxNonInclusionProof(header, absent, proof); err != nil {
+		t.Errorf("failed to verify delivered proof of absent transaction: %v", err)
+	}
+	if err := VerifyTxNonInclusionProof(header, txs[3].Hash(), proof); !errors.Is(err, errTxIncluded) {
+		t.Errorf("delivered proof of included transaction error mismatch: have %v, want %v", err, errTxIncluded)
+	}
+	// Peers older than eth/67 can't be asked
+	old := NewPeer(ETH66, p2p.NewPeer(enode.ID{0xed, 0x03}, "peer", nil), net, nil)
+	defer old.Close()
+
+	if err := old.RequestTxNonInclusionProof(header.Hash(), absent); err == nil {
+		t.Errorf("eth/66 peer accepted non-inclusion proof request")
+	}
+}
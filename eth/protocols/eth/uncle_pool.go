@@ -0,0 +1,125 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+)
+
+// unclePoolDepth is the number of heights below the next block at which side
+// blocks may still be included as uncles by the consensus engines.
+const unclePoolDepth = 7
+
+// uncleReader defines the blockchain methods needed to serve the uncle pool.
+type uncleReader interface {
+	// CurrentBlock retrieves the head of the canonical chain.
+	CurrentBlock() *types.Block
+
+	// GetCanonicalHash retrieves the hash of the canonical block at a height.
+	GetCanonicalHash(number uint64) common.Hash
+
+	// GetHashesByNumber retrieves the hashes of all the headers stored at a
+	// height, canonical or not.
+	GetHashesByNumber(number uint64) []common.Hash
+
+	// GetUnclesInChain retrieves the uncles included in the given block and its
+	// ancestors, up to the given depth.
+	GetUnclesInChain(block *types.Block, length int) []*types.Header
+}
+
+// answerGetUnclePoolQuery collects the side blocks known to the local chain
+// which could still be included as uncles by the next block, but weren't yet.
+// Heights are visited from the head backwards, so that the candidates most
+// likely to be of use come first if the pool is truncated. Pools are bounded
+// by the query limit and by maxUnclePoolServe, and queries for no candidates
+// are rejected.
+func answerGetUnclePoolQuery(chain uncleReader, query GetUnclePoolPacket) (UnclePoolPacket, error) {
+	if query.Limit == 0 {
+		return nil, fmt.Errorf("%w: empty uncle pool requested", errInvalidQuery)
+	}
+	limit := query.Limit
+	if limit > maxUnclePoolServe {
+		limit = maxUnclePoolServe
+	}
+	head := chain.CurrentBlock()
+	if head == nil {
+		return nil, nil
+	}
+	included := make(map[common.Hash]struct{})
+	for _, uncle := range chain.GetUnclesInChain(head, unclePoolDepth) {
+		included[uncle.Hash()] = struct{}{}
+	}
+	var pool UnclePoolPacket
+	for number := head.NumberU64(); number > 0 && head.NumberU64()-number < unclePoolDepth; number-- {
+		canonical := chain.GetCanonicalHash(number)
+		for _, hash := range chain.GetHashesByNumber(number) {
+			if hash == canonical {
+				continue
+			}
+			if _, ok := included[hash]; ok {
+				continue
+			}
+			if uint64(len(pool)) >= limit {
+				return pool, nil
+			}
+			pool = append(pool, UncleCandidate{Hash: hash, Number: number})
+		}
+	}
+	return pool, nil
+}
+
+// sanityCheck verifies that an uncle pool is within the serving limit.
+func (p *UnclePoolPacket) sanityCheck() error {
+	if len(*p) > maxUnclePoolServe {
+		return fmt.Errorf("%w: %d candidates, limit %d", errInvalidUnclePool, len(*p), maxUnclePoolServe)
+	}
+	return nil
+}
+
+// ReplyUnclePool is the eth/67 response to GetUnclePool.
+func (p *Peer) ReplyUnclePool(id uint64, pool UnclePoolPacket) error {
+	// Mark all the side blocks as known, but ensure we don't overflow our limits
+	for _, uncle := range pool {
+		p.markBlock(uncle.Hash)
+	}
+	return send(p.rw, UnclePoolMsg, &UnclePoolPacket66{
+		RequestId:       id,
+		UnclePoolPacket: pool,
+	})
+}
+
+// RequestUnclePool fetches up to limit uncle candidates of the remote chain. The
+// side blocks not known locally are then retrieved like announced ones.
+func (p *Peer) RequestUnclePool(limit uint64) error {
+	p.Log().Debug("Fetching uncle pool", "limit", limit)
+	if err := p.checkOptional(GetUnclePoolMsg); err != nil {
+		return err
+	}
+	id := rand.Uint64()
+
+	requestTracker.Track(p.id, p.version, GetUnclePoolMsg, UnclePoolMsg, id)
+	return send(p.rw, GetUnclePoolMsg, &GetUnclePoolPacket66{
+		RequestId: id,
+		GetUnclePoolPacket: GetUnclePoolPacket{
+			Limit: limit,
+		},
+	})
+}
@@ -0,0 +1,224 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// uncleChain is a chain of canonical blocks with side blocks stored alongside,
+// some of which were included as uncles.
+type uncleChain struct {
+	head     *types.Block
+	side     map[uint64][]common.Hash
+	included []*types.Header
+}
+
+// newUncleChain creates a chain with the given head number and no side blocks.
+func newUncleChain(head uint64) *uncleChain {
+	return &uncleChain{
+		head: newTestBlock(head),
+		side: make(map[uint64][]common.Hash),
+	}
+}
+
+// addSide stores a side block at the given height, included as an uncle if set.
+func (c *uncleChain) addSide(number uint64, id byte, included bool) common.Hash {
+	header := types.EmptyHeader()
+	header.SetNumber(new(big.Int).SetUint64(number))
+	header.SetExtra([]byte{id})
+
+	c.side[number] = append(c.side[number], header.Hash())
+	if included {
+		c.included = append(c.included, header)
+	}
+	return header.Hash()
+}
+
+func (c *uncleChain) CurrentBlock() *types.Block { return c.head }
+
+func (c *uncleChain) GetCanonicalHash(number uint64) common.Hash {
+	return common.Hash{0xca, byte(number)}
+}
+
+func (c *uncleChain) GetHashesByNumber(number uint64) []common.Hash {
+	return append([]common.Hash{c.GetCanonicalHash(number)}, c.side[number]...)
+}
+
+func (c *uncleChain) GetUnclesInChain(block *types.Block, length int) []*types.Header {
+	return c.included
+}
+
+// Tests that uncle pools list the side blocks not included yet within the uncle
+// inclusion window, newest first and within the requested limit, and that
+// chains without side blocks have an empty pool.
+func TestGetUnclePool(t *testing.T) {
+	chain := newUncleChain(10)
+
+	var (
+		head1    = chain.addSide(10, 0x01, false)
+		head2    = chain.addSide(10, 0x02, false)
+		_        = chain.addSide(9, 0x03, true) // Already included
+		deep     = chain.addSide(4, 0x04, false)
+		_        = chain.addSide(3, 0x05, false) // Too deep to be included
+		recent   = chain.addSide(8, 0x06, false)
+		included = chain.addSide(8, 0x07, true)
+	)
+	tests := []struct {
+		chain *uncleChain
+		limit uint64
+		pool  UnclePoolPacket
+	}{
+		// Populated pools, possibly truncated
+		{chain, 16, UnclePoolPacket{{head1, 10}, {head2, 10}, {recent, 8}, {deep, 4}}},
+		{chain, 3, UnclePoolPacket{{head1, 10}, {head2, 10}, {recent, 8}}},
+		{chain, 1, UnclePoolPacket{{head1, 10}}},
+
+		// Empty pools
+		{newUncleChain(10), 16, nil},
+		{newUncleChain(0), 16, nil},
+	}
+	for i, tt := range tests {
+		pool, err := answerGetUnclePoolQuery(tt.chain, GetUnclePoolPacket{Limit: tt.limit})
+		if err != nil {
+			t.Errorf("test %d: failed to answer query: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(pool, tt.pool) {
+			t.Errorf("test %d: pool mismatch: have %v, want %v", i, pool, tt.pool)
+		}
+		for _, uncle := range pool {
+			if uncle.Hash == included {
+				t.Errorf("test %d: included uncle %x listed", i, included)
+			}
+		}
+	}
+	// Pools are capped at the serving limit, and queries for nothing rejected
+	crowded := newUncleChain(10)
+	for i := 0; i < maxUnclePoolServe+10; i++ {
+		crowded.addSide(10, byte(i), false)
+	}
+	pool, err := answerGetUnclePoolQuery(crowded, GetUnclePoolPacket{Limit: 2 * maxUnclePoolServe})
+	if err != nil {
+		t.Fatalf("failed to answer oversized query: %v", err)
+	}
+	if len(pool) != maxUnclePoolServe {
+		t.Errorf("oversized pool length mismatch: have %d, want %d", len(pool), maxUnclePoolServe)
+	}
+	if _, err := answerGetUnclePoolQuery(chain, GetUnclePoolPacket{}); !errors.Is(err, errInvalidQuery) {
+		t.Errorf("empty query error mismatch: have %v, want %v", err, errInvalidQuery)
+	}
+}
+
+// Tests that oversized uncle pools are rejected.
+func TestUnclePoolSanityCheck(t *testing.T) {
+	tests := []struct {
+		pool  UnclePoolPacket
+		valid bool
+	}{
+		{UnclePoolPacket{}, true},
+		{make(UnclePoolPacket, maxUnclePoolServe), true},
+		{make(UnclePoolPacket, maxUnclePoolServe+1), false},
+	}
+	for i, tt := range tests {
+		err := tt.pool.sanityCheck()
+		if tt.valid && err != nil {
+			t.Errorf("test %d: valid pool rejected: %v", i, err)
+		}
+		if !tt.valid && !errors.Is(err, errInvalidUnclePool) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, errInvalidUnclePool)
+		}
+	}
+}
+
+// Tests that uncle pools round-trip through the wire, populated or empty, and
+// mark the candidates as known to the peer.
+func TestUnclePoolRoundTrip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	defer net.Close()
+
+	var (
+		chain  = newUncleChain(10)
+		local  = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xf0, 0x01}, "peer", nil), net, nil)
+		remote = NewPeer(ETH67, p2p.NewPeer(enode.ID{0xf0, 0x02}, "peer", nil), app, nil)
+	)
+	defer local.Close()
+	defer remote.Close()
+	advertiseOptional(local, GetUnclePoolMsg)
+
+	chain.addSide(10, 0x01, false)
+	chain.addSide(9, 0x02, false)
+
+	backend := new(mockBackend)
+	for i, populated := range []bool{true, false} {
+		go local.RequestUnclePool(16)
+
+		msg, err := app.ReadMsg()
+		if err != nil {
+			t.Fatalf("test %d: failed to read request: %v", i, err)
+		}
+		if msg.Code != GetUnclePoolMsg {
+			t.Fatalf("test %d: request code mismatch: have %#x, want %#x", i, msg.Code, GetUnclePoolMsg)
+		}
+		var query GetUnclePoolPacket66
+		if err := msg.Decode(&query); err != nil {
+			t.Fatalf("test %d: failed to decode request: %v", i, err)
+		}
+		if query.Limit != 16 {
+			t.Fatalf("test %d: request mismatch: have %+v", i, query.GetUnclePoolPacket)
+		}
+		var want UnclePoolPacket
+		if populated {
+			if want, err = answerGetUnclePoolQuery(chain, query.GetUnclePoolPacket); err != nil {
+				t.Fatalf("test %d: failed to answer query: %v", i, err)
+			}
+		}
+		go remote.ReplyUnclePool(query.RequestId, want)
+
+		if err := handleMessage(backend, local); err != nil {
+			t.Fatalf("test %d: failed to handle reply: %v", i, err)
+		}
+		if len(backend.handled) != i+1 {
+			t.Fatalf("test %d: delivered packet count mismatch: have %d, want %d", i, len(backend.handled), i+1)
+		}
+		pool := *backend.handled[i].(*UnclePoolPacket)
+		if len(pool) != len(want) || (len(want) > 0 && !reflect.DeepEqual(pool, want)) {
+			t.Fatalf("test %d: delivered pool mismatch: have %v, want %v", i, pool, want)
+		}
+		for _, uncle := range pool {
+			if !local.KnownBlock(uncle.Hash) {
+				t.Errorf("test %d: uncle %x not marked known to the requester", i, uncle.Hash)
+			}
+			if !remote.KnownBlock(uncle.Hash) {
+				t.Errorf("test %d: uncle %x not marked known to the server", i, uncle.Hash)
+			}
+		}
+	}
+	// Peers not advertising the uncle pool can't be asked
+	if err := remote.RequestUnclePool(16); !errors.Is(err, errOptionalNotSupported) {
+		t.Errorf("unadvertised request error mismatch: have %v, want %v", err, errOptionalNotSupported)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/common/mclock"
+	"github.com/dominant-strategies/go-quai/eth/ethconfig"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+)
+
+// errPeerQuarantined is returned if a peer quarantined for repeatedly failing
+// validation attempts to connect.
+var errPeerQuarantined = errors.New("peer quarantined")
+
+// quarantineRecord is the validation history of a node.
+type quarantineRecord struct {
+	failures int            // Validation failures since the last quarantine
+	strikes  int            // Number of quarantines imposed on the node
+	until    mclock.AbsTime // End of the current quarantine
+	last     mclock.AbsTime // Time of the last failure
+}
+
+// quarantine keeps nodes whose peers are repeatedly dropped for delivering data
+// failing validation from reconnecting, as disconnecting them alone doesn't stop
+// them from coming right back. Each quarantine of a node lasts twice as long as
+// the previous one. Nodes behaving for the maximum backoff after their last
+// failure are forgotten.
+type quarantine struct {
+	config ethconfig.QuarantineConfig
+	clock  mclock.Clock
+	nodes  map[enode.ID]*quarantineRecord
+	lock   sync.Mutex
+}
+
+// newQuarantine creates an empty quarantine with the given backoff schedule.
+func newQuarantine(config ethconfig.QuarantineConfig, clock mclock.Clock) *quarantine {
+	return &quarantine{
+		config: config,
+		clock:  clock,
+		nodes:  make(map[enode.ID]*quarantineRecord),
+	}
+}
+
+// fail records a validation failure of a node, quarantining it if it reached the
+// failure threshold. The duration of the imposed quarantine is returned, zero if
+// the node wasn't quarantined.
+func (q *quarantine) fail(id enode.ID) time.Duration {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.config.Threshold <= 0 {
+		return 0
+	}
+	now := q.clock.Now()
+	q.prune(now)
+
+	record := q.nodes[id]
+	if record == nil {
+		record = new(quarantineRecord)
+		q.nodes[id] = record
+	}
+	record.last = now
+	if record.failures++; record.failures < q.config.Threshold {
+		return 0
+	}
+	backoff := q.backoff(record.strikes)
+	record.failures = 0
+	record.strikes++
+	record.until = now.Add(backoff)
+	return backoff
+}
+
+// backoff returns the duration of the quarantine imposed on a node already
+// quarantined the given number of times.
+func (q *quarantine) backoff(strikes int) time.Duration {
+	backoff := q.config.Backoff
+	for i := 0; i < strikes && backoff < q.config.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if q.config.MaxBackoff > 0 && backoff > q.config.MaxBackoff {
+		backoff = q.config.MaxBackoff
+	}
+	return backoff
+}
+
+// prune forgets the nodes which behaved for the maximum backoff since their
+// last failure and are not quarantined.
+func (q *quarantine) prune(now mclock.AbsTime) {
+	for id, record := range q.nodes {
+		if now >= record.until && time.Duration(now-record.last) > q.config.MaxBackoff {
+			delete(q.nodes, id)
+		}
+	}
+}
+
+// remaining returns how long a node is still quarantined for, zero if it may
+// connect.
+func (q *quarantine) remaining(id enode.ID) time.Duration {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	record := q.nodes[id]
+	if record == nil {
+		return 0
+	}
+	if now := q.clock.Now(); now < record.until {
+		return time.Duration(record.until - now)
+	}
+	return 0
+}
+
+// admits reports whether a node may be dialed, filtering the dial candidates.
+func (q *quarantine) admits(node *enode.Node) bool {
+	return q.remaining(node.ID()) == 0
+}
+
+// checkQuarantine refuses a connecting peer if its node is quarantined.
+func (h *handler) checkQuarantine(peer *eth.Peer) error {
+	if wait := h.quarantine.remaining(peer.Peer.ID()); wait > 0 {
+		return fmt.Errorf("%w: %v left", errPeerQuarantined, common.PrettyDuration(wait))
+	}
+	return nil
+}
+
+// recordDrop tracks the disconnection of a peer, quarantining its node if it
+// was dropped for delivering invalid data too many times.
+func (h *handler) recordDrop(peer *eth.Peer, err error) {
+	if !eth.IsValidationFailure(err) {
+		return
+	}
+	if backoff := h.quarantine.fail(peer.Peer.ID()); backoff > 0 {
+		peer.Log().Warn("Quarantined peer failing validation", "duration", common.PrettyDuration(backoff), "err", err)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/common/mclock"
+	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/eth/ethconfig"
+	"github.com/dominant-strategies/go-quai/eth/protocols/eth"
+	"github.com/dominant-strategies/go-quai/p2p"
+	"github.com/dominant-strategies/go-quai/p2p/enode"
+	"github.com/dominant-strategies/go-quai/p2p/enr"
+)
+
+// Tests that nodes are quarantined once reaching the failure threshold, for
+// twice as long every time up to the maximum, and forgotten after behaving.
+func TestQuarantineBackoff(t *testing.T) {
+	var (
+		clock = new(mclock.Simulated)
+		q     = newQuarantine(ethconfig.QuarantineConfig{Threshold: 2, Backoff: time.Minute, MaxBackoff: 5 * time.Minute}, clock)
+		node  = enode.ID{0xea, 0x01}
+	)
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		if backoff := q.fail(node); backoff != 0 {
+			t.Fatalf("quarantine %d: quarantined below the threshold for %v", i, backoff)
+		}
+		if backoff := q.fail(node); backoff != want {
+			t.Fatalf("quarantine %d: backoff mismatch: have %v, want %v", i, backoff, want)
+		}
+		if wait := q.remaining(node); wait != want {
+			t.Errorf("quarantine %d: remaining time mismatch: have %v, want %v", i, wait, want)
+		}
+		if q.admits(enode.SignNull(new(enr.Record), node)) {
+			t.Errorf("quarantine %d: quarantined node admitted for dialing", i)
+		}
+		clock.Run(want)
+		if wait := q.remaining(node); wait != 0 {
+			t.Errorf("quarantine %d: node still quarantined for %v after the backoff", i, wait)
+		}
+	}
+	// Other nodes are unaffected, and behaving nodes start over
+	if wait := q.remaining(enode.ID{0xea, 0x02}); wait != 0 {
+		t.Errorf("unrelated node quarantined for %v", wait)
+	}
+	clock.Run(5*time.Minute + time.Second)
+	q.fail(node)
+	if backoff := q.fail(node); backoff != time.Minute {
+		t.Errorf("backoff after behaving mismatch: have %v, want %v", backoff, time.Minute)
+	}
+}
+
+// Tests that a peer repeatedly dropped for delivering invalid data is refused on
+// reconnect, for an increasing duration every time it reoffends, while peers
+// dropped for other reasons are not.
+func TestQuarantineValidationFailures(t *testing.T) {
+	clock := new(mclock.Simulated)
+	h := &handler{
+		quarantine: newQuarantine(ethconfig.QuarantineConfig{Threshold: 3, Backoff: time.Minute, MaxBackoff: time.Hour}, clock),
+	}
+	node := enode.ID{0xea, 0x03}
+
+	// connect runs a connection of the node, sending it the given pending etxs
+	// rollup, or disconnecting if nil, and returns the reason it was refused or
+	// dropped for.
+	connect := func(rollup *eth.PendingEtxsRollupPacket) (error, error) {
+		app, net := p2p.MsgPipe()
+		defer app.Close()
+		defer net.Close()
+
+		peer := eth.NewPeer(eth.ETH66, p2p.NewPeer(node, "peer", nil), net, nil)
+		defer peer.Close()
+
+		if err := h.checkQuarantine(peer); err != nil {
+			return err, nil
+		}
+		if rollup != nil {
+			go p2p.Send(app, eth.PendingEtxsRollupMsg, rollup)
+		} else {
+			app.Close()
+		}
+		err := eth.Handle((*ethHandler)(h), peer)
+		h.recordDrop(peer, err)
+		return nil, err
+	}
+	// A rollup whose manifest doesn't match the header commitment
+	header := types.EmptyHeader()
+	header.SetManifestHash(common.Hash{0x01}, common.ZONE_CTX)
+	invalid := &eth.PendingEtxsRollupPacket{PendingEtxsRollup: types.PendingEtxsRollup{Header: header, Manifest: types.BlockManifest{{0x02}}}}
+
+	// Drops for other reasons don't count as validation failures
+	for i := 0; i < 5; i++ {
+		refused, err := connect(nil)
+		if refused != nil {
+			t.Fatalf("peer dropped without failing validation refused: %v", refused)
+		}
+		if err == nil || eth.IsValidationFailure(err) {
+			t.Fatalf("disconnect classified as validation failure: %v", err)
+		}
+	}
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		// Drive the peer past the failure threshold
+		for j := 0; j < 3; j++ {
+			refused, err := connect(invalid)
+			if refused != nil {
+				t.Fatalf("quarantine %d, failure %d: peer refused below the threshold: %v", i, j, refused)
+			}
+			if !eth.IsValidationFailure(err) {
+				t.Fatalf("quarantine %d, failure %d: drop not classified as validation failure: %v", i, j, err)
+			}
+		}
+		// Reconnects are refused until the backoff passes
+		if refused, _ := connect(invalid); !errors.Is(refused, errPeerQuarantined) {
+			t.Fatalf("quarantine %d: reconnect error mismatch: have %v, want %v", i, refused, errPeerQuarantined)
+		}
+		if wait := h.quarantine.remaining(node); wait != want {
+			t.Errorf("quarantine %d: backoff mismatch: have %v, want %v", i, wait, want)
+		}
+		clock.Run(want - time.Second)
+		if refused, _ := connect(invalid); !errors.Is(refused, errPeerQuarantined) {
+			t.Fatalf("quarantine %d: reconnect before the backoff passed not refused: %v", i, refused)
+		}
+		clock.Run(time.Second)
+	}
+}
@@ -250,7 +250,7 @@ func (cs *chainSyncer) nextSyncOp() *chainSyncOp {
 		return nil
 	}
 
-	peer := cs.handler.peers.peerWithHighestEntropy()
+	peer := cs.handler.peers.peerWithHighestScore()
 	if peer == nil {
 		return nil
 	}
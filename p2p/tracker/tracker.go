@@ -18,6 +18,7 @@ package tracker
 
 import (
 	"container/list"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -43,6 +44,25 @@ const (
 	// pending requests the node will track. It should never be hit unless an
 	// attacker figures out a way to spin requests.
 	maxTrackedPackets = 100000
+
+	// maxLostPackets is the number of expired or untracked request ids to remember,
+	// so that late responses to them can be told apart from unsolicited ones.
+	maxLostPackets = 16384
+)
+
+var (
+	// ErrExpiredRequest is returned when a response arrives for a request which
+	// was made, but expired or couldn't be tracked before the response arrived.
+	// Such responses are late rather than forged.
+	ErrExpiredRequest = errors.New("expired request id")
+
+	// errUnknownRequest is returned when a response arrives for a request id
+	// which was never issued or was already answered.
+	errUnknownRequest = errors.New("unknown request id")
+
+	// errMismatchedRequest is returned when a response arrives for a pending
+	// request id that was issued to a different peer or expected another reply.
+	errMismatchedRequest = errors.New("mismatched request id")
 )
 
 // request tracks sent network requests which have not yet received a response.
@@ -67,6 +87,9 @@ type Tracker struct {
 	expire  *list.List          // Linked list tracking the expiration order
 	wake    *time.Timer         // Timer tracking the expiration of the next item
 
+	lost      map[uint64]*request // Requests expired or never tracked, awaiting late responses
+	lostOrder *list.List          // Linked list tracking the order the requests were lost in
+
 	lock sync.Mutex // Lock protecting from concurrent updates
 }
 
@@ -78,15 +101,15 @@ func New(protocol string, timeout time.Duration) *Tracker {
 		timeout:  timeout,
 		pending:  make(map[uint64]*request),
 		expire:   list.New(),
+
+		lost:      make(map[uint64]*request),
+		lostOrder: list.New(),
 	}
 }
 
 // Track adds a network request to the tracker to wait for a response to arrive
 // or until the request it cancelled or times out.
 func (t *Tracker) Track(peer string, version uint, reqCode uint64, resCode uint64, id uint64) {
-	if !metrics.Enabled {
-		return
-	}
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
@@ -97,9 +120,11 @@ func (t *Tracker) Track(peer string, version uint, reqCode uint64, resCode uint6
 		log.Error("Network request id collision", "protocol", t.protocol, "version", version, "code", reqCode, "id", id)
 		return
 	}
-	// If we have too many pending requests, bail out instead of leaking memory
+	// If we have too many pending requests, bail out instead of leaking memory.
+	// The request still went out, so its response is late rather than forged.
 	if pending := len(t.pending); pending >= maxTrackedPackets {
 		log.Error("Request tracker exceeded allowance", "pending", pending, "peer", peer, "protocol", t.protocol, "version", version, "code", reqCode)
+		t.lose(id, &request{peer: peer, version: version, reqCode: reqCode, resCode: resCode})
 		return
 	}
 	// Id doesn't exist yet, start tracking it
@@ -111,9 +136,10 @@ func (t *Tracker) Track(peer string, version uint, reqCode uint64, resCode uint6
 		time:    time.Now(),
 		expire:  t.expire.PushBack(id),
 	}
-	g := fmt.Sprintf("%s/%s/%d/%#02x", trackedGaugeName, t.protocol, version, reqCode)
-	metrics.GetOrRegisterGauge(g, nil).Inc(1)
-
+	if metrics.Enabled {
+		g := fmt.Sprintf("%s/%s/%d/%#02x", trackedGaugeName, t.protocol, version, reqCode)
+		metrics.GetOrRegisterGauge(g, nil).Inc(1)
+	}
 	// If we've just inserted the first item, start the expiration timer
 	if t.wake == nil {
 		t.wake = time.AfterFunc(t.timeout, t.clean)
@@ -141,16 +167,32 @@ func (t *Tracker) clean() {
 		// Nope, dead, drop it
 		t.expire.Remove(head)
 		delete(t.pending, id)
+		t.lose(id, req)
 
-		g := fmt.Sprintf("%s/%s/%d/%#02x", trackedGaugeName, t.protocol, req.version, req.reqCode)
-		metrics.GetOrRegisterGauge(g, nil).Dec(1)
+		if metrics.Enabled {
+			g := fmt.Sprintf("%s/%s/%d/%#02x", trackedGaugeName, t.protocol, req.version, req.reqCode)
+			metrics.GetOrRegisterGauge(g, nil).Dec(1)
 
-		m := fmt.Sprintf("%s/%s/%d/%#02x", lostMeterName, t.protocol, req.version, req.reqCode)
-		metrics.GetOrRegisterMeter(m, nil).Mark(1)
+			m := fmt.Sprintf("%s/%s/%d/%#02x", lostMeterName, t.protocol, req.version, req.reqCode)
+			metrics.GetOrRegisterMeter(m, nil).Mark(1)
+		}
 	}
 	t.schedule()
 }
 
+// lose remembers a request which won't be tracked any longer, evicting the one
+// lost the longest ago if too many are remembered.
+func (t *Tracker) lose(id uint64, req *request) {
+	if _, ok := t.lost[id]; ok {
+		return
+	}
+	if t.lostOrder.Len() >= maxLostPackets {
+		delete(t.lost, t.lostOrder.Remove(t.lostOrder.Front()).(uint64))
+	}
+	req.expire = t.lostOrder.PushBack(id)
+	t.lost[id] = req
+}
+
 // schedule starts a timer to trigger on the expiration of the first network
 // packet.
 func (t *Tracker) schedule() {
@@ -161,20 +203,45 @@ func (t *Tracker) schedule() {
 	t.wake = time.AfterFunc(time.Until(t.pending[t.expire.Front().Value.(uint64)].time.Add(t.timeout)), t.clean)
 }
 
-// Fulfil fills a pending request, if any is available, reporting on various metrics.
-func (t *Tracker) Fulfil(peer string, version uint, code uint64, id uint64) {
-	if !metrics.Enabled {
-		return
+// Oldest returns the id of the longest pending request towards the given peer
+// which expects a response with the given code, if any.
+func (t *Tracker) Oldest(peer string, version uint, code uint64) (uint64, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for elem := t.expire.Front(); elem != nil; elem = elem.Next() {
+		id := elem.Value.(uint64)
+		if req := t.pending[id]; req.peer == peer && req.version == version && req.resCode == code {
+			return id, true
+		}
 	}
+	return 0, false
+}
+
+// Fulfil fills a pending request, if any is available, reporting on various metrics
+// and returning the time it took the peer to respond. An error is returned if the
+// response does not match any request that is still pending towards the given
+// peer. Responses to requests made to the peer which expired or couldn't be
+// tracked fail with ErrExpiredRequest, all the others signal an unsolicited reply.
+func (t *Tracker) Fulfil(peer string, version uint, code uint64, id uint64) (time.Duration, error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
 	// If it's a non existing request, track as stale response
 	req, ok := t.pending[id]
 	if !ok {
-		m := fmt.Sprintf("%s/%s/%d/%#02x", staleMeterName, t.protocol, version, code)
-		metrics.GetOrRegisterMeter(m, nil).Mark(1)
-		return
+		if metrics.Enabled {
+			m := fmt.Sprintf("%s/%s/%d/%#02x", staleMeterName, t.protocol, version, code)
+			metrics.GetOrRegisterMeter(m, nil).Mark(1)
+		}
+		// Late responses to lost requests are only accepted once, from the peer
+		// they were made to
+		if req, ok := t.lost[id]; ok && req.peer == peer && req.version == version && req.resCode == code {
+			t.lostOrder.Remove(req.expire)
+			delete(t.lost, id)
+			return 0, fmt.Errorf("%w: %d", ErrExpiredRequest, id)
+		}
+		return 0, fmt.Errorf("%w: %d", errUnknownRequest, id)
 	}
 	// If the response is funky, it might be some active attack
 	if req.peer != peer || req.version != version || req.resCode != code {
@@ -182,7 +249,7 @@ func (t *Tracker) Fulfil(peer string, version uint, code uint64, id uint64) {
 			"have", fmt.Sprintf("%s:%s/%d:%d", peer, t.protocol, version, code),
 			"want", fmt.Sprintf("%s:%s/%d:%d", peer, t.protocol, req.version, req.resCode),
 		)
-		return
+		return 0, fmt.Errorf("%w: %d", errMismatchedRequest, id)
 	}
 	// Everything matches, mark the request serviced and meter it
 	t.expire.Remove(req.expire)
@@ -192,6 +259,10 @@ func (t *Tracker) Fulfil(peer string, version uint, code uint64, id uint64) {
 			t.schedule()
 		}
 	}
+	elapsed := time.Since(req.time)
+	if !metrics.Enabled {
+		return elapsed, nil
+	}
 	g := fmt.Sprintf("%s/%s/%d/%#02x", trackedGaugeName, t.protocol, req.version, req.reqCode)
 	metrics.GetOrRegisterGauge(g, nil).Dec(1)
 
@@ -201,5 +272,6 @@ func (t *Tracker) Fulfil(peer string, version uint, code uint64, id uint64) {
 			metrics.NewExpDecaySample(1028, 0.015),
 		)
 	}
-	metrics.GetOrRegisterHistogramLazy(h, nil, sampler).Update(time.Since(req.time).Microseconds())
+	metrics.GetOrRegisterHistogramLazy(h, nil, sampler).Update(elapsed.Microseconds())
+	return elapsed, nil
 }
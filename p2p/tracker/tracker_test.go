@@ -0,0 +1,69 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package tracker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Tests that responses to expired requests are told apart from the ones to
+// requests never made, and only accepted once from the peer asked.
+func TestExpiredRequests(t *testing.T) {
+	tr := New("test", 10*time.Millisecond)
+	tr.Track("peer", 66, 0x03, 0x04, 1)
+
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := tr.Fulfil("other", 66, 0x04, 1); !errors.Is(err, errUnknownRequest) {
+		t.Errorf("foreign peer response error mismatch: have %v, want %v", err, errUnknownRequest)
+	}
+	if _, err := tr.Fulfil("peer", 66, 0x04, 1); !errors.Is(err, ErrExpiredRequest) {
+		t.Errorf("late response error mismatch: have %v, want %v", err, ErrExpiredRequest)
+	}
+	if _, err := tr.Fulfil("peer", 66, 0x04, 1); !errors.Is(err, errUnknownRequest) {
+		t.Errorf("duplicate late response error mismatch: have %v, want %v", err, errUnknownRequest)
+	}
+	if _, err := tr.Fulfil("peer", 66, 0x04, 2); !errors.Is(err, errUnknownRequest) {
+		t.Errorf("unsolicited response error mismatch: have %v, want %v", err, errUnknownRequest)
+	}
+}
+
+// Tests that requests which couldn't be tracked for the tracker being full have
+// their responses treated as late, and that the lost requests remembered are
+// bounded.
+func TestUntrackedRequests(t *testing.T) {
+	tr := New("test", time.Hour)
+
+	for id := uint64(0); id < maxTrackedPackets+maxLostPackets+1; id++ {
+		tr.Track("peer", 66, 0x03, 0x04, id)
+	}
+	if len(tr.lost) != maxLostPackets {
+		t.Errorf("lost requests mismatch: have %d, want %d", len(tr.lost), maxLostPackets)
+	}
+	// The first untracked request was forgotten, the last one is remembered
+	if _, err := tr.Fulfil("peer", 66, 0x04, maxTrackedPackets); !errors.Is(err, errUnknownRequest) {
+		t.Errorf("evicted response error mismatch: have %v, want %v", err, errUnknownRequest)
+	}
+	if _, err := tr.Fulfil("peer", 66, 0x04, maxTrackedPackets+maxLostPackets); !errors.Is(err, ErrExpiredRequest) {
+		t.Errorf("untracked response error mismatch: have %v, want %v", err, ErrExpiredRequest)
+	}
+	if _, err := tr.Fulfil("peer", 66, 0x04, 0); err != nil {
+		t.Errorf("tracked response rejected: %v", err)
+	}
+}